@@ -46,6 +46,21 @@ func (a *AST) File() *locerr.Source {
 	return a.Root.Pos().File
 }
 
+// TypeDeclGroups splits type declarations into groups. Declarations connected with 'and' are in
+// the same group. Other declaration makes a group by itself.
+func TypeDeclGroups(decls []*TypeDecl) [][]*TypeDecl {
+	groups := [][]*TypeDecl{}
+	for _, decl := range decls {
+		if len(groups) > 0 && decl.Token.Kind == token.AND {
+			last := len(groups) - 1
+			groups[last] = append(groups[last], decl)
+			continue
+		}
+		groups = append(groups, []*TypeDecl{decl})
+	}
+	return groups
+}
+
 // Expr is an interface for node of GoCaml AST.
 // All nodes have its position and name.
 type Expr interface {
@@ -60,11 +75,13 @@ type Expr interface {
 type Symbol struct {
 	DisplayName string
 	Name        string
+	// Token where the symbol is written in source. It is nil when the symbol was generated by compiler
+	Token *token.Token
 	// Other symbol attributes go here
 }
 
 func NewSymbol(name string) *Symbol {
-	return &Symbol{name, name}
+	return &Symbol{name, name, nil}
 }
 
 var unusedSymCount = 0
@@ -72,7 +89,7 @@ var unusedSymCount = 0
 func IgnoredSymbol() *Symbol {
 	unusedSymCount++
 	s := fmt.Sprintf("$unused%d", unusedSymCount)
-	return &Symbol{"_", s}
+	return &Symbol{"_", s, nil}
 }
 
 func (s *Symbol) IsIgnored() bool {
@@ -89,6 +106,25 @@ type FuncDef struct {
 	Params  []Param
 	Body    Expr
 	RetType Expr
+	// Explicit polymorphic type annotation of the function. Maybe nil.
+	//   let rec f : 'a. 'a -> int = fun x -> ...
+	Poly *ForallType
+}
+
+// VariantArm is an arm of 'match' expression for polymorphic variants.
+//   `Foo x -> body   (Tag is "Foo" and Ident is x)
+//   `Bar -> body     (Tag is "Bar" and Ident is nil)
+//   x -> body        (Default arm. Tag is empty and Ident is bound to the matched value)
+type VariantArm struct {
+	Token *token.Token
+	Tag   string
+	Ident *Symbol
+	Body  Expr
+}
+
+// IsDefault returns whether the arm matches to any tag
+func (a *VariantArm) IsDefault() bool {
+	return a.Tag == ""
 }
 
 func (d *FuncDef) ParamSymbols() []*Symbol {
@@ -282,6 +318,37 @@ type (
 	None struct {
 		Token *token.Token
 	}
+	Ok struct {
+		StartToken *token.Token
+		Child      Expr
+	}
+	Error struct {
+		StartToken *token.Token
+		Child      Expr
+	}
+	// 'match' expression for result values
+	//   match r with Ok x -> e1 | Error y -> e2
+	MatchResult struct {
+		StartToken          *token.Token
+		Target              Expr
+		IfOk, IfError       Expr
+		OkIdent, ErrorIdent *Symbol
+		EndPos              locerr.Pos
+	}
+
+	// Polymorphic variant value such as `Foo or `Foo 42
+	Variant struct {
+		TagToken *token.Token
+		Tag      string
+		Payload  Expr // Maybe nil
+	}
+
+	// 'match' expression for polymorphic variants
+	MatchVariant struct {
+		StartToken *token.Token
+		Target     Expr
+		Arms       []*VariantArm
+	}
 
 	ArrayLit struct {
 		StartToken *token.Token
@@ -289,6 +356,38 @@ type (
 		Elems      []Expr
 	}
 
+	// Typed hole such as ?foo. It is a placeholder for an expression not written yet.
+	Hole struct {
+		Token *token.Token
+		Ident string
+		// Symbols visible at the hole. It is set by alpha transform.
+		Scope []*Symbol
+	}
+
+	// 'assert' expression. It checks the condition at runtime and aborts the program with the
+	// location when the condition is false.
+	Assert struct {
+		Token *token.Token
+		Cond  Expr
+	}
+
+	// 'break' and 'continue' in body of 'for' loop. Jump is the expression to jump out of the loop
+	// or to the next iteration. It is set when parser desugars the enclosing loop.
+	Break struct {
+		Token *token.Token
+		Jump  Expr
+	}
+	Continue struct {
+		Token *token.Token
+		Jump  Expr
+	}
+	// Jump to the beginning of the function of enclosing 'for' loop with new arguments. Parser
+	// desugars 'break' and 'continue' into it. Token is 'break' or 'continue' token.
+	LoopJump struct {
+		Token *token.Token
+		Args  []Expr
+	}
+
 	FuncType struct {
 		ParamTypes []Expr
 		RetType    Expr
@@ -306,15 +405,47 @@ type (
 		Ctor       *Symbol
 	}
 
+	// Tag in closed variant type. When Payload is nil, the tag has no payload.
+	//   `Foo of int
+	VariantTagType struct {
+		Token   *token.Token
+		Tag     string
+		Payload Expr
+	}
+
+	// [`Foo of int | `Bar]
+	VariantType struct {
+		StartToken *token.Token
+		EndToken   *token.Token
+		Tags       []*VariantTagType
+	}
+
+	// 'a in type annotation
+	TypeVar struct {
+		Token *token.Token
+		Ident *Symbol
+	}
+
+	// forall 'a 'b. t
+	ForallType struct {
+		StartToken *token.Token
+		Vars       []*TypeVar
+		Body       Expr
+	}
+
 	Typed struct {
 		Child Expr
 		Type  Expr
 	}
 
+	// TypeDecl is a declaration of type alias. Token is 'and' when the declaration follows the
+	// previous one in the same group like 'type t = ... and u = ...'.
 	TypeDecl struct {
 		Token *token.Token
 		Ident *Symbol
 		Type  Expr
+		// Tokens of names in [@@deriving ...] attribute. Nil when the attribute is omitted.
+		Deriving []*token.Token
 	}
 
 	External struct {
@@ -602,6 +733,44 @@ func (e *None) End() locerr.Pos {
 	return e.Token.End
 }
 
+func (e *Ok) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *Ok) End() locerr.Pos {
+	return e.Child.End()
+}
+
+func (e *Error) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *Error) End() locerr.Pos {
+	return e.Child.End()
+}
+
+func (e *MatchResult) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *MatchResult) End() locerr.Pos {
+	return e.EndPos
+}
+
+func (e *Variant) Pos() locerr.Pos {
+	return e.TagToken.Start
+}
+func (e *Variant) End() locerr.Pos {
+	if e.Payload == nil {
+		return e.TagToken.End
+	}
+	return e.Payload.End()
+}
+
+func (e *MatchVariant) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *MatchVariant) End() locerr.Pos {
+	return e.Arms[len(e.Arms)-1].Body.End()
+}
+
 func (e *ArrayLit) Pos() locerr.Pos {
 	return e.StartToken.Start
 }
@@ -609,6 +778,41 @@ func (e *ArrayLit) End() locerr.Pos {
 	return e.EndToken.End
 }
 
+func (e *Hole) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *Hole) End() locerr.Pos {
+	return e.Token.End
+}
+
+func (e *Assert) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *Assert) End() locerr.Pos {
+	return e.Cond.End()
+}
+
+func (e *Break) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *Break) End() locerr.Pos {
+	return e.Token.End
+}
+
+func (e *Continue) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *Continue) End() locerr.Pos {
+	return e.Token.End
+}
+
+func (e *LoopJump) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *LoopJump) End() locerr.Pos {
+	return e.Token.End
+}
+
 func (e *FuncType) Pos() locerr.Pos {
 	return e.ParamTypes[0].Pos()
 }
@@ -640,6 +844,27 @@ func (e *CtorType) End() locerr.Pos {
 	return e.EndToken.End
 }
 
+func (e *VariantType) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *VariantType) End() locerr.Pos {
+	return e.EndToken.End
+}
+
+func (e *TypeVar) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *TypeVar) End() locerr.Pos {
+	return e.Token.End
+}
+
+func (e *ForallType) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *ForallType) End() locerr.Pos {
+	return e.Body.End()
+}
+
 func (e *Typed) Pos() locerr.Pos {
 	return e.Child.Pos()
 }
@@ -712,7 +937,29 @@ func (e *ArrayPut) Name() string  { return "ArrayPut" }
 func (e *Match) Name() string     { return fmt.Sprintf("Match (%s)", e.SomeIdent.DisplayName) }
 func (e *Some) Name() string      { return "Some" }
 func (e *None) Name() string      { return "None" }
+func (e *Ok) Name() string        { return "Ok" }
+func (e *Error) Name() string     { return "Error" }
+func (e *Variant) Name() string   { return fmt.Sprintf("Variant (`%s)", e.Tag) }
+func (e *MatchResult) Name() string {
+	return fmt.Sprintf("MatchResult (%s, %s)", e.OkIdent.DisplayName, e.ErrorIdent.DisplayName)
+}
+func (e *MatchVariant) Name() string {
+	tags := make([]string, 0, len(e.Arms))
+	for _, a := range e.Arms {
+		if a.IsDefault() {
+			tags = append(tags, "_")
+		} else {
+			tags = append(tags, "`"+a.Tag)
+		}
+	}
+	return fmt.Sprintf("MatchVariant (%s)", strings.Join(tags, " | "))
+}
 func (e *ArrayLit) Name() string  { return fmt.Sprintf("ArrayLit (%d)", len(e.Elems)) }
+func (e *Hole) Name() string      { return fmt.Sprintf("Hole (?%s)", e.Ident) }
+func (e *Assert) Name() string    { return "Assert" }
+func (e *Break) Name() string     { return "Break" }
+func (e *Continue) Name() string  { return "Continue" }
+func (e *LoopJump) Name() string  { return fmt.Sprintf("LoopJump (%s)", e.Token.Value()) }
 func (e *FuncType) Name() string  { return "FuncType" }
 func (e *TupleType) Name() string { return fmt.Sprintf("TupleType (%d)", len(e.ElemTypes)) }
 func (e *CtorType) Name() string {
@@ -722,6 +969,30 @@ func (e *CtorType) Name() string {
 	}
 	return fmt.Sprintf("CtorType (%s (%d))", e.Ctor.Name, len)
 }
-func (e *Typed) Name() string    { return "Typed" }
-func (e *TypeDecl) Name() string { return fmt.Sprintf("TypeDecl (%s)", e.Ident.Name) }
+func (e *VariantType) Name() string {
+	tags := make([]string, 0, len(e.Tags))
+	for _, t := range e.Tags {
+		tags = append(tags, "`"+t.Tag)
+	}
+	return fmt.Sprintf("VariantType (%s)", strings.Join(tags, " | "))
+}
+func (e *TypeVar) Name() string { return fmt.Sprintf("TypeVar (%s)", e.Ident.Name) }
+func (e *ForallType) Name() string {
+	vars := make([]string, 0, len(e.Vars))
+	for _, v := range e.Vars {
+		vars = append(vars, v.Ident.Name)
+	}
+	return fmt.Sprintf("ForallType (%s)", strings.Join(vars, " "))
+}
+func (e *Typed) Name() string { return "Typed" }
+func (e *TypeDecl) Name() string {
+	if len(e.Deriving) == 0 {
+		return fmt.Sprintf("TypeDecl (%s)", e.Ident.Name)
+	}
+	names := make([]string, 0, len(e.Deriving))
+	for _, t := range e.Deriving {
+		names = append(names, t.Value())
+	}
+	return fmt.Sprintf("TypeDecl (%s) [@@deriving %s]", e.Ident.Name, strings.Join(names, ", "))
+}
 func (e *External) Name() string { return fmt.Sprintf("External (%s => %s)", e.Ident.Name, e.C) }
@@ -0,0 +1,24 @@
+package ast
+
+import (
+	"strings"
+)
+
+// NodeID identifies a node by its kind and its range in source. Unlike pointer identity, it is kept
+// even if the AST is rewritten as long as the positions of the nodes are preserved.
+// Note that nodes generated by compiler (e.g. functions derived from [@@deriving]) may share the
+// same ID because they have the same position.
+type NodeID struct {
+	Kind  string
+	Start int
+	End   int
+}
+
+// IDOf returns the ID of the node.
+func IDOf(e Expr) NodeID {
+	kind := e.Name()
+	if i := strings.IndexByte(kind, ' '); i >= 0 {
+		kind = kind[:i]
+	}
+	return NodeID{kind, e.Pos().Offset, e.End().Offset}
+}
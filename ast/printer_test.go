@@ -161,6 +161,7 @@ func TestPrintAST(t *testing.T) {
 						nil,
 						NewSymbol("int"),
 					},
+					nil,
 				},
 				&If{
 					tok,
@@ -245,6 +246,7 @@ func TestPrintAST(t *testing.T) {
 					nil,
 					NewSymbol("bool"),
 				},
+				nil,
 			},
 		},
 		Externals: []*External{
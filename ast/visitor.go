@@ -89,6 +89,9 @@ func Visit(vis Visitor, e Expr) {
 		Visit(v, n.Bound)
 		Visit(v, n.Body)
 	case *LetRec:
+		if n.Func.Poly != nil {
+			Visit(v, n.Func.Poly)
+		}
 		for _, p := range n.Func.Params {
 			if p.Type != nil {
 				Visit(v, p.Type)
@@ -132,6 +135,37 @@ func Visit(vis Visitor, e Expr) {
 		Visit(v, n.IfNone)
 	case *Some:
 		Visit(v, n.Child)
+	case *Assert:
+		Visit(v, n.Cond)
+	case *Break:
+		if n.Jump != nil {
+			Visit(v, n.Jump)
+		}
+	case *Continue:
+		if n.Jump != nil {
+			Visit(v, n.Jump)
+		}
+	case *LoopJump:
+		for _, a := range n.Args {
+			Visit(v, a)
+		}
+	case *Ok:
+		Visit(v, n.Child)
+	case *Error:
+		Visit(v, n.Child)
+	case *MatchResult:
+		Visit(v, n.Target)
+		Visit(v, n.IfOk)
+		Visit(v, n.IfError)
+	case *Variant:
+		if n.Payload != nil {
+			Visit(v, n.Payload)
+		}
+	case *MatchVariant:
+		Visit(v, n.Target)
+		for _, a := range n.Arms {
+			Visit(v, a.Body)
+		}
 	case *ArrayLit:
 		for _, e := range n.Elems {
 			Visit(v, e)
@@ -149,6 +183,17 @@ func Visit(vis Visitor, e Expr) {
 		for _, e := range n.ParamTypes {
 			Visit(v, e)
 		}
+	case *VariantType:
+		for _, t := range n.Tags {
+			if t.Payload != nil {
+				Visit(v, t.Payload)
+			}
+		}
+	case *ForallType:
+		for _, tv := range n.Vars {
+			Visit(v, tv)
+		}
+		Visit(v, n.Body)
 	case *Typed:
 		Visit(v, n.Child)
 		Visit(v, n.Type)
@@ -0,0 +1,115 @@
+package cfg
+
+// Note:
+// Dominators are computed with the iterative algorithm described in 'A Simple, Fast Dominance
+// Algorithm' (Cooper, Harvey and Kennedy). Nodes are visited in reverse postorder until immediate
+// dominators converge. Dominance frontiers are computed from immediate dominators by walking up
+// the dominator tree from predecessors of each join node.
+
+func intersect(a, b *Node, idoms []*Node) *Node {
+	for a != b {
+		for a.order > b.order {
+			a = idoms[a.order]
+		}
+		for b.order > a.order {
+			b = idoms[b.order]
+		}
+	}
+	return a
+}
+
+func (g *Graph) computeDominators() {
+	idoms := make([]*Node, len(g.Nodes))
+	idoms[0] = g.Entry
+
+	for changed := true; changed; {
+		changed = false
+		for _, n := range g.Nodes[1:] {
+			var idom *Node
+			for _, p := range n.Preds {
+				if !p.Reachable() || idoms[p.order] == nil {
+					// Not processed yet
+					continue
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = intersect(p, idom, idoms)
+				}
+			}
+			if idoms[n.order] != idom {
+				idoms[n.order] = idom
+				changed = true
+			}
+		}
+	}
+
+	for _, n := range g.Nodes[1:] {
+		idom := idoms[n.order]
+		n.Idom = idom
+		idom.Dominated = append(idom.Dominated, n)
+	}
+
+	for _, n := range g.Nodes {
+		preds := 0
+		for _, p := range n.Preds {
+			if p.Reachable() {
+				preds++
+			}
+		}
+		if n == g.Entry && preds > 0 {
+			// Entry node has an implicit predecessor which enters the function
+			preds++
+		}
+		if preds < 2 {
+			continue
+		}
+		for _, p := range n.Preds {
+			if !p.Reachable() {
+				continue
+			}
+			for r := p; r != n.Idom; r = r.Idom {
+				r.addFrontier(n)
+			}
+		}
+	}
+}
+
+func (n *Node) addFrontier(f *Node) {
+	for _, x := range n.Frontier {
+		if x == f {
+			return
+		}
+	}
+	n.Frontier = append(n.Frontier, f)
+}
+
+// Dominates returns whether the node dominates the other node. Every node dominates itself.
+// Unreachable nodes are not dominated by any node.
+func (n *Node) Dominates(other *Node) bool {
+	if !n.Reachable() || !other.Reachable() {
+		return false
+	}
+	for d := other; d != nil; d = d.Idom {
+		if d == n {
+			return true
+		}
+	}
+	return false
+}
+
+// StrictlyDominates returns whether the node dominates the other node and they are different.
+func (n *Node) StrictlyDominates(other *Node) bool {
+	return n != other && n.Dominates(other)
+}
+
+// IsLoopHeader returns whether the node is a target of back edge. In MIR, only the entry node of a
+// function containing 'jump' can be a loop header.
+func (n *Node) IsLoopHeader() bool {
+	for _, p := range n.Preds {
+		if n.Dominates(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package cfg
+
+import (
+	"testing"
+)
+
+func TestDominates(t *testing.T) {
+	b := parseEntry(t, `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = if $k1 ; type=int
+    BEGIN: then
+    $k4 = int 1 ; type=int
+    END: then
+    BEGIN: else
+    $k5 = int 2 ; type=int
+    END: else
+  $k6 = unary - $k3 ; type=int
+  END: then
+  BEGIN: else
+  $k7 = int 3 ; type=int
+  END: else
+$k8 = binary + $k2 $k2 ; type=int
+END: program
+`)
+	g := Build(b)
+	node := func(ident string) *Node {
+		return g.NodeOf(findInsn(b, ident))
+	}
+
+	cases := []struct {
+		dom, target string
+		expected    bool
+	}{
+		{"$k1", "$k8", true},
+		{"$k1", "$k4", true},
+		{"$k3", "$k6", true},
+		{"$k3", "$k4", true},
+		{"$k4", "$k6", false},
+		{"$k6", "$k8", false},
+		{"$k7", "$k8", false},
+		{"$k8", "$k1", false},
+		{"$k6", "$k6", true},
+	}
+	for _, tc := range cases {
+		if actual := node(tc.dom).Dominates(node(tc.target)); actual != tc.expected {
+			t.Errorf("Node of '%s' dominates node of '%s' should be %v but got %v", tc.dom, tc.target, tc.expected, actual)
+		}
+	}
+
+	if node("$k6").StrictlyDominates(node("$k6")) {
+		t.Error("Node should not strictly dominate itself")
+	}
+	if !g.Entry.StrictlyDominates(node("$k6")) {
+		t.Error("Entry should strictly dominate other nodes")
+	}
+
+	dominated := map[int]bool{}
+	for _, n := range g.Entry.Dominated {
+		dominated[n.ID] = true
+	}
+	if len(dominated) != 3 || !dominated[node("$k3").ID] || !dominated[node("$k7").ID] || !dominated[node("$k8").ID] {
+		t.Errorf("Unexpected children of entry in dominator tree: %v", g.Entry.Dominated)
+	}
+}
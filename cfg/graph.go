@@ -0,0 +1,240 @@
+// Package cfg provides a control flow graph view over MIR blocks and dominator analysis on it.
+//
+// MIR represents control flow structurally. A block may contain 'if' instructions which have their
+// own nested blocks, and 'jump' instructions go back to the beginning of the function. The graph
+// splits MIR blocks into basic blocks (nodes) which are executed sequentially without branching.
+//
+//   $k1 = binary < a$t1 b$t2
+//   $k2 = if $k1
+//     BEGIN: then
+//     $k3 = int 1
+//     END: then
+//     BEGIN: else
+//     $k4 = int 2
+//     END: else
+//   $k5 = binary + $k2 $k2
+//
+// is represented as below. Node #0 ends with the 'if' instruction and node #3 is the join point of
+// the branches. Its value $k2 is a merged value of the branches.
+//
+//   #0 [$k1, $k2] -> #1, #2
+//   #1 [$k3]      -> #3
+//   #2 [$k4]      -> #3
+//   #3 [$k5]
+//
+// The graph does not copy or modify instructions. Each node refers to a range of instructions in
+// the MIR block.
+package cfg
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"io"
+	"strings"
+)
+
+// Node is a basic block in control flow graph. It represents a range [Begin, End) of instructions
+// in a MIR block. The range may be empty when the node is a join point of 'if' at the end of block.
+type Node struct {
+	// ID is unique in the graph. Nodes are numbered in the order of creation.
+	ID    int
+	Block *mir.Block
+	Begin *mir.Insn
+	End   *mir.Insn
+	Preds []*Node
+	Succs []*Node
+	// Immediate dominator of the node. It is nil for the entry node and unreachable nodes.
+	Idom *Node
+	// Nodes immediately dominated by the node (children in dominator tree)
+	Dominated []*Node
+	// Dominance frontier of the node
+	Frontier []*Node
+	// Index in reverse postorder. -1 when the node is unreachable from the entry.
+	order int
+}
+
+// Reachable returns whether the node is reachable from the entry node.
+func (n *Node) Reachable() bool {
+	return n.order >= 0
+}
+
+// Insns returns instructions in the node.
+func (n *Node) Insns() []*mir.Insn {
+	insns := []*mir.Insn{}
+	for i := n.Begin; i != n.End; i = i.Next {
+		insns = append(insns, i)
+	}
+	return insns
+}
+
+// Last returns the last instruction of the node. It returns nil when the node is empty.
+func (n *Node) Last() *mir.Insn {
+	if n.Begin == n.End {
+		return nil
+	}
+	return n.End.Prev
+}
+
+func (n *Node) String() string {
+	idents := []string{}
+	for _, i := range n.Insns() {
+		idents = append(idents, i.Ident)
+	}
+	return fmt.Sprintf("#%d [%s]", n.ID, strings.Join(idents, ", "))
+}
+
+// Graph is a control flow graph of a function body or the entry block of program.
+type Graph struct {
+	Entry *Node
+	// Nodes reachable from the entry node in reverse postorder. The first node is the entry.
+	Nodes []*Node
+	// Nodes whose execution returns from the function
+	Exits []*Node
+	// All nodes including unreachable ones in the order of creation
+	all    []*Node
+	nodeOf map[*mir.Insn]*Node
+	// Values assigned at the end of nodes. Last node of each branch of 'if' assigns the value of
+	// the branch to the 'if' instruction.
+	defs map[*Node][]def
+}
+
+type def struct {
+	name  string
+	ident string
+}
+
+// NodeOf returns the node containing the instruction. It returns nil when the instruction is not in
+// the graph.
+func (g *Graph) NodeOf(insn *mir.Insn) *Node {
+	return g.nodeOf[insn]
+}
+
+// Dump outputs all nodes in the order of creation with their edges and dominators for debugging.
+func (g *Graph) Dump(out io.Writer) {
+	names := func(ns []*Node) string {
+		ss := make([]string, 0, len(ns))
+		for _, n := range ns {
+			ss = append(ss, fmt.Sprintf("#%d", n.ID))
+		}
+		return strings.Join(ss, ",")
+	}
+	for _, n := range g.all {
+		idom := "-"
+		if n.Idom != nil {
+			idom = fmt.Sprintf("#%d", n.Idom.ID)
+		}
+		reachable := ""
+		if !n.Reachable() {
+			reachable = " (unreachable)"
+		}
+		fmt.Fprintf(out, "%s%s preds=(%s) succs=(%s) idom=%s frontier=(%s)\n", n.String(), reachable, names(n.Preds), names(n.Succs), idom, names(n.Frontier))
+	}
+}
+
+type builder struct {
+	graph *Graph
+}
+
+func (b *builder) newNode(block *mir.Block, begin *mir.Insn) *Node {
+	n := &Node{len(b.graph.all), block, begin, block.Bottom, nil, nil, nil, nil, nil, -1}
+	b.graph.all = append(b.graph.all, n)
+	return n
+}
+
+func connect(from, to *Node) {
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// block builds nodes for the block and returns nodes whose control reaches the end of the block.
+func (b *builder) block(blk *mir.Block, preds []*Node) []*Node {
+	n := b.newNode(blk, blk.Top.Next)
+	if b.graph.Entry == nil {
+		b.graph.Entry = n
+	}
+	for _, p := range preds {
+		connect(p, n)
+	}
+
+	for i, end := blk.WholeRange(); i != end; i = i.Next {
+		b.graph.nodeOf[i] = n
+		switch val := i.Val.(type) {
+		case *mir.If:
+			n.End = i.Next
+			exits := b.branch(i.Ident, val.Then, n)
+			exits = append(exits, b.branch(i.Ident, val.Else, n)...)
+			join := b.newNode(blk, i.Next)
+			for _, e := range exits {
+				connect(e, join)
+			}
+			n = join
+		case *mir.Jump:
+			// 'jump' is always the last instruction of block and goes back to the beginning of function
+			n.End = i.Next
+			connect(n, b.graph.Entry)
+			return nil
+		}
+	}
+
+	return []*Node{n}
+}
+
+func (b *builder) branch(name string, blk *mir.Block, from *Node) []*Node {
+	exits := b.block(blk, []*Node{from})
+	for _, e := range exits {
+		b.graph.defs[e] = append(b.graph.defs[e], def{name, blk.Bottom.Prev.Ident})
+	}
+	return exits
+}
+
+// order numbers nodes reachable from the entry in reverse postorder
+func (g *Graph) order() {
+	visited := map[*Node]bool{}
+	postorder := make([]*Node, 0, len(g.all))
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		visited[n] = true
+		for _, s := range n.Succs {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		postorder = append(postorder, n)
+	}
+	visit(g.Entry)
+
+	g.Nodes = make([]*Node, 0, len(postorder))
+	for i := len(postorder) - 1; i >= 0; i-- {
+		n := postorder[i]
+		n.order = len(g.Nodes)
+		g.Nodes = append(g.Nodes, n)
+	}
+}
+
+// Build creates a control flow graph of the block and computes dominators of its nodes. The block
+// should be a body of function or the entry block of program since 'jump' instructions in it are
+// connected to the entry node.
+func Build(block *mir.Block) *Graph {
+	g := &Graph{nodeOf: map[*mir.Insn]*Node{}, defs: map[*Node][]def{}}
+	b := &builder{g}
+	exits := b.block(block, nil)
+	g.order()
+	g.computeDominators()
+	for _, e := range exits {
+		if e.Reachable() {
+			g.Exits = append(g.Exits, e)
+		}
+	}
+	return g
+}
+
+// BuildProgram creates control flow graphs of all toplevel functions and the entry block of the
+// program. The graph of the entry block is mapped to empty name.
+func BuildProgram(prog *mir.Program) map[string]*Graph {
+	graphs := make(map[string]*Graph, len(prog.Toplevel)+1)
+	for name, f := range prog.Toplevel {
+		graphs[name] = Build(f.Val.Body)
+	}
+	graphs[""] = Build(prog.Entry)
+	return graphs
+}
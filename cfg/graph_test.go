@@ -0,0 +1,296 @@
+package cfg
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func parseProgram(t *testing.T, code string) *mir.Program {
+	prog, _, err := mir.Parse(locerr.NewDummySource(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+func parseEntry(t *testing.T, block string) *mir.Block {
+	return parseProgram(t, "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\n"+block).Entry
+}
+
+func findInsn(b *mir.Block, ident string) *mir.Insn {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		if i.Ident == ident {
+			return i
+		}
+		if v, ok := i.Val.(*mir.If); ok {
+			if found := findInsn(v.Then, ident); found != nil {
+				return found
+			}
+			if found := findInsn(v.Else, ident); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func dumpGraph(g *Graph) string {
+	var buf bytes.Buffer
+	g.Dump(&buf)
+	return buf.String()
+}
+
+func TestBuildStraightLine(t *testing.T) {
+	b := parseEntry(t, `
+BEGIN: program
+$k1 = int 1 ; type=int
+$k2 = binary + $k1 $k1 ; type=int
+END: program
+`)
+	g := Build(b)
+	if len(g.Nodes) != 1 {
+		t.Fatalf("Only one node should be created: %s", dumpGraph(g))
+	}
+	n := g.Entry
+	if n.String() != "#0 [$k1, $k2]" {
+		t.Errorf("Unexpected node %s", n.String())
+	}
+	if len(g.Exits) != 1 || g.Exits[0] != n {
+		t.Errorf("Entry should be the exit: %v", g.Exits)
+	}
+	if n.Last() != b.Bottom.Prev {
+		t.Errorf("Last instruction should be '$k2' but got %v", n.Last())
+	}
+}
+
+func TestBuildBranches(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what: "diamond",
+			code: `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = int 1 ; type=int
+  END: then
+  BEGIN: else
+  $k4 = int 2 ; type=int
+  END: else
+$k5 = binary + $k2 $k2 ; type=int
+END: program
+`,
+			expected: `#0 [$k1, $k2] preds=() succs=(#1,#2) idom=- frontier=()
+#1 [$k3] preds=(#0) succs=(#3) idom=#0 frontier=(#3)
+#2 [$k4] preds=(#0) succs=(#3) idom=#0 frontier=(#3)
+#3 [$k5] preds=(#1,#2) succs=() idom=#0 frontier=()
+`,
+		},
+		{
+			what: "if at end of block",
+			code: `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = int 1 ; type=int
+  END: then
+  BEGIN: else
+  $k4 = int 2 ; type=int
+  END: else
+END: program
+`,
+			expected: `#0 [$k1, $k2] preds=() succs=(#1,#2) idom=- frontier=()
+#1 [$k3] preds=(#0) succs=(#3) idom=#0 frontier=(#3)
+#2 [$k4] preds=(#0) succs=(#3) idom=#0 frontier=(#3)
+#3 [] preds=(#1,#2) succs=() idom=#0 frontier=()
+`,
+		},
+		{
+			what: "nested if",
+			code: `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = if $k1 ; type=int
+    BEGIN: then
+    $k4 = int 1 ; type=int
+    END: then
+    BEGIN: else
+    $k5 = int 2 ; type=int
+    END: else
+  $k6 = unary - $k3 ; type=int
+  END: then
+  BEGIN: else
+  $k7 = int 3 ; type=int
+  END: else
+$k8 = binary + $k2 $k2 ; type=int
+END: program
+`,
+			expected: `#0 [$k1, $k2] preds=() succs=(#1,#5) idom=- frontier=()
+#1 [$k3] preds=(#0) succs=(#2,#3) idom=#0 frontier=(#6)
+#2 [$k4] preds=(#1) succs=(#4) idom=#1 frontier=(#4)
+#3 [$k5] preds=(#1) succs=(#4) idom=#1 frontier=(#4)
+#4 [$k6] preds=(#2,#3) succs=(#6) idom=#1 frontier=(#6)
+#5 [$k7] preds=(#0) succs=(#6) idom=#0 frontier=(#6)
+#6 [$k8] preds=(#4,#5) succs=() idom=#0 frontier=()
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			g := Build(parseEntry(t, tc.code))
+			if actual := dumpGraph(g); actual != tc.expected {
+				t.Fatalf("Unexpected graph. Wanted:\n%s\nbut got:\n%s", tc.expected, actual)
+			}
+			last := g.all[len(g.all)-1]
+			if len(g.Exits) != 1 || g.Exits[0] != last {
+				t.Errorf("Exit should be the last join node %s but got %v", last, g.Exits)
+			}
+		})
+	}
+}
+
+const loopProgram = `[TOPLEVELS (1)]
+sum$t1 = recfun n$t2,acc$t3 ; type=int -> int -> int
+  BEGIN: body (sum$t1)
+  $k2 = int 0 ; type=int
+  $k3 = binary = n$t2 $k2 ; type=bool
+  $k12 = if $k3 ; type=int
+    BEGIN: then
+    $k4 = ref acc$t3 ; type=int
+    END: then
+    BEGIN: else
+    $k6 = int 1 ; type=int
+    $k7 = binary - n$t2 $k6 ; type=int
+    $k10 = binary + acc$t3 n$t2 ; type=int
+    $k11 = jump $k7,$k10 ; type=int
+    END: else
+  END: body (sum$t1)
+
+[CLOSURES (0)]
+
+[ENTRY]
+BEGIN: program
+$k13 = int 10 ; type=int
+$k14 = app sum$t1 $k13,$k13 ; type=int
+END: program
+`
+
+func TestBuildLoop(t *testing.T) {
+	prog := parseProgram(t, loopProgram)
+	graphs := BuildProgram(prog)
+	if len(graphs) != 2 {
+		t.Fatalf("Graphs for a function and entry should be built: %v", graphs)
+	}
+
+	g := graphs["sum$t1"]
+	expected := `#0 [$k2, $k3, $k12] preds=(#2) succs=(#1,#2) idom=- frontier=(#0)
+#1 [$k4] preds=(#0) succs=(#3) idom=#0 frontier=()
+#2 [$k6, $k7, $k10, $k11] preds=(#0) succs=(#0) idom=#0 frontier=(#0)
+#3 [] preds=(#1) succs=() idom=#1 frontier=()
+`
+	if actual := dumpGraph(g); actual != expected {
+		t.Fatalf("Unexpected graph. Wanted:\n%s\nbut got:\n%s", expected, actual)
+	}
+	if !g.Entry.IsLoopHeader() {
+		t.Error("Entry node should be a loop header")
+	}
+	for _, n := range g.Nodes[1:] {
+		if n.IsLoopHeader() {
+			t.Errorf("%s should not be a loop header", n)
+		}
+	}
+	if len(g.Exits) != 1 || g.Exits[0].ID != 3 {
+		t.Errorf("Exit should be the join node: %v", g.Exits)
+	}
+
+	if graphs[""].Entry.IsLoopHeader() {
+		t.Error("Entry of program should not be a loop header")
+	}
+}
+
+func TestUnreachableNode(t *testing.T) {
+	prog := parseProgram(t, `[TOPLEVELS (1)]
+f$t1 = fun n$t2 ; type=int -> int
+  BEGIN: body (f$t1)
+  $k1 = bool true ; type=bool
+  $k2 = if $k1 ; type=int
+    BEGIN: then
+    $k3 = jump n$t2 ; type=int
+    END: then
+    BEGIN: else
+    $k4 = jump n$t2 ; type=int
+    END: else
+  $k5 = int 1 ; type=int
+  END: body (f$t1)
+
+[CLOSURES (0)]
+
+[ENTRY]
+BEGIN: program
+$k6 = unit ; type=unit
+END: program
+`)
+	body := prog.Toplevel["f$t1"].Val.Body
+	g := Build(body)
+
+	n := g.NodeOf(findInsn(body, "$k5"))
+	if n == nil {
+		t.Fatal("Node for '$k5' not found")
+	}
+	if n.Reachable() {
+		t.Errorf("%s should be unreachable", n)
+	}
+	if g.Entry.Dominates(n) {
+		t.Errorf("Unreachable node should not be dominated by entry")
+	}
+	if len(g.Exits) != 0 {
+		t.Errorf("Function never returns but exits are %v", g.Exits)
+	}
+	if len(g.Nodes) != 3 {
+		t.Errorf("Unreachable node should not be in nodes: %v", g.Nodes)
+	}
+	if !strings.Contains(dumpGraph(g), "#3 [$k5] (unreachable)") {
+		t.Errorf("Unreachable node is not dumped: %s", dumpGraph(g))
+	}
+}
+
+func TestNodeOf(t *testing.T) {
+	b := parseEntry(t, `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = int 1 ; type=int
+  END: then
+  BEGIN: else
+  $k4 = int 2 ; type=int
+  END: else
+$k5 = binary + $k2 $k2 ; type=int
+END: program
+`)
+	g := Build(b)
+	for ident, id := range map[string]int{"$k1": 0, "$k2": 0, "$k3": 1, "$k4": 2, "$k5": 3} {
+		n := g.NodeOf(findInsn(b, ident))
+		if n == nil {
+			t.Errorf("Node of '%s' not found", ident)
+			continue
+		}
+		if n.ID != id {
+			t.Errorf("'%s' should be in #%d but got %s", ident, id, n)
+		}
+	}
+	if g.NodeOf(mir.NewInsn("$k42", mir.UnitVal, locerr.Pos{})) != nil {
+		t.Errorf("Node should not be found for instruction outside the graph")
+	}
+}
@@ -0,0 +1,244 @@
+package cfg
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"io"
+	"strings"
+)
+
+// Note:
+// Every identifier in MIR is defined exactly once. But values are merged implicitly at two kinds of
+// places. One is a join point of 'if' where the value of 'if' instruction comes from one of its
+// branches. Another is the entry of a function containing 'jump' where parameters come from the
+// caller or from arguments of 'jump'. SSA construction makes these merges explicit as phi nodes.
+//   $k2 = if $k1
+//     BEGIN: then
+//     $k3 = int 1
+//     END: then
+//     BEGIN: else
+//     $k4 = int 2
+//     END: else
+// has the phi node below at the join node.
+//   $k2 = phi [#1: $k3] [#2: $k4]
+//
+// Phi nodes are placed at iterated dominance frontiers of nodes assigning values (Cytron et al.).
+// Then their arguments are filled by walking the dominator tree with stacks of reaching values.
+// A phi node is pruned when its value is not defined on some incoming edge since MIR never uses an
+// identifier outside its scope.
+
+// PhiArg is an incoming value of phi node.
+type PhiArg struct {
+	// Predecessor node which the value comes from. It is nil for the value passed by the caller of
+	// the function.
+	Pred  *Node
+	Ident string
+}
+
+func (a PhiArg) String() string {
+	if a.Pred == nil {
+		return fmt.Sprintf("[caller: %s]", a.Ident)
+	}
+	return fmt.Sprintf("[#%d: %s]", a.Pred.ID, a.Ident)
+}
+
+// Phi is a value merged at the beginning of node. Its identifier is an 'if' instruction or a
+// parameter of function.
+type Phi struct {
+	Ident string
+	Node  *Node
+	// Incoming values in the order of predecessors of the node. The value from the caller comes
+	// first for a parameter merged at the entry node.
+	Args []PhiArg
+}
+
+func (p *Phi) String() string {
+	args := make([]string, 0, len(p.Args))
+	for _, a := range p.Args {
+		args = append(args, a.String())
+	}
+	return fmt.Sprintf("%s = phi %s", p.Ident, strings.Join(args, " "))
+}
+
+// SSA is a control flow graph with explicit phi nodes.
+type SSA struct {
+	Graph *Graph
+	// Phi nodes placed at the beginning of each node
+	Phis  map[*Node][]*Phi
+	phiOf map[string]*Phi
+}
+
+// PhiOf returns the phi node of the identifier. It returns nil when the value of the identifier is
+// not merged.
+func (s *SSA) PhiOf(ident string) *Phi {
+	return s.phiOf[ident]
+}
+
+// Dump outputs phi nodes of reachable nodes for debugging.
+func (s *SSA) Dump(out io.Writer) {
+	for _, n := range s.Graph.Nodes {
+		for _, p := range s.Phis[n] {
+			fmt.Fprintf(out, "#%d: %s\n", n.ID, p.String())
+		}
+	}
+}
+
+type ssaBuilder struct {
+	ssa    *SSA
+	params []string
+	// Stacks of reaching values of merged identifiers while walking the dominator tree
+	stacks map[string][]string
+}
+
+func (b *ssaBuilder) assigns(n *Node) []def {
+	defs := append([]def{}, b.ssa.Graph.defs[n]...)
+	if last := n.Last(); last != nil {
+		if j, ok := last.Val.(*mir.Jump); ok {
+			if len(j.Args) != len(b.params) {
+				panic(fmt.Sprintf("FATAL: 'jump' %s has %d arguments but function has %d parameters", last.Ident, len(j.Args), len(b.params)))
+			}
+			for i, p := range b.params {
+				defs = append(defs, def{p, j.Args[i]})
+			}
+		}
+	}
+	return defs
+}
+
+// iteratedFrontier returns nodes in the iterated dominance frontier of the nodes.
+func iteratedFrontier(nodes []*Node) []*Node {
+	placed := map[*Node]bool{}
+	frontier := []*Node{}
+	for len(nodes) > 0 {
+		n := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		for _, f := range n.Frontier {
+			if placed[f] {
+				continue
+			}
+			placed[f] = true
+			frontier = append(frontier, f)
+			nodes = append(nodes, f)
+		}
+	}
+	return frontier
+}
+
+func (b *ssaBuilder) place() {
+	g := b.ssa.Graph
+	names := []string{}
+	defNodes := map[string][]*Node{}
+	for _, n := range g.Nodes {
+		for _, d := range b.assigns(n) {
+			if _, ok := defNodes[d.name]; !ok {
+				names = append(names, d.name)
+			}
+			defNodes[d.name] = append(defNodes[d.name], n)
+		}
+	}
+
+	for _, name := range names {
+		for _, n := range iteratedFrontier(defNodes[name]) {
+			args := make([]PhiArg, 0, len(n.Preds)+1)
+			if n == g.Entry {
+				args = append(args, PhiArg{nil, name})
+			}
+			for _, p := range n.Preds {
+				if p.Reachable() {
+					args = append(args, PhiArg{p, ""})
+				}
+			}
+			b.ssa.Phis[n] = append(b.ssa.Phis[n], &Phi{name, n, args})
+		}
+	}
+}
+
+func (b *ssaBuilder) reaching(name string) string {
+	s := b.stacks[name]
+	if len(s) == 0 {
+		return ""
+	}
+	return s[len(s)-1]
+}
+
+func (b *ssaBuilder) rename(n *Node) {
+	pushed := []string{}
+	push := func(name, ident string) {
+		b.stacks[name] = append(b.stacks[name], ident)
+		pushed = append(pushed, name)
+	}
+
+	for _, p := range b.ssa.Phis[n] {
+		push(p.Ident, p.Ident)
+	}
+	for _, d := range b.assigns(n) {
+		push(d.name, d.ident)
+	}
+
+	for _, s := range n.Succs {
+		for _, p := range b.ssa.Phis[s] {
+			for i, a := range p.Args {
+				if a.Pred == n {
+					p.Args[i].Ident = b.reaching(p.Ident)
+				}
+			}
+		}
+	}
+
+	for _, d := range n.Dominated {
+		b.rename(d)
+	}
+
+	for _, name := range pushed {
+		s := b.stacks[name]
+		b.stacks[name] = s[:len(s)-1]
+	}
+}
+
+func (b *ssaBuilder) prune() {
+	for n, phis := range b.ssa.Phis {
+		kept := make([]*Phi, 0, len(phis))
+	PhiLoop:
+		for _, p := range phis {
+			for _, a := range p.Args {
+				if a.Ident == "" {
+					continue PhiLoop
+				}
+			}
+			kept = append(kept, p)
+			b.ssa.phiOf[p.Ident] = p
+		}
+		if len(kept) == 0 {
+			delete(b.ssa.Phis, n)
+		} else {
+			b.ssa.Phis[n] = kept
+		}
+	}
+}
+
+// BuildSSA places phi nodes on the control flow graph. Params are parameters of the function whose
+// body the graph was built from. They are assigned by 'jump' instructions in the body. Params
+// should be empty for the graph of the entry block of program.
+func BuildSSA(g *Graph, params []string) *SSA {
+	s := &SSA{g, map[*Node][]*Phi{}, map[string]*Phi{}}
+	b := &ssaBuilder{s, params, map[string][]string{}}
+	b.place()
+	for _, p := range params {
+		// Initial values passed by the caller
+		b.stacks[p] = []string{p}
+	}
+	b.rename(g.Entry)
+	b.prune()
+	return s
+}
+
+// BuildProgramSSA builds control flow graphs with phi nodes for all toplevel functions and the
+// entry block of the program. The entry block is mapped to empty name as BuildProgram.
+func BuildProgramSSA(prog *mir.Program) map[string]*SSA {
+	ssas := make(map[string]*SSA, len(prog.Toplevel)+1)
+	for name, f := range prog.Toplevel {
+		ssas[name] = BuildSSA(Build(f.Val.Body), f.Val.Params)
+	}
+	ssas[""] = BuildSSA(Build(prog.Entry), nil)
+	return ssas
+}
@@ -0,0 +1,133 @@
+package cfg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func dumpSSA(s *SSA) string {
+	var buf bytes.Buffer
+	s.Dump(&buf)
+	return buf.String()
+}
+
+func TestPhiAtJoinOfIf(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what: "diamond",
+			code: `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = int 1 ; type=int
+  END: then
+  BEGIN: else
+  $k4 = int 2 ; type=int
+  END: else
+$k5 = binary + $k2 $k2 ; type=int
+END: program
+`,
+			expected: "#3: $k2 = phi [#1: $k3] [#2: $k4]\n",
+		},
+		{
+			what: "nested if",
+			code: `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = if $k1 ; type=int
+    BEGIN: then
+    $k4 = int 1 ; type=int
+    END: then
+    BEGIN: else
+    $k5 = int 2 ; type=int
+    END: else
+  END: then
+  BEGIN: else
+  $k7 = int 3 ; type=int
+  END: else
+$k8 = binary + $k2 $k2 ; type=int
+END: program
+`,
+			expected: `#4: $k3 = phi [#2: $k4] [#3: $k5]
+#6: $k2 = phi [#4: $k3] [#5: $k7]
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := BuildSSA(Build(parseEntry(t, tc.code)), nil)
+			if actual := dumpSSA(s); actual != tc.expected {
+				t.Fatalf("Unexpected phi nodes. Wanted:\n%s\nbut got:\n%s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPhiAtLoopHeader(t *testing.T) {
+	ssas := BuildProgramSSA(parseProgram(t, loopProgram))
+	if len(ssas) != 2 {
+		t.Fatalf("SSA for a function and entry should be built: %v", ssas)
+	}
+
+	s := ssas["sum$t1"]
+	expected := `#0: n$t2 = phi [caller: n$t2] [#2: $k7]
+#0: acc$t3 = phi [caller: acc$t3] [#2: $k10]
+`
+	if actual := dumpSSA(s); actual != expected {
+		t.Fatalf("Unexpected phi nodes. Wanted:\n%s\nbut got:\n%s", expected, actual)
+	}
+	if p := s.PhiOf("n$t2"); p == nil || p.Node != s.Graph.Entry {
+		t.Errorf("Phi node of parameter should be at entry node: %v", p)
+	}
+	// Else branch never reaches the join node because of 'jump'
+	if p := s.PhiOf("$k12"); p != nil {
+		t.Errorf("Value of 'if' should not be merged: %s", p)
+	}
+	if len(ssas[""].Phis) != 0 {
+		t.Errorf("Entry of program has no phi node: %s", dumpSSA(ssas[""]))
+	}
+}
+
+func TestPrunePhiOutOfScope(t *testing.T) {
+	s := BuildSSA(Build(parseEntry(t, `
+BEGIN: program
+$k1 = bool true ; type=bool
+$k2 = if $k1 ; type=int
+  BEGIN: then
+  $k3 = if $k1 ; type=int
+    BEGIN: then
+    $k4 = int 1 ; type=int
+    END: then
+    BEGIN: else
+    $k5 = int 2 ; type=int
+    END: else
+  $k6 = unary - $k3 ; type=int
+  END: then
+  BEGIN: else
+  $k7 = int 3 ; type=int
+  END: else
+$k8 = binary + $k2 $k2 ; type=int
+END: program
+`)), nil)
+
+	p := s.PhiOf("$k3")
+	if p == nil {
+		t.Fatal("Phi node for '$k3' not found")
+	}
+	if p.Node.ID != 4 {
+		t.Errorf("Phi node for '$k3' should be at #4 but got %s", p.Node)
+	}
+	for _, p := range s.Phis[s.PhiOf("$k2").Node] {
+		if p.Ident == "$k3" {
+			t.Errorf("'$k3' is not defined in else branch but merged: %s", p)
+		}
+	}
+}
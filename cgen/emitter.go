@@ -0,0 +1,419 @@
+// Package cgen provides an alternative backend which emits portable C source from MIR.
+//
+// It does not depend on LLVM. The emitted code is C99 and includes only <stddef.h> and gocaml.h of
+// the runtime, so it can be compiled by any C compiler and linked with runtime/gocamlrt.c and libgc.
+// It is useful to bootstrap GoCaml on platforms without LLVM bindings and to audit generated code.
+//
+// Representations of values follow the LLVM backend where they are visible to runtime (strings,
+// arrays, tuples, closures and options of them), but they are not optimized. Options of strings,
+// functions, arrays and pointers are their elements where None is a null pointer. Other options are
+// pairs of a flag and a value. Tables, buffers and JSON values are opaque pointers to objects of
+// runtime. Identifiers of MIR are kept readable ('x$t1' is 'x_t1') and each function is commented
+// with its MIR name. Integer overflow is undefined in C. Compile the code with -fwrapv where
+// available to make it wrap as the LLVM backend does.
+package cgen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"io"
+	"sort"
+	"strings"
+)
+
+type nameSet map[string]struct{}
+
+// Identifiers which cannot be used for names of C functions and variables
+var reservedNames = []string{
+	"auto", "break", "case", "char", "const", "continue", "default", "do", "double", "else", "enum",
+	"extern", "float", "for", "goto", "if", "inline", "int", "long", "register", "restrict", "return",
+	"short", "signed", "sizeof", "static", "struct", "switch", "typedef", "union", "unsigned", "void",
+	"volatile", "while", "main", "env", "NULL", "size_t", "GC_malloc",
+}
+
+const unitValue = "gocaml_unit_value"
+
+const prelude = `#include <stddef.h>
+#include "gocaml.h"
+
+/* Hash of tag name and boxed payload of variant */
+typedef struct {
+    uint64_t tag;
+    void *payload;
+} gocaml_variant;
+
+static gocaml_unit gocaml_unit_value;
+
+void *GC_malloc(size_t);
+gocaml_bool __str_equal(gocaml_string, gocaml_string);
+void __gocaml_bounds_fail(gocaml_string, gocaml_int, gocaml_int);
+void *__gocaml_table_create(gocaml_layout const *);
+gocaml_bool __gocaml_table_find_int(void *, gocaml_int, void *);
+gocaml_bool __gocaml_table_find_str(void *, gocaml_string const *, void *);
+void __gocaml_table_set_int(void *, gocaml_int, void const *);
+void __gocaml_table_set_str(void *, gocaml_string const *, void const *);
+void __gocaml_table_remove_int(void *, gocaml_int);
+void __gocaml_table_remove_str(void *, gocaml_string const *);
+
+static inline void *gocaml_box(void const *src, size_t size) {
+    char *dst = GC_malloc(size);
+    for (size_t i = 0; i < size; i++) {
+        dst[i] = ((char const *) src)[i];
+    }
+    return dst;
+}
+`
+
+// Runtime functions declared in prelude
+var preludeFuncs = []string{
+	"GC_malloc", "__str_equal", "__gocaml_bounds_fail", "__gocaml_table_create", "__gocaml_table_find_int",
+	"__gocaml_table_find_str", "__gocaml_table_set_int", "__gocaml_table_set_str",
+	"__gocaml_table_remove_int", "__gocaml_table_remove_str",
+}
+
+// envLayout is a struct of the environment of a closure. Unit values are not stored.
+type envLayout struct {
+	// Struct tag. It is empty when the environment has no field
+	tag    string
+	fields map[string]string
+	order  []string
+}
+
+type emitter struct {
+	prog  *mir.Program
+	env   *types.Env
+	types *typeEmitter
+	// Names at file scope
+	global nameSet
+	// C names of toplevel functions
+	funcs map[string]string
+	// Closure wrappers of external functions used as values
+	wrappers map[string]string
+	envs     map[string]*envLayout
+	externs  bytes.Buffer
+	protos   bytes.Buffer
+	defs     bytes.Buffer
+}
+
+// sanitize makes a readable C identifier from the MIR identifier. It may not be unique.
+func sanitize(ident string) string {
+	var b bytes.Buffer
+	for i, r := range strings.TrimLeft(ident, "$") {
+		switch {
+		case r == '$':
+			b.WriteByte('_')
+		case r == '\'':
+			b.WriteString("_q")
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', r == '_', i > 0 && '0' <= r && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	s := b.String()
+	if s == "" || s[0] == '_' || strings.HasPrefix(s, "gocaml") {
+		// Avoid names reserved by C and names of the runtime
+		s = "v" + s
+	}
+	return s
+}
+
+func (e *emitter) unique(base string, local nameSet) string {
+	n := base
+	for i := 1; ; i++ {
+		_, g := e.global[n]
+		_, l := local[n]
+		if !g && !l {
+			return n
+		}
+		n = fmt.Sprintf("%s_%d", base, i)
+	}
+}
+
+func (e *emitter) globalName(ident string) string {
+	n := e.unique(sanitize(ident), nil)
+	e.global[n] = struct{}{}
+	return n
+}
+
+func (e *emitter) typeOf(ident string) types.Type {
+	t, ok := e.env.DeclTable[ident]
+	if !ok {
+		panic("FATAL: Type was not found for ident: " + ident)
+	}
+	return t
+}
+
+func (e *emitter) funTypeOf(ident string) *types.Fun {
+	t := e.typeOf(ident)
+	for {
+		v, ok := t.(*types.Var)
+		if !ok || v.Ref == nil {
+			break
+		}
+		t = v.Ref
+	}
+	f, ok := t.(*types.Fun)
+	if !ok {
+		panic(fmt.Sprintf("FATAL: Type of function '%s' is not a function type: %s", ident, t.String()))
+	}
+	return f
+}
+
+func isUnit(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.Unit:
+		return true
+	case *types.Var:
+		return t.Ref != nil && isUnit(t.Ref)
+	default:
+		return false
+	}
+}
+
+func isString(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.String:
+		return true
+	case *types.Var:
+		return t.Ref != nil && isString(t.Ref)
+	default:
+		return false
+	}
+}
+
+// envOf returns the layout of the environment of the closure. The struct is defined at first use.
+// Environment of a linked closure starts with a pointer to the environment of its enclosing closure
+// (see the note in closure/link.go).
+func (e *emitter) envOf(fun string) *envLayout {
+	if l, ok := e.envs[fun]; ok {
+		return l
+	}
+
+	parent, linked := e.prog.EnvLinks[fun]
+	inParent := nameSet{}
+	if linked {
+		for _, c := range e.prog.Closures[parent] {
+			inParent[c] = struct{}{}
+		}
+	}
+	l := &envLayout{"", map[string]string{}, []string{}}
+	taken := nameSet{"link": struct{}{}}
+	for _, c := range e.prog.Closures[fun] {
+		if _, ok := inParent[c]; ok || isUnit(e.typeOf(c)) {
+			continue
+		}
+		f := sanitize(c)
+		for i := 1; ; i++ {
+			if _, ok := taken[f]; !ok {
+				break
+			}
+			f = fmt.Sprintf("%s_%d", sanitize(c), i)
+		}
+		taken[f] = struct{}{}
+		l.fields[c] = f
+		l.order = append(l.order, c)
+	}
+	e.envs[fun] = l
+	if !linked && len(l.order) == 0 {
+		return l
+	}
+
+	fields := make([]string, 0, len(l.order))
+	for _, c := range l.order {
+		fields = append(fields, declare(e.types.cType(e.typeOf(c)), l.fields[c]))
+	}
+	l.tag = e.funcs[fun] + "_env"
+	fmt.Fprintf(&e.types.out, "/* Environment of %s */\nstruct %s {\n", fun, l.tag)
+	if linked {
+		fmt.Fprintf(&e.types.out, "    void *link; /* Environment of %s */\n", parent)
+	}
+	for _, f := range fields {
+		fmt.Fprintf(&e.types.out, "    %s;\n", f)
+	}
+	e.types.out.WriteString("};\n")
+	return l
+}
+
+// captureExpr returns an expression to load the captured variable from the environment. Variables
+// which are not stored in the environment are loaded following links of environments.
+func (e *emitter) captureExpr(fun, capture, env string) string {
+	l := e.envOf(fun)
+	if f, ok := l.fields[capture]; ok {
+		return fmt.Sprintf("((struct %s *) %s)->%s", l.tag, env, f)
+	}
+	parent, ok := e.prog.EnvLinks[fun]
+	if !ok {
+		panic(fmt.Sprintf("FATAL: Capture '%s' is not found in environment of '%s'", capture, fun))
+	}
+	return e.captureExpr(parent, capture, fmt.Sprintf("((struct %s *) %s)->link", l.tag, env))
+}
+
+func (e *emitter) paramTypes(params []types.Type, closure bool) string {
+	ps := make([]string, 0, len(params)+1)
+	if closure {
+		ps = append(ps, "void *")
+	}
+	for _, p := range params {
+		ps = append(ps, e.types.cType(p))
+	}
+	if len(ps) == 0 {
+		return "void"
+	}
+	return strings.Join(ps, ", ")
+}
+
+func (e *emitter) emitExternals() {
+	declared := nameSet{}
+	for _, n := range preludeFuncs {
+		declared[n] = struct{}{}
+	}
+	names := make([]string, 0, len(e.env.Externals))
+	for n := range e.env.Externals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		ext := e.env.Externals[n]
+		if _, ok := declared[ext.CName]; ok {
+			// External symbol monomorphized from generic one may share the C name with existing one
+			continue
+		}
+		declared[ext.CName] = struct{}{}
+		switch ty := ext.Type.(type) {
+		case *types.Var:
+			// Generic external symbol which is never used
+			continue
+		case *types.Fun:
+			// External function (usually written in C) returns void instead of unit
+			ret := "void"
+			if !isUnit(ty.Ret) {
+				ret = e.types.cType(ty.Ret)
+			}
+			fmt.Fprintf(&e.externs, "%s(%s);\n", declare(ret, ext.CName), e.paramTypes(ty.Params, false))
+		default:
+			fmt.Fprintf(&e.externs, "extern %s;\n", declare(e.types.cType(ty), ext.CName))
+		}
+	}
+}
+
+// emitWrapper defines a closure function which calls the external function. It is necessary when
+// the external function is used as a value since all function values are closures.
+func (e *emitter) emitWrapper(ident string) {
+	ext := e.env.Externals[ident]
+	ty := ext.Type.(*types.Fun)
+	name := e.wrappers[ident]
+	ret := e.types.cType(ty.Ret)
+
+	params := make([]string, 0, len(ty.Params)+1)
+	params = append(params, "void *env")
+	args := make([]string, 0, len(ty.Params))
+	for i, p := range ty.Params {
+		a := fmt.Sprintf("a%d", i)
+		params = append(params, declare(e.types.cType(p), a))
+		args = append(args, a)
+	}
+	call := fmt.Sprintf("%s(%s)", ext.CName, strings.Join(args, ", "))
+
+	fmt.Fprintf(&e.protos, "static %s(%s);\n", declare(ret, name), e.paramTypes(ty.Params, true))
+	fmt.Fprintf(&e.defs, "/* %s as closure */\nstatic %s(%s) {\n", ident, declare(ret, name), strings.Join(params, ", "))
+	if isUnit(ty.Ret) {
+		fmt.Fprintf(&e.defs, "    %s;\n    return %s;\n}\n\n", call, unitValue)
+	} else {
+		fmt.Fprintf(&e.defs, "    return %s;\n}\n\n", call)
+	}
+}
+
+// collectWrappers names closure wrappers of external functions referred as values before emitting
+// functions so that names of local variables never shadow them.
+func (e *emitter) collectWrappers(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch val := i.Val.(type) {
+		case *mir.XRef:
+			if _, ok := e.wrappers[val.Ident]; ok {
+				continue
+			}
+			if ext, ok := e.env.Externals[val.Ident]; ok {
+				if _, ok := ext.Type.(*types.Fun); ok {
+					e.wrappers[val.Ident] = e.globalName(val.Ident + "$closure")
+				}
+			}
+		case *mir.If:
+			e.collectWrappers(val.Then)
+			e.collectWrappers(val.Else)
+		}
+	}
+}
+
+func (e *emitter) emit(out io.Writer, src *locerr.Source) error {
+	e.emitExternals()
+
+	names := e.prog.Toplevel.Names()
+	for _, n := range names {
+		e.funcs[n] = e.globalName(n)
+	}
+	for _, n := range names {
+		e.collectWrappers(e.prog.Toplevel[n].Val.Body)
+	}
+	e.collectWrappers(e.prog.Entry)
+	wrapped := make([]string, 0, len(e.wrappers))
+	for n := range e.wrappers {
+		wrapped = append(wrapped, n)
+	}
+	sort.Strings(wrapped)
+	for _, n := range wrapped {
+		e.emitWrapper(n)
+	}
+
+	for _, n := range names {
+		newFuncEmitter(e, n).emitFun(e.prog.Toplevel[n])
+	}
+	newFuncEmitter(e, "").emitMain(e.prog.Entry)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "/* Generated by gocaml from %s */\n\n", src.Path)
+	buf.WriteString(prelude)
+	for _, section := range []*bytes.Buffer{&e.types.out, &e.externs, &e.protos} {
+		if section.Len() > 0 {
+			buf.WriteByte('\n')
+			buf.Write(section.Bytes())
+		}
+	}
+	buf.WriteByte('\n')
+	buf.Write(e.defs.Bytes())
+	_, err := buf.WriteTo(out)
+	return err
+}
+
+// Emit translates the program into C source and writes it to the output. Types in the program must
+// be monomorphic. Otherwise it returns an error. 'main' function is defined in runtime and it calls
+// '__gocaml_main' defined in the emitted source.
+func Emit(out io.Writer, prog *mir.Program, env *types.Env, src *locerr.Source) error {
+	if err := prog.CheckMonomorphic(env, "C backend"); err != nil {
+		return err
+	}
+	global := make(nameSet, len(reservedNames)+len(env.Externals))
+	for _, n := range reservedNames {
+		global[n] = struct{}{}
+	}
+	for _, ext := range env.Externals {
+		global[ext.CName] = struct{}{}
+	}
+	e := &emitter{
+		prog,
+		env,
+		newTypeEmitter(),
+		global,
+		map[string]string{},
+		map[string]string{},
+		map[string]*envLayout{},
+		bytes.Buffer{},
+		bytes.Buffer{},
+		bytes.Buffer{},
+	}
+	return e.emit(out, src)
+}
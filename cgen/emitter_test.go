@@ -0,0 +1,262 @@
+package cgen
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEmitC(s *locerr.Source) (string, error) {
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return "", err
+	}
+	prog := closure.Transform(ir)
+	var buf bytes.Buffer
+	if err := Emit(&buf, prog, env, s); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func TestEmitSnippets(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{
+			what: "entry point",
+			code: "println_int 42",
+			expected: []string{
+				"/* Generated by gocaml from <dummy> */",
+				"#include \"gocaml.h\"",
+				"int __gocaml_main(void) {",
+				"println_int(",
+				"return 0;",
+			},
+		},
+		{
+			what: "function",
+			code: "let rec f x = x + x in println_int (f 42)",
+			expected: []string{
+				"static gocaml_int f_t1(gocaml_int x_t2) {",
+				"f_t1(",
+			},
+		},
+		{
+			what: "closure",
+			code: "let a = 42 in let rec f x = x + a in let g = f in println_int (g 1)",
+			expected: []string{
+				"struct f_t2_env {",
+				"gocaml_int a_t1;",
+				"static gocaml_int f_t2(void *env, gocaml_int x_t3) {",
+				"gocaml_closure ",
+				"(gocaml_fun) f_t2",
+			},
+		},
+		{
+			what: "string",
+			code: `println_str "a\"b\n"`,
+			expected: []string{
+				`(gocaml_string){(int8_t *) "a\"b\n", 4}`,
+			},
+		},
+		{
+			what: "tuple",
+			code: "let (a, b) = (1, 3.14) in println_int a; println_float b",
+			expected: []string{
+				"/* int * float */",
+				"gocaml_int e0;",
+				"gocaml_float e1;",
+			},
+		},
+		{
+			what: "array",
+			code: "let a = Array.make 3 true in println_bool a.(1)",
+			expected: []string{
+				"/* bool array */",
+				"gocaml_bool *buf;",
+				"__gocaml_bounds_fail(",
+			},
+		},
+		{
+			what: "external",
+			code: `external f: int -> unit = "c_f"; external x: int = "c_x"; f x`,
+			expected: []string{
+				"void c_f(gocaml_int);",
+				"extern gocaml_int c_x;",
+			},
+		},
+		{
+			what: "table",
+			code: `let t = Table.create () in Table.set t "a" (Some 1.0); Table.remove t "b"; println_bool (Table.find t "a" = None)`,
+			expected: []string{
+				"static gocaml_layout const gocaml_layout",
+				"void *t_t1 = __gocaml_table_create(&gocaml_layout",
+				"__gocaml_table_set_str(",
+				"__gocaml_table_remove_str(",
+				"__gocaml_table_find_str(",
+			},
+		},
+		{
+			what: "buffer",
+			code: `let b = Buffer.create () in Buffer.add_string b "a"; Buffer.add_char b 98; println_str (Buffer.contents b)`,
+			expected: []string{
+				"void *gocaml_buffer_create(gocaml_unit);",
+				"void gocaml_buffer_add_string(void *, gocaml_string);",
+				"void *b_t1 = ",
+			},
+		},
+		{
+			what: "json",
+			code: `let j = Json.of_array [| Json.of_int 1; Json.null () |] in println_str (Json.encode j)`,
+			expected: []string{
+				"void *gocaml_json_of_int(gocaml_int);",
+				"gocaml_string gocaml_json_encode(void *);",
+				"void *j_t",
+			},
+		},
+		{
+			what: "reserved name",
+			code: "let int = 1 in let main = 2 in println_int (int + main)",
+			expected: []string{
+				"gocaml_int int_t1 = 1;",
+				"gocaml_int main_t2 = 2;",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			c, err := testEmitC(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tc.expected {
+				if !strings.Contains(c, e) {
+					t.Errorf("Expected '%s' in C source:\n%s", e, c)
+				}
+			}
+		})
+	}
+}
+
+func TestEmitMonomorphicOnly(t *testing.T) {
+	_, err := testEmitC(locerr.NewDummySource("let rec id x = x in id 1; id true; ()"))
+	if err == nil {
+		t.Fatal("Type variable in C backend did not cause an error")
+	}
+	if !strings.Contains(err.Error(), "C backend needs monomorphic types") {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+// Programs in codegen/testdata which are monomorphic after type inference
+var monomorphicTestdata = []string{
+	"argv.ml",
+	"binary_op.ml",
+	"buffer.ml",
+	"builtin_chain.ml",
+	"builtins.ml",
+	"clock.ml",
+	"closure.ml",
+	"constants.ml",
+	"deriving_show_string.ml",
+	"file.ml",
+	"float_nan.ml",
+	"for_loop.ml",
+	"function.ml",
+	"helloworld.ml",
+	"json.ml",
+	"math.ml",
+	"multi_functions.ml",
+	"nested_aggregates.ml",
+	"nested_block.ml",
+	"printf.ml",
+	"random.ml",
+	"recursive_closure.ml",
+	"recursive_func.ml",
+	"regexp.ml",
+	"string.ml",
+	"string_module.ml",
+	"string_repr.ml",
+	"table.ml",
+	"type_annotation.ml",
+	"type_decl.ml",
+	"unary_op.ml",
+	"variant.ml",
+}
+
+// TestRunEmittedC compiles emitted C sources, links them with runtime and checks outputs of the
+// executables as codegen/executable_test.go does.
+func TestRunEmittedC(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("C compiler was not found:", err)
+	}
+	dir, err := ioutil.TempDir("", "gocaml-cgen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runtime := filepath.Join("..", "runtime")
+	rt := filepath.Join(dir, "gocamlrt.o")
+	if out, err := exec.Command(cc, "-std=c99", "-c", "-I", runtime, filepath.Join(runtime, "gocamlrt.c"), "-o", rt).CombinedOutput(); err != nil {
+		t.Skipf("Runtime was not compiled. libgc may not be installed: %s\n%s", err, out)
+	}
+
+	for _, name := range monomorphicTestdata {
+		t.Run(name, func(t *testing.T) {
+			input := filepath.Join("..", "codegen", "testdata", name)
+			s, err := locerr.NewSourceFromFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := testEmitC(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(dir, name+".c")
+			if err := ioutil.WriteFile(file, []byte(c), 0666); err != nil {
+				t.Fatal(err)
+			}
+			exe := filepath.Join(dir, name+".a.out")
+			out, err := exec.Command(cc, "-std=c99", "-fwrapv", "-I", runtime, file, rt, "-lgc", "-lm", "-o", exe).CombinedOutput()
+			if err != nil {
+				t.Fatalf("Emitted C source was not compiled: %s\n%s\n%s", err, out, c)
+			}
+
+			// Programs access files in testdata relatively
+			cmd := exec.Command(exe)
+			cmd.Dir = filepath.Join("..", "codegen")
+			bytes, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.TrimRight(string(bytes), "\n")
+			bytes, err = ioutil.ReadFile(strings.TrimSuffix(input, ".ml") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Some of expected outputs do not end with the last newline of the output
+			want := strings.TrimRight(string(bytes), "\n")
+			if got != want {
+				t.Fatalf("Unexpected output from executable:\n\nGot: '%s'\nWant: '%s'\n%s", got, want, c)
+			}
+		})
+	}
+}
@@ -0,0 +1,687 @@
+package cgen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// funcEmitter emits the body of a function. Each function has its own scope of local names.
+type funcEmitter struct {
+	*emitter
+	// MIR name of the function. It is empty for the entry point
+	name     string
+	locals   nameSet
+	vals     map[string]string
+	body     bytes.Buffer
+	prologue bytes.Buffer
+	indent   int
+	// C names of parameters for 'jump' instructions
+	params []string
+}
+
+func newFuncEmitter(e *emitter, name string) *funcEmitter {
+	return &funcEmitter{e, name, nameSet{}, map[string]string{}, bytes.Buffer{}, bytes.Buffer{}, 1, nil}
+}
+
+func (f *funcEmitter) line(format string, args ...interface{}) {
+	f.body.WriteString(strings.Repeat("    ", f.indent))
+	fmt.Fprintf(&f.body, format, args...)
+	f.body.WriteByte('\n')
+}
+
+// fresh returns a new local name which is unique in the function.
+func (f *funcEmitter) fresh(base string) string {
+	n := f.unique(base, f.locals)
+	f.locals[n] = struct{}{}
+	return n
+}
+
+// local names the variable bound to the identifier.
+func (f *funcEmitter) local(ident string) string {
+	n := f.fresh(sanitize(ident))
+	f.vals[ident] = n
+	return n
+}
+
+func (f *funcEmitter) resolve(ident string) string {
+	if n, ok := f.vals[ident]; ok {
+		return n
+	}
+	panic("FATAL: No value was found for identifier: " + ident)
+}
+
+func (f *funcEmitter) cTypeOf(ident string) string {
+	return f.types.cType(f.typeOf(ident))
+}
+
+// define binds the value of the expression to a new variable. Unit values are not bound to
+// variables. Only expressions which have side effects are evaluated for them.
+func (f *funcEmitter) define(ident, expr string, pure bool) {
+	if isUnit(f.typeOf(ident)) {
+		if !pure {
+			f.line("%s;", expr)
+		}
+		f.vals[ident] = unitValue
+		return
+	}
+	ty := f.cTypeOf(ident)
+	f.line("%s = %s;", declare(ty, f.local(ident)), expr)
+}
+
+// declareUninit declares a variable for a value which is never used at runtime.
+func (f *funcEmitter) declareUninit(ident string) {
+	if isUnit(f.typeOf(ident)) {
+		f.vals[ident] = unitValue
+		return
+	}
+	ty := f.cTypeOf(ident)
+	f.line("%s; /* never used */", declare(ty, f.local(ident)))
+}
+
+// Tag of polymorphic variant is represented as a hash value of its name at runtime as the LLVM
+// backend does.
+func tagExpr(tag string) string {
+	h := fnv.New64a()
+	h.Write([]byte(tag))
+	return fmt.Sprintf("UINT64_C(0x%016x) /* `%s */", h.Sum64(), tag)
+}
+
+func intLit(i int64) string {
+	if i == math.MinInt64 {
+		return "(-INT64_C(9223372036854775807) - 1)"
+	}
+	return strconv.FormatInt(i, 10)
+}
+
+func floatLit(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "(1.0 / 0.0)"
+	case math.IsInf(f, -1):
+		return "(-1.0 / 0.0)"
+	case math.IsNaN(f):
+		return "(0.0 / 0.0)"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// stringLit returns a C string literal. Characters other than printable ASCII are escaped with octal
+// escape sequences. '?' is escaped to avoid trigraphs.
+func stringLit(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\' || c == '?':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c == '\t':
+			b.WriteString("\\t")
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func stringVal(s string) string {
+	return fmt.Sprintf("(gocaml_string){(int8_t *) %s, %d}", stringLit(s), len(s))
+}
+
+func ptrTo(ty string) string {
+	if strings.HasSuffix(ty, "*") {
+		return ty + "*"
+	}
+	return ty + " *"
+}
+
+// eqExpr returns an expression which compares two values of the type.
+func (f *funcEmitter) eqExpr(ty types.Type, l, r string) string {
+	switch ty := ty.(type) {
+	case *types.Unit:
+		return "1"
+	case *types.Bool, *types.Int, *types.Float:
+		return fmt.Sprintf("(%s == %s)", l, r)
+	case *types.String:
+		return fmt.Sprintf("__str_equal(%s, %s)", l, r)
+	case *types.Tuple:
+		if len(ty.Elems) == 0 {
+			return "1"
+		}
+		elems := make([]string, 0, len(ty.Elems))
+		for i, e := range ty.Elems {
+			elems = append(elems, f.eqExpr(e, fmt.Sprintf("%s->e%d", l, i), fmt.Sprintf("%s->e%d", r, i)))
+		}
+		return "(" + strings.Join(elems, " && ") + ")"
+	case *types.Fun:
+		return fmt.Sprintf("(%s.fun == %s.fun)", l, r)
+	case *types.Option:
+		lv, rv := l+".value", r+".value"
+		if nullable(ty.Elem) {
+			lv, rv = l, r
+		}
+		elem := f.eqExpr(ty.Elem, lv, rv)
+		ls, rs := isSomeExpr(ty, l), isSomeExpr(ty, r)
+		return fmt.Sprintf("(%s && %s ? %s : %s == %s)", ls, rs, elem, ls, rs)
+	case *types.Result:
+		payload := func(t types.Type, v string) string {
+			return fmt.Sprintf("*(%s) %s.payload", ptrTo(f.types.cType(t)), v)
+		}
+		ok := f.eqExpr(ty.Ok, payload(ty.Ok, l), payload(ty.Ok, r))
+		err := f.eqExpr(ty.Error, payload(ty.Error, l), payload(ty.Error, r))
+		return fmt.Sprintf("(%s.tag == %s.tag && (%s.tag == %s ? %s : %s))", l, r, l, tagExpr("Ok"), ok, err)
+	case *types.Var:
+		if ty.Ref != nil {
+			return f.eqExpr(ty.Ref, l, r)
+		}
+		panic("unreachable")
+	default:
+		panic("unreachable")
+	}
+}
+
+func (f *funcEmitter) args(idents []string) []string {
+	args := make([]string, 0, len(idents))
+	for _, a := range idents {
+		args = append(args, f.resolve(a))
+	}
+	return args
+}
+
+func (f *funcEmitter) callExpr(app *mir.App) string {
+	args := f.args(app.Args)
+	switch app.Kind {
+	case mir.EXTERNAL_CALL:
+		return fmt.Sprintf("%s(%s)", f.env.Externals[app.Callee].CName, strings.Join(args, ", "))
+	case mir.CLOSURE_CALL:
+		cls := f.resolve(app.Callee)
+		args = append([]string{cls + ".env"}, args...)
+		if fn, ok := f.funcs[app.Callee]; ok {
+			// Callee is a well-known function. Only its environment is necessary.
+			return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", "))
+		}
+		ty := f.funTypeOf(app.Callee)
+		return fmt.Sprintf("((%s (*)(%s)) %s.fun)(%s)", f.types.cType(ty.Ret), f.paramTypes(ty.Params, true), cls, strings.Join(args, ", "))
+	default:
+		fn, ok := f.funcs[app.Callee]
+		if !ok {
+			panic("FATAL: Function is not found for direct call: " + app.Callee)
+		}
+		if _, ok := f.prog.Closures[app.Callee]; ok {
+			// Closure which captures nothing is called directly. Its environment is never accessed.
+			args = append([]string{"NULL"}, args...)
+		}
+		return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", "))
+	}
+}
+
+func binaryOp(op mir.OperatorKind) string {
+	switch op {
+	case mir.ADD, mir.FADD:
+		return "+"
+	case mir.SUB, mir.FSUB:
+		return "-"
+	case mir.MUL, mir.FMUL:
+		return "*"
+	case mir.DIV, mir.FDIV:
+		return "/"
+	case mir.MOD:
+		return "%"
+	case mir.LT:
+		return "<"
+	case mir.LTE:
+		return "<="
+	case mir.GT:
+		return ">"
+	case mir.GTE:
+		return ">="
+	case mir.AND:
+		return "&&"
+	case mir.OR:
+		return "||"
+	default:
+		panic("unreachable")
+	}
+}
+
+// allocObject allocates memory for the object of the struct. The object is allocated on stack when it
+// never escapes from the function. Stack objects are declared at the beginning of the function so
+// that they are not reused by loops of 'jump' instructions.
+func (f *funcEmitter) allocObject(ident, ptr, structTy string) {
+	if _, ok := f.prog.StackAllocated[ident]; ok {
+		obj := f.fresh(ptr + "_obj")
+		fmt.Fprintf(&f.prologue, "    %s %s;\n", structTy, obj)
+		f.line("%s *%s = &%s;", structTy, ptr, obj)
+		return
+	}
+	f.line("%s *%s = GC_malloc(sizeof(%s));", structTy, ptr, structTy)
+}
+
+func (f *funcEmitter) emitTuple(ident string, val *mir.Tuple) {
+	ty := f.cTypeOf(ident)
+	structTy := strings.TrimSuffix(ty, " *")
+	elems := f.args(val.Elems)
+	ptr := f.local(ident)
+	f.allocObject(ident, ptr, structTy)
+	for i, e := range elems {
+		f.line("%s->e%d = %s;", ptr, i, e)
+	}
+}
+
+func (f *funcEmitter) emitArray(ident string, val *mir.Array) {
+	arr, ok := f.typeOf(ident).(*types.Array)
+	if !ok {
+		panic("FATAL: Type of array instruction is not array")
+	}
+	elem := f.types.cType(arr.Elem)
+	size, init := f.resolve(val.Size), f.resolve(val.Elem)
+	ty := f.cTypeOf(ident)
+	name := f.local(ident)
+	iter := f.fresh(name + "_i")
+	f.line("%s %s;", ty, name)
+	f.line("%s.size = %s;", name, size)
+	f.line("%s.buf = GC_malloc(sizeof(%s) * (size_t) %s);", name, elem, size)
+	f.line("for (gocaml_int %s = 0; %s < %s; %s++) {", iter, iter, size, iter)
+	f.line("    %s.buf[%s] = %s;", name, iter, init)
+	f.line("}")
+}
+
+func (f *funcEmitter) emitArrLit(ident string, val *mir.ArrLit) {
+	arr, ok := f.typeOf(ident).(*types.Array)
+	if !ok {
+		panic("FATAL: Type of arrlit instruction is not array")
+	}
+	elems := f.args(val.Elems)
+	ty := f.cTypeOf(ident)
+	name := f.local(ident)
+	if len(elems) == 0 {
+		f.line("%s %s = {NULL, 0};", ty, name)
+		return
+	}
+	f.line("%s %s;", ty, name)
+	f.line("%s.size = %d;", name, len(elems))
+	f.line("%s.buf = GC_malloc(sizeof(%s) * %d);", name, f.types.cType(arr.Elem), len(elems))
+	for i, e := range elems {
+		f.line("%s.buf[%d] = %s;", name, i, e)
+	}
+}
+
+func (f *funcEmitter) emitMakeCls(ident string, val *mir.MakeCls) {
+	fn, ok := f.funcs[val.Fun]
+	if !ok {
+		panic("FATAL: Closure for function not found: " + val.Fun)
+	}
+
+	envVal := "NULL"
+	if shared, ok := f.prog.SharedEnvs[ident]; ok {
+		// Reuse the environment of the preceding closure which captures the same variables
+		envVal = f.resolve(shared) + ".env"
+	} else if l := f.envOf(val.Fun); l.tag != "" {
+		envVal = f.fresh(sanitize(ident) + "_env")
+		f.allocObject(ident, envVal, "struct "+l.tag)
+		if _, linked := f.prog.EnvLinks[val.Fun]; linked {
+			// Linked closure is always made in its enclosing closure. Link to the environment of it.
+			if f.name == "" {
+				panic("FATAL: Linked closure '" + val.Fun + "' is made outside closure")
+			}
+			f.line("%s->link = env;", envVal)
+		}
+		for i, c := range f.prog.Closures[val.Fun] {
+			if field, ok := l.fields[c]; ok {
+				f.line("%s->%s = %s;", envVal, field, f.resolve(val.Vars[i]))
+			}
+		}
+	}
+	f.line("gocaml_closure %s = {(gocaml_fun) %s, %s};", f.local(ident), fn, envVal)
+}
+
+// emitBoundsCheck compares the index with the size of the array. When the index is out of bounds,
+// runtime function reports the location and aborts the program. Since the index is compared as
+// unsigned integer, negative index is also rejected by one comparison.
+func (f *funcEmitter) emitBoundsCheck(ident string, check *mir.BoundsCheck, pos locerr.Pos) {
+	arr, idx := f.resolve(check.Array), f.resolve(check.Index)
+	loc := fmt.Sprintf("%s:%d:%d", pos.File.Path, pos.Line, pos.Column)
+	f.line("if ((uint64_t) %s >= (uint64_t) %s.size) {", idx, arr)
+	f.line("    __gocaml_bounds_fail(%s, %s, %s.size);", stringVal(loc), idx, arr)
+	f.line("}")
+	f.vals[ident] = unitValue
+}
+
+// tableCall returns the runtime function of the operation and the key argument for it. Runtime has
+// functions for each kind of key. String keys are passed by pointer.
+func (f *funcEmitter) tableCall(op, table, key string) (string, string) {
+	tbl, ok := f.typeOf(table).(*types.Table)
+	if !ok {
+		panic("FATAL: Type of table operand is not table")
+	}
+	if isString(tbl.Key) {
+		return "__gocaml_table_" + op + "_str", "&" + f.resolve(key)
+	}
+	return "__gocaml_table_" + op + "_int", f.resolve(key)
+}
+
+func (f *funcEmitter) optionTypeOf(ident string) *types.Option {
+	ty, ok := f.typeOf(ident).(*types.Option)
+	if !ok {
+		panic("FATAL: Type of option operand is not option: " + f.typeOf(ident).String())
+	}
+	return ty
+}
+
+// emitTblLoad finds the key in the table. Runtime writes the value to the option when it is found.
+// Nullable options are initialized with None and overwritten by the value.
+func (f *funcEmitter) emitTblLoad(ident string, val *mir.TblLoad) {
+	fn, key := f.tableCall("find", val.From, val.Key)
+	name := f.local(ident)
+	ty := f.optionTypeOf(ident)
+	if nullable(ty.Elem) {
+		f.line("%s = %s;", declare(f.cTypeOf(ident), name), noneValue(ty))
+		f.line("%s(%s, %s, &%s);", fn, f.resolve(val.From), key, name)
+		return
+	}
+	f.line("%s;", declare(f.cTypeOf(ident), name))
+	f.line("%s.some = %s(%s, %s, &%s.value);", name, fn, f.resolve(val.From), key, name)
+}
+
+func (f *funcEmitter) emitIf(ident string, val *mir.If) {
+	cond := f.resolve(val.Cond)
+	result := ""
+	if !isUnit(f.typeOf(ident)) {
+		ty := f.cTypeOf(ident)
+		result = f.local(ident)
+		f.line("%s;", declare(ty, result))
+	} else {
+		f.vals[ident] = unitValue
+	}
+
+	branch := func(b *mir.Block) {
+		f.indent++
+		v := f.emitBlock(b)
+		if result != "" {
+			f.line("%s = %s;", result, v)
+		}
+		f.indent--
+	}
+	f.line("if (%s) {", cond)
+	branch(val.Then)
+	f.line("} else {")
+	branch(val.Else)
+	f.line("}")
+}
+
+// emitJump assigns arguments to parameters and jumps to the beginning of the function. When some
+// argument is a parameter assigned before it, arguments are saved to temporary variables at first.
+func (f *funcEmitter) emitJump(ident string, val *mir.Jump) {
+	f.declareUninit(ident)
+	args := f.args(val.Args)
+	params := make(nameSet, len(f.params))
+	for _, p := range f.params {
+		params[p] = struct{}{}
+	}
+	parallel := false
+	for i, a := range args {
+		if _, ok := params[a]; ok && a != f.params[i] {
+			parallel = true
+		}
+	}
+
+	if parallel {
+		f.line("{")
+		f.indent++
+		tmps := make([]string, 0, len(args))
+		for i, a := range args {
+			t := f.fresh(f.params[i] + "_next")
+			f.line("%s = %s;", declare(f.cTypeOf(val.Args[i]), t), a)
+			tmps = append(tmps, t)
+		}
+		for i, t := range tmps {
+			f.line("%s = %s;", f.params[i], t)
+		}
+		f.indent--
+		f.line("}")
+	} else {
+		for i, a := range args {
+			if a != f.params[i] {
+				f.line("%s = %s;", f.params[i], a)
+			}
+		}
+	}
+	f.line("goto loop;")
+}
+
+func (f *funcEmitter) emitInsn(insn *mir.Insn) {
+	ident := insn.Ident
+	switch val := insn.Val.(type) {
+	case *mir.Unit:
+		f.vals[ident] = unitValue
+	case *mir.Bool:
+		v := "0"
+		if val.Const {
+			v = "1"
+		}
+		f.define(ident, v, true)
+	case *mir.Int:
+		f.define(ident, intLit(val.Const), true)
+	case *mir.Float:
+		f.define(ident, floatLit(val.Const), true)
+	case *mir.String:
+		f.define(ident, stringVal(val.Const), true)
+	case *mir.Unary:
+		child := f.resolve(val.Child)
+		switch val.Op {
+		case mir.NEG, mir.FNEG:
+			f.define(ident, "-"+child, true)
+		case mir.NOT:
+			f.define(ident, "!"+child, true)
+		default:
+			panic("unreachable")
+		}
+	case *mir.Binary:
+		lhs, rhs := f.resolve(val.LHS), f.resolve(val.RHS)
+		switch val.Op {
+		case mir.EQ:
+			f.define(ident, f.eqExpr(f.typeOf(val.LHS), lhs, rhs), true)
+		case mir.NEQ:
+			if _, ok := f.typeOf(val.LHS).(*types.Float); ok {
+				// Ordered comparison as native code does. NaN is not unequal to anything
+				f.define(ident, fmt.Sprintf("(%s < %s || %s > %s)", lhs, rhs, lhs, rhs), true)
+				break
+			}
+			f.define(ident, "!"+f.eqExpr(f.typeOf(val.LHS), lhs, rhs), true)
+		default:
+			f.define(ident, fmt.Sprintf("%s %s %s", lhs, binaryOp(val.Op), rhs), true)
+		}
+	case *mir.Ref:
+		f.define(ident, f.resolve(val.Ident), true)
+	case *mir.If:
+		f.emitIf(ident, val)
+	case *mir.Fun:
+		panic("unreachable because IR was closure-transformed")
+	case *mir.App:
+		f.define(ident, f.callExpr(val), false)
+	case *mir.Tuple:
+		f.emitTuple(ident, val)
+	case *mir.TplLoad:
+		f.define(ident, fmt.Sprintf("%s->e%d", f.resolve(val.From), val.Index), true)
+	case *mir.Array:
+		f.emitArray(ident, val)
+	case *mir.ArrLit:
+		f.emitArrLit(ident, val)
+	case *mir.ArrLoad:
+		f.define(ident, fmt.Sprintf("%s.buf[%s]", f.resolve(val.From), f.resolve(val.Index)), true)
+	case *mir.ArrStore:
+		f.define(ident, fmt.Sprintf("%s.buf[%s] = %s", f.resolve(val.To), f.resolve(val.Index), f.resolve(val.RHS)), false)
+	case *mir.ArrLen:
+		f.define(ident, f.resolve(val.Array)+".size", true)
+	case *mir.BoundsCheck:
+		f.emitBoundsCheck(ident, val, insn.Pos)
+	case *mir.Table:
+		tbl, ok := f.typeOf(ident).(*types.Table)
+		if !ok {
+			panic("FATAL: Type of table instruction is not table")
+		}
+		f.define(ident, fmt.Sprintf("__gocaml_table_create(%s)", f.types.layoutOf(tbl.Value)), false)
+	case *mir.TblLoad:
+		f.emitTblLoad(ident, val)
+	case *mir.TblStore:
+		fn, key := f.tableCall("set", val.To, val.Key)
+		f.define(ident, fmt.Sprintf("%s(%s, %s, &%s)", fn, f.resolve(val.To), key, f.resolve(val.RHS)), false)
+	case *mir.TblRemove:
+		fn, key := f.tableCall("remove", val.From, val.Key)
+		f.define(ident, fmt.Sprintf("%s(%s, %s)", fn, f.resolve(val.From), key), false)
+	case *mir.XRef:
+		ext, ok := f.env.Externals[val.Ident]
+		if !ok {
+			panic("FATAL: Type for external value not found: " + val.Ident)
+		}
+		if w, ok := f.wrappers[val.Ident]; ok {
+			// External function used as a value is wrapped as a closure
+			f.define(ident, fmt.Sprintf("{(gocaml_fun) %s, NULL}", w), true)
+		} else {
+			f.define(ident, ext.CName, true)
+		}
+	case *mir.MakeCls:
+		f.emitMakeCls(ident, val)
+	case *mir.Some:
+		if nullable(f.optionTypeOf(ident).Elem) {
+			f.define(ident, f.resolve(val.Elem), true)
+			break
+		}
+		f.define(ident, fmt.Sprintf("{1, %s}", f.resolve(val.Elem)), true)
+	case *mir.None:
+		f.define(ident, noneValue(f.optionTypeOf(ident)), true)
+	case *mir.IsSome:
+		f.define(ident, isSomeExpr(f.optionTypeOf(val.OptVal), f.resolve(val.OptVal)), true)
+	case *mir.DerefSome:
+		if nullable(f.optionTypeOf(val.SomeVal).Elem) {
+			f.define(ident, f.resolve(val.SomeVal), true)
+			break
+		}
+		f.define(ident, f.resolve(val.SomeVal)+".value", true)
+	case *mir.Variant:
+		if val.Payload == "" {
+			f.define(ident, fmt.Sprintf("{%s, NULL}", tagExpr(val.Tag)), true)
+			break
+		}
+		p := f.resolve(val.Payload)
+		f.define(ident, fmt.Sprintf("{%s, gocaml_box(&%s, sizeof(%s))}", tagExpr(val.Tag), p, p), true)
+	case *mir.IsVariant:
+		f.define(ident, fmt.Sprintf("%s.tag == %s", f.resolve(val.Target), tagExpr(val.Tag)), true)
+	case *mir.VariantPayload:
+		f.define(ident, fmt.Sprintf("*(%s) %s.payload", ptrTo(f.cTypeOf(ident)), f.resolve(val.Target)), true)
+	case *mir.Unreachable:
+		// Preceding call never returns. The value is never used but needed to keep the instruction typed.
+		f.declareUninit(ident)
+	case *mir.Jump:
+		f.emitJump(ident, val)
+	case *mir.NOP:
+		panic("unreachable")
+	default:
+		panic("unreachable")
+	}
+}
+
+// emitBlock emits instructions in the block and returns the value of the block.
+func (f *funcEmitter) emitBlock(b *mir.Block) string {
+	last := ""
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		f.emitInsn(i)
+		last = i.Ident
+	}
+	return f.resolve(last)
+}
+
+// containsJump returns true when the block contains 'jump' instruction introduced by tail call
+// optimization.
+func containsJump(b *mir.Block) bool {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Jump:
+			return true
+		case *mir.If:
+			if containsJump(v.Then) || containsJump(v.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *funcEmitter) emitFun(insn mir.FunInsn) {
+	fun := insn.Val
+	ty := f.funTypeOf(insn.Name)
+	_, isClosure := f.prog.Closures[insn.Name]
+
+	ret := f.types.cType(ty.Ret)
+	params := make([]string, 0, len(fun.Params)+1)
+	protoParams := make([]string, 0, len(fun.Params)+1)
+	if isClosure {
+		params = append(params, "void *env")
+		protoParams = append(protoParams, "void *")
+	}
+	for _, p := range fun.Params {
+		n := f.local(p)
+		ty := f.cTypeOf(p)
+		params = append(params, declare(ty, n))
+		protoParams = append(protoParams, ty)
+		f.params = append(f.params, n)
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+		protoParams = append(protoParams, "void")
+	}
+
+	if isClosure {
+		// Expose captures of closure
+		for _, c := range f.prog.Closures[insn.Name] {
+			if isUnit(f.typeOf(c)) {
+				f.vals[c] = unitValue
+				continue
+			}
+			load := f.captureExpr(insn.Name, c, "env")
+			f.line("%s = %s;", declare(f.cTypeOf(c), f.local(c)), load)
+		}
+		if fun.IsRecursive {
+			// The closure itself is used in its body. Its closure object is made from its environment.
+			f.line("gocaml_closure %s = {(gocaml_fun) %s, env};", f.local(insn.Name), f.funcs[insn.Name])
+		}
+	}
+	if containsJump(fun.Body) {
+		f.body.WriteString("loop:;\n")
+	}
+	f.line("return %s;", f.emitBlock(fun.Body))
+
+	name := f.funcs[insn.Name]
+	fmt.Fprintf(&f.protos, "static %s(%s);\n", declare(ret, name), strings.Join(protoParams, ", "))
+	fmt.Fprintf(&f.defs, "/* %s %s */\n", insn.Name, insn.Pos.String())
+	fmt.Fprintf(&f.defs, "static %s(%s) {\n", declare(ret, name), strings.Join(params, ", "))
+	f.defs.Write(f.prologue.Bytes())
+	f.defs.Write(f.body.Bytes())
+	f.defs.WriteString("}\n\n")
+}
+
+func (f *funcEmitter) emitMain(entry *mir.Block) {
+	f.emitBlock(entry)
+	f.line("return 0;")
+	f.defs.WriteString("int __gocaml_main(void) {\n")
+	f.defs.Write(f.prologue.Bytes())
+	f.defs.Write(f.body.Bytes())
+	f.defs.WriteString("}\n")
+}
@@ -0,0 +1,229 @@
+package cgen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/types"
+	"strings"
+)
+
+// typeEmitter maps types of MIR to C types. Types which need definitions (tuples, arrays and
+// options) and layouts of values stored to tables are defined on demand in the order they are first
+// used, so that types of fields are always defined before the struct which contains them.
+type typeEmitter struct {
+	out   bytes.Buffer
+	names map[string]string
+	count int
+}
+
+func newTypeEmitter() *typeEmitter {
+	return &typeEmitter{names: map[string]string{}}
+}
+
+// define writes a definition of the type named by the key unless it was already defined. The
+// definition is built from the fields, which are already defined.
+func (t *typeEmitter) define(key, kind string, from types.Type, fields func(name string) string) string {
+	if n, ok := t.names[key]; ok {
+		return n
+	}
+	t.count++
+	name := fmt.Sprintf("gocaml_%s%d", kind, t.count)
+	def := fields(name)
+	fmt.Fprintf(&t.out, "/* %s */\n%s\n", from.String(), def)
+	t.names[key] = name
+	return name
+}
+
+func (t *typeEmitter) tupleOf(ty *types.Tuple) string {
+	elems := make([]string, 0, len(ty.Elems))
+	for _, e := range ty.Elems {
+		elems = append(elems, t.cType(e))
+	}
+	name := t.define("tuple:"+strings.Join(elems, ","), "tuple", ty, func(name string) string {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "struct %s {\n", name)
+		for i, e := range elems {
+			fmt.Fprintf(&b, "    %s e%d;\n", e, i)
+		}
+		b.WriteString("};")
+		return b.String()
+	})
+	return "struct " + name + " *"
+}
+
+func (t *typeEmitter) arrayOf(ty *types.Array) string {
+	elem := t.cType(ty.Elem)
+	return t.define("array:"+elem, "array", ty, func(name string) string {
+		// Layout is the same as gocaml_array in runtime
+		return fmt.Sprintf("typedef struct {\n    %s *buf;\n    gocaml_int size;\n} %s;", elem, name)
+	})
+}
+
+// nullable returns whether None of options of the type is represented as a null pointer. Options
+// of strings, functions, arrays and pointers reuse the representation of their elements as the LLVM
+// backend does, so that runtime functions can return nullable values as options.
+func nullable(elem types.Type) bool {
+	switch ty := elem.(type) {
+	case *types.String, *types.Fun, *types.Array, *types.Tuple, *types.Table, *types.Buffer, *types.Json:
+		return true
+	case *types.Var:
+		return ty.Ref != nil && nullable(ty.Ref)
+	default:
+		return false
+	}
+}
+
+// nullPointer returns the expression of the heap pointer in the value which is null when the
+// nullable option is None.
+func nullPointer(elem types.Type, v string) string {
+	switch ty := elem.(type) {
+	case *types.String:
+		return v + ".chars"
+	case *types.Fun:
+		return v + ".fun"
+	case *types.Array:
+		return v + ".buf"
+	case *types.Var:
+		return nullPointer(ty.Ref, v)
+	default:
+		return v
+	}
+}
+
+// noneValue returns the initializer of None of the option type.
+func noneValue(ty *types.Option) string {
+	if !nullable(ty.Elem) {
+		return "{0}"
+	}
+	switch nullPointer(ty.Elem, "") {
+	case "":
+		return "NULL"
+	case ".fun":
+		return "{NULL, NULL}"
+	default:
+		return "{NULL, 0}"
+	}
+}
+
+// isSomeExpr returns an expression which checks the option value is not None.
+func isSomeExpr(ty *types.Option, v string) string {
+	if !nullable(ty.Elem) {
+		return v + ".some"
+	}
+	return fmt.Sprintf("(%s != NULL)", nullPointer(ty.Elem, v))
+}
+
+func (t *typeEmitter) optionOf(ty *types.Option) string {
+	elem := t.cType(ty.Elem)
+	if nullable(ty.Elem) {
+		return elem
+	}
+	return t.define("option:"+elem, "option", ty, func(name string) string {
+		return fmt.Sprintf("typedef struct {\n    gocaml_bool some;\n    %s value;\n} %s;", elem, name)
+	})
+}
+
+// pointerOffsets returns C expressions of byte offsets of heap pointers in a value of the type.
+// 'base' is the offset of the value in the outermost value.
+func (t *typeEmitter) pointerOffsets(from types.Type, base []string) []string {
+	at := func(field ...string) string {
+		terms := append(append([]string{}, base...), field...)
+		if len(terms) == 0 {
+			return "0"
+		}
+		return strings.Join(terms, " + ")
+	}
+	switch ty := from.(type) {
+	case *types.String:
+		return []string{at("offsetof(gocaml_string, chars)")}
+	case *types.Fun:
+		return []string{at("offsetof(gocaml_closure, env)")}
+	case *types.Tuple, *types.Table, *types.Buffer, *types.Json:
+		return []string{at()}
+	case *types.Array:
+		return []string{at(fmt.Sprintf("offsetof(%s, buf)", t.arrayOf(ty)))}
+	case *types.Option:
+		if nullable(ty.Elem) {
+			return t.pointerOffsets(ty.Elem, base)
+		}
+		field := fmt.Sprintf("offsetof(%s, value)", t.optionOf(ty))
+		return t.pointerOffsets(ty.Elem, append(append([]string{}, base...), field))
+	case *types.Variant, *types.Result:
+		return []string{at("offsetof(gocaml_variant, payload)")}
+	case *types.Var:
+		if ty.Ref != nil {
+			return t.pointerOffsets(ty.Ref, base)
+		}
+		panic("FATAL: Type variable remains in C backend. Program must be monomorphized")
+	default:
+		return nil
+	}
+}
+
+// layoutOf returns a pointer to the layout of values of the type. Runtime copies values stored to
+// tables following it.
+func (t *typeEmitter) layoutOf(from types.Type) string {
+	ty := t.cType(from)
+	offsets := t.pointerOffsets(from, nil)
+	name := t.define("layout:"+ty, "layout", from, func(name string) string {
+		if len(offsets) == 0 {
+			return fmt.Sprintf("static gocaml_layout const %s = {sizeof(%s), 0, NULL};", name, ty)
+		}
+		return fmt.Sprintf(
+			"static size_t const %s_offsets[] = {%s};\nstatic gocaml_layout const %s = {sizeof(%s), %d, %s_offsets};",
+			name,
+			strings.Join(offsets, ", "),
+			name,
+			ty,
+			len(offsets),
+			name,
+		)
+	})
+	return "&" + name
+}
+
+// cType returns the C type of the type. Type of function values is always closure because
+// functions are never values except for closures after closure transform.
+func (t *typeEmitter) cType(from types.Type) string {
+	switch ty := from.(type) {
+	case *types.Unit:
+		return "gocaml_unit"
+	case *types.Bool:
+		return "gocaml_bool"
+	case *types.Int:
+		return "gocaml_int"
+	case *types.Float:
+		return "gocaml_float"
+	case *types.String:
+		return "gocaml_string"
+	case *types.Fun:
+		return "gocaml_closure"
+	case *types.Tuple:
+		return t.tupleOf(ty)
+	case *types.Array:
+		return t.arrayOf(ty)
+	case *types.Option:
+		return t.optionOf(ty)
+	case *types.Table, *types.Buffer, *types.Json:
+		// Opaque pointer to hash table, buffer or JSON value in runtime
+		return "void *"
+	case *types.Variant, *types.Result:
+		// Tag hash and boxed payload as the LLVM backend does
+		return "gocaml_variant"
+	case *types.Var:
+		if ty.Ref != nil {
+			return t.cType(ty.Ref)
+		}
+		panic("FATAL: Type variable remains in C backend. Program must be monomorphized")
+	default:
+		panic("FATAL: Unknown type in C backend: " + from.String())
+	}
+}
+
+// declare returns a declaration of the variable with the type. Spacing is adjusted for pointers.
+func declare(ty, name string) string {
+	if strings.HasSuffix(ty, "*") {
+		return ty + name
+	}
+	return ty + " " + name
+}
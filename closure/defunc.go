@@ -0,0 +1,566 @@
+package closure
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"sort"
+)
+
+// Note:
+// Defunctionalization is a whole-program alternative to closures. Every function type is replaced
+// with a polymorphic variant type whose tags are the functions of the type. Captures of a closure
+// are the payload of its tag. Calling a function value is a direct call to the dispatch function of
+// the type, which checks the tag and calls the function directly with the captures.
+//   x$t1 = int 1
+//   f$t2 = makecls (x$t1) f$t2
+//   $k3 = app h$t4 f$t2
+//   (in body of h$t4) $k1 = appcls k$t5 a$t6
+// is converted into
+//   x$t1 = int 1
+//   f$t2$d1 = variant f$t2 x$t1
+//   $k3 = app h$t4 f$t2$d1
+//   (in body of h$t4) $k1 = app apply$d2 k$t5,a$t6
+//   (in body of apply$d2; apply$d2 = fun $d3,$d4)
+//     $d5 = variantpayload $d3
+//     $d6 = app f$t2 $d4,$d5
+//   (in body of f$t2; f$t2 = fun a$t7,x$t1$d7) ...
+// When a closure captures more than one variable, the payload is a tuple of them.
+// No indirect call remains in the program. It is useful for targets which do not support indirect
+// calls well. Function values called where they are made and recursive closures calling themselves
+// are called directly without the dispatch function.
+//
+// Since closure objects are no longer made, function values cannot be passed to or returned from
+// external functions.
+
+// Runtime function which reports the failure of 'assert' and aborts the program
+const assertFailName = "__assert_fail$builtin"
+
+// shape is a function type and the variant type which replaces it.
+type shape struct {
+	ty      *types.Fun
+	variant *types.Variant
+	// Functions whose values have the type. Value is true when the function is external.
+	tags map[string]bool
+	// Dispatch function. It is empty until the function values are called.
+	apply string
+	pos   locerr.Pos
+}
+
+// makeSite is a function value made by 'makecls' or 'xref' instruction.
+type makeSite struct {
+	owner    string
+	fun      string
+	vars     []string
+	external bool
+}
+
+type defunctionalizer struct {
+	prog   *mir.Program
+	env    *types.Env
+	shapes map[string]*shape
+	order  []*shape
+	// Variant types of shapes. They are never converted again.
+	variants map[*types.Variant]struct{}
+	// Captures of closures before transform
+	captures mir.Closures
+	// Function values by their new identifiers
+	makes map[string]makeSite
+	// Types of functions and identifiers before transform are needed until all instructions are
+	// converted. New types are set to the declaration table at the end.
+	converted map[string]types.Type
+	count     int
+}
+
+func (d *defunctionalizer) fresh(prefix string) string {
+	d.count++
+	return fmt.Sprintf("%s$d%d", prefix, d.count)
+}
+
+func (d *defunctionalizer) funTypeOf(name string) *types.Fun {
+	ty, ok := d.env.DeclTable[name].(*types.Fun)
+	if !ok {
+		panic(fmt.Sprintf("FATAL: Type of function value '%s' is not a function type: %s", name, d.env.DeclTable[name]))
+	}
+	return ty
+}
+
+func (d *defunctionalizer) shapeOf(ty *types.Fun) *shape {
+	key := ty.String()
+	if s, ok := d.shapes[key]; ok {
+		return s
+	}
+	s := &shape{ty, &types.Variant{}, map[string]bool{}, "", locerr.Pos{}}
+	d.shapes[key] = s
+	d.order = append(d.order, s)
+	d.variants[s.variant] = struct{}{}
+	return s
+}
+
+func (d *defunctionalizer) typeOf(ty types.Type) types.Type {
+	switch ty := ty.(type) {
+	case *types.Fun:
+		return d.shapeOf(ty).variant
+	case *types.Tuple:
+		return &types.Tuple{d.typesOf(ty.Elems)}
+	case *types.Array:
+		return &types.Array{d.typeOf(ty.Elem)}
+	case *types.Option:
+		return &types.Option{d.typeOf(ty.Elem)}
+	case *types.Result:
+		return &types.Result{d.typeOf(ty.Ok), d.typeOf(ty.Error)}
+	case *types.Table:
+		return &types.Table{ty.Key, d.typeOf(ty.Value)}
+	case *types.Variant:
+		if _, ok := d.variants[ty]; ok {
+			return ty
+		}
+		tags, row := ty.Flatten()
+		converted := make([]*types.VariantTag, 0, len(tags))
+		for _, t := range tags {
+			payload := t.Payload
+			if payload != nil {
+				payload = d.typeOf(payload)
+			}
+			converted = append(converted, &types.VariantTag{t.Name, payload})
+		}
+		if row == nil {
+			return &types.Variant{converted, nil}
+		}
+		return &types.Variant{converted, row}
+	case *types.Var:
+		if ty.Ref != nil {
+			return d.typeOf(ty.Ref)
+		}
+		return ty
+	default:
+		return ty
+	}
+}
+
+func (d *defunctionalizer) typesOf(tys []types.Type) []types.Type {
+	converted := make([]types.Type, 0, len(tys))
+	for _, t := range tys {
+		converted = append(converted, d.typeOf(t))
+	}
+	return converted
+}
+
+func (d *defunctionalizer) typesOfNames(names []string) []types.Type {
+	tys := make([]types.Type, 0, len(names))
+	for _, n := range names {
+		tys = append(tys, d.env.DeclTable[n])
+	}
+	return tys
+}
+
+func hasFunType(ty types.Type) bool {
+	switch ty := ty.(type) {
+	case *types.Fun:
+		return true
+	case *types.Tuple:
+		for _, e := range ty.Elems {
+			if hasFunType(e) {
+				return true
+			}
+		}
+		return false
+	case *types.Array:
+		return hasFunType(ty.Elem)
+	case *types.Option:
+		return hasFunType(ty.Elem)
+	case *types.Result:
+		return hasFunType(ty.Ok) || hasFunType(ty.Error)
+	case *types.Table:
+		return hasFunType(ty.Value)
+	case *types.Variant:
+		tags, _ := ty.Flatten()
+		for _, t := range tags {
+			if t.Payload != nil && hasFunType(t.Payload) {
+				return true
+			}
+		}
+		return false
+	case *types.Var:
+		return ty.Ref != nil && hasFunType(ty.Ref)
+	default:
+		return false
+	}
+}
+
+// checkExternal returns an error when function values are passed to or returned from the external
+// function since functions in C cannot call variants.
+func (d *defunctionalizer) checkExternal(insn *mir.Insn, name string, tys []types.Type) error {
+	for _, t := range tys {
+		if hasFunType(t) {
+			return locerr.ErrorfAt(insn.Pos, "Function value cannot be passed to or returned from external function '%s' since closures are defunctionalized", name)
+		}
+	}
+	return nil
+}
+
+func renamer(renamed map[string]string) func(string) string {
+	return func(n string) string {
+		if r, ok := renamed[n]; ok {
+			return r
+		}
+		return n
+	}
+}
+
+// renameValues renames operands of the instruction. Callees of direct calls and external calls are
+// not renamed since they are names of functions.
+func renameValues(val mir.Val, rename func(string) string) {
+	if app, ok := val.(*mir.App); ok && app.Kind != mir.CLOSURE_CALL {
+		for i, a := range app.Args {
+			app.Args[i] = rename(a)
+		}
+		return
+	}
+	mir.RenameOperands(val, rename)
+}
+
+func insertBefore(insn, pos *mir.Insn) {
+	insn.Prev = pos.Prev
+	insn.Next = pos
+	pos.Prev.Next = insn
+	pos.Prev = insn
+}
+
+// makeTag replaces the instruction with a variant whose payload is a tuple of the captures. When
+// only one variable is captured, the variable is the payload.
+func (d *defunctionalizer) makeTag(insn *mir.Insn, fun string, vars []string) {
+	switch len(vars) {
+	case 0:
+		insn.Val = &mir.Variant{fun, ""}
+		return
+	case 1:
+		insn.Val = &mir.Variant{fun, vars[0]}
+		return
+	}
+	tpl := d.fresh("")
+	d.env.DeclTable[tpl] = &types.Tuple{d.typesOf(d.typesOfNames(vars))}
+	insertBefore(mir.NewInsn(tpl, &mir.Tuple{vars}, insn.Pos), insn)
+	insn.Val = &mir.Variant{fun, tpl}
+}
+
+// rewrite converts instructions in the body of the function. Owner is empty for the entry point.
+// Closures whose identifiers are the same as function names are renamed since the names are
+// declared as functions.
+func (d *defunctionalizer) rewrite(owner string, b *mir.Block, renamed map[string]string) error {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		renameValues(i.Val, renamer(renamed))
+		switch v := i.Val.(type) {
+		case *mir.MakeCls:
+			s := d.shapeOf(d.funTypeOf(v.Fun))
+			s.tags[v.Fun] = false
+			if _, ok := d.prog.Toplevel[i.Ident]; ok {
+				n := d.fresh(i.Ident)
+				renamed[i.Ident] = n
+				i.Ident = n
+				d.env.DeclTable[n] = s.variant
+			}
+			d.makes[i.Ident] = makeSite{owner, v.Fun, v.Vars, false}
+			d.makeTag(i, v.Fun, v.Vars)
+		case *mir.XRef:
+			ext, ok := d.env.Externals[v.Ident]
+			if !ok {
+				break
+			}
+			if ty, ok := ext.Type.(*types.Fun); ok {
+				if err := d.checkExternal(i, v.Ident, append([]types.Type{ty.Ret}, ty.Params...)); err != nil {
+					return err
+				}
+				d.shapeOf(ty).tags[v.Ident] = true
+				d.makes[i.Ident] = makeSite{owner, v.Ident, nil, true}
+				i.Val = &mir.Variant{v.Ident, ""}
+			}
+		case *mir.App:
+			switch v.Kind {
+			case mir.EXTERNAL_CALL:
+				if err := d.checkExternal(i, v.Callee, append(d.typesOfNames(v.Args), d.env.DeclTable[i.Ident])); err != nil {
+					return err
+				}
+			case mir.CLOSURE_CALL:
+				if owner != "" && v.Callee == owner {
+					// Recursive closure calls itself with its own captures
+					v.Args = append(v.Args, d.captures[owner]...)
+					v.Kind = mir.DIRECT_CALL
+					break
+				}
+				if site, ok := d.makes[v.Callee]; ok && site.owner == owner {
+					// Function value is called where its captures are visible
+					v.Callee = site.fun
+					if site.external {
+						v.Kind = mir.EXTERNAL_CALL
+						break
+					}
+					v.Args = append(v.Args, site.vars...)
+					v.Kind = mir.DIRECT_CALL
+					break
+				}
+				s := d.shapeOf(d.funTypeOf(v.Callee))
+				if s.apply == "" {
+					s.apply = d.fresh("apply")
+					s.pos = i.Pos
+				}
+				v.Args = append([]string{v.Callee}, v.Args...)
+				v.Callee = s.apply
+				v.Kind = mir.DIRECT_CALL
+			}
+		case *mir.If:
+			if err := d.rewrite(owner, v.Then, renamed); err != nil {
+				return err
+			}
+			if err := d.rewrite(owner, v.Else, renamed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *defunctionalizer) visitBlock(b *mir.Block, visit func(*mir.Insn)) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		visit(i)
+		if v, ok := i.Val.(*mir.If); ok {
+			d.visitBlock(v.Then, visit)
+			d.visitBlock(v.Else, visit)
+		}
+	}
+}
+
+// convertFun turns captures of the function into its parameters. When the function refers itself
+// as a value, the value is made at the beginning of the body.
+func (d *defunctionalizer) convertFun(name string) {
+	insn := d.prog.Toplevel[name]
+	fun := insn.Val
+	ty := d.funTypeOf(name)
+	caps := d.captures[name]
+
+	renamed := make(map[string]string, len(caps))
+	params := make([]string, 0, len(caps))
+	for _, c := range caps {
+		p := d.fresh(c)
+		renamed[c] = p
+		params = append(params, p)
+		d.env.DeclTable[p] = d.typeOf(d.env.DeclTable[c])
+	}
+	d.converted[name] = &types.Fun{d.typeOf(ty.Ret), d.typesOf(append(d.typesOfNames(fun.Params), d.typesOfNames(caps)...))}
+	fun.Params = append(fun.Params, params...)
+
+	used := false
+	d.visitBlock(fun.Body, func(i *mir.Insn) {
+		renameValues(i.Val, renamer(renamed))
+		renameValues(i.Val, func(n string) string {
+			used = used || n == name
+			return n
+		})
+		if j, ok := i.Val.(*mir.Jump); ok {
+			// 'jump' assigns all parameters. Captures are passed as they are
+			j.Args = append(j.Args, params...)
+		}
+	})
+	if !used {
+		return
+	}
+
+	self := d.fresh(name)
+	d.visitBlock(fun.Body, func(i *mir.Insn) {
+		renameValues(i.Val, renamer(map[string]string{name: self}))
+	})
+	s := d.shapeOf(ty)
+	s.tags[name] = false
+	d.env.DeclTable[self] = s.variant
+	i := mir.NewInsn(self, mir.NOPVal, insn.Pos)
+	fun.Body.Prepend(i)
+	d.makeTag(i, name, params)
+}
+
+// callTag calls the function of the tag with the arguments and the captures in the payload.
+func (d *defunctionalizer) callTag(s *shape, cls string, args []string, tag string) []*mir.Insn {
+	if s.tags[tag] {
+		ret := d.fresh("")
+		d.env.DeclTable[ret] = d.typeOf(s.ty.Ret)
+		return []*mir.Insn{mir.NewInsn(ret, &mir.App{tag, args, mir.EXTERNAL_CALL}, s.pos)}
+	}
+
+	insns := []*mir.Insn{}
+	callArgs := make([]string, 0, len(args)+len(d.captures[tag]))
+	callArgs = append(callArgs, args...)
+	switch caps := d.captures[tag]; len(caps) {
+	case 0:
+	case 1:
+		payload := d.fresh("")
+		d.env.DeclTable[payload] = d.typeOf(d.env.DeclTable[caps[0]])
+		insns = append(insns, mir.NewInsn(payload, &mir.VariantPayload{cls}, s.pos))
+		callArgs = append(callArgs, payload)
+	default:
+		payload := d.fresh("")
+		d.env.DeclTable[payload] = &types.Tuple{d.typesOf(d.typesOfNames(caps))}
+		insns = append(insns, mir.NewInsn(payload, &mir.VariantPayload{cls}, s.pos))
+		for idx, c := range caps {
+			e := d.fresh("")
+			d.env.DeclTable[e] = d.typeOf(d.env.DeclTable[c])
+			insns = append(insns, mir.NewInsn(e, &mir.TplLoad{payload, idx}, s.pos))
+			callArgs = append(callArgs, e)
+		}
+	}
+	ret := d.fresh("")
+	d.env.DeclTable[ret] = d.typeOf(s.ty.Ret)
+	return append(insns, mir.NewInsn(ret, &mir.App{tag, callArgs, mir.DIRECT_CALL}, s.pos))
+}
+
+func (d *defunctionalizer) dispatch(s *shape, cls string, args []string, tags []string) []*mir.Insn {
+	if len(tags) == 0 {
+		// No value of the function type is made in the monomorphic program so the dispatch function
+		// is never called at runtime. In case it is called, it aborts the program as failed 'assert'.
+		msg := d.fresh("")
+		d.env.DeclTable[msg] = types.StringType
+		text := fmt.Sprintf("no function value of type '%s' is made", s.ty.String())
+		call := d.fresh("")
+		d.env.DeclTable[call] = types.UnitType
+		ret := d.fresh("")
+		d.env.DeclTable[ret] = d.typeOf(s.ty.Ret)
+		return []*mir.Insn{
+			mir.NewInsn(msg, &mir.String{text}, s.pos),
+			mir.NewInsn(call, &mir.App{assertFailName, []string{msg}, mir.EXTERNAL_CALL}, s.pos),
+			mir.NewInsn(ret, mir.UnreachableVal, s.pos),
+		}
+	}
+	call := d.callTag(s, cls, args, tags[0])
+	if len(tags) == 1 {
+		// Only one function remains. Checking the tag is not necessary.
+		return call
+	}
+	cond := d.fresh("")
+	d.env.DeclTable[cond] = types.BoolType
+	then := mir.NewBlockFromArray("then", call)
+	els := mir.NewBlockFromArray("else", d.dispatch(s, cls, args, tags[1:]))
+	ret := d.fresh("")
+	d.env.DeclTable[ret] = d.typeOf(s.ty.Ret)
+	return []*mir.Insn{
+		mir.NewInsn(cond, &mir.IsVariant{cls, tags[0]}, s.pos),
+		mir.NewInsn(ret, &mir.If{cond, then, els}, s.pos),
+	}
+}
+
+// buildApply adds the dispatch function of the shape to toplevel. It takes a function value and
+// arguments, and calls the function of the tag of the value.
+func (d *defunctionalizer) buildApply(s *shape) {
+	cls := d.fresh("")
+	d.env.DeclTable[cls] = s.variant
+	params := []string{cls}
+	for _, t := range s.ty.Params {
+		p := d.fresh("")
+		d.env.DeclTable[p] = d.typeOf(t)
+		params = append(params, p)
+	}
+	d.env.DeclTable[s.apply] = &types.Fun{d.typeOf(s.ty.Ret), d.typesOfNames(params)}
+
+	tags := make([]string, 0, len(s.tags))
+	for t := range s.tags {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	body := mir.NewBlockFromArray(fmt.Sprintf("body (%s)", s.apply), d.dispatch(s, cls, params[1:], tags))
+	d.prog.Toplevel.Add(s.apply, &mir.Fun{params, body, false}, s.pos)
+}
+
+// tagsOf returns tags of the variant type of the shape. Payloads of the tags are types of captures
+// before transform in order to avoid recursive types. Types of values loaded from the payloads are
+// in the declaration table.
+func (d *defunctionalizer) tagsOf(s *shape) []*types.VariantTag {
+	tags := make([]*types.VariantTag, 0, len(s.tags))
+	for name, external := range s.tags {
+		var payload types.Type
+		if caps := d.captures[name]; !external && len(caps) == 1 {
+			payload = d.env.DeclTable[caps[0]]
+		} else if !external && len(caps) > 1 {
+			payload = &types.Tuple{d.typesOfNames(caps)}
+		}
+		tags = append(tags, &types.VariantTag{name, payload})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags
+}
+
+// Defunctionalize replaces all closures and function values in the program with variants. Closure
+// calls are replaced with direct calls to dispatch functions generated for each function type.
+// After the transform, the program has no closure. It must be applied right after closure transform
+// since captures and variables of 'makecls' instructions must have the same names. Types in the
+// program must be monomorphic. It returns an error when the program is polymorphic or a function
+// value is passed to or returned from an external function.
+func Defunctionalize(prog *mir.Program, env *types.Env) error {
+	if err := prog.CheckMonomorphic(env, "defunctionalization"); err != nil {
+		return err
+	}
+	captures := make(mir.Closures, len(prog.Closures))
+	for n, c := range prog.Closures {
+		// Variables of 'makecls' instructions may share the slice. They are renamed while rewriting
+		captures[n] = append([]string{}, c...)
+	}
+	d := &defunctionalizer{
+		prog,
+		env,
+		map[string]*shape{},
+		[]*shape{},
+		map[*types.Variant]struct{}{},
+		captures,
+		map[string]makeSite{},
+		map[string]types.Type{},
+		0,
+	}
+
+	names := prog.Toplevel.Names()
+	values := []string{}
+	collect := func(i *mir.Insn) {
+		values = append(values, i.Ident)
+	}
+	for _, n := range names {
+		fun := prog.Toplevel[n].Val
+		values = append(values, fun.Params...)
+		d.visitBlock(fun.Body, collect)
+	}
+	d.visitBlock(prog.Entry, collect)
+
+	for _, n := range names {
+		if err := d.rewrite(n, prog.Toplevel[n].Val.Body, map[string]string{}); err != nil {
+			return err
+		}
+	}
+	if err := d.rewrite("", prog.Entry, map[string]string{}); err != nil {
+		return err
+	}
+	for _, n := range names {
+		d.convertFun(n)
+	}
+	for _, s := range d.order {
+		if s.apply != "" {
+			d.buildApply(s)
+		}
+	}
+	for _, s := range d.order {
+		s.variant.Tags = d.tagsOf(s)
+	}
+
+	for _, n := range values {
+		if _, ok := d.converted[n]; ok {
+			// Closure was renamed since its identifier is the same as the function name
+			continue
+		}
+		env.DeclTable[n] = d.typeOf(env.DeclTable[n])
+	}
+	for n, t := range d.converted {
+		env.DeclTable[n] = t
+	}
+
+	prog.Closures = mir.Closures{}
+	prog.StackAllocated = map[string]struct{}{}
+	prog.SharedEnvs = map[string]string{}
+	prog.EnvLinks = map[string]string{}
+	return nil
+}
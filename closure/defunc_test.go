@@ -0,0 +1,204 @@
+package closure
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func defunctionalize(t *testing.T, code string) (*mir.Program, *types.Env, error) {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mir.ElimRefs(ir, env)
+	prog := Transform(ir)
+	return prog, env, Defunctionalize(prog, env)
+}
+
+func directCalls(b *mir.Block) []string {
+	calls := []string{}
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.App:
+			if v.Kind == mir.DIRECT_CALL {
+				calls = append(calls, v.Callee)
+			}
+		case *mir.If:
+			calls = append(calls, directCalls(v.Then)...)
+			calls = append(calls, directCalls(v.Else)...)
+		}
+	}
+	return calls
+}
+
+func TestDefunctionalize(t *testing.T) {
+	cases := []struct {
+		what   string
+		code   string
+		params map[string][]string
+		calls  map[string][]string
+		tags   []string
+	}{
+		{
+			what:   "closure passed to function",
+			code:   "let x = 1 in let rec f a = a + x in let rec h (k : int -> int) = k 1 in print_int (h f)",
+			params: map[string][]string{"f$t2": {"a$t3", "x$t1$d3"}, "h$t4": {"k$t5"}},
+			calls:  map[string][]string{"h$t4": {"apply$d1"}, "apply$d1": {"f$t2"}},
+			tags:   []string{"f$t2"},
+		},
+		{
+			what:   "closure called where it is made",
+			code:   "let x = 1 in let rec f a = a + x in print_int (f 2)",
+			params: map[string][]string{"f$t2": {"a$t3", "x$t1$d2"}},
+			calls:  map[string][]string{},
+		},
+		{
+			what:   "recursive closure",
+			code:   "let x = 1 in let rec f a = if a < 0 then x else f (a - 1) in let rec h (k : int -> int) = k 1 in print_int (h f)",
+			params: map[string][]string{"f$t2": {"a$t3", "x$t1$d3"}},
+			calls:  map[string][]string{"f$t2": {"f$t2"}, "h$t4": {"apply$d1"}},
+			tags:   []string{"f$t2"},
+		},
+		{
+			what:   "closures and function of the same type",
+			code:   "let x = 1 in let y = 2 in let rec f a = a + x + y in let rec g b = f b in let rec i (c : int) = c in let rec h (k : int -> int) = k 1 in print_int (h f + h g + h i)",
+			params: map[string][]string{"f$t3": {"a$t4", "x$t1$d6", "y$t2$d7"}, "g$t5": {"b$t6", "f$t3$d8"}, "i$t7": {"c$t8"}},
+			calls:  map[string][]string{"g$t5": {"apply$d1"}, "apply$d1": {"f$t3", "g$t5", "i$t7"}},
+			tags:   []string{"f$t3", "g$t5", "i$t7"},
+		},
+		{
+			what:   "external function used as value",
+			code:   "let rec h (k : int -> unit) = k 1 in h print_int",
+			params: map[string][]string{"h$t1": {"k$t2"}},
+			calls:  map[string][]string{"h$t1": {"apply$d1"}},
+			tags:   []string{"print_int"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			prog, env, err := defunctionalize(t, tc.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mir.Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+			if len(prog.Closures) != 0 {
+				t.Errorf("Closures remain: %v", prog.Closures)
+			}
+
+			for name, want := range tc.params {
+				f, ok := prog.Toplevel[name]
+				if !ok {
+					t.Fatalf("Function '%s' not found", name)
+				}
+				if !reflect.DeepEqual(f.Val.Params, want) {
+					t.Errorf("Wanted parameters %v for '%s' but got %v", want, name, f.Val.Params)
+				}
+				ty := env.DeclTable[name].(*types.Fun)
+				if len(ty.Params) != len(want) {
+					t.Errorf("Type of '%s' does not match to its parameters: %s", name, ty.String())
+				}
+			}
+			for name, want := range tc.calls {
+				f, ok := prog.Toplevel[name]
+				if !ok {
+					t.Fatalf("Function '%s' not found", name)
+				}
+				if calls := directCalls(f.Val.Body); !reflect.DeepEqual(calls, want) {
+					t.Errorf("Wanted direct calls %v in '%s' but got %v", want, name, calls)
+				}
+			}
+
+			for _, name := range prog.Toplevel.Names() {
+				if !strings.HasPrefix(name, "apply$") {
+					continue
+				}
+				if tc.tags == nil {
+					t.Fatalf("Unexpected dispatch function '%s'", name)
+				}
+				v, ok := env.DeclTable[prog.Toplevel[name].Val.Params[0]].(*types.Variant)
+				if !ok {
+					t.Fatalf("Function value passed to '%s' is not a variant", name)
+				}
+				tags := make([]string, 0, len(v.Tags))
+				for _, tag := range v.Tags {
+					tags = append(tags, tag.Name)
+				}
+				if !reflect.DeepEqual(tags, tc.tags) {
+					t.Errorf("Wanted tags %v but got %v", tc.tags, tags)
+				}
+			}
+		})
+	}
+}
+
+func TestDefunctionalizeSelfReference(t *testing.T) {
+	prog, env, err := defunctionalize(t, "let x = 1 in let rec h (k : int -> int) = k 0 in let rec f a = if a > 10 then a + x else h f + a in print_int (f 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mir.Verify(prog); err != nil {
+		t.Fatal(err)
+	}
+	first := prog.Toplevel["f$t4"].Val.Body.Top.Next
+	v, ok := first.Val.(*mir.Variant)
+	if !ok {
+		t.Fatalf("Function referring itself should make its value at first: %v", first.Val)
+	}
+	if v.Tag != "f$t4" || v.Payload != "x$t1$d3" {
+		t.Errorf("Unexpected value of function: %v", v)
+	}
+	if _, ok := env.DeclTable[first.Ident].(*types.Variant); !ok {
+		t.Errorf("Type of function value is not a variant: %s", env.DeclTable[first.Ident].String())
+	}
+}
+
+func TestDefunctionalizeExternalError(t *testing.T) {
+	_, _, err := defunctionalize(t, "external apply_int: (int -> int) -> int = \"apply_int\"; let rec f a = a + 1 in print_int (apply_int f)")
+	if err == nil {
+		t.Fatal("Error should occur")
+	}
+	want := "Function value cannot be passed to or returned from external function 'apply_int'"
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("Unexpected error message '%s'. It should contain '%s'", err.Error(), want)
+	}
+}
+
+func TestDefunctionalizePolymorphicError(t *testing.T) {
+	_, _, err := defunctionalize(t, "let rec ap f x = f x in let rec inc x = x + 1 in print_int (ap inc 1); print_bool (ap (fun b -> not b) true)")
+	if err == nil {
+		t.Fatal("Error should occur")
+	}
+	want := "defunctionalization needs monomorphic types"
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("Unexpected error message '%s'. It should contain '%s'", err.Error(), want)
+	}
+}
+
+func TestDefunctionalizeNoFunctionValue(t *testing.T) {
+	prog, _, err := defunctionalize(t, "let rec h (k : int -> int) = k 1 in print_int 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mir.Verify(prog); err != nil {
+		t.Fatal(err)
+	}
+	body := prog.Toplevel["apply$d1"].Val.Body
+	app, ok := body.Top.Next.Next.Val.(*mir.App)
+	if !ok || app.Kind != mir.EXTERNAL_CALL || app.Callee != assertFailName {
+		t.Fatalf("Dispatch function without function value should abort the program: %v", body.Top.Next.Next.Val)
+	}
+}
@@ -1,131 +1,156 @@
 package closure
 
 import (
-	"fmt"
 	"github.com/rhysd/gocaml/mir"
 )
 
-type freeVarsGatherer struct {
-	found     nameSet
-	transform *transformWithKFO
+// funInfo is a summary of the body of a function (or the entry point) collected by one traversal.
+// Free variables of the function are calculated from the summary without visiting its body again.
+type funInfo struct {
+	name string
+	// Instruction defining the function. It is nil for the entry point
+	insn *mir.Insn
+	fun  *mir.Fun
+	// Functions defined directly in the body in order of their definitions
+	children []*funInfo
+	// Identifiers used as values in the body
+	vals nameSet
+	// Callees of calls in the body. External symbols are not contained
+	calls nameSet
+	// Identifiers defined in the body including parameters and functions defined directly
+	locals nameSet
+	// First instructions using identifiers as values or callees. They are reported as the reasons of
+	// captures
+	sites map[string]*mir.Insn
+
+	// Identifiers captured by the function. Empty when the function is not a closure
+	captures nameSet
+	// True when the function is referred as a value and a closure object must be made
+	made bool
 }
 
-func (fvg *freeVarsGatherer) add(name string) {
-	fvg.found[name] = struct{}{}
+func newFunInfo(name string, insn *mir.Insn, fun *mir.Fun) *funInfo {
+	info := &funInfo{
+		name:     name,
+		insn:     insn,
+		fun:      fun,
+		vals:     nameSet{},
+		calls:    nameSet{},
+		locals:   nameSet{},
+		sites:    map[string]*mir.Insn{},
+		captures: nameSet{},
+	}
+	if fun != nil {
+		for _, p := range fun.Params {
+			info.locals[p] = struct{}{}
+		}
+	}
+	return info
 }
 
-func (fvg *freeVarsGatherer) exploreBlock(block *mir.Block) {
-	// Traverse instructions in the block in reverse order.
-	// First and last instructions are NOP, so skipped.
-	for i := block.Bottom.Prev; i.Prev != nil; i = i.Prev {
-		fvg.exploreInsn(i)
+func (info *funInfo) visit(insn *mir.Insn, n string) {
+	if _, ok := info.sites[n]; !ok {
+		info.sites[n] = insn
 	}
 }
 
-func (fvg *freeVarsGatherer) exploreTillTheEnd(insn *mir.Insn) {
-	end := insn
-	for end.Next.Next != nil {
-		// Find the last instruction before NOP
-		end = end.Next
+func (info *funInfo) use(insn *mir.Insn, names ...string) {
+	for _, n := range names {
+		info.vals[n] = struct{}{}
+		info.visit(insn, n)
 	}
-	for i := end; i != insn.Prev; i = i.Prev {
-		fvg.exploreInsn(i)
+}
+
+type funCollector struct {
+	// All functions in post order. Nested functions precede their enclosing function and the entry
+	// point is the last
+	funs []*funInfo
+	// Mapping names of functions to their summaries
+	byName map[string]*funInfo
+}
+
+func (col *funCollector) collectBlock(info *funInfo, block *mir.Block) {
+	begin, end := block.WholeRange()
+	for i := begin; i != end; i = i.Next {
+		col.collectInsn(info, i)
 	}
 }
 
-func (fvg *freeVarsGatherer) exploreInsn(insn *mir.Insn) {
+func (col *funCollector) collectInsn(info *funInfo, insn *mir.Insn) {
+	info.locals[insn.Ident] = struct{}{}
+
 	switch val := insn.Val.(type) {
 	case *mir.Unary:
-		fvg.add(val.Child)
+		info.use(insn, val.Child)
 	case *mir.Binary:
-		fvg.add(val.LHS)
-		fvg.add(val.RHS)
+		info.use(insn, val.LHS, val.RHS)
 	case *mir.Ref:
-		fvg.add(val.Ident)
+		info.use(insn, val.Ident)
 	case *mir.If:
-		fvg.add(val.Cond)
-		fvg.exploreBlock(val.Then)
-		fvg.exploreBlock(val.Else)
+		info.use(insn, val.Cond)
+		col.collectBlock(info, val.Then)
+		col.collectBlock(info, val.Else)
 	case *mir.App:
-		// Should not add val.Callee to free variables if it is not a closure
-		// because a normal function is treated as label, not a variable
-		// (label is a constant).
-		// `_, ok := fvg.transform.closures[val.Callee]; ok` cannot be used
-		// because callee may be a function variable, which also must be treated
-		// as closure call.
-		if _, ok := fvg.transform.knownFuns[val.Callee]; !ok && val.Kind != mir.EXTERNAL_CALL {
-			fvg.add(val.Callee)
-		}
-		for _, a := range val.Args {
-			fvg.add(a)
+		// Whether the callee is a free variable or not depends on whether it is a known function.
+		// A normal function is treated as label, not a variable (label is a constant).
+		if val.Kind != mir.EXTERNAL_CALL {
+			info.calls[val.Callee] = struct{}{}
+			info.visit(insn, val.Callee)
 		}
+		info.use(insn, val.Args...)
 	case *mir.Tuple:
-		for _, e := range val.Elems {
-			fvg.add(e)
-		}
+		info.use(insn, val.Elems...)
 	case *mir.Array:
-		fvg.add(val.Size)
-		fvg.add(val.Elem)
+		info.use(insn, val.Size, val.Elem)
 	case *mir.ArrLit:
-		for _, e := range val.Elems {
-			fvg.add(e)
-		}
+		info.use(insn, val.Elems...)
 	case *mir.TplLoad:
-		fvg.add(val.From)
+		info.use(insn, val.From)
 	case *mir.ArrLoad:
-		fvg.add(val.From)
-		fvg.add(val.Index)
+		info.use(insn, val.From, val.Index)
 	case *mir.ArrStore:
-		fvg.add(val.To)
-		fvg.add(val.Index)
-		fvg.add(val.RHS)
+		info.use(insn, val.To, val.Index, val.RHS)
 	case *mir.ArrLen:
-		fvg.add(val.Array)
+		info.use(insn, val.Array)
+	case *mir.BoundsCheck:
+		info.use(insn, val.Array, val.Index)
+	case *mir.TblLoad:
+		info.use(insn, val.From, val.Key)
+	case *mir.TblStore:
+		info.use(insn, val.To, val.Key, val.RHS)
+	case *mir.TblRemove:
+		info.use(insn, val.From, val.Key)
 	case *mir.Some:
-		fvg.add(val.Elem)
+		info.use(insn, val.Elem)
 	case *mir.IsSome:
-		fvg.add(val.OptVal)
+		info.use(insn, val.OptVal)
 	case *mir.DerefSome:
-		fvg.add(val.SomeVal)
-	case *mir.Fun:
-		make, ok := fvg.transform.replacedFuns[insn]
-		if !ok {
-			panic(fmt.Sprintf("Visiting function '%s' for gathering free vars is not visit by transformWithKFO: %v", insn.Ident, val))
-		}
-		if make == nil {
-			// The function is not a closure. Need not to be visit because it is
-			// simply moved to toplevel
-			break
-		}
-		fv, ok := fvg.transform.closureBlockFreeVars[make.Fun]
-		if !ok {
-			panic(fmt.Sprintf("Applying unknown closure '%s'", insn.Ident))
-		}
-		for v := range fv {
-			fvg.add(v)
-		}
-		for _, v := range make.Vars {
-			fvg.add(v)
+		info.use(insn, val.SomeVal)
+	case *mir.Variant:
+		if val.Payload != "" {
+			info.use(insn, val.Payload)
 		}
-		delete(fvg.found, make.Fun)
+	case *mir.IsVariant:
+		info.use(insn, val.Target)
+	case *mir.VariantPayload:
+		info.use(insn, val.Target)
+	case *mir.Jump:
+		info.use(insn, val.Args...)
+	case *mir.Fun:
+		child := newFunInfo(insn.Ident, insn, val)
+		info.children = append(info.children, child)
+		col.collectBlock(child, val.Body)
+		col.funs = append(col.funs, child)
+		col.byName[insn.Ident] = child
 	case *mir.MakeCls:
 		panic("unreachable")
 	}
-
-	// Note:
-	// Functions in tree will be moved to toplevel. So they should be ignored here.
-
-	delete(fvg.found, insn.Ident)
-}
-
-func gatherFreeVars(block *mir.Block, trans *transformWithKFO) nameSet {
-	v := &freeVarsGatherer{map[string]struct{}{}, trans}
-	v.exploreBlock(block)
-	return v.found
 }
 
-func gatherFreeVarsTillTheEnd(insn *mir.Insn, trans *transformWithKFO) nameSet {
-	v := &freeVarsGatherer{map[string]struct{}{}, trans}
-	v.exploreTillTheEnd(insn)
-	return v.found
+func collectFuns(entry *mir.Block) *funCollector {
+	col := &funCollector{[]*funInfo{}, map[string]*funInfo{}}
+	root := newFunInfo("", nil, nil)
+	col.collectBlock(root, entry)
+	col.funs = append(col.funs, root)
+	return col
 }
@@ -0,0 +1,243 @@
+package closure
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Lambda lifting is an alternative to closure conversion. When a closure is only called and never
+// used as a value, its free variables can be passed as extra parameters instead of capturing them.
+// All call sites are known, so they can pass the variables. No closure object is allocated.
+//   x$t1 = int 1
+//   f$t2 = makecls (x$t1) f$t2
+//   $k3 = appcls f$t2 a$t4
+//   (in body of f$t2) $k1 = binary + a$t5 x$t1
+// is converted into
+//   x$t1 = int 1
+//   $k3 = app f$t2 a$t4,x$t1
+//   (in body of f$t2; f$t2 = fun a$t5,x$t1$l1) $k1 = binary + a$t5 x$t1$l1
+// Captured variables are renamed to fresh parameters since identifiers must be unique in program.
+//
+// A closure capturing a lifted function captures the free variables of the lifted function instead
+// and calls it directly. Closures used as values (passed to functions, returned, stored in tuples,
+// ...) fall back to closures.
+
+type lifter struct {
+	prog *mir.Program
+	env  *types.Env
+	// 'makecls' instructions of each closure
+	makes map[string][]*mir.Insn
+	// Closures which cannot be lifted since they are used as values
+	escaped nameSet
+	lifted  map[string][]string
+	count   int
+}
+
+func (l *lifter) visitBlock(b *mir.Block, visit func(*mir.Insn)) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		visit(i)
+		if v, ok := i.Val.(*mir.If); ok {
+			l.visitBlock(v.Then, visit)
+			l.visitBlock(v.Else, visit)
+		}
+	}
+}
+
+func (l *lifter) visitAll(visit func(*mir.Insn)) {
+	for _, f := range l.prog.Toplevel {
+		l.visitBlock(f.Val.Body, visit)
+	}
+	l.visitBlock(l.prog.Entry, visit)
+}
+
+// collect finds closures used as values. Closures are allowed to appear only as callees of closure
+// calls and captures.
+func (l *lifter) collect(insn *mir.Insn) {
+	escape := func(n string) string {
+		l.escaped[n] = struct{}{}
+		return n
+	}
+	switch v := insn.Val.(type) {
+	case *mir.App:
+		if v.Kind != mir.CLOSURE_CALL {
+			escape(v.Callee)
+		}
+		for _, a := range v.Args {
+			escape(a)
+		}
+	case *mir.MakeCls:
+		l.makes[v.Fun] = append(l.makes[v.Fun], insn)
+		caps := l.prog.Closures[v.Fun]
+		for i, n := range v.Vars {
+			if n != caps[i] {
+				// Captured with other name. Free variables of it cannot be referred with their names
+				escape(n)
+				escape(caps[i])
+			}
+		}
+	default:
+		mir.RenameOperands(insn.Val, escape)
+	}
+}
+
+func (l *lifter) canLift(name string) bool {
+	if _, ok := l.escaped[name]; ok {
+		return false
+	}
+	for _, insn := range l.makes[name] {
+		if insn.Ident != name {
+			// Closure object is referred with other name
+			return false
+		}
+	}
+	return len(l.makes[name]) > 0
+}
+
+// freeVars returns free variables of the lifted function. Lifted functions in captures are
+// replaced with free variables of them.
+func (l *lifter) freeVars(name string) []string {
+	if fv, ok := l.lifted[name]; ok && fv != nil {
+		return fv
+	}
+	fv := l.expand(l.prog.Closures[name])
+	l.lifted[name] = fv
+	return fv
+}
+
+func (l *lifter) expand(caps []string) []string {
+	expanded := make([]string, 0, len(caps))
+	seen := nameSet{}
+	for _, c := range caps {
+		vars := []string{c}
+		if _, ok := l.lifted[c]; ok {
+			vars = l.freeVars(c)
+		}
+		for _, v := range vars {
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
+				expanded = append(expanded, v)
+			}
+		}
+	}
+	return expanded
+}
+
+// expandMakeCls replaces lifted functions in variables of 'makecls' instructions of the closure.
+// Variables are arranged in the same order as the new captures.
+func (l *lifter) expandMakeCls(name string, caps []string) {
+	for _, insn := range l.makes[name] {
+		v := insn.Val.(*mir.MakeCls)
+		passed := make(map[string]string, len(v.Vars))
+		for i, c := range l.prog.Closures[name] {
+			passed[c] = v.Vars[i]
+		}
+		vars := make([]string, 0, len(caps))
+		for _, c := range caps {
+			if p, ok := passed[c]; ok {
+				c = p
+			}
+			vars = append(vars, c)
+		}
+		v.Vars = vars
+	}
+}
+
+func (l *lifter) rewrite(insn *mir.Insn) {
+	switch v := insn.Val.(type) {
+	case *mir.App:
+		if fv, ok := l.lifted[v.Callee]; ok && v.Kind == mir.CLOSURE_CALL {
+			v.Kind = mir.DIRECT_CALL
+			v.Args = append(v.Args, fv...)
+		}
+	case *mir.MakeCls:
+		if _, ok := l.lifted[v.Fun]; ok {
+			insn.RemoveFromList()
+		}
+	}
+}
+
+// liftFun turns the free variables of the lifted function into its parameters.
+func (l *lifter) liftFun(name string, fv []string) {
+	fun := l.prog.Toplevel[name].Val
+	ty, ok := l.env.DeclTable[name].(*types.Fun)
+	if !ok {
+		panic("FATAL: Type of lifted function '" + name + "' is not a function type")
+	}
+	params := make([]types.Type, 0, len(ty.Params)+len(fv))
+	params = append(params, ty.Params...)
+
+	renamed := make(map[string]string, len(fv))
+	for _, v := range fv {
+		l.count++
+		p := fmt.Sprintf("%s$l%d", v, l.count)
+		renamed[v] = p
+		fun.Params = append(fun.Params, p)
+		t := l.env.DeclTable[v]
+		l.env.DeclTable[p] = t
+		params = append(params, t)
+	}
+	l.env.DeclTable[name] = &types.Fun{ty.Ret, params}
+
+	lifted := make([]string, 0, len(fv))
+	for _, v := range fv {
+		lifted = append(lifted, renamed[v])
+	}
+	l.visitBlock(fun.Body, func(i *mir.Insn) {
+		mir.RenameOperands(i.Val, func(n string) string {
+			if p, ok := renamed[n]; ok {
+				return p
+			}
+			return n
+		})
+		if j, ok := i.Val.(*mir.Jump); ok {
+			// 'jump' assigns all parameters. Lifted parameters are passed as they are
+			j.Args = append(j.Args, lifted...)
+		}
+	})
+}
+
+// LiftLambdas applies lambda lifting to closures which are only called. Free variables of the
+// closures are passed as extra parameters and no closure object is made for them. Other closures
+// remain as they are. It must be applied right after closure transform since captures and variables
+// of 'makecls' instructions must have the same names.
+func LiftLambdas(prog *mir.Program, env *types.Env) {
+	l := &lifter{prog, env, map[string][]*mir.Insn{}, nameSet{}, map[string][]string{}, 0}
+	l.visitAll(l.collect)
+
+	names := prog.Toplevel.Names()
+	for _, name := range names {
+		if _, ok := prog.Closures[name]; ok && l.canLift(name) {
+			// Free variables are calculated later
+			l.lifted[name] = nil
+		}
+	}
+
+	expanded := make(map[string][]string, len(prog.Closures))
+	for _, name := range names {
+		if _, ok := prog.Closures[name]; !ok {
+			continue
+		}
+		if _, ok := l.lifted[name]; ok {
+			l.freeVars(name)
+			continue
+		}
+		caps := l.expand(prog.Closures[name])
+		l.expandMakeCls(name, caps)
+		expanded[name] = caps
+	}
+	for name := range l.lifted {
+		delete(prog.Closures, name)
+	}
+	for name, caps := range expanded {
+		prog.Closures[name] = caps
+	}
+
+	l.visitAll(l.rewrite)
+	for _, name := range prog.Toplevel.Names() {
+		if fv, ok := l.lifted[name]; ok {
+			l.liftFun(name, fv)
+		}
+	}
+}
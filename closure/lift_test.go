@@ -0,0 +1,82 @@
+package closure
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"testing"
+)
+
+func TestLiftLambdas(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		closures map[string][]string
+		params   map[string][]string
+	}{
+		{
+			what:     "closure only called",
+			code:     "let x = 1 in let rec f a = a + x in print_int (f 2)",
+			closures: map[string][]string{},
+			params:   map[string][]string{"f$t2": {"a$t3", "x$t1$l1"}},
+		},
+		{
+			what:     "closure used as value",
+			code:     "let x = 1 in let rec f a = a + x in let rec h k = k 1 in print_int (h f)",
+			closures: map[string][]string{"f$t2": {"x$t1"}},
+			params:   map[string][]string{"f$t2": {"a$t3"}, "h$t4": {"k$t5"}},
+		},
+		{
+			what:     "recursive closure",
+			code:     "let x = 1 in let rec f a = if a < 0 then x else f (a - 1) in print_int (f 2)",
+			closures: map[string][]string{},
+			params:   map[string][]string{"f$t2": {"a$t3", "x$t1$l1"}},
+		},
+		{
+			what:     "closure capturing lifted function",
+			code:     "let x = 1 in let rec f a = a + x in let rec g b = f b in let rec h k = k 1 in print_int (h g)",
+			closures: map[string][]string{"g$t4": {"x$t1"}},
+			params:   map[string][]string{"f$t2": {"a$t3", "x$t1$l1"}, "g$t4": {"b$t5"}, "h$t6": {"k$t7"}},
+		},
+		{
+			what:     "nested closures",
+			code:     "let x = 1 in let rec f a = (let rec g b = a + b + x in g 1) in print_int (f 2)",
+			closures: map[string][]string{},
+			params:   map[string][]string{"f$t2": {"a$t3", "x$t1$l1"}, "g$t4": {"b$t5", "a$t3$l2", "x$t1$l3"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := Transform(ir)
+			LiftLambdas(prog, env)
+			if err := mir.Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(map[string][]string(prog.Closures), tc.closures) {
+				t.Errorf("Wanted closures %v but got %v", tc.closures, prog.Closures)
+			}
+			for name, want := range tc.params {
+				f, ok := prog.Toplevel[name]
+				if !ok {
+					t.Fatalf("Function '%s' not found", name)
+				}
+				if !reflect.DeepEqual(f.Val.Params, want) {
+					t.Errorf("Wanted parameters %v for '%s' but got %v", want, name, f.Val.Params)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package closure
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// ABI of closures used by codegen:
+// A closure value is a pair of a function pointer and a pointer to its environment ({fun*, i8*}). The
+// function of a closure takes the pointer to the environment as its hidden first parameter. A closure
+// which captures nothing may be called directly without the environment.
+//
+// Flat closures (default):
+// The environment is a struct of all captured variables in the order of mir.Closures.
+//   let x = 1 in let y = 2 in let rec f a = (let rec g b = a + b + x + y in g) in f
+//   f: {x, y}
+//   g: {a, x, y}
+// Creating a closure copies all variables, so deeply nested closures copy the same variables again
+// and again. But accessing a captured variable is one load.
+//
+// Linked closures:
+// When a closure is always made in the body of its enclosing closure, its environment starts with a
+// pointer to the environment of the enclosing closure. It is followed by captured variables which
+// are not captured by the enclosing closure, in the order of mir.Closures. Variables captured by the
+// enclosing closure are loaded following the links.
+//   f: {x, y}
+//   g: {f's environment*, a}
+// Creating a closure is cheap, but accessing variables of outer closures needs to follow the links.
+// Environments of outer closures are kept alive by inner closures. To be safe for space, a closure is
+// linked only when it uses all variables captured by its enclosing closure. So a linked environment
+// never retains variables which the closure does not use. Links are recorded in mir.Program.EnvLinks.
+//
+// Environments are allocated on stack when escape analysis shows that the closure does not escape
+// (mir.Program.StackAllocated), and closures in mir.Program.SharedEnvs reuse the environment of
+// another closure.
+
+// Representation is a representation of environments of closures.
+type Representation int
+
+const (
+	// FlatClosures copies all captured variables into the environment of each closure.
+	FlatClosures Representation = iota
+	// LinkedClosures makes environments of nested closures point to environments of their
+	// enclosing closures.
+	LinkedClosures
+)
+
+func (r Representation) String() string {
+	switch r {
+	case FlatClosures:
+		return "flat"
+	case LinkedClosures:
+		return "linked"
+	default:
+		panic("unreachable")
+	}
+}
+
+// ParseRepresentation parses the name of representation of closures. Empty string means flat
+// closures.
+func ParseRepresentation(s string) (Representation, error) {
+	switch s {
+	case "", "flat":
+		return FlatClosures, nil
+	case "linked":
+		return LinkedClosures, nil
+	default:
+		return FlatClosures, locerr.Errorf("Unknown representation of closures '%s'. It must be 'flat' or 'linked'", s)
+	}
+}
+
+type makeClsSite struct {
+	ident string
+	// Function whose body contains the 'makecls' instruction. It is empty for the entry point
+	owner string
+	val   *mir.MakeCls
+}
+
+type linker struct {
+	prog  *mir.Program
+	makes map[string][]makeClsSite
+}
+
+func (l *linker) collect(owner string, b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.MakeCls:
+			l.makes[v.Fun] = append(l.makes[v.Fun], makeClsSite{i.Ident, owner, v})
+		case *mir.If:
+			l.collect(owner, v.Then)
+			l.collect(owner, v.Else)
+		}
+	}
+}
+
+// parentOf returns the closure whose environment the environment of the closure can be linked to.
+// It returns empty string when the closure cannot be linked.
+func (l *linker) parentOf(name string) string {
+	sites := l.makes[name]
+	if len(sites) == 0 {
+		return ""
+	}
+	parent := sites[0].owner
+	onStack := true
+	for _, s := range sites {
+		if s.owner != parent {
+			return ""
+		}
+		if _, ok := l.prog.StackAllocated[s.ident]; !ok {
+			onStack = false
+		}
+	}
+	if parent == "" || parent == name {
+		return ""
+	}
+	parentCaps, ok := l.prog.Closures[parent]
+	if !ok || len(l.makes[parent]) == 0 {
+		return ""
+	}
+
+	// To be safe for space, the closure must use all variables captured by the parent. Otherwise
+	// the linked environment would retain variables which the closure never uses. They must be
+	// passed as they are since they are loaded from the environment of the parent.
+	if len(parentCaps) == 0 {
+		return ""
+	}
+	for _, p := range parentCaps {
+		idx := -1
+		for i, c := range l.prog.Closures[name] {
+			if c == p {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return ""
+		}
+		for _, s := range sites {
+			if s.val.Vars[idx] != p {
+				return ""
+			}
+		}
+	}
+
+	// Environment of the parent must live as long as the closure
+	if !onStack {
+		for _, s := range l.makes[parent] {
+			if _, ok := l.prog.StackAllocated[s.ident]; ok {
+				return ""
+			}
+		}
+	}
+	return parent
+}
+
+// reaches returns true when following links from the closure reaches the target closure.
+func (l *linker) reaches(from, target string) bool {
+	for c, ok := from, true; ok; c, ok = l.prog.EnvLinks[c] {
+		if c == target {
+			return true
+		}
+	}
+	return false
+}
+
+// LinkEnvs links environments of closures to environments of their enclosing closures and records
+// the links in mir.Program.EnvLinks. A closure is linked when all 'makecls' instructions of the
+// closure are in the body of the enclosing closure and it captures all variables captured by the
+// enclosing closure. It should be applied after all passes since
+// passes are not aware of the links.
+func LinkEnvs(prog *mir.Program) {
+	l := &linker{prog, map[string][]makeClsSite{}}
+	for _, f := range prog.Toplevel {
+		l.collect(f.Name, f.Val.Body)
+	}
+	l.collect("", prog.Entry)
+
+	prog.EnvLinks = map[string]string{}
+	for _, n := range prog.Toplevel.Names() {
+		if p := l.parentOf(n); p != "" && !l.reaches(p, n) {
+			prog.EnvLinks[n] = p
+		}
+	}
+
+	// Environments can be shared only when they have the same layout
+	funs := map[string]string{}
+	for f, sites := range l.makes {
+		for _, s := range sites {
+			funs[s.ident] = f
+		}
+	}
+	for to, from := range prog.SharedEnvs {
+		if prog.EnvLinks[funs[to]] != prog.EnvLinks[funs[from]] {
+			delete(prog.SharedEnvs, to)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package closure
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"testing"
+)
+
+func linkedProgram(t *testing.T, code string) *mir.Program {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := Transform(ir)
+	LinkEnvs(prog)
+	if err := mir.Verify(prog); err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+func TestLinkEnvs(t *testing.T) {
+	cases := []struct {
+		what  string
+		code  string
+		links map[string]string
+	}{
+		{
+			what:  "nested closure sharing capture",
+			code:  "let x = 1 in let rec f a = (let rec g b = a + b + x in g) in print_int ((f 1) 2)",
+			links: map[string]string{"g$t4": "f$t2"},
+		},
+		{
+			what:  "nested closure capturing nothing in common",
+			code:  "let x = 1 in let rec f a = (let rec g b = a + b in if a = x then g else g) in print_int ((f 1) 2)",
+			links: map[string]string{},
+		},
+		{
+			what:  "nested closure not using all captures of enclosing closure",
+			code:  "let x = 1 in let y = 2 in let rec f a = (let rec g b = a + b + x in if a = y then g else g) in print_int ((f 1) 2)",
+			links: map[string]string{},
+		},
+		{
+			what:  "enclosing function is not a closure",
+			code:  "let rec f a = (let rec g b = a + b in g) in print_int ((f 1) 2)",
+			links: map[string]string{},
+		},
+		{
+			what:  "closure made at entry point",
+			code:  "let x = 1 in let rec f a = a + x in let rec h k = k 1 in print_int (h f)",
+			links: map[string]string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			prog := linkedProgram(t, tc.code)
+			if !reflect.DeepEqual(prog.EnvLinks, tc.links) {
+				t.Errorf("Wanted links %v but got %v", tc.links, prog.EnvLinks)
+			}
+		})
+	}
+}
+
+func TestLinkDeeplyNestedClosures(t *testing.T) {
+	depth := 10
+	var buf bytes.Buffer
+	buf.WriteString("let x = 1 in\n")
+	for i := 1; i <= depth; i++ {
+		fmt.Fprintf(&buf, "let rec f%d a%d =\n", i, i)
+	}
+	fmt.Fprintf(&buf, "a%d + x in\n", depth)
+	for i := depth; i >= 2; i-- {
+		fmt.Fprintf(&buf, "f%d a%d in\n", i, i-1)
+	}
+	buf.WriteString("print_int (f1 0)")
+
+	prog := linkedProgram(t, buf.String())
+	// All closures except for the outermost one are linked to their enclosing closures
+	if len(prog.EnvLinks) != depth-1 {
+		t.Fatalf("%d links were expected but actually %d found: %v", depth-1, len(prog.EnvLinks), prog.EnvLinks)
+	}
+	for child, parent := range prog.EnvLinks {
+		if !prog.Toplevel[parent].Val.IsRecursive && len(prog.Closures[parent]) == 0 {
+			t.Errorf("Closure '%s' is linked to '%s' which captures nothing", child, parent)
+		}
+	}
+}
+
+func TestParseRepresentation(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  Representation
+	}{
+		{"", FlatClosures},
+		{"flat", FlatClosures},
+		{"linked", LinkedClosures},
+	} {
+		r, err := ParseRepresentation(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != tc.want {
+			t.Errorf("Wanted %s for '%s' but got %s", tc.want, tc.input, r)
+		}
+	}
+
+	if _, err := ParseRepresentation("display"); err == nil {
+		t.Fatal("Unknown representation should cause an error")
+	}
+}
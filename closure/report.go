@@ -0,0 +1,180 @@
+package closure
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+	"io"
+	"sort"
+	"strings"
+)
+
+// AllocReason is a reason why a closure object is allocated for a function.
+type AllocReason int
+
+const (
+	// NotAllocated means that the function is only called directly and no closure object is made.
+	NotAllocated AllocReason = iota
+	// UsedAsValue means that the function is referred as a value (passed, returned, stored, ...).
+	UsedAsValue
+	// CalledAsClosure means that the function has free variables and it is called via its closure.
+	CalledAsClosure
+	// CapturedByClosure means that the function is captured by another closure.
+	CapturedByClosure
+)
+
+func (r AllocReason) String() string {
+	switch r {
+	case NotAllocated:
+		return "not allocated"
+	case UsedAsValue:
+		return "used as value"
+	case CalledAsClosure:
+		return "called as closure"
+	case CapturedByClosure:
+		return "captured by closure"
+	default:
+		panic("unreachable")
+	}
+}
+
+// CaptureReport describes why a variable is captured by a closure.
+type CaptureReport struct {
+	// Var is the identifier of the captured variable.
+	Var string
+	// Use is the instruction using the variable. When the variable is captured only for nested
+	// closures, it is the use in the innermost one.
+	Use *mir.Insn
+	// Via is a list of nested closures from outer to inner through which the variable is captured.
+	// It is empty when the closure body uses the variable directly.
+	Via []string
+}
+
+// ClosureReport describes captures and allocation of a function which is a closure or whose closure
+// object is allocated.
+type ClosureReport struct {
+	Name string
+	Pos  locerr.Pos
+	// Captures are sorted by names of variables. It is empty when the function has no free variable.
+	Captures []CaptureReport
+	Alloc    AllocReason
+	// AllocSite is the instruction which makes a closure object necessary. It is nil when the reason
+	// is CapturedByClosure or no closure object is allocated.
+	AllocSite *mir.Insn
+	// CapturedBy is the closure capturing the function when the reason is CapturedByClosure.
+	CapturedBy string
+}
+
+// Report is a structured report of closure transform. It explains which functions capture which
+// variables and why closure objects are allocated so that users can find hidden allocations.
+type Report struct {
+	// Closures are sorted by their positions.
+	Closures []*ClosureReport
+}
+
+// Dump writes the report in human readable format to the writer.
+func (r *Report) Dump(out io.Writer) {
+	for _, c := range r.Closures {
+		fmt.Fprintf(out, "%s (at %s)\n", c.Name, c.Pos.String())
+		for _, capture := range c.Captures {
+			fmt.Fprintf(out, "  captures %s", capture.Var)
+			if len(capture.Via) > 0 {
+				fmt.Fprintf(out, " for %s", strings.Join(capture.Via, " -> "))
+			}
+			fmt.Fprintf(out, " (used by '%s' at %s)\n", capture.Use.Ident, capture.Use.Pos.String())
+		}
+		switch c.Alloc {
+		case NotAllocated:
+			fmt.Fprintln(out, "  closure is not allocated")
+		case CapturedByClosure:
+			fmt.Fprintf(out, "  closure is allocated since it is captured by %s\n", c.CapturedBy)
+		default:
+			fmt.Fprintf(out, "  closure is allocated since it is %s by '%s' at %s\n", c.Alloc, c.AllocSite.Ident, c.AllocSite.Pos.String())
+		}
+	}
+}
+
+type reporter struct {
+	trans  *transformWithKFO
+	parent map[*funInfo]*funInfo
+}
+
+// captureOf finds the use of the captured variable in the function or in its nested closures.
+func (rep *reporter) captureOf(info *funInfo, v string) CaptureReport {
+	if insn, ok := info.sites[v]; ok {
+		if _, ok := info.vals[v]; ok || !rep.trans.isKnown(v) {
+			return CaptureReport{v, insn, []string{}}
+		}
+	}
+	for _, c := range info.children {
+		if _, ok := c.captures[v]; ok && c.made {
+			inner := rep.captureOf(c, v)
+			inner.Via = append([]string{c.name}, inner.Via...)
+			return inner
+		}
+	}
+	panic("FATAL: Use of captured variable '" + v + "' not found in '" + info.name + "'")
+}
+
+func (rep *reporter) allocOf(info *funInfo, r *ClosureReport) {
+	if !info.made {
+		r.Alloc = NotAllocated
+		return
+	}
+	p := rep.parent[info]
+	if _, ok := p.vals[info.name]; ok {
+		r.Alloc = UsedAsValue
+		r.AllocSite = p.sites[info.name]
+		return
+	}
+	if _, ok := p.calls[info.name]; ok && !rep.trans.isKnown(info.name) {
+		r.Alloc = CalledAsClosure
+		r.AllocSite = p.sites[info.name]
+		return
+	}
+	for _, s := range p.children {
+		if _, ok := s.captures[info.name]; ok && s.made {
+			r.Alloc = CapturedByClosure
+			r.CapturedBy = s.name
+			return
+		}
+	}
+	panic("FATAL: Reason of allocating closure for '" + info.name + "' not found")
+}
+
+func (rep *reporter) build() *Report {
+	closures := []*ClosureReport{}
+	for _, f := range rep.trans.funs {
+		if f.insn == nil {
+			continue
+		}
+		if _, ok := rep.trans.closures[f.name]; !ok && !f.made {
+			continue
+		}
+		r := &ClosureReport{Name: f.name, Pos: f.insn.Pos, Captures: []CaptureReport{}}
+		for _, v := range f.captures.toSortedArray() {
+			if v == f.name {
+				// Recursive function refers itself via its own closure object
+				continue
+			}
+			r.Captures = append(r.Captures, rep.captureOf(f, v))
+		}
+		rep.allocOf(f, r)
+		closures = append(closures, r)
+	}
+	sort.Slice(closures, func(i, j int) bool {
+		return closures[i].Pos.Offset < closures[j].Pos.Offset
+	})
+	return &Report{closures}
+}
+
+func newReport(trans *transformWithKFO) *Report {
+	parent := map[*funInfo]*funInfo{}
+	for _, f := range trans.funs {
+		for _, c := range f.children {
+			parent[c] = f
+		}
+	}
+	rep := &reporter{trans, parent}
+	return rep.build()
+}
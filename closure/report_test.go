@@ -0,0 +1,133 @@
+package closure
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func reportOf(t *testing.T, code string) *Report {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rep := TransformWithReport(ir)
+	return rep
+}
+
+func TestTransformWithReport(t *testing.T) {
+	type capture struct {
+		name string
+		use  string
+		via  []string
+	}
+	cases := []struct {
+		what     string
+		code     string
+		name     string
+		captures []capture
+		alloc    AllocReason
+		site     string
+		by       string
+	}{
+		{
+			what:     "closure called directly",
+			code:     "let x = 1 in let rec f a = a + x in print_int (f 2)",
+			name:     "f$t2",
+			captures: []capture{{"x$t1", "$k3", []string{}}},
+			alloc:    CalledAsClosure,
+			site:     "$k7",
+		},
+		{
+			what:     "function used as value",
+			code:     "let rec f a = a in let rec h k = k 1 in print_int (h f)",
+			name:     "f$t1",
+			captures: []capture{},
+			alloc:    UsedAsValue,
+			site:     "$k5",
+		},
+		{
+			what:     "capture for nested closure",
+			code:     "let x = 1 in let rec f a = (let rec g b = a + b + x in g) in print_int ((f 1) 2)",
+			name:     "f$t2",
+			captures: []capture{{"x$t1", "$k5", []string{"g$t4"}}},
+			alloc:    CalledAsClosure,
+			site:     "$k10",
+		},
+		{
+			what:     "closure captured by other closure",
+			code:     "let x = 1 in let rec f a = a + x in let rec g b = f b in print_int (g 1)",
+			name:     "f$t2",
+			captures: []capture{{"x$t1", "$k3", []string{}}},
+			alloc:    CapturedByClosure,
+			by:       "g$t4",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			rep := reportOf(t, tc.code)
+			var found *ClosureReport
+			for _, c := range rep.Closures {
+				if c.Name == tc.name {
+					found = c
+				}
+			}
+			if found == nil {
+				t.Fatalf("Closure '%s' is not reported: %v", tc.name, rep.Closures)
+			}
+
+			captures := []capture{}
+			for _, c := range found.Captures {
+				captures = append(captures, capture{c.Var, c.Use.Ident, c.Via})
+			}
+			if !reflect.DeepEqual(captures, tc.captures) {
+				t.Errorf("Wanted captures %v but got %v", tc.captures, captures)
+			}
+			if found.Alloc != tc.alloc {
+				t.Errorf("Wanted allocation reason '%s' but got '%s'", tc.alloc, found.Alloc)
+			}
+			if tc.site != "" && (found.AllocSite == nil || found.AllocSite.Ident != tc.site) {
+				t.Errorf("Wanted allocation site '%s' but got %v", tc.site, found.AllocSite)
+			}
+			if found.CapturedBy != tc.by {
+				t.Errorf("Wanted closure capturing it '%s' but got '%s'", tc.by, found.CapturedBy)
+			}
+		})
+	}
+}
+
+func TestReportKnownFunctions(t *testing.T) {
+	rep := reportOf(t, "let rec f a = a + 1 in print_int (f 2)")
+	if len(rep.Closures) != 0 {
+		t.Fatalf("Known function should not be reported: %v", rep.Closures)
+	}
+}
+
+func TestDumpReport(t *testing.T) {
+	rep := reportOf(t, "let x = 1 in let rec f a = (let rec g b = a + b + x in g) in print_int ((f 1) 2)")
+	var buf bytes.Buffer
+	rep.Dump(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"f$t2 (at <<dummy>:1:14>)",
+		"  captures x$t1 for g$t4 (used by '$k5' at <<dummy>:1:51>)",
+		"  closure is allocated since it is used as value by '$k7' at <<dummy>:1:56>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("'%s' is not contained in output: %s", want, out)
+		}
+	}
+	if strings.Index(out, "f$t2") > strings.Index(out, "g$t4 (at") {
+		t.Errorf("Closures should be sorted by their positions: %s", out)
+	}
+}
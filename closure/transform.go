@@ -6,21 +6,34 @@
 // hidden parameter. And need to insert a code to make a closure at the definition
 // point of the function.
 //
-// In closure transform, it visits function's body assuming the function is a normal function.
-// As the result of the visit, if some free variables found, it means that the function
-// is actually not a normal function, but a closure. So restore the state and retry
-// visiting its body after adding the function to closures list.
-//
 // Note that applied normal functions are not free variables, but applied closures are
 // free variables. Normal function is not a value but closure is a value.
-// So, considering recursive functions, before visiting function's body, the function must
-// be determined to normal function or closure. That's the reason to assume function is a
-// normal function at first and then backtrack after if needed.
+// So whether a function is a closure depends on whether the functions it calls are closures,
+// including the function itself and its enclosing functions in the case of recursive functions.
+//
+// At first, the program is traversed only once to summarize each function body (identifiers
+// used as values, callees and identifiers defined in it). Then free variables are calculated
+// from the summaries assuming all functions are normal functions (known functions). When some
+// free variables are found in a function, the function is actually a closure. Turning a function
+// into a closure only adds free variables to others, so the calculation is repeated until no
+// function newly turns into a closure. Since functions are visited in post order, a closure is
+// found in one pass except for calls to enclosing functions. Usually it finishes in one or two
+// passes.
+//
+// Functions cannot be mutually recursive because 'let rec' binds only one function ('let rec ...
+// and ...' is not supported yet). A closure can capture only closures defined before it and itself
+// is referred via its own closure object (IsRecursive), so captures never form a cycle. When
+// recursive groups are supported, closures in a group should share one environment capturing free
+// variables of all of them (like mir.Program.SharedEnvs) instead of capturing each other.
+//
+// A program is compiled from one source file, so all functions are visible to this analysis and
+// external symbols are only C functions called directly. When separate compilation is supported,
+// the set of known functions of a module should be exported with its compiled object so that
+// calls to known functions of other modules remain direct calls instead of closure calls.
 //
 package closure
 
 import (
-	"fmt"
 	"github.com/rhysd/gocaml/mir"
 	"sort"
 )
@@ -38,112 +51,90 @@ func (set nameSet) toSortedArray() []string {
 
 // Do closure transform with known functions optimization
 type transformWithKFO struct {
-	knownFuns            nameSet
-	replacedFuns         map[*mir.Insn]*mir.MakeCls // nil means simply removing the function
-	closures             mir.Closures               // Mapping function name to free variables
-	closureBlockFreeVars map[string]nameSet         // Known free variables of closures' blocks
+	funs   []*funInfo
+	byName map[string]*funInfo
+	// Functions which have free variables
+	closures nameSet
 }
 
-func (trans *transformWithKFO) duplicate() *transformWithKFO {
-	known := make(map[string]struct{}, len(trans.knownFuns))
-	for k := range trans.knownFuns {
-		known[k] = struct{}{}
+func (trans *transformWithKFO) isKnown(name string) bool {
+	if _, ok := trans.byName[name]; !ok {
+		// Function variable. All function variables are closures.
+		return false
 	}
-	funs := make(map[*mir.Insn]*mir.MakeCls, len(trans.replacedFuns))
-	for f, v := range trans.replacedFuns {
-		funs[f] = v
+	_, ok := trans.closures[name]
+	return !ok
+}
+
+// freeVars calculates free variables of the function from its summary. Free variables of nested
+// functions were already calculated since functions are visited in post order.
+func (trans *transformWithKFO) freeVars(info *funInfo) nameSet {
+	fv := nameSet{}
+	for v := range info.vals {
+		fv[v] = struct{}{}
 	}
-	clss := make(map[string][]string, len(trans.closures))
-	for f, fv := range trans.closures {
-		clss[f] = fv
+	for c := range info.calls {
+		if !trans.isKnown(c) {
+			fv[c] = struct{}{}
+		}
 	}
-	blks := make(map[string]nameSet, len(trans.closureBlockFreeVars))
-	for f, fv := range trans.closureBlockFreeVars {
-		blks[f] = fv
+	for _, c := range info.children {
+		if !c.made {
+			// The function is simply moved to toplevel. It does not capture anything
+			continue
+		}
+		for v := range c.captures {
+			fv[v] = struct{}{}
+		}
 	}
-	return &transformWithKFO{
-		known,
-		funs,
-		clss,
-		blks,
+	for l := range info.locals {
+		delete(fv, l)
 	}
+	return fv
 }
 
-func (trans *transformWithKFO) block(block *mir.Block) {
-	// Skip first NOP instruction
-	trans.insn(block.Top.Next)
-}
-
-func (trans *transformWithKFO) insn(insn *mir.Insn) {
-	if insn.Next == nil {
-		// Reaches bottom of the block
-		return
-	}
-
-	switch val := insn.Val.(type) {
-	case *mir.Fun:
-		// Assume the function is not a closure and try to transform its body
-		dup := trans.duplicate()
-		dup.knownFuns[insn.Ident] = struct{}{}
-		dup.block(val.Body)
-		// Check there is no free variable actually
-		fv := gatherFreeVars(val.Body, dup)
-		for _, p := range val.Params {
-			delete(fv, p)
+// markMade determines which functions defined in the body need to make closure objects. A function
+// needs it when referred as a value, called as a closure or captured by the following functions.
+func (trans *transformWithKFO) markMade(info *funInfo) {
+	// Functions can be captured only by functions defined after them. So visit them in reverse order.
+	for i := len(info.children) - 1; i >= 0; i-- {
+		c := info.children[i]
+		if _, ok := info.vals[c.name]; ok {
+			c.made = true
+			continue
 		}
-		if len(fv) != 0 {
-			// Assumed the function is not a closure. But there are actually some
-			// free variables. It means that the function is actually a closure.
-			// Discard 'dup' and retry visiting its body with adding it to closures.
-			trans.block(val.Body)
-			fv = gatherFreeVars(val.Body, trans)
-			for _, p := range val.Params {
-				delete(fv, p)
-			}
-			if _, ok := fv[insn.Ident]; ok {
-				// When the closure itself is used in its body (recursive function), it must prepare
-				// the closure object in its body to use itself in its body.
-				val.IsRecursive = true
-				delete(fv, insn.Ident)
+		if _, ok := info.calls[c.name]; ok && !trans.isKnown(c.name) {
+			c.made = true
+			continue
+		}
+		for _, s := range info.children[i+1:] {
+			if _, ok := s.captures[c.name]; ok && s.made {
+				c.made = true
+				break
 			}
-			trans.closures[insn.Ident] = fv.toSortedArray()
-		} else {
-			// When the function is actually not a closure, continue to use 'dup' as current visitor
-			*trans = *dup
 		}
+	}
+}
 
-		// Visit recursively
-		trans.insn(insn.Next)
-
-		// Visit rest block of the 'fun' instruction
-		if cache, ok := trans.closureBlockFreeVars[insn.Ident]; ok {
-			fv = cache
-		} else {
-			fv = gatherFreeVarsTillTheEnd(insn.Next, trans)
-		}
-		trans.closureBlockFreeVars[insn.Ident] = fv
-
-		var replaced *mir.MakeCls
-		if _, ok := fv[insn.Ident]; ok {
-			vars, ok := trans.closures[insn.Ident]
-			if !ok {
-				// When the function is used as a variable, it must have an empty
-				// closure even if there is no free variable for the function.
-				// It's because we can't know a passed function variable is a closure or not.
-				vars = []string{}
-				trans.closures[insn.Ident] = vars
-				delete(trans.knownFuns, insn.Ident)
+// analyze calculates free variables of all functions until no function newly turns into a closure.
+func (trans *transformWithKFO) analyze() {
+	for changed := true; changed; {
+		changed = false
+		for _, f := range trans.funs {
+			trans.markMade(f)
+			if f.insn == nil {
+				// Entry point
+				continue
+			}
+			fv := trans.freeVars(f)
+			if _, ok := trans.closures[f.name]; !ok && len(fv) != 0 {
+				// Assumed the function is not a closure. But there are actually some free variables.
+				// It means that the function is actually a closure.
+				trans.closures[f.name] = struct{}{}
+				changed = true
 			}
-			// If the function is referred from somewhere, we need to  make a closure.
-			replaced = &mir.MakeCls{vars, insn.Ident}
+			f.captures = fv
 		}
-		trans.replacedFuns[insn] = replaced
-	case *mir.If:
-		trans.block(val.Then)
-		trans.block(val.Else)
-		trans.insn(insn.Next)
-	default:
-		trans.insn(insn.Next)
 	}
 }
 
@@ -152,33 +143,65 @@ func (trans *transformWithKFO) insn(insn *mir.Insn) {
 // entry point and closure information.
 // All nested function was moved to toplevel.
 func Transform(ir *mir.Block) *mir.Program {
-	t := &transformWithKFO{
-		map[string]struct{}{},
-		map[*mir.Insn]*mir.MakeCls{},
-		map[string][]string{},
-		map[string]nameSet{},
+	prog, _ := transform(ir, false)
+	return prog
+}
+
+// TransformWithReport executes closure transform as Transform does and also returns a report which
+// explains captures of closures and allocations of closure objects.
+func TransformWithReport(ir *mir.Block) (*mir.Program, *Report) {
+	return transform(ir, true)
+}
+
+func transform(ir *mir.Block, report bool) (*mir.Program, *Report) {
+	col := collectFuns(ir)
+	t := &transformWithKFO{col.funs, col.byName, nameSet{}}
+	t.analyze()
+
+	var rep *Report
+	if report {
+		// Captures are modified while moving functions to toplevel
+		rep = newReport(t)
 	}
-	t.block(ir)
 
 	// Move all functions to toplevel and put closure instance if needed
 	toplevel := mir.NewToplevel()
-	for insn, make := range t.replacedFuns {
-		f, ok := insn.Val.(*mir.Fun)
-		if !ok {
-			panic(fmt.Sprintf("Replaced function '%s' is actually not a function: %v", insn.Ident, insn.Val))
+	closures := mir.Closures{}
+	for _, f := range t.funs {
+		if f.insn == nil {
+			continue
 		}
-		toplevel.Add(insn.Ident, f, insn.Pos)
-
-		if make == nil {
-			// It's not a closure. Simply remove 'fun' instruction from list
-			insn.RemoveFromList()
-		} else {
-			// Replace 'fun' with 'makecls' to make a closure instead of defining the function
-			insn.Val = make
+		if _, ok := t.closures[f.name]; ok {
+			if _, ok := f.captures[f.name]; ok {
+				// When the closure itself is used in its body (recursive function), it must prepare
+				// the closure object in its body to use itself in its body.
+				f.fun.IsRecursive = true
+				delete(f.captures, f.name)
+			}
+			closures[f.name] = f.captures.toSortedArray()
+		}
+
+		toplevel.Add(f.name, f.fun, f.insn.Pos)
+
+		if !f.made {
+			// It's not referred as a value. Simply remove 'fun' instruction from list
+			f.insn.RemoveFromList()
+			continue
 		}
+
+		vars, ok := closures[f.name]
+		if !ok {
+			// When the function is used as a variable, it must have an empty
+			// closure even if there is no free variable for the function.
+			// It's because we can't know a passed function variable is a closure or not.
+			vars = []string{}
+			closures[f.name] = vars
+		}
+		// Replace 'fun' with 'makecls' to make a closure instead of defining the function
+		f.insn.Val = &mir.MakeCls{vars, f.name}
 	}
 
-	prog := &mir.Program{toplevel, t.closures, ir}
+	prog := &mir.Program{toplevel, closures, ir, map[string]struct{}{}, map[string]string{}, map[string]string{}}
 	fixAppsInProg(prog)
-	return prog
+	return prog, rep
 }
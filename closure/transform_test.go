@@ -507,3 +507,42 @@ func TestClosureCaptureInInsn(t *testing.T) {
 		}
 	}
 }
+
+func TestDeeplyNestedClosures(t *testing.T) {
+	// Each function is a closure capturing 'x'. Whether a function is a closure is not determined
+	// until its innermost function is visited.
+	depth := 100
+	var buf bytes.Buffer
+	buf.WriteString("let x = 1 in\n")
+	for i := 1; i <= depth; i++ {
+		fmt.Fprintf(&buf, "let rec f%d a%d =\n", i, i)
+	}
+	fmt.Fprintf(&buf, "a%d + x in\n", depth)
+	for i := depth; i >= 2; i-- {
+		fmt.Fprintf(&buf, "f%d a%d in\n", i, i-1)
+	}
+	buf.WriteString("print_int (f1 0)")
+
+	s := locerr.NewDummySource(buf.String())
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := Transform(ir)
+
+	if len(prog.Closures) != depth {
+		t.Fatalf("%d closures were expected but actually %d found: %v", depth, len(prog.Closures), prog.Closures)
+	}
+	for f, caps := range prog.Closures {
+		if len(caps) != 1 || caps[0] != "x$t1" {
+			t.Errorf("Closure '%s' should capture only 'x$t1' but actually captures %v", f, caps)
+		}
+	}
+	if len(prog.Toplevel) != depth {
+		t.Errorf("%d functions should be moved to toplevel but actually %d", depth, len(prog.Toplevel))
+	}
+}
@@ -0,0 +1,124 @@
+package closure
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// mir.Verify checks invariants of any MIR program after closure transform. This verifier checks
+// stronger invariants which closure transform guarantees on its output.
+//
+// - No 'fun' instruction remains in blocks
+// - Every 'makecls' instruction makes a closure of a toplevel function
+// - Captures of every closure are exactly the free variables referred in its body
+// - Functions which are not closures refer no free variable
+//
+// Optimization passes may make some captures unused, so the verifier is valid right after closure
+// transform (or after unused captures are trimmed).
+
+type closureVerifier struct {
+	prog *mir.Program
+}
+
+func (v *closureVerifier) verifyBlock(b *mir.Block, where string) error {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch val := i.Val.(type) {
+		case *mir.Fun:
+			return locerr.ErrorfAt(i.Pos, "Function '%s' remains in %s after closure transform", i.Ident, where)
+		case *mir.MakeCls:
+			if _, ok := v.prog.Toplevel[val.Fun]; !ok {
+				return locerr.ErrorfAt(i.Pos, "Closure '%s' in %s is made for '%s' which is not a toplevel function", i.Ident, where, val.Fun)
+			}
+		case *mir.If:
+			if err := v.verifyBlock(val.Then, where); err != nil {
+				return err
+			}
+			if err := v.verifyBlock(val.Else, where); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectRefs collects identifiers defined in the block and identifiers referred by instructions
+// in it. Callees of direct calls and external calls are not referred as values.
+func collectRefs(b *mir.Block, defs, refs nameSet) {
+	refer := func(n string) string {
+		refs[n] = struct{}{}
+		return n
+	}
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		defs[i.Ident] = struct{}{}
+		switch val := i.Val.(type) {
+		case *mir.App:
+			if val.Kind == mir.CLOSURE_CALL {
+				refer(val.Callee)
+			}
+			for _, a := range val.Args {
+				refer(a)
+			}
+		case *mir.If:
+			refer(val.Cond)
+			collectRefs(val.Then, defs, refs)
+			collectRefs(val.Else, defs, refs)
+		default:
+			mir.RenameOperands(i.Val, refer)
+		}
+	}
+}
+
+func (v *closureVerifier) verifyCaptures(f mir.FunInsn) error {
+	defs, refs := nameSet{}, nameSet{}
+	for _, p := range f.Val.Params {
+		defs[p] = struct{}{}
+	}
+	collectRefs(f.Val.Body, defs, refs)
+
+	caps, isClosure := v.prog.Closures[f.Name]
+	captured := make(nameSet, len(caps))
+	for _, c := range caps {
+		if _, ok := captured[c]; ok {
+			return locerr.ErrorfAt(f.Pos, "Closure '%s' captures variable '%s' more than once", f.Name, c)
+		}
+		if _, ok := refs[c]; !ok {
+			return locerr.ErrorfAt(f.Pos, "Closure '%s' captures variable '%s' but its body never refers it", f.Name, c)
+		}
+		captured[c] = struct{}{}
+	}
+
+	for _, r := range refs.toSortedArray() {
+		if _, ok := defs[r]; ok {
+			continue
+		}
+		if _, ok := captured[r]; ok {
+			continue
+		}
+		if isClosure && r == f.Name {
+			// Closure can refer itself
+			continue
+		}
+		if !isClosure {
+			return locerr.ErrorfAt(f.Pos, "Function '%s' is not a closure but refers free variable '%s'", f.Name, r)
+		}
+		return locerr.ErrorfAt(f.Pos, "Closure '%s' refers free variable '%s' which is not captured", f.Name, r)
+	}
+	return nil
+}
+
+// Verify checks invariants of the program which closure transform guarantees and returns an error
+// when they are broken. It should be used right after closure transform.
+func Verify(prog *mir.Program) error {
+	v := &closureVerifier{prog}
+	for _, name := range prog.Toplevel.Names() {
+		f := prog.Toplevel[name]
+		if err := v.verifyBlock(f.Val.Body, "function '"+name+"'"); err != nil {
+			return err
+		}
+		if err := v.verifyCaptures(f); err != nil {
+			return err
+		}
+	}
+	return v.verifyBlock(prog.Entry, "entry point")
+}
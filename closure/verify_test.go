@@ -0,0 +1,121 @@
+package closure
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestVerifyTransformedProgram(t *testing.T) {
+	for _, code := range []string{
+		"let rec f a = a + 1 in print_int (f 2)",
+		"let x = 1 in let rec f a = if a < 0 then x else f (a - 1) in print_int (f 2)",
+		"let x = 1 in let rec f a = (let rec g b = a + b + x in g) in print_int ((f 1) 2)",
+		"let x = 1 in let rec f a = a + x in let rec g b = f b in let rec h k = k 1 in print_int (h g)",
+	} {
+		s := locerr.NewDummySource(code)
+		ast, err := syntax.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ir, err := sema.SemanticsCheck(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(Transform(ir)); err != nil {
+			t.Errorf("Error for code '%s': %s", code, err)
+		}
+	}
+}
+
+func TestVerifyBrokenProgram(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		breaks   func(p *mir.Program)
+		expected string
+	}{
+		{
+			what: "function remaining in block",
+			code: "let x = 1 in print_int x",
+			breaks: func(p *mir.Program) {
+				body := mir.NewBlockFromArray("body (g)", []*mir.Insn{mir.NewInsn("$k100", &mir.Int{1}, locerr.Pos{})})
+				p.Entry.Prepend(mir.NewInsn("g", &mir.Fun{[]string{}, body, false}, locerr.Pos{}))
+			},
+			expected: "Function 'g' remains in entry point after closure transform",
+		},
+		{
+			what: "closure of unknown function",
+			code: "let x = 1 in let rec f a = a + x in let rec h k = k 1 in print_int (h f)",
+			breaks: func(p *mir.Program) {
+				for i, end := p.Entry.WholeRange(); i != end; i = i.Next {
+					if v, ok := i.Val.(*mir.MakeCls); ok {
+						v.Fun = "unknown"
+					}
+				}
+			},
+			expected: "Closure 'f$t2' in entry point is made for 'unknown' which is not a toplevel function",
+		},
+		{
+			what: "capture never referred",
+			code: "let x = 1 in let y = 2 in let rec f a = a + x in print_int (f y)",
+			breaks: func(p *mir.Program) {
+				p.Closures["f$t3"] = append(p.Closures["f$t3"], "y$t2")
+			},
+			expected: "Closure 'f$t3' captures variable 'y$t2' but its body never refers it",
+		},
+		{
+			what: "capture duplicated",
+			code: "let x = 1 in let rec f a = a + x in print_int (f 1)",
+			breaks: func(p *mir.Program) {
+				p.Closures["f$t2"] = []string{"x$t1", "x$t1"}
+			},
+			expected: "Closure 'f$t2' captures variable 'x$t1' more than once",
+		},
+		{
+			what: "free variable not captured",
+			code: "let x = 1 in let y = 2 in let rec f a = a + x + y in print_int (f 1)",
+			breaks: func(p *mir.Program) {
+				p.Closures["f$t3"] = []string{"x$t1"}
+			},
+			expected: "Closure 'f$t3' refers free variable 'y$t2' which is not captured",
+		},
+		{
+			what: "free variable of known function",
+			code: "let x = 1 in let rec f a = a + x in print_int (f 1)",
+			breaks: func(p *mir.Program) {
+				delete(p.Closures, "f$t2")
+			},
+			expected: "Function 'f$t2' is not a closure but refers free variable 'x$t1'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := Transform(ir)
+			if err := Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+			tc.breaks(prog)
+			err = Verify(prog)
+			if err == nil {
+				t.Fatalf("Error was expected: %s", tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Unexpected error message '%s'. It should contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package codegen
+
+import (
+	"llvm.org/llvm/bindings/go/llvm"
+	"strings"
+)
+
+// Note:
+// LLVM does not implement the C calling convention for aggregate values. Clang lowers struct
+// parameters and return values for the target ABI before emitting LLVM IR, so functions written
+// in C (e.g. runtime) expect the lowered forms. GoCaml passes strings, arrays, closures and
+// variants to external functions as structs. Tuples are passed as pointers and need no lowering.
+//
+// System V AMD64 ABI:
+//   Aggregates larger than 16 bytes are copied onto the stack ('byval') and returned via memory
+//   pointed by a hidden first parameter ('sret'). Smaller aggregates GoCaml generates are passed
+//   in registers as LLVM does by default.
+//
+// AArch64 (AAPCS64, also used by Apple Silicon):
+//   Aggregates larger than 16 bytes are copied to memory by caller and passed via pointer. They
+//   are returned via memory pointed by x8, which LLVM assigns to 'sret' parameter. Homogeneous
+//   floating-point aggregates (HFA) are passed in floating-point registers as LLVM does. Other
+//   aggregates are packed into general purpose registers, so they are coerced to i64 or [2 x i64].
+//   Without the coercion, {i1, i2} would be passed in two registers instead of one.
+//
+// Functions defined in GoCaml are not lowered because they are only called from GoCaml.
+
+type cABI int
+
+const (
+	// Aggregates are passed as values of LLVM IR as they are
+	abiDefault cABI = iota
+	// System V AMD64 ABI
+	abiSysV
+	// Procedure call standard for the ARM 64-bit architecture
+	abiAAPCS64
+)
+
+func (abi cABI) String() string {
+	switch abi {
+	case abiSysV:
+		return "System V AMD64"
+	case abiAAPCS64:
+		return "AAPCS64"
+	default:
+		return "none (aggregates are passed as values of LLVM IR)"
+	}
+}
+
+func cABIOf(triple string) cABI {
+	if strings.Contains(triple, "windows") {
+		return abiDefault
+	}
+	switch arch := strings.SplitN(triple, "-", 2)[0]; {
+	case arch == "x86_64" || arch == "amd64":
+		return abiSysV
+	case arch == "aarch64" || strings.HasPrefix(arch, "arm64"):
+		return abiAAPCS64
+	default:
+		return abiDefault
+	}
+}
+
+type argKind int
+
+const (
+	// Value is passed as is
+	argDirect argKind = iota
+	// Value is reinterpreted as a value of the lowered type
+	argCoerced
+	// Pointer to a copy of the value is passed
+	argIndirect
+)
+
+type argABI struct {
+	kind argKind
+	// Type of the value in GoCaml
+	orig llvm.Type
+	// Type of the value in the lowered signature
+	lowered llvm.Type
+}
+
+// cSignature is a signature of external function lowered for the C calling convention.
+type cSignature struct {
+	ret    argABI
+	params []argABI
+	// Lowered function type. When return value is indirect, its pointer is the first parameter.
+	fun llvm.Type
+}
+
+func (sig *cSignature) hasIndirect() bool {
+	if sig.ret.kind == argIndirect {
+		return true
+	}
+	for _, p := range sig.params {
+		if p.kind == argIndirect {
+			return true
+		}
+	}
+	return false
+}
+
+// hfaMembers returns the number of floating-point members if the type is a homogeneous
+// floating-point aggregate. Otherwise it returns 0.
+func hfaMembers(t llvm.Type, base llvm.TypeKind) int {
+	switch t.TypeKind() {
+	case llvm.StructTypeKind:
+		n := 0
+		for _, elem := range t.StructElementTypes() {
+			m := hfaMembers(elem, base)
+			if m == 0 {
+				return 0
+			}
+			n += m
+		}
+		return n
+	case base:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isHFA(t llvm.Type) bool {
+	for _, base := range []llvm.TypeKind{llvm.DoubleTypeKind, llvm.FloatTypeKind} {
+		if n := hfaMembers(t, base); 1 <= n && n <= 4 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *moduleBuilder) classifyCArg(t llvm.Type) argABI {
+	if b.abi == abiDefault || t.TypeKind() != llvm.StructTypeKind {
+		return argABI{argDirect, t, t}
+	}
+	size := b.targetData.TypeAllocSize(t)
+	if size > 16 {
+		return argABI{argIndirect, t, llvm.PointerType(t, 0 /*address space*/)}
+	}
+	if b.abi == abiSysV || size == 0 || isHFA(t) {
+		return argABI{argDirect, t, t}
+	}
+	i64 := b.context.Int64Type()
+	if size <= 8 {
+		return argABI{argCoerced, t, i64}
+	}
+	return argABI{argCoerced, t, llvm.ArrayType(i64, 2)}
+}
+
+func (b *moduleBuilder) lowerCSignature(t llvm.Type) *cSignature {
+	ret := b.classifyCArg(t.ReturnType())
+	origParams := t.ParamTypes()
+	params := make([]argABI, 0, len(origParams))
+	lowered := make([]llvm.Type, 0, len(origParams)+1)
+
+	retTy := ret.lowered
+	if ret.kind == argIndirect {
+		lowered = append(lowered, ret.lowered)
+		retTy = b.context.VoidType()
+	}
+	for _, p := range origParams {
+		param := b.classifyCArg(p)
+		params = append(params, param)
+		lowered = append(lowered, param.lowered)
+	}
+
+	return &cSignature{ret, params, llvm.FunctionType(retTy, lowered, false /*varargs*/)}
+}
+
+// addCAttributes adds attributes for indirect values and bools to the function declaration or the
+// call instruction.
+func (b *moduleBuilder) addCAttributes(sig *cSignature, add func(int, llvm.Attribute)) {
+	// Index 0 is for return value. Parameters start from index 1
+	idx := 1
+	if sig.ret.kind == argIndirect {
+		add(idx, b.attributes["sret"])
+		idx++
+	} else if isBool(sig.ret.lowered) {
+		add(0, b.attributes["zeroext"])
+	}
+	for _, p := range sig.params {
+		if p.kind == argIndirect && b.abi == abiSysV {
+			add(idx, b.attributes["byval"])
+		} else if isBool(p.lowered) {
+			add(idx, b.attributes["zeroext"])
+		}
+		idx++
+	}
+}
+
+func isBool(t llvm.Type) bool {
+	return t.TypeKind() == llvm.IntegerTypeKind && t.IntTypeWidth() == 1
+}
+
+// addBoolAttributes adds 'zeroext' to bool parameters and return value of the function type since
+// bool is C's int (gocaml_bool) in C ABI.
+func (b *moduleBuilder) addBoolAttributes(t llvm.Type, add func(int, llvm.Attribute)) {
+	if isBool(t.ReturnType()) {
+		add(0, b.attributes["zeroext"])
+	}
+	for i, p := range t.ParamTypes() {
+		if isBool(p) {
+			add(i+1, b.attributes["zeroext"])
+		}
+	}
+}
+
+// buildExternalCall calls the external C function with arguments following the calling
+// convention of the target.
+func (b *blockBuilder) buildExternalCall(cName string, args []llvm.Value) llvm.Value {
+	funVal, ok := b.globalTable[cName]
+	if !ok {
+		panic("Value for function is not found in table: " + cName)
+	}
+	sig, ok := b.cSignatures[cName]
+	if !ok {
+		panic("Signature of external function is not found: " + cName)
+	}
+
+	lowered := make([]llvm.Value, 0, len(args)+1)
+	var retSlot llvm.Value
+	if sig.ret.kind == argIndirect {
+		retSlot = b.buildAlloca(sig.ret.orig, "sret")
+		lowered = append(lowered, retSlot)
+	}
+
+	for i, arg := range args {
+		switch p := sig.params[i]; p.kind {
+		case argDirect:
+			lowered = append(lowered, arg)
+		case argCoerced:
+			// Allocate the lowered type since it may be larger than the original type
+			slot := b.buildAlloca(p.lowered, "coerce")
+			b.builder.CreateStore(arg, b.builder.CreateBitCast(slot, llvm.PointerType(p.orig, 0 /*address space*/), ""))
+			lowered = append(lowered, b.builder.CreateLoad(slot, ""))
+		case argIndirect:
+			slot := b.buildAlloca(p.orig, "byval")
+			b.builder.CreateStore(arg, slot)
+			lowered = append(lowered, slot)
+		}
+	}
+
+	var ret llvm.Value
+	if sig.hasIndirect() {
+		// Statepoint cannot pass 'sret' and 'byval' attributes to the callee
+		ret = b.builder.CreateCall(funVal, lowered, "")
+		b.addCAttributes(sig, ret.AddCallSiteAttribute)
+	} else {
+		ret = b.buildCall(funVal, lowered, llvm.CCallConv)
+		if !b.gcStackMaps {
+			b.addCAttributes(sig, ret.AddCallSiteAttribute)
+		}
+	}
+
+	switch sig.ret.kind {
+	case argCoerced:
+		slot := b.buildAlloca(sig.ret.lowered, "coerce")
+		b.builder.CreateStore(ret, slot)
+		return b.builder.CreateLoad(b.builder.CreateBitCast(slot, llvm.PointerType(sig.ret.orig, 0 /*address space*/), ""), "")
+	case argIndirect:
+		return b.builder.CreateLoad(retSlot, "")
+	default:
+		return ret
+	}
+}
@@ -0,0 +1,97 @@
+package codegen
+
+import (
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestCABIOf(t *testing.T) {
+	for triple, want := range map[string]cABI{
+		"x86_64-unknown-linux-gnu":  abiSysV,
+		"x86_64-apple-darwin17.0.0": abiSysV,
+		"aarch64-unknown-linux-gnu": abiAAPCS64,
+		"arm64-apple-darwin20.1.0":  abiAAPCS64,
+		"arm64e-apple-darwin20.1.0": abiAAPCS64,
+		"x86_64-pc-windows-msvc":    abiDefault,
+		"wasm32-unknown-unknown":    abiDefault,
+		"armv7-unknown-linux-gnu":   abiDefault,
+	} {
+		if have := cABIOf(triple); have != want {
+			t.Errorf("Wanted %s ABI for '%s' but got %s", want, triple, have)
+		}
+	}
+}
+
+func testEmitIRForTriple(code string, triple string) (string, error) {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return "", err
+	}
+	prog := closure.Transform(ir)
+	opts := EmitOptions{OptimizeNone, triple, "", "", "", false, false, false, false, nil, false, false, "", RelocDefault, GCBoehm}
+	e, err := NewEmitter(prog, env, s, opts)
+	if err != nil {
+		return "", err
+	}
+	defer e.Dispose()
+	return e.EmitLLVMIR(), nil
+}
+
+func TestLowerExternalFunctions(t *testing.T) {
+	code := `
+	external f: string option option -> string option option = "c_f";
+	let s = str_concat "a" "b" in
+	let g = str_length in
+	println_int (g s);
+	f None`
+	cases := []struct {
+		triple string
+		want   []string
+	}{
+		{
+			triple: "aarch64-unknown-linux-gnu",
+			want: []string{
+				"declare [2 x i64] @str_concat([2 x i64], [2 x i64])",
+				"call [2 x i64] @str_concat(",
+				"declare i64 @str_length([2 x i64])",
+				"sret",
+			},
+		},
+		{
+			triple: "arm64-apple-darwin20.1.0",
+			want: []string{
+				"declare [2 x i64] @str_concat([2 x i64], [2 x i64])",
+			},
+		},
+		{
+			triple: "x86_64-unknown-linux-gnu",
+			want: []string{
+				"declare %gocaml.string @str_concat(%gocaml.string, %gocaml.string)",
+				"sret",
+				"byval",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.triple, func(t *testing.T) {
+			ir, err := testEmitIRForTriple(code, tc.triple)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(ir, want) {
+					t.Errorf("'%s' was not found in LLVM IR: %s", want, ir)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/rhysd/gocaml/mir"
 	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"hash/fnv"
 	"llvm.org/llvm/bindings/go/llvm"
 )
 
@@ -32,11 +34,19 @@ type blockBuilder struct {
 	registers   map[string]llvm.Value
 	unitVal     llvm.Value
 	allocaBlock llvm.BasicBlock
+	// Beginning of the function body and slots of parameters for 'jump' instructions
+	loopBlock  llvm.BasicBlock
+	paramSlots []llvm.Value
+	// Pointer to the environment of the closure being built. It is empty outside closures
+	envPtr llvm.Value
+	// Slots of heap pointers in values for GC stack maps and built-in GC
+	roots     map[string][]gcRoot
+	rootSlots []llvm.Value
 }
 
 func newBlockBuilder(b *moduleBuilder, allocaBlock llvm.BasicBlock) *blockBuilder {
 	unit := llvm.Undef(b.typeBuilder.unitT)
-	return &blockBuilder{b, map[string]llvm.Value{}, unit, allocaBlock}
+	return &blockBuilder{b, map[string]llvm.Value{}, unit, allocaBlock, llvm.BasicBlock{}, nil, llvm.Value{}, map[string][]gcRoot{}, nil}
 }
 
 func (b *blockBuilder) resolve(ident string) llvm.Value {
@@ -45,7 +55,7 @@ func (b *blockBuilder) resolve(ident string) llvm.Value {
 	// Functions and external symbols are treated as global variable. But they are directly referred
 	// in builder. So we don't need to check global variables generally here.
 	if reg, ok := b.registers[ident]; ok {
-		return reg
+		return b.reloadRoots(ident, reg)
 	}
 	panic("No value was found for identifier: " + ident)
 }
@@ -60,27 +70,21 @@ func (b *blockBuilder) typeOf(ident string) types.Type {
 	panic("Type was not found for ident: " + ident)
 }
 
-func (b *blockBuilder) buildMallocRaw(ty llvm.Type, sizeVal llvm.Value, name string) llvm.Value {
-	mallocVal, ok := b.globalTable["GC_malloc"]
-	if !ok {
-		panic("'GC_malloc' not found. Function protoypes for libgc were not emitted")
-	}
-	allocated := b.builder.CreateCall(mallocVal, []llvm.Value{sizeVal}, "")
-	ptrTy := llvm.PointerType(ty, 0 /*address space*/)
-	return b.builder.CreateBitCast(allocated, ptrTy, name)
+func (b *blockBuilder) buildMalloc(ty llvm.Type, name string) llvm.Value {
+	return b.buildGCAlloc(ty, llvm.ConstInt(b.typeBuilder.sizeT, 1, false /*sign extend*/), name)
 }
 
-func (b *blockBuilder) buildMalloc(ty llvm.Type, name string) llvm.Value {
-	size := b.targetData.TypeAllocSize(ty)
-	sizeVal := llvm.ConstInt(b.typeBuilder.sizeT, size, false /*sign extend*/)
-	return b.buildMallocRaw(ty, sizeVal, name)
+// buildObjectAlloc allocates memory for the object bound to the identifier. The object is allocated
+// on stack when it never escapes from the function. Otherwise it is allocated on GC heap.
+func (b *blockBuilder) buildObjectAlloc(ident string, ty llvm.Type, name string) llvm.Value {
+	if _, ok := b.stackAllocated[ident]; ok {
+		return b.buildAlloca(ty, name)
+	}
+	return b.buildMalloc(ty, name)
 }
 
 func (b *blockBuilder) buildArrayMalloc(ty llvm.Type, numElems llvm.Value, name string) llvm.Value {
-	size := b.targetData.TypeAllocSize(ty)
-	tySizeVal := llvm.ConstInt(b.typeBuilder.sizeT, size, false /*sign extend*/)
-	sizeVal := b.builder.CreateMul(tySizeVal, b.builder.CreateTrunc(numElems, b.typeBuilder.sizeT, ""), "")
-	return b.buildMallocRaw(ty, sizeVal, name)
+	return b.buildGCAlloc(ty, b.builder.CreateTrunc(numElems, b.typeBuilder.sizeT, ""), name)
 }
 
 func (b *blockBuilder) buildAlloca(t llvm.Type, name string) llvm.Value {
@@ -97,6 +101,30 @@ func (b *blockBuilder) buildAlloca(t llvm.Type, name string) llvm.Value {
 	return alloca
 }
 
+// buildLoopHeader prepares the loop for 'jump' instructions in the function body. Parameters are
+// stored in stack slots and loaded at the beginning of the loop. 'jump' instruction stores new
+// arguments to the slots and jumps to the beginning. The slots will be promoted to registers by
+// mem2reg pass.
+func (b *blockBuilder) buildLoopHeader(params []string) {
+	slots := make([]llvm.Value, 0, len(params))
+	for _, p := range params {
+		reg := b.resolve(p)
+		slot := b.buildAlloca(reg.Type(), p+".slot")
+		b.builder.CreateStore(reg, slot)
+		slots = append(slots, slot)
+	}
+
+	loop := llvm.AddBasicBlock(b.builder.GetInsertBlock().Parent(), "loop")
+	b.builder.CreateBr(loop)
+	b.builder.SetInsertPointAtEnd(loop)
+	for i, p := range params {
+		b.registers[p] = b.builder.CreateLoad(slots[i], p)
+	}
+
+	b.loopBlock = loop
+	b.paramSlots = slots
+}
+
 func (b *blockBuilder) buildEq(ty types.Type, bin *mir.Binary, lhs, rhs llvm.Value) llvm.Value {
 	icmp, fcmp, name := getOpCmpPredicate(bin.Op)
 
@@ -113,11 +141,7 @@ func (b *blockBuilder) buildEq(ty types.Type, bin *mir.Binary, lhs, rhs llvm.Val
 	case *types.Float:
 		return b.builder.CreateFCmp(fcmp, lhs, rhs, name)
 	case *types.String:
-		eqlFun, ok := b.globalTable["__str_equal"]
-		if !ok {
-			panic("__str_equal() not found")
-		}
-		cmp := b.builder.CreateCall(eqlFun, []llvm.Value{lhs, rhs}, "")
+		cmp := b.buildExternalCall("__str_equal", []llvm.Value{lhs, rhs})
 		i := uint64(1)
 		if bin.Op == mir.NEQ {
 			i = 0
@@ -146,6 +170,8 @@ func (b *blockBuilder) buildEq(ty types.Type, bin *mir.Binary, lhs, rhs llvm.Val
 		return b.builder.CreateICmp(icmp, lfun, rfun, name+".fun")
 	case *types.Option:
 		return b.buildEqOption(ty, bin, lhs, rhs)
+	case *types.Result:
+		return b.buildEqResult(ty, bin, lhs, rhs)
 	case *types.Array:
 		panic("unreachable")
 	default:
@@ -203,6 +229,60 @@ func (b *blockBuilder) buildEqOption(ty *types.Option, bin *mir.Binary, lhs, rhs
 	return phi
 }
 
+func (b *blockBuilder) buildResultPayload(resVal llvm.Value, ty types.Type) llvm.Value {
+	boxed := b.builder.CreateExtractValue(resVal, 1, "")
+	ptr := b.builder.CreateBitCast(boxed, llvm.PointerType(b.typeBuilder.fromMIR(ty), 0 /*address space*/), "")
+	return b.builder.CreateLoad(ptr, "")
+}
+
+func (b *blockBuilder) buildEqResult(ty *types.Result, bin *mir.Binary, lhs, rhs llvm.Value) llvm.Value {
+	lhsTag := b.builder.CreateExtractValue(lhs, 0, "")
+	rhsTag := b.builder.CreateExtractValue(rhs, 0, "")
+	sameTag := b.builder.CreateICmp(llvm.IntEQ, lhsTag, rhsTag, "")
+	lhsIsOk := b.builder.CreateICmp(llvm.IntEQ, lhsTag, b.variantTagVal("Ok"), "")
+
+	parent := b.builder.GetInsertBlock().Parent()
+	sameBlk := llvm.AddBasicBlock(parent, "eq.res.same")
+	okBlk := llvm.AddBasicBlock(parent, "eq.res.ok")
+	errBlk := llvm.AddBasicBlock(parent, "eq.res.err")
+	diffBlk := llvm.AddBasicBlock(parent, "eq.res.diff")
+	endBlk := llvm.AddBasicBlock(parent, "eq.res.end")
+
+	b.builder.CreateCondBr(sameTag, sameBlk, diffBlk)
+
+	b.builder.SetInsertPointAtEnd(sameBlk)
+	b.builder.CreateCondBr(lhsIsOk, okBlk, errBlk)
+
+	// When both values are Ok(v), compare contained values
+	b.builder.SetInsertPointAtEnd(okBlk)
+	okEqVal := b.buildEq(ty.Ok, bin, b.buildResultPayload(lhs, ty.Ok), b.buildResultPayload(rhs, ty.Ok))
+	b.builder.CreateBr(endBlk)
+	okLastBlk := b.builder.GetInsertBlock()
+
+	// When both values are Error(v), compare contained values
+	errBlk.MoveAfter(okLastBlk)
+	b.builder.SetInsertPointAtEnd(errBlk)
+	errEqVal := b.buildEq(ty.Error, bin, b.buildResultPayload(lhs, ty.Error), b.buildResultPayload(rhs, ty.Error))
+	b.builder.CreateBr(endBlk)
+	errLastBlk := b.builder.GetInsertBlock()
+
+	// One is Ok(v) and another is Error(v)
+	diffBlk.MoveAfter(errLastBlk)
+	b.builder.SetInsertPointAtEnd(diffBlk)
+	i := uint64(0)
+	if bin.Op == mir.NEQ {
+		i = 1
+	}
+	diffEqVal := llvm.ConstInt(b.typeBuilder.boolT, i, false /*sign extend*/)
+	b.builder.CreateBr(endBlk)
+
+	endBlk.MoveAfter(diffBlk)
+	b.builder.SetInsertPointAtEnd(endBlk)
+	phi := b.builder.CreatePHI(b.typeBuilder.boolT, "eq.res.merge")
+	phi.AddIncoming([]llvm.Value{okEqVal, errEqVal, diffEqVal}, []llvm.BasicBlock{okLastBlk, errLastBlk, diffBlk})
+	return phi
+}
+
 func (b *blockBuilder) buildIsSome(optVal llvm.Value, tyVal llvm.Type, ty *types.Option) llvm.Value {
 	switch ty.Elem.(type) {
 	case *types.Int, *types.Bool, *types.Float:
@@ -214,9 +294,9 @@ func (b *blockBuilder) buildIsSome(optVal llvm.Value, tyVal llvm.Type, ty *types
 	case *types.String, *types.Fun, *types.Array:
 		ptr := b.builder.CreateExtractValue(optVal, 0, "")
 		return b.builder.CreateNot(b.builder.CreateIsNull(ptr, ""), "issome")
-	case *types.Tuple:
+	case *types.Tuple, *types.Table, *types.Buffer, *types.Json:
 		return b.builder.CreateNot(b.builder.CreateIsNull(optVal, ""), "issome")
-	case *types.Option, *types.Unit:
+	case *types.Option, *types.Unit, *types.Variant, *types.Result:
 		flag := b.builder.CreateExtractValue(optVal, 0, "")
 		return b.builder.CreateICmp(
 			llvm.IntEQ,
@@ -250,15 +330,72 @@ func (b *blockBuilder) buildDerefSome(optVal llvm.Value, ty *types.Option) llvm.
 		v := b.builder.CreateLShr(optVal, one, "")
 		// Truncate to the same size bits
 		return b.builder.CreateTrunc(v, b.typeBuilder.boolT, "derefsome")
-	case *types.String, *types.Fun, *types.Array, *types.Tuple:
+	case *types.String, *types.Fun, *types.Array, *types.Tuple, *types.Table, *types.Buffer, *types.Json:
 		return optVal
-	case *types.Option, *types.Unit:
+	case *types.Option, *types.Unit, *types.Variant, *types.Result:
 		return b.builder.CreateExtractValue(optVal, 1, "derefsome")
 	default:
 		panic("unreachable")
 	}
 }
 
+func (b *blockBuilder) buildSome(ty *types.Option, elemVal llvm.Value) llvm.Value {
+	switch ty.Elem.(type) {
+	case *types.Int, *types.Bool:
+		tyVal := b.typeBuilder.buildOption(ty)
+		// Extend 1 bit for flag
+		extended := b.builder.CreateZExt(elemVal, tyVal, "")
+		// Lowest bit is a flag. So shift left by 1 bit
+		shifted := b.builder.CreateShl(extended, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
+		// Set flag to 1
+		return b.builder.CreateOr(shifted, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
+	case *types.Float:
+		// Similar to Int or Bool cases, but bitcast is required
+		tyVal := b.typeBuilder.buildOption(ty)
+		casted := b.builder.CreateBitCast(elemVal, llvm.Int64Type(), "")
+		extended := b.builder.CreateZExt(casted, tyVal, "")
+		shifted := b.builder.CreateShl(extended, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
+		return b.builder.CreateOr(shifted, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
+	case *types.String, *types.Fun, *types.Array, *types.Tuple, *types.Table, *types.Buffer, *types.Json:
+		// They use NULL pointer for 'None' value. So nothing to do to make 'Some' value.
+		return elemVal
+	case *types.Option, *types.Unit, *types.Variant, *types.Result:
+		v := llvm.Undef(b.typeBuilder.buildOption(ty))
+		v = b.builder.CreateInsertValue(v, llvm.ConstInt(b.typeBuilder.boolT, 1, false), 0, "some.flag")
+		v = b.builder.CreateInsertValue(v, elemVal, 1, "some.elem")
+		return v
+	default:
+		panic("unreachable")
+	}
+}
+
+func (b *blockBuilder) buildNone(ty *types.Option) llvm.Value {
+	tyVal := b.typeBuilder.buildOption(ty)
+	switch ty.Elem.(type) {
+	case *types.Int, *types.Bool, *types.Float:
+		return llvm.ConstInt(tyVal, 0, false)
+	case *types.String, *types.Fun, *types.Array:
+		// Null pointer at the first field means 'None'. Other fields are also null since
+		// reference counting reads pointers in them
+		return llvm.ConstNull(tyVal)
+	case *types.Tuple, *types.Table, *types.Buffer, *types.Json:
+		return llvm.ConstPointerNull(tyVal)
+	case *types.Option, *types.Unit, *types.Variant, *types.Result:
+		// Flag is false
+		return llvm.ConstNull(tyVal)
+	default:
+		panic("unreachable")
+	}
+}
+
+// Tag of polymorphic variant is represented as a hash value of its name at runtime. Since the value
+// only depends on its name, the same tag has the same value in all variant types.
+func (b *blockBuilder) variantTagVal(tag string) llvm.Value {
+	h := fnv.New64a()
+	h.Write([]byte(tag))
+	return llvm.ConstInt(b.typeBuilder.intT, h.Sum64(), false /*sign extend*/)
+}
+
 func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 	switch val := val.(type) {
 	case *mir.Unit:
@@ -274,17 +411,21 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 	case *mir.Float:
 		return llvm.ConstFloat(b.typeBuilder.floatT, val.Const)
 	case *mir.String:
-		strVal := b.buildAlloca(b.typeBuilder.stringT, "")
-
-		charsVal := b.builder.CreateGlobalStringPtr(val.Const, "")
-		charsPtr := b.builder.CreateStructGEP(strVal, 0, "")
-		b.builder.CreateStore(charsVal, charsPtr)
-
+		// Note:
+		// String is a pair of pointer to characters and its length. Characters are not
+		// null-terminated and may contain '\0'. So the literal is emitted as a constant array of
+		// exactly its length instead of C string.
+		charsVal := llvm.ConstString(val.Const, false /*addnull*/)
+		global := llvm.AddGlobal(b.module, charsVal.Type(), "str")
+		global.SetInitializer(charsVal)
+		global.SetLinkage(llvm.PrivateLinkage)
+		global.SetGlobalConstant(true)
+		global.SetUnnamedAddr(true)
+
+		zero := llvm.ConstInt(b.context.Int32Type(), 0, false /*signed*/)
+		charsPtr := llvm.ConstInBoundsGEP(global, []llvm.Value{zero, zero})
 		sizeVal := llvm.ConstInt(b.typeBuilder.intT, uint64(len(val.Const)), true /*signed*/)
-		sizePtr := b.builder.CreateStructGEP(strVal, 1, "str.size")
-		b.builder.CreateStore(sizeVal, sizePtr)
-
-		return b.builder.CreateLoad(strVal, "str")
+		return llvm.ConstNamedStruct(b.typeBuilder.stringT, []llvm.Value{charsPtr, sizeVal})
 	case *mir.Unary:
 		child := b.resolve(val.Child)
 		switch val.Op {
@@ -335,53 +476,35 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		if !ok {
 			panic("Value not found for ref: " + val.Ident)
 		}
-		return reg
+		return b.reloadRoots(val.Ident, reg)
 	case *mir.If:
-		parent := b.builder.GetInsertBlock().Parent()
-		thenBlock := llvm.AddBasicBlock(parent, "if.then")
-		elseBlock := llvm.AddBasicBlock(parent, "if.else")
-		endBlock := llvm.AddBasicBlock(parent, "if.end")
-
-		ty := b.typeBuilder.fromMIR(b.typeOf(ident))
-		cond := b.resolve(val.Cond)
-		b.builder.CreateCondBr(cond, thenBlock, elseBlock)
-
-		b.builder.SetInsertPointAtEnd(thenBlock)
-		thenVal := b.buildBlock(val.Then)
-		b.builder.CreateBr(endBlock)
-		thenLastBlock := b.builder.GetInsertBlock()
-
-		elseBlock.MoveAfter(thenLastBlock)
-		b.builder.SetInsertPointAtEnd(elseBlock)
-		elseVal := b.buildBlock(val.Else)
-		b.builder.CreateBr(endBlock)
-		elseLastBlock := b.builder.GetInsertBlock()
-
-		endBlock.MoveAfter(elseLastBlock)
-		b.builder.SetInsertPointAtEnd(endBlock)
-		phi := b.builder.CreatePHI(ty, "if.merge")
-		phi.AddIncoming([]llvm.Value{thenVal, elseVal}, []llvm.BasicBlock{thenLastBlock, elseLastBlock})
-		return phi
+		panic("unreachable because 'if' is built with its position by buildIf()")
 	case *mir.Fun:
 		panic("unreachable because IR was closure-transformed")
 	case *mir.App:
+		if val.Kind == mir.EXTERNAL_CALL {
+			args := make([]llvm.Value, 0, len(val.Args))
+			for _, a := range val.Args {
+				args = append(args, b.resolve(a))
+			}
+			ret := b.buildExternalCall(b.env.Externals[val.Callee].CName, args)
+			if ret.Type().TypeKind() == llvm.VoidTypeKind {
+				ret = b.unitVal
+			}
+			return ret
+		}
+
 		argsLen := len(val.Args)
-		if val.Kind == mir.CLOSURE_CALL {
+		_, closureFun := b.closures[val.Callee]
+		if val.Kind == mir.CLOSURE_CALL || val.Kind == mir.DIRECT_CALL && closureFun {
 			argsLen++
 		}
 		argVals := make([]llvm.Value, 0, argsLen)
 
-		table := b.funcTable
-		callee := val.Callee
-		if val.Kind == mir.EXTERNAL_CALL {
-			table = b.globalTable
-			callee = b.env.Externals[val.Callee].CName
-		}
-
 		// Find function pointer for invoking a function directly
-		funVal, funFound := table[callee]
+		funVal, funFound := b.funcTable[val.Callee]
 		if !funFound && val.Kind != mir.CLOSURE_CALL {
-			panic("Value for function is not found in table: " + callee)
+			panic("Value for function is not found in table: " + val.Callee)
 		}
 
 		if val.Kind == mir.CLOSURE_CALL {
@@ -395,15 +518,27 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 			// Extract pointer to captures object
 			capturesPtr := b.builder.CreateExtractValue(closureVal, 1, "capturesptr")
 			argVals = append(argVals, capturesPtr)
+		} else if val.Kind == mir.DIRECT_CALL && closureFun {
+			// Closure which captures nothing is called directly. Its captures are never accessed.
+			argVals = append(argVals, llvm.ConstPointerNull(b.typeBuilder.voidPtrT))
 		}
 
 		for _, a := range val.Args {
 			argVals = append(argVals, b.resolve(a))
 		}
 
+		cc := gocamlCallConv
+		if val.Kind == mir.CLOSURE_CALL || closureFun {
+			cc = closureCallConv
+		}
+
 		// Note:
 		// Call inst cannot have a name when the return type is void.
-		ret := b.builder.CreateCall(funVal, argVals, "")
+		ret := b.buildCall(funVal, argVals, cc)
+		if cc == closureCallConv && !b.gcStackMaps {
+			// Closure may be a function written in C which expects C's int for bool
+			b.addBoolAttributes(funVal.Type().ElementType(), ret.AddCallSiteAttribute)
+		}
 		if ret.Type().TypeKind() == llvm.VoidTypeKind {
 			// When returned value is void
 			ret = b.unitVal
@@ -416,11 +551,12 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		ptrTy := b.typeBuilder.fromMIR(b.typeOf(ident))
 		allocTy := ptrTy.ElementType()
 
-		ptr := b.buildMalloc(allocTy, ident)
+		ptr := b.buildObjectAlloc(ident, allocTy, ident)
+		_, onStack := b.stackAllocated[ident]
 		for i, e := range val.Elems {
 			v := b.resolve(e)
 			p := b.builder.CreateStructGEP(ptr, i, fmt.Sprintf("%s.%d", ident, i))
-			b.builder.CreateStore(v, p)
+			b.buildStoreToHeap(v, p, !onStack)
 		}
 		return ptr
 	case *mir.Array:
@@ -458,7 +594,7 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		// Copy 2nd argument to each element
 		b.builder.SetInsertPointAtEnd(loopBlock)
 		elemPtr := b.builder.CreateInBoundsGEP(arrVal, []llvm.Value{iterVal}, "")
-		b.builder.CreateStore(elemVal, elemPtr)
+		b.buildStoreToHeap(elemVal, elemPtr, true)
 		iterVal = b.builder.CreateAdd(iterVal, llvm.ConstInt(b.typeBuilder.intT, 1, false), "arr.init.inc")
 		b.builder.CreateStore(iterVal, iterPtr)
 		b.builder.CreateBr(condBlock)
@@ -476,7 +612,8 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 			panic("Type of arrlit instruction is not array")
 		}
 
-		arr := llvm.Undef(b.typeBuilder.fromMIR(t))
+		// Buffer of empty array is null
+		arr := llvm.ConstNull(b.typeBuilder.fromMIR(t))
 		sizeVal := llvm.ConstInt(b.typeBuilder.intT, uint64(len(val.Elems)), false /*signed*/)
 		arr = b.builder.CreateInsertValue(arr, sizeVal, 1, "")
 
@@ -492,7 +629,7 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 			indices := []llvm.Value{llvm.ConstInt(b.typeBuilder.intT, uint64(i), false /*sized*/)}
 			elemVal := b.resolve(elem)
 			elemPtr := b.builder.CreateInBoundsGEP(arrPtr, indices, fmt.Sprintf("array.elem.%d", i))
-			b.builder.CreateStore(elemVal, elemPtr)
+			b.buildStoreToHeap(elemVal, elemPtr, true)
 		}
 
 		return arr
@@ -512,11 +649,28 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		rhsVal := b.resolve(val.RHS)
 		arrPtr := b.builder.CreateExtractValue(toVal, 0, "")
 		elemPtr := b.builder.CreateInBoundsGEP(arrPtr, []llvm.Value{idxVal}, "")
+		if b.gcKind == GCRefCount {
+			// Retain new value before releasing old one since they may be the same object
+			old := b.builder.CreateLoad(elemPtr, "arrstore.old")
+			b.buildStoreToHeap(rhsVal, elemPtr, true)
+			b.buildRelease(old)
+			return b.unitVal
+		}
 		b.builder.CreateStore(rhsVal, elemPtr)
 		return b.unitVal
+	case *mir.BoundsCheck:
+		panic("unreachable")
 	case *mir.ArrLen:
 		fromVal := b.resolve(val.Array)
 		return b.builder.CreateExtractValue(fromVal, 1, "arrsize")
+	case *mir.Table:
+		return b.buildTableCreate(ident)
+	case *mir.TblLoad:
+		return b.buildTableFind(ident, val)
+	case *mir.TblStore:
+		return b.buildTableSet(val)
+	case *mir.TblRemove:
+		return b.buildTableRemove(val)
 	case *mir.XRef:
 		ext, ok := b.env.Externals[val.Ident]
 		if !ok {
@@ -539,10 +693,12 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		alloc := b.buildAlloca(clsTy, "")
 		funPtr := b.builder.CreateStructGEP(alloc, 0, "")
 		b.builder.CreateStore(funVal, funPtr)
+		// Wrapper does not use environment
+		envPtr := b.builder.CreateStructGEP(alloc, 1, "")
+		b.builder.CreateStore(llvm.ConstPointerNull(b.typeBuilder.voidPtrT), envPtr)
 		return b.builder.CreateLoad(alloc, val.Ident+".cls")
 	case *mir.MakeCls:
-		closure, ok := b.closures[val.Fun]
-		if !ok {
+		if _, ok := b.closures[val.Fun]; !ok {
 			panic("Closure for function not found: " + val.Fun)
 		}
 
@@ -553,7 +709,7 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		funPtrTy := llvm.PointerType(b.typeBuilder.buildFun(funcT, false), 0 /*address space*/)
 
 		closureTy := b.context.StructCreateNamed(fmt.Sprintf("%s.clsobj", val.Fun))
-		capturesTy := b.typeBuilder.buildClosureCaptures(val.Fun, closure)
+		capturesTy, indices := b.envLayout(val.Fun)
 		closureTy.StructSetBody([]llvm.Type{funPtrTy, llvm.PointerType(capturesTy, 0 /*address space*/)}, false /*packed*/)
 
 		closureVal := b.buildAlloca(closureTy, "")
@@ -565,11 +721,28 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 		}
 		b.builder.CreateStore(funPtr, b.builder.CreateStructGEP(closureVal, 0, ""))
 
-		capturesVal := b.buildMalloc(capturesTy, fmt.Sprintf("captures.%s", val.Fun))
-		for i, v := range val.Vars {
-			ptr := b.builder.CreateStructGEP(capturesVal, i, "")
-			freevar := b.resolve(v)
-			b.builder.CreateStore(freevar, ptr)
+		var capturesVal llvm.Value
+		if shared, ok := b.sharedEnvs[ident]; ok {
+			// Reuse captures of the preceding closure which captures the same variables
+			capturesPtr := b.builder.CreateExtractValue(b.resolve(shared), 1, "")
+			capturesVal = b.builder.CreateBitCast(capturesPtr, llvm.PointerType(capturesTy, 0 /*address space*/), fmt.Sprintf("captures.%s", val.Fun))
+		} else {
+			capturesVal = b.buildObjectAlloc(ident, capturesTy, fmt.Sprintf("captures.%s", val.Fun))
+			_, onStack := b.stackAllocated[ident]
+			offset := 0
+			if _, linked := b.envLinks[val.Fun]; linked {
+				// Linked closure is always made in its enclosing closure. Link to the environment of it.
+				if b.envPtr.C == nil {
+					panic("FATAL: Linked closure '" + val.Fun + "' is made outside closure")
+				}
+				b.buildStoreToHeap(b.envPtr, b.builder.CreateStructGEP(capturesVal, 0, ""), !onStack)
+				offset = 1
+			}
+			for i, idx := range indices {
+				ptr := b.builder.CreateStructGEP(capturesVal, i+offset, "")
+				freevar := b.resolve(val.Vars[idx])
+				b.buildStoreToHeap(freevar, ptr, !onStack)
+			}
 		}
 		b.builder.CreateStore(capturesVal, b.builder.CreateStructGEP(closureVal, 1, ""))
 
@@ -581,63 +754,17 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 
 		return b.builder.CreateLoad(castedVal, fmt.Sprintf("closure.%s", val.Fun))
 	case *mir.Some:
-		elemVal := b.resolve(val.Elem)
 		ty, ok := b.typeOf(ident).(*types.Option)
 		if !ok {
 			panic("Type of Some is not an option type: " + b.typeOf(ident).String())
 		}
-
-		switch ty.Elem.(type) {
-		case *types.Int, *types.Bool:
-			tyVal := b.typeBuilder.buildOption(ty)
-			// Extend 1 bit for flag
-			extended := b.builder.CreateZExt(elemVal, tyVal, "")
-			// Lowest bit is a flag. So shift left by 1 bit
-			shifted := b.builder.CreateShl(extended, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
-			// Set flag to 1
-			return b.builder.CreateOr(shifted, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
-		case *types.Float:
-			// Similar to Int or Bool cases, but bitcast is required
-			tyVal := b.typeBuilder.buildOption(ty)
-			casted := b.builder.CreateBitCast(elemVal, llvm.Int64Type(), "")
-			extended := b.builder.CreateZExt(casted, tyVal, "")
-			shifted := b.builder.CreateShl(extended, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
-			return b.builder.CreateOr(shifted, llvm.ConstInt(tyVal, 1, false /*signed*/), "")
-		case *types.String, *types.Fun, *types.Array, *types.Tuple:
-			// They use NULL pointer for 'None' value. So nothing to do to make 'Some' value.
-			return elemVal
-		case *types.Option, *types.Unit:
-			v := llvm.Undef(b.typeBuilder.buildOption(ty))
-			v = b.builder.CreateInsertValue(v, llvm.ConstInt(b.typeBuilder.boolT, 1, false), 0, "some.flag")
-			v = b.builder.CreateInsertValue(v, elemVal, 1, "some.elem")
-			return v
-		default:
-			panic("unreachable")
-		}
+		return b.buildSome(ty, b.resolve(val.Elem))
 	case *mir.None:
 		ty, ok := b.typeOf(ident).(*types.Option)
 		if !ok {
 			panic("Type of None is not an option type: " + b.typeOf(ident).String())
 		}
-
-		tyVal := b.typeBuilder.buildOption(ty)
-		switch ty.Elem.(type) {
-		case *types.Int, *types.Bool, *types.Float:
-			return llvm.ConstInt(tyVal, 0, false)
-		case *types.String, *types.Fun, *types.Array:
-			v := llvm.Undef(tyVal)
-			null := llvm.ConstPointerNull(tyVal.StructElementTypes()[0])
-			v = b.builder.CreateInsertValue(v, null, 0, "none.flag")
-			return v
-		case *types.Tuple:
-			return llvm.ConstPointerNull(tyVal)
-		case *types.Option, *types.Unit:
-			v := llvm.Undef(b.typeBuilder.buildOption(ty))
-			v = b.builder.CreateInsertValue(v, llvm.ConstInt(b.typeBuilder.boolT, 0, false), 0, "none.flag")
-			return v
-		default:
-			panic("unreachable")
-		}
+		return b.buildNone(ty)
 	case *mir.IsSome:
 		optVal := b.resolve(val.OptVal)
 		ty, ok := b.typeOf(val.OptVal).(*types.Option)
@@ -652,6 +779,50 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 			panic("Type of DerefSome is not an option type: " + b.typeOf(val.SomeVal).String())
 		}
 		return b.buildDerefSome(optVal, ty)
+	case *mir.Variant:
+		ty := b.typeBuilder.fromMIR(b.typeOf(ident))
+		v := llvm.Undef(ty)
+		v = b.builder.CreateInsertValue(v, b.variantTagVal(val.Tag), 0, "variant.tag")
+		if val.Payload == "" {
+			null := llvm.ConstPointerNull(b.typeBuilder.voidPtrT)
+			return b.builder.CreateInsertValue(v, null, 1, "variant")
+		}
+		payloadVal := b.resolve(val.Payload)
+		ptr := b.buildMalloc(payloadVal.Type(), "")
+		b.buildStoreToHeap(payloadVal, ptr, true)
+		boxed := b.builder.CreateBitCast(ptr, b.typeBuilder.voidPtrT, "")
+		return b.builder.CreateInsertValue(v, boxed, 1, "variant")
+	case *mir.IsVariant:
+		tag := b.builder.CreateExtractValue(b.resolve(val.Target), 0, "")
+		return b.builder.CreateICmp(llvm.IntEQ, tag, b.variantTagVal(val.Tag), "isvariant")
+	case *mir.VariantPayload:
+		boxed := b.builder.CreateExtractValue(b.resolve(val.Target), 1, "")
+		ty := b.typeBuilder.fromMIR(b.typeOf(ident))
+		ptr := b.builder.CreateBitCast(boxed, llvm.PointerType(ty, 0 /*address space*/), "")
+		return b.builder.CreateLoad(ptr, "variantpayload")
+	case *mir.Unreachable:
+		// Note:
+		// Preceding call never returns. The value is never used but needed to keep the instruction
+		// typed. 'unreachable' terminator cannot be put here because instructions may follow it in
+		// the same basic block.
+		return llvm.Undef(b.typeBuilder.fromMIR(b.typeOf(ident)))
+	case *mir.Jump:
+		args := make([]llvm.Value, 0, len(val.Args))
+		for _, a := range val.Args {
+			args = append(args, b.resolve(a))
+		}
+		for i, a := range args {
+			b.builder.CreateStore(a, b.paramSlots[i])
+		}
+		b.builder.CreateBr(b.loopBlock)
+
+		// Note:
+		// Instructions which follow 'jump' (e.g. branch to the end of 'if') are never executed. They
+		// are put in a new basic block without predecessor so that they do not break the terminator
+		// of the current block. The value is never used.
+		dead := llvm.AddBasicBlock(b.builder.GetInsertBlock().Parent(), "jump.dead")
+		b.builder.SetInsertPointAtEnd(dead)
+		return llvm.Undef(b.typeBuilder.fromMIR(b.typeOf(ident)))
 	case *mir.NOP:
 		panic("unreachable")
 	default:
@@ -659,15 +830,226 @@ func (b *blockBuilder) buildVal(ident string, val mir.Val) llvm.Value {
 	}
 }
 
+// buildBoundsCheck compares the index with the size of the array. When the index is out of bounds,
+// runtime function reports the location and aborts the program. Since the index is compared as
+// unsigned integer, negative index is also rejected by one comparison.
+func (b *blockBuilder) buildBoundsCheck(check *mir.BoundsCheck, pos locerr.Pos) llvm.Value {
+	arrVal := b.resolve(check.Array)
+	idxVal := b.resolve(check.Index)
+	sizeVal := b.builder.CreateExtractValue(arrVal, 1, "arrsize")
+	inBounds := b.builder.CreateICmp(llvm.IntULT, idxVal, sizeVal, "inbounds")
+
+	parent := b.builder.GetInsertBlock().Parent()
+	okBlk := llvm.AddBasicBlock(parent, "bounds.ok")
+	failBlk := llvm.AddBasicBlock(parent, "bounds.fail")
+	b.builder.CreateCondBr(inBounds, okBlk, failBlk)
+
+	b.builder.SetInsertPointAtEnd(failBlk)
+	b.buildExternalCall("__gocaml_bounds_fail", []llvm.Value{b.buildLocation(pos), idxVal, sizeVal})
+	b.builder.CreateUnreachable()
+
+	okBlk.MoveAfter(failBlk)
+	b.builder.SetInsertPointAtEnd(okBlk)
+	return b.unitVal
+}
+
+// buildStackCheck compares the frame address of the function with the limit of stack set by
+// runtime. When the stack is exhausted by deep recursion, runtime function reports the location of
+// the function and aborts the program instead of crashing with segmentation fault.
+func (b *blockBuilder) buildStackCheck(pos locerr.Pos) {
+	limit := b.module.NamedGlobal("__gocaml_stack_limit")
+	if limit.C == nil {
+		limit = llvm.AddGlobal(b.module, b.typeBuilder.voidPtrT, "__gocaml_stack_limit")
+		limit.SetLinkage(llvm.ExternalLinkage)
+	}
+	i32 := b.context.Int32Type()
+	frameaddr := b.declareIntrinsic("llvm.frameaddress", llvm.FunctionType(b.typeBuilder.voidPtrT, []llvm.Type{i32}, false /*varargs*/))
+
+	frame := b.builder.CreateCall(frameaddr, []llvm.Value{llvm.ConstInt(i32, 0, false /*signed*/)}, "frame")
+	limitVal := b.builder.CreateLoad(limit, "stack.limit")
+	// Stack grows downward. When limit is NULL, nothing is detected.
+	exhausted := b.builder.CreateICmp(llvm.IntULT, frame, limitVal, "stack.exhausted")
+
+	parent := b.builder.GetInsertBlock().Parent()
+	okBlk := llvm.AddBasicBlock(parent, "stack.ok")
+	failBlk := llvm.AddBasicBlock(parent, "stack.overflow")
+	b.builder.CreateCondBr(exhausted, failBlk, okBlk)
+
+	b.builder.SetInsertPointAtEnd(failBlk)
+	b.buildExternalCall("__gocaml_stack_overflow", []llvm.Value{b.buildLocation(pos)})
+	b.builder.CreateUnreachable()
+
+	okBlk.MoveAfter(failBlk)
+	b.builder.SetInsertPointAtEnd(okBlk)
+}
+
+// buildLocation builds a string of the source location reported by runtime on failure.
+func (b *blockBuilder) buildLocation(pos locerr.Pos) llvm.Value {
+	loc := fmt.Sprintf("%s:%d:%d", pos.File.Path, pos.Line, pos.Column)
+	return b.buildVal("", &mir.String{loc})
+}
+
+// buildCheckedArith builds integer addition, subtraction, multiplication or negation with LLVM's
+// overflow intrinsic when checked arithmetic is enabled. On overflow, runtime function reports the
+// location and aborts the program. It returns false for other operations.
+func (b *blockBuilder) buildCheckedArith(val mir.Val, pos locerr.Pos) (llvm.Value, bool) {
+	if !b.checkedArith {
+		return llvm.Value{}, false
+	}
+
+	var op, name string
+	var lhs, rhs llvm.Value
+	switch val := val.(type) {
+	case *mir.Binary:
+		switch val.Op {
+		case mir.ADD:
+			op, name = "sadd", "add"
+		case mir.SUB:
+			op, name = "ssub", "sub"
+		case mir.MUL:
+			op, name = "smul", "mul"
+		default:
+			return llvm.Value{}, false
+		}
+		lhs, rhs = b.resolve(val.LHS), b.resolve(val.RHS)
+	case *mir.Unary:
+		if val.Op != mir.NEG {
+			return llvm.Value{}, false
+		}
+		// -x is checked as 0 - x since only -INT_MIN overflows
+		op, name = "ssub", "neg"
+		lhs, rhs = llvm.ConstInt(b.typeBuilder.intT, 0, true /*signed*/), b.resolve(val.Child)
+	default:
+		return llvm.Value{}, false
+	}
+
+	intT := b.typeBuilder.intT
+	retT := b.context.StructType([]llvm.Type{intT, b.context.Int1Type()}, false /*packed*/)
+	intrinsic := fmt.Sprintf("llvm.%s.with.overflow.%s", op, mangleIntrinsicType(intT))
+	funVal := b.declareIntrinsic(intrinsic, llvm.FunctionType(retT, []llvm.Type{intT, intT}, false /*varargs*/))
+	ret := b.builder.CreateCall(funVal, []llvm.Value{lhs, rhs}, "")
+	overflow := b.builder.CreateExtractValue(ret, 1, name+".overflow")
+
+	parent := b.builder.GetInsertBlock().Parent()
+	okBlk := llvm.AddBasicBlock(parent, "overflow.ok")
+	failBlk := llvm.AddBasicBlock(parent, "overflow.fail")
+	b.builder.CreateCondBr(overflow, failBlk, okBlk)
+
+	b.builder.SetInsertPointAtEnd(failBlk)
+	b.buildExternalCall("__gocaml_overflow_fail", []llvm.Value{b.buildLocation(pos)})
+	b.builder.CreateUnreachable()
+
+	okBlk.MoveAfter(failBlk)
+	b.builder.SetInsertPointAtEnd(okBlk)
+	return b.builder.CreateExtractValue(ret, 0, name), true
+}
+
+// buildIf builds branches of 'if' and merges their values.
+func (b *blockBuilder) buildIf(ident string, val *mir.If, pos locerr.Pos) llvm.Value {
+	parent := b.builder.GetInsertBlock().Parent()
+	thenBlock := llvm.AddBasicBlock(parent, "if.then")
+	elseBlock := llvm.AddBasicBlock(parent, "if.else")
+	endBlock := llvm.AddBasicBlock(parent, "if.end")
+
+	ty := b.typeBuilder.fromMIR(b.typeOf(ident))
+	cond := b.resolve(val.Cond)
+	b.buildCondBr(cond, thenBlock, elseBlock, pos)
+
+	b.builder.SetInsertPointAtEnd(thenBlock)
+	thenVal := b.buildBlock(val.Then)
+	b.builder.CreateBr(endBlock)
+	thenLastBlock := b.builder.GetInsertBlock()
+
+	elseBlock.MoveAfter(thenLastBlock)
+	b.builder.SetInsertPointAtEnd(elseBlock)
+	elseVal := b.buildBlock(val.Else)
+	b.builder.CreateBr(endBlock)
+	elseLastBlock := b.builder.GetInsertBlock()
+
+	endBlock.MoveAfter(elseLastBlock)
+	b.builder.SetInsertPointAtEnd(endBlock)
+	phi := b.builder.CreatePHI(ty, "if.merge")
+	phi.AddIncoming([]llvm.Value{thenVal, elseVal}, []llvm.BasicBlock{thenLastBlock, elseLastBlock})
+	return phi
+}
+
 func (b *blockBuilder) buildInsn(insn *mir.Insn) llvm.Value {
 	if b.debug != nil {
 		b.debug.setLocation(b.builder, insn.Pos)
 	}
-	v := b.buildVal(insn.Ident, insn.Val)
+	var v llvm.Value
+	switch val := insn.Val.(type) {
+	case *mir.BoundsCheck:
+		// Location of the check is reported on failure
+		v = b.buildBoundsCheck(val, insn.Pos)
+	case *mir.If:
+		v = b.buildIf(insn.Ident, val, insn.Pos)
+	case *mir.App:
+		b.countSite(mir.ProfileCall, insn.Pos)
+		v = b.buildVal(insn.Ident, val)
+	case *mir.Binary, *mir.Unary:
+		checked, ok := b.buildCheckedArith(insn.Val, insn.Pos)
+		if !ok {
+			checked, ok = b.buildCheckedDiv(insn.Val, insn.Pos)
+		}
+		if !ok {
+			checked = b.buildVal(insn.Ident, insn.Val)
+		}
+		v = checked
+	default:
+		v = b.buildVal(insn.Ident, insn.Val)
+	}
 	b.registers[insn.Ident] = v
+	if b.usesRootSlots() {
+		b.buildRoots(insn.Ident, v)
+	}
+	if b.debug != nil {
+		b.debug.describeVar(insn.Ident, b.env.DeclTable[insn.Ident], v, 0, insn.Pos, b.builder.GetInsertBlock())
+	}
 	return v
 }
 
+// buildTailBlock builds the block whose value is returned from the function. Each branch of 'if' in
+// tail position returns its value directly instead of merging values. A call in tail position is
+// marked as a tail call and immediately followed by 'ret' so that the call can be compiled into a
+// jump without growing the stack.
+func (b *blockBuilder) buildTailBlock(block *mir.Block) {
+	i := block.Top.Next
+	for i.Next != block.Bottom {
+		b.buildInsn(i)
+		i = i.Next
+	}
+
+	switch val := i.Val.(type) {
+	case *mir.If:
+		if b.debug != nil {
+			b.debug.setLocation(b.builder, i.Pos)
+		}
+		parent := b.builder.GetInsertBlock().Parent()
+		thenBlock := llvm.AddBasicBlock(parent, "if.then")
+		elseBlock := llvm.AddBasicBlock(parent, "if.else")
+		b.buildCondBr(b.resolve(val.Cond), thenBlock, elseBlock, i.Pos)
+
+		b.builder.SetInsertPointAtEnd(thenBlock)
+		b.buildTailBlock(val.Then)
+
+		elseBlock.MoveAfter(b.builder.GetInsertBlock())
+		b.builder.SetInsertPointAtEnd(elseBlock)
+		b.buildTailBlock(val.Else)
+	case *mir.App:
+		ret := b.buildInsn(i)
+		// Callee must not access the stack of caller in tail call. A call must not be a tail call when
+		// roots are tracked because GC needs the frame of caller.
+		_, onStack := b.stackAllocated[val.Callee]
+		if call := b.builder.GetInsertBlock().LastInstruction().IsACallInst(); !call.IsNil() && !onStack && !b.usesRootSlots() {
+			call.SetTailCall(true)
+		}
+		b.builder.CreateRet(ret)
+	default:
+		b.builder.CreateRet(b.buildInsn(i))
+	}
+}
+
 func (b *blockBuilder) buildBlock(block *mir.Block) llvm.Value {
 	i := block.Top.Next
 	for {
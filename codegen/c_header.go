@@ -0,0 +1,216 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// cHeader builds C declarations of external symbols following C ABI described in runtime/gocaml.h.
+// Tuple types and function types of closures are defined on demand in the order they are first
+// used.
+type cHeader struct {
+	defs  bytes.Buffer
+	decls bytes.Buffer
+	names map[string]string
+	count int
+}
+
+func (h *cHeader) define(key, kind string, from types.Type, def func(name string) string) string {
+	if n, ok := h.names[key]; ok {
+		return n
+	}
+	h.count++
+	name := fmt.Sprintf("gocaml_%s%d", kind, h.count)
+	fmt.Fprintf(&h.defs, "/* %s */\n%s\n\n", from.String(), def(name))
+	h.names[key] = name
+	return name
+}
+
+// funOf defines the type of function pointer of the closure and a helper to call the closure.
+func (h *cHeader) funOf(ty *types.Fun) (string, bool) {
+	ret, ok := h.cType(ty.Ret, false)
+	if !ok {
+		return "", false
+	}
+	params := make([]string, 0, len(ty.Params)+1)
+	params = append(params, "void *")
+	for _, p := range ty.Params {
+		c, ok := h.cType(p, false)
+		if !ok {
+			return "", false
+		}
+		params = append(params, c)
+	}
+	h.define("fun:"+ret+"("+strings.Join(params, ",")+")", "fun", ty, func(name string) string {
+		decls := make([]string, 0, len(params))
+		args := make([]string, 0, len(params))
+		decls = append(decls, "gocaml_closure c")
+		args = append(args, "c.env")
+		for i, p := range params[1:] {
+			a := fmt.Sprintf("a%d", i)
+			decls = append(decls, declare(p, a))
+			args = append(args, a)
+		}
+		return fmt.Sprintf(
+			"typedef %s;\nstatic inline %s(%s) {\n    return ((%s) c.fun)(%s);\n}",
+			declare(ret, "(*"+name+")("+strings.Join(params, ", ")+")"),
+			declare(ret, name+"_call"), strings.Join(decls, ", "),
+			name, strings.Join(args, ", "),
+		)
+	})
+	return "gocaml_closure", true
+}
+
+func (h *cHeader) tupleOf(ty *types.Tuple) (string, bool) {
+	elems := make([]string, 0, len(ty.Elems))
+	for _, e := range ty.Elems {
+		c, ok := h.cType(e, true)
+		if !ok {
+			return "", false
+		}
+		elems = append(elems, c)
+	}
+	name := h.define("tuple:"+strings.Join(elems, ","), "tuple", ty, func(name string) string {
+		var b bytes.Buffer
+		b.WriteString("typedef struct {\n")
+		for i, e := range elems {
+			fmt.Fprintf(&b, "    %s;\n", declare(e, fmt.Sprintf("e%d", i)))
+		}
+		fmt.Fprintf(&b, "} %s;", name)
+		return b.String()
+	})
+	return name + " *", true
+}
+
+// cType returns the C type of the type. field is true when the value is stored in memory as a field
+// of tuple. It returns false when the type has no representation in C ABI.
+func (h *cHeader) cType(from types.Type, field bool) (string, bool) {
+	switch ty := from.(type) {
+	case *types.Unit:
+		return "gocaml_unit", true
+	case *types.Bool:
+		if field {
+			return "uint8_t", true
+		}
+		return "gocaml_bool", true
+	case *types.Int:
+		return "gocaml_int", true
+	case *types.Float:
+		return "gocaml_float", true
+	case *types.String:
+		return "gocaml_string", true
+	case *types.Array:
+		return "gocaml_array", true
+	case *types.Table, *types.Buffer, *types.Json:
+		return "void *", true
+	case *types.Tuple:
+		return h.tupleOf(ty)
+	case *types.Fun:
+		return h.funOf(ty)
+	case *types.Var:
+		if ty.Ref != nil {
+			return h.cType(ty.Ref, field)
+		}
+		return "", false
+	default:
+		return "", false
+	}
+}
+
+// declare returns a declaration of the name with the type. Spacing is adjusted for pointers.
+func declare(ty, name string) string {
+	if strings.HasSuffix(ty, "*") {
+		return ty + name
+	}
+	return ty + " " + name
+}
+
+func (h *cHeader) declareExternal(name string, ext *types.External) {
+	switch ty := ext.Type.(type) {
+	case *types.Fun:
+		ret, ok := h.cType(ty.Ret, false)
+		if _, unit := ty.Ret.(*types.Unit); unit {
+			// External function returns void instead of unit
+			ret = "void"
+		}
+		params := make([]string, 0, len(ty.Params))
+		for _, p := range ty.Params {
+			c, valid := h.cType(p, false)
+			ok = ok && valid
+			params = append(params, c)
+		}
+		if ok {
+			fmt.Fprintf(&h.decls, "/* %s: %s */\n%s(%s);\n", name, ty.String(), declare(ret, ext.CName), strings.Join(params, ", "))
+			return
+		}
+	default:
+		if c, ok := h.cType(ty, false); ok {
+			fmt.Fprintf(&h.decls, "/* %s: %s */\nextern %s;\n", name, ty.String(), declare(c, ext.CName))
+			return
+		}
+	}
+	fmt.Fprintf(&h.decls, "/* %s: %s is not declared since the type has no representation in C ABI */\n", name, ext.Type.String())
+}
+
+// headerGuard makes a name of include guard macro from the path of the source.
+func headerGuard(src *locerr.Source) string {
+	base := strings.TrimSuffix(filepath.Base(src.Path), filepath.Ext(src.Path))
+	guard := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, base)
+	return "GOCAML_" + guard + "_H_INCLUDED"
+}
+
+// EmitCHeader writes a C header which declares external symbols of the program other than builtins.
+// C functions called from the program can be implemented with the declarations. Closures passed to
+// them can be called with the generated helpers. Symbols whose types have no representation in C
+// ABI (options, variants and results) are only listed in comments. Please see runtime/gocaml.h for
+// the C ABI.
+func EmitCHeader(out io.Writer, env *types.Env, src *locerr.Source) error {
+	h := &cHeader{names: map[string]string{}}
+
+	names := make([]string, 0, len(env.Externals))
+	for n := range env.Externals {
+		if !types.IsBuiltin(n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	declared := map[string]struct{}{}
+	for _, n := range names {
+		ext := env.Externals[n]
+		if _, ok := ext.Type.(*types.Forall); ok {
+			// Generic external symbol is declared for each instantiation
+			continue
+		}
+		if _, ok := declared[ext.CName]; ok {
+			continue
+		}
+		declared[ext.CName] = struct{}{}
+		h.declareExternal(n, ext)
+	}
+
+	guard := headerGuard(src)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "/* Generated by gocaml from %s */\n\n", src.Path)
+	fmt.Fprintf(&buf, "#if !defined %s\n#define %s\n\n#include \"gocaml.h\"\n\n", guard, guard)
+	buf.Write(h.defs.Bytes())
+	buf.Write(h.decls.Bytes())
+	fmt.Fprintf(&buf, "\n#endif /* %s */\n", guard)
+	_, err := buf.WriteTo(out)
+	return err
+}
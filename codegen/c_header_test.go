@@ -0,0 +1,145 @@
+package codegen
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const cHeaderTestCode = `
+external apply: (int -> bool) -> int -> bool = "c_apply";
+external make_pair: int -> int * bool = "c_make_pair";
+external get: int option -> int = "c_get";
+external counter: int = "c_counter";
+let y = str_to_int "3" in
+let rec f x = x = y in
+println_bool (apply f 3);
+println_bool (apply f 4);
+let (a, b) = make_pair counter in
+println_int a;
+println_bool b`
+
+func TestEmitCHeader(t *testing.T) {
+	s := locerr.NewDummySource(cHeaderTestCode)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, _, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := EmitCHeader(&buf, env, s); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"#include \"gocaml.h\"",
+		"typedef gocaml_bool (*gocaml_fun1)(void *, gocaml_int);",
+		"static inline gocaml_bool gocaml_fun1_call(gocaml_closure c, gocaml_int a0) {",
+		"gocaml_bool c_apply(gocaml_closure, gocaml_int);",
+		"    uint8_t e1;\n} gocaml_tuple2;",
+		"gocaml_tuple2 *c_make_pair(gocaml_int);",
+		"extern gocaml_int c_counter;",
+		"/* get: int option -> int is not declared",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("'%s' was not found in header: %s", want, out)
+		}
+	}
+	if strings.Contains(out, "println_int") {
+		t.Errorf("Builtin was declared in header: %s", out)
+	}
+}
+
+func TestHeaderGuard(t *testing.T) {
+	s := locerr.NewDummySource("")
+	s.Path = "/path/to/my-lib.ml"
+	if g := headerGuard(s); g != "GOCAML_MY_LIB_H_INCLUDED" {
+		t.Fatal("Unexpected include guard:", g)
+	}
+}
+
+func TestCallClosureFromC(t *testing.T) {
+	code := strings.Replace(cHeaderTestCode, `external get: int option -> int = "c_get";`, "", 1)
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "gocaml-c-header-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var header bytes.Buffer
+	if err := EmitCHeader(&header, env, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.h"), header.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	csrc := `#include <stddef.h>
+#include "test.h"
+
+void *GC_malloc(size_t);
+
+gocaml_int c_counter = 42;
+
+gocaml_bool c_apply(gocaml_closure f, gocaml_int x) {
+    return gocaml_fun1_call(f, x);
+}
+
+gocaml_tuple2 *c_make_pair(gocaml_int i) {
+    gocaml_tuple2 *t = GC_malloc(sizeof(gocaml_tuple2));
+    t->e0 = i;
+    t->e1 = 1;
+    return t;
+}
+`
+	cfile := filepath.Join(dir, "test.c")
+	if err := ioutil.WriteFile(cfile, []byte(csrc), 0666); err != nil {
+		t.Fatal(err)
+	}
+	include, err := filepath.Abs("../runtime")
+	if err != nil {
+		panic(err)
+	}
+	objfile := filepath.Join(dir, "test.o")
+	if out, err := exec.Command("clang", "-c", "-I"+include, "-I"+dir, cfile, "-o", objfile).CombinedOutput(); err != nil {
+		t.Fatalf("Cannot compile C source: %s: %s", err, out)
+	}
+
+	opts := EmitOptions{OptimizeNone, "", "", "", objfile, false, false, false, false, nil, false, false, "", RelocDefault, GCBoehm}
+	e, err := NewEmitter(closure.Transform(ir), env, s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	exe := filepath.Join(dir, "test")
+	if err := e.EmitExecutable(exe); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(exe).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "true\nfalse\n42\ntrue\n" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+}
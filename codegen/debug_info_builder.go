@@ -5,6 +5,7 @@ import (
 	"github.com/rhysd/locerr"
 	"llvm.org/llvm/bindings/go/llvm"
 	"path/filepath"
+	"strings"
 )
 
 type sizeEntry struct {
@@ -229,7 +230,7 @@ func (d *debugInfoBuilder) typeInfo(ty types.Type) llvm.Metadata {
 			return d.basicTypeInfo(ty, llvm.DW_ATE_unsigned)
 		case *types.String, *types.Fun, *types.Array, *types.Tuple:
 			return d.typeInfo(ty)
-		case *types.Option, *types.Unit:
+		case *types.Option, *types.Unit, *types.Variant, *types.Result:
 			size := d.sizes.sizeOf(ty)
 			elems := []llvm.Metadata{
 				d.basicTypeInfo(ty, llvm.DW_ATE_boolean),
@@ -246,6 +247,19 @@ func (d *debugInfoBuilder) typeInfo(ty types.Type) llvm.Metadata {
 		default:
 			panic("unreachable")
 		}
+	case *types.Variant, *types.Result:
+		size := d.sizes.sizeOf(ty)
+		elems := []llvm.Metadata{
+			d.basicTypeInfo(types.IntType, llvm.DW_ATE_unsigned),
+			d.voidPtrInfo,
+		}
+		return d.builder.CreateStructType(d.compileUnit, llvm.DIStructType{
+			Name:        ty.String(),
+			File:        d.file,
+			SizeInBits:  size.allocInBits,
+			AlignInBits: size.alignInBits,
+			Elements:    elems,
+		})
 	default:
 		panic("cannot handle debug info for type " + ty.String())
 	}
@@ -284,6 +298,83 @@ func (d *debugInfoBuilder) setFuncInfo(funptr llvm.Value, ty *types.Fun, line in
 	d.scope = meta
 }
 
+// hasTypeInfo returns whether debug information can be generated for the type. Type variables
+// remain in generic functions which were not monomorphized.
+func hasTypeInfo(ty types.Type) bool {
+	switch ty := ty.(type) {
+	case *types.Int, *types.Bool, *types.Float, *types.String, *types.Variant, *types.Result:
+		return true
+	case *types.Fun:
+		for _, p := range ty.Params {
+			if !hasTypeInfo(p) {
+				return false
+			}
+		}
+		return hasTypeInfo(ty.Ret)
+	case *types.Tuple:
+		for _, e := range ty.Elems {
+			if !hasTypeInfo(e) {
+				return false
+			}
+		}
+		return true
+	case *types.Array:
+		return hasTypeInfo(ty.Elem)
+	case *types.Option:
+		return hasTypeInfo(ty.Elem)
+	default:
+		// Unit values have nothing to show
+		return false
+	}
+}
+
+// sourceName returns the name of the variable in source. Temporary variables introduced by the
+// compiler are not in source.
+func sourceName(ident string) (string, bool) {
+	if strings.HasPrefix(ident, "$") {
+		return "", false
+	}
+	if i := strings.LastIndex(ident, "$t"); i > 0 {
+		// Remove suffix added by alpha transform
+		return ident[:i], true
+	}
+	return ident, true
+}
+
+// describeVar tells debuggers the value of the variable with llvm.dbg.value at the end of the block.
+// argNo is 1-based index of parameter, or 0 for local variables.
+func (d *debugInfoBuilder) describeVar(ident string, ty types.Type, val llvm.Value, argNo int, pos locerr.Pos, block llvm.BasicBlock) {
+	name, ok := sourceName(ident)
+	if !ok || d.scope.C == nil || val.IsNil() || !hasTypeInfo(ty) {
+		return
+	}
+	if !block.LastInstruction().IsATerminatorInst().IsNil() {
+		// Code after the terminator is never executed (e.g. after calling 'exit')
+		return
+	}
+
+	tyInfo := d.typeInfo(ty)
+	var info llvm.Metadata
+	if argNo > 0 {
+		info = d.builder.CreateParameterVariable(d.scope, llvm.DIParameterVariable{
+			Name:  name,
+			File:  d.file,
+			Line:  pos.Line,
+			Type:  tyInfo,
+			ArgNo: argNo,
+		})
+	} else {
+		info = d.builder.CreateAutoVariable(d.scope, llvm.DIAutoVariable{
+			Name: name,
+			File: d.file,
+			Line: pos.Line,
+			Type: tyInfo,
+		})
+	}
+	loc := llvm.DebugLoc{Line: uint(pos.Line), Col: uint(pos.Column), Scope: d.scope}
+	d.builder.InsertValueAtEnd(val, info, d.builder.CreateExpression(nil), loc, block)
+}
+
 func (d *debugInfoBuilder) setLocation(b llvm.Builder, pos locerr.Pos) {
 	scope := d.scope
 	if scope.C == nil {
@@ -0,0 +1,101 @@
+package codegen
+
+import (
+	"llvm.org/llvm/bindings/go/llvm"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Check is a result of an item checked by Doctor.
+type Check struct {
+	// Subject is what was checked
+	Subject string
+	// OK is false when compiling or running programs would fail
+	OK bool
+	// Detail is a found path or a reason of the failure
+	Detail string
+}
+
+// multiarchLibDir returns the library directory of Debian-based Linux distributions.
+func multiarchLibDir() string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	}
+	return filepath.Join("/usr/lib", arch+"-linux-gnu")
+}
+
+// detectLibgc finds libgc in the directories searched by the linker.
+func detectLibgc() (string, bool) {
+	dirs := []string{"/usr/local/lib", "/usr/lib", "/usr/lib64", multiarchLibDir()}
+	if path := detectLibgcPath(); path != "" {
+		dirs = append([]string{path}, dirs...)
+	}
+	for _, dir := range dirs {
+		for _, lib := range []string{"libgc.a", "libgc.so", "libgc.dylib"} {
+			path := filepath.Join(dir, lib)
+			if _, err := os.Stat(path); err == nil {
+				return path, true
+			}
+		}
+	}
+	return "Not found in " + strings.Join(dirs, ", "), false
+}
+
+// Doctor checks whether programs can be compiled for the target and run on this machine without
+// additional setup. Empty triple means the host machine. Runtime for JIT and libgc are checked only
+// for the host machine since libraries for other targets depend on sysroot.
+func Doctor(triple string) []Check {
+	host := triple == "" || triple == llvm.DefaultTargetTriple()
+	if triple == "" {
+		triple = llvm.DefaultTargetTriple()
+	}
+
+	checks := make([]Check, 0, 7)
+	add := func(subject string, ok bool, detail string) {
+		checks = append(checks, Check{subject, ok, detail})
+	}
+
+	if target, err := llvm.GetTargetFromTriple(triple); err != nil {
+		add("Target "+triple, false, err.Error())
+	} else {
+		add("Target "+triple, true, target.Description())
+	}
+	add("C calling convention", true, cABIOf(triple).String())
+	add("Relocation model", true, relocModelOf(RelocDefault, triple).String())
+
+	lnk := newDefaultLinker("", "")
+	if !host {
+		lnk = newDefaultLinker("", triple)
+	}
+	if path, err := lnk.runtimePath(); err != nil {
+		add("Runtime library", false, err.Error())
+	} else {
+		add("Runtime library", true, path)
+	}
+	if path, err := exec.LookPath(lnk.linkerCmd); err != nil {
+		add("Linker", false, err.Error())
+	} else {
+		add("Linker", true, path)
+	}
+
+	if !host {
+		return checks
+	}
+
+	if path, err := detectRuntimePath("gocamlrt.so"); err != nil {
+		add("Runtime library for JIT", false, err.Error())
+	} else {
+		add("Runtime library for JIT", true, path)
+	}
+	detail, ok := detectLibgc()
+	add("libgc", ok, detail)
+
+	return checks
+}
@@ -0,0 +1,54 @@
+package codegen
+
+import (
+	"llvm.org/llvm/bindings/go/llvm"
+	"strings"
+	"testing"
+)
+
+func TestDoctorForHost(t *testing.T) {
+	checks := Doctor("")
+	if len(checks) == 0 {
+		t.Fatal("Nothing was checked")
+	}
+	if c := checks[0]; !c.OK || c.Subject != "Target "+llvm.DefaultTargetTriple() {
+		t.Fatalf("Host target is not available: %#v", c)
+	}
+	found := false
+	for _, c := range checks {
+		if c.Subject == "Runtime library for JIT" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Runtime library for JIT was not checked for host: %#v", checks)
+	}
+}
+
+func TestDoctorForOtherTarget(t *testing.T) {
+	checks := Doctor("arm64-apple-ios")
+	if c := checks[0]; !c.OK {
+		t.Fatalf("AArch64 target is not available: %#v", c)
+	}
+	for _, c := range checks {
+		switch c.Subject {
+		case "C calling convention":
+			if c.Detail != "AAPCS64" {
+				t.Errorf("Unexpected calling convention: %s", c.Detail)
+			}
+		case "Runtime library":
+			if !c.OK && !strings.Contains(c.Detail, "arm64-apple-ios/gocamlrt.a") {
+				t.Errorf("Runtime for the target was not looked up: %s", c.Detail)
+			}
+		case "Runtime library for JIT", "libgc":
+			t.Errorf("'%s' should not be checked on cross compilation", c.Subject)
+		}
+	}
+}
+
+func TestDoctorForUnknownTarget(t *testing.T) {
+	checks := Doctor("unknown-target-triple")
+	if checks[0].OK {
+		t.Fatalf("Unknown target should not be available: %#v", checks[0])
+	}
+}
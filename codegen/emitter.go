@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"llvm.org/llvm/bindings/go/llvm"
 	"os"
+	"strings"
 )
 
 func init() {
@@ -35,6 +36,49 @@ const (
 	OptimizeAggressive
 )
 
+// RelocModel is a relocation model of generated code.
+type RelocModel int
+
+const (
+	// RelocDefault is RelocPIE on targets which require position-independent executables (Linux,
+	// Android and macOS). On other targets, it is the default model of LLVM for the target.
+	RelocDefault RelocModel = iota
+	// RelocPIE generates position-independent code and links position-independent executables
+	RelocPIE
+	// RelocPIC generates position-independent code. Executables are linked as the linker does by
+	// default. It is useful for object files linked into shared libraries.
+	RelocPIC
+	// RelocStatic generates code which is not position-independent and links executables which are
+	// not position-independent
+	RelocStatic
+)
+
+func (reloc RelocModel) String() string {
+	switch reloc {
+	case RelocPIE:
+		return "pie"
+	case RelocPIC:
+		return "pic"
+	case RelocStatic:
+		return "static"
+	default:
+		return "default of the target"
+	}
+}
+
+// relocModelOf resolves RelocDefault for the target triple.
+func relocModelOf(reloc RelocModel, triple string) RelocModel {
+	if reloc != RelocDefault {
+		return reloc
+	}
+	for _, sys := range []string{"linux", "android", "darwin"} {
+		if strings.Contains(triple, sys) {
+			return RelocPIE
+		}
+	}
+	return RelocDefault
+}
+
 // EmitOptions represents emitter options to customize emitter behavior
 type EmitOptions struct {
 	// Optimization determines how many optimizations are added
@@ -43,22 +87,71 @@ type EmitOptions struct {
 	// on your machine.
 	// https://clang.llvm.org/docs/CrossCompilation.html#target-triple
 	Triple string
+	// CPU is a name of the target CPU such as "haswell". Empty string means a generic CPU of the
+	// target. Please see 'llc -march={arch} -mcpu=help' for available CPUs.
+	CPU string
+	// Features is a comma-separated list of target features to enable or disable such as
+	// "+avx2,-sse4.1".
+	Features string
 	// Additional linker flags used at linking generated object files
 	LinkerFlags string
+	// LTO enables link-time optimization. Object files contain LLVM bitcode instead of native code
+	// and they are linked with the runtime compiled into bitcode ('gocamlrt.bc'), so functions of
+	// runtime can be inlined into the program. Linker must be clang.
+	LTO bool
+	// SharedRuntime links the runtime as a shared library ('gocamlrt.so') instead of the static
+	// library. Executables find it via rpath to the directory of the runtime or the system library
+	// paths. It cannot be used with LTO.
+	SharedRuntime bool
 	// DebugInfo determines to generate debug information or not. If true, debug information will
 	// be added and you can debug the generated executable with debugger like an LLDB.
 	DebugInfo bool
+	// ProfileGenerate instruments the executable to count calls and branches at runtime. The profile
+	// is written to the file specified by $GOCAML_PROFILE ('gocaml.profile' by default) at exit.
+	ProfileGenerate bool
+	// Profile recorded by instrumented executable. Branches are weighted with it. It can be nil.
+	Profile *mir.Profile
+	// GCStackMaps wraps calls in LLVM's statepoints so that stack maps of GC roots are emitted to
+	// '__LLVM_StackMaps' section. The conservative GC is still used at runtime.
+	GCStackMaps bool
+	// CheckedArith checks overflow of integer addition, subtraction, multiplication and negation
+	// with LLVM's overflow intrinsics. On overflow, the program reports the location and aborts.
+	// Integer operations wrap around by default.
+	CheckedArith bool
+	// Sanitize is a comma-separated list of sanitizers; 'address' and 'undefined'. The program is
+	// instrumented for them and linked with their runtimes. Linker must be clang.
+	Sanitize string
+	// Reloc is a relocation model of generated code and executables.
+	Reloc RelocModel
+	// GC is a garbage collector of the runtime used by the executable.
+	GC GCKind
+}
+
+// relocModel returns the relocation model resolved for the target.
+func (opts *EmitOptions) relocModel() RelocModel {
+	triple := opts.Triple
+	if triple == "" {
+		triple = llvm.DefaultTargetTriple()
+	}
+	return relocModelOf(opts.Reloc, triple)
+}
+
+// isCrossCompiling returns whether the target is different from the host machine.
+func (opts *EmitOptions) isCrossCompiling() bool {
+	return opts.Triple != "" && opts.Triple != llvm.DefaultTargetTriple()
 }
 
 // Emitter object to emit LLVM IR, object file, assembly or executable.
 type Emitter struct {
 	EmitOptions
-	MIR      *mir.Program
-	Env      *types.Env
-	Source   *locerr.Source
-	Module   llvm.Module
-	Machine  llvm.TargetMachine
-	Disposed bool
+	MIR     *mir.Program
+	Env     *types.Env
+	Source  *locerr.Source
+	Module  llvm.Module
+	Machine llvm.TargetMachine
+	// LLVMPasses customizes LLVM passes run by RunOptimizationPasses
+	LLVMPasses LLVMPassOptions
+	Disposed   bool
 }
 
 // Dispose does finalization for internal module and target machine.
@@ -72,16 +165,41 @@ func (emitter *Emitter) Dispose() {
 	emitter.Disposed = true
 }
 
-// RunOptimizationPasses passes optimizations on generated LLVM IR module following specified optimization level.
-func (emitter *Emitter) RunOptimizationPasses() {
+// RunOptimizationPasses passes optimizations on generated LLVM IR module following specified
+// optimization level. The pipeline can be customized with emitter.LLVMPasses. Error is returned
+// when the custom pipeline is invalid. Instrumentation passes of sanitizers run after the
+// optimizations.
+func (emitter *Emitter) RunOptimizationPasses() error {
+	if err := emitter.runOptimizationPasses(); err != nil {
+		return err
+	}
+	emitter.runSanitizerPasses()
+	return nil
+}
+
+func (emitter *Emitter) runOptimizationPasses() error {
+	if emitter.LLVMPasses.Pipeline != "" {
+		pm, err := newLLVMPipeline(emitter.LLVMPasses.Pipeline)
+		if err != nil {
+			return err
+		}
+		defer pm.Dispose()
+		pm.Run(emitter.Module)
+		return nil
+	}
+
 	if emitter.Optimization == OptimizeNone {
-		return
+		return nil
 	}
 	level := int(emitter.Optimization)
 
+	emitter.LLVMPasses.enableVectorizers()
 	builder := llvm.NewPassManagerBuilder()
 	defer builder.Dispose()
 	builder.SetOptLevel(level)
+	// Loop unrolling increases compile time and code size. -O1 does not unroll loops for faster
+	// compilation.
+	builder.SetDisableUnrollLoops(emitter.Optimization == OptimizeLess || emitter.LLVMPasses.DisableUnrollLoops)
 
 	// Threshold magic numbers came from computeThresholdFromOptLevels() in llvm/lib/Analysis/InlineCost.cpp
 	threshold := uint(225) // O2
@@ -89,7 +207,12 @@ func (emitter *Emitter) RunOptimizationPasses() {
 		// -O1 is the same inline level as -O2
 		threshold = 275
 	}
-	builder.UseInlinerWithThreshold(threshold)
+	if t := emitter.LLVMPasses.InlineThreshold; t > 0 {
+		threshold = uint(t)
+	}
+	if emitter.LLVMPasses.InlineThreshold >= 0 {
+		builder.UseInlinerWithThreshold(threshold)
+	}
 
 	funcPasses := llvm.NewFunctionPassManagerForModule(emitter.Module)
 	defer funcPasses.Dispose()
@@ -107,6 +230,7 @@ func (emitter *Emitter) RunOptimizationPasses() {
 	defer modPasses.Dispose()
 	builder.Populate(modPasses)
 	modPasses.Run(emitter.Module)
+	return nil
 }
 
 // EmitLLVMIR returns LLVM IR as string.
@@ -114,6 +238,14 @@ func (emitter *Emitter) EmitLLVMIR() string {
 	return emitter.Module.String()
 }
 
+// EmitBitcode returns LLVM bitcode as byte sequence.
+func (emitter *Emitter) EmitBitcode() []byte {
+	buf := llvm.WriteBitcodeToMemoryBuffer(emitter.Module)
+	bc := buf.Bytes()
+	buf.Dispose()
+	return bc
+}
+
 // EmitAsm returns assembly code as string.
 func (emitter *Emitter) EmitAsm() (string, error) {
 	buf, err := emitter.Machine.EmitToMemoryBuffer(emitter.Module, llvm.AssemblyFile)
@@ -125,8 +257,12 @@ func (emitter *Emitter) EmitAsm() (string, error) {
 	return asm, nil
 }
 
-// EmitObject returns object file contents as byte sequence.
+// EmitObject returns object file contents as byte sequence. With LTO, the object file is LLVM
+// bitcode as 'clang -flto -c' emits.
 func (emitter *Emitter) EmitObject() ([]byte, error) {
+	if emitter.LTO {
+		return emitter.EmitBitcode(), nil
+	}
 	buf, err := emitter.Machine.EmitToMemoryBuffer(emitter.Module, llvm.ObjectFile)
 	if err != nil {
 		return nil, err
@@ -147,7 +283,18 @@ func (emitter *Emitter) EmitExecutable(executable string) (err error) {
 		return
 	}
 	defer os.Remove(objfile)
-	linker := newDefaultLinker(emitter.LinkerFlags)
+	triple := ""
+	if emitter.isCrossCompiling() {
+		triple = emitter.Triple
+	}
+	linker := newDefaultLinker(emitter.LinkerFlags, triple)
+	if emitter.LTO {
+		linker.lto = true
+		linker.optLevel = emitter.Optimization
+	}
+	linker.shared = emitter.SharedRuntime
+	linker.sanitize, _ = parseSanitizers(emitter.Sanitize)
+	linker.reloc = emitter.relocModel()
 	err = linker.link(executable, []string{objfile})
 	// Linker link runtime and make an executable
 	return
@@ -172,6 +319,7 @@ func NewEmitter(prog *mir.Program, env *types.Env, src *locerr.Source, opts Emit
 		src,
 		builder.module,
 		builder.machine,
+		LLVMPassOptions{},
 		false,
 	}, nil
 }
@@ -1,11 +1,14 @@
 package codegen
 
 import (
+	"bytes"
 	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
 	"github.com/rhysd/gocaml/sema"
 	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/locerr"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -22,7 +25,7 @@ func testCreateEmitter(code string, optimize OptLevel, debug bool) (e *Emitter,
 		return
 	}
 	prog := closure.Transform(ir)
-	opts := EmitOptions{optimize, "", "", debug}
+	opts := EmitOptions{optimize, "", "", "", "", false, false, debug, false, nil, false, false, "", RelocDefault, GCBoehm}
 	e, err = NewEmitter(prog, env, s, opts)
 	if err != nil {
 		return
@@ -76,6 +79,19 @@ func TestEmitObject(t *testing.T) {
 	}
 }
 
+func TestEmitBitcode(t *testing.T) {
+	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	bc := e.EmitBitcode()
+	// Magic number of LLVM bitcode. Bitcode for Darwin is wrapped with another header
+	if !bytes.HasPrefix(bc, []byte("BC\xc0\xde")) && !bytes.HasPrefix(bc, []byte("\xde\xc0\x17\x0b")) {
+		t.Fatalf("Emitted bitcode is broken: %v", bc)
+	}
+}
+
 func TestEmitExecutable(t *testing.T) {
 	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeDefault, false)
 	if err != nil {
@@ -102,6 +118,67 @@ func TestEmitExecutable(t *testing.T) {
 	}
 }
 
+func TestEmitExecutableWithLTO(t *testing.T) {
+	if _, err := detectRuntimePath("gocamlrt.bc"); err != nil {
+		t.Skip(err)
+	}
+	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.LTO = true
+	obj, err := e.EmitObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(obj, []byte("BC\xc0\xde")) && !bytes.HasPrefix(obj, []byte("\xde\xc0\x17\x0b")) {
+		t.Fatalf("Object file for LTO is not bitcode: %v", obj)
+	}
+	outfile, err := filepath.Abs("__test_lto_a.out")
+	if err != nil {
+		panic(err)
+	}
+	if err := e.EmitExecutable(outfile); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfile)
+	out, err := exec.Command(outfile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "84\n" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+}
+
+func TestEmitExecutableWithSharedRuntime(t *testing.T) {
+	if _, err := detectRuntimePath("gocamlrt.so"); err != nil {
+		t.Skip(err)
+	}
+	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.SharedRuntime = true
+	outfile, err := filepath.Abs("__test_shared_a.out")
+	if err != nil {
+		panic(err)
+	}
+	if err := e.EmitExecutable(outfile); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfile)
+	out, err := exec.Command(outfile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "84\n" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+}
+
 func TestEmitUnoptimizedLLVMIR(t *testing.T) {
 	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeNone, false)
 	if err != nil {
@@ -126,6 +203,46 @@ func TestEmitLLVMIRWithDebugInfo(t *testing.T) {
 	}
 }
 
+func TestEmitDebugInfoOfVariables(t *testing.T) {
+	e, err := testCreateEmitter("let rec f x = let y = x + 1 in y * 2 in let z = f 42 in println_int z", OptimizeNone, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	ir := e.EmitLLVMIR()
+	for _, want := range []string{
+		"call void @llvm.dbg.value(",
+		`!DILocalVariable(name: "x", arg: 1`,
+		`!DILocalVariable(name: "y"`,
+		`!DILocalVariable(name: "z"`,
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("Debug information for variable '%s' is not contained: %s", want, ir)
+		}
+	}
+	if strings.Contains(ir, `!DILocalVariable(name: "$k`) {
+		t.Errorf("Temporary variables should not be described: %s", ir)
+	}
+}
+
+func TestSourceNameOfVariable(t *testing.T) {
+	for _, tc := range []struct {
+		ident string
+		name  string
+		ok    bool
+	}{
+		{"x$t1", "x", true},
+		{"foo'$t12", "foo'", true},
+		{"x", "x", true},
+		{"$k1", "", false},
+	} {
+		name, ok := sourceName(tc.ident)
+		if name != tc.name || ok != tc.ok {
+			t.Errorf("Expected (%q, %v) for %q but got (%q, %v)", tc.name, tc.ok, tc.ident, name, ok)
+		}
+	}
+}
+
 func TestEmitOptimizedAggressive(t *testing.T) {
 	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeAggressive, false)
 	if err != nil {
@@ -184,3 +301,302 @@ func TestDisposeEmitter(t *testing.T) {
 	// Do not crash when it's called twice
 	e.Dispose()
 }
+
+func testCreateEmitterWithProfile(code string, generate bool, profile *mir.Profile) (*Emitter, error) {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return nil, err
+	}
+	prog := closure.Transform(ir)
+	opts := EmitOptions{OptimizeNone, "", "", "", "", false, false, false, generate, profile, false, false, "", RelocDefault, GCBoehm}
+	return NewEmitter(prog, env, s, opts)
+}
+
+func TestEmitInstrumentation(t *testing.T) {
+	e, err := testCreateEmitterWithProfile("let rec f x = if x < 0 then 0 else x in println_int (f 42)", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	ir := e.EmitLLVMIR()
+	for _, expected := range []string{
+		"@__gocaml_profile_counters = private global [4 x i64] zeroinitializer",
+		"call void @__gocaml_profile_init(",
+		"prof.inc",
+	} {
+		if !strings.Contains(ir, expected) {
+			t.Errorf("IR does not contain '%s': %s", expected, ir)
+		}
+	}
+}
+
+func TestEmitBranchWeights(t *testing.T) {
+	code := "let rec f x = if x < 0 then 0 else x in println_int (f 42)"
+	profile := mir.NewProfile()
+	pos := locerr.Pos{Line: 1, Column: 15}
+	profile.Add(mir.ProfileThen, pos, 3)
+	profile.Add(mir.ProfileElse, pos, 97)
+	e, err := testCreateEmitterWithProfile(code, false, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	ir := e.EmitLLVMIR()
+	if !strings.Contains(ir, `!{!"branch_weights", i32 4, i32 98}`) {
+		t.Fatalf("IR does not contain branch weights: %s", ir)
+	}
+	if strings.Contains(ir, "__gocaml_profile_init") {
+		t.Fatalf("IR was instrumented without -profile-generate: %s", ir)
+	}
+}
+
+func TestEmitSharedClosureEnv(t *testing.T) {
+	code := "let x = 1 in let rec f a = a + x in let rec g b = b * x in println_int (f (g 2))"
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+	prog.SharedEnvs["g$t4"] = "f$t2"
+	e, err := NewEmitter(prog, env, s, EmitOptions{OptimizeNone, "", "", "", "", false, false, false, false, nil, false, false, "", RelocDefault, GCBoehm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	out := e.EmitLLVMIR()
+	if !strings.Contains(out, "%captures.g$t4 = bitcast") {
+		t.Fatalf("Environment of closure 'f$t2' was not reused by closure 'g$t4': %s", out)
+	}
+}
+
+func TestEmitLinkedClosureEnv(t *testing.T) {
+	code := "let x = 1 in let rec f a = (let rec g b = a + b + x in g) in println_int ((f 1) 2)"
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+	closure.LinkEnvs(prog)
+	if prog.EnvLinks["g$t4"] != "f$t2" {
+		t.Fatalf("Closure 'g$t4' should be linked to 'f$t2': %v", prog.EnvLinks)
+	}
+	e, err := NewEmitter(prog, env, s, EmitOptions{OptimizeNone, "", "", "", "", false, false, false, false, nil, false, false, "", RelocDefault, GCBoehm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	out := e.EmitLLVMIR()
+	// 'x$t1' is loaded from environment of 'f$t2' following the link in body of 'g$t4'
+	for _, want := range []string{"%g$t4.link = load", "%f$t2.capture.x$t1 = load"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("'%s' was not found in emitted IR: %s", want, out)
+		}
+	}
+}
+
+func TestEmitForTargetCPU(t *testing.T) {
+	code := "let a = Array.make 8 1.0 in let rec f i = if i < 8 then (a.(i) <- a.(i) *. 2.0; f (i + 1)) in f 0"
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+	opts := EmitOptions{OptimizeDefault, "x86_64-unknown-linux-gnu", "haswell", "+avx2,+fma", "", false, false, false, false, nil, false, false, "", RelocDefault, GCBoehm}
+	e, err := NewEmitter(prog, env, s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.RunOptimizationPasses()
+	asm, err := e.EmitAsm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(asm, ".text") {
+		t.Fatalf("Unexpected assembly for haswell: %s", asm)
+	}
+}
+
+func TestEmitFastCallConv(t *testing.T) {
+	code := "let rec f x = x + x in let g = str_length in println_int (f (g \"abc\"))"
+	e, err := testCreateEmitter(code, OptimizeNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	ir := e.EmitLLVMIR()
+	for _, want := range []string{
+		"define private fastcc i64 @",
+		"call fastcc i64 @",
+		"define i32 @__gocaml_main()",
+		"declare i64 @str_length(",
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("'%s' was not found in LLVM IR: %s", want, ir)
+		}
+	}
+}
+
+func TestEmitClosureCallConv(t *testing.T) {
+	code := `
+	external apply: (int -> bool) -> int -> bool = "c_apply";
+	let y = str_to_int "3" in
+	let rec f x = x = y in
+	let rec g h = h 1 in
+	println_bool (g f);
+	println_bool (apply f 3)`
+	e, err := testCreateEmitter(code, OptimizeNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	ir := e.EmitLLVMIR()
+	for _, want := range []string{
+		"define private zeroext i1 @",
+		"call zeroext i1 %",
+		"declare zeroext i1 @c_apply(",
+		"declare void @println_bool(i1 zeroext)",
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("'%s' was not found in LLVM IR: %s", want, ir)
+		}
+	}
+	if strings.Contains(ir, "define private fastcc zeroext i1 @") {
+		t.Errorf("Closure must follow C calling convention: %s", ir)
+	}
+}
+
+func TestEmitCheckedArith(t *testing.T) {
+	code := "let x = str_to_int \"1\" in println_int (-(x * x + x - 1))"
+	for _, checked := range []bool{true, false} {
+		s := locerr.NewDummySource(code)
+		ast, err := syntax.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, ir, err := sema.SemanticsCheck(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog := closure.Transform(ir)
+		opts := EmitOptions{OptimizeNone, "", "", "", "", false, false, false, false, nil, false, checked, "", RelocDefault, GCBoehm}
+		e, err := NewEmitter(prog, env, s, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Dispose()
+		out := e.EmitLLVMIR()
+		for _, intrinsic := range []string{
+			"@llvm.sadd.with.overflow.i64",
+			"@llvm.ssub.with.overflow.i64",
+			"@llvm.smul.with.overflow.i64",
+			"call void @__gocaml_overflow_fail(",
+		} {
+			if have := strings.Contains(out, intrinsic); have != checked {
+				t.Errorf("'%s' was found: %v, but checked arithmetic is %v: %s", intrinsic, have, checked, out)
+			}
+		}
+	}
+}
+
+func TestEmitStackCheck(t *testing.T) {
+	for _, tc := range []struct {
+		code    string
+		checked bool
+	}{
+		{"let rec fib n = if n < 2 then n else fib (n - 1) + fib (n - 2) in println_int (fib 10)", true},
+		{"let rec f x = x + x in println_int (f 10)", false},
+	} {
+		e, err := testCreateEmitter(tc.code, OptimizeNone, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Dispose()
+		ir := e.EmitLLVMIR()
+		for _, want := range []string{
+			"@llvm.frameaddress",
+			"@__gocaml_stack_limit",
+			"call void @__gocaml_stack_overflow(",
+		} {
+			if have := strings.Contains(ir, want); have != tc.checked {
+				t.Errorf("'%s' was found: %v, but stack check is expected: %v: %s", want, have, tc.checked, ir)
+			}
+		}
+	}
+}
+
+func TestRelocModelOf(t *testing.T) {
+	for _, tc := range []struct {
+		reloc  RelocModel
+		triple string
+		want   RelocModel
+	}{
+		{RelocDefault, "x86_64-unknown-linux-gnu", RelocPIE},
+		{RelocDefault, "aarch64-linux-android", RelocPIE},
+		{RelocDefault, "arm64-apple-darwin20.1.0", RelocPIE},
+		{RelocDefault, "x86_64-pc-windows-msvc", RelocDefault},
+		{RelocDefault, "wasm32-unknown-unknown", RelocDefault},
+		{RelocStatic, "x86_64-unknown-linux-gnu", RelocStatic},
+		{RelocPIC, "x86_64-pc-windows-msvc", RelocPIC},
+	} {
+		if have := relocModelOf(tc.reloc, tc.triple); have != tc.want {
+			t.Errorf("Wanted %s for %s on '%s' but got %s", tc.want, tc.reloc, tc.triple, have)
+		}
+	}
+}
+
+func TestEmitPositionIndependentCode(t *testing.T) {
+	code := "println_int (str_length argv.(0))"
+	for _, tc := range []struct {
+		reloc RelocModel
+		want  string
+	}{
+		{RelocPIE, "println_int@PLT"},
+		{RelocPIC, "argv@GOTPCREL(%rip)"},
+		{RelocStatic, "callq\tprintln_int\n"},
+	} {
+		s := locerr.NewDummySource(code)
+		ast, err := syntax.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, ir, err := sema.SemanticsCheck(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog := closure.Transform(ir)
+		opts := EmitOptions{OptimizeNone, "x86_64-unknown-linux-gnu", "", "", "", false, false, false, false, nil, false, false, "", tc.reloc, GCBoehm}
+		e, err := NewEmitter(prog, env, s, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Dispose()
+		asm, err := e.EmitAsm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(asm, tc.want) {
+			t.Errorf("'%s' was not found in assembly for %s: %s", tc.want, tc.reloc, asm)
+		}
+	}
+}
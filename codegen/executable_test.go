@@ -1,8 +1,10 @@
 package codegen
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/interp"
 	"github.com/rhysd/gocaml/sema"
 	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/locerr"
@@ -63,17 +65,26 @@ func TestExecutable(t *testing.T) {
 			}
 			prog := closure.Transform(ir)
 
-			opts := EmitOptions{OptimizeDefault, "", "", true}
+			outfile, err := filepath.Abs(fmt.Sprintf("test.%s.a.out", base))
+			if err != nil {
+				panic(err)
+			}
+
+			var interpreted bytes.Buffer
+			it := interp.NewInterpreter(prog, env)
+			it.Args = []string{outfile}
+			it.Stdout = &interpreted
+			if _, err := it.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := EmitOptions{OptimizeDefault, "", "", "", "", false, false, true, false, nil, false, false, "", RelocDefault, GCBoehm}
 			emitter, err := NewEmitter(prog, env, s, opts)
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer emitter.Dispose()
 			emitter.RunOptimizationPasses()
-			outfile, err := filepath.Abs(fmt.Sprintf("test.%s.a.out", base))
-			if err != nil {
-				panic(err)
-			}
 			if err := emitter.EmitExecutable(outfile); err != nil {
 				t.Fatal(err)
 			}
@@ -96,6 +107,12 @@ func TestExecutable(t *testing.T) {
 			if got != want {
 				t.Fatalf("Unexpected output from executable:\n\nGot: '%s'\nWant: '%s'", got, want)
 			}
+
+			// Interpreter does not share implementation with code generation. Different output
+			// means miscompilation (or a bug of interpreter)
+			if interpreted := interpreted.String(); interpreted != got {
+				t.Fatalf("Output from executable is different from interpreter:\n\nExecutable: '%s'\nInterpreter: '%s'", got, interpreted)
+			}
 		})
 	}
 }
@@ -130,7 +147,7 @@ func BenchmarkExecutableCreation(b *testing.B) {
 		}
 		prog := closure.Transform(ir)
 
-		opts := EmitOptions{OptimizeDefault, "", "", true}
+		opts := EmitOptions{OptimizeDefault, "", "", "", "", false, false, true, false, nil, false, false, "", RelocDefault, GCBoehm}
 		emitter, err := NewEmitter(prog, env, source, opts)
 		if err != nil {
 			b.Fatal(err)
@@ -188,7 +205,7 @@ func TestExamples(t *testing.T) {
 			}
 			prog := closure.Transform(ir)
 
-			opts := EmitOptions{OptimizeDefault, "", "", true}
+			opts := EmitOptions{OptimizeDefault, "", "", "", "", false, false, true, false, nil, false, false, "", RelocDefault, GCBoehm}
 			emitter, err := NewEmitter(prog, env, s, opts)
 			if err != nil {
 				t.Fatal(err)
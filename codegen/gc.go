@@ -0,0 +1,170 @@
+package codegen
+
+import (
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Note:
+// Generated code allocates all objects with 'gocaml_alloc' of the runtime. Each allocation passes a
+// layout which describes byte offsets of heap pointers in the object. Layouts are constant globals
+// shared by allocations of the same type. Function pointers in closures are not heap pointers and
+// not included. The runtime implements 'gocaml_alloc' with the collector selected by '__gocaml_gc'
+// which generated code defines (please see GCKind).
+//
+// Boehm GC allocates objects without heap pointers (e.g. characters of strings) as atomic objects
+// which are not scanned. The built-in GC scans only the pointers in layouts. No collection happens
+// with GCNone and objects are allocated from arenas which are never freed. Reference counting
+// (GCRefCount) is described in refcount.go.
+//
+// With the built-in GC and reference counting, heap pointers in stack frames are spilled to root slots in the same way as
+// GC stack maps (please see statepoint.go) and the slots are registered with 'llvm.gcroot'. LLVM's
+// 'shadow-stack' GC strategy links a frame holding the slots into 'llvm_gc_root_chain' at entry of
+// the function and unlinks it before returning. The collector walks the chain to find roots. Calls
+// in tail position are not marked as tail calls since the frame of caller must remain linked while
+// callee runs. They cannot be used with GC stack maps since a function has only one GC strategy.
+
+// GCKind is a garbage collector of the runtime. Values are the same as '__gocaml_gc' in
+// runtime/gocamlrt.c.
+type GCKind int
+
+const (
+	// GCBoehm is Boehm GC which scans the stack conservatively
+	GCBoehm GCKind = iota
+	// GCBuiltin is the precise mark-sweep collector of the runtime. Roots on stack are tracked
+	GCBuiltin
+	// GCNone never collects garbage. Objects are allocated from arenas with little overhead. It is
+	// useful for short-running programs whose memory usage is bounded.
+	GCNone
+	// GCRefCount frees objects by counting references to them. Latency is predictable but cycles
+	// are not freed unless the mark-sweep collector of GCBuiltin is enabled for them.
+	GCRefCount
+)
+
+func (kind GCKind) String() string {
+	switch kind {
+	case GCBuiltin:
+		return "built-in GC"
+	case GCNone:
+		return "no GC"
+	case GCRefCount:
+		return "reference counting"
+	default:
+		return "Boehm GC"
+	}
+}
+
+// usesShadowStack returns whether the runtime finds roots on stack with the shadow stack.
+func (kind GCKind) usesShadowStack() bool {
+	return kind == GCBuiltin || kind == GCRefCount
+}
+
+// shadowStackStrategy is the name of LLVM's GC strategy which maintains the shadow stack.
+const shadowStackStrategy = "shadow-stack"
+
+// usesRootSlots returns whether heap pointers in stack frames are spilled to root slots.
+func (b *moduleBuilder) usesRootSlots() bool {
+	return b.gcStackMaps || b.gcKind.usesShadowStack()
+}
+
+// setGCStrategy sets the GC strategy to the function when roots are tracked.
+func (b *moduleBuilder) setGCStrategy(f llvm.Value) {
+	if b.gcStackMaps {
+		f.SetGC(gcStrategy)
+	} else if b.gcKind.usesShadowStack() {
+		f.SetGC(shadowStackStrategy)
+	}
+}
+
+// buildAllocDecls declares the allocation function of the runtime and defines the variable to
+// select the collector. Functions for reference counting are also declared when it is selected.
+func (b *moduleBuilder) buildAllocDecls() {
+	sizeT := b.typeBuilder.sizeT
+	b.layoutT = b.context.StructCreateNamed("gocaml.layout")
+	b.layoutT.StructSetBody([]llvm.Type{sizeT, sizeT, llvm.PointerType(sizeT, 0 /*address space*/)}, false /*packed*/)
+	b.gcLayouts = map[string]llvm.Value{}
+
+	params := []llvm.Type{llvm.PointerType(b.layoutT, 0 /*address space*/), sizeT}
+	t := llvm.FunctionType(b.typeBuilder.voidPtrT, params, false /*varargs*/)
+	v := llvm.AddFunction(b.module, "gocaml_alloc", t)
+	v.SetLinkage(llvm.ExternalLinkage)
+	v.AddFunctionAttr(b.attributes["nounwind"])
+	b.globalTable["gocaml_alloc"] = v
+
+	i32 := b.context.Int32Type()
+	kind := llvm.AddGlobal(b.module, i32, "__gocaml_gc")
+	kind.SetInitializer(llvm.ConstInt(i32, uint64(b.gcKind), false /*signed*/))
+	kind.SetLinkage(llvm.ExternalLinkage)
+
+	if b.gcKind == GCRefCount {
+		b.buildRefCountDecls()
+	}
+}
+
+// pointerOffset returns the byte offset of the element at the path in the type.
+func (b *moduleBuilder) pointerOffset(t llvm.Type, path []int) uint64 {
+	offset := uint64(0)
+	for _, i := range path {
+		offset += b.targetData.ElementOffset(t, i)
+		t = t.StructElementTypes()[i]
+	}
+	return offset
+}
+
+// gcLayout returns the layout of objects of the type passed to 'gocaml_alloc'. Please see
+// gocaml_layout in runtime/gocaml.h.
+func (b *moduleBuilder) gcLayout(t llvm.Type) llvm.Value {
+	key := t.String()
+	if l, ok := b.gcLayouts[key]; ok {
+		return l
+	}
+
+	sizeT := b.typeBuilder.sizeT
+	paths := heapPointerPaths(t, nil, nil)
+	offsets := make([]llvm.Value, 0, len(paths))
+	for _, path := range paths {
+		offsets = append(offsets, llvm.ConstInt(sizeT, b.pointerOffset(t, path), false /*signed*/))
+	}
+
+	offsetsPtr := llvm.ConstPointerNull(llvm.PointerType(sizeT, 0 /*address space*/))
+	if len(offsets) > 0 {
+		arr := llvm.ConstArray(sizeT, offsets)
+		global := llvm.AddGlobal(b.module, arr.Type(), "gc.offsets")
+		global.SetInitializer(arr)
+		global.SetLinkage(llvm.PrivateLinkage)
+		global.SetGlobalConstant(true)
+		global.SetUnnamedAddr(true)
+		zero := llvm.ConstInt(b.context.Int32Type(), 0, false /*signed*/)
+		offsetsPtr = llvm.ConstInBoundsGEP(global, []llvm.Value{zero, zero})
+	}
+
+	layout := llvm.AddGlobal(b.module, b.layoutT, "gc.layout")
+	layout.SetInitializer(llvm.ConstNamedStruct(b.layoutT, []llvm.Value{
+		llvm.ConstInt(sizeT, b.targetData.TypeAllocSize(t), false /*signed*/),
+		llvm.ConstInt(sizeT, uint64(len(offsets)), false /*signed*/),
+		offsetsPtr,
+	}))
+	layout.SetLinkage(llvm.PrivateLinkage)
+	layout.SetGlobalConstant(true)
+	layout.SetUnnamedAddr(true)
+
+	b.gcLayouts[key] = layout
+	return layout
+}
+
+func (b *moduleBuilder) gcRootDecl() llvm.Value {
+	voidPtrT := b.typeBuilder.voidPtrT
+	params := []llvm.Type{llvm.PointerType(voidPtrT, 0 /*address space*/), voidPtrT}
+	t := llvm.FunctionType(b.context.VoidType(), params, false /*varargs*/)
+	return b.declareIntrinsic("llvm.gcroot", t)
+}
+
+// buildGCAlloc allocates 'count' objects of the type on GC heap.
+func (b *blockBuilder) buildGCAlloc(ty llvm.Type, count llvm.Value, name string) llvm.Value {
+	allocVal, ok := b.globalTable["gocaml_alloc"]
+	if !ok {
+		panic("'gocaml_alloc' not found. Declarations for allocation were not emitted")
+	}
+	allocated := b.buildCall(allocVal, []llvm.Value{b.gcLayout(ty), count}, llvm.CCallConv)
+	ptrTy := llvm.PointerType(ty, 0 /*address space*/)
+	return b.builder.CreateBitCast(allocated, ptrTy, name)
+}
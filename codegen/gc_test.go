@@ -0,0 +1,167 @@
+package codegen
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCreateEmitterWithGC(code string, gc GCKind, stackMaps bool) (*Emitter, error) {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return nil, err
+	}
+	prog := closure.Transform(ir)
+	opts := EmitOptions{OptimizeNone, "", "", "", "", false, false, false, false, nil, stackMaps, false, "", RelocDefault, gc}
+	return NewEmitter(prog, env, s, opts)
+}
+
+const gcTestCode = `
+	let rec f s = str_concat s "!" in
+	let rec g s = (f s, 42, [| 1; 2 |]) in
+	let t = g "a" in
+	let (s, i, a) = t in
+	println_str s;
+	println_int (i + Array.length a)`
+
+func TestEmitAllocation(t *testing.T) {
+	for _, tc := range []struct {
+		gc     GCKind
+		want   []string
+		unwant []string
+	}{
+		{
+			gc: GCBoehm,
+			want: []string{
+				"@__gocaml_gc = global i32 0",
+				"call i8* @gocaml_alloc(%gocaml.layout* @gc.layout",
+			},
+			unwant: []string{"GC_malloc", `gc "shadow-stack"`, "@llvm.gcroot", ".root = alloca"},
+		},
+		{
+			gc: GCBuiltin,
+			want: []string{
+				`gc "shadow-stack"`,
+				"@__gocaml_gc = global i32 1",
+				"%gocaml.layout = type { i64, i64, i64* }",
+				"call void @llvm.gcroot(i8**",
+				"call i8* @gocaml_alloc(%gocaml.layout* @gc.layout",
+				// Offsets of characters of string and buffer of array in the tuple
+				"[2 x i64] [i64 0, i64 24]",
+			},
+			// Frame of caller must remain in shadow stack while callee runs
+			unwant: []string{"GC_malloc", "tail call"},
+		},
+		{
+			gc: GCNone,
+			want: []string{
+				"@__gocaml_gc = global i32 2",
+				"call i8* @gocaml_alloc(%gocaml.layout* @gc.layout",
+			},
+			unwant: []string{"GC_malloc", `gc "shadow-stack"`, ".root = alloca"},
+		},
+	} {
+		t.Run(tc.gc.String(), func(t *testing.T) {
+			e, err := testCreateEmitterWithGC(gcTestCode, tc.gc, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Dispose()
+			out := e.EmitLLVMIR()
+			for _, want := range tc.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("'%s' was not found in LLVM IR: %s", want, out)
+				}
+			}
+			for _, unwant := range tc.unwant {
+				if strings.Contains(out, unwant) {
+					t.Errorf("'%s' was unexpectedly found in LLVM IR: %s", unwant, out)
+				}
+			}
+			if _, err := e.EmitObject(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBuiltinGCWithStackMaps(t *testing.T) {
+	_, err := testCreateEmitterWithGC("println_int 42", GCBuiltin, true)
+	if err == nil {
+		t.Fatal("Built-in GC with GC stack maps should cause an error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "GC stack maps cannot be emitted with built-in GC") {
+		t.Fatal("Unexpected error:", msg)
+	}
+}
+
+func TestExecutableGC(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.ml")
+	if err != nil {
+		panic(err)
+	}
+	for _, gc := range []GCKind{GCBuiltin, GCNone, GCRefCount} {
+		for _, input := range inputs {
+			base := filepath.Base(input)
+			t.Run(fmt.Sprintf("%s/%s", gc, base), func(t *testing.T) {
+				s, err := locerr.NewSourceFromFile(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ast, err := syntax.Parse(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				env, ir, err := sema.SemanticsCheck(ast)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				opts := EmitOptions{OptimizeDefault, "", "", "", "", false, false, false, false, nil, false, false, "", RelocDefault, gc}
+				e, err := NewEmitter(closure.Transform(ir), env, s, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer e.Dispose()
+				e.RunOptimizationPasses()
+				outfile, err := filepath.Abs(fmt.Sprintf("test.%s.gc%d.out", base, gc))
+				if err != nil {
+					panic(err)
+				}
+				if err := e.EmitExecutable(outfile); err != nil {
+					t.Fatal(err)
+				}
+				defer os.Remove(outfile)
+
+				// Built-in GC and reference counting free garbage at every allocation to find
+				// objects which are not reachable from roots or whose references are not counted
+				cmd := exec.Command(outfile)
+				cmd.Env = append(os.Environ(), "GOCAML_GC_INITIAL_HEAP=1", "GOCAML_GC_GROWTH=0")
+				got, err := cmd.Output()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := ioutil.ReadFile(strings.TrimSuffix(input, ".ml") + ".out")
+				if err != nil {
+					panic(err)
+				}
+				if string(got) != strings.TrimSuffix(string(want), "\n") {
+					t.Fatalf("Unexpected output from executable:\n\nGot: '%s'\nWant: '%s'", got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package codegen
+
+import (
+	"github.com/rhysd/locerr"
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Note:
+// JIT execution compiles the module with MCJIT in the process and calls the compiled code directly.
+// Go bindings of LLVM do not provide ORC JIT APIs. Runtime is loaded from shared library
+// 'gocamlrt.so' instead of being linked statically.
+//
+// main() of runtime cannot be called because the symbol is resolved to main() of the host process.
+// Instead, the module has one more function '__gocaml_jit_main' which does the same as main() of
+// runtime. It also flushes buffered outputs of C standard library since the host process does not
+// flush them when it exits.
+//
+// Boehm GC finds the bottom of stack of the main thread at initialization. The JIT-compiled code
+// must run on the main thread. Otherwise GC scans a wrong stack.
+
+func (emitter *Emitter) declareFun(name string, t llvm.Type) llvm.Value {
+	if f := emitter.Module.NamedFunction(name); f.C != nil {
+		return f
+	}
+	f := llvm.AddFunction(emitter.Module, name, t)
+	f.SetLinkage(llvm.ExternalLinkage)
+	return f
+}
+
+// buildJITMain builds '__gocaml_jit_main' which initializes runtime with the arguments, runs the
+// program and flushes outputs.
+func (emitter *Emitter) buildJITMain(args []string) llvm.Value {
+	ctx := emitter.Module.Context()
+	builder := ctx.NewBuilder()
+	defer builder.Dispose()
+
+	i32T := ctx.Int32Type()
+	charPtrT := llvm.PointerType(ctx.Int8Type(), 0)
+	argvT := llvm.PointerType(charPtrT, 0)
+
+	initFun := emitter.declareFun("__gocaml_init", llvm.FunctionType(ctx.VoidType(), []llvm.Type{i32T, argvT}, false /*varargs*/))
+	flushFun := emitter.declareFun("fflush", llvm.FunctionType(i32T, []llvm.Type{charPtrT}, false /*varargs*/))
+	mainFun := emitter.Module.NamedFunction("__gocaml_main")
+	if mainFun.C == nil {
+		panic("FATAL: __gocaml_main() not found")
+	}
+
+	funVal := llvm.AddFunction(emitter.Module, "__gocaml_jit_main", llvm.FunctionType(i32T, []llvm.Type{}, false /*varargs*/))
+	builder.SetInsertPointAtEnd(ctx.AddBasicBlock(funVal, "entry"))
+
+	elems := make([]llvm.Value, 0, len(args))
+	for _, arg := range args {
+		elems = append(elems, builder.CreateGlobalStringPtr(arg, "__gocaml_jit_arg"))
+	}
+	argsT := llvm.ArrayType(charPtrT, len(elems))
+	argv := llvm.AddGlobal(emitter.Module, argsT, "__gocaml_jit_argv")
+	argv.SetInitializer(llvm.ConstArray(charPtrT, elems))
+	argv.SetLinkage(llvm.PrivateLinkage)
+	argv.SetGlobalConstant(true)
+
+	zero := llvm.ConstInt(i32T, 0, false)
+	argc := llvm.ConstInt(i32T, uint64(len(args)), false)
+	builder.CreateCall(initFun, []llvm.Value{argc, llvm.ConstInBoundsGEP(argv, []llvm.Value{zero, zero})}, "")
+	status := builder.CreateCall(mainFun, []llvm.Value{}, "status")
+	builder.CreateCall(flushFun, []llvm.Value{llvm.ConstPointerNull(charPtrT)}, "")
+	builder.CreateRet(status)
+
+	return funVal
+}
+
+// RunJIT compiles the module with JIT compiler and runs it in the current process. args is a list of
+// program arguments whose first element is the name of the program. It returns the exit status of
+// the program. When the program calls 'exit', the current process exits. The module is modified to
+// add an entry point. It must be called on the main thread.
+func (emitter *Emitter) RunJIT(args []string) (int, error) {
+	if emitter.isCrossCompiling() {
+		return 0, locerr.Errorf("JIT execution is not available for target '%s'. Only native target is supported", emitter.Triple)
+	}
+	if emitter.ProfileGenerate {
+		return 0, locerr.NewError("Profile instrumentation is not supported by JIT execution")
+	}
+	if emitter.Sanitize != "" {
+		return 0, locerr.NewError("Sanitizers are not supported by JIT execution")
+	}
+	if emitter.GC != GCBoehm {
+		return 0, locerr.Errorf("Only Boehm GC is supported by JIT execution but %s was specified", emitter.GC)
+	}
+
+	rt, err := detectRuntimePath("gocamlrt.so")
+	if err != nil {
+		return 0, err
+	}
+	if err := llvm.LoadLibraryPermanently(rt); err != nil {
+		return 0, locerr.Notef(err, "Cannot load runtime library '%s'", rt)
+	}
+
+	llvm.LinkInMCJIT()
+	if err := llvm.InitializeNativeTarget(); err != nil {
+		return 0, err
+	}
+	if err := llvm.InitializeNativeAsmPrinter(); err != nil {
+		return 0, err
+	}
+
+	entry := emitter.buildJITMain(args)
+
+	opts := llvm.NewMCJITCompilerOptions()
+	opts.SetMCJITOptimizationLevel(uint(emitter.Optimization))
+	engine, err := llvm.NewMCJITCompiler(emitter.Module, opts)
+	if err != nil {
+		return 0, locerr.Note(err, "Cannot create JIT compiler")
+	}
+	defer func() {
+		// Execution engine owns the module. Take it back not to dispose it twice
+		engine.RemoveModule(emitter.Module)
+		engine.Dispose()
+	}()
+
+	engine.RunStaticConstructors()
+	ret := engine.RunFunction(entry, []llvm.GenericValue{})
+	defer ret.Dispose()
+	engine.RunStaticDestructors()
+
+	return int(int32(ret.Int(true))), nil
+}
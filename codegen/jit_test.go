@@ -0,0 +1,62 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJITMainIsBuilt(t *testing.T) {
+	e, err := testCreateEmitter("println_int 42", OptimizeDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.buildJITMain([]string{"prog", "arg"})
+	ir := e.EmitLLVMIR()
+	for _, want := range []string{
+		"define i32 @__gocaml_jit_main()",
+		"call void @__gocaml_init(i32 2, ",
+		"call i32 @__gocaml_main()",
+		"call i32 @fflush(i8* null)",
+		"c\"prog\\00\"",
+		"c\"arg\\00\"",
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("'%s' was not found in LLVM IR: %s", want, ir)
+		}
+	}
+}
+
+func TestRunJIT(t *testing.T) {
+	if _, err := detectRuntimePath("gocamlrt.so"); err != nil {
+		t.Skip(err)
+	}
+	e, err := testCreateEmitter("let a = Array.make 10 1 in let rec sum i = if i < 0 then 0 else a.(i) + sum (i - 1) in assert (sum 9 = 10)", OptimizeDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	status, err := e.RunJIT([]string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0 {
+		t.Fatal("Unexpected exit status:", status)
+	}
+}
+
+func TestRunJITForOtherTarget(t *testing.T) {
+	e, err := testCreateEmitter("println_int 42", OptimizeDefault, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.Triple = "wasm32-unknown-unknown"
+	_, err = e.RunJIT([]string{"test"})
+	if err == nil {
+		t.Fatal("Error should occur for non-native target")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Only native target is supported") {
+		t.Fatal("Unexpected error:", msg)
+	}
+}
@@ -1,6 +1,7 @@
 package codegen
 
 import (
+	"fmt"
 	"github.com/rhysd/locerr"
 	"go/build"
 	"os"
@@ -23,11 +24,13 @@ func gopaths() []string {
 	return filepath.SplitList(s)
 }
 
-func detectRuntimePath() (string, error) {
+// detectRuntimePath finds the runtime library file. lib is 'gocamlrt.a' for static linking or
+// 'gocamlrt.so' for loading it into the process.
+func detectRuntimePath(lib string) (string, error) {
 	// XXX:
 	// Need to investigate solid way to get runtime library path
 
-	fromBuildDir, err := filepath.Abs(filepath.Join(filepath.Dir(os.Args[0]), "runtime/gocamlrt.a"))
+	fromBuildDir, err := filepath.Abs(filepath.Join(filepath.Dir(os.Args[0]), "runtime", lib))
 	if err != nil {
 		return "", err
 	}
@@ -38,21 +41,23 @@ func detectRuntimePath() (string, error) {
 	candidates := []string{fromBuildDir}
 
 	for _, gopath := range gopaths() {
-		fromGopath := filepath.Join(gopath, "src/github.com/rhysd/gocaml/runtime/gocamlrt.a")
+		fromGopath := filepath.Join(gopath, "src/github.com/rhysd/gocaml/runtime", lib)
 		if _, err := os.Stat(fromGopath); err == nil {
 			return fromGopath, nil
 		}
 		candidates = append(candidates, fromGopath)
 	}
 
-	return "", locerr.Errorf("Runtime library (gocamlrt.a) was not found. Candidates: %s", strings.Join(candidates, ", "))
+	return "", locerr.Errorf("Runtime library (%s) was not found. Candidates: %s", lib, strings.Join(candidates, ", "))
 }
 
 func detectLibgcPath() string {
 	if runtime.GOOS == "darwin" {
-		brewLib := filepath.Clean("/usr/local/opt/bdw-gc/lib")
-		if _, err := os.Stat(brewLib); err == nil {
-			return brewLib
+		// Homebrew is installed in /opt/homebrew on Apple Silicon and in /usr/local on Intel Mac
+		for _, brewLib := range []string{"/opt/homebrew/opt/bdw-gc/lib", "/usr/local/opt/bdw-gc/lib"} {
+			if _, err := os.Stat(brewLib); err == nil {
+				return brewLib
+			}
 		}
 	}
 
@@ -62,32 +67,95 @@ func detectLibgcPath() string {
 type linker struct {
 	linkerCmd string
 	ldflags   string
+	// Target triple on cross compilation. It is empty when linking for the host machine.
+	triple string
+	// Link-time optimization with the optimization level. Object files and runtime are bitcode.
+	lto      bool
+	optLevel OptLevel
+	// Link the runtime as a shared library
+	shared bool
+	// Link runtimes of the sanitizers
+	sanitize sanitizers
+	// Relocation model resolved for the target. Executables are position-independent with RelocPIE
+	reloc RelocModel
 }
 
-func newDefaultLinker(ldflags string) *linker {
+func newDefaultLinker(ldflags string, triple string) *linker {
 	cmd := os.Getenv("GOCAML_LINKER_CMD")
 	if cmd == "" {
 		cmd = "clang"
 	}
-	return &linker{cmd, ldflags}
+	return &linker{cmd, ldflags, triple, false, OptimizeNone, false, sanitizers{}, RelocDefault}
 }
 
 func (lnk *linker) cmdFailed(args []string, msg string) error {
 	return locerr.Errorf("Linker command failed: %s %s:\n%s", lnk.linkerCmd, strings.Join(args, " "), msg)
 }
 
+// runtimePath returns the path to the runtime library linked to executables.
+func (lnk *linker) runtimePath() (string, error) {
+	// Runtime for other target is built in runtime/{triple}/ directory
+	lib := "gocamlrt.a"
+	if lnk.lto {
+		lib = "gocamlrt.bc"
+	} else if lnk.shared {
+		lib = "gocamlrt.so"
+	}
+	if lnk.triple != "" {
+		lib = filepath.Join(lnk.triple, lib)
+	}
+	return detectRuntimePath(lib)
+}
+
+func (lnk *linker) isClang() bool {
+	return strings.Contains(filepath.Base(lnk.linkerCmd), "clang")
+}
+
 func (lnk *linker) link(executable string, objFiles []string) error {
 	// TODO: Consider Windows environment
 
-	runtimePath, err := detectRuntimePath()
+	if lnk.lto && lnk.shared {
+		return locerr.NewError("Link-time optimization needs static runtime but shared runtime was specified")
+	}
+	if lnk.lto && !lnk.isClang() {
+		return locerr.Errorf("Link-time optimization needs clang as linker but linker is '%s'", lnk.linkerCmd)
+	}
+	if lnk.sanitize.enabled() && !lnk.isClang() {
+		return locerr.Errorf("Sanitizers need clang as linker but linker is '%s'", lnk.linkerCmd)
+	}
+
+	runtimePath, err := lnk.runtimePath()
 	if err != nil {
 		return err
 	}
 
 	args := append(objFiles, "-o", executable, runtimePath, "-L/usr/local/lib", "-L/usr/lib")
+	if lnk.triple != "" && lnk.isClang() {
+		// Other linkers such as gcc do not accept target triple. Options for the target should be
+		// given via -ldflags
+		args = append(args, "-target", lnk.triple)
+	}
 	if path := detectLibgcPath(); path != "" {
 		args = append(args, "-L"+path)
 	}
+	if lnk.shared {
+		// Shared runtime is found at the directory where it was linked or system library paths
+		args = append(args, "-Wl,-rpath,"+filepath.Dir(runtimePath))
+	}
+	if lnk.lto {
+		// Optimization level at link time determines optimizations across modules
+		args = append(args, "-flto", fmt.Sprintf("-O%d", lnk.optLevel))
+	}
+	if lnk.sanitize.enabled() {
+		args = append(args, lnk.sanitize.linkerFlag())
+	}
+	switch lnk.reloc {
+	case RelocPIE:
+		args = append(args, "-pie")
+	case RelocStatic:
+		// Linkers on hardened distributions make position-independent executables by default
+		args = append(args, "-no-pie")
+	}
 	args = append(args, "-lgc", lnk.ldflags)
 
 	if _, err := exec.Command(lnk.linkerCmd, args...).Output(); err != nil {
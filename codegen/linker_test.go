@@ -7,7 +7,7 @@ import (
 )
 
 func TestLinkFailed(t *testing.T) {
-	l := newDefaultLinker("")
+	l := newDefaultLinker("", "")
 	err := l.link("dummy", []string{"not-exist.o"})
 	if err == nil {
 		t.Fatalf("No error occurred")
@@ -23,7 +23,7 @@ func TestMultiGOPATH(t *testing.T) {
 	defer os.Setenv("GOPATH", gopath)
 	os.Setenv("GOPATH", "unknown-path:"+gopath)
 
-	l := newDefaultLinker("")
+	l := newDefaultLinker("", "")
 	err := l.link("dummy", []string{"not-exist.o"})
 	if !strings.Contains(err.Error(), "Linker command failed: ") {
 		t.Fatalf("Unexpected error message '%s'", err.Error())
@@ -35,19 +35,70 @@ func TestRuntimeNotFound(t *testing.T) {
 	defer os.Setenv("GOPATH", gopath)
 	os.Setenv("GOPATH", "/unknown/path/to/somewhere")
 
-	l := newDefaultLinker("")
+	l := newDefaultLinker("", "")
 	err := l.link("dummy", []string{"not-exist.o"})
 	if !strings.Contains(err.Error(), "Runtime library (gocamlrt.a) was not found") {
 		t.Fatalf("Unexpected error message '%s'", err.Error())
 	}
 }
 
+func TestRuntimeForTargetNotFound(t *testing.T) {
+	l := newDefaultLinker("", "unknown-target-triple")
+	err := l.link("dummy", []string{"not-exist.o"})
+	if !strings.Contains(err.Error(), "Runtime library (unknown-target-triple/gocamlrt.a) was not found") {
+		t.Fatalf("Unexpected error message '%s'", err.Error())
+	}
+}
+
 func TestCustomizeLinkerCommand(t *testing.T) {
 	saved := os.Getenv("GOCAML_LINKER_CMD")
 	defer os.Setenv("GOCAML_LINKER_CMD", saved)
 	os.Setenv("GOCAML_LINKER_CMD", "linker-command-for-test")
-	l := newDefaultLinker("")
+	l := newDefaultLinker("", "")
 	if l.linkerCmd != "linker-command-for-test" {
 		t.Fatalf("Wanted 'linker-command-for-test' as linker command but had '%s'", l.linkerCmd)
 	}
 }
+
+func TestLTONeedsClang(t *testing.T) {
+	l := newDefaultLinker("", "")
+	l.linkerCmd = "gcc"
+	l.lto = true
+	err := l.link("dummy", []string{"not-exist.o"})
+	if err == nil || !strings.Contains(err.Error(), "Link-time optimization needs clang") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestSharedRuntimeNotFound(t *testing.T) {
+	gopath := os.Getenv("GOPATH")
+	defer os.Setenv("GOPATH", gopath)
+	os.Setenv("GOPATH", "/unknown/path/to/somewhere")
+
+	l := newDefaultLinker("", "")
+	l.shared = true
+	err := l.link("dummy", []string{"not-exist.o"})
+	if !strings.Contains(err.Error(), "Runtime library (gocamlrt.so) was not found") {
+		t.Fatalf("Unexpected error message '%s'", err.Error())
+	}
+}
+
+func TestSharedRuntimeWithLTO(t *testing.T) {
+	l := newDefaultLinker("", "")
+	l.lto = true
+	l.shared = true
+	err := l.link("dummy", []string{"not-exist.o"})
+	if err == nil || !strings.Contains(err.Error(), "Link-time optimization needs static runtime") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestSanitizersNeedClang(t *testing.T) {
+	l := newDefaultLinker("", "")
+	l.linkerCmd = "gcc"
+	l.sanitize = sanitizers{true, false}
+	err := l.link("dummy", []string{"not-exist.o"})
+	if err == nil || !strings.Contains(err.Error(), "Sanitizers need clang") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
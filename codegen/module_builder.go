@@ -20,9 +20,50 @@ type moduleBuilder struct {
 	attributes  map[string]llvm.Attribute
 	globalTable map[string]llvm.Value
 	funcTable   map[string]llvm.Value
+	// Calling convention of C on the target and signatures of external functions lowered for it
+	abi         cABI
+	cSignatures map[string]*cSignature
 	closures    mir.Closures
+	// Tuples and closures which are allocated on stack
+	stackAllocated map[string]struct{}
+	// Closures which reuse environments of preceding closures
+	sharedEnvs map[string]string
+	// Closures whose environments are linked to environments of their enclosing closures
+	envLinks map[string]string
+	// Instrument the program to record profile
+	instrument bool
+	profiler   *profiler
+	// Profile used for weighting branches. It is nil when no profile is given.
+	profile *mir.Profile
+	// Wrap calls in statepoints to emit stack maps of GC roots
+	gcStackMaps bool
+	// Abort on overflow of integer operations
+	checkedArith bool
+	// Sanitizers instrumenting the program
+	sanitize sanitizers
+	// Garbage collector selected in runtime. Roots are tracked for the built-in collector and
+	// reference counting
+	gcKind    GCKind
+	layoutT   llvm.Type
+	gcLayouts map[string]llvm.Value
 }
 
+// Note:
+// Functions defined in GoCaml which are not closures are never called from C. They use 'fastcc' so
+// that LLVM can choose registers for arguments and return values freely. Calls of them must also be
+// marked as 'fastcc'. Mismatched calling convention is undefined behavior.
+//
+// Closures may be passed to external functions and called from C. Closure bodies and closure
+// wrappers of external functions follow the C calling convention as documented in
+// runtime/gocaml.h. Bool parameters and return values are zero-extended to C's int. Externals and
+// '__gocaml_main' (called by runtime) also follow the C calling convention.
+
+// gocamlCallConv is a calling convention of functions defined in GoCaml.
+const gocamlCallConv = llvm.FastCallConv
+
+// closureCallConv is a calling convention of functions called via closures.
+const closureCallConv = llvm.CCallConv
+
 func createAttributeTable(ctx llvm.Context) map[string]llvm.Attribute {
 	attrs := map[string]llvm.Attribute{}
 
@@ -34,6 +75,10 @@ func createAttributeTable(ctx llvm.Context) map[string]llvm.Attribute {
 		"ssp",
 		"uwtable",
 		"alwaysinline",
+		"sret",
+		"byval",
+		"sanitize_address",
+		"zeroext",
 	} {
 		kind := llvm.AttributeKindID(attr)
 		attrs[attr] = ctx.CreateEnumAttribute(kind, 0)
@@ -58,6 +103,15 @@ func newModuleBuilder(env *types.Env, file *locerr.Source, opts EmitOptions) (*m
 		triple = llvm.DefaultTargetTriple()
 	}
 
+	san, err := parseSanitizers(opts.Sanitize)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.GC.usesShadowStack() && opts.GCStackMaps {
+		return nil, locerr.Errorf("GC stack maps cannot be emitted with %s", opts.GC)
+	}
+
 	optLevel := llvm.CodeGenLevelDefault
 	switch opts.Optimization {
 	case OptimizeNone:
@@ -73,12 +127,20 @@ func newModuleBuilder(env *types.Env, file *locerr.Source, opts EmitOptions) (*m
 		return nil, err
 	}
 
+	reloc := llvm.RelocDefault
+	switch relocModelOf(opts.Reloc, triple) {
+	case RelocPIE, RelocPIC:
+		reloc = llvm.RelocPIC
+	case RelocStatic:
+		reloc = llvm.RelocStatic
+	}
+
 	machine := target.CreateTargetMachine(
 		triple,
-		"", // CPU
-		"", // Features
+		opts.CPU,
+		opts.Features,
 		optLevel,
-		llvm.RelocDefault,     // static or dynamic-no-pic or default
+		reloc,                 // static or PIC or dynamic-no-pic or default
 		llvm.CodeModelDefault, // small, medium, large, kernel, JIT-default, default
 	)
 
@@ -118,6 +180,20 @@ func newModuleBuilder(env *types.Env, file *locerr.Source, opts EmitOptions) (*m
 		createAttributeTable(ctx),
 		nil,
 		nil,
+		cABIOf(triple),
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		opts.ProfileGenerate,
+		nil,
+		opts.Profile,
+		opts.GCStackMaps,
+		opts.CheckedArith,
+		san,
+		opts.GC,
+		llvm.Type{},
 		nil,
 	}, nil
 }
@@ -147,15 +223,20 @@ func (b *moduleBuilder) buildExternalClosureWrapper(funName string, ty *types.Fu
 	tyVal := b.typeBuilder.buildExternalClosure(ty)
 	val := llvm.AddFunction(b.module, name, tyVal)
 	val.SetLinkage(llvm.PrivateLinkage)
+	val.SetFunctionCallConv(closureCallConv)
+	b.addBoolAttributes(tyVal, val.AddAttributeAtIndex)
 	val.AddFunctionAttr(b.attributes["alwaysinline"])
 	val.AddFunctionAttr(b.attributes["nounwind"])
 	val.AddFunctionAttr(b.attributes["ssp"])
 	val.AddFunctionAttr(b.attributes["uwtable"])
 	val.AddFunctionAttr(b.attributes["disable-tail-calls"])
+	b.setGCStrategy(val)
+	if b.sanitize.address {
+		val.AddFunctionAttr(b.attributes["sanitize_address"])
+	}
 	b.funcTable[name] = val
 
-	extFunVal, ok := b.globalTable[cName]
-	if !ok {
+	if _, ok := b.globalTable[cName]; !ok {
 		panic("No external symbol for closure wrapper not found: " + cName)
 	}
 
@@ -168,7 +249,8 @@ func (b *moduleBuilder) buildExternalClosureWrapper(funName string, ty *types.Fu
 	for i := 0; i < lenArgs; i++ {
 		args = append(args, val.Param(i+1))
 	}
-	ret := b.builder.CreateCall(extFunVal, args, "")
+	// Stack slots for lowering arguments are allocated in the entry block
+	ret := newBlockBuilder(b, body).buildExternalCall(cName, args)
 	if ty.Ret == types.UnitType {
 		// When the external function returns void
 		ret = llvm.ConstNamedStruct(b.typeBuilder.unitT, []llvm.Value{})
@@ -180,16 +262,24 @@ func (b *moduleBuilder) buildExternalClosureWrapper(funName string, ty *types.Fu
 }
 
 func (b *moduleBuilder) buildExternalDecl(ext *types.External) {
+	if _, ok := b.globalTable[ext.CName]; ok {
+		// External symbol monomorphized from generic one may share the C name with existing one.
+		// e.g. 'print' instantiated as 'int -> unit' is linked to 'print_int'.
+		return
+	}
+
 	switch ty := ext.Type.(type) {
 	case *types.Var:
 		panic("unreachable")
 	case *types.Fun:
 		// Make a declaration for the external symbol function
-		tyVal := b.typeBuilder.buildExternalFun(ty)
-		val := llvm.AddFunction(b.module, ext.CName, tyVal)
+		sig := b.lowerCSignature(b.typeBuilder.buildExternalFun(ty))
+		val := llvm.AddFunction(b.module, ext.CName, sig.fun)
 		val.SetLinkage(llvm.ExternalLinkage)
 		val.AddFunctionAttr(b.attributes["disable-tail-calls"])
+		b.addCAttributes(sig, val.AddAttributeAtIndex)
 		b.globalTable[ext.CName] = val
+		b.cSignatures[ext.CName] = sig
 	default:
 		t := b.typeBuilder.fromMIR(ty)
 		v := llvm.AddGlobal(b.module, t, ext.CName)
@@ -227,16 +317,118 @@ func (b *moduleBuilder) buildFuncDecl(insn mir.FunInsn) {
 
 	// Currently GoCaml does not have modules. So all functions are private.
 	v.SetLinkage(llvm.PrivateLinkage)
+	if isClosure {
+		v.SetFunctionCallConv(closureCallConv)
+		b.addBoolAttributes(t, v.AddAttributeAtIndex)
+	} else {
+		v.SetFunctionCallConv(gocamlCallConv)
+	}
 
 	v.AddFunctionAttr(b.attributes["inlinehint"])
 	v.AddFunctionAttr(b.attributes["nounwind"])
 	v.AddFunctionAttr(b.attributes["ssp"])
 	v.AddFunctionAttr(b.attributes["uwtable"])
 	v.AddFunctionAttr(b.attributes["disable-tail-calls"])
+	b.setGCStrategy(v)
+	if b.sanitize.address {
+		v.AddFunctionAttr(b.attributes["sanitize_address"])
+	}
 
 	b.funcTable[name] = v
 }
 
+// containsJump returns true when the block contains 'jump' instruction introduced by tail call
+// optimization.
+func containsJump(block *mir.Block) bool {
+	for i := block.Top.Next; i.Next != nil; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Jump:
+			return true
+		case *mir.If:
+			if containsJump(v.Then) || containsJump(v.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsCall returns true when the block calls functions defined in GoCaml. Only such functions
+// can make the stack overflow by recursion.
+func containsCall(block *mir.Block) bool {
+	for i := block.Top.Next; i.Next != nil; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.App:
+			if v.Kind != mir.EXTERNAL_CALL {
+				return true
+			}
+		case *mir.If:
+			if containsCall(v.Then) || containsCall(v.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// envLayout returns the type of the environment of the closure and indices of captures stored in it.
+// Environment of a linked closure starts with a pointer to the environment of its enclosing closure
+// and captures of the enclosing closure are not stored (see the note in closure/link.go).
+func (b *moduleBuilder) envLayout(name string) (llvm.Type, []int) {
+	closure := b.closures[name]
+	parent, linked := b.envLinks[name]
+	if !linked {
+		indices := make([]int, 0, len(closure))
+		for i := range closure {
+			indices = append(indices, i)
+		}
+		return b.typeBuilder.buildClosureCaptures(name, closure), indices
+	}
+
+	inParent := map[string]struct{}{}
+	for _, c := range b.closures[parent] {
+		inParent[c] = struct{}{}
+	}
+	own := []string{}
+	indices := []int{}
+	for i, c := range closure {
+		if _, ok := inParent[c]; !ok {
+			own = append(own, c)
+			indices = append(indices, i)
+		}
+	}
+	return b.typeBuilder.buildLinkedClosureCaptures(name, own), indices
+}
+
+// loadCaptures loads needed captures from the environment of the closure. Captures which are not
+// stored in the environment are loaded from environments of enclosing closures following links.
+func (b *moduleBuilder) loadCaptures(name string, env llvm.Value, needed map[string]struct{}, regs map[string]llvm.Value) {
+	closure := b.closures[name]
+	envTy, indices := b.envLayout(name)
+	_, linked := b.envLinks[name]
+	offset := 0
+	if linked {
+		offset = 1
+	}
+
+	envVal := b.builder.CreateBitCast(env, llvm.PointerType(envTy, 0 /*address space*/), fmt.Sprintf("%s.capture", name))
+	for i, idx := range indices {
+		n := closure[idx]
+		if _, ok := needed[n]; !ok {
+			continue
+		}
+		ptr := b.builder.CreateStructGEP(envVal, i+offset, "")
+		regs[n] = b.builder.CreateLoad(ptr, fmt.Sprintf("%s.capture.%s", name, n))
+		delete(needed, n)
+	}
+
+	if !linked || len(needed) == 0 {
+		return
+	}
+	parentEnv := b.builder.CreateLoad(b.builder.CreateStructGEP(envVal, 0, ""), fmt.Sprintf("%s.link", name))
+	b.loadCaptures(b.envLinks[name], parentEnv, needed, regs)
+}
+
 func (b *moduleBuilder) buildFunBody(insn mir.FunInsn) {
 	name := insn.Name
 	fun := insn.Val
@@ -271,14 +463,13 @@ func (b *moduleBuilder) buildFunBody(insn mir.FunInsn) {
 
 	// Expose captures of closure
 	if isClosure {
+		blockBuilder.envPtr = funVal.Param(0)
 		if len(closure) > 0 {
-			capturesTy := llvm.PointerType(b.typeBuilder.buildClosureCaptures(name, closure), 0 /*address space*/)
-			closureVal := b.builder.CreateBitCast(funVal.Param(0), capturesTy, fmt.Sprintf("%s.capture", name))
-			for i, n := range closure {
-				ptr := b.builder.CreateStructGEP(closureVal, i, "")
-				exposed := b.builder.CreateLoad(ptr, fmt.Sprintf("%s.capture.%s", name, n))
-				blockBuilder.registers[n] = exposed
+			needed := make(map[string]struct{}, len(closure))
+			for _, n := range closure {
+				needed[n] = struct{}{}
 			}
+			b.loadCaptures(name, funVal.Param(0), needed, blockBuilder.registers)
 		}
 		if fun.IsRecursive {
 			// When the closure itself is used in its body, it needs to prepare the closure object
@@ -296,8 +487,40 @@ func (b *moduleBuilder) buildFunBody(insn mir.FunInsn) {
 		}
 	}
 
-	lastVal := blockBuilder.buildBlock(fun.Body)
-	b.builder.CreateRet(lastVal)
+	if containsCall(fun.Body) {
+		if b.debug != nil {
+			b.debug.setLocation(b.builder, insn.Pos)
+		}
+		blockBuilder.buildStackCheck(insn.Pos)
+	}
+
+	if containsJump(fun.Body) {
+		blockBuilder.buildLoopHeader(fun.Params)
+	}
+
+	if b.usesRootSlots() {
+		// Parameters and captures are also GC roots
+		for _, p := range fun.Params {
+			blockBuilder.buildRoots(p, blockBuilder.registers[p])
+		}
+		for _, c := range closure {
+			if v, ok := blockBuilder.registers[c]; ok {
+				blockBuilder.buildRoots(c, v)
+			}
+		}
+		if v, ok := blockBuilder.registers[name]; ok {
+			blockBuilder.buildRoots(name, v)
+		}
+	}
+
+	if b.debug != nil {
+		ty := b.env.DeclTable[name].(*types.Fun)
+		for i, p := range fun.Params {
+			b.debug.describeVar(p, ty.Params[i], blockBuilder.registers[p], i+1, insn.Pos, b.builder.GetInsertBlock())
+		}
+	}
+
+	blockBuilder.buildTailBlock(fun.Body)
 	if b.debug != nil {
 		b.debug.clearLocation(b.builder)
 	}
@@ -324,6 +547,10 @@ func (b *moduleBuilder) buildMain(entry *mir.Block) {
 	funVal.AddFunctionAttr(b.attributes["ssp"])
 	funVal.AddFunctionAttr(b.attributes["uwtable"])
 	funVal.AddFunctionAttr(b.attributes["disable-tail-calls"])
+	b.setGCStrategy(funVal)
+	if b.sanitize.address {
+		funVal.AddFunctionAttr(b.attributes["sanitize_address"])
+	}
 
 	if b.debug != nil {
 		pos := entry.Top.Next.Pos
@@ -334,6 +561,9 @@ func (b *moduleBuilder) buildMain(entry *mir.Block) {
 	start := b.context.AddBasicBlock(funVal, "start")
 	b.builder.SetInsertPointAtEnd(start)
 	builder := newBlockBuilder(b, allocaBlock)
+	if b.profiler != nil {
+		builder.buildProfileInit()
+	}
 	builder.buildBlock(entry)
 
 	b.builder.CreateRet(llvm.ConstInt(int32T, 0, true))
@@ -354,28 +584,29 @@ func (b *moduleBuilder) buildMain(entry *mir.Block) {
 	}
 }
 
-func (b *moduleBuilder) buildLibgcFuncDecls() {
-	t := llvm.FunctionType(b.typeBuilder.voidPtrT, []llvm.Type{b.typeBuilder.sizeT}, false /*vaargs*/)
-	v := llvm.AddFunction(b.module, "GC_malloc", t)
-	v.SetLinkage(llvm.ExternalLinkage)
-	v.AddFunctionAttr(b.attributes["nounwind"])
-	b.globalTable["GC_malloc"] = v
-}
-
 func (b *moduleBuilder) build(prog *mir.Program) error {
 	// Note:
 	// Currently global variables are external symbols only.
-	b.globalTable = make(map[string]llvm.Value, len(b.env.Externals)+1 /* 1 = libgc functions */)
+	b.globalTable = make(map[string]llvm.Value, len(b.env.Externals)+1 /* 1 = gocaml_alloc */)
+	b.cSignatures = make(map[string]*cSignature, len(b.env.Externals))
 	// Note:
 	// Closures for external functions are also defined.
 	b.funcTable = make(map[string]llvm.Value, len(prog.Toplevel)+len(b.env.Externals))
 
-	b.buildLibgcFuncDecls()
+	b.buildAllocDecls()
+	b.buildTableDecls()
 	for _, ext := range b.env.Externals {
 		b.buildExternalDecl(ext)
 	}
 
 	b.closures = prog.Closures
+	b.stackAllocated = prog.StackAllocated
+	b.sharedEnvs = prog.SharedEnvs
+	b.envLinks = prog.EnvLinks
+	if b.instrument {
+		b.profiler = newProfiler(prog)
+		b.buildProfileGlobals()
+	}
 	for _, fun := range prog.Toplevel {
 		b.buildFuncDecl(fun)
 	}
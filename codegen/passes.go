@@ -0,0 +1,116 @@
+package codegen
+
+import (
+	"github.com/rhysd/locerr"
+	"llvm.org/llvm/bindings/go/llvm"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Note:
+// LLVM C API (and its Go bindings) of LLVM 5 only provides the legacy pass manager. Pipelines of
+// the new pass manager are not available. A pipeline given as string is made of the passes which
+// can be added via the C API. Their names are the same as 'opt' command.
+//
+// PassManagerBuilder of C API has no switch for vectorizers. They are enabled via command line
+// options of LLVM ('-vectorize-loops' and '-vectorize-slp') which PassManagerBuilder reads when it
+// is created. The options are global in the process and cannot be disabled once enabled.
+
+// LLVMPassOptions customizes LLVM optimization passes run by Emitter.RunOptimizationPasses.
+// Zero value means the standard pipeline of the optimization level.
+type LLVMPassOptions struct {
+	// InlineThreshold is a threshold of the inliner. 0 means the default threshold of the
+	// optimization level. Negative value disables the inliner.
+	InlineThreshold int
+	// LoopVectorize enables the loop vectorizer
+	LoopVectorize bool
+	// SLPVectorize enables the SLP (superword-level parallelism) vectorizer
+	SLPVectorize bool
+	// DisableUnrollLoops disables loop unrolling. Loops are not unrolled at OptimizeLess regardless
+	// of this option.
+	DisableUnrollLoops bool
+	// Pipeline is a comma-separated list of LLVM passes run instead of the standard pipeline. Please
+	// see LLVMPassNames for available passes. They run even with OptimizeNone.
+	Pipeline string
+}
+
+var llvmPasses = map[string]func(llvm.PassManager){
+	"adce":                  llvm.PassManager.AddAggressiveDCEPass,
+	"argpromotion":          llvm.PassManager.AddArgumentPromotionPass,
+	"constmerge":            llvm.PassManager.AddConstantMergePass,
+	"constprop":             llvm.PassManager.AddConstantPropagationPass,
+	"deadargelim":           llvm.PassManager.AddDeadArgEliminationPass,
+	"dse":                   llvm.PassManager.AddDeadStoreEliminationPass,
+	"functionattrs":         llvm.PassManager.AddFunctionAttrsPass,
+	"globaldce":             llvm.PassManager.AddGlobalDCEPass,
+	"globalopt":             llvm.PassManager.AddGlobalOptimizerPass,
+	"gvn":                   llvm.PassManager.AddGVNPass,
+	"indvars":               llvm.PassManager.AddIndVarSimplifyPass,
+	"inline":                llvm.PassManager.AddFunctionInliningPass,
+	"instcombine":           llvm.PassManager.AddInstructionCombiningPass,
+	"ipsccp":                llvm.PassManager.AddIPSCCPPass,
+	"jump-threading":        llvm.PassManager.AddJumpThreadingPass,
+	"licm":                  llvm.PassManager.AddLICMPass,
+	"loop-deletion":         llvm.PassManager.AddLoopDeletionPass,
+	"loop-rotate":           llvm.PassManager.AddLoopRotatePass,
+	"loop-unroll":           llvm.PassManager.AddLoopUnrollPass,
+	"loop-unswitch":         llvm.PassManager.AddLoopUnswitchPass,
+	"mem2reg":               llvm.PassManager.AddPromoteMemoryToRegisterPass,
+	"memcpyopt":             llvm.PassManager.AddMemCpyOptPass,
+	"prune-eh":              llvm.PassManager.AddPruneEHPass,
+	"reassociate":           llvm.PassManager.AddReassociatePass,
+	"sccp":                  llvm.PassManager.AddSCCPPass,
+	"simplifycfg":           llvm.PassManager.AddCFGSimplificationPass,
+	"sroa":                  llvm.PassManager.AddScalarReplAggregatesPass,
+	"strip-dead-prototypes": llvm.PassManager.AddStripDeadPrototypesPass,
+	"tailcallelim":          llvm.PassManager.AddTailCallEliminationPass,
+	"verify":                llvm.PassManager.AddVerifierPass,
+}
+
+// LLVMPassNames returns names of LLVM passes available in LLVMPassOptions.Pipeline in sorted order.
+func LLVMPassNames() []string {
+	names := make([]string, 0, len(llvmPasses))
+	for n := range llvmPasses {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newLLVMPipeline creates a pass manager which runs the passes in the comma-separated list.
+func newLLVMPipeline(pipeline string) (llvm.PassManager, error) {
+	pm := llvm.NewPassManager()
+	for _, name := range strings.Split(pipeline, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		add, ok := llvmPasses[name]
+		if !ok {
+			pm.Dispose()
+			return llvm.PassManager{}, locerr.Errorf("Unknown LLVM pass '%s'. Available passes: %s", name, strings.Join(LLVMPassNames(), ", "))
+		}
+		add(pm)
+	}
+	return pm, nil
+}
+
+var (
+	enableLoopVectorize sync.Once
+	enableSLPVectorize  sync.Once
+)
+
+// enableVectorizers enables vectorizers in pass manager builders created after this call.
+func (opts *LLVMPassOptions) enableVectorizers() {
+	if opts.LoopVectorize {
+		enableLoopVectorize.Do(func() {
+			llvm.ParseCommandLineOptions([]string{"gocaml", "-vectorize-loops"}, "")
+		})
+	}
+	if opts.SLPVectorize {
+		enableSLPVectorize.Do(func() {
+			llvm.ParseCommandLineOptions([]string{"gocaml", "-vectorize-slp"}, "")
+		})
+	}
+}
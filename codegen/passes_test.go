@@ -0,0 +1,52 @@
+package codegen
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLLVMPassNames(t *testing.T) {
+	names := LLVMPassNames()
+	if !sort.StringsAreSorted(names) {
+		t.Fatal("Pass names are not sorted:", names)
+	}
+	for _, want := range []string{"mem2reg", "instcombine", "gvn", "inline"} {
+		i := sort.SearchStrings(names, want)
+		if i == len(names) || names[i] != want {
+			t.Errorf("Pass '%s' is not available: %v", want, names)
+		}
+	}
+}
+
+func TestCustomLLVMPipeline(t *testing.T) {
+	e, err := testCreateEmitter("let rec f x = x + x in println_int (f 42)", OptimizeNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.LLVMPasses.Pipeline = "mem2reg, instcombine,inline,verify"
+	if err := e.RunOptimizationPasses(); err != nil {
+		t.Fatal(err)
+	}
+	ir := e.EmitLLVMIR()
+	if !strings.Contains(ir, "@__gocaml_main") {
+		t.Fatalf("Unexpected LLVM IR after custom pipeline: %s", ir)
+	}
+}
+
+func TestUnknownLLVMPass(t *testing.T) {
+	e, err := testCreateEmitter("println_int 42", OptimizeNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	e.LLVMPasses.Pipeline = "mem2reg,unknown-pass"
+	err = e.RunOptimizationPasses()
+	if err == nil {
+		t.Fatal("Unknown pass should cause an error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Unknown LLVM pass 'unknown-pass'") {
+		t.Fatal("Unexpected error:", msg)
+	}
+}
@@ -0,0 +1,145 @@
+package codegen
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+	"llvm.org/llvm/bindings/go/llvm"
+	"math"
+)
+
+// Note:
+// Instrumentation counts calls and branches of 'if' taken at runtime. Each site has a counter in
+// global array '__gocaml_profile_counters' and its name in global string '__gocaml_profile_sites'
+// separated by newlines. Sites at the same source position share one counter. The entry point
+// registers them to runtime with __gocaml_profile_init() and runtime writes the profile to a file at
+// exit. Please see mir.Profile for the format of the profile.
+//
+// When a profile is given, its counts of branches are attached to conditional branches as
+// 'branch_weights' metadata so that LLVM can lay out hot paths first.
+
+type profiler struct {
+	// Index of counter for each site
+	sites    map[string]int
+	names    bytes.Buffer
+	counters llvm.Value
+	initFun  llvm.Value
+}
+
+func (p *profiler) addSite(kind string, pos locerr.Pos) {
+	name := mir.ProfileSite(kind, pos)
+	if _, ok := p.sites[name]; ok {
+		return
+	}
+	p.sites[name] = len(p.sites)
+	p.names.WriteString(name)
+	p.names.WriteByte('\n')
+}
+
+func (p *profiler) collectSites(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.App:
+			p.addSite(mir.ProfileCall, i.Pos)
+		case *mir.If:
+			p.addSite(mir.ProfileThen, i.Pos)
+			p.addSite(mir.ProfileElse, i.Pos)
+			p.collectSites(v.Then)
+			p.collectSites(v.Else)
+		}
+	}
+}
+
+func newProfiler(prog *mir.Program) *profiler {
+	p := &profiler{sites: map[string]int{}}
+	for _, f := range prog.Toplevel {
+		p.collectSites(f.Val.Body)
+	}
+	p.collectSites(prog.Entry)
+	return p
+}
+
+// buildProfileGlobals defines counters and names of sites, and declares the runtime function to
+// register them.
+func (b *moduleBuilder) buildProfileGlobals() {
+	p := b.profiler
+	intT := b.typeBuilder.intT
+
+	countersT := llvm.ArrayType(intT, len(p.sites))
+	p.counters = llvm.AddGlobal(b.module, countersT, "__gocaml_profile_counters")
+	p.counters.SetInitializer(llvm.ConstNull(countersT))
+	p.counters.SetLinkage(llvm.PrivateLinkage)
+
+	t := llvm.FunctionType(b.context.VoidType(), []llvm.Type{b.typeBuilder.voidPtrT, llvm.PointerType(intT, 0), intT}, false /*varargs*/)
+	p.initFun = llvm.AddFunction(b.module, "__gocaml_profile_init", t)
+	p.initFun.SetLinkage(llvm.ExternalLinkage)
+	p.initFun.AddFunctionAttr(b.attributes["nounwind"])
+}
+
+// buildProfileInit registers counters to runtime at the beginning of the program.
+func (b *blockBuilder) buildProfileInit() {
+	p := b.profiler
+	names := b.builder.CreateGlobalStringPtr(p.names.String(), "__gocaml_profile_sites")
+	zero := llvm.ConstInt(b.context.Int32Type(), 0, false)
+	counters := llvm.ConstInBoundsGEP(p.counters, []llvm.Value{zero, zero})
+	size := llvm.ConstInt(b.typeBuilder.intT, uint64(len(p.sites)), false)
+	b.builder.CreateCall(p.initFun, []llvm.Value{names, counters, size}, "")
+}
+
+// countSite increments the counter of the site when instrumentation is enabled.
+func (b *blockBuilder) countSite(kind string, pos locerr.Pos) {
+	p := b.profiler
+	if p == nil {
+		return
+	}
+	idx, ok := p.sites[mir.ProfileSite(kind, pos)]
+	if !ok {
+		panic("FATAL: Site was not collected for instrumentation: " + mir.ProfileSite(kind, pos))
+	}
+	i32T := b.context.Int32Type()
+	ptr := llvm.ConstInBoundsGEP(p.counters, []llvm.Value{
+		llvm.ConstInt(i32T, 0, false),
+		llvm.ConstInt(i32T, uint64(idx), false),
+	})
+	count := b.builder.CreateLoad(ptr, "prof.count")
+	count = b.builder.CreateAdd(count, llvm.ConstInt(b.typeBuilder.intT, 1, false), "prof.inc")
+	b.builder.CreateStore(count, ptr)
+}
+
+// branchWeight scales the count into 32bit weight. Weight is never zero because LLVM regards a
+// branch with zero weight as unreachable.
+func branchWeight(count int64, scale int64) uint64 {
+	return uint64(count/scale + 1)
+}
+
+// buildCondBr builds the conditional branch of 'if' at the position. Branches are counted with
+// instrumentation and weighted with profile.
+func (b *blockBuilder) buildCondBr(cond llvm.Value, thenBlk, elseBlk llvm.BasicBlock, pos locerr.Pos) {
+	br := b.builder.CreateCondBr(cond, thenBlk, elseBlk)
+
+	if b.profile != nil {
+		t, tok := b.profile.Count(mir.ProfileThen, pos)
+		e, eok := b.profile.Count(mir.ProfileElse, pos)
+		if tok && eok {
+			max := t
+			if e > max {
+				max = e
+			}
+			scale := max/math.MaxUint32 + 1
+			i32T := b.context.Int32Type()
+			weights := b.context.MDNode([]llvm.Metadata{
+				b.context.MDString("branch_weights"),
+				llvm.ConstInt(i32T, branchWeight(t, scale), false).ConstantAsMetadata(),
+				llvm.ConstInt(i32T, branchWeight(e, scale), false).ConstantAsMetadata(),
+			})
+			br.SetMetadata(b.context.MDKindID("prof"), weights)
+		}
+	}
+
+	if b.profiler != nil {
+		b.builder.SetInsertPointAtEnd(thenBlk)
+		b.countSite(mir.ProfileThen, pos)
+		b.builder.SetInsertPointAtEnd(elseBlk)
+		b.countSite(mir.ProfileElse, pos)
+	}
+}
@@ -0,0 +1,67 @@
+package codegen
+
+import (
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Note:
+// With GCRefCount, the runtime counts references to each object from other objects. Generated code
+// calls 'gocaml_retain' for each heap pointer in a value stored to an object on GC heap (elements
+// of tuples and arrays, captures of closures and payloads of variants) and 'gocaml_release' for a
+// pointer overwritten by storing to an element of array. Objects in the runtime release their
+// pointers when they are freed.
+//
+// References from stack frames are not counted (deferred reference counting). They are tracked
+// with root slots in the same way as the built-in GC. An object whose count drops to zero is
+// recorded in a table of the runtime and is freed at a later allocation unless a root slot points
+// to it. Since the table is bounded, pauses are short and predictable. Cycles of objects are never
+// freed by counting. They are collected by the mark-sweep collector only when it is enabled with
+// $GOCAML_RC_CYCLES or 'do_garbage_collection' is called.
+//
+// Objects allocated on stack are not counted. Pointers stored to them are not retained since
+// nothing releases them. Heap pointers must not be undefined values since the runtime reads them.
+// Missing fields of values (e.g. 'None' of closure) are filled with null.
+
+func (b *moduleBuilder) buildRefCountDecls() {
+	t := llvm.FunctionType(b.context.VoidType(), []llvm.Type{b.typeBuilder.voidPtrT}, false /*varargs*/)
+	for _, name := range []string{"gocaml_retain", "gocaml_release"} {
+		v := llvm.AddFunction(b.module, name, t)
+		v.SetLinkage(llvm.ExternalLinkage)
+		v.AddFunctionAttr(b.attributes["nounwind"])
+		b.globalTable[name] = v
+	}
+}
+
+// buildRefCount calls the function for each heap pointer in the value when reference counting is
+// enabled.
+func (b *blockBuilder) buildRefCount(fun string, v llvm.Value) {
+	if b.gcKind != GCRefCount {
+		return
+	}
+	funVal, ok := b.globalTable[fun]
+	if !ok {
+		panic("FATAL: '" + fun + "' not found. Declarations for reference counting were not emitted")
+	}
+	for _, path := range heapPointerPaths(v.Type(), nil, nil) {
+		ptr := b.builder.CreateBitCast(b.extractPath(v, path), b.typeBuilder.voidPtrT, "")
+		b.builder.CreateCall(funVal, []llvm.Value{ptr}, "")
+	}
+}
+
+// buildRetain counts references to objects from the value which was stored to GC heap.
+func (b *blockBuilder) buildRetain(v llvm.Value) {
+	b.buildRefCount("gocaml_retain", v)
+}
+
+// buildRelease drops references to objects from the value which was removed from GC heap.
+func (b *blockBuilder) buildRelease(v llvm.Value) {
+	b.buildRefCount("gocaml_release", v)
+}
+
+// buildStoreToHeap stores the value to the object and retains it when the object is on GC heap.
+func (b *blockBuilder) buildStoreToHeap(v, ptr llvm.Value, onHeap bool) {
+	b.builder.CreateStore(v, ptr)
+	if onHeap {
+		b.buildRetain(v)
+	}
+}
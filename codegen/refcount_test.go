@@ -0,0 +1,67 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmitRefCount(t *testing.T) {
+	code := `
+	let rec f s = (s, [| s |]) in
+	let (s, a) = f "a" in
+	a.(0) <- str_concat s "!";
+	let o = if Array.length a > 0 then Some a else None in
+	match o with
+	| Some a -> println_str a.(0)
+	| None -> ()`
+
+	e, err := testCreateEmitterWithGC(code, GCRefCount, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	out := e.EmitLLVMIR()
+	for _, want := range []string{
+		"@__gocaml_gc = global i32 3",
+		`gc "shadow-stack"`,
+		"call void @llvm.gcroot(i8**",
+		"declare void @gocaml_retain(i8*)",
+		"declare void @gocaml_release(i8*)",
+		"call void @gocaml_retain(i8*",
+		"arrstore.old",
+		"call void @gocaml_release(i8*",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("'%s' was not found in LLVM IR: %s", want, out)
+		}
+	}
+	if _, err := e.EmitObject(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoRefCountWithOtherGC(t *testing.T) {
+	for _, gc := range []GCKind{GCBoehm, GCBuiltin, GCNone} {
+		e, err := testCreateEmitterWithGC(gcTestCode, gc, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := e.EmitLLVMIR()
+		e.Dispose()
+		for _, unwant := range []string{"gocaml_retain", "gocaml_release"} {
+			if strings.Contains(out, unwant) {
+				t.Errorf("'%s' was unexpectedly found in LLVM IR with %s: %s", unwant, gc, out)
+			}
+		}
+	}
+}
+
+func TestRefCountWithStackMaps(t *testing.T) {
+	_, err := testCreateEmitterWithGC("println_int 42", GCRefCount, true)
+	if err == nil {
+		t.Fatal("Reference counting with GC stack maps should cause an error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "GC stack maps cannot be emitted with reference counting") {
+		t.Fatal("Unexpected error:", msg)
+	}
+}
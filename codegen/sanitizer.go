@@ -0,0 +1,122 @@
+package codegen
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+	"llvm.org/llvm/bindings/go/llvm"
+	"strings"
+)
+
+// Note:
+// AddressSanitizer is implemented by LLVM's instrumentation passes. They only instrument functions
+// which have 'sanitize_address' attribute. The passes run after optimizations as clang does, so
+// checks which optimizations would remove are not inserted. The sanitizer runtime is linked by
+// clang's -fsanitize option. Objects allocated by GC are not tracked by AddressSanitizer. It finds
+// errors on stack-allocated objects, globals and memory accessed by C functions via interceptors.
+//
+// UndefinedBehaviorSanitizer is a feature of clang's frontend and LLVM has no pass for it. Instead,
+// operations whose results are undefined in LLVM IR are checked in generated code: integer
+// division and modulo by zero and division of the minimum integer by -1. Signed overflow of other
+// operations is not checked since integers wrap around in GoCaml (please see -checked-arith).
+// The sanitizer runtime is still linked so that external C functions compiled with
+// -fsanitize=undefined can be linked.
+
+var sanitizerNames = []string{"address", "undefined"}
+
+// sanitizers is a set of sanitizers enabled by EmitOptions.Sanitize.
+type sanitizers struct {
+	address   bool
+	undefined bool
+}
+
+// parseSanitizers parses a comma-separated list of sanitizers.
+func parseSanitizers(list string) (sanitizers, error) {
+	var s sanitizers
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "address":
+			s.address = true
+		case "undefined":
+			s.undefined = true
+		default:
+			return sanitizers{}, locerr.Errorf("Unknown sanitizer '%s'. Available sanitizers: %s", name, strings.Join(sanitizerNames, ", "))
+		}
+	}
+	return s, nil
+}
+
+func (s sanitizers) enabled() bool {
+	return s.address || s.undefined
+}
+
+// linkerFlag returns clang's flag to link the sanitizer runtimes.
+func (s sanitizers) linkerFlag() string {
+	names := make([]string, 0, len(sanitizerNames))
+	if s.address {
+		names = append(names, "address")
+	}
+	if s.undefined {
+		names = append(names, "undefined")
+	}
+	return "-fsanitize=" + strings.Join(names, ",")
+}
+
+// runSanitizerPasses runs instrumentation passes of the sanitizers.
+func (emitter *Emitter) runSanitizerPasses() {
+	// Sanitizers were validated when the emitter was created
+	san, _ := parseSanitizers(emitter.Sanitize)
+	if !san.address {
+		return
+	}
+	pm := llvm.NewPassManager()
+	defer pm.Dispose()
+	pm.AddAddressSanitizerFunctionPass()
+	pm.AddAddressSanitizerModulePass()
+	pm.Run(emitter.Module)
+}
+
+// buildCheckedDiv builds integer division or modulo which checks the operands when undefined
+// behavior sanitizer is enabled. On undefined behavior, runtime function reports the location and
+// aborts the program. It returns false for other operations.
+func (b *blockBuilder) buildCheckedDiv(val mir.Val, pos locerr.Pos) (llvm.Value, bool) {
+	if !b.sanitize.undefined {
+		return llvm.Value{}, false
+	}
+	bin, ok := val.(*mir.Binary)
+	if !ok || (bin.Op != mir.DIV && bin.Op != mir.MOD) {
+		return llvm.Value{}, false
+	}
+
+	lhs, rhs := b.resolve(bin.LHS), b.resolve(bin.RHS)
+	intT := b.typeBuilder.intT
+	zero := b.builder.CreateICmp(llvm.IntEQ, rhs, llvm.ConstInt(intT, 0, false /*signed*/), "divzero")
+	b.buildUndefinedCheck(zero, "division by zero", pos)
+
+	minInt := llvm.ConstInt(intT, 1<<63, false /*signed*/)
+	isMin := b.builder.CreateICmp(llvm.IntEQ, lhs, minInt, "")
+	isMinusOne := b.builder.CreateICmp(llvm.IntEQ, rhs, llvm.ConstAllOnes(intT), "")
+	overflow := b.builder.CreateAnd(isMin, isMinusOne, "divoverflow")
+	b.buildUndefinedCheck(overflow, "division overflow", pos)
+
+	if bin.Op == mir.DIV {
+		return b.builder.CreateSDiv(lhs, rhs, "div"), true
+	}
+	return b.builder.CreateSRem(lhs, rhs, "mod"), true
+}
+
+// buildUndefinedCheck reports the undefined behavior and aborts the program when the condition is
+// true.
+func (b *blockBuilder) buildUndefinedCheck(cond llvm.Value, what string, pos locerr.Pos) {
+	parent := b.builder.GetInsertBlock().Parent()
+	okBlk := llvm.AddBasicBlock(parent, "ubsan.ok")
+	failBlk := llvm.AddBasicBlock(parent, "ubsan.fail")
+	b.builder.CreateCondBr(cond, failBlk, okBlk)
+
+	b.builder.SetInsertPointAtEnd(failBlk)
+	b.buildExternalCall("__gocaml_undefined_fail", []llvm.Value{b.buildLocation(pos), b.buildVal("", &mir.String{what})})
+	b.builder.CreateUnreachable()
+
+	okBlk.MoveAfter(failBlk)
+	b.builder.SetInsertPointAtEnd(okBlk)
+}
@@ -0,0 +1,90 @@
+package codegen
+
+import (
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func testCreateEmitterWithSanitizers(code string, sanitize string) (*Emitter, error) {
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return nil, err
+	}
+	prog := closure.Transform(ir)
+	opts := EmitOptions{OptimizeNone, "", "", "", "", false, false, false, false, nil, false, false, sanitize, RelocDefault, GCBoehm}
+	return NewEmitter(prog, env, s, opts)
+}
+
+func TestParseSanitizers(t *testing.T) {
+	for list, want := range map[string]sanitizers{
+		"":                   sanitizers{},
+		"address":            sanitizers{true, false},
+		"undefined":          sanitizers{false, true},
+		"address, undefined": sanitizers{true, true},
+	} {
+		have, err := parseSanitizers(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("Wanted %v for '%s' but got %v", want, list, have)
+		}
+	}
+	if flag := (sanitizers{true, true}).linkerFlag(); flag != "-fsanitize=address,undefined" {
+		t.Errorf("Unexpected linker flag: %s", flag)
+	}
+}
+
+func TestUnknownSanitizer(t *testing.T) {
+	_, err := testCreateEmitterWithSanitizers("println_int 42", "address,memory")
+	if err == nil {
+		t.Fatal("Unknown sanitizer should cause an error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Unknown sanitizer 'memory'") {
+		t.Fatal("Unexpected error:", msg)
+	}
+}
+
+func TestEmitAddressSanitizer(t *testing.T) {
+	e, err := testCreateEmitterWithSanitizers("let t = (1, 2) in let (a, b) = t in println_int (a + b)", "address")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	if err := e.RunOptimizationPasses(); err != nil {
+		t.Fatal(err)
+	}
+	ir := e.EmitLLVMIR()
+	for _, want := range []string{"sanitize_address", "@asan.module_ctor"} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("'%s' was not found in LLVM IR: %s", want, ir)
+		}
+	}
+}
+
+func TestEmitUndefinedSanitizer(t *testing.T) {
+	code := "let x = str_to_int \"1\" in println_int (10 / x); println_int (10 % x); println_int (x + 1)"
+	for _, sanitize := range []string{"undefined", ""} {
+		e, err := testCreateEmitterWithSanitizers(code, sanitize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Dispose()
+		ir := e.EmitLLVMIR()
+		checked := sanitize != ""
+		for _, want := range []string{"call void @__gocaml_undefined_fail(", "division by zero", "division overflow"} {
+			if have := strings.Contains(ir, want); have != checked {
+				t.Errorf("'%s' was found: %v, but undefined behavior sanitizer is %v: %s", want, have, checked, ir)
+			}
+		}
+	}
+}
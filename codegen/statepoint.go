@@ -0,0 +1,230 @@
+package codegen
+
+import (
+	"fmt"
+	"llvm.org/llvm/bindings/go/llvm"
+	"strings"
+)
+
+// Note:
+// When GC stack maps are enabled, each call in generated code is wrapped in LLVM's statepoint
+// ('llvm.experimental.gc.statepoint') so that LLVM records where GC roots live at the return
+// address of the call. The records are emitted to '__LLVM_StackMaps' section of the object file.
+// Boehm GC still scans the stack conservatively. The stack maps are for a future precise or moving
+// collector.
+//
+// Heap pointers in GoCaml values (strings, arrays, tuples, closures, variants and options of them)
+// are spilled to root slots allocated in the entry block of the function. Every statepoint takes
+// all root slots of the function as its GC arguments, so stack maps describe the slots as stack
+// locations. Each use of a value reloads its pointers from the slots. A collector can update the
+// slots to move objects without LLVM's relocation (gc.relocate) of SSA values.
+//
+// Root slots are initialized with null and may hold a stale pointer of a value which is no longer
+// used. Roots may also point to objects outside GC heap such as string literals or objects allocated
+// on stack. A collector must ignore them.
+//
+// Calls of external functions which take or return aggregates via memory ('sret' or 'byval') are
+// not wrapped because a statepoint cannot pass parameter attributes to the callee. Calls in tail
+// position are not marked as tail calls since the frame must remain for the collector.
+
+// gcStrategy is the name of LLVM's GC strategy which lowers statepoints.
+const gcStrategy = "statepoint-example"
+
+// statepointID is an ID of statepoints recorded in stack maps. It is the same value as LLVM uses
+// by default.
+const statepointID = 0xABCDEF00
+
+// gcRoot is a root slot of a heap pointer in the value. path is indices of the pointer in the
+// aggregate value. It is empty when the value itself is a pointer.
+type gcRoot struct {
+	path []int
+	slot llvm.Value
+}
+
+// mangleIntrinsicType returns the suffix of an overloaded intrinsic name for the type.
+// It follows getMangledTypeStr() in llvm/lib/IR/Function.cpp.
+func mangleIntrinsicType(t llvm.Type) string {
+	switch t.TypeKind() {
+	case llvm.PointerTypeKind:
+		return fmt.Sprintf("p%d%s", t.PointerAddressSpace(), mangleIntrinsicType(t.ElementType()))
+	case llvm.ArrayTypeKind:
+		return fmt.Sprintf("a%d%s", t.ArrayLength(), mangleIntrinsicType(t.ElementType()))
+	case llvm.StructTypeKind:
+		if name := t.StructName(); name != "" {
+			return "s_" + name
+		}
+		elems := t.StructElementTypes()
+		ss := make([]string, 0, len(elems))
+		for _, e := range elems {
+			ss = append(ss, mangleIntrinsicType(e))
+		}
+		return "sl_" + strings.Join(ss, "") + "s"
+	case llvm.FunctionTypeKind:
+		params := t.ParamTypes()
+		ss := make([]string, 0, len(params))
+		for _, p := range params {
+			ss = append(ss, mangleIntrinsicType(p))
+		}
+		varargs := ""
+		if t.IsFunctionVarArg() {
+			varargs = "vararg"
+		}
+		return "f_" + mangleIntrinsicType(t.ReturnType()) + strings.Join(ss, "") + varargs + "f"
+	case llvm.IntegerTypeKind:
+		return fmt.Sprintf("i%d", t.IntTypeWidth())
+	case llvm.FloatTypeKind:
+		return "f32"
+	case llvm.DoubleTypeKind:
+		return "f64"
+	case llvm.VoidTypeKind:
+		return "isVoid"
+	default:
+		panic("FATAL: Cannot mangle type for intrinsic: " + t.String())
+	}
+}
+
+// heapPointerPaths collects paths to pointers in the type. Function pointers are not collected
+// because they never point to GC heap.
+func heapPointerPaths(t llvm.Type, path []int, paths [][]int) [][]int {
+	switch t.TypeKind() {
+	case llvm.PointerTypeKind:
+		if t.ElementType().TypeKind() == llvm.FunctionTypeKind {
+			return paths
+		}
+		return append(paths, append([]int{}, path...))
+	case llvm.StructTypeKind:
+		for i, elem := range t.StructElementTypes() {
+			paths = heapPointerPaths(elem, append(path, i), paths)
+		}
+		return paths
+	default:
+		return paths
+	}
+}
+
+func (b *moduleBuilder) declareIntrinsic(name string, t llvm.Type) llvm.Value {
+	if f := b.module.NamedFunction(name); f.C != nil {
+		return f
+	}
+	return llvm.AddFunction(b.module, name, t)
+}
+
+func (b *moduleBuilder) statepointDecl(funPtrTy llvm.Type) llvm.Value {
+	i32 := b.context.Int32Type()
+	i64 := b.context.Int64Type()
+	params := []llvm.Type{i64, i32, funPtrTy, i32, i32}
+	t := llvm.FunctionType(b.context.TokenType(), params, true /*varargs*/)
+	return b.declareIntrinsic("llvm.experimental.gc.statepoint."+mangleIntrinsicType(funPtrTy), t)
+}
+
+func (b *moduleBuilder) gcResultDecl(retTy llvm.Type) llvm.Value {
+	t := llvm.FunctionType(retTy, []llvm.Type{b.context.TokenType()}, false /*varargs*/)
+	return b.declareIntrinsic("llvm.experimental.gc.result."+mangleIntrinsicType(retTy), t)
+}
+
+// buildRootSlot allocates a slot for a GC root in the entry block and initializes it with null.
+func (b *blockBuilder) buildRootSlot(name string) llvm.Value {
+	saved := b.builder.GetInsertBlock()
+	b.builder.SetInsertPointAtEnd(b.allocaBlock)
+	slot := b.builder.CreateAlloca(b.typeBuilder.voidPtrT, name)
+	b.builder.CreateStore(llvm.ConstPointerNull(b.typeBuilder.voidPtrT), slot)
+	if b.gcKind.usesShadowStack() {
+		b.builder.CreateCall(b.gcRootDecl(), []llvm.Value{slot, llvm.ConstPointerNull(b.typeBuilder.voidPtrT)}, "")
+	}
+	b.builder.SetInsertPointAtEnd(saved)
+	b.rootSlots = append(b.rootSlots, slot)
+	return slot
+}
+
+func (b *blockBuilder) extractPath(v llvm.Value, path []int) llvm.Value {
+	for _, i := range path {
+		v = b.builder.CreateExtractValue(v, i, "")
+	}
+	return v
+}
+
+func (b *blockBuilder) insertPath(agg, v llvm.Value, path []int) llvm.Value {
+	if len(path) == 1 {
+		return b.builder.CreateInsertValue(agg, v, path[0], "")
+	}
+	inner := b.builder.CreateExtractValue(agg, path[0], "")
+	inner = b.insertPath(inner, v, path[1:])
+	return b.builder.CreateInsertValue(agg, inner, path[0], "")
+}
+
+// buildRoots spills heap pointers in the value bound to the identifier to root slots.
+func (b *blockBuilder) buildRoots(ident string, v llvm.Value) {
+	paths := heapPointerPaths(v.Type(), nil, nil)
+	if len(paths) == 0 {
+		return
+	}
+	roots := make([]gcRoot, 0, len(paths))
+	for _, path := range paths {
+		slot := b.buildRootSlot(ident + ".root")
+		ptr := b.builder.CreateBitCast(b.extractPath(v, path), b.typeBuilder.voidPtrT, "")
+		b.builder.CreateStore(ptr, slot)
+		roots = append(roots, gcRoot{path, slot})
+	}
+	b.roots[ident] = roots
+}
+
+// reloadRoots reloads heap pointers of the value from its root slots since collector may have
+// updated them.
+func (b *blockBuilder) reloadRoots(ident string, v llvm.Value) llvm.Value {
+	roots, ok := b.roots[ident]
+	if !ok {
+		return v
+	}
+	for _, root := range roots {
+		ptr := b.builder.CreateLoad(root.slot, ident+".reload")
+		if len(root.path) == 0 {
+			return b.builder.CreateBitCast(ptr, v.Type(), "")
+		}
+		ptr = b.builder.CreateBitCast(ptr, b.extractPath(v, root.path).Type(), "")
+		v = b.insertPath(v, ptr, root.path)
+	}
+	return v
+}
+
+// buildStatepoint calls the function via statepoint with all root slots of the function. It returns
+// the returned value of the call. Unit value is returned when the function returns void. Calling
+// convention of the statepoint is used for calling the function.
+func (b *blockBuilder) buildStatepoint(funVal llvm.Value, args []llvm.Value, cc llvm.CallConv) llvm.Value {
+	i32 := b.context.Int32Type()
+	i64 := b.context.Int64Type()
+	zero := llvm.ConstInt(i32, 0, false)
+
+	ops := make([]llvm.Value, 0, len(args)+len(b.rootSlots)+7)
+	ops = append(ops,
+		llvm.ConstInt(i64, statepointID, false),
+		zero, // The number of bytes to patch
+		funVal,
+		llvm.ConstInt(i32, uint64(len(args)), false),
+		zero, // Flags
+	)
+	ops = append(ops, args...)
+	ops = append(ops,
+		zero, // The number of transition arguments
+		zero, // The number of deoptimization arguments
+	)
+	ops = append(ops, b.rootSlots...)
+	token := b.builder.CreateCall(b.statepointDecl(funVal.Type()), ops, "statepoint")
+	token.SetInstructionCallConv(cc)
+
+	retTy := funVal.Type().ElementType().ReturnType()
+	if retTy.TypeKind() == llvm.VoidTypeKind {
+		return b.unitVal
+	}
+	return b.builder.CreateCall(b.gcResultDecl(retTy), []llvm.Value{token}, "")
+}
+
+// buildCall calls the function with the calling convention. The call is wrapped in a statepoint
+// when GC stack maps are enabled.
+func (b *blockBuilder) buildCall(funVal llvm.Value, args []llvm.Value, cc llvm.CallConv) llvm.Value {
+	if b.gcStackMaps {
+		return b.buildStatepoint(funVal, args, cc)
+	}
+	call := b.builder.CreateCall(funVal, args, "")
+	call.SetInstructionCallConv(cc)
+	return call
+}
@@ -0,0 +1,79 @@
+package codegen
+
+import (
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"llvm.org/llvm/bindings/go/llvm"
+	"strings"
+	"testing"
+)
+
+func TestMangleIntrinsicType(t *testing.T) {
+	ctx := llvm.NewContext()
+	defer ctx.Dispose()
+	i8Ptr := llvm.PointerType(ctx.Int8Type(), 0)
+	named := ctx.StructCreateNamed("gocaml.string")
+	named.StructSetBody([]llvm.Type{i8Ptr, ctx.Int64Type()}, false)
+
+	for _, tc := range []struct {
+		ty   llvm.Type
+		want string
+	}{
+		{ctx.Int64Type(), "i64"},
+		{ctx.DoubleType(), "f64"},
+		{i8Ptr, "p0i8"},
+		{llvm.ArrayType(ctx.Int64Type(), 2), "a2i64"},
+		{ctx.StructType([]llvm.Type{i8Ptr, ctx.Int64Type()}, false), "sl_p0i8i64s"},
+		{named, "s_gocaml.string"},
+		{llvm.PointerType(llvm.FunctionType(ctx.VoidType(), nil, false), 0), "p0f_isVoidf"},
+		{llvm.PointerType(llvm.FunctionType(i8Ptr, []llvm.Type{ctx.Int64Type()}, false), 0), "p0f_p0i8i64f"},
+	} {
+		if have := mangleIntrinsicType(tc.ty); have != tc.want {
+			t.Errorf("Wanted '%s' but got '%s' for type %s", tc.want, have, tc.ty.String())
+		}
+	}
+}
+
+func TestEmitGCStackMaps(t *testing.T) {
+	code := `
+	let rec f s = str_concat s "!" in
+	let t = (f "a", [| 1; 2 |]) in
+	let (s, a) = t in
+	println_str s;
+	println_int (Array.length a)`
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+	opts := EmitOptions{OptimizeNone, "", "", "", "", false, false, false, false, nil, true, false, "", RelocDefault, GCBoehm}
+	e, err := NewEmitter(prog, env, s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Dispose()
+	out := e.EmitLLVMIR()
+	for _, want := range []string{
+		`gc "statepoint-example"`,
+		"@llvm.experimental.gc.statepoint.",
+		"@llvm.experimental.gc.result.",
+		".root = alloca i8*",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("'%s' was not found in LLVM IR: %s", want, out)
+		}
+	}
+	if strings.Contains(out, "tail call") {
+		t.Errorf("Statepoint must not be a tail call: %s", out)
+	}
+	if _, err := e.EmitObject(); err != nil {
+		t.Fatal(err)
+	}
+}
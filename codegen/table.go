@@ -0,0 +1,113 @@
+package codegen
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+// Note:
+// Tables are opaque pointers to hash tables of the runtime (please see runtime/gocamlrt.c). Since
+// values of any type can be stored, a value is passed to the runtime via a stack slot and the
+// runtime copies it as bytes following the layout of its type. The layout is the same one passed to
+// 'gocaml_alloc'. The runtime retains and releases heap pointers in keys and values by itself with
+// reference counting. Keys are int or string and the runtime has functions for each kind of key.
+// String keys are also passed via stack slots so that calls do not depend on how the C ABI of the
+// target passes structs.
+
+func (b *moduleBuilder) buildTableDecls() {
+	voidPtrT := b.typeBuilder.voidPtrT
+	intT := b.typeBuilder.intT
+	strPtrT := llvm.PointerType(b.typeBuilder.stringT, 0 /*address space*/)
+	layoutPtrT := llvm.PointerType(b.layoutT, 0 /*address space*/)
+	boolT := b.context.Int32Type() // gocaml_bool is C's int
+	voidT := b.context.VoidType()
+
+	decls := []struct {
+		name   string
+		ret    llvm.Type
+		params []llvm.Type
+	}{
+		{"__gocaml_table_create", voidPtrT, []llvm.Type{layoutPtrT}},
+		{"__gocaml_table_find_int", boolT, []llvm.Type{voidPtrT, intT, voidPtrT}},
+		{"__gocaml_table_find_str", boolT, []llvm.Type{voidPtrT, strPtrT, voidPtrT}},
+		{"__gocaml_table_set_int", voidT, []llvm.Type{voidPtrT, intT, voidPtrT}},
+		{"__gocaml_table_set_str", voidT, []llvm.Type{voidPtrT, strPtrT, voidPtrT}},
+		{"__gocaml_table_remove_int", voidT, []llvm.Type{voidPtrT, intT}},
+		{"__gocaml_table_remove_str", voidT, []llvm.Type{voidPtrT, strPtrT}},
+	}
+	for _, d := range decls {
+		v := llvm.AddFunction(b.module, d.name, llvm.FunctionType(d.ret, d.params, false /*varargs*/))
+		v.SetLinkage(llvm.ExternalLinkage)
+		v.AddFunctionAttr(b.attributes["nounwind"])
+		b.globalTable[d.name] = v
+	}
+}
+
+func (b *blockBuilder) tableFun(name string) llvm.Value {
+	v, ok := b.globalTable[name]
+	if !ok {
+		panic("FATAL: '" + name + "' not found. Declarations for tables were not emitted")
+	}
+	return v
+}
+
+// tableCall returns the runtime function of the operation for the key type of the table and the
+// key argument passed to it.
+func (b *blockBuilder) tableCall(op, table, key string) (llvm.Value, llvm.Value) {
+	ty, ok := b.typeOf(table).(*types.Table)
+	if !ok {
+		panic("Type of table operand is not a table type: " + b.typeOf(table).String())
+	}
+	keyVal := b.resolve(key)
+	if _, ok := ty.Key.(*types.String); !ok {
+		return b.tableFun("__gocaml_table_" + op + "_int"), keyVal
+	}
+	slot := b.buildAlloca(b.typeBuilder.stringT, "tbl.key")
+	b.builder.CreateStore(keyVal, slot)
+	return b.tableFun("__gocaml_table_" + op + "_str"), slot
+}
+
+func (b *blockBuilder) buildTableCreate(ident string) llvm.Value {
+	ty, ok := b.typeOf(ident).(*types.Table)
+	if !ok {
+		panic("Type of table instruction is not a table type: " + b.typeOf(ident).String())
+	}
+	layout := b.gcLayout(b.typeBuilder.fromMIR(ty.Value))
+	return b.buildCall(b.tableFun("__gocaml_table_create"), []llvm.Value{layout}, llvm.CCallConv)
+}
+
+// buildTableFind makes an option value from the flag returned from the runtime and the value
+// which the runtime wrote to the slot.
+func (b *blockBuilder) buildTableFind(ident string, val *mir.TblLoad) llvm.Value {
+	ty, ok := b.typeOf(ident).(*types.Option)
+	if !ok {
+		panic("Type of tblload is not an option type: " + b.typeOf(ident).String())
+	}
+	fun, key := b.tableCall("find", val.From, val.Key)
+	elemTy := b.typeBuilder.fromMIR(ty.Elem)
+	slot := b.buildAlloca(elemTy, "tbl.value")
+	// Heap pointers must not be undefined values even if the key is not found
+	b.builder.CreateStore(llvm.ConstNull(elemTy), slot)
+	ptr := b.builder.CreateBitCast(slot, b.typeBuilder.voidPtrT, "")
+	found := b.buildCall(fun, []llvm.Value{b.resolve(val.From), key, ptr}, llvm.CCallConv)
+	found = b.builder.CreateICmp(llvm.IntNE, found, llvm.ConstInt(found.Type(), 0, false /*signed*/), "tbl.found")
+	some := b.buildSome(ty, b.builder.CreateLoad(slot, ""))
+	return b.builder.CreateSelect(found, some, b.buildNone(ty), "tblload")
+}
+
+func (b *blockBuilder) buildTableSet(val *mir.TblStore) llvm.Value {
+	fun, key := b.tableCall("set", val.To, val.Key)
+	rhsVal := b.resolve(val.RHS)
+	slot := b.buildAlloca(rhsVal.Type(), "tbl.value")
+	b.builder.CreateStore(rhsVal, slot)
+	ptr := b.builder.CreateBitCast(slot, b.typeBuilder.voidPtrT, "")
+	b.buildCall(fun, []llvm.Value{b.resolve(val.To), key, ptr}, llvm.CCallConv)
+	return b.unitVal
+}
+
+func (b *blockBuilder) buildTableRemove(val *mir.TblRemove) llvm.Value {
+	fun, key := b.tableCall("remove", val.From, val.Key)
+	b.buildCall(fun, []llvm.Value{b.resolve(val.From), key}, llvm.CCallConv)
+	return b.unitVal
+}
@@ -0,0 +1,52 @@
+let b = Buffer.create () in
+println_int (Buffer.length b);
+println_str (str_concat "[" (str_concat (Buffer.contents b) "]"));
+Buffer.add_string b "Hello";
+Buffer.add_char b 44;
+Buffer.add_char b 32;
+Buffer.add_string b "world";
+Buffer.add_string b "";
+Buffer.add_char b (to_char_code "!");
+let s = Buffer.contents b in
+println_str s;
+println_int (Buffer.length b);
+
+(* Contents returned before are not modified by later additions *)
+Buffer.add_string b " again";
+println_str s;
+println_str (Buffer.contents b);
+
+(* Only the lowest 8 bits of a character code are added *)
+let c = Buffer.create () in
+Buffer.add_char c (65 + 256);
+println_str (Buffer.contents c);
+
+(* Build a long string *)
+let rec fill buf i n =
+  if i < n then (
+    Buffer.add_string buf (int_to_str (i % 10));
+    fill buf (i + 1) n
+  ) else ()
+in
+let long = Buffer.create () in
+fill long 0 2000;
+let t = Buffer.contents long in
+println_int (str_length t);
+println_str (str_sub t 1995 2000);
+
+(* Buffers are shared by references *)
+let rec add_twice (x : buffer) str = Buffer.add_string x str; Buffer.add_string x str in
+let d = Buffer.create () in
+let bufs = [| d; d |] in
+add_twice bufs.(0) "ab";
+Buffer.add_string bufs.(1) "c";
+println_str (Buffer.contents d);
+
+(* Options and tuples of buffers *)
+let o = Some (Buffer.create ()) in
+match o with
+| Some x -> Buffer.add_string x "in option"; println_str (Buffer.contents x)
+| None -> ();
+let (p, n) = (Buffer.create (), 3) in
+Buffer.add_string p (int_to_str n);
+println_str (Buffer.contents p)
@@ -0,0 +1,8 @@
+let start = monotonic_ns () in
+let cpu = clock () in
+let rec loop i acc = if i = 0 then acc else loop (i - 1) (acc + i) in
+println_int (loop 1000 0);
+println_bool (monotonic_ns () >= start);
+println_bool (clock () >= cpu);
+println_bool (cpu >= 0.0);
+println_bool (time_now () > 0)
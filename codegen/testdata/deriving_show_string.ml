@@ -0,0 +1,6 @@
+type s = string [@@deriving show];
+type t = (string * string option) array [@@deriving show];
+println_str (show_s "plain");
+println_str (show_s "quote \" and backslash \\");
+println_str (show_s "tab\tnewline\nbell\007del\x7f");
+print_str (show_t [| ("a\"b", Some "c\\d"); ("", None) |])
@@ -8,3 +8,22 @@ let b = write_file "testdata/piyo.txt" "this is test for write_file()" in
 if not b then println_str "failed to write!" else
 let f = read_file "testdata/piyo.txt" in
 println_str (match f with Some c -> c | None -> "failed to open file")
+;
+
+let h = open_out "testdata/piyo.txt" in
+let _ = output_string h "first line\n" in
+let _ = output_string h "second line" in
+println_bool (close_file h);
+println_bool (close_file h);
+let h = open_append "testdata/piyo.txt" in
+let _ = output_string h "\nthird line\n" in
+let _ = close_file h in
+let h = open_in "testdata/piyo.txt" in
+println_str (match input_line h with Some l -> l | None -> "EOF");
+println_bool (output_string h "read only");
+print_str (input_all h);
+println_str (match input_line h with Some l -> l | None -> "EOF");
+let _ = close_file h in
+println_int (open_in "unknown_file");
+println_bool (close_file 1);
+println_bool (output_string 1 "to stdout")
@@ -0,0 +1,13 @@
+let nan = 0.0 /. 0.0 in
+let rec div x y = x /. y in
+let n = div 0.0 0.0 in
+println_bool (nan = nan);
+println_bool (nan <> nan);
+println_bool (n = n);
+println_bool (n <> n);
+println_bool (n <> 1.0);
+println_bool (1.0 <> n);
+println_bool (n < 1.0);
+println_bool (n >= 1.0);
+println_bool (1.0 <> 2.0);
+print_bool (1.0 <> 1.0)
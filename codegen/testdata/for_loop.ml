@@ -0,0 +1,40 @@
+let max = 9223372036854775807 in
+let min = -9223372036854775807 - 1 in
+
+(* Counter never overflows at the bound *)
+for i = max - 2 to max do
+  println_int (max - i)
+done;
+for i = min + 2 downto min do
+  println_int (i - min)
+done;
+
+(* 'break' and 'continue' at non-tail positions *)
+let sum = Array.make 1 0 in
+for i = 1 to 100 do
+  if i % 2 = 0 then continue else ();
+  if i > 9 then break else ();
+  sum.(0) <- sum.(0) + i
+done;
+println_int sum.(0);
+
+for i = 3 downto 0 do
+  let x = if i = 1 then continue else i * 10 in
+  println_int (x + (if i = 2 then break else 1))
+done;
+
+(* Jumps are bound to the innermost loop *)
+for i = 0 to 2 do
+  for j = 0 to 2 do
+    if j > i then break else ();
+    print_int (i * 10 + j);
+    print_str " "
+  done;
+  println_str ""
+done;
+
+(* 'break' in the last iteration and 'continue' up to max_int *)
+for i = max - 1 to max do
+  if i = max then (println_str "last"; break) else ();
+  continue
+done
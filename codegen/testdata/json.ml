@@ -0,0 +1,143 @@
+(* Build a value and encode it *)
+let v = Json.of_object [|
+  ("name", Json.of_string "gocaml");
+  ("version", Json.of_int 42);
+  ("ratio", Json.of_float 0.5);
+  ("tags", Json.of_array [| Json.of_string "ml"; Json.null (); Json.of_bool true |]);
+  ("nested", Json.of_object [| ("empty", Json.of_array [||]) |])
+|] in
+println_str (Json.encode v);
+
+(* Strings are escaped *)
+println_str (Json.encode (Json.of_string "quote \" backslash \\ tab \t newline \n"));
+println_str (Json.encode (Json.of_string (from_char_code 1)));
+
+(* Floats are encoded with the fewest digits and keep their kind *)
+let rec print_float_json f = println_str (Json.encode (Json.of_float f)) in
+print_float_json 1.0;
+print_float_json 0.1;
+print_float_json (-.2.5);
+print_float_json 1e100;
+print_float_json 123456789.0;
+print_float_json (1.0 /. 3.0);
+print_float_json infinity;
+print_float_json nan;
+
+(* Walk a decoded value *)
+let rec show j =
+  let kind = Json.kind j in
+  if kind = "array" || kind = "object" then (
+    let rec loop i =
+      match Json.get j i with
+      | Some e ->
+        if kind = "object" then (
+          match Json.key j i with
+          | Some k -> print_str (str_concat k "=")
+          | None -> ()
+        ) else ();
+        show e;
+        loop (i + 1)
+      | None -> ()
+    in
+    print_str (str_concat kind "(");
+    loop 0;
+    print_str ")"
+  ) else (
+    print_str (Json.encode j);
+    print_str ":";
+    print_str kind;
+    print_str " "
+  )
+in
+let src = "  {\"a\": [1, -2, 3.5, 1e3, true, false, null], \"b\": {\"c\": \"d\\u00e9\\ud83d\\ude00\"}, \"a\": 0}  " in
+(match Json.decode src with
+ | Some j ->
+   show j;
+   println_str "";
+   println_int (Json.length j);
+   (* Member returns the last field with the key *)
+   (match Json.member j "a" with
+    | Some a -> println_int (Json.to_int a)
+    | None -> println_str "not found");
+   (match Json.member j "z" with
+    | Some _ -> println_str "found"
+    | None -> println_str "not found");
+   (match Json.member j "b" with
+    | Some b ->
+      (match Json.member b "c" with
+       | Some c ->
+         let s = Json.to_string c in
+         println_int (str_length s);
+         println_str (Json.encode c)
+       | None -> ())
+    | None -> ());
+   println_str (Json.encode j)
+ | None -> println_str "failed");
+
+(* Accessors of scalar values *)
+(match Json.decode "[true, 7, 2.25, 3, \"s\"]" with
+ | Some j ->
+   let rec at i = match Json.get j i with Some e -> e | None -> Json.null () in
+   println_bool (Json.to_bool (at 0));
+   println_int (Json.to_int (at 1));
+   println_float (Json.to_float (at 2));
+   println_float (Json.to_float (at 3));
+   println_str (Json.to_string (at 4));
+   println_str (Json.kind (at 5))
+ | None -> println_str "failed");
+
+(* Integers which do not fit in int are decoded as floats *)
+let rec kind_of s =
+  match Json.decode s with
+  | Some j -> println_str (str_concat (Json.kind j) (str_concat " " (Json.encode j)))
+  | None -> println_str (str_concat "invalid " s)
+in
+kind_of "9223372036854775807";
+kind_of "-9223372036854775808";
+kind_of "9223372036854775808";
+kind_of "-0";
+kind_of "-0.0";
+kind_of "1E+2";
+kind_of "\"x\\/x\\bx\\fx\\rx\"";
+
+(* Invalid inputs *)
+kind_of "";
+kind_of "  ";
+kind_of "[1, 2";
+kind_of "[1, 2,]";
+kind_of "{\"a\" 1}";
+kind_of "{1: 2}";
+kind_of "01";
+kind_of "1.";
+kind_of ".5";
+kind_of "+1";
+kind_of "tru";
+kind_of "nulls";
+kind_of "[] []";
+kind_of "\"unterminated";
+kind_of "\"bad escape \\x\"";
+kind_of "\"lone surrogate \\ud800\"";
+kind_of "\"tab\tin string\"";
+
+(* Nesting is limited *)
+let rec nest n =
+  if n = 0 then "0" else str_concat "[" (str_concat (nest (n - 1)) "]")
+in
+(match Json.decode (nest 512) with
+ | Some _ -> println_str "512 ok"
+ | None -> println_str "512 failed");
+(match Json.decode (nest 513) with
+ | Some _ -> println_str "513 ok"
+ | None -> println_str "513 failed");
+
+(* Values are copied from arrays *)
+let elems = [| Json.of_int 1; Json.of_int 2 |] in
+let a = Json.of_array elems in
+elems.(0) <- Json.of_int 100;
+println_str (Json.encode a);
+
+(* Round trip *)
+let text = Json.encode v in
+match Json.decode text with
+| Some w -> println_bool (Json.encode w = text)
+| None -> println_str "failed"
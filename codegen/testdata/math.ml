@@ -0,0 +1,17 @@
+println_float (sqrt 16.0);
+println_float (sin 0.0);
+println_float (cos 0.0);
+println_float (atan 0.0);
+println_float (exp 0.0);
+println_float (log 1.0);
+println_float (floor (-.1.5));
+println_float (abs_float (-.2.5));
+println_float (abs_float 2.5);
+println_float (fmin 1.5 (-.1.5));
+println_float (fmax 1.5 (-.1.5));
+println_float (fmin nan 1.0);
+println_float (fmax 2.0 nan);
+println_int (min 3 (-4));
+println_int (max 3 (-4));
+let f = max in
+println_int (f 10 20)
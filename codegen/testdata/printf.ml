@@ -0,0 +1,7 @@
+printf "hello\n";
+printf "%d + %d = %d\n" 1 2 (1 + 2);
+printf "%s is %b%%\n" "this" true;
+let f = 3.14 in
+printf "pi is about %f\n" f;
+printf "%s%s" "foo" "bar";
+printf "\n"
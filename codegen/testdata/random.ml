@@ -0,0 +1,24 @@
+let rec show n =
+  if n > 0 then (print_int (random_int 100); print_str " "; show (n - 1)) else ()
+in
+show 5; println_str "";
+println_float (random_float ());
+random_seed 42;
+show 5; println_str "";
+random_seed 42;
+show 5; println_str "";
+println_int (random_int 9223372036854775807);
+println_int (random_int 0);
+println_int (random_int (-3));
+let rec in_range n =
+  if n = 0 then true else
+  let f = random_float () in
+  if 0.0 <= f && f < 1.0 then in_range (n - 1) else false
+in
+println_bool (in_range 1000);
+let rec within n =
+  if n = 0 then true else
+  let i = random_int 7 in
+  if 0 <= i && i < 7 then within (n - 1) else false
+in
+println_bool (within 1000)
@@ -0,0 +1,41 @@
+let rec show_find p s =
+  match Re.find p s with
+  | Some m -> println_str (str_concat "found: " m)
+  | None -> println_str "not found"
+in
+
+(* Re.match checks the whole string *)
+println_bool (Re.match "a*b" "aaab");
+println_bool (Re.match "a*b" "aaabc");
+println_bool (Re.match "" "");
+println_bool (Re.match "a|ab" "ab");
+println_bool (Re.match "(a|b)+c?" "abba");
+println_bool (Re.match "^\\d+$" "123");
+println_bool (Re.match "\\d+" "12a");
+println_bool (Re.match "[^a-c]x" "dx");
+println_bool (Re.match "[a-c]x" "dx");
+
+(* Re.find returns the leftmost match *)
+show_find "b+" "aabbbcc";
+show_find "a|ab" "xab";
+show_find "x*" "abc";
+show_find "(ab)*c" "ababc!";
+show_find "z" "abc";
+show_find "\\w+@\\w+\\.com" "mail: foo@bar.com!";
+show_find "[0-9]+" "no digits";
+show_find "c$" "abcc";
+show_find "(a*)*b" "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaac";
+show_find "[]a]+" "x]a]y";
+show_find "[a\\-z]+" "b-az";
+show_find "\\." "a.b";
+show_find ".+" "ab\ncd";
+show_find "\\s\\S" "a  b";
+
+(* Re.replace replaces all matches *)
+println_str (Re.replace "o" "0" "foo boo");
+println_str (Re.replace "x*" "-" "abc");
+println_str (Re.replace "\\s+" " " "a  b\t\tc");
+println_str (Re.replace "^" ">" "abc");
+println_str (Re.replace "$" "<" "abc");
+println_str (Re.replace "a|b" "" "abcab");
+println_str (Re.replace "[aeiou]" "" "regular expression")
@@ -0,0 +1,22 @@
+let s = "Hello, world" in
+println_int (String.length s);
+println_str (String.sub s 7 12);
+println_int (String.index s "world");
+println_int (String.index s "o");
+println_int (String.index s "foo");
+println_int (String.index s "");
+println_str (String.uppercase s);
+println_str (String.lowercase s);
+
+let words = String.split "foo,bar,,baz" "," in
+println_int (Array.length words);
+println_str words.(1);
+println_str (String.join words "|");
+println_int (Array.length (String.split "" ","));
+println_str (String.join (String.split "abc" "") "-");
+println_str (String.join [| |] ", ");
+println_str (String.join (String.split "a--b--c" "--") "+");
+
+let n = String.to_int "42" in
+println_str (String.of_int (n * 2));
+println_int (String.to_int (String.of_int (-7)) + 1)
@@ -0,0 +1,10 @@
+let s = "a\000b" in
+println_int (str_length s);
+println_bool (s = "a\000c");
+println_bool (s = "a\000b");
+let t = str_concat s "cd" in
+println_int (str_length t);
+println_str (str_sub t 2 5);
+println_int (str_length (str_concat "ab" "c"));
+println_int (str_to_int (str_sub "x42y" 1 3));
+println_float (str_to_float (str_sub "1.5x" 0 3))
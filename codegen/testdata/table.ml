@@ -0,0 +1,76 @@
+(* int keys *)
+let t = Table.create () in
+let rec show_int o = match o with Some i -> println_int i | None -> println_str "none" in
+Table.set t 1 10;
+Table.set t 2 20;
+show_int (Table.find t 1);
+show_int (Table.find t 2);
+show_int (Table.find t 3);
+Table.set t 1 100;
+show_int (Table.find t 1);
+Table.remove t 1;
+show_int (Table.find t 1);
+Table.remove t 42;
+Table.set t 1 1000;
+show_int (Table.find t 1);
+Table.set t (-5) 5;
+show_int (Table.find t (-5));
+
+(* string keys *)
+let s = Table.create () in
+let rec show_str o = match o with Some s -> println_str s | None -> println_str "none" in
+Table.set s "foo" "FOO";
+Table.set s "bar" "BAR";
+Table.set s "" "EMPTY";
+show_str (Table.find s "foo");
+show_str (Table.find s (str_sub "xbarx" 1 4));
+show_str (Table.find s "");
+show_str (Table.find s "baz");
+Table.remove s "foo";
+show_str (Table.find s "foo");
+show_str (Table.find s "bar");
+
+(* many entries *)
+let rec fill n = if n < 1000 then (Table.set t n (n * n); fill (n + 1)) else () in
+fill 0;
+let rec sum n acc = if n < 1000 then match Table.find t n with Some i -> sum (n + 1) (acc + i) | None -> acc else acc in
+println_int (sum 0 0);
+let rec drop n = if n < 1000 then (if n % 2 = 0 then Table.remove t n else (); drop (n + 1)) else () in
+drop 0;
+let rec count n acc = if n < 1000 then match Table.find t n with Some _ -> count (n + 1) (acc + 1) | None -> count (n + 1) acc else acc in
+println_int (count 0 0);
+let names = Table.create () in
+let rec fill_str n = if n < 1000 then (Table.set names (int_to_str n) n; fill_str (n + 1)) else () in
+fill_str 0;
+match Table.find names "777" with Some i -> println_int i | None -> println_str "none";
+
+(* values of any type *)
+let u = Table.create () in
+Table.set u "pair" (1, "one");
+Table.set u "none" (0, "");
+(match Table.find u "pair" with Some p -> let (i, n) = p in print_int i; println_str n | None -> println_str "none");
+let f = Table.create () in
+let a = 3 in
+Table.set f 0 (fun x -> x + a);
+Table.set f 1 (fun x -> x * a);
+(match Table.find f 1 with Some g -> println_int (g 7) | None -> println_str "none");
+let n = Table.create () in
+Table.set n 0 (Some 3.14);
+Table.set n 1 None;
+let rec show_opt o = match o with Some x -> println_float x | None -> println_str "stored none" in
+(match Table.find n 0 with Some o -> show_opt o | None -> println_str "none");
+(match Table.find n 1 with Some o -> show_opt o | None -> println_str "none");
+let b = Table.create () in
+Table.set b "yes" true;
+Table.set b "no" false;
+(match Table.find b "no" with Some x -> println_bool x | None -> println_str "none");
+let seen = Table.create () in
+Table.set seen 3 ();
+(match Table.find seen 3 with Some _ -> println_str "seen" | None -> println_str "not seen");
+let nested = Table.create () in
+let inner = Table.create () in
+Table.set nested "inner" inner;
+Table.set inner 7 [| 1; 2; 3 |];
+match Table.find nested "inner" with
+  | Some i -> (match Table.find i 7 with Some arr -> println_int arr.(2) | None -> println_str "none")
+  | None -> println_str "none"
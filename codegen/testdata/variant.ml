@@ -0,0 +1,35 @@
+let rec name v =
+  match v with
+  | `Red -> "red"
+  | `Green -> "green"
+  | `Rgb code -> str_concat "rgb:" (int_to_str code)
+in
+println_str (name `Red);
+println_str (name `Green);
+println_str (name (`Rgb 42));
+
+let rec is_zero v =
+  match v with
+  | `Zero -> true
+  | other -> false
+in
+println_bool (is_zero `Zero);
+println_bool (is_zero (`Succ 3));
+
+let rec sum v =
+  match v with
+  | `Double i -> i * 2
+  | `Single i -> i
+  | `Nothing -> 0
+in
+println_int (sum (`Double 21));
+println_int (sum (`Single 10));
+println_int (sum `Nothing);
+
+let rec unwrap v =
+  match v with
+  | `Some x -> (match x with `Str s -> s)
+  | `None -> "none"
+in
+println_str (unwrap (`Some (`Str "nested")));
+println_str (unwrap `None)
@@ -70,6 +70,27 @@ func (b *typeBuilder) buildClosureCaptures(name string, closure []string) llvm.T
 	return captures
 }
 
+func (b *typeBuilder) buildLinkedClosureCaptures(name string, own []string) llvm.Type {
+	if cached, ok := b.captures[name]; ok {
+		return cached
+	}
+
+	// First field is a pointer to the environment of the enclosing closure
+	fields := make([]llvm.Type, 0, len(own)+1)
+	fields = append(fields, b.voidPtrT)
+	for _, capture := range own {
+		t, ok := b.env.DeclTable[capture]
+		if !ok {
+			panic(fmt.Sprintf("Type of capture '%s' not found!", capture))
+		}
+		fields = append(fields, b.fromMIR(t))
+	}
+
+	captures := b.context.StructType(fields, false /*packed*/)
+	b.captures[name] = captures
+	return captures
+}
+
 func (b *typeBuilder) buildExternalFun(from *types.Fun) llvm.Type {
 	ret := b.fromMIR(from.Ret)
 	if ret == b.unitT {
@@ -129,7 +150,7 @@ func (b *typeBuilder) buildOption(ty *types.Option) llvm.Type {
 		return b.optBoolT
 	case *types.Float:
 		return b.optFloatT
-	case *types.String, *types.Fun, *types.Tuple, *types.Array:
+	case *types.String, *types.Fun, *types.Tuple, *types.Array, *types.Table, *types.Buffer, *types.Json:
 		// Represents 'None' value with NULL pointer
 		return b.fromMIR(elem)
 	case *types.Option:
@@ -138,6 +159,12 @@ func (b *typeBuilder) buildOption(ty *types.Option) llvm.Type {
 			b.buildOption(elem),
 		}
 		return b.context.StructType(elems, false /*packed*/)
+	case *types.Variant, *types.Result:
+		elems := []llvm.Type{
+			b.boolT,
+			b.fromMIR(elem),
+		}
+		return b.context.StructType(elems, false /*packed*/)
 	case *types.Unit:
 		elems := []llvm.Type{
 			b.boolT,
@@ -180,6 +207,13 @@ func (b *typeBuilder) fromMIR(from types.Type) llvm.Type {
 		}, false /*packed*/)
 	case *types.Option:
 		return b.buildOption(ty)
+	case *types.Table, *types.Buffer, *types.Json:
+		// Opaque pointer to hash table, buffer or JSON value of runtime
+		return b.voidPtrT
+	case *types.Variant, *types.Result:
+		// Tag hash and boxed payload. Payload is NULL when the tag has no payload.
+		// Result value is a variant tagged with `Ok or `Error.
+		return b.context.StructType([]llvm.Type{b.intT, b.voidPtrT}, false /*packed*/)
 	case *types.Var:
 		panic("unreachable")
 	default:
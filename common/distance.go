@@ -0,0 +1,88 @@
+package common
+
+import (
+	"sort"
+)
+
+// EditDistance returns edit distance between two strings. It counts insertions, deletions,
+// substitutions and transpositions of adjacent bytes (optimal string alignment distance) since
+// transposition is a common typo.
+func EditDistance(a, b string) int {
+	// Three rows of the matrix are enough to calculate the distance
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// SimilarNames returns at most max candidates which are close to the name. Candidates are sorted by
+// their edit distances and then by names. Candidates too far from the name are not returned.
+func SimilarNames(name string, candidates []string, max int) []string {
+	// Allow one typo per three characters
+	limit := len(name) / 3
+	if limit < 1 {
+		limit = 1
+	}
+
+	type scored struct {
+		name     string
+		distance int
+	}
+	found := []scored{}
+	seen := map[string]struct{}{}
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		if d := EditDistance(name, c); d <= limit {
+			found = append(found, scored{c, d})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		return found[i].name < found[j].name
+	})
+	if len(found) > max {
+		found = found[:max]
+	}
+
+	names := make([]string, 0, len(found))
+	for _, f := range found {
+		names = append(names, f.name)
+	}
+	return names
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"abc", "abc", 0},
+		{"abc", "abd", 1},
+		{"abc", "ac", 1},
+		{"ac", "abc", 1},
+		{"kitten", "sitting", 3},
+		{"count", "conut", 1},
+		{"ab", "ba", 1},
+		{"println_int", "print_int", 2},
+	} {
+		if had := EditDistance(tc.a, tc.b); had != tc.want {
+			t.Errorf("EditDistance(%q, %q) == %d (want %d)", tc.a, tc.b, had, tc.want)
+		}
+	}
+}
+
+func TestSimilarNames(t *testing.T) {
+	candidates := []string{"println_int", "print_int", "println_str", "counter", "count", "x", "y", "count"}
+	for _, tc := range []struct {
+		name string
+		want []string
+	}{
+		{"printn_int", []string{"print_int", "println_int"}},
+		{"conut", []string{"count"}},
+		{"countr", []string{"count", "counter"}},
+		{"z", []string{"x", "y"}},
+		{"x", []string{"y"}},
+		{"something", []string{}},
+	} {
+		had := SimilarNames(tc.name, candidates, 3)
+		if !reflect.DeepEqual(had, tc.want) {
+			t.Errorf("SimilarNames(%q) == %v (want %v)", tc.name, had, tc.want)
+		}
+	}
+}
@@ -3,12 +3,17 @@
 package driver
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/cgen"
 	"github.com/rhysd/gocaml/closure"
 	"github.com/rhysd/gocaml/codegen"
+	"github.com/rhysd/gocaml/interp"
+	"github.com/rhysd/gocaml/jsgen"
 	"github.com/rhysd/gocaml/mir"
 	"github.com/rhysd/gocaml/mono"
+	"github.com/rhysd/gocaml/opt"
 	"github.com/rhysd/gocaml/sema"
 	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/gocaml/token"
@@ -19,21 +24,121 @@ import (
 	"path/filepath"
 )
 
+// JSTarget is the name of target which compiles programs into JavaScript instead of native code.
+const JSTarget = "js"
+
+// OptLevel is an optimization level. It determines both the pipeline of MIR passes and LLVM passes.
+// Higher level generates faster code but takes more compile time.
 type OptLevel int
 
 const (
+	// O0 disables all optimizations except for guaranteed tail calls.
 	O0 OptLevel = iota
+	// O1 runs only cheap optimizations.
 	O1
+	// O2 is the default optimization level.
 	O2
+	// O3 optimizes aggressively. Small functions are also inlined on MIR by default.
 	O3
 )
 
+// DefaultInlineThreshold returns the threshold of inlining MIR functions used at the optimization
+// level when it is not specified explicitly.
+func DefaultInlineThreshold(level OptLevel) int {
+	if level == O3 {
+		return 20
+	}
+	return 0
+}
+
 // Driver instance to compile GoCaml code into other representations.
 type Driver struct {
+	// Optimization is the optimization level. Please see opt.DefaultPipeline for MIR passes enabled at
+	// each level.
 	Optimization OptLevel
 	LinkFlags    string
+	// LTO enables link-time optimization. Runtime compiled into LLVM bitcode is linked with clang's
+	// -flto so that functions of runtime can be inlined into the program.
+	LTO bool
+	// Runtime is linkage of the runtime library; 'static' or 'shared'. Executables depend on
+	// 'gocamlrt.so' with shared runtime. Static runtime is linked when it is empty.
+	Runtime string
+	// Reloc is a relocation model of generated code; 'pie', 'pic' or 'static'. Please see
+	// codegen.RelocModel. The default model of the target is used when it is empty.
+	Reloc string
+	// GC is a garbage collector of executables; 'boehm', 'builtin', 'none' or 'rc'. Boehm GC is used
+	// when it is empty. Please see codegen.GCKind. Only native code compiled with LLVM can select it.
+	GC string
+	// TargetTriple is the target of native code. When it is JSTarget, programs are compiled into
+	// JavaScript without LLVM.
 	TargetTriple string
-	DebugInfo    bool
+	// TargetCPU is a name of CPU of the target like 'haswell'. Generic CPU is used when it is empty.
+	TargetCPU string
+	// TargetFeatures is a comma-separated list of features of the target CPU to enable or disable
+	// like '+avx2,-sse4.1'.
+	TargetFeatures string
+	// DebugInfo emits debug information. It also verifies MIR after transform and optimization passes.
+	DebugInfo bool
+	NoAssert  bool
+	// NoBoundsCheck does not check indices of arrays at runtime. Out-of-bounds access is undefined
+	// behavior.
+	NoBoundsCheck bool
+	// CheckedArith aborts the program with the location when integer addition, subtraction,
+	// multiplication or negation overflows. Integers wrap around by default. Only native code
+	// compiled with LLVM is checked.
+	CheckedArith bool
+	// Sanitize is a comma-separated list of sanitizers; 'address' and 'undefined'. Executables are
+	// instrumented with them and linked with their runtimes. Only native code compiled with LLVM is
+	// instrumented.
+	Sanitize string
+	// Warnings is a comma-separated specification to enable or disable warnings. Please see
+	// sema.Warnings.Configure for the format. All warnings are enabled when it is empty.
+	Warnings string
+	// WarningsAsErrors makes compilation fail when some warning is reported.
+	WarningsAsErrors bool
+	// ParallelInference infers independent top-level bindings concurrently.
+	ParallelInference bool
+	// InlineThreshold is the maximum number of MIR instructions of functions to be inlined. Inlining
+	// is disabled when it is zero.
+	InlineThreshold int
+	// DiagnoseTailCalls reports calls in tail position which are not guaranteed to be tail calls as
+	// warnings.
+	DiagnoseTailCalls bool
+	// Passes is a comma-separated list of MIR passes run after closure transform. Please see
+	// opt.PassNames for available passes. The default pipeline of the optimization level is used
+	// when it is empty.
+	Passes string
+	// PassStats prints time and the number of instructions before and after each MIR pass to stderr.
+	PassStats bool
+	// ProfileGenerate instruments the executable to record execution counts of calls and branches.
+	ProfileGenerate bool
+	// ProfileUse is a path to the profile recorded by instrumented executable. Inlining and branches
+	// are optimized for hot paths in the profile.
+	ProfileUse string
+	// LambdaLifting passes free variables of closures which are only called as extra parameters
+	// instead of making closure objects. Please see closure.LiftLambdas.
+	LambdaLifting bool
+	// Defunctionalize replaces closures with variants and closure calls with direct calls to dispatch
+	// functions. Please see closure.Defunctionalize.
+	Defunctionalize bool
+	// ClosureRepr is a representation of environments of closures; 'flat' or 'linked'. Please see
+	// closure.Representation. Flat closures are used when it is empty.
+	ClosureRepr string
+	// LLVMPasses is a comma-separated list of LLVM passes run instead of the standard pipeline of
+	// the optimization level. Please see codegen.LLVMPassNames for available passes.
+	LLVMPasses string
+	// LLVMInlineThreshold is a threshold of LLVM's inliner. 0 means the default threshold of the
+	// optimization level and negative value disables it.
+	LLVMInlineThreshold int
+	// VectorizeLoops and VectorizeSLP enable the loop vectorizer and the SLP vectorizer of LLVM.
+	VectorizeLoops bool
+	VectorizeSLP   bool
+	// NoUnrollLoops disables loop unrolling of LLVM.
+	NoUnrollLoops bool
+	// GCStackMaps emits stack maps of GC roots at calls with LLVM's statepoints for precise GC.
+	// The conservative GC is still used at runtime.
+	GCStackMaps bool
+	profile     *mir.Profile
 }
 
 // PrintTokens returns the lexed tokens for a source code.
@@ -86,7 +191,40 @@ func (d *Driver) SemanticAnalysis(src *locerr.Source) (*types.Env, sema.Inferred
 		return nil, nil, err
 	}
 
-	return sema.Analyze(a)
+	ws, err := d.newWarnings()
+	if err != nil {
+		return nil, nil, err
+	}
+	env, inferred, err := sema.AnalyzeWithOptions(a, sema.Options{d.NoAssert, ws, d.ParallelInference, d.NoBoundsCheck, false})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.reportWarnings(ws); err != nil {
+		return nil, nil, err
+	}
+	return env, inferred, nil
+}
+
+func (d *Driver) newWarnings() (*sema.Warnings, error) {
+	ws := sema.NewWarnings()
+	if err := ws.Configure(d.Warnings); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// reportWarnings outputs reported warnings to stderr. When WarningsAsErrors is set, it returns an
+// error instead.
+func (d *Driver) reportWarnings(ws *sema.Warnings) error {
+	if d.WarningsAsErrors {
+		if err := ws.AsError(); err != nil {
+			return err
+		}
+	}
+	for _, w := range ws.List() {
+		fmt.Fprintln(os.Stderr, w.String())
+	}
+	return nil
 }
 
 func (d *Driver) DumpEnvToStdout(src *locerr.Source) error {
@@ -102,22 +240,167 @@ func (d *Driver) DumpEnvToStdout(src *locerr.Source) error {
 	return nil
 }
 
-// EmitMIR emits MIR tree representation.
-func (d *Driver) EmitMIR(src *locerr.Source) (*mir.Program, *types.Env, error) {
+// lowerToMIR emits MIR block tree before closure transform. When the MIR will not be monomorphized,
+// rank-N polymorphic parameters and polymorphic recursion are accepted. Defunctionalization needs
+// monomorphic types so it still rejects them.
+func (d *Driver) lowerToMIR(src *locerr.Source, monomorphize bool) (*mir.Block, *types.Env, error) {
 	parsed, err := d.Parse(src)
 	if err != nil {
 		return nil, nil, err
 	}
-	env, ir, err := sema.SemanticsCheck(parsed)
+	ws, err := d.newWarnings()
+	if err != nil {
+		return nil, nil, err
+	}
+	env, ir, err := sema.SemanticsCheckWithOptions(parsed, sema.Options{d.NoAssert, ws, d.ParallelInference, d.NoBoundsCheck, !monomorphize && !d.Defunctionalize})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.reportWarnings(ws); err != nil {
+		return nil, nil, err
+	}
+	if d.Optimization != O0 {
+		mir.ElimRefs(ir, env)
+		mir.EtaReduce(ir, env)
+	}
+	return ir, env, nil
+}
+
+// ExplainClosures returns a report which explains which functions capture which variables and why
+// closure objects are allocated.
+func (d *Driver) ExplainClosures(src *locerr.Source) (*closure.Report, error) {
+	ir, _, err := d.lowerToMIR(src, true)
+	if err != nil {
+		return nil, err
+	}
+	_, report := closure.TransformWithReport(ir)
+	return report, nil
+}
+
+// EmitMIR emits MIR tree representation.
+func (d *Driver) EmitMIR(src *locerr.Source) (*mir.Program, *types.Env, error) {
+	return d.emitMIR(src, true)
+}
+
+// emitMIR emits MIR of the program. Monomorphization can be skipped when a consumer of the MIR can
+// handle generic functions by itself.
+func (d *Driver) emitMIR(src *locerr.Source, monomorphize bool) (*mir.Program, *types.Env, error) {
+	ir, env, err := d.lowerToMIR(src, monomorphize)
 	if err != nil {
 		return nil, nil, err
 	}
 	prog := closure.Transform(ir)
-	prog = mono.Monomorphize(prog, env)
+	if d.DebugInfo {
+		if err := closure.Verify(prog); err != nil {
+			return nil, nil, locerr.Note(err, "Closures are broken after closure transform")
+		}
+	}
+	if monomorphize {
+		prog = mono.Monomorphize(prog, env)
+	}
+	if err := d.verifyMIR(prog, "closure transform"); err != nil {
+		return nil, nil, err
+	}
+	if d.LambdaLifting {
+		closure.LiftLambdas(prog, env)
+		if err := d.verifyMIR(prog, "lambda lifting"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if d.Defunctionalize {
+		if err := closure.Defunctionalize(prog, env); err != nil {
+			return nil, nil, err
+		}
+		if err := d.verifyMIR(prog, "defunctionalization"); err != nil {
+			return nil, nil, err
+		}
+	}
+	pm, err := d.pipeline()
+	if err != nil {
+		return nil, nil, err
+	}
+	pm.Verify = d.DebugInfo
+	pm.Profile, err = d.readProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pm.Run(prog, env); err != nil {
+		return nil, nil, err
+	}
+	if d.PassStats {
+		pm.DumpStats(os.Stderr)
+	}
+	// Passes may leave captures which are no longer used. Closures must not retain them
+	opt.TrimClosureCaptures(prog)
+	repr, err := closure.ParseRepresentation(d.ClosureRepr)
+	if err != nil {
+		return nil, nil, locerr.Note(err, "Invalid closure representation specified with -closure-repr")
+	}
+	if repr == closure.LinkedClosures {
+		closure.LinkEnvs(prog)
+		if err := d.verifyMIR(prog, "linking closures"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if d.DebugInfo {
+		if err := opt.CheckSafeForSpace(prog); err != nil {
+			return nil, nil, locerr.Note(err, "Closures are not safe for space")
+		}
+	}
+	if d.DiagnoseTailCalls {
+		ws, err := d.newWarnings()
+		if err != nil {
+			return nil, nil, err
+		}
+		opt.DiagnoseTailCalls(prog, env, ws)
+		if err := d.reportWarnings(ws); err != nil {
+			return nil, nil, err
+		}
+	}
 	return prog, env, nil
 }
 
+// pipeline creates a pass manager to optimize MIR.
+func (d *Driver) pipeline() (*mir.PassManager, error) {
+	names := opt.DefaultPipeline(int(d.Optimization), d.InlineThreshold)
+	if d.Passes != "" {
+		specified, err := opt.ParsePipeline(d.Passes)
+		if err != nil {
+			return nil, locerr.Note(err, "Invalid pipeline specified with -passes")
+		}
+		names = specified
+	}
+	return opt.NewPipeline(names, d.InlineThreshold)
+}
+
+// readProfile reads the profile specified by ProfileUse. It returns nil when no profile is specified.
+func (d *Driver) readProfile() (*mir.Profile, error) {
+	if d.ProfileUse == "" || d.profile != nil {
+		return d.profile, nil
+	}
+	p, err := mir.ReadProfile(d.ProfileUse)
+	if err != nil {
+		return nil, locerr.Note(err, "Invalid profile specified with -profile-use")
+	}
+	d.profile = p
+	return p, nil
+}
+
+// verifyMIR checks the program is not broken by passes when compiling with debug information.
+func (d *Driver) verifyMIR(prog *mir.Program, after string) error {
+	if !d.DebugInfo {
+		return nil
+	}
+	if err := mir.Verify(prog); err != nil {
+		return locerr.Notef(err, "MIR is broken after %s", after)
+	}
+	return nil
+}
+
 func (d *Driver) emitterFromSource(src *locerr.Source) (*codegen.Emitter, error) {
+	if d.TargetTriple == JSTarget {
+		return nil, locerr.NewError("LLVM IR, assembly and object file cannot be emitted for target 'js'")
+	}
 	prog, env, err := d.EmitMIR(src)
 	if err != nil {
 		return nil, err
@@ -132,9 +415,50 @@ func (d *Driver) emitterFromSource(src *locerr.Source) (*codegen.Emitter, error)
 	case O3:
 		level = codegen.OptimizeAggressive
 	}
-	opts := codegen.EmitOptions{level, d.TargetTriple, d.LinkFlags, d.DebugInfo}
+	profile, err := d.readProfile()
+	if err != nil {
+		return nil, err
+	}
+	shared := false
+	switch d.Runtime {
+	case "", "static":
+	case "shared":
+		shared = true
+	default:
+		return nil, locerr.Errorf("Runtime must be 'static' or 'shared' but '%s' was specified", d.Runtime)
+	}
+	reloc := codegen.RelocDefault
+	switch d.Reloc {
+	case "":
+	case "pie":
+		reloc = codegen.RelocPIE
+	case "pic":
+		reloc = codegen.RelocPIC
+	case "static":
+		reloc = codegen.RelocStatic
+	default:
+		return nil, locerr.Errorf("Relocation model must be 'pie', 'pic' or 'static' but '%s' was specified", d.Reloc)
+	}
+	gc := codegen.GCBoehm
+	switch d.GC {
+	case "", "boehm":
+	case "builtin":
+		gc = codegen.GCBuiltin
+	case "none":
+		gc = codegen.GCNone
+	case "rc":
+		gc = codegen.GCRefCount
+	default:
+		return nil, locerr.Errorf("GC must be 'boehm', 'builtin', 'none' or 'rc' but '%s' was specified", d.GC)
+	}
+	opts := codegen.EmitOptions{level, d.TargetTriple, d.TargetCPU, d.TargetFeatures, d.LinkFlags, d.LTO, shared, d.DebugInfo, d.ProfileGenerate, profile, d.GCStackMaps, d.CheckedArith, d.Sanitize, reloc, gc}
 
-	return codegen.NewEmitter(prog, env, src, opts)
+	emitter, err := codegen.NewEmitter(prog, env, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	emitter.LLVMPasses = codegen.LLVMPassOptions{d.LLVMInlineThreshold, d.VectorizeLoops, d.VectorizeSLP, d.NoUnrollLoops, d.LLVMPasses}
+	return emitter, nil
 }
 
 func (d *Driver) EmitObjFile(src *locerr.Source) error {
@@ -143,7 +467,9 @@ func (d *Driver) EmitObjFile(src *locerr.Source) error {
 		return err
 	}
 	defer emitter.Dispose()
-	emitter.RunOptimizationPasses()
+	if err := emitter.RunOptimizationPasses(); err != nil {
+		return err
+	}
 	obj, err := emitter.EmitObject()
 	if err != nil {
 		return err
@@ -158,7 +484,9 @@ func (d *Driver) EmitLLVMIR(src *locerr.Source) (string, error) {
 		return "", err
 	}
 	defer emitter.Dispose()
-	emitter.RunOptimizationPasses()
+	if err := emitter.RunOptimizationPasses(); err != nil {
+		return "", err
+	}
 
 	return emitter.EmitLLVMIR(), nil
 }
@@ -169,18 +497,171 @@ func (d *Driver) EmitAsm(src *locerr.Source) (string, error) {
 		return "", err
 	}
 	defer emitter.Dispose()
-	emitter.RunOptimizationPasses()
+	if err := emitter.RunOptimizationPasses(); err != nil {
+		return "", err
+	}
 
 	return emitter.EmitAsm()
 }
 
+// Extensions of files written by EmitFile for each kind of artifact. Executable has no extension.
+var emitExts = map[string]string{
+	"ir":  ".ll",
+	"bc":  ".bc",
+	"asm": ".s",
+	"obj": ".o",
+	"exe": "",
+	"h":   ".h",
+}
+
+// EmitFile compiles the program and writes the artifact to a file named after the source (or
+// 'a.out' for stdin) without linking it except for executable. kind is one of 'ir' (LLVM IR), 'bc'
+// (LLVM bitcode), 'asm' (assembly), 'obj' (object file), 'exe' (executable) and 'h' (C header
+// declaring external symbols).
+func (d *Driver) EmitFile(src *locerr.Source, kind string) error {
+	ext, ok := emitExts[kind]
+	if !ok {
+		return locerr.Errorf("Unknown kind of artifact '%s'. It must be one of 'ir', 'bc', 'asm', 'obj', 'exe' or 'h'", kind)
+	}
+	filename := "a.out" + ext
+	if src.Exists {
+		filename = src.BaseName() + ext
+	}
+
+	switch kind {
+	case "exe":
+		return d.Compile(src)
+	case "h":
+		_, env, err := d.EmitMIR(src)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := codegen.EmitCHeader(&buf, env, src); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filename, buf.Bytes(), 0666)
+	}
+
+	emitter, err := d.emitterFromSource(src)
+	if err != nil {
+		return err
+	}
+	defer emitter.Dispose()
+	if err := emitter.RunOptimizationPasses(); err != nil {
+		return err
+	}
+
+	var out []byte
+	switch kind {
+	case "ir":
+		out = []byte(emitter.EmitLLVMIR())
+	case "bc":
+		out = emitter.EmitBitcode()
+	case "asm":
+		asm, err := emitter.EmitAsm()
+		if err != nil {
+			return err
+		}
+		out = []byte(asm)
+	case "obj":
+		if out, err = emitter.EmitObject(); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(filename, out, 0666)
+}
+
+// EmitC emits portable C source of the program. Unlike other emitters, it does not need LLVM. The
+// C source can be compiled with any C99 compiler and linked with the runtime. Since MIR is not
+// monomorphized yet, programs which use generic functions polymorphically are rejected by the C
+// backend.
+func (d *Driver) EmitC(src *locerr.Source) (string, error) {
+	prog, env, err := d.emitMIR(src, false)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := cgen.Emit(&buf, prog, env, src); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// EmitJS emits JavaScript of the program. The script contains runtime and runs with Node.js. It does
+// not need LLVM. Since values of JavaScript are not typed statically, the program is not
+// monomorphized.
+func (d *Driver) EmitJS(src *locerr.Source) (string, error) {
+	prog, env, err := d.emitMIR(src, false)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := jsgen.Emit(&buf, prog, env, src); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// compileJS writes JavaScript of the program to a file instead of an executable.
+func (d *Driver) compileJS(source *locerr.Source) error {
+	if d.ProfileGenerate {
+		return locerr.NewError("Profile instrumentation is not supported for target 'js'")
+	}
+	js, err := d.EmitJS(source)
+	if err != nil {
+		return err
+	}
+	filename := "a.out.js"
+	if source.Exists {
+		filename = fmt.Sprintf("%s.js", source.BaseName())
+	}
+	return ioutil.WriteFile(filename, []byte(js), 0666)
+}
+
+// Run executes the program with MIR interpreter instead of compiling it. It does not need LLVM.
+// args is a list of program arguments whose first element is the name of the program. Returned
+// integer is the exit status of the program. Since values know their types at runtime in the
+// interpreter, the program is not monomorphized.
+func (d *Driver) Run(src *locerr.Source, args []string) (int, error) {
+	prog, env, err := d.emitMIR(src, false)
+	if err != nil {
+		return 0, err
+	}
+	it := interp.NewInterpreter(prog, env)
+	it.Args = args
+	return it.Run()
+}
+
+// RunJIT compiles the program with LLVM JIT compiler and runs it in the current process without
+// linking an executable. args is a list of program arguments whose first element is the name of
+// the program. Returned integer is the exit status of the program. It must be called on the main
+// thread.
+func (d *Driver) RunJIT(src *locerr.Source, args []string) (int, error) {
+	emitter, err := d.emitterFromSource(src)
+	if err != nil {
+		return 0, err
+	}
+	defer emitter.Dispose()
+	if err := emitter.RunOptimizationPasses(); err != nil {
+		return 0, err
+	}
+	return emitter.RunJIT(args)
+}
+
 func (d *Driver) Compile(source *locerr.Source) error {
+	if d.TargetTriple == JSTarget {
+		return d.compileJS(source)
+	}
 	emitter, err := d.emitterFromSource(source)
 	if err != nil {
 		return err
 	}
 	defer emitter.Dispose()
-	emitter.RunOptimizationPasses()
+	if err := emitter.RunOptimizationPasses(); err != nil {
+		return err
+	}
 	var executable string
 	if source.Exists {
 		executable = source.BaseName()
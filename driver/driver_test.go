@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestEmitC(t *testing.T) {
+	d := Driver{}
+	for _, opt := range []OptLevel{O0, O2} {
+		d.Optimization = opt
+		c, err := d.EmitC(locerr.NewDummySource("let rec f x = x + 1 in print_int (f 41)"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(c, "int __gocaml_main(void) {") {
+			t.Fatalf("Entry point was not found in emitted C source at O%d:\n%s", opt, c)
+		}
+	}
+}
+
+func TestEmitCRejectsGenericFunctions(t *testing.T) {
+	d := Driver{}
+	_, err := d.EmitC(locerr.NewDummySource("let rec id x = x in print_int (id 1); print_bool (id true)"))
+	if err == nil {
+		t.Fatal("Generic function was not rejected by C backend")
+	}
+	if !strings.Contains(err.Error(), "C backend needs monomorphic types") {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestEmitJS(t *testing.T) {
+	src := locerr.NewDummySource("let rec id x = x in print_int (id 1); print_bool (id true)")
+	d := Driver{}
+	for _, opt := range []OptLevel{O0, O2} {
+		d.Optimization = opt
+		js, err := d.EmitJS(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := exec.LookPath("node")
+		if err != nil {
+			continue
+		}
+		f, err := ioutil.TempFile("", "gocaml-driver-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString(js); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		out, err := exec.Command(node, f.Name()).Output()
+		if err != nil {
+			t.Fatalf("Emitted JavaScript failed at O%d: %s\n%s", opt, err, js)
+		}
+		if string(out) != "1true" {
+			t.Fatalf("Unexpected output at O%d: '%s'", opt, out)
+		}
+	}
+}
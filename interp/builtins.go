@@ -0,0 +1,601 @@
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type builtin func(it *Interpreter, args []value) value
+
+// Functions in runtime/gocamlrt.c and libm keyed by their C names
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"print_int": func(it *Interpreter, args []value) value {
+			it.out.WriteString(strconv.FormatInt(args[0].(int64), 10))
+			return unit{}
+		},
+		"print_bool": func(it *Interpreter, args []value) value {
+			it.out.WriteString(strconv.FormatBool(args[0].(bool)))
+			return unit{}
+		},
+		"print_float": func(it *Interpreter, args []value) value {
+			it.out.WriteString(formatFloat(args[0].(float64)))
+			return unit{}
+		},
+		"print_str": func(it *Interpreter, args []value) value {
+			it.out.WriteString(args[0].(string))
+			return unit{}
+		},
+		"println_int": func(it *Interpreter, args []value) value {
+			it.out.WriteString(strconv.FormatInt(args[0].(int64), 10) + "\n")
+			return unit{}
+		},
+		"println_bool": func(it *Interpreter, args []value) value {
+			it.out.WriteString(strconv.FormatBool(args[0].(bool)) + "\n")
+			return unit{}
+		},
+		"println_float": func(it *Interpreter, args []value) value {
+			it.out.WriteString(formatFloat(args[0].(float64)) + "\n")
+			return unit{}
+		},
+		"println_str": func(it *Interpreter, args []value) value {
+			it.out.WriteString(args[0].(string) + "\n")
+			return unit{}
+		},
+		"float_to_int": func(it *Interpreter, args []value) value {
+			return int64(args[0].(float64))
+		},
+		"int_to_float": func(it *Interpreter, args []value) value {
+			return float64(args[0].(int64))
+		},
+		"str_length": func(it *Interpreter, args []value) value {
+			return int64(len(args[0].(string)))
+		},
+		"__str_equal": func(it *Interpreter, args []value) value {
+			return args[0].(string) == args[1].(string)
+		},
+		"__gocaml_assert_fail": func(it *Interpreter, args []value) value {
+			it.abort(fmt.Sprintf("Assertion failed at %s", args[0].(string)))
+			return unit{}
+		},
+		"__gocaml_bounds_fail": func(it *Interpreter, args []value) value {
+			it.abort(fmt.Sprintf("Index out of bounds at %s: index is %d but size of array is %d", args[0].(string), args[1].(int64), args[2].(int64)))
+			return unit{}
+		},
+		"__gocaml_exit": func(it *Interpreter, args []value) value {
+			panic(exit(uint8(args[0].(int64))))
+		},
+		"__gocaml_str_escape": func(it *Interpreter, args []value) value {
+			return escapeStr(args[0].(string))
+		},
+		"str_concat": func(it *Interpreter, args []value) value {
+			return args[0].(string) + args[1].(string)
+		},
+		"str_sub": func(it *Interpreter, args []value) value {
+			s := args[0].(string)
+			size := int64(len(s))
+			start, last := args[1].(int64), args[2].(int64)
+			if start < 0 {
+				start = 0
+			} else if start > size {
+				start = size
+			}
+			if last < 0 {
+				last = 0
+			} else if last > size {
+				last = size
+			}
+			if last < start {
+				return ""
+			}
+			return s[start:last]
+		},
+		"str_index": func(it *Interpreter, args []value) value {
+			return int64(strings.Index(args[0].(string), args[1].(string)))
+		},
+		"str_split": func(it *Interpreter, args []value) value {
+			s, sep := args[0].(string), args[1].(string)
+			var ss []string
+			if sep == "" {
+				// Split into bytes instead of UTF-8 characters as runtime does
+				ss = make([]string, 0, len(s))
+				for i := 0; i < len(s); i++ {
+					ss = append(ss, s[i:i+1])
+				}
+			} else {
+				ss = strings.Split(s, sep)
+			}
+			elems := make([]value, 0, len(ss))
+			for _, e := range ss {
+				elems = append(elems, e)
+			}
+			return &array{elems}
+		},
+		"str_join": func(it *Interpreter, args []value) value {
+			elems := args[0].(*array).elems
+			ss := make([]string, 0, len(elems))
+			for _, e := range elems {
+				ss = append(ss, e.(string))
+			}
+			return strings.Join(ss, args[1].(string))
+		},
+		"str_uppercase": func(it *Interpreter, args []value) value {
+			return mapASCII(args[0].(string), 'a', 'A')
+		},
+		"str_lowercase": func(it *Interpreter, args []value) value {
+			return mapASCII(args[0].(string), 'A', 'a')
+		},
+		"int_to_str": func(it *Interpreter, args []value) value {
+			return strconv.FormatInt(args[0].(int64), 10)
+		},
+		"float_to_str": func(it *Interpreter, args []value) value {
+			return formatFloat(args[0].(float64))
+		},
+		"str_to_int": func(it *Interpreter, args []value) value {
+			return atoi(args[0].(string))
+		},
+		"str_to_float": func(it *Interpreter, args []value) value {
+			return atof(args[0].(string))
+		},
+		"get_line": func(it *Interpreter, args []value) value {
+			it.out.Flush()
+			var b bytes.Buffer
+			for b.Len() < 1023 {
+				c, err := it.in.ReadByte()
+				if err != nil {
+					break
+				}
+				b.WriteByte(c)
+				if c == '\n' {
+					break
+				}
+			}
+			return b.String()
+		},
+		"get_char": func(it *Interpreter, args []value) value {
+			it.out.Flush()
+			c, err := it.in.ReadByte()
+			if err != nil {
+				// getchar() returns EOF (-1)
+				c = 0xff
+			}
+			return string([]byte{c})
+		},
+		"to_char_code": func(it *Interpreter, args []value) value {
+			s := args[0].(string)
+			if len(s) == 0 {
+				return int64(0)
+			}
+			// Characters are int8_t in runtime
+			return int64(int8(s[0]))
+		},
+		"from_char_code": func(it *Interpreter, args []value) value {
+			return string([]byte{byte(args[0].(int64))})
+		},
+		"do_garbage_collection":      func(it *Interpreter, args []value) value { return unit{} },
+		"enable_garbage_collection":  func(it *Interpreter, args []value) value { return unit{} },
+		"disable_garbage_collection": func(it *Interpreter, args []value) value { return unit{} },
+		"bit_and": func(it *Interpreter, args []value) value {
+			return args[0].(int64) & args[1].(int64)
+		},
+		"bit_or": func(it *Interpreter, args []value) value {
+			return args[0].(int64) | args[1].(int64)
+		},
+		"bit_xor": func(it *Interpreter, args []value) value {
+			return args[0].(int64) ^ args[1].(int64)
+		},
+		"bit_rsft": func(it *Interpreter, args []value) value {
+			return args[0].(int64) >> uint64(args[1].(int64))
+		},
+		"bit_lsft": func(it *Interpreter, args []value) value {
+			return args[0].(int64) << uint64(args[1].(int64))
+		},
+		"bit_inv": func(it *Interpreter, args []value) value {
+			return ^args[0].(int64)
+		},
+		"ceil":  mathFunc(math.Ceil),
+		"floor": mathFunc(math.Floor),
+		"exp":   mathFunc(math.Exp),
+		"log":   mathFunc(math.Log),
+		"log10": mathFunc(math.Log10),
+		"log1p": mathFunc(math.Log1p),
+		"sqrt":  mathFunc(math.Sqrt),
+		"sin":   mathFunc(math.Sin),
+		"cos":   mathFunc(math.Cos),
+		"tan":   mathFunc(math.Tan),
+		"asin":  mathFunc(math.Asin),
+		"acos":  mathFunc(math.Acos),
+		"atan":  mathFunc(math.Atan),
+		"sinh":  mathFunc(math.Sinh),
+		"cosh":  mathFunc(math.Cosh),
+		"tanh":  mathFunc(math.Tanh),
+		"asinh": mathFunc(math.Asinh),
+		"acosh": mathFunc(math.Acosh),
+		"atanh": mathFunc(math.Atanh),
+		"atan2": func(it *Interpreter, args []value) value {
+			if len(args) < 2 {
+				// atan2 is declared with one parameter in built-in table
+				return math.NaN()
+			}
+			return math.Atan2(args[0].(float64), args[1].(float64))
+		},
+		"hypot": func(it *Interpreter, args []value) value {
+			return math.Hypot(args[0].(float64), args[1].(float64))
+		},
+		"fmod": func(it *Interpreter, args []value) value {
+			return math.Mod(args[0].(float64), args[1].(float64))
+		},
+		"gocaml_modf": func(it *Interpreter, args []value) value {
+			i, frac := math.Modf(args[0].(float64))
+			return tuple{frac, i}
+		},
+		"gocaml_frexp": func(it *Interpreter, args []value) value {
+			frac, exp := math.Frexp(args[0].(float64))
+			return tuple{frac, int64(exp)}
+		},
+		"gocaml_ldexp": func(it *Interpreter, args []value) value {
+			return math.Ldexp(args[0].(float64), int(args[1].(int64)))
+		},
+		"fabs": mathFunc(math.Abs),
+		"fmin": func(it *Interpreter, args []value) value {
+			return fminmax(args[0].(float64), args[1].(float64), math.Min)
+		},
+		"fmax": func(it *Interpreter, args []value) value {
+			return fminmax(args[0].(float64), args[1].(float64), math.Max)
+		},
+		"gocaml_min": func(it *Interpreter, args []value) value {
+			l, r := args[0].(int64), args[1].(int64)
+			if l < r {
+				return l
+			}
+			return r
+		},
+		"gocaml_max": func(it *Interpreter, args []value) value {
+			l, r := args[0].(int64), args[1].(int64)
+			if l > r {
+				return l
+			}
+			return r
+		},
+		"time_now": func(it *Interpreter, args []value) value {
+			return time.Now().Unix()
+		},
+		"gocaml_clock": func(it *Interpreter, args []value) value {
+			// Processor time is not available in standard library. Elapsed time is used instead
+			return time.Since(it.start).Seconds()
+		},
+		"gocaml_monotonic_ns": func(it *Interpreter, args []value) value {
+			// Time since the start of program is measured with monotonic clock
+			return time.Since(it.start).Nanoseconds()
+		},
+		"gocaml_random_seed": func(it *Interpreter, args []value) value {
+			it.random = uint64(args[0].(int64))
+			return unit{}
+		},
+		"gocaml_random_int": func(it *Interpreter, args []value) value {
+			bound := args[0].(int64)
+			if bound <= 0 {
+				return int64(0)
+			}
+			n := uint64(bound)
+			for {
+				// Reject values in the last incomplete range to avoid modulo bias
+				x := it.randomNext() >> 1
+				r := x % n
+				if x-r <= 1<<63-n {
+					return int64(r)
+				}
+			}
+		},
+		"gocaml_random_float": func(it *Interpreter, args []value) value {
+			return float64(it.randomNext()>>11) / (1 << 53)
+		},
+		"read_file": func(it *Interpreter, args []value) value {
+			b, err := ioutil.ReadFile(args[0].(string))
+			if err != nil {
+				return option{}
+			}
+			return option{true, string(b)}
+		},
+		"write_file": func(it *Interpreter, args []value) value {
+			return ioutil.WriteFile(args[0].(string), []byte(args[1].(string)), 0666) == nil
+		},
+		"gocaml_getenv": func(it *Interpreter, args []value) value {
+			if v, ok := os.LookupEnv(args[0].(string)); ok {
+				return option{true, v}
+			}
+			return option{}
+		},
+		"gocaml_open_in": func(it *Interpreter, args []value) value {
+			return it.openFile(args[0].(string), os.O_RDONLY)
+		},
+		"gocaml_open_out": func(it *Interpreter, args []value) value {
+			return it.openFile(args[0].(string), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		},
+		"gocaml_open_append": func(it *Interpreter, args []value) value {
+			return it.openFile(args[0].(string), os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+		},
+		"gocaml_input_line": func(it *Interpreter, args []value) value {
+			f := it.fileOf(args[0].(int64))
+			if f == nil || f.r == nil {
+				return option{}
+			}
+			if s, ok := readLine(f.r); ok {
+				return option{true, s}
+			}
+			return option{}
+		},
+		"gocaml_input_all": func(it *Interpreter, args []value) value {
+			f := it.fileOf(args[0].(int64))
+			if f == nil || f.r == nil {
+				return ""
+			}
+			b, _ := ioutil.ReadAll(f.r)
+			return string(b)
+		},
+		"gocaml_output_string": func(it *Interpreter, args []value) value {
+			f := it.fileOf(args[0].(int64))
+			if f == nil || f.w == nil {
+				return false
+			}
+			_, err := io.WriteString(f.w, args[1].(string))
+			return err == nil
+		},
+		"gocaml_close_file": func(it *Interpreter, args []value) value {
+			return it.closeFile(args[0].(int64))
+		},
+		"gocaml_read_line": func(it *Interpreter, args []value) value {
+			it.out.Flush()
+			if s, ok := readLine(it.in); ok {
+				return option{true, s}
+			}
+			return option{}
+		},
+		"gocaml_buffer_create": func(it *Interpreter, args []value) value {
+			return &bytes.Buffer{}
+		},
+		"gocaml_buffer_add_string": func(it *Interpreter, args []value) value {
+			args[0].(*bytes.Buffer).WriteString(args[1].(string))
+			return unit{}
+		},
+		"gocaml_buffer_add_char": func(it *Interpreter, args []value) value {
+			args[0].(*bytes.Buffer).WriteByte(byte(args[1].(int64)))
+			return unit{}
+		},
+		"gocaml_buffer_contents": func(it *Interpreter, args []value) value {
+			return args[0].(*bytes.Buffer).String()
+		},
+		"gocaml_buffer_length": func(it *Interpreter, args []value) value {
+			return int64(args[0].(*bytes.Buffer).Len())
+		},
+		"gocaml_re_match": func(it *Interpreter, args []value) value {
+			return it.reMatch(args[0].(string), args[1].(string))
+		},
+		"gocaml_re_find": func(it *Interpreter, args []value) value {
+			return it.reFind(args[0].(string), args[1].(string))
+		},
+		"gocaml_re_replace": func(it *Interpreter, args []value) value {
+			return it.reReplace(args[0].(string), args[1].(string), args[2].(string))
+		},
+		"gocaml_json_null": func(it *Interpreter, args []value) value {
+			return &jsonValue{kind: jsonNull}
+		},
+		"gocaml_json_of_bool": func(it *Interpreter, args []value) value {
+			return &jsonValue{kind: jsonBool, b: args[0].(bool)}
+		},
+		"gocaml_json_of_int": func(it *Interpreter, args []value) value {
+			return &jsonValue{kind: jsonInt, i: args[0].(int64)}
+		},
+		"gocaml_json_of_float": func(it *Interpreter, args []value) value {
+			return &jsonValue{kind: jsonFloat, f: args[0].(float64)}
+		},
+		"gocaml_json_of_string": func(it *Interpreter, args []value) value {
+			return &jsonValue{kind: jsonString, s: args[0].(string)}
+		},
+		"gocaml_json_of_array": func(it *Interpreter, args []value) value {
+			return jsonOfArray(args[0].(*array))
+		},
+		"gocaml_json_of_object": func(it *Interpreter, args []value) value {
+			return jsonOfObject(args[0].(*array))
+		},
+		"gocaml_json_kind": func(it *Interpreter, args []value) value {
+			return jsonKindNames[args[0].(*jsonValue).kind]
+		},
+		"gocaml_json_to_bool": func(it *Interpreter, args []value) value {
+			v := args[0].(*jsonValue)
+			it.jsonExpect("to_bool", v, "bool", jsonBool)
+			return v.b
+		},
+		"gocaml_json_to_int": func(it *Interpreter, args []value) value {
+			v := args[0].(*jsonValue)
+			it.jsonExpect("to_int", v, "int", jsonInt)
+			return v.i
+		},
+		"gocaml_json_to_float": func(it *Interpreter, args []value) value {
+			v := args[0].(*jsonValue)
+			it.jsonExpect("to_float", v, "float or int", jsonFloat, jsonInt)
+			if v.kind == jsonInt {
+				return float64(v.i)
+			}
+			return v.f
+		},
+		"gocaml_json_to_string": func(it *Interpreter, args []value) value {
+			v := args[0].(*jsonValue)
+			it.jsonExpect("to_string", v, "string", jsonString)
+			return v.s
+		},
+		"gocaml_json_length": func(it *Interpreter, args []value) value {
+			v := args[0].(*jsonValue)
+			it.jsonExpect("length", v, "array or object", jsonArray, jsonObject)
+			return int64(len(v.elems))
+		},
+		"gocaml_json_get": func(it *Interpreter, args []value) value {
+			return it.jsonGet(args[0].(*jsonValue), args[1].(int64))
+		},
+		"gocaml_json_key": func(it *Interpreter, args []value) value {
+			return it.jsonKey(args[0].(*jsonValue), args[1].(int64))
+		},
+		"gocaml_json_member": func(it *Interpreter, args []value) value {
+			return it.jsonMember(args[0].(*jsonValue), args[1].(string))
+		},
+		"gocaml_json_encode": func(it *Interpreter, args []value) value {
+			return string(encodeJSON(nil, args[0].(*jsonValue)))
+		},
+		"gocaml_json_decode": func(it *Interpreter, args []value) value {
+			return decodeJSON(args[0].(string))
+		},
+	}
+}
+
+func mathFunc(f func(float64) float64) builtin {
+	return func(it *Interpreter, args []value) value {
+		return f(args[0].(float64))
+	}
+}
+
+// formatFloat formats the float as printf("%g") does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', 6, 64)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || '\t' <= c && c <= '\r'
+}
+
+// mapASCII converts ASCII letters in [from, from+25] to ones from 'to' byte by byte. Other bytes
+// are not changed since strings are sequences of bytes.
+func mapASCII(s string, from, to byte) string {
+	b := []byte(s)
+	for i, c := range b {
+		if from <= c && c <= from+25 {
+			b[i] = c - from + to
+		}
+	}
+	return string(b)
+}
+
+// fminmax applies math.Min or math.Max to the floats. When one of them is NaN, it returns the other
+// as fmin() and fmax() in C do.
+// escapeStr escapes '"', '\\' and control characters as string literal of GoCaml.
+func escapeStr(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c == '\t':
+			b.WriteString("\\t")
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func fminmax(l, r float64, f func(float64, float64) float64) float64 {
+	if math.IsNaN(l) {
+		return r
+	}
+	if math.IsNaN(r) {
+		return l
+	}
+	return f(l, r)
+}
+
+// randomNext generates the next pseudo random number with SplitMix64 as runtime does.
+func (it *Interpreter) randomNext() uint64 {
+	it.random += 0x9E3779B97F4A7C15
+	z := it.random
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// atoi parses the prefix of the string as an integer as atoi() does.
+func atoi(s string) int64 {
+	i := 0
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	start := i
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(s[start:i], 10, 64)
+	if err != nil {
+		return 0
+	}
+	// atoi() returns int
+	return int64(int32(n))
+}
+
+// atof parses the longest prefix of the string which represents a float as atof() does.
+func atof(s string) float64 {
+	i := 0
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	start := i
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	if rest := strings.ToLower(s[i:]); strings.HasPrefix(rest, "inf") || strings.HasPrefix(rest, "nan") {
+		f, _ := strconv.ParseFloat(s[start:i+3], 64)
+		return f
+	}
+	digits := func() int {
+		n := 0
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+			n++
+		}
+		return n
+	}
+	n := digits()
+	if i < len(s) && s[i] == '.' {
+		i++
+		n += digits()
+	}
+	if n == 0 {
+		return 0
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			i = j
+		}
+	}
+	// Out of range value is rounded to infinity or zero as strtod() does
+	f, _ := strconv.ParseFloat(s[start:i], 64)
+	return f
+}
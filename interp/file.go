@@ -0,0 +1,81 @@
+package interp
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// file is a file opened by a program. Handles 0, 1 and 2 are stdin, stdout and stderr as runtime.
+type file struct {
+	r *bufio.Reader
+	w io.Writer
+	// Closer is nil for standard streams since they cannot be closed
+	c io.Closer
+}
+
+// stderr writes to stderr after flushing stdout as runtime does.
+type stderr struct {
+	it *Interpreter
+}
+
+func (s stderr) Write(b []byte) (int, error) {
+	s.it.out.Flush()
+	return s.it.Stderr.Write(b)
+}
+
+// openFile opens the file with flags of os.OpenFile() and returns its handle. It returns -1 when
+// the file cannot be opened. Handles of closed files are reused.
+func (it *Interpreter) openFile(name string, flag int) int64 {
+	f, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		return -1
+	}
+	opened := &file{c: f}
+	if flag == os.O_RDONLY {
+		opened.r = bufio.NewReader(f)
+	} else {
+		opened.w = f
+	}
+	for i, o := range it.files {
+		if o == nil {
+			it.files[i] = opened
+			return int64(i)
+		}
+	}
+	it.files = append(it.files, opened)
+	return int64(len(it.files) - 1)
+}
+
+func (it *Interpreter) fileOf(handle int64) *file {
+	if handle < 0 || handle >= int64(len(it.files)) {
+		return nil
+	}
+	return it.files[handle]
+}
+
+// readLine reads a line without newline. It returns false when no character was read before EOF.
+func readLine(r *bufio.Reader) (string, bool) {
+	s, err := r.ReadString('\n')
+	if err != nil && s == "" {
+		return "", false
+	}
+	return strings.TrimSuffix(s, "\n"), true
+}
+
+func (it *Interpreter) closeFile(handle int64) bool {
+	f := it.fileOf(handle)
+	if f == nil || f.c == nil {
+		return false
+	}
+	it.files[handle] = nil
+	return f.c.Close() == nil
+}
+
+// closeFiles closes files which the program did not close.
+func (it *Interpreter) closeFiles() {
+	for i := range it.files {
+		it.closeFile(int64(i))
+	}
+}
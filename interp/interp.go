@@ -0,0 +1,422 @@
+// Package interp provides an interpreter of MIR.
+//
+// It executes a program after closure transform directly without compiling it, so programs can
+// run on machines where LLVM is not available. Since its implementation is independent from code
+// generation, comparing outputs of the interpreter and compiled executables also detects
+// miscompilations.
+//
+// The interpreter walks instructions of MIR. Values are represented with Go values which know
+// their own types (please see the note in value.go), so the program need not be monomorphized.
+// External functions are implemented in Go for functions of runtime and libm. Other external
+// symbols are not available.
+package interp
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"time"
+)
+
+// exit is thrown as panic to terminate the program with the status code.
+type exit int
+
+// runtimeError is thrown as panic when the program cannot be executed any more.
+type runtimeError struct {
+	err *locerr.Error
+}
+
+// Interpreter executes a MIR program. The program must be closure-transformed.
+type Interpreter struct {
+	prog *mir.Program
+	env  *types.Env
+	// Args is a list of program arguments. The first element is the name of the program.
+	Args []string
+	// Stdin, Stdout and Stderr are standard I/O streams of the program
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	in     *bufio.Reader
+	out    *bufio.Writer
+	// Files opened by the program indexed by their handles. Please see openFile()
+	files []*file
+	// Time when the program started
+	start time.Time
+	// State of pseudo random number generator
+	random uint64
+}
+
+// NewInterpreter creates a new interpreter for the program. Standard I/O streams of the process are
+// used by default.
+func NewInterpreter(prog *mir.Program, env *types.Env) *Interpreter {
+	return &Interpreter{
+		prog:   prog,
+		env:    env,
+		Args:   []string{"gocaml"},
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// frame is a scope of a function call.
+type frame struct {
+	vals map[string]value
+	// Arguments of 'jump' instruction. It is set when the body jumps to the beginning of the function
+	jump []value
+}
+
+func (f *frame) get(ident string) value {
+	v, ok := f.vals[ident]
+	if !ok {
+		panic("FATAL: No value was found for identifier: " + ident)
+	}
+	return v
+}
+
+func (f *frame) args(idents []string) []value {
+	vs := make([]value, 0, len(idents))
+	for _, i := range idents {
+		vs = append(vs, f.get(i))
+	}
+	return vs
+}
+
+// abort reports the message to stderr and exits with the status of abort().
+func (it *Interpreter) abort(msg string) {
+	it.out.Flush()
+	fmt.Fprintln(it.Stderr, msg)
+	panic(exit(134))
+}
+
+func (it *Interpreter) fail(pos locerr.Pos, format string, args ...interface{}) {
+	panic(runtimeError{locerr.ErrorfAt(pos, format, args...)})
+}
+
+func (it *Interpreter) callExternal(pos locerr.Pos, name string, args []value) value {
+	ext, ok := it.env.Externals[name]
+	if !ok {
+		panic("FATAL: External symbol not found: " + name)
+	}
+	f, ok := builtins[ext.CName]
+	if !ok {
+		it.fail(pos, "External function '%s' is not available in interpreter", ext.CName)
+	}
+	return f(it, args)
+}
+
+func (it *Interpreter) externalValue(pos locerr.Pos, name string) value {
+	ext, ok := it.env.Externals[name]
+	if !ok {
+		panic("FATAL: External symbol not found: " + name)
+	}
+	switch ext.CName {
+	case "argv":
+		elems := make([]value, 0, len(it.Args))
+		for _, a := range it.Args {
+			elems = append(elems, a)
+		}
+		return &array{elems}
+	case "gocaml_infinity":
+		return math.Inf(1)
+	case "gocaml_nan":
+		return math.NaN()
+	}
+	if _, ok := builtins[ext.CName]; !ok {
+		it.fail(pos, "External symbol '%s' is not available in interpreter", ext.CName)
+	}
+	return external(name)
+}
+
+// call calls the toplevel function. Captures are nil when the function is called directly.
+func (it *Interpreter) call(name string, captures []value, args []value) value {
+	fun, ok := it.prog.Toplevel[name]
+	if !ok {
+		panic("FATAL: Function not found: " + name)
+	}
+	f := &frame{vals: make(map[string]value, len(args)+len(captures))}
+	if captures != nil {
+		for i, c := range it.prog.Closures[name] {
+			f.vals[c] = captures[i]
+		}
+		if fun.Val.IsRecursive {
+			f.vals[name] = &function{name, captures}
+		}
+	}
+	for {
+		for i, p := range fun.Val.Params {
+			f.vals[p] = args[i]
+		}
+		ret := it.evalBlock(f, fun.Val.Body)
+		if f.jump == nil {
+			return ret
+		}
+		args, f.jump = f.jump, nil
+	}
+}
+
+func (it *Interpreter) callValue(pos locerr.Pos, callee value, args []value) value {
+	switch callee := callee.(type) {
+	case *function:
+		return it.call(callee.fun, callee.captures, args)
+	case external:
+		return it.callExternal(pos, string(callee), args)
+	default:
+		panic(fmt.Sprintf("FATAL: Callee is not a function: %v", callee))
+	}
+}
+
+func (it *Interpreter) evalApp(f *frame, app *mir.App, pos locerr.Pos) value {
+	args := f.args(app.Args)
+	switch app.Kind {
+	case mir.EXTERNAL_CALL:
+		return it.callExternal(pos, app.Callee, args)
+	case mir.CLOSURE_CALL:
+		return it.callValue(pos, f.get(app.Callee), args)
+	default:
+		return it.call(app.Callee, nil, args)
+	}
+}
+
+func evalArith(op mir.OperatorKind, lhs, rhs value) value {
+	switch op {
+	case mir.ADD:
+		return lhs.(int64) + rhs.(int64)
+	case mir.SUB:
+		return lhs.(int64) - rhs.(int64)
+	case mir.MUL:
+		return lhs.(int64) * rhs.(int64)
+	case mir.DIV:
+		return lhs.(int64) / rhs.(int64)
+	case mir.MOD:
+		return lhs.(int64) % rhs.(int64)
+	case mir.FADD:
+		return lhs.(float64) + rhs.(float64)
+	case mir.FSUB:
+		return lhs.(float64) - rhs.(float64)
+	case mir.FMUL:
+		return lhs.(float64) * rhs.(float64)
+	case mir.FDIV:
+		return lhs.(float64) / rhs.(float64)
+	case mir.AND:
+		return lhs.(bool) && rhs.(bool)
+	case mir.OR:
+		return lhs.(bool) || rhs.(bool)
+	default:
+		panic("unreachable")
+	}
+}
+
+func evalCompare(op mir.OperatorKind, lhs, rhs value) bool {
+	switch l := lhs.(type) {
+	case int64:
+		r := rhs.(int64)
+		switch op {
+		case mir.LT:
+			return l < r
+		case mir.LTE:
+			return l <= r
+		case mir.GT:
+			return l > r
+		default:
+			return l >= r
+		}
+	case float64:
+		r := rhs.(float64)
+		switch op {
+		case mir.LT:
+			return l < r
+		case mir.LTE:
+			return l <= r
+		case mir.GT:
+			return l > r
+		default:
+			return l >= r
+		}
+	default:
+		panic(fmt.Sprintf("FATAL: Values cannot be compared: %v", lhs))
+	}
+}
+
+func (it *Interpreter) evalInsn(f *frame, insn *mir.Insn) value {
+	switch val := insn.Val.(type) {
+	case *mir.Unit:
+		return unit{}
+	case *mir.Bool:
+		return val.Const
+	case *mir.Int:
+		return val.Const
+	case *mir.Float:
+		return val.Const
+	case *mir.String:
+		return val.Const
+	case *mir.Unary:
+		child := f.get(val.Child)
+		switch val.Op {
+		case mir.NEG:
+			return -child.(int64)
+		case mir.FNEG:
+			return -child.(float64)
+		case mir.NOT:
+			return !child.(bool)
+		default:
+			panic("unreachable")
+		}
+	case *mir.Binary:
+		lhs, rhs := f.get(val.LHS), f.get(val.RHS)
+		switch val.Op {
+		case mir.EQ:
+			return equal(lhs, rhs)
+		case mir.NEQ:
+			if l, ok := lhs.(float64); ok {
+				// Ordered comparison as native code does. NaN is not unequal to anything
+				r := rhs.(float64)
+				return !math.IsNaN(l) && !math.IsNaN(r) && l != r
+			}
+			return !equal(lhs, rhs)
+		case mir.LT, mir.LTE, mir.GT, mir.GTE:
+			return evalCompare(val.Op, lhs, rhs)
+		default:
+			return evalArith(val.Op, lhs, rhs)
+		}
+	case *mir.Ref:
+		return f.get(val.Ident)
+	case *mir.If:
+		if f.get(val.Cond).(bool) {
+			return it.evalBlock(f, val.Then)
+		}
+		return it.evalBlock(f, val.Else)
+	case *mir.Fun:
+		panic("unreachable because IR was closure-transformed")
+	case *mir.App:
+		return it.evalApp(f, val, insn.Pos)
+	case *mir.Tuple:
+		return tuple(f.args(val.Elems))
+	case *mir.TplLoad:
+		return f.get(val.From).(tuple)[val.Index]
+	case *mir.Array:
+		size := f.get(val.Size).(int64)
+		if size < 0 {
+			it.fail(insn.Pos, "Size of array is negative: %d", size)
+		}
+		elem := f.get(val.Elem)
+		elems := make([]value, size)
+		for i := range elems {
+			elems[i] = elem
+		}
+		return &array{elems}
+	case *mir.ArrLit:
+		return &array{f.args(val.Elems)}
+	case *mir.ArrLoad:
+		return f.get(val.From).(*array).elems[f.get(val.Index).(int64)]
+	case *mir.ArrStore:
+		f.get(val.To).(*array).elems[f.get(val.Index).(int64)] = f.get(val.RHS)
+		return unit{}
+	case *mir.ArrLen:
+		return int64(len(f.get(val.Array).(*array).elems))
+	case *mir.BoundsCheck:
+		size := int64(len(f.get(val.Array).(*array).elems))
+		if idx := f.get(val.Index).(int64); idx < 0 || size <= idx {
+			loc := fmt.Sprintf("%s:%d:%d", insn.Pos.File.Path, insn.Pos.Line, insn.Pos.Column)
+			builtins["__gocaml_bounds_fail"](it, []value{loc, idx, size})
+		}
+		return unit{}
+	case *mir.Table:
+		return table{}
+	case *mir.TblLoad:
+		v, ok := f.get(val.From).(table)[f.get(val.Key)]
+		return option{ok, v}
+	case *mir.TblStore:
+		f.get(val.To).(table)[f.get(val.Key)] = f.get(val.RHS)
+		return unit{}
+	case *mir.TblRemove:
+		delete(f.get(val.From).(table), f.get(val.Key))
+		return unit{}
+	case *mir.XRef:
+		return it.externalValue(insn.Pos, val.Ident)
+	case *mir.MakeCls:
+		return &function{val.Fun, f.args(val.Vars)}
+	case *mir.Some:
+		return option{true, f.get(val.Elem)}
+	case *mir.None:
+		return option{}
+	case *mir.IsSome:
+		return f.get(val.OptVal).(option).some
+	case *mir.DerefSome:
+		return f.get(val.SomeVal).(option).elem
+	case *mir.Variant:
+		if val.Payload == "" {
+			return variant{val.Tag, nil}
+		}
+		return variant{val.Tag, f.get(val.Payload)}
+	case *mir.IsVariant:
+		return f.get(val.Target).(variant).tag == val.Tag
+	case *mir.VariantPayload:
+		return f.get(val.Target).(variant).payload
+	case *mir.NOP:
+		return unit{}
+	case *mir.Unreachable:
+		panic("FATAL: Unreachable instruction was executed")
+	case *mir.Jump:
+		f.jump = f.args(val.Args)
+		return unit{}
+	default:
+		panic("unreachable")
+	}
+}
+
+// evalBlock executes instructions in the block and returns the value of the block. It stops when
+// the block jumps to the beginning of the function.
+func (it *Interpreter) evalBlock(f *frame, b *mir.Block) value {
+	var v value = unit{}
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		v = it.evalInsn(f, i)
+		if f.jump != nil {
+			return v
+		}
+		f.vals[i.Ident] = v
+	}
+	return v
+}
+
+func (it *Interpreter) run() (code int, err error) {
+	defer func() {
+		if it.out.Flush() != nil && err == nil {
+			err = locerr.NewError("Cannot write output of program")
+		}
+	}()
+	defer func() {
+		switch r := recover().(type) {
+		case nil:
+		case exit:
+			code = int(r)
+		case runtimeError:
+			err = r.err
+		case runtime.Error:
+			// e.g. Division by zero
+			err = locerr.Notef(locerr.NewError(r.Error()), "Runtime error while interpreting program")
+		default:
+			panic(r)
+		}
+	}()
+	it.evalBlock(&frame{vals: map[string]value{}}, it.prog.Entry)
+	return 0, nil
+}
+
+// Run executes the program and returns its exit status. Error is returned when the program cannot
+// be executed by the interpreter.
+func (it *Interpreter) Run() (int, error) {
+	it.in = bufio.NewReader(it.Stdin)
+	it.out = bufio.NewWriter(it.Stdout)
+	it.files = []*file{{r: it.in}, {w: it.out}, {w: stderr{it}}}
+	it.start = time.Now()
+	it.random = 0
+	defer it.closeFiles()
+	return it.run()
+}
@@ -0,0 +1,258 @@
+package interp
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/opt"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testRun(s *locerr.Source, stdin string) (int, string, string, error) {
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return 0, "", "", err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return 0, "", "", err
+	}
+	prog := closure.Transform(ir)
+	var stdout, stderr bytes.Buffer
+	it := NewInterpreter(prog, env)
+	it.Stdin = strings.NewReader(stdin)
+	it.Stdout = &stdout
+	it.Stderr = &stderr
+	code, err := it.Run()
+	return code, stdout.String(), stderr.String(), err
+}
+
+func TestRunSnippets(t *testing.T) {
+	cases := []struct {
+		what   string
+		code   string
+		stdin  string
+		status int
+		stdout string
+		stderr string
+	}{
+		{
+			what:   "print",
+			code:   "println_int 42; print_str \"foo\"",
+			stdout: "42\nfoo",
+		},
+		{
+			what:   "exit status",
+			code:   "print_str \"bye\"; exit 3; println_str \"unreachable\"",
+			status: 3,
+			stdout: "bye",
+		},
+		{
+			what:   "closure",
+			code:   "let a = 40 in let rec f x = x + a in let g = f in println_int (g 2)",
+			stdout: "42\n",
+		},
+		{
+			what:   "recursive closure",
+			code:   "let a = 1 in let rec f n = if n = 0 then a else n * f (n - 1) in let g = f in println_int (g 5)",
+			stdout: "120\n",
+		},
+		{
+			what:   "external function as value",
+			code:   "let f = println_int in f 42",
+			stdout: "42\n",
+		},
+		{
+			what:   "integer overflow",
+			code:   "println_int (9223372036854775807 + 1)",
+			stdout: "-9223372036854775808\n",
+		},
+		{
+			what:   "float format",
+			code:   "println_float 3.14; println_float 1e20; println_float (0.0 /. 0.0)",
+			stdout: "3.14\n1e+20\nnan\n",
+		},
+		{
+			what:   "equality",
+			code:   "println_bool ((1, Some \"a\") = (1, Some \"a\")); println_bool (Some 1 = None)",
+			stdout: "true\nfalse\n",
+		},
+		{
+			what:   "stdin",
+			code:   "print_str (get_line ()); println_str (get_char ())",
+			stdin:  "foo\nbar",
+			stdout: "foo\nb\n",
+		},
+		{
+			what:   "read lines from stdin",
+			code:   "let rec show l = match l with Some s -> println_str s | None -> println_str \"EOF\" in show (read_line ()); show (input_line 0); show (read_line ())",
+			stdin:  "foo\nbar",
+			stdout: "foo\nbar\nEOF\n",
+		},
+		{
+			what:   "standard streams as files",
+			code:   "let _ = output_string 1 \"out\" in let _ = output_string 2 \"err\" in println_bool (close_file 2)",
+			stdout: "outfalse\n",
+			stderr: "err",
+		},
+		{
+			what:   "bounds check",
+			code:   "let a = Array.make 3 0 in print_str \"before\"; println_int a.(3)",
+			status: 134,
+			stdout: "before",
+			stderr: "Index out of bounds at <dummy>:1:59: index is 3 but size of array is 3\n",
+		},
+		{
+			what:   "assertion",
+			code:   "assert (1 = 2)",
+			status: 134,
+			stderr: "Assertion failed at <dummy>:1:1\n",
+		},
+		{
+			what:   "invalid regular expression",
+			code:   "println_bool (Re.match \"[a-z]+(\" \"abc\")",
+			status: 134,
+			stderr: "Invalid regular expression '[a-z]+(': Missing ')' at offset 7\n",
+		},
+		{
+			what:   "json kind mismatch",
+			code:   "println_int (Json.to_int (Json.of_string \"42\"))",
+			status: 134,
+			stderr: "Json.to_int: Expected int but got string\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			code, stdout, stderr, err := testRun(locerr.NewDummySource(tc.code), tc.stdin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tc.status {
+				t.Errorf("Expected exit status %d but got %d", tc.status, code)
+			}
+			if stdout != tc.stdout {
+				t.Errorf("Expected stdout %q but got %q", tc.stdout, stdout)
+			}
+			if stderr != tc.stderr {
+				t.Errorf("Expected stderr %q but got %q", tc.stderr, stderr)
+			}
+		})
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	_, _, _, err := testRun(locerr.NewDummySource("let z = 0 in println_int (1 / z)"), "")
+	if err == nil {
+		t.Fatal("Division by zero should cause an error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "divide by zero") {
+		t.Fatal("Unexpected error message:", msg)
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	os.Setenv("GOCAML_TEST_GETENV", "hello")
+	defer os.Unsetenv("GOCAML_TEST_GETENV")
+	code := `
+	let rec show name = match getenv name with Some v -> println_str v | None -> println_str "unset" in
+	show "GOCAML_TEST_GETENV";
+	show "GOCAML_TEST_GETENV_UNSET"`
+	_, stdout, _, err := testRun(locerr.NewDummySource(code), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello\nunset\n"; stdout != want {
+		t.Fatalf("Expected stdout %q but got %q", want, stdout)
+	}
+}
+
+func TestFloatNaNComparison(t *testing.T) {
+	code := `
+	let nan = 0.0 /. 0.0 in
+	let rec div x y = x /. y in
+	let n = div 0.0 0.0 in
+	print_bool (nan <> nan); print_bool (n <> n); print_bool (n <> 1.0); print_bool (1.0 <> 2.0)`
+	// Constant folding evaluates the comparison at compile time at -O1
+	for _, level := range []int{0, 1} {
+		ast, err := syntax.Parse(locerr.NewDummySource(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, ir, err := sema.SemanticsCheck(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog := closure.Transform(ir)
+		pm, err := opt.NewPipeline(opt.DefaultPipeline(level, 0), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pm.Run(prog, env); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		it := NewInterpreter(prog, env)
+		it.Stdout = &out
+		if _, err := it.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if want := "falsefalsefalsetrue"; out.String() != want {
+			t.Fatalf("Expected %q at -O%d but got %q", want, level, out.String())
+		}
+	}
+}
+
+// Outputs of these programs depend on the environment where they run
+var environmentDependentTestdata = map[string]struct{}{
+	"argv.ml": {},
+	"file.ml": {},
+}
+
+func TestRunTestdata(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("..", "codegen", "testdata", "*.ml"))
+	if err != nil {
+		panic(err)
+	}
+	for _, input := range inputs {
+		name := filepath.Base(input)
+		if _, ok := environmentDependentTestdata[name]; ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			expected, err := ioutil.ReadFile(strings.TrimSuffix(input, ".ml") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := locerr.NewSourceFromFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				// Some programs in testdata are not accepted by semantic analysis yet
+				t.Skip(err)
+			}
+			var out bytes.Buffer
+			it := NewInterpreter(closure.Transform(ir), env)
+			it.Stdout = &out
+			if _, err := it.Run(); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.TrimRight(string(expected), "\n")
+			if have := strings.TrimRight(out.String(), "\n"); have != want {
+				t.Fatalf("Unexpected output. Expected:\n%s\nbut got:\n%s", want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package interp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSON values of 'Json' module. Encoding and decoding follow runtime/gocamlrt.c so that the
+// interpreter returns the same results as executables. encoding/json is not used since it treats
+// strings as UTF-8 and does not distinguish integers from floats.
+
+type jsonKind int
+
+const (
+	jsonNull jsonKind = iota
+	jsonBool
+	jsonInt
+	jsonFloat
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+var jsonKindNames = [...]string{"null", "bool", "int", "float", "string", "array", "object"}
+
+// Maximum nesting of arrays and objects accepted by decoder
+const jsonMaxDepth = 512
+
+// jsonValue is an immutable JSON value. Keys are only used by objects and have the same length as
+// elems.
+type jsonValue struct {
+	kind  jsonKind
+	b     bool
+	i     int64
+	f     float64
+	s     string
+	elems []*jsonValue
+	keys  []string
+}
+
+func (it *Interpreter) jsonExpect(fun string, v *jsonValue, expected string, kinds ...jsonKind) {
+	for _, k := range kinds {
+		if v.kind == k {
+			return
+		}
+	}
+	it.abort(fmt.Sprintf("Json.%s: Expected %s but got %s", fun, expected, jsonKindNames[v.kind]))
+}
+
+func jsonOfArray(a *array) *jsonValue {
+	elems := make([]*jsonValue, 0, len(a.elems))
+	for _, e := range a.elems {
+		elems = append(elems, e.(*jsonValue))
+	}
+	return &jsonValue{kind: jsonArray, elems: elems}
+}
+
+func jsonOfObject(a *array) *jsonValue {
+	v := &jsonValue{kind: jsonObject, elems: make([]*jsonValue, 0, len(a.elems)), keys: make([]string, 0, len(a.elems))}
+	for _, e := range a.elems {
+		field := e.(tuple)
+		v.keys = append(v.keys, field[0].(string))
+		v.elems = append(v.elems, field[1].(*jsonValue))
+	}
+	return v
+}
+
+func (it *Interpreter) jsonGet(v *jsonValue, idx int64) option {
+	it.jsonExpect("get", v, "array or object", jsonArray, jsonObject)
+	if idx < 0 || idx >= int64(len(v.elems)) {
+		return option{}
+	}
+	return option{true, v.elems[idx]}
+}
+
+func (it *Interpreter) jsonKey(v *jsonValue, idx int64) option {
+	it.jsonExpect("key", v, "object", jsonObject)
+	if idx < 0 || idx >= int64(len(v.keys)) {
+		return option{}
+	}
+	return option{true, v.keys[idx]}
+}
+
+// jsonMember returns the value of the last field with the key
+func (it *Interpreter) jsonMember(v *jsonValue, key string) option {
+	it.jsonExpect("member", v, "object", jsonObject)
+	for i := len(v.keys) - 1; i >= 0; i-- {
+		if v.keys[i] == key {
+			return option{true, v.elems[i]}
+		}
+	}
+	return option{}
+}
+
+// formatJSONFloat formats the float with the fewest digits which are parsed as the same float, as
+// printf("%.*g") does. '.0' is added to integral numbers so that they are decoded as floats again.
+func formatJSONFloat(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "null"
+	}
+	var s string
+	for prec := 1; prec <= 17; prec++ {
+		s = strconv.FormatFloat(f, 'g', prec, 64)
+		if g, _ := strconv.ParseFloat(s, 64); g == f {
+			break
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c != '-' && (c < '0' || '9' < c) {
+			return s
+		}
+	}
+	return s + ".0"
+}
+
+func quoteJSON(out []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	out = append(out, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			out = append(out, '\\', c)
+		case '\b':
+			out = append(out, '\\', 'b')
+		case '\f':
+			out = append(out, '\\', 'f')
+		case '\n':
+			out = append(out, '\\', 'n')
+		case '\r':
+			out = append(out, '\\', 'r')
+		case '\t':
+			out = append(out, '\\', 't')
+		default:
+			if c < 0x20 {
+				out = append(out, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			} else {
+				out = append(out, c)
+			}
+		}
+	}
+	return append(out, '"')
+}
+
+func encodeJSON(out []byte, v *jsonValue) []byte {
+	switch v.kind {
+	case jsonNull:
+		return append(out, "null"...)
+	case jsonBool:
+		return strconv.AppendBool(out, v.b)
+	case jsonInt:
+		return strconv.AppendInt(out, v.i, 10)
+	case jsonFloat:
+		return append(out, formatJSONFloat(v.f)...)
+	case jsonString:
+		return quoteJSON(out, v.s)
+	case jsonArray:
+		out = append(out, '[')
+		for i, e := range v.elems {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			out = encodeJSON(out, e)
+		}
+		return append(out, ']')
+	default:
+		out = append(out, '{')
+		for i, e := range v.elems {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			out = quoteJSON(out, v.keys[i])
+			out = append(out, ':')
+			out = encodeJSON(out, e)
+		}
+		return append(out, '}')
+	}
+}
+
+// jsonDecoder parses JSON text. Methods return false on a syntax error.
+type jsonDecoder struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (d *jsonDecoder) skipSpaces() {
+	for d.pos < len(d.src) {
+		switch d.src[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (d *jsonDecoder) consume(s string) bool {
+	if len(d.src)-d.pos < len(s) || d.src[d.pos:d.pos+len(s)] != s {
+		return false
+	}
+	d.pos += len(s)
+	return true
+}
+
+func (d *jsonDecoder) hex4() (rune, bool) {
+	if len(d.src)-d.pos < 4 {
+		return 0, false
+	}
+	u, err := strconv.ParseUint(d.src[d.pos:d.pos+4], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	d.pos += 4
+	return rune(u), true
+}
+
+func (d *jsonDecoder) str() (string, bool) {
+	d.pos++ // Eat '"'
+	out := []byte{}
+	for d.pos < len(d.src) {
+		c := d.src[d.pos]
+		d.pos++
+		switch {
+		case c == '"':
+			return string(out), true
+		case c < 0x20:
+			return "", false
+		case c != '\\':
+			out = append(out, c)
+			continue
+		}
+		if d.pos >= len(d.src) {
+			return "", false
+		}
+		e := d.src[d.pos]
+		d.pos++
+		switch e {
+		case '"', '\\', '/':
+			out = append(out, e)
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r, ok := d.hex4()
+			if !ok || 0xdc00 <= r && r <= 0xdfff {
+				return "", false
+			}
+			if 0xd800 <= r && r <= 0xdbff {
+				// High surrogate must be followed by low surrogate
+				if !d.consume("\\u") {
+					return "", false
+				}
+				lo, ok := d.hex4()
+				if !ok || lo < 0xdc00 || 0xdfff < lo {
+					return "", false
+				}
+				r = 0x10000 + (r-0xd800)<<10 + (lo - 0xdc00)
+			}
+			var buf [utf8.UTFMax]byte
+			out = append(out, buf[:utf8.EncodeRune(buf[:], r)]...)
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func (d *jsonDecoder) digits() bool {
+	start := d.pos
+	for d.pos < len(d.src) && isDigit(d.src[d.pos]) {
+		d.pos++
+	}
+	return d.pos > start
+}
+
+// number parses a number. Numbers without fraction and exponent are integers unless they overflow.
+func (d *jsonDecoder) number() (*jsonValue, bool) {
+	start := d.pos
+	if d.src[d.pos] == '-' {
+		d.pos++
+	}
+	if d.pos < len(d.src) && d.src[d.pos] == '0' {
+		d.pos++
+	} else if !d.digits() {
+		return nil, false
+	}
+	integral := true
+	if d.pos < len(d.src) && d.src[d.pos] == '.' {
+		d.pos++
+		if !d.digits() {
+			return nil, false
+		}
+		integral = false
+	}
+	if d.pos < len(d.src) && (d.src[d.pos] == 'e' || d.src[d.pos] == 'E') {
+		d.pos++
+		if d.pos < len(d.src) && (d.src[d.pos] == '+' || d.src[d.pos] == '-') {
+			d.pos++
+		}
+		if !d.digits() {
+			return nil, false
+		}
+		integral = false
+	}
+	lit := d.src[start:d.pos]
+	if integral {
+		if i, err := strconv.ParseInt(lit, 10, 64); err == nil {
+			return &jsonValue{kind: jsonInt, i: i}, true
+		}
+	}
+	// Too large numbers are infinity
+	f, _ := strconv.ParseFloat(lit, 64)
+	return &jsonValue{kind: jsonFloat, f: f}, true
+}
+
+// elements parses elements of an array or fields of an object until the closing character
+func (d *jsonDecoder) elements(v *jsonValue, closing byte) bool {
+	d.depth++
+	if d.depth > jsonMaxDepth {
+		return false
+	}
+	d.pos++ // Eat '[' or '{'
+	d.skipSpaces()
+	if d.consume(string(closing)) {
+		d.depth--
+		return true
+	}
+	for {
+		if v.kind == jsonObject {
+			d.skipSpaces()
+			if d.pos >= len(d.src) || d.src[d.pos] != '"' {
+				return false
+			}
+			k, ok := d.str()
+			if !ok {
+				return false
+			}
+			d.skipSpaces()
+			if !d.consume(":") {
+				return false
+			}
+			v.keys = append(v.keys, k)
+		}
+		e, ok := d.value()
+		if !ok {
+			return false
+		}
+		v.elems = append(v.elems, e)
+		d.skipSpaces()
+		if d.consume(string(closing)) {
+			d.depth--
+			return true
+		}
+		if !d.consume(",") {
+			return false
+		}
+	}
+}
+
+func (d *jsonDecoder) value() (*jsonValue, bool) {
+	d.skipSpaces()
+	if d.pos >= len(d.src) {
+		return nil, false
+	}
+	switch c := d.src[d.pos]; c {
+	case 'n':
+		return &jsonValue{kind: jsonNull}, d.consume("null")
+	case 't':
+		return &jsonValue{kind: jsonBool, b: true}, d.consume("true")
+	case 'f':
+		return &jsonValue{kind: jsonBool, b: false}, d.consume("false")
+	case '"':
+		s, ok := d.str()
+		return &jsonValue{kind: jsonString, s: s}, ok
+	case '[':
+		v := &jsonValue{kind: jsonArray, elems: []*jsonValue{}}
+		return v, d.elements(v, ']')
+	case '{':
+		v := &jsonValue{kind: jsonObject, elems: []*jsonValue{}, keys: []string{}}
+		return v, d.elements(v, '}')
+	default:
+		if c == '-' || isDigit(c) {
+			return d.number()
+		}
+		return nil, false
+	}
+}
+
+// decodeJSON parses the whole string as one JSON value. Spaces around the value are allowed.
+func decodeJSON(s string) option {
+	d := &jsonDecoder{src: s}
+	v, ok := d.value()
+	if !ok {
+		return option{}
+	}
+	d.skipSpaces()
+	if d.pos < len(s) {
+		return option{}
+	}
+	return option{true, v}
+}
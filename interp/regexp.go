@@ -0,0 +1,411 @@
+package interp
+
+import (
+	"fmt"
+)
+
+// Regular expressions of 'Re' module. This is the same engine as runtime/gocamlrt.c so that the
+// interpreter returns the same results as executables. Go's regexp package is not used since it
+// treats strings as UTF-8 and its syntax is different. Please see the runtime for the syntax.
+
+type reOp int
+
+const (
+	reChar reOp = iota
+	reAny
+	reClass
+	reSplit
+	reJmp
+	reBol
+	reEol
+	reMatch
+)
+
+type reInsn struct {
+	op  reOp
+	x   int // Relative offset of jump. Preferred branch of split
+	y   int // Relative offset of another branch of split
+	c   byte
+	set [256]bool
+}
+
+type reProg struct {
+	insns []*reInsn
+	pat   string
+	pos   int
+}
+
+type reThread struct {
+	pc    int
+	start int
+}
+
+// reError is raised by panic while compiling a pattern
+type reError struct {
+	msg string
+}
+
+func (p *reProg) fail(msg string) {
+	panic(&reError{fmt.Sprintf("Invalid regular expression '%s': %s at offset %d", p.pat, msg, p.pos)})
+}
+
+func (p *reProg) eof() bool {
+	return p.pos >= len(p.pat)
+}
+
+func (p *reProg) peek() byte {
+	return p.pat[p.pos]
+}
+
+func (p *reProg) insert(at int, op reOp) *reInsn {
+	i := &reInsn{op: op}
+	p.insns = append(p.insns, nil)
+	copy(p.insns[at+1:], p.insns[at:])
+	p.insns[at] = i
+	return i
+}
+
+func (p *reProg) emit(op reOp) *reInsn {
+	return p.insert(len(p.insns), op)
+}
+
+func reSetRange(set *[256]bool, lo, hi byte) {
+	for c := int(lo); c <= int(hi); c++ {
+		set[c] = true
+	}
+}
+
+// reClassEscape adds the class of '\d', '\w', '\s' or their complements. It returns false when the
+// character is not a class escape.
+func reClassEscape(e byte, set *[256]bool) bool {
+	var s [256]bool
+	switch e {
+	case 'd', 'D':
+		reSetRange(&s, '0', '9')
+	case 'w', 'W':
+		reSetRange(&s, 'a', 'z')
+		reSetRange(&s, 'A', 'Z')
+		reSetRange(&s, '0', '9')
+		reSetRange(&s, '_', '_')
+	case 's', 'S':
+		reSetRange(&s, ' ', ' ')
+		reSetRange(&s, '\t', '\r') // \t \n \v \f \r
+	default:
+		return false
+	}
+	complement := e == 'D' || e == 'W' || e == 'S'
+	for c, b := range s {
+		if b != complement {
+			set[c] = true
+		}
+	}
+	return true
+}
+
+// charEscape parses the character after '\'
+func (p *reProg) charEscape() byte {
+	if p.eof() {
+		p.fail("Trailing '\\'")
+	}
+	e := p.peek()
+	p.pos++
+	switch e {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	}
+	if ('a' <= e && e <= 'z') || ('A' <= e && e <= 'Z') || ('0' <= e && e <= '9') {
+		p.pos--
+		p.fail("Unknown escape")
+	}
+	return e
+}
+
+func (p *reProg) parseClass() {
+	var set [256]bool
+	negate := false
+	if !p.eof() && p.peek() == '^' {
+		negate = true
+		p.pos++
+	}
+	for first := true; ; first = false {
+		if p.eof() {
+			p.fail("Missing ']'")
+		}
+		lo := p.peek()
+		p.pos++
+		if lo == ']' && !first {
+			break
+		}
+		if lo == '\\' {
+			if !p.eof() && reClassEscape(p.peek(), &set) {
+				p.pos++
+				continue
+			}
+			lo = p.charEscape()
+		}
+		hi := lo
+		if p.pos+1 < len(p.pat) && p.peek() == '-' && p.pat[p.pos+1] != ']' {
+			p.pos++
+			hi = p.peek()
+			p.pos++
+			if hi == '\\' {
+				hi = p.charEscape()
+			}
+			if hi < lo {
+				p.fail("Invalid range in character class")
+			}
+		}
+		reSetRange(&set, lo, hi)
+	}
+	if negate {
+		for c := range set {
+			set[c] = !set[c]
+		}
+	}
+	p.emit(reClass).set = set
+}
+
+func (p *reProg) parseAtom() {
+	c := p.peek()
+	p.pos++
+	switch c {
+	case '(':
+		p.parseAlt()
+		if p.eof() {
+			p.fail("Missing ')'")
+		}
+		p.pos++ // Eat ')'
+	case '*', '+', '?':
+		p.pos--
+		p.fail("Nothing to repeat")
+	case '.':
+		p.emit(reAny)
+	case '^':
+		p.emit(reBol)
+	case '$':
+		p.emit(reEol)
+	case '[':
+		p.parseClass()
+	case '\\':
+		var set [256]bool
+		if !p.eof() && reClassEscape(p.peek(), &set) {
+			p.pos++
+			p.emit(reClass).set = set
+			return
+		}
+		p.emit(reChar).c = p.charEscape()
+	default:
+		p.emit(reChar).c = c
+	}
+}
+
+func isRepetition(c byte) bool {
+	return c == '*' || c == '+' || c == '?'
+}
+
+func (p *reProg) parseRepeat() {
+	start := len(p.insns)
+	p.parseAtom()
+	if p.eof() || !isRepetition(p.peek()) {
+		return
+	}
+	q := p.peek()
+	p.pos++
+	l := len(p.insns) - start
+	switch q {
+	case '*':
+		// L: split +1, +(len+2); e; jmp L
+		i := p.insert(start, reSplit)
+		i.x, i.y = 1, l+2
+		p.emit(reJmp).x = -(l + 1)
+	case '+':
+		// L: e; split L, +1
+		i := p.emit(reSplit)
+		i.x, i.y = -l, 1
+	default:
+		// split +1, +(len+1); e
+		i := p.insert(start, reSplit)
+		i.x, i.y = 1, l+1
+	}
+	if !p.eof() && isRepetition(p.peek()) {
+		p.fail("Nested repetition")
+	}
+}
+
+func (p *reProg) parseAlt() {
+	start := len(p.insns)
+	for {
+		for !p.eof() && p.peek() != '|' && p.peek() != ')' {
+			p.parseRepeat()
+		}
+		if p.eof() || p.peek() != '|' {
+			return
+		}
+		p.pos++ // Eat '|'
+		// split +1, +(len+2); e1; jmp END; e2
+		l := len(p.insns) - start
+		i := p.insert(start, reSplit)
+		i.x, i.y = 1, l+2
+		jmp := len(p.insns)
+		p.emit(reJmp)
+		for !p.eof() && p.peek() != '|' && p.peek() != ')' {
+			p.parseRepeat()
+		}
+		p.insns[jmp].x = len(p.insns) - jmp
+	}
+}
+
+// reCompile compiles the pattern. When whole is true, the pattern must match until the end of
+// string. Error is returned as a message for the runtime error.
+func reCompile(pat string, whole bool) (prog *reProg, msg string) {
+	defer func() {
+		if err := recover(); err != nil {
+			e, ok := err.(*reError)
+			if !ok {
+				panic(err)
+			}
+			prog, msg = nil, e.msg
+		}
+	}()
+	p := &reProg{pat: pat}
+	p.parseAlt()
+	if !p.eof() {
+		p.fail("Unmatched ')'")
+	}
+	if whole {
+		p.emit(reEol)
+	}
+	p.emit(reMatch)
+	return p, ""
+}
+
+func (p *reProg) addThread(list []reThread, marks []int, pc, start, pos, size int) []reThread {
+	// Position + 1 marks threads added to the list for the position
+	if marks[pc] == pos+1 {
+		return list
+	}
+	marks[pc] = pos + 1
+	i := p.insns[pc]
+	switch i.op {
+	case reJmp:
+		return p.addThread(list, marks, pc+i.x, start, pos, size)
+	case reSplit:
+		list = p.addThread(list, marks, pc+i.x, start, pos, size)
+		return p.addThread(list, marks, pc+i.y, start, pos, size)
+	case reBol:
+		if pos == 0 {
+			return p.addThread(list, marks, pc+1, start, pos, size)
+		}
+		return list
+	case reEol:
+		if pos == size {
+			return p.addThread(list, marks, pc+1, start, pos, size)
+		}
+		return list
+	default:
+		return append(list, reThread{pc, start})
+	}
+}
+
+// run searches the first match starting at 'from' or later. When anchored is true, the match must
+// start at 'from'.
+func (p *reProg) run(s string, from int, anchored bool) (int, int, bool) {
+	clist := make([]reThread, 0, len(p.insns))
+	nlist := make([]reThread, 0, len(p.insns))
+	marks := make([]int, len(p.insns))
+	matched := false
+	matchStart, matchEnd := 0, 0
+
+	for pos := from; ; pos++ {
+		if !matched && (!anchored || pos == from) {
+			// New thread has the lowest priority
+			clist = p.addThread(clist, marks, 0, pos, pos, len(s))
+		}
+		if len(clist) == 0 && (matched || anchored) {
+			break
+		}
+		nlist = nlist[:0]
+		for _, t := range clist {
+			i := p.insns[t.pc]
+			step := false
+			if pos < len(s) {
+				c := s[pos]
+				switch i.op {
+				case reChar:
+					step = c == i.c
+				case reAny:
+					step = c != '\n'
+				case reClass:
+					step = i.set[c]
+				}
+			}
+			if step {
+				nlist = p.addThread(nlist, marks, t.pc+1, t.start, pos+1, len(s))
+			} else if i.op == reMatch {
+				// Threads after this one have lower priority
+				matched = true
+				matchStart, matchEnd = t.start, pos
+				break
+			}
+		}
+		if pos >= len(s) {
+			break
+		}
+		clist, nlist = nlist, clist
+	}
+
+	return matchStart, matchEnd, matched
+}
+
+func (it *Interpreter) compileRegexp(pat string, whole bool) *reProg {
+	p, msg := reCompile(pat, whole)
+	if p == nil {
+		it.abort(msg)
+	}
+	return p
+}
+
+func (it *Interpreter) reMatch(pat, s string) bool {
+	_, _, ok := it.compileRegexp(pat, true).run(s, 0, true)
+	return ok
+}
+
+func (it *Interpreter) reFind(pat, s string) option {
+	start, end, ok := it.compileRegexp(pat, false).run(s, 0, false)
+	if !ok {
+		return option{}
+	}
+	return option{true, s[start:end]}
+}
+
+// reReplace replaces all matches. After an empty match, the next character is copied to make
+// progress.
+func (it *Interpreter) reReplace(pat, by, s string) string {
+	p := it.compileRegexp(pat, false)
+	out := make([]byte, 0, len(s))
+	pos := 0
+	for pos <= len(s) {
+		start, end, ok := p.run(s, pos, false)
+		if !ok {
+			break
+		}
+		out = append(out, s[pos:start]...)
+		out = append(out, by...)
+		if end > start {
+			pos = end
+			continue
+		}
+		if start < len(s) {
+			out = append(out, s[start])
+		}
+		pos = start + 1
+	}
+	if pos < len(s) {
+		out = append(out, s[pos:]...)
+	}
+	return string(out)
+}
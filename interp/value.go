@@ -0,0 +1,83 @@
+package interp
+
+// Values at runtime are represented with Go values. Since each value knows its own type, the
+// interpreter does not need type information of identifiers. It means that programs need not be
+// monomorphized.
+//
+//   unit     -> unit
+//   bool     -> bool
+//   int      -> int64
+//   float    -> float64
+//   string   -> string (sequence of bytes)
+//   tuple    -> tuple
+//   array    -> *array (arrays are mutable and shared)
+//   table    -> table (Go map keyed by int64 or string)
+//   buffer   -> *bytes.Buffer (buffers are mutable and shared)
+//   json     -> *jsonValue
+//   option   -> option
+//   variant  -> variant (also used for 'Ok' and 'Error' of result)
+//   function -> *function or external (external function used as value)
+
+// value is a value at runtime.
+type value interface{}
+
+type unit struct{}
+
+type tuple []value
+
+type array struct {
+	elems []value
+}
+
+type table map[value]value
+
+type option struct {
+	some bool
+	elem value
+}
+
+type variant struct {
+	tag     string
+	payload value
+}
+
+// function is a toplevel function and values captured by it. Values are in the same order as
+// mir.Program.Closures. Captures are nil for functions which are not closures.
+type function struct {
+	fun      string
+	captures []value
+}
+
+type external string
+
+// equal compares two values structurally as '=' operator does. Functions are equal when they are
+// the same function.
+func equal(l, r value) bool {
+	switch l := l.(type) {
+	case tuple:
+		r := r.(tuple)
+		for i, e := range l {
+			if !equal(e, r[i]) {
+				return false
+			}
+		}
+		return true
+	case option:
+		r := r.(option)
+		if !l.some || !r.some {
+			return l.some == r.some
+		}
+		return equal(l.elem, r.elem)
+	case variant:
+		r := r.(variant)
+		return l.tag == r.tag && equal(l.payload, r.payload)
+	case *function:
+		r, ok := r.(*function)
+		return ok && l.fun == r.fun
+	case *array:
+		// Arrays are compared by identity as pointers in native code
+		return l == r
+	default:
+		return l == r
+	}
+}
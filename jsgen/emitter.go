@@ -0,0 +1,226 @@
+// Package jsgen provides a backend which emits JavaScript from MIR.
+//
+// The emitted code is a single script which contains a small runtime (corresponding to
+// runtime/gocamlrt.c) and runs with Node.js. It does not depend on LLVM.
+//
+// Values are mapped to natural JavaScript values. Integers are BigInt and results of arithmetic are
+// wrapped in 64 bits as the LLVM backend does. Floats are numbers and booleans are booleans. Strings
+// are JavaScript strings whose characters are bytes (0..255) so that lengths and indices are the
+// same as native code. Tuples are arrays, arrays of int and float are typed arrays (BigInt64Array and
+// Float64Array) and other arrays are normal arrays. Tables are Map objects keyed by BigInt or string.
+// Buffers are objects holding chunks of strings. JSON values are objects of kind name and contents.
+// None is null and 'Some x' is {value: x}. Variants are objects of tag name and payload. Closures are
+// JavaScript functions bound to objects of their environments, so calling a function value is a
+// normal function call.
+//
+// Since values are typed dynamically, types in the program need not be monomorphic. Equality of
+// values whose types are not known at compile time is checked structurally by runtime.
+//
+// External symbols which are not defined in runtime refer global variables of JavaScript by their C
+// names. Their arguments and return values are represented as described above.
+package jsgen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"io"
+	"strings"
+)
+
+type nameSet map[string]struct{}
+
+// Identifiers which cannot be used for names of JavaScript functions and variables. Global objects
+// used by emitted code and runtime are also reserved to prevent shadowing them.
+var reservedNames = []string{
+	"arguments", "await", "break", "case", "catch", "class", "const", "continue", "debugger",
+	"default", "delete", "do", "else", "enum", "eval", "export", "extends", "false", "finally", "for",
+	"function", "if", "implements", "import", "in", "instanceof", "interface", "let", "new", "null",
+	"package", "private", "protected", "public", "return", "static", "super", "switch", "this",
+	"throw", "true", "try", "typeof", "var", "void", "while", "with", "yield", "undefined", "NaN",
+	"Infinity", "env", "Array", "BigInt", "BigInt64Array", "Buffer", "Date", "Float64Array", "Map",
+	"Math", "Number", "Object", "String", "TextDecoder", "Uint8Array", "console", "globalThis",
+	"performance", "process", "require", "parseFloat", "parseInt",
+}
+
+const unitValue = "undefined"
+
+// envLayout is the layout of the object of a closure's environment. Unit values are not stored.
+type envLayout struct {
+	fields map[string]string
+	order  []string
+}
+
+type emitter struct {
+	prog *mir.Program
+	env  *types.Env
+	// Names at the scope of the script
+	global nameSet
+	// JavaScript names of toplevel functions
+	funcs map[string]string
+	envs  map[string]*envLayout
+	defs  bytes.Buffer
+}
+
+func isIdentChar(r rune, head bool) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r == '_' || r == '$' || !head && '0' <= r && r <= '9'
+}
+
+// sanitize makes a JavaScript identifier from the MIR identifier. Since '$' is available in
+// JavaScript identifiers, most identifiers are kept as they are. It may not be unique.
+func sanitize(ident string) string {
+	var b bytes.Buffer
+	for i, r := range ident {
+		if isIdentChar(r, i == 0) {
+			b.WriteRune(r)
+		} else if r == '\'' {
+			b.WriteString("_q")
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	s := b.String()
+	if s == "" || strings.HasPrefix(s, "__gocaml") || strings.HasPrefix(s, "gocaml") {
+		// Avoid names of runtime
+		s = "v" + s
+	}
+	return s
+}
+
+func (e *emitter) unique(base string, local nameSet) string {
+	n := base
+	for i := 1; ; i++ {
+		_, g := e.global[n]
+		_, l := local[n]
+		if !g && !l {
+			return n
+		}
+		n = fmt.Sprintf("%s_%d", base, i)
+	}
+}
+
+func (e *emitter) globalName(ident string) string {
+	n := e.unique(sanitize(ident), nil)
+	e.global[n] = struct{}{}
+	return n
+}
+
+func (e *emitter) typeOf(ident string) types.Type {
+	t, ok := e.env.DeclTable[ident]
+	if !ok {
+		panic("FATAL: Type was not found for ident: " + ident)
+	}
+	return t
+}
+
+// resolveType follows references of type variables.
+func resolveType(t types.Type) types.Type {
+	for {
+		v, ok := t.(*types.Var)
+		if !ok || v.Ref == nil {
+			return t
+		}
+		t = v.Ref
+	}
+}
+
+func isUnit(t types.Type) bool {
+	_, ok := resolveType(t).(*types.Unit)
+	return ok
+}
+
+// envOf returns the layout of the environment of the closure. Environment of a linked closure has
+// 'link' property which points to the environment of its enclosing closure (see the note in
+// closure/link.go).
+func (e *emitter) envOf(fun string) *envLayout {
+	if l, ok := e.envs[fun]; ok {
+		return l
+	}
+
+	inParent := nameSet{}
+	if parent, linked := e.prog.EnvLinks[fun]; linked {
+		for _, c := range e.prog.Closures[parent] {
+			inParent[c] = struct{}{}
+		}
+	}
+	l := &envLayout{map[string]string{}, []string{}}
+	taken := nameSet{"link": struct{}{}}
+	for _, c := range e.prog.Closures[fun] {
+		if _, ok := inParent[c]; ok || isUnit(e.typeOf(c)) {
+			continue
+		}
+		f := sanitize(c)
+		for i := 1; ; i++ {
+			if _, ok := taken[f]; !ok {
+				break
+			}
+			f = fmt.Sprintf("%s_%d", sanitize(c), i)
+		}
+		taken[f] = struct{}{}
+		l.fields[c] = f
+		l.order = append(l.order, c)
+	}
+	e.envs[fun] = l
+	return l
+}
+
+// captureExpr returns an expression to load the captured variable from the environment. Variables
+// which are not stored in the environment are loaded following links of environments.
+func (e *emitter) captureExpr(fun, capture, env string) string {
+	l := e.envOf(fun)
+	if f, ok := l.fields[capture]; ok {
+		return env + "." + f
+	}
+	parent, ok := e.prog.EnvLinks[fun]
+	if !ok {
+		panic(fmt.Sprintf("FATAL: Capture '%s' is not found in environment of '%s'", capture, fun))
+	}
+	return e.captureExpr(parent, capture, env+".link")
+}
+
+func (e *emitter) emit(out io.Writer, src *locerr.Source) error {
+	names := e.prog.Toplevel.Names()
+	for _, n := range names {
+		e.funcs[n] = e.globalName(n)
+	}
+	for _, n := range names {
+		newFuncEmitter(e, n).emitFun(e.prog.Toplevel[n])
+	}
+	newFuncEmitter(e, "").emitMain(e.prog.Entry)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Generated by gocaml from %s\n\n", src.Path)
+	buf.WriteString("(function () {\n'use strict';\n\n")
+	buf.WriteString(runtime)
+	buf.WriteByte('\n')
+	buf.Write(e.defs.Bytes())
+	buf.WriteString("\n__gocaml_start(__gocaml_main);\n})();\n")
+	_, err := buf.WriteTo(out)
+	return err
+}
+
+// Emit translates the program into JavaScript and writes it to the output. The output is a script
+// which runs the program when it is evaluated.
+func Emit(out io.Writer, prog *mir.Program, env *types.Env, src *locerr.Source) error {
+	global := make(nameSet, len(reservedNames)+len(runtimeNames)+len(env.Externals))
+	for _, n := range reservedNames {
+		global[n] = struct{}{}
+	}
+	for _, n := range runtimeNames {
+		global[n] = struct{}{}
+	}
+	for _, ext := range env.Externals {
+		global[ext.CName] = struct{}{}
+	}
+	e := &emitter{
+		prog,
+		env,
+		global,
+		map[string]string{},
+		map[string]*envLayout{},
+		bytes.Buffer{},
+	}
+	return e.emit(out, src)
+}
@@ -0,0 +1,216 @@
+package jsgen
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/opt"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEmitJS(s *locerr.Source, passes ...string) (string, error) {
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		return "", err
+	}
+	prog := closure.Transform(ir)
+	pm, err := opt.NewPipeline(passes, 0)
+	if err != nil {
+		return "", err
+	}
+	if err := pm.Run(prog, env); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := Emit(&buf, prog, env, s); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func TestEmitSnippets(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		passes   []string
+		expected []string
+	}{
+		{
+			what: "entry point",
+			code: "println_int 42",
+			expected: []string{
+				"// Generated by gocaml from <dummy>",
+				"function __gocaml_main() {",
+				"println_int(",
+				"__gocaml_start(__gocaml_main);",
+			},
+		},
+		{
+			what: "function",
+			code: "let rec f x = x + x in println_int (f 42)",
+			expected: []string{
+				"function f$t1(x$t2) {",
+				"BigInt.asIntN(64, ",
+				"f$t1(",
+			},
+		},
+		{
+			what: "closure",
+			code: "let a = 42 in let rec f x = x + a in let g = f in println_int (g 1)",
+			expected: []string{
+				"function f$t2(env, x$t3) {",
+				"const a$t1 = env.a$t1;",
+				"{a$t1: a$t1}",
+				"__gocaml_closure(f$t2, ",
+			},
+		},
+		{
+			what: "string",
+			code: `println_str "a\"b\n"`,
+			expected: []string{
+				`"a\"b\n"`,
+			},
+		},
+		{
+			what: "float",
+			code: "let a = 3.14 in println_float (a +. 1.0)",
+			expected: []string{
+				"= 3.14;",
+				"= 1;",
+			},
+		},
+		{
+			what: "typed array",
+			code: "let a = Array.make 3 1 in let b = [| 1.0 |] in let c = Array.make 3 true in println_int a.(0)",
+			expected: []string{
+				"new BigInt64Array(Number(",
+				"Float64Array.of(",
+				"new Array(Number(",
+				"__gocaml_bounds_fail(",
+			},
+		},
+		{
+			what:   "tail call",
+			code:   "let rec f n acc = if n = 0 then acc else f (n - 1) (acc + n) in println_int (f 10 0)",
+			passes: []string{"tail-call"},
+			expected: []string{
+				"loop: for (;;) {",
+				"continue loop;",
+			},
+		},
+		{
+			what: "reserved name",
+			code: "let new = 1 in let process = 2 in println_int (new + process)",
+			expected: []string{
+				"const new$t1 = 1n;",
+				"const process$t2 = 2n;",
+			},
+		},
+		{
+			what: "generic function",
+			code: "let rec eq x y = x = y in println_bool (eq 1 1); println_bool (eq true false)",
+			expected: []string{
+				"__gocaml_equal(",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			js, err := testEmitJS(locerr.NewDummySource(tc.code), tc.passes...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tc.expected {
+				if !strings.Contains(js, e) {
+					t.Errorf("Expected '%s' in JavaScript:\n%s", e, js)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for _, tc := range []struct {
+		ident    string
+		expected string
+	}{
+		{"x$t1", "x$t1"},
+		{"$k1", "$k1"},
+		{"x'", "x_q"},
+		{"lambda.line1.col11$t1", "lambda_line1_col11$t1"},
+		{"gocaml_main", "vgocaml_main"},
+		{"__gocaml_print", "v__gocaml_print"},
+	} {
+		if s := sanitize(tc.ident); s != tc.expected {
+			t.Errorf("Expected '%s' for '%s' but got '%s'", tc.expected, tc.ident, s)
+		}
+	}
+}
+
+// Outputs of these programs depend on the environment where they run
+var environmentDependentTestdata = map[string]struct{}{
+	"argv.ml": {},
+	"file.ml": {},
+}
+
+func TestRunEmittedJS(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("Node.js was not found:", err)
+	}
+	inputs, err := filepath.Glob(filepath.Join("..", "codegen", "testdata", "*.ml"))
+	if err != nil {
+		panic(err)
+	}
+	dir, err := ioutil.TempDir("", "gocaml-jsgen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, input := range inputs {
+		name := filepath.Base(input)
+		if _, ok := environmentDependentTestdata[name]; ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			expected, err := ioutil.ReadFile(strings.TrimSuffix(input, ".ml") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := locerr.NewSourceFromFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			js, err := testEmitJS(s)
+			if err != nil {
+				// Some programs in testdata are not accepted by semantic analysis yet
+				t.Skip(err)
+			}
+			file := filepath.Join(dir, name+".js")
+			if err := ioutil.WriteFile(file, []byte(js), 0666); err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command(node, file).Output()
+			if err != nil {
+				t.Fatalf("Emitted JavaScript failed: %s\n%s", err, js)
+			}
+			want := strings.TrimRight(string(expected), "\n")
+			if have := strings.TrimRight(string(out), "\n"); have != want {
+				t.Fatalf("Unexpected output. Expected:\n%s\nbut got:\n%s", want, have)
+			}
+		})
+	}
+}
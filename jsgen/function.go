@@ -0,0 +1,544 @@
+package jsgen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// funcEmitter emits the body of a function. Each function has its own scope of local names.
+type funcEmitter struct {
+	*emitter
+	// MIR name of the function. It is empty for the entry point
+	name   string
+	locals nameSet
+	vals   map[string]string
+	// Variables of environments made by 'makecls' instructions. They may be shared by following
+	// closures
+	envVals map[string]string
+	body    bytes.Buffer
+	indent  int
+	// JavaScript names of parameters for 'jump' instructions
+	params []string
+}
+
+func newFuncEmitter(e *emitter, name string) *funcEmitter {
+	return &funcEmitter{e, name, nameSet{}, map[string]string{}, map[string]string{}, bytes.Buffer{}, 1, nil}
+}
+
+func (f *funcEmitter) line(format string, args ...interface{}) {
+	f.body.WriteString(strings.Repeat("    ", f.indent))
+	fmt.Fprintf(&f.body, format, args...)
+	f.body.WriteByte('\n')
+}
+
+// fresh returns a new local name which is unique in the function.
+func (f *funcEmitter) fresh(base string) string {
+	n := f.unique(base, f.locals)
+	f.locals[n] = struct{}{}
+	return n
+}
+
+// local names the variable bound to the identifier.
+func (f *funcEmitter) local(ident string) string {
+	n := f.fresh(sanitize(ident))
+	f.vals[ident] = n
+	return n
+}
+
+func (f *funcEmitter) resolve(ident string) string {
+	if n, ok := f.vals[ident]; ok {
+		return n
+	}
+	panic("FATAL: No value was found for identifier: " + ident)
+}
+
+// define binds the value of the expression to a new constant. Unit values are not bound to
+// variables. Only expressions which have side effects are evaluated for them.
+func (f *funcEmitter) define(ident, expr string, pure bool) {
+	if isUnit(f.typeOf(ident)) {
+		if !pure {
+			f.line("%s;", expr)
+		}
+		f.vals[ident] = unitValue
+		return
+	}
+	f.line("const %s = %s;", f.local(ident), expr)
+}
+
+func intLit(i int64) string {
+	return strconv.FormatInt(i, 10) + "n"
+}
+
+func floatLit(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// stringLit returns a JavaScript string literal. Each byte of the string is one character. Bytes
+// other than printable ASCII are escaped.
+func stringLit(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c == '\t':
+			b.WriteString("\\t")
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// wrapInt wraps the result of integer arithmetic in 64 bits.
+func wrapInt(expr string) string {
+	return fmt.Sprintf("BigInt.asIntN(64, %s)", expr)
+}
+
+// typedArray returns the constructor of typed array for the element type. It returns an empty string
+// when the elements are stored in a normal array.
+func typedArray(elem types.Type) string {
+	switch resolveType(elem).(type) {
+	case *types.Int:
+		return "BigInt64Array"
+	case *types.Float:
+		return "Float64Array"
+	default:
+		return ""
+	}
+}
+
+func (f *funcEmitter) elemTypeOf(ident string) types.Type {
+	if arr, ok := resolveType(f.typeOf(ident)).(*types.Array); ok {
+		return arr.Elem
+	}
+	// Element type is not known until instantiation
+	return &types.Var{}
+}
+
+// eqExpr returns an expression which compares two values of the type.
+func (f *funcEmitter) eqExpr(ty types.Type, l, r string) string {
+	switch ty := resolveType(ty).(type) {
+	case *types.Unit:
+		return "true"
+	case *types.Bool, *types.Int, *types.Float, *types.String:
+		return fmt.Sprintf("(%s === %s)", l, r)
+	case *types.Tuple:
+		if len(ty.Elems) == 0 {
+			return "true"
+		}
+		elems := make([]string, 0, len(ty.Elems))
+		for i, e := range ty.Elems {
+			elems = append(elems, f.eqExpr(e, fmt.Sprintf("%s[%d]", l, i), fmt.Sprintf("%s[%d]", r, i)))
+		}
+		return "(" + strings.Join(elems, " && ") + ")"
+	case *types.Fun:
+		return fmt.Sprintf("__gocaml_fun_equal(%s, %s)", l, r)
+	case *types.Option:
+		elem := f.eqExpr(ty.Elem, l+".value", r+".value")
+		return fmt.Sprintf("(%s !== null && %s !== null ? %s : %s === %s)", l, r, elem, l, r)
+	case *types.Result:
+		ok := f.eqExpr(ty.Ok, l+".payload", r+".payload")
+		err := f.eqExpr(ty.Error, l+".payload", r+".payload")
+		return fmt.Sprintf("(%s.tag === %s.tag && (%s.tag === \"Ok\" ? %s : %s))", l, r, l, ok, err)
+	case *types.Var:
+		// Type is not known until instantiation
+		return fmt.Sprintf("__gocaml_equal(%s, %s)", l, r)
+	default:
+		panic("unreachable")
+	}
+}
+
+func (f *funcEmitter) args(idents []string) []string {
+	args := make([]string, 0, len(idents))
+	for _, a := range idents {
+		args = append(args, f.resolve(a))
+	}
+	return args
+}
+
+func (f *funcEmitter) callExpr(app *mir.App) string {
+	args := f.args(app.Args)
+	switch app.Kind {
+	case mir.EXTERNAL_CALL:
+		return fmt.Sprintf("%s(%s)", f.env.Externals[app.Callee].CName, strings.Join(args, ", "))
+	case mir.CLOSURE_CALL:
+		// Closure is a function bound to its environment
+		return fmt.Sprintf("%s(%s)", f.resolve(app.Callee), strings.Join(args, ", "))
+	default:
+		fn, ok := f.funcs[app.Callee]
+		if !ok {
+			panic("FATAL: Function is not found for direct call: " + app.Callee)
+		}
+		if _, ok := f.prog.Closures[app.Callee]; ok {
+			// Closure which captures nothing is called directly. Its environment is never accessed.
+			args = append([]string{"null"}, args...)
+		}
+		return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", "))
+	}
+}
+
+func binaryOp(op mir.OperatorKind) string {
+	switch op {
+	case mir.ADD, mir.FADD:
+		return "+"
+	case mir.SUB, mir.FSUB:
+		return "-"
+	case mir.MUL, mir.FMUL:
+		return "*"
+	case mir.DIV, mir.FDIV:
+		return "/"
+	case mir.MOD:
+		return "%"
+	case mir.LT:
+		return "<"
+	case mir.LTE:
+		return "<="
+	case mir.GT:
+		return ">"
+	case mir.GTE:
+		return ">="
+	case mir.AND:
+		return "&&"
+	case mir.OR:
+		return "||"
+	default:
+		panic("unreachable")
+	}
+}
+
+func (f *funcEmitter) emitBinary(ident string, val *mir.Binary) {
+	lhs, rhs := f.resolve(val.LHS), f.resolve(val.RHS)
+	switch val.Op {
+	case mir.EQ:
+		f.define(ident, f.eqExpr(f.typeOf(val.LHS), lhs, rhs), true)
+	case mir.NEQ:
+		if _, ok := resolveType(f.typeOf(val.LHS)).(*types.Float); ok {
+			// Ordered comparison as native code does. NaN is not unequal to anything
+			f.define(ident, fmt.Sprintf("(%s < %s || %s > %s)", lhs, rhs, lhs, rhs), true)
+			break
+		}
+		f.define(ident, "!"+f.eqExpr(f.typeOf(val.LHS), lhs, rhs), true)
+	case mir.ADD, mir.SUB, mir.MUL, mir.DIV:
+		// Division also overflows when dividing the minimum integer by -1
+		f.define(ident, wrapInt(fmt.Sprintf("%s %s %s", lhs, binaryOp(val.Op), rhs)), true)
+	default:
+		f.define(ident, fmt.Sprintf("%s %s %s", lhs, binaryOp(val.Op), rhs), true)
+	}
+}
+
+func (f *funcEmitter) emitArray(ident string, val *mir.Array) {
+	size, init := f.resolve(val.Size), f.resolve(val.Elem)
+	ctor := typedArray(f.elemTypeOf(ident))
+	if ctor == "" {
+		ctor = "Array"
+	}
+	f.define(ident, fmt.Sprintf("new %s(Number(%s)).fill(%s)", ctor, size, init), true)
+}
+
+func (f *funcEmitter) emitArrLit(ident string, val *mir.ArrLit) {
+	elems := strings.Join(f.args(val.Elems), ", ")
+	if ctor := typedArray(f.elemTypeOf(ident)); ctor != "" {
+		f.define(ident, fmt.Sprintf("%s.of(%s)", ctor, elems), true)
+		return
+	}
+	f.define(ident, "["+elems+"]", true)
+}
+
+func (f *funcEmitter) emitMakeCls(ident string, val *mir.MakeCls) {
+	fn, ok := f.funcs[val.Fun]
+	if !ok {
+		panic("FATAL: Closure for function not found: " + val.Fun)
+	}
+
+	envVal := "null"
+	if shared, ok := f.prog.SharedEnvs[ident]; ok {
+		// Reuse the environment of the preceding closure which captures the same variables
+		envVal = f.envVals[shared]
+	} else {
+		l := f.envOf(val.Fun)
+		props := make([]string, 0, len(l.order)+1)
+		if _, linked := f.prog.EnvLinks[val.Fun]; linked {
+			// Linked closure is always made in its enclosing closure. Link to the environment of it.
+			if f.name == "" {
+				panic("FATAL: Linked closure '" + val.Fun + "' is made outside closure")
+			}
+			props = append(props, "link: env")
+		}
+		for i, c := range f.prog.Closures[val.Fun] {
+			if field, ok := l.fields[c]; ok {
+				props = append(props, fmt.Sprintf("%s: %s", field, f.resolve(val.Vars[i])))
+			}
+		}
+		if len(props) > 0 {
+			envVal = f.fresh(sanitize(ident) + "_env")
+			f.line("const %s = {%s};", envVal, strings.Join(props, ", "))
+		}
+	}
+	f.envVals[ident] = envVal
+	f.define(ident, fmt.Sprintf("__gocaml_closure(%s, %s)", fn, envVal), true)
+}
+
+// emitBoundsCheck checks the index is in bounds of the array. When it is out of bounds, runtime
+// reports the location and aborts the program.
+func (f *funcEmitter) emitBoundsCheck(ident string, check *mir.BoundsCheck, pos locerr.Pos) {
+	arr, idx := f.resolve(check.Array), f.resolve(check.Index)
+	loc := fmt.Sprintf("%s:%d:%d", pos.File.Path, pos.Line, pos.Column)
+	f.line("if (%s < 0n || %s >= %s.length) {", idx, idx, arr)
+	f.line("    __gocaml_bounds_fail(%s, %s, BigInt(%s.length));", stringLit(loc), idx, arr)
+	f.line("}")
+	f.vals[ident] = unitValue
+}
+
+func (f *funcEmitter) emitIf(ident string, val *mir.If) {
+	cond := f.resolve(val.Cond)
+	result := ""
+	if !isUnit(f.typeOf(ident)) {
+		result = f.local(ident)
+		f.line("let %s;", result)
+	} else {
+		f.vals[ident] = unitValue
+	}
+
+	branch := func(b *mir.Block) {
+		f.indent++
+		v := f.emitBlock(b)
+		if result != "" {
+			f.line("%s = %s;", result, v)
+		}
+		f.indent--
+	}
+	f.line("if (%s) {", cond)
+	branch(val.Then)
+	f.line("} else {")
+	branch(val.Else)
+	f.line("}")
+}
+
+// emitJump assigns arguments to parameters and continues the loop of the function body. When two
+// or more parameters are changed, they are assigned at once by destructuring assignment.
+func (f *funcEmitter) emitJump(ident string, val *mir.Jump) {
+	f.vals[ident] = unitValue
+	params, args := []string{}, []string{}
+	for i, a := range f.args(val.Args) {
+		if a != f.params[i] {
+			params = append(params, f.params[i])
+			args = append(args, a)
+		}
+	}
+	switch len(params) {
+	case 0:
+	case 1:
+		f.line("%s = %s;", params[0], args[0])
+	default:
+		f.line("[%s] = [%s];", strings.Join(params, ", "), strings.Join(args, ", "))
+	}
+	f.line("continue loop;")
+}
+
+func (f *funcEmitter) emitInsn(insn *mir.Insn) {
+	ident := insn.Ident
+	switch val := insn.Val.(type) {
+	case *mir.Unit:
+		f.vals[ident] = unitValue
+	case *mir.Bool:
+		f.define(ident, strconv.FormatBool(val.Const), true)
+	case *mir.Int:
+		f.define(ident, intLit(val.Const), true)
+	case *mir.Float:
+		f.define(ident, floatLit(val.Const), true)
+	case *mir.String:
+		f.define(ident, stringLit(val.Const), true)
+	case *mir.Unary:
+		child := f.resolve(val.Child)
+		switch val.Op {
+		case mir.NEG:
+			f.define(ident, wrapInt("-"+child), true)
+		case mir.FNEG:
+			f.define(ident, "-"+child, true)
+		case mir.NOT:
+			f.define(ident, "!"+child, true)
+		default:
+			panic("unreachable")
+		}
+	case *mir.Binary:
+		f.emitBinary(ident, val)
+	case *mir.Ref:
+		f.define(ident, f.resolve(val.Ident), true)
+	case *mir.If:
+		f.emitIf(ident, val)
+	case *mir.Fun:
+		panic("unreachable because IR was closure-transformed")
+	case *mir.App:
+		f.define(ident, f.callExpr(val), false)
+	case *mir.Tuple:
+		f.define(ident, "["+strings.Join(f.args(val.Elems), ", ")+"]", true)
+	case *mir.TplLoad:
+		f.define(ident, fmt.Sprintf("%s[%d]", f.resolve(val.From), val.Index), true)
+	case *mir.Array:
+		f.emitArray(ident, val)
+	case *mir.ArrLit:
+		f.emitArrLit(ident, val)
+	case *mir.ArrLoad:
+		f.define(ident, fmt.Sprintf("%s[Number(%s)]", f.resolve(val.From), f.resolve(val.Index)), true)
+	case *mir.ArrStore:
+		f.define(ident, fmt.Sprintf("%s[Number(%s)] = %s", f.resolve(val.To), f.resolve(val.Index), f.resolve(val.RHS)), false)
+	case *mir.ArrLen:
+		f.define(ident, fmt.Sprintf("BigInt(%s.length)", f.resolve(val.Array)), true)
+	case *mir.BoundsCheck:
+		f.emitBoundsCheck(ident, val, insn.Pos)
+	case *mir.Table:
+		f.define(ident, "new Map()", true)
+	case *mir.TblLoad:
+		t, k := f.resolve(val.From), f.resolve(val.Key)
+		f.define(ident, fmt.Sprintf("%s.has(%s) ? {value: %s.get(%s)} : null", t, k, t, k), true)
+	case *mir.TblStore:
+		f.define(ident, fmt.Sprintf("%s.set(%s, %s)", f.resolve(val.To), f.resolve(val.Key), f.resolve(val.RHS)), false)
+	case *mir.TblRemove:
+		f.define(ident, fmt.Sprintf("%s.delete(%s)", f.resolve(val.From), f.resolve(val.Key)), false)
+	case *mir.XRef:
+		ext, ok := f.env.Externals[val.Ident]
+		if !ok {
+			panic("FATAL: Type for external value not found: " + val.Ident)
+		}
+		// External function is also a JavaScript function. It can be used as a closure as it is
+		f.define(ident, ext.CName, true)
+	case *mir.MakeCls:
+		f.emitMakeCls(ident, val)
+	case *mir.Some:
+		f.define(ident, fmt.Sprintf("{value: %s}", f.resolve(val.Elem)), true)
+	case *mir.None:
+		f.define(ident, "null", true)
+	case *mir.IsSome:
+		f.define(ident, f.resolve(val.OptVal)+" !== null", true)
+	case *mir.DerefSome:
+		f.define(ident, f.resolve(val.SomeVal)+".value", true)
+	case *mir.Variant:
+		payload := "null"
+		if val.Payload != "" {
+			payload = f.resolve(val.Payload)
+		}
+		f.define(ident, fmt.Sprintf("{tag: %s, payload: %s}", stringLit(val.Tag), payload), true)
+	case *mir.IsVariant:
+		f.define(ident, fmt.Sprintf("%s.tag === %s", f.resolve(val.Target), stringLit(val.Tag)), true)
+	case *mir.VariantPayload:
+		f.define(ident, f.resolve(val.Target)+".payload", true)
+	case *mir.Unreachable:
+		// Preceding call never returns. The value is never used.
+		f.vals[ident] = unitValue
+	case *mir.Jump:
+		f.emitJump(ident, val)
+	case *mir.NOP:
+		panic("unreachable")
+	default:
+		panic("unreachable")
+	}
+}
+
+// emitBlock emits instructions in the block and returns the value of the block.
+func (f *funcEmitter) emitBlock(b *mir.Block) string {
+	last := ""
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		f.emitInsn(i)
+		last = i.Ident
+	}
+	return f.resolve(last)
+}
+
+// containsJump returns true when the block contains 'jump' instruction introduced by tail call
+// optimization.
+func containsJump(b *mir.Block) bool {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Jump:
+			return true
+		case *mir.If:
+			if containsJump(v.Then) || containsJump(v.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *funcEmitter) emitFun(insn mir.FunInsn) {
+	fun := insn.Val
+	_, isClosure := f.prog.Closures[insn.Name]
+
+	params := make([]string, 0, len(fun.Params)+1)
+	if isClosure {
+		params = append(params, "env")
+	}
+	for _, p := range fun.Params {
+		n := f.local(p)
+		params = append(params, n)
+		f.params = append(f.params, n)
+	}
+
+	if isClosure {
+		// Expose captures of closure
+		for _, c := range f.prog.Closures[insn.Name] {
+			if isUnit(f.typeOf(c)) {
+				f.vals[c] = unitValue
+				continue
+			}
+			load := f.captureExpr(insn.Name, c, "env")
+			f.line("const %s = %s;", f.local(c), load)
+		}
+		if fun.IsRecursive {
+			// The closure itself is used in its body. Its closure object is made from its environment.
+			f.line("const %s = __gocaml_closure(%s, env);", f.local(insn.Name), f.funcs[insn.Name])
+		}
+	}
+
+	// Tail calls are jumps to the beginning of the loop
+	loop := containsJump(fun.Body)
+	if loop {
+		f.line("loop: for (;;) {")
+		f.indent++
+	}
+	ret := f.emitBlock(fun.Body)
+	if ret != unitValue {
+		f.line("return %s;", ret)
+	} else if loop {
+		f.line("return;")
+	}
+	if loop {
+		f.indent--
+		f.line("}")
+	}
+
+	fmt.Fprintf(&f.defs, "// %s %s\n", insn.Name, insn.Pos.String())
+	fmt.Fprintf(&f.defs, "function %s(%s) {\n", f.funcs[insn.Name], strings.Join(params, ", "))
+	f.defs.Write(f.body.Bytes())
+	f.defs.WriteString("}\n\n")
+}
+
+func (f *funcEmitter) emitMain(entry *mir.Block) {
+	f.emitBlock(entry)
+	f.defs.WriteString("function __gocaml_main() {\n")
+	f.defs.Write(f.body.Bytes())
+	f.defs.WriteString("}\n")
+}
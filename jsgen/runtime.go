@@ -0,0 +1,1508 @@
+package jsgen
+
+// Names defined in runtime. Names of external symbols in runtime are the same as C names of them
+// so that calls to external functions are emitted in the same way for any external symbol.
+var runtimeNames = []string{
+	"__gocaml_node",
+	"__gocaml_fs",
+	"__gocaml_stdout",
+	"__gocaml_write_fd",
+	"__gocaml_decode",
+	"__gocaml_flush",
+	"__gocaml_print",
+	"__GocamlExit",
+	"__gocaml_abort",
+	"__gocaml_start",
+	"__gocaml_closure",
+	"__gocaml_fun_equal",
+	"__gocaml_equal",
+	"__gocaml_format_float",
+	"__gocaml_read_byte",
+	"__gocaml_files",
+	"__gocaml_open",
+	"__gocaml_read_line",
+	"__gocaml_random_state",
+	"__gocaml_random_next",
+	"__gocaml_re_ops",
+	"__gocaml_re_compile",
+	"__gocaml_re_run",
+	"__gocaml_json_kinds",
+	"__gocaml_json_expect",
+	"__gocaml_json_float",
+	"__gocaml_json_quote",
+	"__gocaml_json_encode",
+	"__gocaml_json_parse",
+	"__gocaml_main",
+}
+
+// runtime is the small runtime library put at the beginning of the emitted code. It corresponds to
+// runtime/gocamlrt.c. Output is buffered and written to stdout synchronously on Node.js. On other
+// hosts, it is written to console line by line.
+const runtime = `// Runtime of GoCaml for JavaScript. Integers are BigInt wrapped in 64 bits. Strings are sequences
+// of bytes; code of each character is 0..255.
+
+var __gocaml_node = typeof process !== 'undefined' && typeof require === 'function';
+var __gocaml_fs = __gocaml_node ? require('fs') : null;
+var __gocaml_stdout = '';
+
+function __gocaml_write_fd(fd, s) {
+    var buf = Buffer.from(s, 'latin1');
+    var off = 0;
+    while (off < buf.length) {
+        try {
+            off += __gocaml_fs.writeSync(fd, buf, off, buf.length - off);
+        } catch (e) {
+            if (e.code !== 'EAGAIN') {
+                throw e;
+            }
+        }
+    }
+}
+
+function __gocaml_decode(s) {
+    if (typeof TextDecoder === 'undefined') {
+        return s;
+    }
+    var bytes = new Uint8Array(s.length);
+    for (var i = 0; i < s.length; i++) {
+        bytes[i] = s.charCodeAt(i);
+    }
+    return new TextDecoder().decode(bytes);
+}
+
+function __gocaml_flush(exiting) {
+    var out = __gocaml_stdout;
+    if (__gocaml_node) {
+        __gocaml_stdout = '';
+        if (out !== '') {
+            __gocaml_write_fd(1, out);
+        }
+        return;
+    }
+    // console.log always appends a newline. An incomplete line is kept until exit
+    var end = exiting ? out.length : out.lastIndexOf('\n') + 1;
+    if (end === 0) {
+        return;
+    }
+    __gocaml_stdout = out.slice(end);
+    out = out.slice(0, end);
+    console.log(__gocaml_decode(out.charAt(out.length - 1) === '\n' ? out.slice(0, -1) : out));
+}
+
+function __gocaml_print(s) {
+    __gocaml_stdout += s;
+    if (__gocaml_stdout.length >= 8192) {
+        __gocaml_flush(false);
+    }
+}
+
+// Thrown to exit the program with the status code
+function __GocamlExit(code) {
+    this.code = code;
+}
+
+// Reports the message to stderr and exits with the status of abort()
+function __gocaml_abort(msg) {
+    __gocaml_flush(true);
+    if (__gocaml_node) {
+        __gocaml_write_fd(2, msg + '\n');
+    } else {
+        console.error(__gocaml_decode(msg));
+    }
+    throw new __GocamlExit(134);
+}
+
+function __gocaml_start(main) {
+    var code = 0;
+    try {
+        main();
+    } catch (e) {
+        if (!(e instanceof __GocamlExit)) {
+            __gocaml_flush(true);
+            throw e;
+        }
+        code = e.code;
+    }
+    __gocaml_flush(true);
+    if (__gocaml_node) {
+        process.exitCode = code;
+    }
+}
+
+// Closure is a function bound to its environment. Its code is remembered to compare closures
+function __gocaml_closure(fun, env) {
+    var cls = fun.bind(null, env);
+    cls.fun = fun;
+    return cls;
+}
+
+function __gocaml_fun_equal(l, r) {
+    return l === r || (l.fun !== undefined && l.fun === r.fun);
+}
+
+// Structural equality for values whose types are not known at compile time
+function __gocaml_equal(l, r) {
+    if (l === r) {
+        return true;
+    }
+    if (typeof l === 'function') {
+        return __gocaml_fun_equal(l, r);
+    }
+    if (l === null || r === null || typeof l !== 'object') {
+        return false;
+    }
+    if (Array.isArray(l)) {
+        for (var i = 0; i < l.length; i++) {
+            if (!__gocaml_equal(l[i], r[i])) {
+                return false;
+            }
+        }
+        return true;
+    }
+    if ('tag' in l) {
+        return l.tag === r.tag && __gocaml_equal(l.payload, r.payload);
+    }
+    return __gocaml_equal(l.value, r.value);
+}
+
+// Formats the float as printf("%g") does
+function __gocaml_format_float(d) {
+    if (Number.isNaN(d)) {
+        return 'nan';
+    }
+    if (!Number.isFinite(d)) {
+        return d < 0 ? '-inf' : 'inf';
+    }
+    if (d === 0) {
+        return Object.is(d, -0) ? '-0' : '0';
+    }
+    var strip = function (s) {
+        return s.indexOf('.') < 0 ? s : s.replace(/0+$/, '').replace(/\.$/, '');
+    };
+    var exp = d.toExponential(5).split('e');
+    var e = parseInt(exp[1], 10);
+    if (e < -4 || e >= 6) {
+        var digits = exp[1].slice(1);
+        return strip(exp[0]) + 'e' + exp[1].charAt(0) + (digits.length < 2 ? '0' + digits : digits);
+    }
+    return strip(d.toFixed(5 - e));
+}
+
+// Reads one byte from the file descriptor. It returns -1 at EOF
+function __gocaml_read_byte(fd) {
+    if (!__gocaml_node) {
+        return -1;
+    }
+    var buf = Buffer.alloc(1);
+    for (;;) {
+        try {
+            return __gocaml_fs.readSync(fd, buf, 0, 1, null) === 0 ? -1 : buf[0];
+        } catch (e) {
+            if (e.code === 'EOF') {
+                return -1;
+            }
+            if (e.code !== 'EAGAIN') {
+                throw e;
+            }
+        }
+    }
+}
+
+var gocaml_infinity = Infinity;
+var gocaml_nan = NaN;
+var argv = !__gocaml_node ? ['gocaml'] : process.argv.slice(1).map(function (a) {
+    return Buffer.from(a, 'utf8').toString('latin1');
+});
+
+function print_int(i) {
+    __gocaml_print(i.toString());
+}
+
+function print_bool(b) {
+    __gocaml_print(b ? 'true' : 'false');
+}
+
+function print_float(d) {
+    __gocaml_print(__gocaml_format_float(d));
+}
+
+function print_str(s) {
+    __gocaml_print(s);
+}
+
+function println_int(i) {
+    __gocaml_print(i.toString() + '\n');
+}
+
+function println_bool(b) {
+    __gocaml_print(b ? 'true\n' : 'false\n');
+}
+
+function println_float(d) {
+    __gocaml_print(__gocaml_format_float(d) + '\n');
+}
+
+function println_str(s) {
+    __gocaml_print(s + '\n');
+}
+
+function float_to_int(f) {
+    if (!Number.isFinite(f)) {
+        return -(2n ** 63n);
+    }
+    return BigInt.asIntN(64, BigInt(Math.trunc(f)));
+}
+
+function int_to_float(i) {
+    return Number(i);
+}
+
+function str_length(s) {
+    return BigInt(s.length);
+}
+
+function __gocaml_assert_fail(loc) {
+    __gocaml_abort('Assertion failed at ' + loc);
+}
+
+function __gocaml_bounds_fail(loc, index, size) {
+    __gocaml_abort('Index out of bounds at ' + loc + ': index is ' + index + ' but size of array is ' + size);
+}
+
+function __gocaml_exit(code) {
+    throw new __GocamlExit(Number(BigInt.asUintN(8, code)));
+}
+
+// Escapes '"', '\\' and control characters as string literal of GoCaml
+function __gocaml_str_escape(s) {
+    var ret = '';
+    for (var i = 0; i < s.length; i++) {
+        var c = s.charCodeAt(i);
+        if (c === 0x22 || c === 0x5c) {
+            ret += '\\' + s[i];
+        } else if (c === 0x0a) {
+            ret += '\\n';
+        } else if (c === 0x09) {
+            ret += '\\t';
+        } else if (c < 0x20 || c === 0x7f) {
+            ret += '\\x' + (c < 0x10 ? '0' : '') + c.toString(16);
+        } else {
+            ret += s[i];
+        }
+    }
+    return ret;
+}
+
+function str_concat(l, r) {
+    return l + r;
+}
+
+// Slice [start,last) like Go's str[start:last]
+function str_sub(s, start, last) {
+    var size = BigInt(s.length);
+    if (start < 0n) {
+        start = 0n;
+    } else if (start > size) {
+        start = size;
+    }
+    if (last < 0n) {
+        last = 0n;
+    } else if (last > size) {
+        last = size;
+    }
+    return s.slice(Number(start), Number(last));
+}
+
+function str_index(s, sub) {
+    return BigInt(s.indexOf(sub));
+}
+
+// Empty separator splits the string into bytes
+function str_split(s, sep) {
+    return s.split(sep);
+}
+
+function str_join(a, sep) {
+    return a.join(sep);
+}
+
+function str_uppercase(s) {
+    return s.replace(/[a-z]+/g, function (m) { return m.toUpperCase(); });
+}
+
+function str_lowercase(s) {
+    return s.replace(/[A-Z]+/g, function (m) { return m.toLowerCase(); });
+}
+
+function int_to_str(i) {
+    return i.toString();
+}
+
+function float_to_str(f) {
+    return __gocaml_format_float(f);
+}
+
+function str_to_int(s) {
+    var m = /^[ \t\n\v\f\r]*([+-]?[0-9]+)/.exec(s);
+    return m === null ? 0n : BigInt.asIntN(32, BigInt(m[1]));
+}
+
+function str_to_float(s) {
+    var t = s.replace(/^[ \t\n\v\f\r]+/, '');
+    var m = /^([+-]?)(inf|nan)/i.exec(t);
+    if (m !== null) {
+        var v = m[2].toLowerCase() === 'inf' ? Infinity : NaN;
+        return m[1] === '-' ? -v : v;
+    }
+    var f = parseFloat(t);
+    return Number.isNaN(f) ? 0 : f;
+}
+
+function get_line(_) {
+    __gocaml_flush(false);
+    var s = '';
+    while (s.length < 1023) {
+        var c = __gocaml_read_byte(0);
+        if (c < 0) {
+            break;
+        }
+        s += String.fromCharCode(c);
+        if (c === 10) {
+            break;
+        }
+    }
+    return s;
+}
+
+function get_char(_) {
+    __gocaml_flush(false);
+    var c = __gocaml_read_byte(0);
+    return String.fromCharCode(c < 0 ? 0xff : c);
+}
+
+function to_char_code(s) {
+    if (s.length === 0) {
+        return 0n;
+    }
+    // Characters are signed as int8_t in C runtime
+    var c = s.charCodeAt(0);
+    return BigInt(c >= 128 ? c - 256 : c);
+}
+
+function from_char_code(i) {
+    return String.fromCharCode(Number(BigInt.asUintN(8, i)));
+}
+
+// Memory is managed by JavaScript engine
+function do_garbage_collection(_) {}
+function enable_garbage_collection(_) {}
+function disable_garbage_collection(_) {}
+
+function bit_and(l, r) {
+    return l & r;
+}
+
+function bit_or(l, r) {
+    return l | r;
+}
+
+function bit_xor(l, r) {
+    return l ^ r;
+}
+
+function bit_rsft(l, r) {
+    return l >> r;
+}
+
+function bit_lsft(l, r) {
+    return BigInt.asIntN(64, l << r);
+}
+
+function bit_inv(i) {
+    return ~i;
+}
+
+function ceil(f) {
+    return Math.ceil(f);
+}
+
+function floor(f) {
+    return Math.floor(f);
+}
+
+function exp(f) {
+    return Math.exp(f);
+}
+
+function log(f) {
+    return Math.log(f);
+}
+
+function log10(f) {
+    return Math.log10(f);
+}
+
+function log1p(f) {
+    return Math.log1p(f);
+}
+
+function sqrt(f) {
+    return Math.sqrt(f);
+}
+
+function sin(f) {
+    return Math.sin(f);
+}
+
+function cos(f) {
+    return Math.cos(f);
+}
+
+function tan(f) {
+    return Math.tan(f);
+}
+
+function asin(f) {
+    return Math.asin(f);
+}
+
+function acos(f) {
+    return Math.acos(f);
+}
+
+function atan(f) {
+    return Math.atan(f);
+}
+
+function atan2(y, x) {
+    return Math.atan2(y, x);
+}
+
+function sinh(f) {
+    return Math.sinh(f);
+}
+
+function cosh(f) {
+    return Math.cosh(f);
+}
+
+function tanh(f) {
+    return Math.tanh(f);
+}
+
+function asinh(f) {
+    return Math.asinh(f);
+}
+
+function acosh(f) {
+    return Math.acosh(f);
+}
+
+function atanh(f) {
+    return Math.atanh(f);
+}
+
+function hypot(x, y) {
+    return Math.hypot(x, y);
+}
+
+function fmod(x, y) {
+    return x % y;
+}
+
+function fabs(f) {
+    return Math.abs(f);
+}
+
+// NaN is ignored as fmin() and fmax() in C
+function fmin(x, y) {
+    return Number.isNaN(x) ? y : Number.isNaN(y) ? x : Math.min(x, y);
+}
+
+function fmax(x, y) {
+    return Number.isNaN(x) ? y : Number.isNaN(y) ? x : Math.max(x, y);
+}
+
+function gocaml_min(l, r) {
+    return l < r ? l : r;
+}
+
+function gocaml_max(l, r) {
+    return l > r ? l : r;
+}
+
+function gocaml_modf(f) {
+    var i = Math.trunc(f);
+    if (Number.isNaN(f)) {
+        return [f, f];
+    }
+    var frac = Number.isFinite(f) ? f - i : 0;
+    return [frac === 0 && f < 0 ? -0 : frac, i];
+}
+
+function gocaml_frexp(f) {
+    if (f === 0 || !Number.isFinite(f)) {
+        return [f, 0n];
+    }
+    var e = Math.max(-1023, Math.floor(Math.log2(Math.abs(f))) + 1);
+    var m = f * Math.pow(2, -e);
+    while (Math.abs(m) < 0.5) {
+        m *= 2;
+        e--;
+    }
+    while (Math.abs(m) >= 1) {
+        m /= 2;
+        e++;
+    }
+    return [m, BigInt(e)];
+}
+
+function gocaml_ldexp(f, i) {
+    return f * Math.pow(2, Number(i));
+}
+
+function time_now(_) {
+    return BigInt(Math.floor(Date.now() / 1000));
+}
+
+// Processor time on Node.js. Elapsed time is used on other hosts
+function gocaml_clock(_) {
+    if (__gocaml_node) {
+        var u = process.cpuUsage();
+        return (u.user + u.system) / 1e6;
+    }
+    return performance.now() / 1e3;
+}
+
+function gocaml_monotonic_ns(_) {
+    if (__gocaml_node) {
+        return BigInt.asIntN(64, process.hrtime.bigint());
+    }
+    return BigInt(Math.round(performance.now() * 1e6));
+}
+
+// SplitMix64 as runtime. The seed is 0 until random_seed is called
+var __gocaml_random_state = 0n;
+
+function __gocaml_random_next() {
+    var z = __gocaml_random_state = BigInt.asUintN(64, __gocaml_random_state + 0x9E3779B97F4A7C15n);
+    z = BigInt.asUintN(64, (z ^ (z >> 30n)) * 0xBF58476D1CE4E5B9n);
+    z = BigInt.asUintN(64, (z ^ (z >> 27n)) * 0x94D049BB133111EBn);
+    return z ^ (z >> 31n);
+}
+
+function gocaml_random_seed(seed) {
+    __gocaml_random_state = BigInt.asUintN(64, seed);
+}
+
+function gocaml_random_int(bound) {
+    if (bound <= 0n) {
+        return 0n;
+    }
+    for (;;) {
+        // Reject values in the last incomplete range to avoid modulo bias
+        var x = __gocaml_random_next() >> 1n;
+        var r = x % bound;
+        if (x - r <= (1n << 63n) - bound) {
+            return r;
+        }
+    }
+}
+
+function gocaml_random_float(_) {
+    return Number(__gocaml_random_next() >> 11n) / 9007199254740992;
+}
+
+function read_file(name) {
+    if (!__gocaml_node) {
+        return null;
+    }
+    try {
+        return {value: __gocaml_fs.readFileSync(Buffer.from(name, 'latin1').toString('utf8'), 'latin1')};
+    } catch (e) {
+        return null;
+    }
+}
+
+function write_file(name, content) {
+    if (!__gocaml_node) {
+        return false;
+    }
+    try {
+        __gocaml_fs.writeFileSync(Buffer.from(name, 'latin1').toString('utf8'), Buffer.from(content, 'latin1'));
+        return true;
+    } catch (e) {
+        return false;
+    }
+}
+
+// Files opened by the program indexed by their handles. 0, 1 and 2 are stdin, stdout and stderr
+var __gocaml_files = [null, null, null];
+
+function __gocaml_open(name, flags) {
+    if (!__gocaml_node) {
+        return -1n;
+    }
+    var fd;
+    try {
+        fd = __gocaml_fs.openSync(Buffer.from(name, 'latin1').toString('utf8'), flags);
+    } catch (e) {
+        return -1n;
+    }
+    var h = 3;
+    while (h < __gocaml_files.length && __gocaml_files[h] !== null) {
+        h++;
+    }
+    __gocaml_files[h] = {fd: fd, readable: flags === 'r'};
+    return BigInt(h);
+}
+
+// Reads a line without newline. It returns None when no byte was read before EOF
+function __gocaml_read_line(fd) {
+    var c = __gocaml_read_byte(fd);
+    if (c < 0) {
+        return null;
+    }
+    var s = '';
+    while (c >= 0 && c !== 10) {
+        s += String.fromCharCode(c);
+        c = __gocaml_read_byte(fd);
+    }
+    return {value: s};
+}
+
+function gocaml_open_in(name) {
+    return __gocaml_open(name, 'r');
+}
+
+function gocaml_open_out(name) {
+    return __gocaml_open(name, 'w');
+}
+
+function gocaml_open_append(name) {
+    return __gocaml_open(name, 'a');
+}
+
+function gocaml_input_line(h) {
+    if (h === 0n) {
+        return __gocaml_read_line(0);
+    }
+    var f = h < 0n ? null : __gocaml_files[Number(h)];
+    if (!f || !f.readable) {
+        return null;
+    }
+    return __gocaml_read_line(f.fd);
+}
+
+function gocaml_input_all(h) {
+    var f = h === 0n ? {fd: 0, readable: __gocaml_node} : h < 0n ? null : __gocaml_files[Number(h)];
+    if (!f || !f.readable) {
+        return '';
+    }
+    try {
+        return __gocaml_fs.readFileSync(f.fd, 'latin1');
+    } catch (e) {
+        return '';
+    }
+}
+
+function gocaml_output_string(h, s) {
+    if (h === 1n) {
+        __gocaml_print(s);
+        return true;
+    }
+    if (h === 2n) {
+        __gocaml_flush(false);
+        if (__gocaml_node) {
+            __gocaml_write_fd(2, s);
+        } else {
+            console.error(__gocaml_decode(s));
+        }
+        return true;
+    }
+    var f = h < 0n ? null : __gocaml_files[Number(h)];
+    if (!f || f.readable) {
+        return false;
+    }
+    try {
+        __gocaml_write_fd(f.fd, s);
+        return true;
+    } catch (e) {
+        return false;
+    }
+}
+
+// Standard streams cannot be closed
+function gocaml_close_file(h) {
+    var f = h < 3n ? null : __gocaml_files[Number(h)];
+    if (!f) {
+        return false;
+    }
+    __gocaml_files[Number(h)] = null;
+    try {
+        __gocaml_fs.closeSync(f.fd);
+        return true;
+    } catch (e) {
+        return false;
+    }
+}
+
+function gocaml_read_line(_) {
+    __gocaml_flush(false);
+    return __gocaml_read_line(0);
+}
+
+function gocaml_getenv(name) {
+    if (!__gocaml_node) {
+        return null;
+    }
+    var v = process.env[Buffer.from(name, 'latin1').toString('utf8')];
+    return v === undefined ? null : {value: Buffer.from(v, 'utf8').toString('latin1')};
+}
+
+// Buffer keeps added strings as chunks and joins them when its contents are requested
+function gocaml_buffer_create(_) {
+    return {chunks: [], length: 0};
+}
+
+function gocaml_buffer_add_string(b, s) {
+    b.chunks.push(s);
+    b.length += s.length;
+}
+
+function gocaml_buffer_add_char(b, c) {
+    b.chunks.push(String.fromCharCode(Number(BigInt.asUintN(8, c))));
+    b.length++;
+}
+
+function gocaml_buffer_contents(b) {
+    if (b.chunks.length > 1) {
+        b.chunks = [b.chunks.join('')];
+    }
+    return b.chunks.length === 0 ? '' : b.chunks[0];
+}
+
+function gocaml_buffer_length(b) {
+    return BigInt(b.length);
+}
+
+// Regular expressions are compiled and run by the same engine as runtime/gocamlrt.c since RegExp
+// has different syntax. An instruction is {op, x, y, c, set}. Jumps are relative.
+var __gocaml_re_ops = {CHAR: 0, ANY: 1, CLASS: 2, SPLIT: 3, JMP: 4, BOL: 5, EOL: 6, MATCH: 7};
+
+function __gocaml_re_compile(pat, whole) {
+    var O = __gocaml_re_ops;
+    var insns = [];
+    var pos = 0;
+
+    function fail(msg) {
+        __gocaml_abort("Invalid regular expression '" + pat + "': " + msg + ' at offset ' + pos);
+    }
+    function eof() {
+        return pos >= pat.length;
+    }
+    function peek() {
+        return pat.charCodeAt(pos);
+    }
+    function insert(at, op) {
+        var i = {op: op, x: 0, y: 0, c: 0, set: null};
+        insns.splice(at, 0, i);
+        return i;
+    }
+    function emit(op) {
+        return insert(insns.length, op);
+    }
+    function setRange(set, lo, hi) {
+        for (var c = lo; c <= hi; c++) {
+            set[c] = 1;
+        }
+    }
+    // Adds the class of \d, \w, \s or their complements. Returns false when it is not a class escape
+    function classEscape(e, set) {
+        var s = new Uint8Array(256);
+        switch (String.fromCharCode(e)) {
+        case 'd': case 'D':
+            setRange(s, 48, 57);
+            break;
+        case 'w': case 'W':
+            setRange(s, 97, 122);
+            setRange(s, 65, 90);
+            setRange(s, 48, 57);
+            setRange(s, 95, 95);
+            break;
+        case 's': case 'S':
+            setRange(s, 32, 32);
+            setRange(s, 9, 13); // \t \n \v \f \r
+            break;
+        default:
+            return false;
+        }
+        var complement = e === 68 || e === 87 || e === 83 ? 1 : 0;
+        for (var c = 0; c < 256; c++) {
+            if (s[c] !== complement) {
+                set[c] = 1;
+            }
+        }
+        return true;
+    }
+    // Parses the character after '\\'
+    function charEscape() {
+        if (eof()) {
+            fail("Trailing '\\'");
+        }
+        var e = peek();
+        pos++;
+        switch (e) {
+        case 110:
+            return 10; // \n
+        case 116:
+            return 9; // \t
+        case 114:
+            return 13; // \r
+        }
+        if ((97 <= e && e <= 122) || (65 <= e && e <= 90) || (48 <= e && e <= 57)) {
+            pos--;
+            fail('Unknown escape');
+        }
+        return e;
+    }
+    function parseClass() {
+        var set = new Uint8Array(256);
+        var negate = false;
+        if (!eof() && peek() === 94) {
+            negate = true;
+            pos++;
+        }
+        for (var first = true;; first = false) {
+            if (eof()) {
+                fail("Missing ']'");
+            }
+            var lo = peek();
+            pos++;
+            if (lo === 93 && !first) {
+                break;
+            }
+            if (lo === 92) {
+                if (!eof() && classEscape(peek(), set)) {
+                    pos++;
+                    continue;
+                }
+                lo = charEscape();
+            }
+            var hi = lo;
+            if (pos + 1 < pat.length && peek() === 45 && pat.charCodeAt(pos + 1) !== 93) {
+                pos++;
+                hi = peek();
+                pos++;
+                if (hi === 92) {
+                    hi = charEscape();
+                }
+                if (hi < lo) {
+                    fail('Invalid range in character class');
+                }
+            }
+            setRange(set, lo, hi);
+        }
+        if (negate) {
+            for (var c = 0; c < 256; c++) {
+                set[c] ^= 1;
+            }
+        }
+        emit(O.CLASS).set = set;
+    }
+    function parseAtom() {
+        var c = peek();
+        pos++;
+        switch (String.fromCharCode(c)) {
+        case '(':
+            parseAlt();
+            if (eof()) {
+                fail("Missing ')'");
+            }
+            pos++; // Eat ')'
+            break;
+        case '*': case '+': case '?':
+            pos--;
+            fail('Nothing to repeat');
+            break;
+        case '.':
+            emit(O.ANY);
+            break;
+        case '^':
+            emit(O.BOL);
+            break;
+        case '$':
+            emit(O.EOL);
+            break;
+        case '[':
+            parseClass();
+            break;
+        case '\\':
+            var set = new Uint8Array(256);
+            if (!eof() && classEscape(peek(), set)) {
+                pos++;
+                emit(O.CLASS).set = set;
+                break;
+            }
+            emit(O.CHAR).c = charEscape();
+            break;
+        default:
+            emit(O.CHAR).c = c;
+            break;
+        }
+    }
+    function isRepetition() {
+        return !eof() && (peek() === 42 || peek() === 43 || peek() === 63);
+    }
+    function parseRepeat() {
+        var start = insns.length;
+        parseAtom();
+        if (!isRepetition()) {
+            return;
+        }
+        var q = peek();
+        pos++;
+        var len = insns.length - start;
+        var i;
+        if (q === 42) {
+            // L: split +1, +(len+2); e; jmp L
+            i = insert(start, O.SPLIT);
+            i.x = 1;
+            i.y = len + 2;
+            emit(O.JMP).x = -(len + 1);
+        } else if (q === 43) {
+            // L: e; split L, +1
+            i = emit(O.SPLIT);
+            i.x = -len;
+            i.y = 1;
+        } else {
+            // split +1, +(len+1); e
+            i = insert(start, O.SPLIT);
+            i.x = 1;
+            i.y = len + 1;
+        }
+        if (isRepetition()) {
+            fail('Nested repetition');
+        }
+    }
+    function parseConcat() {
+        while (!eof() && peek() !== 124 && peek() !== 41) {
+            parseRepeat();
+        }
+    }
+    function parseAlt() {
+        var start = insns.length;
+        for (;;) {
+            parseConcat();
+            if (eof() || peek() !== 124) {
+                return;
+            }
+            pos++; // Eat '|'
+            // split +1, +(len+2); e1; jmp END; e2
+            var i = insert(start, O.SPLIT);
+            i.x = 1;
+            i.y = insns.length - start + 1;
+            var jmp = emit(O.JMP);
+            var at = insns.length - 1;
+            parseConcat();
+            jmp.x = insns.length - at;
+        }
+    }
+
+    parseAlt();
+    if (!eof()) {
+        fail("Unmatched ')'");
+    }
+    if (whole) {
+        emit(O.EOL);
+    }
+    emit(O.MATCH);
+    return insns;
+}
+
+// Searches the first match starting at 'from' or later with Pike VM. When 'anchored' is true, the
+// match must start at 'from'. Returns [start, end] or null.
+function __gocaml_re_run(insns, s, from, anchored) {
+    var O = __gocaml_re_ops;
+    var marks = new Array(insns.length).fill(0);
+    var clist = [];
+    var nlist = [];
+    var match = null;
+
+    // Position + 1 marks threads added to the list for the position
+    function add(list, pc, start, pos) {
+        if (marks[pc] === pos + 1) {
+            return;
+        }
+        marks[pc] = pos + 1;
+        var i = insns[pc];
+        switch (i.op) {
+        case O.JMP:
+            add(list, pc + i.x, start, pos);
+            break;
+        case O.SPLIT:
+            add(list, pc + i.x, start, pos);
+            add(list, pc + i.y, start, pos);
+            break;
+        case O.BOL:
+            if (pos === 0) {
+                add(list, pc + 1, start, pos);
+            }
+            break;
+        case O.EOL:
+            if (pos === s.length) {
+                add(list, pc + 1, start, pos);
+            }
+            break;
+        default:
+            list.push({pc: pc, start: start});
+            break;
+        }
+    }
+
+    for (var pos = from;; pos++) {
+        if (match === null && (!anchored || pos === from)) {
+            // New thread has the lowest priority
+            add(clist, 0, pos, pos);
+        }
+        if (clist.length === 0 && (match !== null || anchored)) {
+            break;
+        }
+        nlist = [];
+        for (var t = 0; t < clist.length; t++) {
+            var i = insns[clist[t].pc];
+            var step = false;
+            if (pos < s.length) {
+                var c = s.charCodeAt(pos);
+                switch (i.op) {
+                case O.CHAR:
+                    step = c === i.c;
+                    break;
+                case O.ANY:
+                    step = c !== 10;
+                    break;
+                case O.CLASS:
+                    step = i.set[c] === 1;
+                    break;
+                }
+            }
+            if (step) {
+                add(nlist, clist[t].pc + 1, clist[t].start, pos + 1);
+            } else if (i.op === O.MATCH) {
+                // Threads after this one have lower priority
+                match = [clist[t].start, pos];
+                break;
+            }
+        }
+        if (pos >= s.length) {
+            break;
+        }
+        clist = nlist;
+    }
+    return match;
+}
+
+function gocaml_re_match(pat, s) {
+    return __gocaml_re_run(__gocaml_re_compile(pat, true), s, 0, true) !== null;
+}
+
+function gocaml_re_find(pat, s) {
+    var m = __gocaml_re_run(__gocaml_re_compile(pat, false), s, 0, false);
+    return m === null ? null : {value: s.slice(m[0], m[1])};
+}
+
+// Replaces all matches. After an empty match, the next character is copied to make progress.
+function gocaml_re_replace(pat, by, s) {
+    var insns = __gocaml_re_compile(pat, false);
+    var out = [];
+    var pos = 0;
+    while (pos <= s.length) {
+        var m = __gocaml_re_run(insns, s, pos, false);
+        if (m === null) {
+            break;
+        }
+        out.push(s.slice(pos, m[0]), by);
+        if (m[1] > m[0]) {
+            pos = m[1];
+            continue;
+        }
+        out.push(s.slice(m[0], m[0] + 1));
+        pos = m[0] + 1;
+    }
+    out.push(s.slice(pos));
+    return out.join('');
+}
+
+// JSON values are objects of kind name and contents. Arrays and objects have elements (values of
+// fields for objects) in 'elems' and objects also have keys in 'keys'. Encoding and decoding follow
+// runtime/gocamlrt.c so that results are the same as native code.
+var __gocaml_json_kinds = {NULL: 'null', BOOL: 'bool', INT: 'int', FLOAT: 'float', STRING: 'string', ARRAY: 'array', OBJECT: 'object'};
+
+function __gocaml_json_expect(fun, v, expected, kinds) {
+    if (kinds.indexOf(v.kind) < 0) {
+        __gocaml_abort('Json.' + fun + ': Expected ' + expected + ' but got ' + v.kind);
+    }
+}
+
+function gocaml_json_null(_) {
+    return {kind: __gocaml_json_kinds.NULL};
+}
+
+function gocaml_json_of_bool(b) {
+    return {kind: __gocaml_json_kinds.BOOL, value: b};
+}
+
+function gocaml_json_of_int(i) {
+    return {kind: __gocaml_json_kinds.INT, value: i};
+}
+
+function gocaml_json_of_float(f) {
+    return {kind: __gocaml_json_kinds.FLOAT, value: f};
+}
+
+function gocaml_json_of_string(s) {
+    return {kind: __gocaml_json_kinds.STRING, value: s};
+}
+
+// Elements are copied since arrays are mutable
+function gocaml_json_of_array(a) {
+    return {kind: __gocaml_json_kinds.ARRAY, elems: Array.from(a)};
+}
+
+function gocaml_json_of_object(a) {
+    return {
+        kind: __gocaml_json_kinds.OBJECT,
+        keys: a.map(function (f) { return f[0]; }),
+        elems: a.map(function (f) { return f[1]; }),
+    };
+}
+
+function gocaml_json_kind(v) {
+    return v.kind;
+}
+
+function gocaml_json_to_bool(v) {
+    __gocaml_json_expect('to_bool', v, 'bool', [__gocaml_json_kinds.BOOL]);
+    return v.value;
+}
+
+function gocaml_json_to_int(v) {
+    __gocaml_json_expect('to_int', v, 'int', [__gocaml_json_kinds.INT]);
+    return v.value;
+}
+
+function gocaml_json_to_float(v) {
+    __gocaml_json_expect('to_float', v, 'float or int', [__gocaml_json_kinds.FLOAT, __gocaml_json_kinds.INT]);
+    return Number(v.value);
+}
+
+function gocaml_json_to_string(v) {
+    __gocaml_json_expect('to_string', v, 'string', [__gocaml_json_kinds.STRING]);
+    return v.value;
+}
+
+function gocaml_json_length(v) {
+    __gocaml_json_expect('length', v, 'array or object', [__gocaml_json_kinds.ARRAY, __gocaml_json_kinds.OBJECT]);
+    return BigInt(v.elems.length);
+}
+
+function gocaml_json_get(v, i) {
+    __gocaml_json_expect('get', v, 'array or object', [__gocaml_json_kinds.ARRAY, __gocaml_json_kinds.OBJECT]);
+    return i < 0n || i >= BigInt(v.elems.length) ? null : {value: v.elems[Number(i)]};
+}
+
+function gocaml_json_key(v, i) {
+    __gocaml_json_expect('key', v, 'object', [__gocaml_json_kinds.OBJECT]);
+    return i < 0n || i >= BigInt(v.keys.length) ? null : {value: v.keys[Number(i)]};
+}
+
+// Returns the value of the last field with the key
+function gocaml_json_member(v, key) {
+    __gocaml_json_expect('member', v, 'object', [__gocaml_json_kinds.OBJECT]);
+    var i = v.keys.lastIndexOf(key);
+    return i < 0 ? null : {value: v.elems[i]};
+}
+
+function __gocaml_json_quote(s) {
+    return '"' + s.replace(/["\\\x00-\x1f]/g, function (c) {
+        switch (c) {
+        case '"': return '\\"';
+        case '\\': return '\\\\';
+        case '\b': return '\\b';
+        case '\f': return '\\f';
+        case '\n': return '\\n';
+        case '\r': return '\\r';
+        case '\t': return '\\t';
+        default: return '\\u00' + (c.charCodeAt(0) < 16 ? '0' : '') + c.charCodeAt(0).toString(16);
+        }
+    }) + '"';
+}
+
+// Formats the finite float with the fewest digits which are parsed as the same float as
+// printf("%.*g") does. Since toPrecision() rounds half up, digits are rounded half to even from the
+// exact decimal digits of the float.
+function __gocaml_json_float(f) {
+    var sign = f < 0 || Object.is(f, -0) ? '-' : '';
+    var view = new DataView(new ArrayBuffer(8));
+    view.setFloat64(0, Math.abs(f));
+    var bits = view.getBigUint64(0);
+    var exp2 = Number(bits >> 52n);
+    var mant = bits & ((1n << 52n) - 1n);
+    if (exp2 === 0) {
+        exp2 = 1; // Subnormal
+    } else {
+        mant |= 1n << 52n;
+    }
+    exp2 -= 1075;
+    // f = 0.digits * 10^point
+    var digits = exp2 >= 0 ? (mant << BigInt(exp2)).toString() : (mant * 5n ** BigInt(-exp2)).toString();
+    var point = exp2 >= 0 ? digits.length : digits.length + exp2;
+    digits = digits.replace(/0+$/, '');
+    if (digits === '') {
+        return sign + '0';
+    }
+    for (var prec = 1; ; prec++) {
+        var d = digits.slice(0, prec);
+        var p = point;
+        var rest = digits.slice(prec);
+        if (rest !== '' && (rest > '5' || (rest === '5' && (d.charCodeAt(d.length - 1) & 1) === 1))) {
+            // Round up with carry
+            var i = d.length - 1;
+            while (i >= 0 && d.charAt(i) === '9') {
+                i--;
+            }
+            if (i < 0) {
+                d = '1';
+                p++;
+            } else {
+                d = d.slice(0, i) + String.fromCharCode(d.charCodeAt(i) + 1);
+            }
+        }
+        d = d.replace(/0+$/, '');
+        var e = p - 1;
+        var s;
+        if (e < -4 || e >= prec) {
+            var ae = Math.abs(e);
+            s = d.charAt(0) + (d.length > 1 ? '.' + d.slice(1) : '') + 'e' + (e < 0 ? '-' : '+') + (ae < 10 ? '0' : '') + ae;
+        } else if (p <= 0) {
+            s = '0.' + '0'.repeat(-p) + d;
+        } else if (p >= d.length) {
+            s = d + '0'.repeat(p - d.length);
+        } else {
+            s = d.slice(0, p) + '.' + d.slice(p);
+        }
+        if (Number(s) === Math.abs(f)) {
+            return sign + s;
+        }
+    }
+}
+
+function __gocaml_json_encode(v, out) {
+    switch (v.kind) {
+    case __gocaml_json_kinds.NULL:
+        out.push('null');
+        return;
+    case __gocaml_json_kinds.BOOL:
+    case __gocaml_json_kinds.INT:
+        out.push(v.value.toString());
+        return;
+    case __gocaml_json_kinds.FLOAT:
+        if (!Number.isFinite(v.value)) {
+            out.push('null');
+            return;
+        }
+        var s = __gocaml_json_float(v.value);
+        out.push(/^[-0-9]+$/.test(s) ? s + '.0' : s);
+        return;
+    case __gocaml_json_kinds.STRING:
+        out.push(__gocaml_json_quote(v.value));
+        return;
+    }
+    var obj = v.kind === __gocaml_json_kinds.OBJECT;
+    out.push(obj ? '{' : '[');
+    for (var i = 0; i < v.elems.length; i++) {
+        if (i > 0) {
+            out.push(',');
+        }
+        if (obj) {
+            out.push(__gocaml_json_quote(v.keys[i]), ':');
+        }
+        __gocaml_json_encode(v.elems[i], out);
+    }
+    out.push(obj ? '}' : ']');
+}
+
+function gocaml_json_encode(v) {
+    var out = [];
+    __gocaml_json_encode(v, out);
+    return out.join('');
+}
+
+// Parses the whole string as one JSON value. It returns null on a syntax error. Arrays and objects
+// nested more than 512 levels are rejected.
+function __gocaml_json_parse(src) {
+    var pos = 0;
+    var depth = 0;
+    var spaces = function () {
+        while (pos < src.length && ' \t\n\r'.indexOf(src.charAt(pos)) >= 0) {
+            pos++;
+        }
+    };
+    var consume = function (s) {
+        if (src.startsWith(s, pos)) {
+            pos += s.length;
+            return true;
+        }
+        return false;
+    };
+    var hex4 = function () {
+        var h = src.slice(pos, pos + 4);
+        if (!/^[0-9a-fA-F]{4}$/.test(h)) {
+            return -1;
+        }
+        pos += 4;
+        return parseInt(h, 16);
+    };
+    // Characters of strings are bytes. Code points are encoded in UTF-8
+    var utf8 = function (r) {
+        if (r < 0x80) {
+            return String.fromCharCode(r);
+        }
+        if (r < 0x800) {
+            return String.fromCharCode(0xc0 | (r >> 6), 0x80 | (r & 0x3f));
+        }
+        if (r < 0x10000) {
+            return String.fromCharCode(0xe0 | (r >> 12), 0x80 | ((r >> 6) & 0x3f), 0x80 | (r & 0x3f));
+        }
+        return String.fromCharCode(0xf0 | (r >> 18), 0x80 | ((r >> 12) & 0x3f), 0x80 | ((r >> 6) & 0x3f), 0x80 | (r & 0x3f));
+    };
+    var escapes = {'"': '"', '\\': '\\', '/': '/', b: '\b', f: '\f', n: '\n', r: '\r', t: '\t'};
+    var str = function () {
+        pos++; // Eat '"'
+        var out = [];
+        while (pos < src.length) {
+            var c = src.charAt(pos++);
+            if (c === '"') {
+                return out.join('');
+            }
+            if (c < ' ') {
+                return null;
+            }
+            if (c !== '\\') {
+                out.push(c);
+                continue;
+            }
+            var e = src.charAt(pos++);
+            if (e !== 'u') {
+                if (!Object.prototype.hasOwnProperty.call(escapes, e)) {
+                    return null;
+                }
+                out.push(escapes[e]);
+                continue;
+            }
+            var r = hex4();
+            if (r < 0 || (0xdc00 <= r && r <= 0xdfff)) {
+                return null;
+            }
+            if (0xd800 <= r && r <= 0xdbff) {
+                // High surrogate must be followed by low surrogate
+                if (!consume('\\u')) {
+                    return null;
+                }
+                var lo = hex4();
+                if (lo < 0xdc00 || 0xdfff < lo) {
+                    return null;
+                }
+                r = 0x10000 + ((r - 0xd800) << 10) + (lo - 0xdc00);
+            }
+            out.push(utf8(r));
+        }
+        return null;
+    };
+    // Numbers without fraction and exponent are integers unless they overflow
+    var number = function () {
+        var re = /-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?/y;
+        re.lastIndex = pos;
+        var m = re.exec(src);
+        if (m === null) {
+            return null;
+        }
+        pos += m[0].length;
+        if (m[2] === undefined && m[3] === undefined) {
+            var i = BigInt(m[0]);
+            if (BigInt.asIntN(64, i) === i) {
+                return {kind: __gocaml_json_kinds.INT, value: i};
+            }
+        }
+        // Too large numbers are infinity
+        return {kind: __gocaml_json_kinds.FLOAT, value: Number(m[0])};
+    };
+    var value;
+    var elements = function (v, closing) {
+        if (++depth > 512) {
+            return null;
+        }
+        pos++; // Eat '[' or '{'
+        spaces();
+        if (consume(closing)) {
+            depth--;
+            return v;
+        }
+        for (;;) {
+            if (v.keys !== undefined) {
+                spaces();
+                if (src.charAt(pos) !== '"') {
+                    return null;
+                }
+                var k = str();
+                spaces();
+                if (k === null || !consume(':')) {
+                    return null;
+                }
+                v.keys.push(k);
+            }
+            var e = value();
+            if (e === null) {
+                return null;
+            }
+            v.elems.push(e);
+            spaces();
+            if (consume(closing)) {
+                depth--;
+                return v;
+            }
+            if (!consume(',')) {
+                return null;
+            }
+        }
+    };
+    value = function () {
+        spaces();
+        var c = src.charAt(pos);
+        switch (c) {
+        case 'n':
+            return consume('null') ? {kind: __gocaml_json_kinds.NULL} : null;
+        case 't':
+        case 'f':
+            return consume(c === 't' ? 'true' : 'false') ? {kind: __gocaml_json_kinds.BOOL, value: c === 't'} : null;
+        case '"':
+            var s = str();
+            return s === null ? null : {kind: __gocaml_json_kinds.STRING, value: s};
+        case '[':
+            return elements({kind: __gocaml_json_kinds.ARRAY, elems: []}, ']');
+        case '{':
+            return elements({kind: __gocaml_json_kinds.OBJECT, elems: [], keys: []}, '}');
+        default:
+            return c === '-' || ('0' <= c && c <= '9') ? number() : null;
+        }
+    };
+    var v = value();
+    spaces();
+    return v === null || pos < src.length ? null : v;
+}
+
+function gocaml_json_decode(s) {
+    var v = __gocaml_json_parse(s);
+    return v === null ? null : {value: v};
+}
+`
@@ -7,6 +7,7 @@ import (
 	"github.com/rhysd/gocaml/driver"
 	"github.com/rhysd/locerr"
 	"os"
+	"runtime"
 	"strings"
 )
 
@@ -16,17 +17,60 @@ var (
 	showAST     = flag.Bool("ast", false, "Show AST for input")
 	analyze     = flag.Bool("analyze", false, "Dump analyzed symbols and types information to stdout")
 	showMIR     = flag.Bool("mir", false, "Emit GoCaml Intermediate Language representation to stdout")
+	explainCls  = flag.Bool("explain-closures", false, "Report which functions capture which variables and why closures are allocated")
 	check       = flag.Bool("check", false, "Check code (syntax, types, ...) and report errors if exist")
 	llvm        = flag.Bool("llvm", false, "Emit LLVM IR to stdout")
 	asm         = flag.Bool("asm", false, "Emit assembler code to stdout")
+	emitC       = flag.Bool("emit-c", false, "Emit portable C source to stdout. It does not need LLVM")
+	run         = flag.Bool("run", false, "Run the program with MIR interpreter instead of compiling it. It does not need LLVM. Arguments after file are passed to the program")
+	jit         = flag.Bool("jit", false, "Run the program with LLVM JIT compiler instead of the interpreter with -run")
 	opt         = flag.Int("opt", -1, "Optimization level (0~3). 0: none, 1: less, 2: default, 3: aggressive")
+	o0          = flag.Bool("O0", false, "Disable optimizations. Same as -opt 0")
+	o1          = flag.Bool("O1", false, "Run only cheap optimizations. Same as -opt 1")
+	o2          = flag.Bool("O2", false, "Run default optimizations. Same as -opt 2")
+	o3          = flag.Bool("O3", false, "Run aggressive optimizations including inlining. Same as -opt 3")
 	obj         = flag.Bool("obj", false, "Compile to object file")
+	emit        = flag.String("emit", "", "Write an artifact to a file without linking. 'ir' (LLVM IR), 'bc' (LLVM bitcode), 'asm' (assembly), 'obj' (object file), 'exe' (executable) or 'h' (C header declaring external symbols)")
 	ldflags     = flag.String("ldflags", "", "Flags passed to underlying linker")
-	debug       = flag.Bool("g", false, "Compile with debug information")
-	target      = flag.String("target", "", "Target architecture triple")
+	rtLinkage   = flag.String("runtime", "static", "Linkage of runtime library. 'static' or 'shared'. Executables load 'gocamlrt.so' at startup with 'shared'")
+	reloc       = flag.String("reloc", "", "Relocation model. 'pie' (position-independent executable), 'pic' (position-independent code) or 'static'. Default is 'pie' on Linux, Android and macOS and the default of the target on others")
+	lto         = flag.Bool("lto", false, "Enable link-time optimization with clang. Object files contain LLVM bitcode and runtime is also linked as bitcode")
+	gc          = flag.String("gc", "boehm", "Garbage collector of executables. 'boehm' (conservative Boehm GC), 'builtin' (precise mark-sweep GC of runtime) or 'none' (arena allocation without collection) or 'rc' (reference counting. Cycles are collected only with $GOCAML_RC_CYCLES=1). Heap is tuned with $GOCAML_GC_INITIAL_HEAP, $GOCAML_GC_MAX_HEAP and $GOCAML_GC_GROWTH")
+	gcStackMaps = flag.Bool("gc-stackmaps", false, "Emit stack maps of GC roots at calls using LLVM statepoints for a precise GC. Conservative GC is still used at runtime")
+	debug       = flag.Bool("g", false, "Compile with debug information and verify MIR after each pass")
+	target      = flag.String("target", "", "Target architecture triple. 'js' compiles into JavaScript without LLVM")
 	showTargets = flag.Bool("show-targets", false, "Show all available targets")
+	doctor      = flag.Bool("doctor", false, "Check whether programs can be compiled for the target (-target) and run on this machine")
+	mcpu        = flag.String("mcpu", "", "Target CPU such as 'haswell'. Generic CPU of the target is used by default")
+	mattr       = flag.String("mattr", "", "Comma-separated list of target features to enable or disable such as '+avx2,-sse4.1'")
+	noAssert    = flag.Bool("no-assert", false, "Compile out 'assert' expressions")
+	noBounds    = flag.Bool("no-bounds-check", false, "Do not check indices of arrays at runtime")
+	checkArith  = flag.Bool("checked-arith", false, "Abort with the location when integer arithmetic overflows instead of wrapping around")
+	sanitize    = flag.String("sanitize", "", "Comma-separated list of sanitizers to instrument the executable with. 'address' (AddressSanitizer) and 'undefined' (checks of undefined behavior)")
+	warnings    = flag.String("W", "all", "Enable or disable warnings. Comma-separated list of 'all', 'none', 'W001' or 'no-W001'")
+	werror      = flag.Bool("Werror", false, "Treat warnings as errors")
+	parallel    = flag.Bool("parallel-inference", false, "Infer independent top-level bindings concurrently")
+	tailcalls   = flag.Bool("diagnose-tail-calls", false, "Report calls in tail position which are not guaranteed to be tail calls as warnings (W006)")
+	inline      = flag.Int("inline", -1, "Inline functions whose size is less than or equal to the number of MIR instructions. 0 disables inlining. Default value depends on optimization level")
+	passes      = flag.String("passes", "", "Comma-separated list of MIR passes to run instead of the default pipeline of the optimization level")
+	llvmPasses  = flag.String("llvm-passes", "", "Comma-separated list of LLVM passes such as 'mem2reg,instcombine,gvn' to run instead of the standard pipeline of the optimization level")
+	llvmInline  = flag.Int("llvm-inline-threshold", 0, "Threshold of LLVM's inliner. 0 means the default threshold of the optimization level. Negative value disables it")
+	vecLoops    = flag.Bool("vectorize-loops", false, "Enable the loop vectorizer of LLVM")
+	vecSLP      = flag.Bool("vectorize-slp", false, "Enable the SLP vectorizer of LLVM")
+	noUnroll    = flag.Bool("no-unroll-loops", false, "Disable loop unrolling of LLVM")
+	passStats   = flag.Bool("pass-stats", false, "Report time and the number of MIR instructions before and after each pass to stderr")
+	profileGen  = flag.Bool("profile-generate", false, "Instrument executable to record counts of calls and branches to $GOCAML_PROFILE ('gocaml.profile' by default) at exit")
+	profileUse  = flag.String("profile-use", "", "Optimize inlining and branches for hot paths in the profile recorded by executable compiled with -profile-generate")
+	lambdaLift  = flag.Bool("lambda-lift", false, "Pass free variables of closures which are only called as extra parameters instead of allocating closures")
+	defunc      = flag.Bool("defunctionalize", false, "Replace closures with variants and call them via generated dispatch functions instead of indirect calls")
+	closureRepr = flag.String("closure-repr", "flat", "Representation of closures. 'flat' copies all captured variables into each closure. 'linked' makes nested closures point to environments of their enclosing closures")
 )
 
+func init() {
+	// Code compiled with -jit must run on the main thread (see codegen.Emitter.RunJIT)
+	runtime.LockOSThread()
+}
+
 const usageHeader = `Usage: gocaml [flags] [file]
 
   Compiler for GoCaml.
@@ -40,22 +84,46 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func getOptLevel() driver.OptLevel {
-	switch *opt {
+func getOptLevel() (driver.OptLevel, error) {
+	level := *opt
+	specified := ""
+	for i, set := range []bool{*o0, *o1, *o2, *o3} {
+		if !set {
+			continue
+		}
+		name := fmt.Sprintf("-O%d", i)
+		if specified != "" {
+			return driver.O0, fmt.Errorf("Only one optimization level can be specified but both %s and %s were specified", specified, name)
+		}
+		if *opt >= 0 && *opt != i {
+			return driver.O0, fmt.Errorf("%s conflicts with -opt %d", name, *opt)
+		}
+		specified = name
+		level = i
+	}
+
+	switch level {
 	case 0:
-		return driver.O0
+		return driver.O0, nil
 	case 1:
-		return driver.O1
+		return driver.O1, nil
 	case 2:
-		return driver.O2
+		return driver.O2, nil
 	case 3:
-		return driver.O3
+		return driver.O3, nil
 	default:
 		if *llvm {
-			return driver.O0
+			return driver.O0, nil
 		}
-		return driver.O2
+		return driver.O2, nil
+	}
+}
+
+func getInlineThreshold(level driver.OptLevel) int {
+	if *inline < 0 {
+		return driver.DefaultInlineThreshold(level)
 	}
+	return *inline
 }
 
 func main() {
@@ -76,11 +144,33 @@ func main() {
 			pad := strings.Repeat("\t", tabs)
 			fmt.Printf("%s:%s%s\n", t.Name, pad, t.Description)
 		}
+		fmt.Printf("%s:\t\t\tJavaScript (Node.js)\n", driver.JSTarget)
 		os.Exit(0)
 	}
 
+	if *doctor {
+		ok := true
+		for _, c := range codegen.Doctor(*target) {
+			mark := "ok"
+			if !c.OK {
+				mark = "NG"
+				ok = false
+			}
+			fmt.Printf("[%s] %s: %s\n", mark, c.Subject, c.Detail)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	level, err := getOptLevel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	var src *locerr.Source
-	var err error
 
 	if flag.NArg() == 0 {
 		src, err = locerr.NewSourceFromStdin()
@@ -94,10 +184,38 @@ func main() {
 	}
 
 	d := driver.Driver{
-		Optimization: getOptLevel(),
-		TargetTriple: *target,
-		LinkFlags:    *ldflags,
-		DebugInfo:    *debug,
+		Optimization:        level,
+		TargetTriple:        *target,
+		TargetCPU:           *mcpu,
+		TargetFeatures:      *mattr,
+		LinkFlags:           *ldflags,
+		LTO:                 *lto,
+		Runtime:             *rtLinkage,
+		Reloc:               *reloc,
+		GC:                  *gc,
+		DebugInfo:           *debug,
+		NoAssert:            *noAssert,
+		NoBoundsCheck:       *noBounds,
+		CheckedArith:        *checkArith,
+		Sanitize:            *sanitize,
+		Warnings:            *warnings,
+		WarningsAsErrors:    *werror,
+		ParallelInference:   *parallel,
+		InlineThreshold:     getInlineThreshold(level),
+		DiagnoseTailCalls:   *tailcalls,
+		Passes:              *passes,
+		PassStats:           *passStats,
+		ProfileGenerate:     *profileGen,
+		ProfileUse:          *profileUse,
+		LambdaLifting:       *lambdaLift,
+		ClosureRepr:         *closureRepr,
+		Defunctionalize:     *defunc,
+		LLVMPasses:          *llvmPasses,
+		LLVMInlineThreshold: *llvmInline,
+		VectorizeLoops:      *vecLoops,
+		VectorizeSLP:        *vecSLP,
+		NoUnrollLoops:       *noUnroll,
+		GCStackMaps:         *gcStackMaps,
 	}
 
 	switch {
@@ -121,7 +239,14 @@ func main() {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(4)
 		}
-		prog.Println(os.Stdout, env)
+		prog.Dump(os.Stdout, env)
+	case *explainCls:
+		report, err := d.ExplainClosures(src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(4)
+		}
+		report.Dump(os.Stdout)
 	case *llvm:
 		ir, err := d.EmitLLVMIR(src)
 		if err != nil {
@@ -136,6 +261,33 @@ func main() {
 			os.Exit(4)
 		}
 		fmt.Println(asm)
+	case *emitC:
+		c, err := d.EmitC(src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(4)
+		}
+		fmt.Print(c)
+	case *run:
+		args := []string{"gocaml"}
+		if flag.NArg() > 0 {
+			args = flag.Args()
+		}
+		execute := d.Run
+		if *jit {
+			execute = d.RunJIT
+		}
+		code, err := execute(src, args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(4)
+		}
+		os.Exit(code)
+	case *emit != "":
+		if err := d.EmitFile(src, *emit); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(4)
+		}
 	case *obj:
 		if err := d.EmitObjFile(src); err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -119,6 +119,18 @@ func (b *Block) WholeRange() (begin *Insn, end *Insn) {
 	return
 }
 
+// Size returns the number of instructions in the block including nested blocks.
+func (b *Block) Size() int {
+	size := 0
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		size++
+		if v, ok := i.Val.(*If); ok {
+			size += v.Then.Size() + v.Else.Size()
+		}
+	}
+	return size
+}
+
 // Instruction.
 // Its form is always `ident = val`
 type Insn struct {
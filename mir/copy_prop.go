@@ -0,0 +1,141 @@
+package mir
+
+import (
+	"github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Copy propagation is beta reduction on the program after closure transform. ElimRefs is applied
+// before closure transform, but inlining and other passes introduce 'ref' instructions again. And
+// the last instruction of a block is kept by ElimRefs even if the block is spliced into the
+// enclosing one later.
+// Since identifiers are unique across the program, aliases are substituted beyond blocks. They are
+// propagated into branches of 'if' and into bodies of toplevel functions. When the alias is captured
+// by a closure, the referred identifier is captured instead.
+//   x$t1 = int 42
+//   y$t2 = ref x$t1
+//   f$t3 = makecls (y$t2) f$t3
+//   (in body of f$t3) $k1 = binary + a$t4 y$t2
+// is converted into
+//   x$t1 = int 42
+//   f$t3 = makecls (x$t1) f$t3
+//   (in body of f$t3) $k1 = binary + a$t4 x$t1
+// Captures duplicated by the substitution are merged. As with ElimRefs, 'ref' instructions
+// instantiating generic values and the last instruction of a block are kept.
+
+type copyPropagator struct {
+	env   *types.Env
+	subst map[string]string
+	// Instructions of aliases to remove
+	aliases []*Insn
+}
+
+func (prop *copyPropagator) resolve(name string) string {
+	for {
+		n, ok := prop.subst[name]
+		if !ok {
+			return name
+		}
+		name = n
+	}
+}
+
+func (prop *copyPropagator) collect(b *Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *Ref:
+			if i.Next == end {
+				continue
+			}
+			if _, ok := prop.env.RefInsts[i.Ident]; ok {
+				continue
+			}
+			prop.subst[i.Ident] = v.Ident
+			prop.aliases = append(prop.aliases, i)
+		case *If:
+			prop.collect(v.Then)
+			prop.collect(v.Else)
+		}
+	}
+}
+
+func (prop *copyPropagator) rename(b *Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		RenameOperands(i.Val, prop.resolve)
+		if v, ok := i.Val.(*If); ok {
+			prop.rename(v.Then)
+			prop.rename(v.Else)
+		}
+	}
+}
+
+func (prop *copyPropagator) collectMakeCls(b *Block, found map[string][]*MakeCls) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *MakeCls:
+			found[v.Fun] = append(found[v.Fun], v)
+		case *If:
+			prop.collectMakeCls(v.Then, found)
+			prop.collectMakeCls(v.Else, found)
+		}
+	}
+}
+
+// uniqueCaptures removes captures which are duplicated by the substitution. Variables of 'makecls'
+// instructions are removed at the same indices.
+func uniqueCaptures(caps []string, makes []*MakeCls) []string {
+	seen := make(map[string]struct{}, len(caps))
+	kept := make([]int, 0, len(caps))
+	for idx, c := range caps {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		kept = append(kept, idx)
+	}
+	if len(kept) == len(caps) {
+		return caps
+	}
+
+	filter := func(names []string) []string {
+		ret := make([]string, 0, len(kept))
+		for _, idx := range kept {
+			ret = append(ret, names[idx])
+		}
+		return ret
+	}
+	for _, m := range makes {
+		m.Vars = filter(m.Vars)
+	}
+	return filter(caps)
+}
+
+// PropagateCopies eliminates 'ref' instructions across blocks and toplevel functions in the program.
+// It should be applied after closure transform.
+func PropagateCopies(prog *Program, env *types.Env) {
+	prop := &copyPropagator{env, map[string]string{}, nil}
+	for _, f := range prog.Toplevel {
+		prop.collect(f.Val.Body)
+	}
+	prop.collect(prog.Entry)
+
+	for _, f := range prog.Toplevel {
+		prop.rename(f.Val.Body)
+	}
+	prop.rename(prog.Entry)
+
+	makes := map[string][]*MakeCls{}
+	for _, f := range prog.Toplevel {
+		prop.collectMakeCls(f.Val.Body, makes)
+	}
+	prop.collectMakeCls(prog.Entry, makes)
+	for name, caps := range prog.Closures {
+		renameAll(caps, prop.resolve)
+		prog.Closures[name] = uniqueCaptures(caps, makes[name])
+	}
+
+	for _, i := range prop.aliases {
+		delete(env.DeclTable, i.Ident)
+		i.RemoveFromList()
+	}
+}
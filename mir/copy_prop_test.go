@@ -0,0 +1,141 @@
+package mir
+
+import (
+	"bytes"
+	"github.com/rhysd/locerr"
+	"testing"
+)
+
+func TestPropagateCopies(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what: "aliases in branches and captures",
+			code: `[TOPLEVELS (1)]
+f$t3 = fun a$t4 ; type=int -> int
+  BEGIN: body (f$t3)
+  $k1 = binary + a$t4 y$t2 ; type=int
+  $k2 = binary + $k1 x$t1 ; type=int
+  END: body (f$t3)
+
+[CLOSURES (1)]
+f$t3:	x$t1,y$t2
+
+[ENTRY]
+BEGIN: program
+x$t1 = int 42 ; type=int
+y$t2 = ref x$t1 ; type=int
+f$t3 = makecls (x$t1,y$t2) f$t3 ; type=int -> int
+c$t5 = bool true ; type=bool
+$k5 = if c$t5 ; type=int
+  BEGIN: then
+  $k3 = ref y$t2 ; type=int
+  $k4 = appcls f$t3 $k3 ; type=int
+  END: then
+  BEGIN: else
+  $k6 = ref y$t2 ; type=int
+  END: else
+$k7 = xref println_int ; type=int -> unit
+$k8 = appcls $k7 $k5 ; type=unit
+END: program
+`,
+			expected: `[TOPLEVELS (1)]
+f$t3 = fun a$t4 ; type=int -> int
+  BEGIN: body (f$t3)
+  $k1 = binary + a$t4 x$t1 ; type=int
+  $k2 = binary + $k1 x$t1 ; type=int
+  END: body (f$t3)
+
+[CLOSURES (1)]
+f$t3:	x$t1
+
+[ENTRY]
+BEGIN: program
+x$t1 = int 42 ; type=int
+f$t3 = makecls (x$t1) f$t3 ; type=int -> int
+c$t5 = bool true ; type=bool
+$k5 = if c$t5 ; type=int
+  BEGIN: then
+  $k4 = appcls f$t3 x$t1 ; type=int
+  END: then
+  BEGIN: else
+  $k6 = ref x$t1 ; type=int
+  END: else
+$k7 = xref println_int ; type=int -> unit
+$k8 = appcls $k7 $k5 ; type=unit
+END: program
+`,
+		},
+		{
+			what: "alias of closure captured by other closure",
+			code: `[TOPLEVELS (2)]
+f$t2 = fun a$t3 ; type=int -> int
+  BEGIN: body (f$t2)
+  $k1 = binary + a$t3 x$t1 ; type=int
+  END: body (f$t2)
+
+g$t5 = fun b$t6 ; type=int -> int
+  BEGIN: body (g$t5)
+  $k2 = appcls h$t4 b$t6 ; type=int
+  END: body (g$t5)
+
+[CLOSURES (2)]
+f$t2:	x$t1
+g$t5:	h$t4
+
+[ENTRY]
+BEGIN: program
+x$t1 = int 1 ; type=int
+f$t2 = makecls (x$t1) f$t2 ; type=int -> int
+h$t4 = ref f$t2 ; type=int -> int
+g$t5 = makecls (h$t4) g$t5 ; type=int -> int
+$k3 = appcls g$t5 x$t1 ; type=int
+END: program
+`,
+			expected: `[TOPLEVELS (2)]
+f$t2 = fun a$t3 ; type=int -> int
+  BEGIN: body (f$t2)
+  $k1 = binary + a$t3 x$t1 ; type=int
+  END: body (f$t2)
+
+g$t5 = fun b$t6 ; type=int -> int
+  BEGIN: body (g$t5)
+  $k2 = appcls f$t2 b$t6 ; type=int
+  END: body (g$t5)
+
+[CLOSURES (2)]
+f$t2:	x$t1
+g$t5:	f$t2
+
+[ENTRY]
+BEGIN: program
+x$t1 = int 1 ; type=int
+f$t2 = makecls (x$t1) f$t2 ; type=int -> int
+g$t5 = makecls (f$t2) g$t5 ; type=int -> int
+$k3 = appcls g$t5 x$t1 ; type=int
+END: program
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			prog, env, err := Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			PropagateCopies(prog, env)
+			if err := Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			prog.Dump(&buf, env)
+			if out := buf.String(); out != tc.expected {
+				t.Fatalf("Unexpected program:\n%s\nwanted:\n%s", out, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package mir
+
+import (
+	"github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Beta reduction removes aliases introduced by 'ref' instructions. Uses of the alias are replaced
+// with the referred identifier.
+//   x$t1 = int 42
+//   $k1 = ref x$t1
+//   y$t2 = ref $k1
+//   $k2 = binary + y$t2 $k1
+// is converted into
+//   x$t1 = int 42
+//   $k2 = binary + x$t1 x$t1
+// 'ref' instructions which instantiate generic values are kept because monomorphization needs the
+// instantiations recorded with their identifiers. And the last instruction of a block is kept because
+// it is the value of the block.
+// Aliases of identifiers bound by 'fun' or 'makecls' are also kept. Closure transform regards function
+// names as known globals and does not capture them, so substituting an alias of a closure with the
+// function name would make the closure refer to a variable which is never captured.
+
+type refEliminator struct {
+	env   *types.Env
+	subst map[string]string
+	funs  map[string]struct{}
+}
+
+func (elim *refEliminator) resolve(name string) string {
+	if n, ok := elim.subst[name]; ok {
+		return n
+	}
+	return name
+}
+
+func (elim *refEliminator) replaceOperands(val Val) {
+	RenameOperands(val, elim.resolve)
+	switch v := val.(type) {
+	case *If:
+		elim.block(v.Then)
+		elim.block(v.Else)
+	case *Fun:
+		elim.block(v.Body)
+	}
+}
+
+func (elim *refEliminator) block(b *Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		elim.replaceOperands(i.Val)
+
+		switch i.Val.(type) {
+		case *Fun, *MakeCls:
+			elim.funs[i.Ident] = struct{}{}
+		}
+
+		ref, ok := i.Val.(*Ref)
+		if !ok || i.Next == end {
+			continue
+		}
+		if _, ok := elim.env.RefInsts[i.Ident]; ok {
+			continue
+		}
+		if _, ok := elim.funs[ref.Ident]; ok {
+			continue
+		}
+		elim.subst[i.Ident] = ref.Ident
+		delete(elim.env.DeclTable, i.Ident)
+		i.RemoveFromList()
+	}
+}
+
+// ElimRefs eliminates unnecessary 'ref' instructions by beta reduction. It should be applied to the
+// MIR converted from AST before closure transform since it also shrinks function bodies.
+func ElimRefs(ir *Block, env *types.Env) {
+	elim := &refEliminator{env, map[string]string{}, map[string]struct{}{}}
+	elim.block(ir)
+}
@@ -0,0 +1,138 @@
+package mir
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestElimRefs(t *testing.T) {
+	pos := locerr.Pos{}
+	env := types.NewEnv()
+	for _, n := range []string{"x$t1", "$k1", "y$t2", "$k2", "$k3", "$k4", "$k5", "$k6", "a$t4", "$k7", "$k8"} {
+		env.DeclTable[n] = types.IntType
+	}
+	env.DeclTable["c$t3"] = types.BoolType
+	env.DeclTable["f$t5"] = &types.Fun{types.IntType, []types.Type{types.IntType}}
+
+	then := NewBlockFromArray("then", []*Insn{
+		NewInsn("$k4", &Ref{"y$t2"}, pos),
+		NewInsn("$k5", &Ref{"$k4"}, pos),
+	})
+	els := NewBlockFromArray("else", []*Insn{
+		NewInsn("$k6", &Ref{"$k1"}, pos),
+	})
+	body := NewBlockFromArray("body (f$t5)", []*Insn{
+		NewInsn("$k7", &Ref{"a$t4"}, pos),
+		NewInsn("$k8", &Binary{ADD, "$k7", "$k1"}, pos),
+	})
+	ir := NewBlockFromArray("program", []*Insn{
+		NewInsn("x$t1", &Int{42}, pos),
+		NewInsn("$k1", &Ref{"x$t1"}, pos),
+		NewInsn("y$t2", &Ref{"$k1"}, pos),
+		NewInsn("$k2", &Binary{ADD, "y$t2", "$k1"}, pos),
+		NewInsn("f$t5", &Fun{[]string{"a$t4"}, body, false}, pos),
+		NewInsn("c$t3", &Bool{true}, pos),
+		NewInsn("$k3", &If{"c$t3", then, els}, pos),
+	})
+
+	ElimRefs(ir, env)
+
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	out := buf.String()
+
+	for _, expected := range []string{
+		"$k2 = binary + x$t1 x$t1",
+		"$k8 = binary + a$t4 x$t1",
+		"$k5 = ref x$t1",
+		"$k6 = ref x$t1",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected '%s' to be contained in '%s'", expected, out)
+		}
+	}
+	for _, removed := range []string{"$k1 =", "y$t2 =", "$k4 =", "$k7 ="} {
+		if strings.Contains(out, removed) {
+			t.Errorf("Expected '%s' to be removed from '%s'", removed, out)
+		}
+		if _, ok := env.DeclTable[strings.TrimSuffix(removed, " =")]; ok {
+			t.Errorf("Type of removed identifier '%s' remains in declaration table", removed)
+		}
+	}
+}
+
+func TestElimRefsKeepInstantiations(t *testing.T) {
+	pos := locerr.Pos{}
+	env := types.NewEnv()
+	env.DeclTable["x$t1"] = types.IntType
+	env.DeclTable["$k1"] = types.IntType
+	env.DeclTable["$k2"] = types.IntType
+	env.RefInsts["$k1"] = &types.Instantiation{}
+
+	ir := NewBlockFromArray("program", []*Insn{
+		NewInsn("x$t1", &Int{42}, pos),
+		NewInsn("$k1", &Ref{"x$t1"}, pos),
+		NewInsn("$k2", &Ref{"$k1"}, pos),
+	})
+
+	ElimRefs(ir, env)
+
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	out := buf.String()
+	if !strings.Contains(out, "$k1 = ref x$t1") {
+		t.Fatalf("Instantiated reference was removed: %s", out)
+	}
+}
+
+func TestElimRefsKeepAliasOfClosure(t *testing.T) {
+	pos := locerr.Pos{}
+	env := types.NewEnv()
+	fun := &types.Fun{types.IntType, []types.Type{types.IntType}}
+	for _, n := range []string{"lambda$t1", "foo$t3", "clo$t5", "g$t6", "h$t7", "$k3"} {
+		env.DeclTable[n] = fun
+	}
+	for _, n := range []string{"x$t2", "y$t4", "$k1", "$k2", "$k4", "$k5"} {
+		env.DeclTable[n] = types.IntType
+	}
+
+	lambda := NewBlockFromArray("body (lambda$t1)", []*Insn{
+		NewInsn("$k1", &Ref{"x$t2"}, pos),
+	})
+	clo := NewBlockFromArray("body (clo$t5)", []*Insn{
+		NewInsn("$k2", &Ref{"y$t4"}, pos),
+		NewInsn("$k3", &Ref{"foo$t3"}, pos),
+		NewInsn("$k4", &App{"$k3", []string{"$k2"}, CLOSURE_CALL}, pos),
+	})
+	ir := NewBlockFromArray("program", []*Insn{
+		NewInsn("lambda$t1", &Fun{[]string{"x$t2"}, lambda, false}, pos),
+		NewInsn("foo$t3", &Ref{"lambda$t1"}, pos),
+		NewInsn("clo$t5", &Fun{[]string{"y$t4"}, clo, false}, pos),
+		NewInsn("g$t6", &MakeCls{[]string{"foo$t3"}, "clo$t5"}, pos),
+		NewInsn("h$t7", &Ref{"g$t6"}, pos),
+		NewInsn("$k5", &App{"h$t7", []string{"x$t2"}, CLOSURE_CALL}, pos),
+	})
+
+	ElimRefs(ir, env)
+
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	out := buf.String()
+
+	for _, expected := range []string{
+		"foo$t3 = ref lambda$t1",
+		"$k4 = appcls foo$t3 y$t4",
+		"h$t7 = ref g$t6",
+		"appcls h$t7 x$t2",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected '%s' to be contained in '%s'", expected, out)
+		}
+	}
+	if strings.Contains(out, "appcls lambda$t1") {
+		t.Errorf("Alias of closure was substituted with function name: %s", out)
+	}
+}
@@ -0,0 +1,254 @@
+package mir
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"io"
+	"sort"
+)
+
+// Note:
+// Program is encoded into binary with encoding/gob. Since instructions are doubly linked and values
+// are interfaces, the program is converted into a tree of plain structs before encoding. Value and
+// type of each instruction are stored in their textual representation (the same as Program.Dump) and
+// decoded by the MIR parser. Unlike the textual format, positions of instructions and the result of
+// escape analysis are preserved.
+
+// EncodingVersion is a version of binary format of program. Decoding a program encoded with other
+// version fails.
+const EncodingVersion = 1
+
+type encodedPos struct {
+	Offset, Line, Column int
+}
+
+type encodedInsn struct {
+	Ident  string
+	Val    string
+	Type   string
+	Pos    encodedPos
+	Blocks []encodedBlock // Blocks of 'if' or body of 'fun'
+}
+
+type encodedBlock struct {
+	Name  string
+	Insns []encodedInsn
+}
+
+type encodedProgram struct {
+	Version        int
+	Toplevel       []encodedInsn
+	Closures       map[string][]string
+	Entry          encodedBlock
+	StackAllocated []string
+	SharedEnvs     map[string]string
+	EnvLinks       map[string]string
+}
+
+type encoder struct {
+	env *types.Env
+}
+
+func (enc *encoder) insn(ident string, val Val, pos locerr.Pos) (encodedInsn, error) {
+	ty, ok := enc.env.DeclTable[ident]
+	if !ok {
+		return encodedInsn{}, locerr.Errorf("Type of identifier '%s' not found", ident)
+	}
+	var buf bytes.Buffer
+	val.Print(&buf)
+	i := encodedInsn{ident, buf.String(), ty.String(), encodedPos{pos.Offset, pos.Line, pos.Column}, nil}
+
+	var blocks []*Block
+	switch v := val.(type) {
+	case *If:
+		blocks = []*Block{v.Then, v.Else}
+	case *Fun:
+		blocks = []*Block{v.Body}
+	}
+	for _, b := range blocks {
+		eb, err := enc.block(b)
+		if err != nil {
+			return encodedInsn{}, err
+		}
+		i.Blocks = append(i.Blocks, eb)
+	}
+	return i, nil
+}
+
+func (enc *encoder) block(b *Block) (encodedBlock, error) {
+	eb := encodedBlock{b.Name, []encodedInsn{}}
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		ei, err := enc.insn(i.Ident, i.Val, i.Pos)
+		if err != nil {
+			return eb, err
+		}
+		eb.Insns = append(eb.Insns, ei)
+	}
+	return eb, nil
+}
+
+// Encode writes the program and types of its identifiers to the writer in binary format.
+func Encode(w io.Writer, prog *Program, env *types.Env) error {
+	enc := &encoder{env}
+	ep := encodedProgram{EncodingVersion, []encodedInsn{}, prog.Closures, encodedBlock{}, []string{}, prog.SharedEnvs, prog.EnvLinks}
+
+	for _, n := range prog.Toplevel.Names() {
+		f := prog.Toplevel[n]
+		i, err := enc.insn(n, f.Val, f.Pos)
+		if err != nil {
+			return err
+		}
+		ep.Toplevel = append(ep.Toplevel, i)
+	}
+
+	entry, err := enc.block(prog.Entry)
+	if err != nil {
+		return err
+	}
+	ep.Entry = entry
+
+	for n := range prog.StackAllocated {
+		ep.StackAllocated = append(ep.StackAllocated, n)
+	}
+	sort.Strings(ep.StackAllocated)
+
+	return gob.NewEncoder(w).Encode(&ep)
+}
+
+type decoder struct {
+	src    *locerr.Source
+	parser *parser
+}
+
+func (dec *decoder) insn(ei *encodedInsn) (*Insn, error) {
+	ty, err := types.Parse(ei.Type)
+	if err != nil {
+		return nil, err
+	}
+	dec.parser.env.DeclTable[ei.Ident] = ty
+
+	val, err := dec.parser.parseVal(ei.Val, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*Block
+	for i := range ei.Blocks {
+		b, err := dec.block(&ei.Blocks[i])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	switch val := val.(type) {
+	case *If:
+		if len(blocks) != 2 {
+			return nil, locerr.Errorf("'if' instruction '%s' must have 2 blocks but has %d", ei.Ident, len(blocks))
+		}
+		val.Then, val.Else = blocks[0], blocks[1]
+	case *Fun:
+		if len(blocks) != 1 {
+			return nil, locerr.Errorf("Function '%s' must have its body but has %d blocks", ei.Ident, len(blocks))
+		}
+		fun, ok := ty.(*types.Fun)
+		if !ok || len(fun.Params) != len(val.Params) {
+			return nil, locerr.Errorf("Type of function '%s' with %d parameters must be function type but got '%s'", ei.Ident, len(val.Params), ei.Type)
+		}
+		for i, p := range val.Params {
+			dec.parser.env.DeclTable[p] = fun.Params[i]
+		}
+		val.Body = blocks[0]
+	default:
+		if len(blocks) != 0 {
+			return nil, locerr.Errorf("Instruction '%s' must not have blocks", ei.Ident)
+		}
+	}
+
+	pos := locerr.Pos{ei.Pos.Offset, ei.Pos.Line, ei.Pos.Column, dec.src}
+	return NewInsn(ei.Ident, val, pos), nil
+}
+
+func (dec *decoder) block(eb *encodedBlock) (*Block, error) {
+	b := NewEmptyBlock(eb.Name)
+	for i := range eb.Insns {
+		insn, err := dec.insn(&eb.Insns[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Append(insn)
+	}
+	return b, nil
+}
+
+func (dec *decoder) program(ep *encodedProgram) (*Program, error) {
+	if ep.Version != EncodingVersion {
+		return nil, locerr.Errorf("Version of encoded program is %d but version %d is expected", ep.Version, EncodingVersion)
+	}
+
+	top := NewToplevel()
+	for i := range ep.Toplevel {
+		insn, err := dec.insn(&ep.Toplevel[i])
+		if err != nil {
+			return nil, err
+		}
+		f, ok := insn.Val.(*Fun)
+		if !ok {
+			return nil, locerr.Errorf("Toplevel '%s' must be a function", insn.Ident)
+		}
+		top.Add(insn.Ident, f, insn.Pos)
+	}
+
+	entry, err := dec.block(&ep.Entry)
+	if err != nil {
+		return nil, err
+	}
+
+	closures := ep.Closures
+	if closures == nil {
+		// gob does not encode empty map
+		closures = Closures{}
+	}
+	for c, caps := range closures {
+		if caps == nil {
+			closures[c] = []string{}
+		}
+	}
+
+	stack := make(map[string]struct{}, len(ep.StackAllocated))
+	for _, n := range ep.StackAllocated {
+		stack[n] = struct{}{}
+	}
+
+	shared := ep.SharedEnvs
+	if shared == nil {
+		shared = map[string]string{}
+	}
+	links := ep.EnvLinks
+	if links == nil {
+		links = map[string]string{}
+	}
+
+	return &Program{top, closures, entry, stack, shared, links}, nil
+}
+
+// Decode reads a program encoded by Encode. It returns the program and the type environment which
+// contains types of identifiers in the program. Positions of instructions are positions in the given
+// source.
+func Decode(r io.Reader, src *locerr.Source) (*Program, *types.Env, error) {
+	var ep encodedProgram
+	if err := gob.NewDecoder(r).Decode(&ep); err != nil {
+		return nil, nil, locerr.Notef(err, "Decoding MIR failed")
+	}
+	p := newParser(locerr.NewDummySource(""))
+	// Values are not in source. Errors on parsing them are reported at the first line of empty source
+	p.current = 0
+	dec := &decoder{src, p}
+	prog, err := dec.program(&ep)
+	if err != nil {
+		return nil, nil, locerr.Notef(err, "Decoding MIR failed")
+	}
+	return prog, dec.parser.env, nil
+}
@@ -0,0 +1,158 @@
+package mir
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.mir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := locerr.NewSourceFromFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog, env, err := Parse(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stack := prog.Entry.Top.Next.Ident
+			prog.StackAllocated[stack] = struct{}{}
+
+			var encoded bytes.Buffer
+			if err := Encode(&encoded, prog, env); err != nil {
+				t.Fatal(err)
+			}
+			decoded, decodedEnv, err := Decode(&encoded, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Verify(decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			var want, have bytes.Buffer
+			prog.Dump(&want, env)
+			decoded.Dump(&have, decodedEnv)
+			if want.String() != have.String() {
+				t.Fatalf("Decoded program is different from original one:\n%s", have.String())
+			}
+
+			if _, ok := decoded.StackAllocated[stack]; !ok || len(decoded.StackAllocated) != 1 {
+				t.Errorf("Stack allocated values were not preserved: %v", decoded.StackAllocated)
+			}
+			for n, f := range prog.Toplevel {
+				if pos := decoded.Toplevel[n].Pos; pos.Line != f.Pos.Line || pos.Column != f.Pos.Column || pos.File != src {
+					t.Errorf("Position of '%s' was not preserved: %v", n, pos)
+				}
+			}
+			last, decodedLast := prog.Entry.Bottom.Prev, decoded.Entry.Bottom.Prev
+			if last.Pos.Offset != decodedLast.Pos.Offset || last.Pos.Line != decodedLast.Pos.Line {
+				t.Errorf("Position of '%s' was not preserved: %v", last.Ident, decodedLast.Pos)
+			}
+		})
+	}
+}
+
+func TestEncodeMissingType(t *testing.T) {
+	prog := &Program{
+		NewToplevel(),
+		Closures{},
+		NewBlockFromArray("program", []*Insn{
+			NewInsn("$k1", UnitVal, locerr.Pos{}),
+		}),
+		map[string]struct{}{},
+		map[string]string{},
+		map[string]string{},
+	}
+	var buf bytes.Buffer
+	err := Encode(&buf, prog, types.NewEnv())
+	if err == nil {
+		t.Fatal("Error did not occur")
+	}
+	if !strings.Contains(err.Error(), "Type of identifier '$k1' not found") {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	encode := func(ep *encodedProgram) *bytes.Buffer {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(ep); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	insn := func(ident, val, ty string, blocks ...encodedBlock) encodedInsn {
+		return encodedInsn{ident, val, ty, encodedPos{}, blocks}
+	}
+	entry := encodedBlock{"program", []encodedInsn{insn("$k1", "unit", "unit")}}
+
+	cases := []struct {
+		what     string
+		input    *bytes.Buffer
+		expected string
+	}{
+		{
+			what:     "broken input",
+			input:    bytes.NewBufferString("this is not encoded program"),
+			expected: "Decoding MIR failed",
+		},
+		{
+			what:     "version mismatch",
+			input:    encode(&encodedProgram{EncodingVersion + 1, nil, nil, entry, nil, nil, nil}),
+			expected: "Version of encoded program is 2 but version 1 is expected",
+		},
+		{
+			what: "unknown instruction",
+			input: encode(&encodedProgram{EncodingVersion, nil, nil, encodedBlock{"program", []encodedInsn{
+				insn("$k1", "foo", "unit"),
+			}}, nil, nil, nil}),
+			expected: "Unknown instruction 'foo'",
+		},
+		{
+			what: "broken type",
+			input: encode(&encodedProgram{EncodingVersion, nil, nil, encodedBlock{"program", []encodedInsn{
+				insn("$k1", "unit", "foo"),
+			}}, nil, nil, nil}),
+			expected: "Unknown type 'foo'",
+		},
+		{
+			what: "if without blocks",
+			input: encode(&encodedProgram{EncodingVersion, nil, nil, encodedBlock{"program", []encodedInsn{
+				insn("$k1", "bool true", "bool"),
+				insn("$k2", "if $k1", "unit"),
+			}}, nil, nil, nil}),
+			expected: "'if' instruction '$k2' must have 2 blocks but has 0",
+		},
+		{
+			what: "toplevel is not function",
+			input: encode(&encodedProgram{EncodingVersion, []encodedInsn{
+				insn("$k2", "int 1", "int"),
+			}, nil, entry, nil, nil, nil}),
+			expected: "Toplevel '$k2' must be a function",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			_, _, err := Decode(tc.input, locerr.NewDummySource(""))
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected '%s' to be contained in error message '%s'", tc.expected, err.Error())
+			}
+		})
+	}
+}
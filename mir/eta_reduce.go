@@ -0,0 +1,93 @@
+package mir
+
+import (
+	"github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Eta reduction replaces references to a wrapper function which only calls another function with
+// the same arguments by references to the wrapped function.
+//   f$t1 = fun x$t2
+//     $k1 = app g$t3 x$t2
+//   $k2 = tuple f$t1,f$t1
+// is converted into
+//   $k2 = tuple g$t3,g$t3
+// Since the wrapper function is removed, no closure is allocated for it after closure transform.
+// The wrapper is reduced only when its type is the same as the wrapped function's type and it is not
+// generic because monomorphization needs instantiations recorded with the wrapper.
+//
+// Eta reduction should be applied after ElimRefs since arguments are usually passed via 'ref'
+// instructions.
+
+type etaReducer struct {
+	env   *types.Env
+	subst map[string]string
+}
+
+func (eta *etaReducer) resolve(name string) string {
+	if n, ok := eta.subst[name]; ok {
+		return n
+	}
+	return name
+}
+
+// wrappedCallee returns the function wrapped by the function when it is a wrapper function.
+func (eta *etaReducer) wrappedCallee(name string, fun *Fun) (string, bool) {
+	insn := fun.Body.Top.Next
+	if insn.Next != fun.Body.Bottom {
+		return "", false
+	}
+	app, ok := insn.Val.(*App)
+	if !ok || app.Callee == name || len(app.Args) != len(fun.Params) {
+		return "", false
+	}
+	for i, p := range fun.Params {
+		if app.Args[i] != p || app.Callee == p {
+			return "", false
+		}
+	}
+	if _, ok := eta.env.RefInsts[insn.Ident]; ok {
+		// Wrapped function is generic and instantiated at the call
+		return "", false
+	}
+
+	wrapper, ok := eta.env.DeclTable[name]
+	if !ok || len(types.GenericNames(wrapper)) > 0 {
+		return "", false
+	}
+	wrapped, ok := eta.env.DeclTable[app.Callee]
+	if !ok || !types.Equals(wrapper, wrapped) {
+		return "", false
+	}
+	return app.Callee, true
+}
+
+func (eta *etaReducer) block(b *Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		RenameOperands(i.Val, eta.resolve)
+
+		switch v := i.Val.(type) {
+		case *If:
+			eta.block(v.Then)
+			eta.block(v.Else)
+		case *Fun:
+			eta.block(v.Body)
+			if i.Next == end {
+				continue
+			}
+			if callee, ok := eta.wrappedCallee(i.Ident, v); ok {
+				eta.subst[i.Ident] = callee
+				delete(eta.env.DeclTable, i.Ident)
+				i.RemoveFromList()
+			}
+		}
+	}
+}
+
+// EtaReduce removes wrapper functions which only call other functions with the same arguments and
+// replaces references to them with the wrapped functions. It should be applied to the MIR converted
+// from AST before closure transform.
+func EtaReduce(ir *Block, env *types.Env) {
+	eta := &etaReducer{env, map[string]string{}}
+	eta.block(ir)
+}
@@ -0,0 +1,100 @@
+package mir
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestEtaReduce(t *testing.T) {
+	pos := locerr.Pos{}
+	intFun := &types.Fun{types.IntType, []types.Type{types.IntType}}
+	boolFun := &types.Fun{types.IntType, []types.Type{types.BoolType}}
+
+	cases := []struct {
+		what    string
+		wrapped types.Type
+		body    []*Insn
+		reduced bool
+	}{
+		{
+			what:    "wrapper function",
+			wrapped: intFun,
+			body: []*Insn{
+				NewInsn("$k1", &App{"g$t1", []string{"x$t3"}, DIRECT_CALL}, pos),
+			},
+			reduced: true,
+		},
+		{
+			what:    "type mismatch",
+			wrapped: boolFun,
+			body: []*Insn{
+				NewInsn("$k1", &App{"g$t1", []string{"x$t3"}, DIRECT_CALL}, pos),
+			},
+			reduced: false,
+		},
+		{
+			what:    "argument is not parameter",
+			wrapped: intFun,
+			body: []*Insn{
+				NewInsn("$k1", &App{"g$t1", []string{"y$t4"}, DIRECT_CALL}, pos),
+			},
+			reduced: false,
+		},
+		{
+			what:    "multiple instructions",
+			wrapped: intFun,
+			body: []*Insn{
+				NewInsn("$k2", &Int{1}, pos),
+				NewInsn("$k1", &App{"g$t1", []string{"x$t3"}, DIRECT_CALL}, pos),
+			},
+			reduced: false,
+		},
+		{
+			what:    "recursive function",
+			wrapped: intFun,
+			body: []*Insn{
+				NewInsn("$k1", &App{"f$t2", []string{"x$t3"}, DIRECT_CALL}, pos),
+			},
+			reduced: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			env := types.NewEnv()
+			env.DeclTable["g$t1"] = tc.wrapped
+			env.DeclTable["f$t2"] = intFun
+			env.DeclTable["x$t3"] = types.IntType
+			env.DeclTable["y$t4"] = types.IntType
+			env.DeclTable["$k1"] = types.IntType
+			env.DeclTable["$k2"] = types.IntType
+			env.DeclTable["$k3"] = &types.Tuple{[]types.Type{intFun, intFun}}
+
+			ir := NewBlockFromArray("program", []*Insn{
+				NewInsn("f$t2", &Fun{[]string{"x$t3"}, NewBlockFromArray("body (f$t2)", tc.body), false}, pos),
+				NewInsn("$k3", &Tuple{[]string{"f$t2", "f$t2"}}, pos),
+			})
+
+			EtaReduce(ir, env)
+
+			var buf bytes.Buffer
+			ir.Println(&buf, env)
+			out := buf.String()
+			if tc.reduced {
+				if !strings.Contains(out, "$k3 = tuple g$t1,g$t1") {
+					t.Errorf("References to wrapper were not replaced: %s", out)
+				}
+				if strings.Contains(out, "f$t2 = fun") {
+					t.Errorf("Wrapper function was not removed: %s", out)
+				}
+			} else {
+				if !strings.Contains(out, "$k3 = tuple f$t2,f$t2") {
+					t.Errorf("References to function were unexpectedly replaced: %s", out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,490 @@
+package mir
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strconv"
+	"strings"
+)
+
+// Note:
+// Parser reads the textual representation of program output by Program.Dump. It is useful to write
+// tests of passes with MIR fixtures and to reproduce bugs from dumped MIR.
+//
+//   [TOPLEVELS (1)]
+//   f$t1 = fun x$t2 ; type=int -> int
+//     BEGIN: body (f$t1)
+//     $k1 = binary + x$t2 x$t2 ; type=int
+//     END: body (f$t1)
+//
+//   [CLOSURES (0)]
+//
+//   [ENTRY]
+//   BEGIN: program
+//   $k2 = int 1 ; type=int
+//   $k3 = app f$t1 $k2 ; type=int
+//   END: program
+//
+// Each instruction is one line and nested blocks of 'if' and 'fun' follow the line. Indentation and
+// blank lines are ignored. Types of identifiers are put in the type environment. Since instantiations
+// of generic functions are not in the text, parsed program cannot be monomorphized.
+
+var (
+	unaryOps  = map[string]OperatorKind{}
+	binaryOps = map[string]OperatorKind{}
+	appKinds  = map[string]AppKind{}
+)
+
+func init() {
+	for i, s := range OpTable {
+		switch op := OperatorKind(i); op {
+		case NOT, NEG, FNEG:
+			unaryOps[s] = op
+		default:
+			binaryOps[s] = op
+		}
+	}
+	for i, s := range appTable {
+		appKinds["app"+s] = AppKind(i)
+	}
+}
+
+type parser struct {
+	src   *locerr.Source
+	lines []string
+	// Byte offsets of the beginning of lines
+	offsets []int
+	// Index of current line
+	current int
+	env     *types.Env
+}
+
+func newParser(src *locerr.Source) *parser {
+	lines := strings.Split(string(src.Code), "\n")
+	offsets := make([]int, 0, len(lines))
+	offset := 0
+	for _, l := range lines {
+		offsets = append(offsets, offset)
+		offset += len(l) + 1
+	}
+	return &parser{src, lines, offsets, -1, types.NewEnv()}
+}
+
+// pos returns position at the column of current line
+func (p *parser) pos(col int) locerr.Pos {
+	if p.current >= len(p.lines) {
+		return locerr.Pos{len(p.src.Code), len(p.lines), 1, p.src}
+	}
+	line := p.lines[p.current]
+	indent := len(line) - len(strings.TrimLeft(line, " \t"))
+	return locerr.Pos{p.offsets[p.current] + indent + col, p.current + 1, indent + col + 1, p.src}
+}
+
+func (p *parser) errorf(col int, format string, args ...interface{}) error {
+	return locerr.ErrorfAt(p.pos(col), format, args...)
+}
+
+// next moves to next non-empty line and returns it without indentation. It returns false at the end
+// of source.
+func (p *parser) next() (string, bool) {
+	for p.current+1 < len(p.lines) {
+		p.current++
+		l := strings.TrimSpace(p.lines[p.current])
+		if l != "" {
+			return l, true
+		}
+	}
+	p.current = len(p.lines)
+	return "", false
+}
+
+func (p *parser) expectLine(what string) (string, error) {
+	l, ok := p.next()
+	if !ok {
+		return "", p.errorf(0, "%s is expected but reached end of input", what)
+	}
+	return l, nil
+}
+
+func (p *parser) parseHeader(name string) (int, error) {
+	l, err := p.expectLine(fmt.Sprintf("[%s] section", name))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if _, err := fmt.Sscanf(l, "["+name+" (%d)]", &n); err != nil {
+		return 0, p.errorf(0, "[%s (n)] is expected but got '%s'", name, l)
+	}
+	return n, nil
+}
+
+func (p *parser) parseBlock() (*Block, error) {
+	l, err := p.expectLine("Beginning of block")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(l, "BEGIN: ") {
+		return nil, p.errorf(0, "'BEGIN: {name}' is expected but got '%s'", l)
+	}
+	name := l[len("BEGIN: "):]
+	block := NewEmptyBlock(name)
+	for {
+		l, err := p.expectLine(fmt.Sprintf("End of block '%s'", name))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(l, "END: ") {
+			if l[len("END: "):] != name {
+				return nil, p.errorf(0, "'END: %s' is expected but got '%s'", name, l)
+			}
+			return block, nil
+		}
+		insn, err := p.parseInsn(l)
+		if err != nil {
+			return nil, err
+		}
+		block.Append(insn)
+	}
+}
+
+func splitIdents(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func (p *parser) parseVal(s string, col int) (Val, error) {
+	op := s
+	args := ""
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		op, args = s[:i], s[i+1:]
+	}
+	fields := strings.Split(args, " ")
+	arity := func(n int) error {
+		if len(fields) != n {
+			return p.errorf(col, "'%s' takes %d operands but got '%s'", op, n, args)
+		}
+		return nil
+	}
+	tag := func(t string) (string, error) {
+		if !strings.HasPrefix(t, "`") || len(t) == 1 {
+			return "", p.errorf(col, "Tag of variant must start with '`' but got '%s'", t)
+		}
+		return t[1:], nil
+	}
+
+	switch op {
+	case "unit":
+		return UnitVal, nil
+	case "none":
+		return NoneVal, nil
+	case "unreachable":
+		return UnreachableVal, nil
+	case "nop":
+		return NOPVal, nil
+	case "bool":
+		b, err := strconv.ParseBool(args)
+		if err != nil {
+			return nil, p.errorf(col, "Invalid boolean constant '%s'", args)
+		}
+		return &Bool{b}, nil
+	case "int":
+		i, err := strconv.ParseInt(args, 10, 64)
+		if err != nil {
+			return nil, p.errorf(col, "Invalid integer constant '%s'", args)
+		}
+		return &Int{i}, nil
+	case "float":
+		f, err := strconv.ParseFloat(args, 64)
+		if err != nil {
+			return nil, p.errorf(col, "Invalid float constant '%s'", args)
+		}
+		return &Float{f}, nil
+	case "string":
+		str, err := strconv.Unquote(args)
+		if err != nil {
+			return nil, p.errorf(col, "Invalid string literal %s", args)
+		}
+		return &String{str}, nil
+	case "unary":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		o, ok := unaryOps[fields[0]]
+		if !ok {
+			return nil, p.errorf(col, "Unknown unary operator '%s'", fields[0])
+		}
+		return &Unary{o, fields[1]}, nil
+	case "binary":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		o, ok := binaryOps[fields[0]]
+		if !ok {
+			return nil, p.errorf(col, "Unknown binary operator '%s'", fields[0])
+		}
+		return &Binary{o, fields[1], fields[2]}, nil
+	case "ref":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &Ref{fields[0]}, nil
+	case "if":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		// Blocks are parsed by caller
+		return &If{fields[0], nil, nil}, nil
+	case "fun", "recfun":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		// Body is parsed by caller
+		return &Fun{splitIdents(fields[0]), nil, op == "recfun"}, nil
+	case "app", "appcls", "appx":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		return &App{fields[0], splitIdents(fields[1]), appKinds[op]}, nil
+	case "tuple":
+		return &Tuple{splitIdents(args)}, nil
+	case "tplload":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		idx, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, p.errorf(col, "Invalid index of tuple '%s'", fields[0])
+		}
+		return &TplLoad{fields[1], idx}, nil
+	case "array":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		return &Array{fields[0], fields[1]}, nil
+	case "arrlit":
+		return &ArrLit{splitIdents(args)}, nil
+	case "arrload":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		return &ArrLoad{fields[1], fields[0]}, nil
+	case "arrstore":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		return &ArrStore{fields[1], fields[0], fields[2]}, nil
+	case "arrlen":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &ArrLen{fields[0]}, nil
+	case "boundscheck":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		return &BoundsCheck{fields[1], fields[0]}, nil
+	case "table":
+		return &Table{}, nil
+	case "tblload":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		return &TblLoad{fields[1], fields[0]}, nil
+	case "tblstore":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		return &TblStore{fields[1], fields[0], fields[2]}, nil
+	case "tblremove":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		return &TblRemove{fields[1], fields[0]}, nil
+	case "xref":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &XRef{fields[0]}, nil
+	case "jump":
+		return &Jump{splitIdents(args)}, nil
+	case "makecls":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		vars := fields[0]
+		if !strings.HasPrefix(vars, "(") || !strings.HasSuffix(vars, ")") {
+			return nil, p.errorf(col, "Captures of 'makecls' must be surrounded by '(' and ')' but got '%s'", vars)
+		}
+		return &MakeCls{splitIdents(vars[1 : len(vars)-1]), fields[1]}, nil
+	case "some":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &Some{fields[0]}, nil
+	case "issome":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &IsSome{fields[0]}, nil
+	case "derefsome":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &DerefSome{fields[0]}, nil
+	case "variant":
+		if len(fields) != 1 {
+			if err := arity(2); err != nil {
+				return nil, err
+			}
+		}
+		t, err := tag(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		payload := ""
+		if len(fields) == 2 {
+			payload = fields[1]
+		}
+		return &Variant{t, payload}, nil
+	case "isvariant":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		t, err := tag(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return &IsVariant{fields[1], t}, nil
+	case "variantpayload":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &VariantPayload{fields[0]}, nil
+	default:
+		return nil, p.errorf(col, "Unknown instruction '%s'", op)
+	}
+}
+
+// parseInsn parses an instruction at current line and nested blocks following it.
+func (p *parser) parseInsn(l string) (*Insn, error) {
+	eq := strings.Index(l, " = ")
+	if eq <= 0 {
+		return nil, p.errorf(0, "'{ident} = {value} ; type={type}' is expected but got '%s'", l)
+	}
+	ident := l[:eq]
+	pos := p.pos(0)
+
+	valStart := eq + len(" = ")
+	sep := strings.LastIndex(l, " ; type=")
+	if sep < valStart {
+		return nil, p.errorf(valStart, "Type of '%s' is missing. ' ; type={type}' is expected at the end of line", ident)
+	}
+	tyStart := sep + len(" ; type=")
+	ty, err := types.Parse(l[tyStart:])
+	if err != nil {
+		return nil, locerr.WithPos(p.pos(tyStart), err)
+	}
+	// Note: Closure is declared twice as toplevel function and 'makecls' instruction with the same type
+	p.env.DeclTable[ident] = ty
+
+	val, err := p.parseVal(l[valStart:sep], valStart)
+	if err != nil {
+		return nil, err
+	}
+
+	switch val := val.(type) {
+	case *If:
+		if val.Then, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+		if val.Else, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+	case *Fun:
+		fun, ok := ty.(*types.Fun)
+		if !ok || len(fun.Params) != len(val.Params) {
+			return nil, p.errorf(tyStart, "Type of function '%s' with %d parameters must be function type but got '%s'", ident, len(val.Params), ty.String())
+		}
+		for i, param := range val.Params {
+			p.env.DeclTable[param] = fun.Params[i]
+		}
+		if val.Body, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewInsn(ident, val, pos), nil
+}
+
+func (p *parser) parseProgram() (*Program, error) {
+	numFuns, err := p.parseHeader("TOPLEVELS")
+	if err != nil {
+		return nil, err
+	}
+	top := NewToplevel()
+	for i := 0; i < numFuns; i++ {
+		l, err := p.expectLine("Toplevel function")
+		if err != nil {
+			return nil, err
+		}
+		insn, err := p.parseInsn(l)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := insn.Val.(*Fun)
+		if !ok {
+			return nil, locerr.ErrorfAt(insn.Pos, "Toplevel '%s' must be a function", insn.Ident)
+		}
+		top.Add(insn.Ident, f, insn.Pos)
+	}
+
+	numClosures, err := p.parseHeader("CLOSURES")
+	if err != nil {
+		return nil, err
+	}
+	closures := Closures{}
+	for i := 0; i < numClosures; i++ {
+		l, err := p.expectLine("Captures of closure")
+		if err != nil {
+			return nil, err
+		}
+		// Line may be trimmed when the closure captures nothing
+		colon := strings.Index(l, ":")
+		if colon <= 0 {
+			return nil, p.errorf(0, "'{name}:\t{captures}' is expected but got '%s'", l)
+		}
+		closures[l[:colon]] = splitIdents(strings.TrimSpace(l[colon+1:]))
+	}
+
+	l, err := p.expectLine("[ENTRY] section")
+	if err != nil {
+		return nil, err
+	}
+	if l != "[ENTRY]" {
+		return nil, p.errorf(0, "[ENTRY] is expected but got '%s'", l)
+	}
+	entry, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := p.next(); ok {
+		return nil, p.errorf(0, "Unexpected line '%s' after entry block", l)
+	}
+
+	return &Program{top, closures, entry, map[string]struct{}{}, map[string]string{}, map[string]string{}}, nil
+}
+
+// Parse parses the textual representation of program output by Program.Dump. It returns the program
+// and the type environment which contains types of identifiers in the program.
+func Parse(src *locerr.Source) (*Program, *types.Env, error) {
+	p := newParser(src)
+	prog, err := p.parseProgram()
+	if err != nil {
+		return nil, nil, locerr.Note(err, "Parsing MIR failed")
+	}
+	return prog, p.env, nil
+}
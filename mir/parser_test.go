@@ -0,0 +1,178 @@
+package mir
+
+import (
+	"bytes"
+	"github.com/rhysd/locerr"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFixtures(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.mir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No fixture was found")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := locerr.NewSourceFromFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog, env, err := Parse(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			prog.Dump(&buf, env)
+			if buf.String() != string(src.Code) {
+				t.Fatalf("Dumped program is different from its source:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestParseProgram(t *testing.T) {
+	code, err := ioutil.ReadFile("testdata/closure.mir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, env, err := Parse(locerr.NewDummySource(string(code)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prog.Toplevel) != 2 {
+		t.Fatalf("Wanted 2 toplevel functions but got %d", len(prog.Toplevel))
+	}
+	f, ok := prog.Toplevel["f$t3"]
+	if !ok {
+		t.Fatalf("Function 'f$t3' not found: %v", prog.Toplevel)
+	}
+	if len(f.Val.Params) != 1 || f.Val.Params[0] != "a$t4" {
+		t.Errorf("Unexpected parameters: %v", f.Val.Params)
+	}
+	if f.Pos.Line != 2 {
+		t.Errorf("Function should be at line 2 but got %d", f.Pos.Line)
+	}
+	if ty := env.DeclTable["a$t4"]; ty == nil || ty.String() != "int" {
+		t.Errorf("Type of parameter should be 'int' but got %v", ty)
+	}
+	if caps := prog.Closures["g$t5"]; len(caps) != 1 || caps[0] != "f$t3" {
+		t.Errorf("Unexpected captures of 'g$t5': %v", caps)
+	}
+
+	s := prog.Entry.Top.Next.Next.Val.(*String)
+	if s.Const != "a \"quoted\" ; type=string" {
+		t.Errorf("Unexpected string constant: %s", s.Const)
+	}
+	app := prog.Entry.Bottom.Prev.Val.(*App)
+	if app.Kind != CLOSURE_CALL || app.Callee != "$k38" || len(app.Args) != 1 || app.Args[0] != "$k41" {
+		t.Errorf("Unexpected application: %v", app)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "empty",
+			code:     "",
+			expected: "[TOPLEVELS] section is expected but reached end of input",
+		},
+		{
+			what:     "no header",
+			code:     "BEGIN: program\n$k1 = unit ; type=unit\nEND: program",
+			expected: "[TOPLEVELS (n)] is expected but got 'BEGIN: program'",
+		},
+		{
+			what:     "unknown instruction",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = foo $k2 ; type=unit\nEND: program",
+			expected: "Unknown instruction 'foo'",
+		},
+		{
+			what:     "missing type",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = unit\nEND: program",
+			expected: "Type of '$k1' is missing",
+		},
+		{
+			what:     "broken type",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = unit ; type=int ->\nEND: program",
+			expected: "Type is expected",
+		},
+		{
+			what:     "wrong number of operands",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = binary + $k2 ; type=int\nEND: program",
+			expected: "'binary' takes 3 operands but got '+ $k2'",
+		},
+		{
+			what:     "unknown operator",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = unary + $k2 ; type=int\nEND: program",
+			expected: "Unknown unary operator '+'",
+		},
+		{
+			what:     "unclosed block",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = unit ; type=unit",
+			expected: "End of block 'program' is expected but reached end of input",
+		},
+		{
+			what:     "mismatched end of block",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = unit ; type=unit\nEND: then",
+			expected: "'END: program' is expected but got 'END: then'",
+		},
+		{
+			what:     "function type mismatch",
+			code:     "[TOPLEVELS (1)]\nf$t1 = fun a$t2,b$t3 ; type=int -> int\nBEGIN: body (f$t1)\n$k1 = ref a$t2 ; type=int\nEND: body (f$t1)\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k2 = unit ; type=unit\nEND: program",
+			expected: "Type of function 'f$t1' with 2 parameters must be function type but got 'int -> int'",
+		},
+		{
+			what:     "toplevel is not a function",
+			code:     "[TOPLEVELS (1)]\n$k1 = unit ; type=unit\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k2 = unit ; type=unit\nEND: program",
+			expected: "Toplevel '$k1' must be a function",
+		},
+		{
+			what:     "trailing line",
+			code:     "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n$k1 = unit ; type=unit\nEND: program\n$k2 = unit ; type=unit",
+			expected: "Unexpected line '$k2 = unit ; type=unit' after entry block",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			_, _, err := Parse(locerr.NewDummySource(tc.code))
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected '%s' to be contained in error message '%s'", tc.expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	code := "[TOPLEVELS (0)]\n[CLOSURES (0)]\n[ENTRY]\nBEGIN: program\n  $k1 = foo ; type=unit\nEND: program"
+	_, _, err := Parse(locerr.NewDummySource(code))
+	if err == nil {
+		t.Fatal("Error did not occur")
+	}
+	e, ok := err.(*locerr.Error)
+	if !ok {
+		t.Fatalf("Error should be locerr.Error: %v", err)
+	}
+	if e.Start.Line != 5 || e.Start.Column != 9 {
+		t.Errorf("Error should be at 5:9 but got %d:%d", e.Start.Line, e.Start.Column)
+	}
+}
@@ -0,0 +1,171 @@
+package mir
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"io"
+	"time"
+)
+
+// Pass is a transformation of MIR program run by PassManager.
+type Pass interface {
+	Name() string
+	// Requires returns names of analyses whose results are used by the pass. They are computed
+	// before running the pass and can be obtained via PassContext.Result.
+	Requires() []string
+	Run(ctx *PassContext) error
+}
+
+// Analysis computes information on MIR program without modifying it. Its result is cached until
+// some pass transforms the program.
+type Analysis interface {
+	Name() string
+	Analyze(prog *Program, env *types.Env) interface{}
+}
+
+// PassContext is a state shared by passes while running a pipeline.
+type PassContext struct {
+	Prog *Program
+	Env  *types.Env
+	// Profile recorded by instrumented executable. It is nil when no profile is given.
+	Profile *Profile
+	results map[string]interface{}
+}
+
+// Result returns the result of the analysis. It panics when the analysis is not required by the
+// running pass.
+func (ctx *PassContext) Result(analysis string) interface{} {
+	r, ok := ctx.results[analysis]
+	if !ok {
+		panic("FATAL: Result of analysis '" + analysis + "' is not available. Pass must declare it as requirement")
+	}
+	return r
+}
+
+type passFunc struct {
+	name     string
+	requires []string
+	run      func(ctx *PassContext) error
+}
+
+func (p *passFunc) Name() string {
+	return p.name
+}
+
+func (p *passFunc) Requires() []string {
+	return p.requires
+}
+
+func (p *passFunc) Run(ctx *PassContext) error {
+	return p.run(ctx)
+}
+
+// PassFunc makes a pass from the function.
+func PassFunc(name string, requires []string, run func(ctx *PassContext) error) Pass {
+	return &passFunc{name, requires, run}
+}
+
+// PassStat is a statistics of running a pass or an analysis.
+type PassStat struct {
+	Name     string
+	Analysis bool
+	// Wall time to run the pass
+	Time time.Duration
+	// Number of instructions in the program before and after the pass
+	SizeBefore int
+	SizeAfter  int
+}
+
+// PassManager runs a pipeline of passes in order. Analyses required by passes are run on demand.
+type PassManager struct {
+	// Verify makes the manager verify the program after each pass.
+	Verify bool
+	// Profile is passed to passes via PassContext.
+	Profile *Profile
+	// Stats of passes and analyses run by the last Run call in order
+	Stats    []PassStat
+	passes   []Pass
+	analyses map[string]Analysis
+}
+
+// NewPassManager creates an empty pipeline.
+func NewPassManager() *PassManager {
+	return &PassManager{false, nil, nil, []Pass{}, map[string]Analysis{}}
+}
+
+// Add appends the pass to the pipeline.
+func (pm *PassManager) Add(p Pass) {
+	pm.passes = append(pm.passes, p)
+}
+
+// RegisterAnalysis makes the analysis available to passes in the pipeline.
+func (pm *PassManager) RegisterAnalysis(a Analysis) {
+	pm.analyses[a.Name()] = a
+}
+
+// Passes returns names of passes in the pipeline in order.
+func (pm *PassManager) Passes() []string {
+	names := make([]string, 0, len(pm.passes))
+	for _, p := range pm.passes {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// Run applies passes in the pipeline to the program. It stops at the first pass which fails.
+func (pm *PassManager) Run(prog *Program, env *types.Env) error {
+	ctx := &PassContext{prog, env, pm.Profile, map[string]interface{}{}}
+	pm.Stats = []PassStat{}
+	size := prog.Size()
+	for _, p := range pm.passes {
+		for _, name := range p.Requires() {
+			if _, ok := ctx.results[name]; ok {
+				continue
+			}
+			a, ok := pm.analyses[name]
+			if !ok {
+				return locerr.Errorf("Analysis '%s' required by pass '%s' is not registered", name, p.Name())
+			}
+			start := time.Now()
+			ctx.results[name] = a.Analyze(prog, env)
+			pm.Stats = append(pm.Stats, PassStat{name, true, time.Since(start), size, size})
+		}
+
+		start := time.Now()
+		err := p.Run(ctx)
+		elapsed := time.Since(start)
+		if err != nil {
+			return locerr.Notef(err, "Pass '%s' failed", p.Name())
+		}
+		after := prog.Size()
+		pm.Stats = append(pm.Stats, PassStat{p.Name(), false, elapsed, size, after})
+		size = after
+		// Passes may modify the program. Results of analyses are no longer valid.
+		ctx.results = map[string]interface{}{}
+
+		if pm.Verify {
+			if err := Verify(prog); err != nil {
+				return locerr.Notef(err, "MIR is broken after pass '%s'", p.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// DumpStats outputs statistics of the last Run call as a table.
+func (pm *PassManager) DumpStats(out io.Writer) {
+	fmt.Fprintf(out, "%-24s %12s %8s %8s\n", "Pass", "Time", "Before", "After")
+	total := time.Duration(0)
+	for _, s := range pm.Stats {
+		name := s.Name
+		if s.Analysis {
+			name = "(" + name + ")"
+		}
+		fmt.Fprintf(out, "%-24s %12s %8d %8d\n", name, s.Time.String(), s.SizeBefore, s.SizeAfter)
+		total += s.Time
+	}
+	if len(pm.Stats) > 0 {
+		fmt.Fprintf(out, "%-24s %12s %8d %8d\n", "Total", total.String(), pm.Stats[0].SizeBefore, pm.Stats[len(pm.Stats)-1].SizeAfter)
+	}
+}
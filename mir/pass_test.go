@@ -0,0 +1,174 @@
+package mir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type countAnalysis struct {
+	count int
+}
+
+func (a *countAnalysis) Name() string {
+	return "count"
+}
+
+func (a *countAnalysis) Analyze(prog *Program, env *types.Env) interface{} {
+	a.count++
+	return a.count
+}
+
+func testPassProgram() *Program {
+	return &Program{
+		NewToplevel(),
+		Closures{},
+		NewBlockFromArray("program", []*Insn{
+			NewInsn("$k1", UnitVal, locerr.Pos{}),
+		}),
+		map[string]struct{}{},
+		map[string]string{},
+		map[string]string{},
+	}
+}
+
+func TestPassManagerRunsPassesInOrder(t *testing.T) {
+	a := &countAnalysis{}
+	pm := NewPassManager()
+	pm.RegisterAnalysis(a)
+
+	log := []string{}
+	record := func(name string, requires ...string) Pass {
+		return PassFunc(name, requires, func(ctx *PassContext) error {
+			entry := name
+			if len(requires) > 0 {
+				entry = fmt.Sprintf("%s:%d", name, ctx.Result("count").(int))
+			}
+			log = append(log, entry)
+			return nil
+		})
+	}
+	pm.Add(record("a", "count"))
+	pm.Add(record("b"))
+	pm.Add(record("c", "count"))
+	pm.Add(record("d", "count", "count"))
+
+	if names := pm.Passes(); !reflect.DeepEqual(names, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("Unexpected passes: %v", names)
+	}
+	if err := pm.Run(testPassProgram(), types.NewEnv()); err != nil {
+		t.Fatal(err)
+	}
+	// Analysis is run again for each pass since all passes may modify the program
+	expected := []string{"a:1", "b", "c:2", "d:3"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("Wanted %v but got %v", expected, log)
+	}
+}
+
+func TestPassManagerErrors(t *testing.T) {
+	cases := []struct {
+		what     string
+		pass     Pass
+		verify   bool
+		expected string
+	}{
+		{
+			what:     "unregistered analysis",
+			pass:     PassFunc("foo", []string{"unknown"}, func(*PassContext) error { return nil }),
+			expected: "Analysis 'unknown' required by pass 'foo' is not registered",
+		},
+		{
+			what:     "pass fails",
+			pass:     PassFunc("foo", nil, func(*PassContext) error { return errors.New("oops") }),
+			expected: "Pass 'foo' failed",
+		},
+		{
+			what: "broken program",
+			pass: PassFunc("foo", nil, func(ctx *PassContext) error {
+				ctx.Prog.Entry.Bottom.Prev.Val = &Ref{"unknown"}
+				return nil
+			}),
+			verify:   true,
+			expected: "MIR is broken after pass 'foo'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			pm := NewPassManager()
+			pm.Verify = tc.verify
+			pm.Add(tc.pass)
+			err := pm.Run(testPassProgram(), types.NewEnv())
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected '%s' to be contained in error message '%s'", tc.expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestResultOfUndeclaredAnalysis(t *testing.T) {
+	pm := NewPassManager()
+	pm.RegisterAnalysis(&countAnalysis{})
+	pm.Add(PassFunc("foo", nil, func(ctx *PassContext) error {
+		ctx.Result("count")
+		return nil
+	}))
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Getting result of undeclared analysis should panic")
+		}
+	}()
+	pm.Run(testPassProgram(), types.NewEnv())
+}
+
+func TestPassStats(t *testing.T) {
+	pm := NewPassManager()
+	pm.RegisterAnalysis(&countAnalysis{})
+	pm.Add(PassFunc("grow", []string{"count"}, func(ctx *PassContext) error {
+		ctx.Prog.Entry.Append(NewInsn("$k2", UnitVal, locerr.Pos{}))
+		return nil
+	}))
+	pm.Add(PassFunc("nothing", nil, func(*PassContext) error { return nil }))
+	if err := pm.Run(testPassProgram(), types.NewEnv()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PassStat{
+		{"count", true, 0, 1, 1},
+		{"grow", false, 0, 1, 2},
+		{"nothing", false, 0, 2, 2},
+	}
+	if len(pm.Stats) != len(expected) {
+		t.Fatalf("Wanted %d stats but got %v", len(expected), pm.Stats)
+	}
+	for i, s := range pm.Stats {
+		if s.Time < 0 {
+			t.Errorf("Time of '%s' should not be negative: %v", s.Name, s.Time)
+		}
+		s.Time = 0
+		if s != expected[i] {
+			t.Errorf("Wanted %v but got %v", expected[i], s)
+		}
+	}
+
+	var buf bytes.Buffer
+	pm.DumpStats(&buf)
+	out := buf.String()
+	for _, want := range []string{"Pass", "(count)", "grow", "nothing", "Total"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("'%s' is not contained in stats: %s", want, out)
+		}
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 5 {
+		t.Errorf("Stats should have header, 3 entries and total: %s", out)
+	}
+}
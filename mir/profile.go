@@ -0,0 +1,109 @@
+package mir
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rhysd/locerr"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Note:
+// Profile is recorded by an executable compiled with instrumentation. Each line of the profile is a
+// kind of the site, its source position and the number of times it was executed.
+//   call 3:10 1200
+//   then 5:5 1199
+//   else 5:5 1
+// 'call' is a call of function. 'then' and 'else' are branches of 'if' taken. Sites are identified by
+// their source positions so that the profile can be used for compilation with other optimization
+// options. Counts of sites at the same position (e.g. functions inlined into several callers) are
+// summed.
+
+const (
+	ProfileCall = "call"
+	ProfileThen = "then"
+	ProfileElse = "else"
+)
+
+// ProfileSite returns the name of the site in profile.
+func ProfileSite(kind string, pos locerr.Pos) string {
+	return fmt.Sprintf("%s %d:%d", kind, pos.Line, pos.Column)
+}
+
+// Profile is execution counts of sites in the program.
+type Profile struct {
+	counts map[string]int64
+	// The largest count of calls
+	maxCall int64
+}
+
+// NewProfile creates an empty profile.
+func NewProfile() *Profile {
+	return &Profile{map[string]int64{}, 0}
+}
+
+// Add adds the count to the site.
+func (p *Profile) Add(kind string, pos locerr.Pos, count int64) {
+	site := ProfileSite(kind, pos)
+	p.counts[site] += count
+	if kind == ProfileCall && p.counts[site] > p.maxCall {
+		p.maxCall = p.counts[site]
+	}
+}
+
+// Count returns the number of times the site was executed. The second return value is false when
+// the site is not recorded in the profile.
+func (p *Profile) Count(kind string, pos locerr.Pos) (int64, bool) {
+	c, ok := p.counts[ProfileSite(kind, pos)]
+	return c, ok
+}
+
+// MaxCall returns the count of the hottest call site.
+func (p *Profile) MaxCall() int64 {
+	return p.maxCall
+}
+
+// ParseProfile parses the profile. The file is used for error messages.
+func ParseProfile(r io.Reader, file string) (*Profile, error) {
+	p := NewProfile()
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 3 {
+			return nil, locerr.Errorf("Invalid line %d in profile '%s': 3 fields are expected but got '%s'", line, file, l)
+		}
+		kind := fields[0]
+		if kind != ProfileCall && kind != ProfileThen && kind != ProfileElse {
+			return nil, locerr.Errorf("Invalid line %d in profile '%s': Unknown kind of site '%s'", line, file, kind)
+		}
+		var pos locerr.Pos
+		if _, err := fmt.Sscanf(fields[1], "%d:%d", &pos.Line, &pos.Column); err != nil {
+			return nil, locerr.Errorf("Invalid line %d in profile '%s': Position must be 'line:column' but got '%s'", line, file, fields[1])
+		}
+		count, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || count < 0 {
+			return nil, locerr.Errorf("Invalid line %d in profile '%s': Count must be a non-negative integer but got '%s'", line, file, fields[2])
+		}
+		p.Add(kind, pos, count)
+	}
+	if err := s.Err(); err != nil {
+		return nil, locerr.Notef(err, "Cannot read profile '%s'", file)
+	}
+	return p, nil
+}
+
+// ReadProfile reads the profile from the file.
+func ReadProfile(file string) (*Profile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, locerr.Notef(err, "Cannot open profile '%s'", file)
+	}
+	defer f.Close()
+	return ParseProfile(f, file)
+}
@@ -0,0 +1,70 @@
+package mir
+
+import (
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	src := `call 3:10 1200
+then 5:5 1199
+
+else 5:5 1
+call 3:10 300
+call 7:1 0
+`
+	p, err := ParseProfile(strings.NewReader(src), "test.profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		kind  string
+		line  int
+		col   int
+		count int64
+		ok    bool
+	}{
+		{ProfileCall, 3, 10, 1500, true},
+		{ProfileThen, 5, 5, 1199, true},
+		{ProfileElse, 5, 5, 1, true},
+		{ProfileCall, 7, 1, 0, true},
+		{ProfileCall, 5, 5, 0, false},
+		{ProfileThen, 3, 10, 0, false},
+	} {
+		c, ok := p.Count(tc.kind, locerr.Pos{Line: tc.line, Column: tc.col})
+		if ok != tc.ok || c != tc.count {
+			t.Errorf("Wanted (%d, %v) for '%s %d:%d' but got (%d, %v)", tc.count, tc.ok, tc.kind, tc.line, tc.col, c, ok)
+		}
+	}
+
+	if p.MaxCall() != 1500 {
+		t.Errorf("Count of hottest call should be 1500 but got %d", p.MaxCall())
+	}
+}
+
+func TestParseProfileError(t *testing.T) {
+	for _, tc := range []struct {
+		what     string
+		src      string
+		expected string
+	}{
+		{"too few fields", "call 3:10", "3 fields are expected"},
+		{"unknown kind", "loop 3:10 1", "Unknown kind of site 'loop'"},
+		{"invalid position", "call 3 1", "Position must be 'line:column'"},
+		{"invalid count", "call 3:10 a", "Count must be a non-negative integer"},
+		{"negative count", "call 3:10 -1", "Count must be a non-negative integer"},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			_, err := ParseProfile(strings.NewReader("then 1:1 0\n"+tc.src), "test.profile")
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			msg := err.Error()
+			if !strings.Contains(msg, tc.expected) || !strings.Contains(msg, "line 2") {
+				t.Fatalf("Unexpected error message: %s", msg)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
 	"io"
+	"sort"
 	"strings"
 )
 
@@ -27,17 +28,49 @@ func (top Toplevel) Add(n string, f *Fun, p locerr.Pos) {
 	top[n] = FunInsn{n, f, p}
 }
 
+// Names returns sorted names of toplevel functions.
+func (top Toplevel) Names() []string {
+	ns := make([]string, 0, len(top))
+	for n := range top {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
 // Program representation. Program can be obtained after closure transform because
 // all functions must be at the top.
 type Program struct {
 	Toplevel Toplevel // Mapping from function name to its instruction
 	Closures Closures // Mapping from closure name to it free variables
 	Entry    *Block
+	// Identifiers of tuples and closures which never escape from the function creating them. They
+	// are allocated on stack instead of heap. It is filled by escape analysis.
+	StackAllocated map[string]struct{}
+	// Mapping from identifiers of 'makecls' instructions to identifiers of preceding 'makecls'
+	// instructions whose captured environments are reused. It is filled by closure environment
+	// minimization.
+	SharedEnvs map[string]string
+	// Mapping from closure names to names of their enclosing closures. Environment of the closure
+	// points to the environment of the enclosing closure instead of copying variables captured by
+	// both. It is filled when closures are linked (see closure.LinkEnvs).
+	EnvLinks map[string]string
+}
+
+// Size returns the number of instructions in the program. Each toplevel function is counted as one
+// instruction in addition to its body.
+func (prog *Program) Size() int {
+	size := prog.Entry.Size()
+	for _, f := range prog.Toplevel {
+		size += 1 + f.Val.Body.Size()
+	}
+	return size
 }
 
 func (prog *Program) PrintToplevels(out io.Writer, env *types.Env) {
 	p := printer{env, out, ""}
-	for n, f := range prog.Toplevel {
+	for _, n := range prog.Toplevel.Names() {
+		f := prog.Toplevel[n]
 		p.printlnInsn(NewInsn(n, f.Val, f.Pos))
 		fmt.Fprintln(out)
 	}
@@ -48,8 +81,13 @@ func (prog *Program) Dump(out io.Writer, env *types.Env) {
 	prog.PrintToplevels(out, env)
 
 	fmt.Fprintf(out, "[CLOSURES (%d)]\n", len(prog.Closures))
-	for c, fv := range prog.Closures {
-		fmt.Fprintf(out, "%s:\t%s\n", c, strings.Join(fv, ","))
+	names := make([]string, 0, len(prog.Closures))
+	for c := range prog.Closures {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	for _, c := range names {
+		fmt.Fprintf(out, "%s:\t%s\n", c, strings.Join(prog.Closures[c], ","))
 	}
 	fmt.Fprintln(out)
 
@@ -61,3 +99,78 @@ func (prog *Program) Println(out io.Writer, env *types.Env) {
 	prog.PrintToplevels(out, env)
 	prog.Entry.Println(out, env)
 }
+
+type typeVarFinder struct {
+	found bool
+}
+
+func (f *typeVarFinder) VisitTopdown(t types.Type) types.Visitor {
+	if f.found {
+		return nil
+	}
+	switch t := t.(type) {
+	case *types.Var:
+		if t.Ref == nil {
+			f.found = true
+			return nil
+		}
+	case *types.Forall:
+		f.found = true
+		return nil
+	case *types.Variant:
+		// Row variable of open variant does not change representation of its values
+		for _, tag := range t.Tags {
+			if tag.Payload != nil {
+				types.Visit(f, tag.Payload)
+			}
+		}
+		return nil
+	}
+	return f
+}
+
+func (f *typeVarFinder) VisitBottomup(types.Type) {}
+
+func isMonomorphic(t types.Type) bool {
+	f := &typeVarFinder{}
+	types.Visit(f, t)
+	return !f.found
+}
+
+func checkMonomorphicBlock(b *Block, env *types.Env) *Insn {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		if t, ok := env.DeclTable[i.Ident]; ok && !isMonomorphic(t) {
+			return i
+		}
+		if v, ok := i.Val.(*If); ok {
+			if found := checkMonomorphicBlock(v.Then, env); found != nil {
+				return found
+			}
+			if found := checkMonomorphicBlock(v.Else, env); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// CheckMonomorphic returns an error when some value in the program has a polymorphic type. 'user'
+// describes what needs monomorphic types (e.g. "C backend") and is included in the error message.
+func (prog *Program) CheckMonomorphic(env *types.Env, user string) error {
+	err := func(ident string, pos locerr.Pos) error {
+		return locerr.ErrorfAt(pos, "Type of '%s' is polymorphic type '%s' but %s needs monomorphic types. Generic functions are not monomorphized yet", ident, env.DeclTable[ident].String(), user)
+	}
+	for _, n := range prog.Toplevel.Names() {
+		f := prog.Toplevel[n]
+		if !isMonomorphic(env.DeclTable[n]) {
+			return err(n, f.Pos)
+		}
+		if i := checkMonomorphicBlock(f.Val.Body, env); i != nil {
+			return err(i.Ident, i.Pos)
+		}
+	}
+	if i := checkMonomorphicBlock(prog.Entry, env); i != nil {
+		return err(i.Ident, i.Pos)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package mir
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
 	"strings"
@@ -15,6 +16,9 @@ func TestDump(t *testing.T) {
 		NewBlockFromArray("program", []*Insn{
 			NewInsn("$k1", UnitVal, locerr.Pos{}),
 		}),
+		map[string]struct{}{},
+		map[string]string{},
+		map[string]string{},
 	}
 
 	env := types.NewEnv()
@@ -33,3 +37,72 @@ func TestDump(t *testing.T) {
 		t.Fatalf("Entry section not found")
 	}
 }
+
+func TestProgramSize(t *testing.T) {
+	prog, _, err := Parse(locerr.NewDummySource(`[TOPLEVELS (1)]
+f$t1 = fun x$t2 ; type=int -> int
+  BEGIN: body (f$t1)
+  $k1 = bool true ; type=bool
+  $k2 = if $k1 ; type=int
+    BEGIN: then
+    $k3 = int 1 ; type=int
+    END: then
+    BEGIN: else
+    $k4 = int 2 ; type=int
+    END: else
+  END: body (f$t1)
+
+[CLOSURES (0)]
+
+[ENTRY]
+BEGIN: program
+$k5 = int 1 ; type=int
+$k6 = app f$t1 $k5 ; type=int
+END: program
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := prog.Toplevel["f$t1"].Val.Body.Size(); size != 4 {
+		t.Errorf("Size of function body should be 4 but got %d", size)
+	}
+	if size := prog.Size(); size != 7 {
+		t.Errorf("Size of program should be 7 but got %d", size)
+	}
+}
+
+func TestCheckMonomorphic(t *testing.T) {
+	src := `[TOPLEVELS (1)]
+id$t1 = fun x$t2 ; type=%s
+  BEGIN: body (id$t1)
+  $k1 = ref x$t2 ; type=%s
+  END: body (id$t1)
+
+[CLOSURES (0)]
+
+[ENTRY]
+BEGIN: program
+$k2 = int 1 ; type=int
+$k3 = app id$t1 $k2 ; type=int
+END: program
+`
+	prog, env, err := Parse(locerr.NewDummySource(fmt.Sprintf(src, "int -> int", "int")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.CheckMonomorphic(env, "test"); err != nil {
+		t.Fatal("Monomorphic program was rejected:", err)
+	}
+
+	prog, env, err = Parse(locerr.NewDummySource(fmt.Sprintf(src, "'a -> 'a", "'a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = prog.CheckMonomorphic(env, "test")
+	if err == nil {
+		t.Fatal("Polymorphic program was not rejected")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Type of 'id$t1' is polymorphic type ''a -> 'a' but test needs monomorphic types") {
+		t.Fatal("Unexpected error:", msg)
+	}
+}
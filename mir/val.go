@@ -138,6 +138,26 @@ type (
 	ArrLen struct {
 		Array string
 	}
+	// Check the index is in bounds of the array. Program aborts reporting its position when the
+	// index is out of bounds. Its value is unit.
+	BoundsCheck struct {
+		Array, Index string
+	}
+	// Create an empty hash table
+	Table struct {
+	}
+	// Find the value of the key in the table. Its value is an option
+	TblLoad struct {
+		From, Key string
+	}
+	// Set the value of the key in the table. Its value is unit
+	TblStore struct {
+		To, Key, RHS string
+	}
+	// Remove the key from the table. Its value is unit
+	TblRemove struct {
+		From, Key string
+	}
 	Some struct {
 		Elem string
 	}
@@ -149,11 +169,30 @@ type (
 	DerefSome struct {
 		SomeVal string
 	}
+	Variant struct {
+		Tag     string
+		Payload string // Empty when the tag has no payload
+	}
+	IsVariant struct {
+		Target string
+		Tag    string
+	}
+	VariantPayload struct {
+		Target string
+	}
 	XRef struct {
 		Ident string
 	}
 	NOP struct {
 	}
+	// Value of expression which never returns such as 'exit'. It is never used at runtime.
+	Unreachable struct {
+	}
+	// Jump to the beginning of the enclosing function with new arguments. Introduced by tail call
+	// optimization and by 'break' and 'continue' in 'for' loop. Its value is never used.
+	Jump struct {
+		Args []string
+	}
 	// Introduced at closure-transform.
 	MakeCls struct {
 		Vars []string
@@ -162,9 +201,10 @@ type (
 )
 
 var (
-	UnitVal = &Unit{}
-	NOPVal  = &NOP{}
-	NoneVal = &None{}
+	UnitVal        = &Unit{}
+	NOPVal         = &NOP{}
+	NoneVal        = &None{}
+	UnreachableVal = &Unreachable{}
 )
 
 func (v *Unit) Print(out io.Writer) {
@@ -177,7 +217,12 @@ func (v *Int) Print(out io.Writer) {
 	fmt.Fprintf(out, "int %d", v.Const)
 }
 func (v *Float) Print(out io.Writer) {
-	fmt.Fprintf(out, "float %f", v.Const)
+	s := fmt.Sprintf("%f", v.Const)
+	if f, err := strconv.ParseFloat(s, 64); err != nil || f != v.Const {
+		// Print the shortest exact representation when 6 digits after the point are not enough
+		s = strconv.FormatFloat(v.Const, 'g', -1, 64)
+	}
+	fmt.Fprintf(out, "float %s", s)
 }
 func (v *String) Print(out io.Writer) {
 	fmt.Fprintf(out, "string %s", strconv.Quote(v.Const))
@@ -225,12 +270,33 @@ func (v *ArrStore) Print(out io.Writer) {
 func (v *ArrLen) Print(out io.Writer) {
 	fmt.Fprintf(out, "arrlen %s", v.Array)
 }
+func (v *BoundsCheck) Print(out io.Writer) {
+	fmt.Fprintf(out, "boundscheck %s %s", v.Index, v.Array)
+}
+func (v *Table) Print(out io.Writer) {
+	fmt.Fprint(out, "table")
+}
+func (v *TblLoad) Print(out io.Writer) {
+	fmt.Fprintf(out, "tblload %s %s", v.Key, v.From)
+}
+func (v *TblStore) Print(out io.Writer) {
+	fmt.Fprintf(out, "tblstore %s %s %s", v.Key, v.To, v.RHS)
+}
+func (v *TblRemove) Print(out io.Writer) {
+	fmt.Fprintf(out, "tblremove %s %s", v.Key, v.From)
+}
 func (v *XRef) Print(out io.Writer) {
 	fmt.Fprintf(out, "xref %s", v.Ident)
 }
 func (v *NOP) Print(out io.Writer) {
 	fmt.Fprint(out, "nop")
 }
+func (v *Unreachable) Print(out io.Writer) {
+	fmt.Fprint(out, "unreachable")
+}
+func (v *Jump) Print(out io.Writer) {
+	fmt.Fprintf(out, "jump %s", strings.Join(v.Args, ","))
+}
 func (v *MakeCls) Print(out io.Writer) {
 	fmt.Fprintf(out, "makecls (%s) %s", strings.Join(v.Vars, ","), v.Fun)
 }
@@ -246,3 +312,90 @@ func (v *IsSome) Print(out io.Writer) {
 func (v *DerefSome) Print(out io.Writer) {
 	fmt.Fprintf(out, "derefsome %s", v.SomeVal)
 }
+func (v *Variant) Print(out io.Writer) {
+	if v.Payload == "" {
+		fmt.Fprintf(out, "variant `%s", v.Tag)
+		return
+	}
+	fmt.Fprintf(out, "variant `%s %s", v.Tag, v.Payload)
+}
+func (v *IsVariant) Print(out io.Writer) {
+	fmt.Fprintf(out, "isvariant `%s %s", v.Tag, v.Target)
+}
+func (v *VariantPayload) Print(out io.Writer) {
+	fmt.Fprintf(out, "variantpayload %s", v.Target)
+}
+
+func renameAll(names []string, rename func(string) string) {
+	for i, n := range names {
+		names[i] = rename(n)
+	}
+}
+
+// RenameOperands replaces identifiers used by the value with the results of the rename function.
+// Blocks nested in the value are not visited.
+func RenameOperands(val Val, rename func(string) string) {
+	switch v := val.(type) {
+	case *Unary:
+		v.Child = rename(v.Child)
+	case *Binary:
+		v.LHS = rename(v.LHS)
+		v.RHS = rename(v.RHS)
+	case *Ref:
+		v.Ident = rename(v.Ident)
+	case *If:
+		v.Cond = rename(v.Cond)
+	case *App:
+		v.Callee = rename(v.Callee)
+		renameAll(v.Args, rename)
+	case *Tuple:
+		renameAll(v.Elems, rename)
+	case *TplLoad:
+		v.From = rename(v.From)
+	case *Array:
+		v.Size = rename(v.Size)
+		v.Elem = rename(v.Elem)
+	case *ArrLit:
+		renameAll(v.Elems, rename)
+	case *ArrLoad:
+		v.From = rename(v.From)
+		v.Index = rename(v.Index)
+	case *ArrStore:
+		v.To = rename(v.To)
+		v.Index = rename(v.Index)
+		v.RHS = rename(v.RHS)
+	case *ArrLen:
+		v.Array = rename(v.Array)
+	case *BoundsCheck:
+		v.Array = rename(v.Array)
+		v.Index = rename(v.Index)
+	case *TblLoad:
+		v.From = rename(v.From)
+		v.Key = rename(v.Key)
+	case *TblStore:
+		v.To = rename(v.To)
+		v.Key = rename(v.Key)
+		v.RHS = rename(v.RHS)
+	case *TblRemove:
+		v.From = rename(v.From)
+		v.Key = rename(v.Key)
+	case *Some:
+		v.Elem = rename(v.Elem)
+	case *IsSome:
+		v.OptVal = rename(v.OptVal)
+	case *DerefSome:
+		v.SomeVal = rename(v.SomeVal)
+	case *Variant:
+		if v.Payload != "" {
+			v.Payload = rename(v.Payload)
+		}
+	case *IsVariant:
+		v.Target = rename(v.Target)
+	case *VariantPayload:
+		v.Target = rename(v.Target)
+	case *MakeCls:
+		renameAll(v.Vars, rename)
+	case *Jump:
+		renameAll(v.Args, rename)
+	}
+}
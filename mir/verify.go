@@ -0,0 +1,271 @@
+package mir
+
+import (
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// Verifier checks structural invariants of MIR program after closure transform. It is useful to
+// detect broken MIR produced by transform or optimization passes before generating code from it.
+//
+// - Every block has NOP instructions at its top and bottom, and its instructions are linked properly
+// - Every block contains at least one instruction and 'jump' appears only at the end of a block
+// - Every identifier is defined only once in the program
+// - Every operand refers to a value defined before it in scope
+// - Free variables used in a closure body are captured by the closure
+// - No 'fun' instruction remains since all functions must be moved to toplevel
+// - Callee of direct call and function of 'makecls' are toplevel functions
+// - Closure sharing environment of another closure is defined after the closure in its scope
+// - Closure linked to environment of another closure is made only in the body of the closure
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type funScope struct {
+	name    string
+	params  []string
+	closure bool
+}
+
+type verifier struct {
+	prog *Program
+	// All identifiers defined in the program
+	defined map[string]struct{}
+	// Identifiers visible at current instruction
+	visible map[string]struct{}
+	fun     *funScope
+}
+
+func (v *verifier) define(name string, pos locerr.Pos) error {
+	if _, ok := v.defined[name]; ok {
+		return locerr.ErrorfAt(pos, "Identifier '%s' is defined more than once", name)
+	}
+	v.defined[name] = struct{}{}
+	return nil
+}
+
+func (v *verifier) collectDefs(b *Block) error {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		if err := v.define(i.Ident, i.Pos); err != nil {
+			return err
+		}
+		if val, ok := i.Val.(*If); ok {
+			if err := v.collectDefs(val.Then); err != nil {
+				return err
+			}
+			if err := v.collectDefs(val.Else); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *verifier) where() string {
+	if v.fun == nil {
+		return "entry"
+	}
+	return "function '" + v.fun.name + "'"
+}
+
+func (v *verifier) checkOperand(name string, insn *Insn) error {
+	if _, ok := v.visible[name]; ok {
+		return nil
+	}
+	if _, ok := v.defined[name]; ok && v.fun != nil && v.fun.closure {
+		return locerr.ErrorfAt(insn.Pos, "Free variable '%s' used at '%s' is not captured by closure '%s'", name, insn.Ident, v.fun.name)
+	}
+	return locerr.ErrorfAt(insn.Pos, "Identifier '%s' used at '%s' in %s is not defined in its scope", name, insn.Ident, v.where())
+}
+
+func (v *verifier) checkToplevelFun(name string, insn *Insn) error {
+	if _, ok := v.prog.Toplevel[name]; !ok {
+		return locerr.ErrorfAt(insn.Pos, "Function '%s' referred at '%s' in %s is not a toplevel function", name, insn.Ident, v.where())
+	}
+	return nil
+}
+
+func (v *verifier) checkVal(insn *Insn) error {
+	switch val := insn.Val.(type) {
+	case *Fun:
+		return locerr.ErrorfAt(insn.Pos, "Function '%s' remains in %s. All functions must be moved to toplevel by closure transform", insn.Ident, v.where())
+	case *NOP:
+		return locerr.ErrorfAt(insn.Pos, "NOP instruction '%s' appears in the middle of block in %s", insn.Ident, v.where())
+	case *App:
+		switch val.Kind {
+		case DIRECT_CALL:
+			if err := v.checkToplevelFun(val.Callee, insn); err != nil {
+				return err
+			}
+			// Closure which captures nothing can be called directly since its captures are never accessed
+			if caps, ok := v.prog.Closures[val.Callee]; ok && len(caps) > 0 {
+				return locerr.ErrorfAt(insn.Pos, "Closure '%s' is called directly at '%s' without its captures", val.Callee, insn.Ident)
+			}
+		case CLOSURE_CALL:
+			if err := v.checkOperand(val.Callee, insn); err != nil {
+				return err
+			}
+		}
+		for _, a := range val.Args {
+			if err := v.checkOperand(a, insn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *MakeCls:
+		if err := v.checkToplevelFun(val.Fun, insn); err != nil {
+			return err
+		}
+		caps, ok := v.prog.Closures[val.Fun]
+		if !ok {
+			return locerr.ErrorfAt(insn.Pos, "Function '%s' of closure '%s' is not registered as closure", val.Fun, insn.Ident)
+		}
+		if len(caps) != len(val.Vars) {
+			return locerr.ErrorfAt(insn.Pos, "Closure '%s' captures %d variables but closure '%s' requires %d", insn.Ident, len(val.Vars), val.Fun, len(caps))
+		}
+		if parent, ok := v.prog.EnvLinks[val.Fun]; ok {
+			if v.fun == nil || v.fun.name != parent || !v.fun.closure {
+				return locerr.ErrorfAt(insn.Pos, "Closure '%s' linked to environment of closure '%s' is made outside it in %s", insn.Ident, parent, v.where())
+			}
+			for i, c := range caps {
+				if val.Vars[i] != c && containsName(v.prog.Closures[parent], c) {
+					return locerr.ErrorfAt(insn.Pos, "Closure '%s' captures '%s' as '%s' but it must be loaded from environment of closure '%s'", insn.Ident, val.Vars[i], c, parent)
+				}
+			}
+		}
+		if shared, ok := v.prog.SharedEnvs[insn.Ident]; ok {
+			if _, ok := v.visible[shared]; !ok {
+				return locerr.ErrorfAt(insn.Pos, "Closure '%s' shares environment of closure '%s' which is not defined before it in %s", insn.Ident, shared, v.where())
+			}
+		}
+	case *Jump:
+		if v.fun == nil {
+			return locerr.ErrorfAt(insn.Pos, "'jump' at '%s' appears outside function", insn.Ident)
+		}
+		if len(val.Args) != len(v.fun.params) {
+			return locerr.ErrorfAt(insn.Pos, "'jump' at '%s' passes %d arguments but function '%s' takes %d parameters", insn.Ident, len(val.Args), v.fun.name, len(v.fun.params))
+		}
+		if insn.Next.Next != nil {
+			return locerr.ErrorfAt(insn.Pos, "'jump' at '%s' must be the last instruction of block in function '%s'", insn.Ident, v.fun.name)
+		}
+	case *If:
+		if err := v.checkOperand(val.Cond, insn); err != nil {
+			return err
+		}
+		if err := v.verifyBlock(val.Then); err != nil {
+			return err
+		}
+		return v.verifyBlock(val.Else)
+	}
+
+	var err error
+	RenameOperands(insn.Val, func(n string) string {
+		if err == nil {
+			err = v.checkOperand(n, insn)
+		}
+		return n
+	})
+	return err
+}
+
+func (v *verifier) verifyBlock(b *Block) error {
+	if b.Top == nil || b.Bottom == nil || b.Top.Prev != nil || b.Bottom.Next != nil {
+		return locerr.Errorf("Block '%s' in %s does not have top and bottom instructions", b.Name, v.where())
+	}
+	if _, ok := b.Top.Val.(*NOP); !ok {
+		return locerr.Errorf("Top of block '%s' in %s is not NOP", b.Name, v.where())
+	}
+	if _, ok := b.Bottom.Val.(*NOP); !ok {
+		return locerr.Errorf("Bottom of block '%s' in %s is not NOP", b.Name, v.where())
+	}
+	if b.Top.Next == b.Bottom {
+		return locerr.Errorf("Block '%s' in %s contains no instruction", b.Name, v.where())
+	}
+
+	defs := []string{}
+	for i := b.Top; i != b.Bottom; i = i.Next {
+		if i.Next == nil || i.Next.Prev != i {
+			return locerr.ErrorfAt(i.Pos, "Instruction '%s' in block '%s' in %s is not linked properly", i.Ident, b.Name, v.where())
+		}
+		if i == b.Top {
+			continue
+		}
+		if err := v.checkVal(i); err != nil {
+			return err
+		}
+		v.visible[i.Ident] = struct{}{}
+		defs = append(defs, i.Ident)
+	}
+
+	// Values defined in the block are not visible from outside
+	for _, d := range defs {
+		delete(v.visible, d)
+	}
+	return nil
+}
+
+func (v *verifier) verifyFun(f FunInsn) error {
+	if f.Name == "" {
+		return locerr.ErrorAt(f.Pos, "Toplevel function has no name")
+	}
+	caps, isClosure := v.prog.Closures[f.Name]
+	v.fun = &funScope{f.Name, f.Val.Params, isClosure}
+	v.visible = make(map[string]struct{}, len(f.Val.Params)+len(caps)+1)
+	for _, p := range f.Val.Params {
+		v.visible[p] = struct{}{}
+	}
+	for _, c := range caps {
+		v.visible[c] = struct{}{}
+	}
+	if isClosure {
+		// Closure can refer itself in its body
+		v.visible[f.Name] = struct{}{}
+	}
+	err := v.verifyBlock(f.Val.Body)
+	v.fun = nil
+	return err
+}
+
+// Verify checks structural invariants of the program after closure transform and returns an error
+// when it is broken. It does not check types.
+func Verify(prog *Program) error {
+	v := &verifier{prog, map[string]struct{}{}, nil, nil}
+
+	for name, f := range prog.Toplevel {
+		if name != f.Name {
+			return locerr.ErrorfAt(f.Pos, "Toplevel function '%s' is registered with different name '%s'", f.Name, name)
+		}
+		for _, p := range f.Val.Params {
+			if err := v.define(p, f.Pos); err != nil {
+				return err
+			}
+		}
+		if err := v.collectDefs(f.Val.Body); err != nil {
+			return err
+		}
+	}
+	if err := v.collectDefs(prog.Entry); err != nil {
+		return err
+	}
+
+	for name := range prog.Closures {
+		if _, ok := prog.Toplevel[name]; !ok {
+			return locerr.Errorf("Closure '%s' is not a toplevel function", name)
+		}
+	}
+
+	for _, f := range prog.Toplevel {
+		if err := v.verifyFun(f); err != nil {
+			return locerr.NoteAt(f.Pos, err, "Verifying function '"+f.Name+"'")
+		}
+	}
+
+	v.visible = map[string]struct{}{}
+	return v.verifyBlock(prog.Entry)
+}
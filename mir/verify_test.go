@@ -0,0 +1,183 @@
+package mir
+
+import (
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+// Program for 'let x = 1 in let rec f a = a + x in let rec g b = b in g (f 2)' after closure transform
+func verifiedProgram() *Program {
+	pos := locerr.Pos{}
+	top := NewToplevel()
+	top.Add("f$t2", &Fun{[]string{"a$t3"}, NewBlockFromArray("body (f$t2)", []*Insn{
+		NewInsn("$k1", &Binary{ADD, "a$t3", "x$t1"}, pos),
+	}), false}, pos)
+	top.Add("g$t4", &Fun{[]string{"b$t5"}, NewBlockFromArray("body (g$t4)", []*Insn{
+		NewInsn("$k2", &Ref{"b$t5"}, pos),
+	}), false}, pos)
+	entry := NewBlockFromArray("program", []*Insn{
+		NewInsn("x$t1", &Int{1}, pos),
+		NewInsn("f$t2", &MakeCls{[]string{"x$t1"}, "f$t2"}, pos),
+		NewInsn("$k3", &Int{2}, pos),
+		NewInsn("$k4", &App{"f$t2", []string{"$k3"}, CLOSURE_CALL}, pos),
+		NewInsn("$k5", &App{"g$t4", []string{"$k4"}, DIRECT_CALL}, pos),
+	})
+	return &Program{top, Closures{"f$t2": []string{"x$t1"}}, entry, map[string]struct{}{}, map[string]string{}, map[string]string{}}
+}
+
+func TestVerifyOK(t *testing.T) {
+	if err := Verify(verifiedProgram()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBrokenProgram(t *testing.T) {
+	pos := locerr.Pos{}
+	cases := []struct {
+		what     string
+		breaks   func(*Program)
+		expected string
+	}{
+		{
+			what: "undefined identifier",
+			breaks: func(p *Program) {
+				p.Entry.Bottom.Prev.Val.(*App).Args[0] = "$k42"
+			},
+			expected: "Identifier '$k42' used at '$k5' in entry is not defined in its scope",
+		},
+		{
+			what: "use before definition",
+			breaks: func(p *Program) {
+				p.Entry.Prepend(NewInsn("$k6", &Ref{"$k3"}, pos))
+			},
+			expected: "Identifier '$k3' used at '$k6' in entry is not defined in its scope",
+		},
+		{
+			what: "use of value in other function",
+			breaks: func(p *Program) {
+				p.Toplevel["g$t4"].Val.Body.Append(NewInsn("$k6", &Ref{"a$t3"}, pos))
+			},
+			expected: "Identifier 'a$t3' used at '$k6' in function 'g$t4' is not defined in its scope",
+		},
+		{
+			what: "use of value in other branch",
+			breaks: func(p *Program) {
+				then := NewBlockFromArray("then", []*Insn{NewInsn("$k7", &Int{1}, pos)})
+				els := NewBlockFromArray("else", []*Insn{NewInsn("$k8", &Ref{"$k7"}, pos)})
+				p.Entry.Append(NewInsn("$k6", &Bool{true}, pos))
+				p.Entry.Append(NewInsn("$k9", &If{"$k6", then, els}, pos))
+			},
+			expected: "Identifier '$k7' used at '$k8' in entry is not defined in its scope",
+		},
+		{
+			what: "duplicate definition",
+			breaks: func(p *Program) {
+				p.Entry.Append(NewInsn("$k3", &Int{3}, pos))
+			},
+			expected: "Identifier '$k3' is defined more than once",
+		},
+		{
+			what: "free variable not captured",
+			breaks: func(p *Program) {
+				p.Closures["f$t2"] = []string{}
+				p.Entry.Top.Next.Next.Val.(*MakeCls).Vars = []string{}
+			},
+			expected: "Free variable 'x$t1' used at '$k1' is not captured by closure 'f$t2'",
+		},
+		{
+			what: "number of captures mismatch",
+			breaks: func(p *Program) {
+				p.Entry.Top.Next.Next.Val.(*MakeCls).Vars = []string{}
+			},
+			expected: "Closure 'f$t2' captures 0 variables but closure 'f$t2' requires 1",
+		},
+		{
+			what: "shared environment not in scope",
+			breaks: func(p *Program) {
+				p.SharedEnvs["f$t2"] = "$k4"
+			},
+			expected: "Closure 'f$t2' shares environment of closure '$k4' which is not defined before it in entry",
+		},
+		{
+			what: "linked closure made outside its enclosing closure",
+			breaks: func(p *Program) {
+				p.EnvLinks["f$t2"] = "g$t4"
+			},
+			expected: "Closure 'f$t2' linked to environment of closure 'g$t4' is made outside it in entry",
+		},
+		{
+			what: "function remaining",
+			breaks: func(p *Program) {
+				body := NewBlockFromArray("body (h$t6)", []*Insn{NewInsn("$k6", &Unit{}, pos)})
+				p.Entry.Append(NewInsn("h$t6", &Fun{[]string{}, body, false}, pos))
+			},
+			expected: "Function 'h$t6' remains in entry",
+		},
+		{
+			what: "direct call of closure",
+			breaks: func(p *Program) {
+				p.Entry.Top.Next.Next.Next.Next.Val.(*App).Kind = DIRECT_CALL
+			},
+			expected: "Closure 'f$t2' is called directly at '$k4' without its captures",
+		},
+		{
+			what: "direct call of unknown function",
+			breaks: func(p *Program) {
+				p.Entry.Bottom.Prev.Val.(*App).Callee = "h$t6"
+			},
+			expected: "Function 'h$t6' referred at '$k5' in entry is not a toplevel function",
+		},
+		{
+			what: "empty block",
+			breaks: func(p *Program) {
+				p.Entry.Append(NewInsn("$k6", &Bool{true}, pos))
+				then := NewBlockFromArray("then", []*Insn{NewInsn("$k7", &Int{1}, pos)})
+				p.Entry.Append(NewInsn("$k8", &If{"$k6", then, NewEmptyBlock("else")}, pos))
+			},
+			expected: "Block 'else' in entry contains no instruction",
+		},
+		{
+			what: "broken link",
+			breaks: func(p *Program) {
+				p.Entry.Top.Next.Next.Prev = p.Entry.Top
+			},
+			expected: "Instruction 'x$t1' in block 'program' in entry is not linked properly",
+		},
+		{
+			what: "jump in middle of block",
+			breaks: func(p *Program) {
+				p.Toplevel["g$t4"].Val.Body.Prepend(NewInsn("$k6", &Jump{[]string{"b$t5"}}, pos))
+			},
+			expected: "'jump' at '$k6' must be the last instruction of block in function 'g$t4'",
+		},
+		{
+			what: "jump with wrong number of arguments",
+			breaks: func(p *Program) {
+				p.Toplevel["g$t4"].Val.Body.Append(NewInsn("$k6", &Jump{[]string{"b$t5", "$k2"}}, pos))
+			},
+			expected: "'jump' at '$k6' passes 2 arguments but function 'g$t4' takes 1 parameters",
+		},
+		{
+			what: "jump outside function",
+			breaks: func(p *Program) {
+				p.Entry.Append(NewInsn("$k6", &Jump{[]string{}}, pos))
+			},
+			expected: "'jump' at '$k6' appears outside function",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			prog := verifiedProgram()
+			tc.breaks(prog)
+			err := Verify(prog)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Unexpected error message. Expected '%s' to be contained in '%s'", tc.expected, err.Error())
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/rhysd/gocaml/mir"
 	"github.com/rhysd/gocaml/types"
 	"strings"
+	"unicode"
 )
 
 // Monomorphization makes polymorphic instructions into monomorphic ones.
@@ -118,6 +119,19 @@ import (
 // don't break alpha transformation. We introduce another ID counter to solve this.
 // All created instructions due to monomorphization will have a new name with counter. If the counter
 // value is `42`, the instruction monomorphized from `foo$t3` will be named as `foo$t3$42`.
+//
+// Generic external symbols are also monomorphized. Each instantiation of a generic external symbol
+// is a distinct external symbol and its C name is suffixed with the instantiated types.
+//
+// ```
+// external print : 'a. 'a -> unit = "print";
+// print 42;
+// print 3.14
+// ```
+//
+// In above example, `print` is instantiated as `int -> unit` and `float -> unit`. Each `xref print`
+// instruction is replaced with `xref print$int` or `xref print$float`. Their C names are `print_int` and
+// `print_float`. Generic external symbols themselves are removed from the environment.
 
 type typeVarAssignment map[types.VarID]types.Type
 
@@ -172,6 +186,39 @@ func (assign typeVarAssignment) assign(t types.Type) (types.Type, bool) {
 		if changed {
 			return &types.Option{elem}, true
 		}
+	case *types.Result:
+		ok, c1 := assign.assign(t.Ok)
+		err, c2 := assign.assign(t.Error)
+		if c1 || c2 {
+			return &types.Result{ok, err}, true
+		}
+	case *types.Table:
+		key, c1 := assign.assign(t.Key)
+		val, c2 := assign.assign(t.Value)
+		if c1 || c2 {
+			return &types.Table{key, val}, true
+		}
+	case *types.Variant:
+		changed := false
+		tags := make([]*types.VariantTag, 0, len(t.Tags))
+		for _, tag := range t.Tags {
+			p := tag.Payload
+			if p != nil {
+				var c bool
+				p, c = assign.assign(p)
+				changed = changed || c
+			}
+			tags = append(tags, &types.VariantTag{tag.Name, p})
+		}
+		var row types.Type
+		if t.Row != nil {
+			var c bool
+			row, c = assign.assign(t.Row)
+			changed = changed || c
+		}
+		if changed {
+			return &types.Variant{tags, row}, true
+		}
 	case *types.Var:
 		return assign.assignToVar(t)
 	}
@@ -195,6 +242,17 @@ func mangleType(t types.Type) string {
 	return t.String()
 }
 
+var cNameReplacer = strings.NewReplacer("->", " to ", "*", " x ", "(", " lp ", ")", " rp ")
+
+// mangleCName mangles the type into a string which is available as a part of C identifier.
+func mangleCName(t types.Type) string {
+	s := cNameReplacer.Replace(t.String())
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, "_")
+}
+
 type codeDup struct {
 	*monomorphizer
 	replacedIdents map[string]string
@@ -270,9 +328,14 @@ func (dup *codeDup) dupInsn(from *mir.Insn) *mir.Insn {
 	}
 
 	switch val := from.Val.(type) {
-	case *mir.Unit, *mir.Bool, *mir.Int, *mir.Float, *mir.String, *mir.None, *mir.XRef:
+	case *mir.Unit, *mir.Bool, *mir.Int, *mir.Float, *mir.String, *mir.None:
 		// Don't need to duplicate instruction because they don't refer any idents
 		to.Val = val
+	case *mir.XRef:
+		to.Val = val
+		if inst, ok := dup.env.RefInsts[from.Ident]; ok {
+			to.Val = &mir.XRef{dup.instantiateExternal(val.Ident, inst, dup.typeVarAssign)}
+		}
 	case *mir.Unary:
 		to.Val = &mir.Unary{val.Op, dup.resolveIdent(val.Child)}
 	case *mir.Binary:
@@ -326,12 +389,36 @@ func (dup *codeDup) dupInsn(from *mir.Insn) *mir.Insn {
 		}
 	case *mir.ArrLen:
 		to.Val = &mir.ArrLen{dup.resolveIdent(val.Array)}
+	case *mir.BoundsCheck:
+		to.Val = &mir.BoundsCheck{dup.resolveIdent(val.Array), dup.resolveIdent(val.Index)}
+	case *mir.TblLoad:
+		to.Val = &mir.TblLoad{dup.resolveIdent(val.From), dup.resolveIdent(val.Key)}
+	case *mir.TblStore:
+		to.Val = &mir.TblStore{
+			dup.resolveIdent(val.To),
+			dup.resolveIdent(val.Key),
+			dup.resolveIdent(val.RHS),
+		}
+	case *mir.TblRemove:
+		to.Val = &mir.TblRemove{dup.resolveIdent(val.From), dup.resolveIdent(val.Key)}
 	case *mir.Some:
 		to.Val = &mir.Some{dup.resolveIdent(val.Elem)}
 	case *mir.IsSome:
 		to.Val = &mir.IsSome{dup.resolveIdent(val.OptVal)}
 	case *mir.DerefSome:
 		to.Val = &mir.DerefSome{dup.resolveIdent(val.SomeVal)}
+	case *mir.Variant:
+		payload := val.Payload
+		if payload != "" {
+			payload = dup.resolveIdent(payload)
+		}
+		to.Val = &mir.Variant{val.Tag, payload}
+	case *mir.IsVariant:
+		to.Val = &mir.IsVariant{dup.resolveIdent(val.Target), val.Tag}
+	case *mir.VariantPayload:
+		to.Val = &mir.VariantPayload{dup.resolveIdent(val.Target)}
+	case *mir.Jump:
+		to.Val = &mir.Jump{dup.resolveIdents(val.Args)}
 	case *mir.MakeCls:
 		fun := dup.dupClosure(val.Fun, val.Vars)
 		caps, _ := dup.toProg.Closures[fun.Name]
@@ -501,7 +588,7 @@ func newMonomorphizer(from *mir.Program, env *types.Env) *monomorphizer {
 		env,
 		from.Closures,
 		from.Toplevel,
-		&mir.Program{mir.Toplevel{}, mir.Closures{}, nil},
+		&mir.Program{mir.Toplevel{}, mir.Closures{}, nil, map[string]struct{}{}, map[string]string{}, map[string]string{}},
 		0,
 		make(map[string][]funInst, 3),
 	}
@@ -516,8 +603,38 @@ func (mono *monomorphizer) genID() uint {
 	return mono.ID
 }
 
+// instantiateExternal returns the name of external symbol monomorphized from the generic external
+// symbol with the instantiation. When the external symbol is not generic, its name is returned as-is.
+func (mono *monomorphizer) instantiateExternal(name string, inst *types.Instantiation, assign typeVarAssignment) string {
+	ext, ok := mono.env.Externals[name]
+	if !ok {
+		panic("FATAL: Unknown external symbol: " + name)
+	}
+	if _, ok := ext.Type.(*types.Forall); !ok {
+		return name
+	}
+
+	names := append(make([]string, 0, len(inst.Mapping)+1), name)
+	cnames := append(make([]string, 0, len(inst.Mapping)+1), ext.CName)
+	for _, m := range inst.Mapping {
+		t := assign.applyTo(m.Type)
+		names = append(names, mangleType(t))
+		cnames = append(cnames, mangleCName(t))
+	}
+
+	mangled := strings.Join(names, "$")
+	if _, ok := mono.env.Externals[mangled]; !ok {
+		mono.env.Externals[mangled] = &types.External{assign.applyTo(inst.To), strings.Join(cnames, "_")}
+	}
+	return mangled
+}
+
 func (mono *monomorphizer) visitInsn(from *mir.Insn) {
 	switch val := from.Val.(type) {
+	case *mir.XRef:
+		if inst, ok := mono.env.RefInsts[from.Ident]; ok {
+			val.Ident = mono.instantiateExternal(val.Ident, inst, typeVarAssignment{})
+		}
 	case *mir.MakeCls:
 		mono.newCodeDup().dupClosure(val.Fun, val.Vars)
 	case *mir.App:
@@ -566,5 +683,12 @@ func Monomorphize(prog *mir.Program, env *types.Env) *mir.Program {
 	mono.visitBlock(prog.Entry)
 	mono.toProg.Entry = prog.Entry
 
+	// All references to generic external symbols were replaced with monomorphized ones
+	for name, ext := range env.Externals {
+		if _, ok := ext.Type.(*types.Forall); ok {
+			delete(env.Externals, name)
+		}
+	}
+
 	return mono.toProg
 }
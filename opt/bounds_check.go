@@ -0,0 +1,353 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+)
+
+// Note:
+// Bounds checks inserted before accessing arrays are removed when the index is proved to be in
+// bounds. An index is in bounds when it is not negative and less than the size of the array. The size
+// is known in following cases.
+//   - Constant index of an array whose size is constant: a.(1) where a = Array.make 3 0
+//   - Same index of the same array was already checked before: a.(i) <- a.(i) + 1
+//   - Condition of enclosing 'if' compares the index with the length of the array:
+//       if i < Array.length a then a.(i) else 0
+//     Comparison with 'Array.length a - 1' by '<=' is also considered. It appears in 'for' loops.
+// An index is proved to be non-negative when it is a non-negative constant, the length of an array, an
+// index already checked, or 'i + 1' where 'i' is non-negative and less than some value (so it does
+// not overflow). Parameters of functions which are only called are non-negative when all arguments
+// at call sites (including 'jump') are non-negative. They are computed optimistically; all parameters
+// are assumed to be non-negative at first and assumptions which are not satisfied at some call site
+// are dropped until they converge.
+//
+// Identifiers are unique across the program and captured variables in closures have the same names
+// as the captured ones. So the definition of each identifier can be looked up from anywhere.
+// A removed check is replaced with unit value. It is cleaned up by dead code elimination.
+
+// fact means that LHS is less than RHS (or equal to RHS when not strict) in the scope.
+type fact struct {
+	lhs, rhs string
+	strict   bool
+}
+
+type checkedIndex struct {
+	array, index string
+}
+
+type boundsCheckElim struct {
+	// Definitions of all identifiers in the program. Identifiers defined more than once have nil.
+	defs map[string]mir.Val
+	// Parameters of functions whose all uses are calls
+	params map[string][]string
+	// Parameters assumed to be non-negative
+	nonNegParams map[string]bool
+	// Facts and checked indices in scope. They are truncated on leaving blocks.
+	facts   []fact
+	checked []checkedIndex
+	// Function currently visited. Empty at entry of program.
+	fun     string
+	changed bool
+}
+
+func (elim *boundsCheckElim) collectDefs(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		if _, ok := elim.defs[i.Ident]; ok {
+			elim.defs[i.Ident] = nil
+		} else {
+			elim.defs[i.Ident] = i.Val
+		}
+		if v, ok := i.Val.(*mir.If); ok {
+			elim.collectDefs(v.Then)
+			elim.collectDefs(v.Else)
+		}
+	}
+}
+
+// collectEscapes removes functions used as values other than callees from candidates of parameter
+// analysis.
+func (elim *boundsCheckElim) collectEscapes(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		operands := operandsOf(i.Val)
+		if app, ok := i.Val.(*mir.App); ok {
+			operands = app.Args
+		}
+		for _, o := range operands {
+			delete(elim.params, o)
+		}
+		if v, ok := i.Val.(*mir.If); ok {
+			elim.collectEscapes(v.Then)
+			elim.collectEscapes(v.Else)
+		}
+	}
+}
+
+// resolve follows 'ref' instructions and returns the identifier which defines the value.
+func (elim *boundsCheckElim) resolve(ident string) string {
+	for {
+		r, ok := elim.defs[ident].(*mir.Ref)
+		if !ok {
+			return ident
+		}
+		ident = r.Ident
+	}
+}
+
+func (elim *boundsCheckElim) constInt(ident string) (int64, bool) {
+	if i, ok := elim.defs[elim.resolve(ident)].(*mir.Int); ok {
+		return i.Const, true
+	}
+	return 0, false
+}
+
+func (elim *boundsCheckElim) arraySize(array string) (int64, bool) {
+	switch v := elim.defs[array].(type) {
+	case *mir.Array:
+		return elim.constInt(v.Size)
+	case *mir.ArrLit:
+		return int64(len(v.Elems)), true
+	default:
+		return 0, false
+	}
+}
+
+// lengthOffset returns the array and offset when the value is 'Array.length a + offset'.
+func (elim *boundsCheckElim) lengthOffset(ident string) (string, int64, bool) {
+	switch v := elim.defs[elim.resolve(ident)].(type) {
+	case *mir.ArrLen:
+		return elim.resolve(v.Array), 0, true
+	case *mir.Binary:
+		if v.Op != mir.SUB {
+			return "", 0, false
+		}
+		c, ok := elim.constInt(v.RHS)
+		if !ok || c < 0 {
+			return "", 0, false
+		}
+		l, ok := elim.defs[elim.resolve(v.LHS)].(*mir.ArrLen)
+		if !ok {
+			return "", 0, false
+		}
+		return elim.resolve(l.Array), -c, true
+	default:
+		return "", 0, false
+	}
+}
+
+// lessThanLength returns true when the fact means LHS is less than the length of the array. When
+// the array is empty, any array is accepted.
+func (elim *boundsCheckElim) lessThanLength(f fact, array string) bool {
+	a, offset, ok := elim.lengthOffset(f.rhs)
+	if !ok || (array != "" && a != array) {
+		return false
+	}
+	if f.strict {
+		return offset <= 0
+	}
+	return offset <= -1
+}
+
+// bounded returns true when adding one to the value never overflows.
+func (elim *boundsCheckElim) bounded(ident string) bool {
+	for _, f := range elim.facts {
+		if f.lhs == ident && (f.strict || elim.lessThanLength(f, "")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (elim *boundsCheckElim) nonNegative(ident string) bool {
+	ident = elim.resolve(ident)
+	if elim.nonNegParams[ident] {
+		return true
+	}
+	for _, c := range elim.checked {
+		if c.index == ident {
+			return true
+		}
+	}
+	for _, f := range elim.facts {
+		if f.rhs != ident {
+			continue
+		}
+		if c, ok := elim.constInt(f.lhs); ok && (c >= 0 || f.strict && c >= -1) {
+			return true
+		}
+	}
+
+	switch v := elim.defs[ident].(type) {
+	case *mir.Int:
+		return v.Const >= 0
+	case *mir.ArrLen:
+		return true
+	case *mir.Binary:
+		if v.Op != mir.ADD {
+			return false
+		}
+		lhs, rhs := elim.resolve(v.LHS), elim.resolve(v.RHS)
+		c, ok := elim.constInt(rhs)
+		if !ok {
+			lhs, rhs = rhs, lhs
+			c, ok = elim.constInt(rhs)
+		}
+		if !ok || c < 0 || c > 1 || !elim.nonNegative(lhs) {
+			return false
+		}
+		return c == 0 || elim.bounded(lhs)
+	default:
+		return false
+	}
+}
+
+func (elim *boundsCheckElim) inBounds(index, array string) bool {
+	if c, ok := elim.constInt(index); ok {
+		if size, ok := elim.arraySize(array); ok && 0 <= c && c < size {
+			return true
+		}
+	}
+	for _, c := range elim.checked {
+		if c.index == index && c.array == array {
+			return true
+		}
+	}
+	if !elim.nonNegative(index) {
+		return false
+	}
+	for _, f := range elim.facts {
+		if f.lhs == index && elim.lessThanLength(f, array) {
+			return true
+		}
+	}
+	return false
+}
+
+// assume adds facts implied by the condition when it is evaluated to the value.
+func (elim *boundsCheckElim) assume(cond string, value bool) {
+	bin, ok := elim.defs[elim.resolve(cond)].(*mir.Binary)
+	if !ok {
+		return
+	}
+	lhs, rhs := elim.resolve(bin.LHS), elim.resolve(bin.RHS)
+	switch bin.Op {
+	case mir.AND:
+		if value {
+			elim.assume(lhs, true)
+			elim.assume(rhs, true)
+		}
+		return
+	case mir.OR:
+		if !value {
+			elim.assume(lhs, false)
+			elim.assume(rhs, false)
+		}
+		return
+	}
+
+	// Normalize the comparison into 'lhs < rhs' or 'lhs <= rhs'
+	var strict bool
+	switch bin.Op {
+	case mir.LT:
+		strict = true
+	case mir.LTE:
+		strict = false
+	case mir.GT:
+		lhs, rhs, strict = rhs, lhs, true
+	case mir.GTE:
+		lhs, rhs, strict = rhs, lhs, false
+	default:
+		return
+	}
+	if !value {
+		// !(l < r) means r <= l and !(l <= r) means r < l
+		lhs, rhs, strict = rhs, lhs, !strict
+	}
+	elim.facts = append(elim.facts, fact{lhs, rhs, strict})
+}
+
+// visitCall drops assumptions on parameters of the callee which are not satisfied by the arguments.
+func (elim *boundsCheckElim) visitCall(callee string, args []string) {
+	params, ok := elim.params[callee]
+	if !ok {
+		return
+	}
+	for i, p := range params {
+		if elim.nonNegParams[p] && (i >= len(args) || !elim.nonNegative(args[i])) {
+			delete(elim.nonNegParams, p)
+			elim.changed = true
+		}
+	}
+}
+
+func (elim *boundsCheckElim) visit(b *mir.Block, remove bool) {
+	numFacts, numChecked := len(elim.facts), len(elim.checked)
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.BoundsCheck:
+			index, array := elim.resolve(v.Index), elim.resolve(v.Array)
+			if remove && elim.inBounds(index, array) {
+				i.Val = mir.UnitVal
+			}
+			// Following instructions are not executed when the index is out of bounds
+			elim.checked = append(elim.checked, checkedIndex{array, index})
+		case *mir.If:
+			n := len(elim.facts)
+			elim.assume(v.Cond, true)
+			elim.visit(v.Then, remove)
+			elim.facts = elim.facts[:n]
+			elim.assume(v.Cond, false)
+			elim.visit(v.Else, remove)
+			elim.facts = elim.facts[:n]
+		case *mir.App:
+			if v.Kind != mir.EXTERNAL_CALL {
+				elim.visitCall(v.Callee, v.Args)
+			}
+		case *mir.Jump:
+			elim.visitCall(elim.fun, v.Args)
+		}
+	}
+	elim.facts = elim.facts[:numFacts]
+	elim.checked = elim.checked[:numChecked]
+}
+
+func (elim *boundsCheckElim) visitProgram(prog *mir.Program, remove bool) {
+	for _, name := range prog.Toplevel.Names() {
+		elim.fun = name
+		elim.visit(prog.Toplevel[name].Val.Body, remove)
+	}
+	elim.fun = ""
+	elim.visit(prog.Entry, remove)
+}
+
+// EliminateBoundsChecks removes bounds checks whose indices are proved to be in bounds of arrays.
+func EliminateBoundsChecks(prog *mir.Program) {
+	elim := &boundsCheckElim{
+		map[string]mir.Val{},
+		map[string][]string{},
+		map[string]bool{},
+		[]fact{},
+		[]checkedIndex{},
+		"",
+		true,
+	}
+
+	for name, f := range prog.Toplevel {
+		elim.collectDefs(f.Val.Body)
+		elim.params[name] = f.Val.Params
+	}
+	elim.collectDefs(prog.Entry)
+	for _, f := range prog.Toplevel {
+		elim.collectEscapes(f.Val.Body)
+	}
+	elim.collectEscapes(prog.Entry)
+	for _, params := range elim.params {
+		for _, p := range params {
+			elim.nonNegParams[p] = true
+		}
+	}
+
+	for elim.changed {
+		elim.changed = false
+		elim.visitProgram(prog, false)
+	}
+	elim.visitProgram(prog, true)
+}
@@ -0,0 +1,142 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestEliminateBoundsChecks(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		tailCall bool
+		// Number of bounds checks remaining after the elimination
+		remains int
+	}{
+		{
+			what:    "constant index of constant size array",
+			code:    "let a = Array.make 3 0 in a.(0) <- 1; println_int a.(2)",
+			remains: 0,
+		},
+		{
+			what:    "constant index of array literal",
+			code:    "let a = [| 1; 2 |] in println_int a.(1)",
+			remains: 0,
+		},
+		{
+			what:    "constant index out of bounds",
+			code:    "let a = Array.make 3 0 in println_int a.(3)",
+			remains: 1,
+		},
+		{
+			what:    "negative constant index",
+			code:    "let a = Array.make 3 0 in println_int a.(-1)",
+			remains: 1,
+		},
+		{
+			what:    "unknown index",
+			code:    "let rec f a i = a.(i) in println_int (f (Array.make 3 0) 1)",
+			remains: 1,
+		},
+		{
+			what:    "same index already checked",
+			code:    "let rec f a i = a.(i) <- a.(i) + 1 in f (Array.make 3 0) 1",
+			remains: 1,
+		},
+		{
+			what:    "index of other array already checked",
+			code:    "let rec f a b i = a.(i) <- b.(i) in f (Array.make 3 0) (Array.make 2 0) 1",
+			remains: 2,
+		},
+		{
+			what:    "index compared with length in then branch",
+			code:    "let rec f a i = if i < Array.length a then a.(i) else 0 in println_int (f (Array.make 3 0) 1)",
+			remains: 0,
+		},
+		{
+			what:    "index compared with length in else branch",
+			code:    "let rec f a i = if i >= Array.length a then 0 else a.(i) in println_int (f (Array.make 3 0) 1)",
+			remains: 0,
+		},
+		{
+			what:    "index compared with length of other array",
+			code:    "let rec f a b i = if i < Array.length b then a.(i) else 0 in println_int (f (Array.make 3 0) (Array.make 4 0) 1)",
+			remains: 1,
+		},
+		{
+			what:    "index compared with length in other branch",
+			code:    "let rec f a i = if i < Array.length a then 0 else a.(i) in println_int (f (Array.make 3 0) 1)",
+			remains: 1,
+		},
+		{
+			what:    "index may be negative",
+			code:    "let rec f a i = if i < Array.length a then a.(i) else 0 in println_int (f (Array.make 3 0) (-1))",
+			remains: 1,
+		},
+		{
+			what:    "lower bound checked by condition",
+			code:    "let rec f a i = if 0 <= i && i < Array.length a then a.(i) else 0 in println_int (f (Array.make 3 0) (-1))",
+			remains: 0,
+		},
+		{
+			what:    "function escapes",
+			code:    "let rec f a i = if i < Array.length a then a.(i) else 0 in let g = f in println_int (g (Array.make 3 0) 1)",
+			remains: 1,
+		},
+		{
+			what:    "for loop",
+			code:    "let a = [| 3; 1; 4 |] in for i = 0 to Array.length a - 1 do println_int a.(i) done",
+			remains: 0,
+		},
+		{
+			what:     "for loop optimized into jump",
+			code:     "let a = [| 3; 1; 4 |] in for i = 0 to Array.length a - 1 do a.(i) <- a.(i) * 2 done",
+			tailCall: true,
+			remains:  0,
+		},
+		{
+			what:    "for loop over other range",
+			code:    "let a = [| 3; 1; 4 |] in for i = 0 to Array.length a do println_int a.(i) done",
+			remains: 1,
+		},
+		{
+			what:    "loop not bounded by length",
+			code:    "let rec f a i = if i < 10 then (println_int a.(i); f a (i + 1)) else () in f (Array.make 3 0) 0",
+			remains: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			if tc.tailCall {
+				OptimizeTailCalls(prog)
+			}
+			EliminateBoundsChecks(prog)
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			if tc.tailCall && !strings.Contains(out, "jump") {
+				t.Fatalf("Tail call was not optimized: %s", out)
+			}
+			if n := strings.Count(out, "boundscheck"); n != tc.remains {
+				t.Fatalf("Wanted %d bounds checks to remain but got %d: %s", tc.remains, n, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"strings"
+)
+
+// Note:
+// Closure transform captures all free variables of a function. After optimizations, some of them
+// may be no longer used in the closure body (e.g. uses removed by constant folding or inlining). A
+// captured variable is kept only when it is live in the closure body. Since this pass is applied after
+// dead code elimination, a variable is live when any instruction in the body uses it.
+//   f$t3 = makecls (x$t1,y$t2) f$t3
+//   (in body of f$t3) $k1 = binary + x$t1 a$t4
+// is converted into
+//   f$t3 = makecls (x$t1) f$t3
+// Removing a capture may make variables in the enclosing function dead. Dead code is eliminated
+// again and captures are checked until no capture is removed.
+//
+// Then closures capturing the same variables in the same order share one environment. When a
+// 'makecls' instruction is preceded by another one with the same variables in the same function and
+// the preceding one is visible from it, it reuses the environment of the preceding closure instead of
+// allocating a new one. The sharing is recorded in mir.Program.SharedEnvs for code generation. An
+// environment on stack is not shared with a closure whose environment must be on heap.
+//   f$t3 = makecls (x$t1) f$t3
+//   g$t5 = makecls (x$t1) g$t5   (* shares the environment of f$t3 *)
+
+type envMinimizer struct {
+	prog *mir.Program
+	// 'makecls' instructions of each function
+	makes map[string][]*mir.MakeCls
+}
+
+func (m *envMinimizer) collectMakeCls(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.MakeCls:
+			m.makes[v.Fun] = append(m.makes[v.Fun], v)
+		case *mir.If:
+			m.collectMakeCls(v.Then)
+			m.collectMakeCls(v.Else)
+		}
+	}
+}
+
+func collectUses(b *mir.Block, used map[string]struct{}) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		for _, o := range operandsOf(i.Val) {
+			used[o] = struct{}{}
+		}
+		if v, ok := i.Val.(*mir.If); ok {
+			collectUses(v.Then, used)
+			collectUses(v.Else, used)
+		}
+	}
+}
+
+// trimCaptures removes captures which are not used in the body of the closure. Variables of 'makecls'
+// instructions are removed at the same indices. It returns true when some capture was removed.
+func (m *envMinimizer) trimCaptures(name string, caps []string) bool {
+	used := map[string]struct{}{}
+	collectUses(m.prog.Toplevel[name].Val.Body, used)
+
+	kept := make([]int, 0, len(caps))
+	for idx, c := range caps {
+		if _, ok := used[c]; ok {
+			kept = append(kept, idx)
+		}
+	}
+	if len(kept) == len(caps) {
+		return false
+	}
+
+	filter := func(names []string) []string {
+		ret := make([]string, 0, len(kept))
+		for _, idx := range kept {
+			ret = append(ret, names[idx])
+		}
+		return ret
+	}
+	for _, make := range m.makes[name] {
+		make.Vars = filter(make.Vars)
+	}
+	m.prog.Closures[name] = filter(caps)
+	return true
+}
+
+func (m *envMinimizer) canShare(from, to string) bool {
+	_, fromStack := m.prog.StackAllocated[from]
+	_, toStack := m.prog.StackAllocated[to]
+	return !fromStack || toStack
+}
+
+// shareEnvs finds closures which can reuse environments of preceding closures. envs maps variables
+// of 'makecls' instructions visible at the block to their identifiers.
+func (m *envMinimizer) shareEnvs(b *mir.Block, envs map[string]string) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.MakeCls:
+			if len(v.Vars) == 0 {
+				// Nothing to share
+				continue
+			}
+			key := strings.Join(v.Vars, ",")
+			if from, ok := envs[key]; ok && m.canShare(from, i.Ident) {
+				m.prog.SharedEnvs[i.Ident] = from
+				continue
+			}
+			envs[key] = i.Ident
+		case *mir.If:
+			for _, blk := range []*mir.Block{v.Then, v.Else} {
+				scoped := make(map[string]string, len(envs))
+				for k, e := range envs {
+					scoped[k] = e
+				}
+				m.shareEnvs(blk, scoped)
+			}
+		}
+	}
+}
+
+func newEnvMinimizer(prog *mir.Program) *envMinimizer {
+	m := &envMinimizer{prog, map[string][]*mir.MakeCls{}}
+	for _, f := range prog.Toplevel {
+		m.collectMakeCls(f.Val.Body)
+	}
+	m.collectMakeCls(prog.Entry)
+	return m
+}
+
+// trimAll removes unused captures of all closures until no capture is removed. It returns true when
+// some capture was removed.
+func (m *envMinimizer) trimAll() bool {
+	trimmed := false
+	for {
+		changed := false
+		for name, caps := range m.prog.Closures {
+			if m.trimCaptures(name, caps) {
+				changed = true
+			}
+		}
+		if !changed {
+			return trimmed
+		}
+		trimmed = true
+		// Variables which were only captured are no longer used
+		EliminateDeadCode(m.prog)
+	}
+}
+
+func (m *envMinimizer) shareAll() {
+	for _, f := range m.prog.Toplevel {
+		m.shareEnvs(f.Val.Body, map[string]string{})
+	}
+	m.shareEnvs(m.prog.Entry, map[string]string{})
+}
+
+// MinimizeClosureEnvs removes captures which are not used in closure bodies and shares environments
+// of closures capturing the same variables. It should be applied after dead code elimination.
+func MinimizeClosureEnvs(prog *mir.Program) {
+	// Sharing is calculated again after removing captures
+	prog.SharedEnvs = map[string]string{}
+	m := newEnvMinimizer(prog)
+	m.trimAll()
+	m.shareAll()
+}
+
+// TrimClosureCaptures only removes captures which are not used in closure bodies so that
+// environments of closures never retain dead variables. Passes may make captures dead after
+// MinimizeClosureEnvs or it may not be run at all. Environments shared among closures are
+// calculated again when some capture is removed.
+func TrimClosureCaptures(prog *mir.Program) {
+	m := newEnvMinimizer(prog)
+	if !m.trimAll() || len(prog.SharedEnvs) == 0 {
+		return
+	}
+	prog.SharedEnvs = map[string]string{}
+	m.shareAll()
+}
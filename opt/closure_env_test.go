@@ -0,0 +1,129 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"testing"
+)
+
+func TestMinimizeClosureEnvs(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		closures map[string][]string
+		shared   map[string]string
+	}{
+		{
+			what:     "unused capture",
+			code:     "let x = 1 in let rec f a = if true then a else a + x in f 2",
+			closures: map[string][]string{"f$t2": {}},
+			shared:   map[string]string{},
+		},
+		{
+			what:     "used capture is kept",
+			code:     "let x = 1 in let y = 2 in let rec f a = if true then a + y else a + x in f 2",
+			closures: map[string][]string{"f$t3": {"y$t2"}},
+			shared:   map[string]string{},
+		},
+		{
+			what:     "capture only for nested closure",
+			code:     "let x = 1 in let rec f a = let rec g b = if true then b else b + x in g a in f 2",
+			closures: map[string][]string{"f$t2": {}, "g$t4": {}},
+			shared:   map[string]string{},
+		},
+		{
+			what:     "same captures",
+			code:     "let x = 1 in let rec f a = a + x in let rec g b = b * x in f (g 2)",
+			closures: map[string][]string{"f$t2": {"x$t1"}, "g$t4": {"x$t1"}},
+			shared:   map[string]string{"g$t4": "f$t2"},
+		},
+		{
+			what:     "same captures after removing unused one",
+			code:     "let x = 1 in let y = 2 in let rec f a = a + x in let rec g b = if true then b * x else b * y in f (g 2)",
+			closures: map[string][]string{"f$t3": {"x$t1"}, "g$t5": {"x$t1"}},
+			shared:   map[string]string{"g$t5": "f$t3"},
+		},
+		{
+			what:     "different captures",
+			code:     "let x = 1 in let y = 2 in let rec f a = a + x in let rec g b = b * x * y in f (g 2)",
+			closures: map[string][]string{"f$t3": {"x$t1"}, "g$t5": {"x$t1", "y$t2"}},
+			shared:   map[string]string{},
+		},
+		{
+			what:     "closures in other branches",
+			code:     "let x = 1 in if x > 0 then (let rec f a = a + x in f 1) else (let rec g b = b * x in g 2)",
+			closures: map[string][]string{"f$t2": {"x$t1"}, "g$t4": {"x$t1"}},
+			shared:   map[string]string{},
+		},
+		{
+			what:     "closure in branch",
+			code:     "let x = 1 in let rec f a = a + x in if x > 0 then (let rec g b = b * x in g (f 1)) else 0",
+			closures: map[string][]string{"f$t2": {"x$t1"}, "g$t4": {"x$t1"}},
+			shared:   map[string]string{"g$t4": "f$t2"},
+		},
+		{
+			what:     "environment on stack is not shared with escaping closure",
+			code:     "let x = 1 in let rec f a = a + x in let rec g b = b * x in let rec h k = k 1 in (h g) + (f 2)",
+			closures: map[string][]string{"f$t2": {"x$t1"}, "g$t4": {"x$t1"}},
+			shared:   map[string]string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mir.ElimRefs(ir, env)
+			prog := closure.Transform(ir)
+			SimplifyBranches(prog, env)
+			EliminateDeadCode(prog)
+			AnalyzeEscapes(prog)
+			MinimizeClosureEnvs(prog)
+			if err := mir.Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(map[string][]string(prog.Closures), tc.closures) {
+				t.Errorf("Wanted closures %v but got %v", tc.closures, prog.Closures)
+			}
+			if !reflect.DeepEqual(prog.SharedEnvs, tc.shared) {
+				t.Errorf("Wanted shared environments %v but got %v", tc.shared, prog.SharedEnvs)
+			}
+		})
+	}
+}
+
+func TestSharedEnvEscapes(t *testing.T) {
+	code := "let x = 1 in let rec f a = a + x in let rec g b = b * x in let rec h k = k 1 in (h g) + (f 2); ()"
+	s := locerr.NewDummySource(code)
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mir.ElimRefs(ir, env)
+	prog := closure.Transform(ir)
+	MinimizeClosureEnvs(prog)
+	if from, ok := prog.SharedEnvs["g$t4"]; !ok || from != "f$t2" {
+		t.Fatalf("Closure 'g$t4' should share environment of 'f$t2': %v", prog.SharedEnvs)
+	}
+	AnalyzeEscapes(prog)
+	// 'f$t2' is only called but its environment is used by 'g$t4' which escapes
+	if _, ok := prog.StackAllocated["f$t2"]; ok {
+		t.Fatalf("Shared environment of 'f$t2' should not be allocated on stack: %v", prog.StackAllocated)
+	}
+}
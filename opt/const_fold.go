@@ -0,0 +1,269 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/cfg"
+	"github.com/rhysd/gocaml/mir"
+	"math"
+)
+
+// Note:
+// Constant folding evaluates operations whose operands are all constants at compile time. Constants
+// are propagated through 'ref' instructions so that operations using them can also be folded.
+//   $k1 = int 1
+//   $k2 = int 2
+//   x$t1 = binary + $k1 $k2
+//   y$t2 = ref x$t1
+//   $k3 = binary < y$t2 $k2
+// is converted into
+//   $k1 = int 1
+//   $k2 = int 2
+//   x$t1 = int 3
+//   y$t2 = int 3
+//   $k3 = bool false
+// The value of 'if' instruction is also constant when all of its branches result in the same
+// constant. Such merges are found as phi nodes of SSA built by cfg package.
+//   $k2 = if $k1
+//     BEGIN: then
+//     $k3 = int 1
+//     END: then
+//     BEGIN: else
+//     $k4 = int 1
+//     END: else
+//   $k5 = binary + $k2 $k2
+// folds $k5 into 'int 2'. The 'if' instruction itself is kept since its branches may have side
+// effects.
+// Instructions which are no longer used are not removed by this pass. Operations whose results are
+// undefined in LLVM IR such as division by zero are not folded and left to runtime.
+
+type constFolder struct {
+	// Constant values of identifiers. Since all identifiers are unique after alpha transform, they
+	// can be shared among all blocks.
+	consts map[string]mir.Val
+	// Merged values of 'if' instructions and parameters
+	phis    []*cfg.Phi
+	changed bool
+}
+
+func (f *constFolder) intOf(name string) (int64, bool) {
+	if i, ok := f.consts[name].(*mir.Int); ok {
+		return i.Const, true
+	}
+	return 0, false
+}
+
+func (f *constFolder) floatOf(name string) (float64, bool) {
+	if v, ok := f.consts[name].(*mir.Float); ok {
+		return v.Const, true
+	}
+	return 0, false
+}
+
+func (f *constFolder) boolOf(name string) (bool, bool) {
+	if b, ok := f.consts[name].(*mir.Bool); ok {
+		return b.Const, true
+	}
+	return false, false
+}
+
+func sameConst(l, r mir.Val) bool {
+	switch l := l.(type) {
+	case *mir.Int:
+		r, ok := r.(*mir.Int)
+		return ok && l.Const == r.Const
+	case *mir.Float:
+		// Compare bits not to merge 0.0 and -0.0
+		r, ok := r.(*mir.Float)
+		return ok && math.Float64bits(l.Const) == math.Float64bits(r.Const)
+	case *mir.Bool:
+		r, ok := r.(*mir.Bool)
+		return ok && l.Const == r.Const
+	default:
+		return false
+	}
+}
+
+func (f *constFolder) foldPhi(p *cfg.Phi) {
+	if _, ok := f.consts[p.Ident]; ok {
+		return
+	}
+	var folded mir.Val
+	for _, a := range p.Args {
+		c, ok := f.consts[a.Ident]
+		if !ok || folded != nil && !sameConst(folded, c) {
+			return
+		}
+		folded = c
+	}
+	f.consts[p.Ident] = folded
+	f.changed = true
+}
+
+func (f *constFolder) foldUnary(v *mir.Unary) mir.Val {
+	switch v.Op {
+	case mir.NEG:
+		if i, ok := f.intOf(v.Child); ok {
+			return &mir.Int{-i}
+		}
+	case mir.FNEG:
+		if x, ok := f.floatOf(v.Child); ok {
+			return &mir.Float{-x}
+		}
+	case mir.NOT:
+		if b, ok := f.boolOf(v.Child); ok {
+			return &mir.Bool{!b}
+		}
+	}
+	return nil
+}
+
+func foldIntBinary(op mir.OperatorKind, l, r int64) mir.Val {
+	switch op {
+	case mir.ADD:
+		return &mir.Int{l + r}
+	case mir.SUB:
+		return &mir.Int{l - r}
+	case mir.MUL:
+		return &mir.Int{l * r}
+	case mir.DIV, mir.MOD:
+		if r == 0 || l == math.MinInt64 && r == -1 {
+			// Undefined behavior. Leave it to runtime
+			return nil
+		}
+		if op == mir.DIV {
+			return &mir.Int{l / r}
+		}
+		return &mir.Int{l % r}
+	case mir.LT:
+		return &mir.Bool{l < r}
+	case mir.LTE:
+		return &mir.Bool{l <= r}
+	case mir.GT:
+		return &mir.Bool{l > r}
+	case mir.GTE:
+		return &mir.Bool{l >= r}
+	case mir.EQ:
+		return &mir.Bool{l == r}
+	case mir.NEQ:
+		return &mir.Bool{l != r}
+	default:
+		return nil
+	}
+}
+
+func foldFloatBinary(op mir.OperatorKind, l, r float64) mir.Val {
+	switch op {
+	case mir.FADD:
+		return &mir.Float{l + r}
+	case mir.FSUB:
+		return &mir.Float{l - r}
+	case mir.FMUL:
+		return &mir.Float{l * r}
+	case mir.FDIV:
+		return &mir.Float{l / r}
+	case mir.LT:
+		return &mir.Bool{l < r}
+	case mir.LTE:
+		return &mir.Bool{l <= r}
+	case mir.GT:
+		return &mir.Bool{l > r}
+	case mir.GTE:
+		return &mir.Bool{l >= r}
+	case mir.EQ:
+		return &mir.Bool{l == r}
+	case mir.NEQ:
+		// Comparison is ordered in codegen. It is false when one of operands is NaN
+		return &mir.Bool{!math.IsNaN(l) && !math.IsNaN(r) && l != r}
+	default:
+		return nil
+	}
+}
+
+func foldBoolBinary(op mir.OperatorKind, l, r bool) mir.Val {
+	switch op {
+	case mir.AND:
+		return &mir.Bool{l && r}
+	case mir.OR:
+		return &mir.Bool{l || r}
+	case mir.EQ:
+		return &mir.Bool{l == r}
+	case mir.NEQ:
+		return &mir.Bool{l != r}
+	default:
+		return nil
+	}
+}
+
+func (f *constFolder) foldBinary(v *mir.Binary) mir.Val {
+	if l, ok := f.intOf(v.LHS); ok {
+		if r, ok := f.intOf(v.RHS); ok {
+			return foldIntBinary(v.Op, l, r)
+		}
+		return nil
+	}
+	if l, ok := f.floatOf(v.LHS); ok {
+		if r, ok := f.floatOf(v.RHS); ok {
+			return foldFloatBinary(v.Op, l, r)
+		}
+		return nil
+	}
+	if l, ok := f.boolOf(v.LHS); ok {
+		if r, ok := f.boolOf(v.RHS); ok {
+			return foldBoolBinary(v.Op, l, r)
+		}
+	}
+	return nil
+}
+
+func (f *constFolder) foldBlock(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		var folded mir.Val
+		switch v := i.Val.(type) {
+		case *mir.Int, *mir.Float, *mir.Bool:
+			if _, ok := f.consts[i.Ident]; !ok {
+				f.consts[i.Ident] = v
+				f.changed = true
+			}
+			continue
+		case *mir.Ref:
+			folded = f.consts[v.Ident]
+		case *mir.Unary:
+			folded = f.foldUnary(v)
+		case *mir.Binary:
+			folded = f.foldBinary(v)
+		case *mir.If:
+			f.foldBlock(v.Then)
+			f.foldBlock(v.Else)
+		}
+		if folded == nil {
+			continue
+		}
+		i.Val = folded
+		f.consts[i.Ident] = folded
+		f.changed = true
+	}
+}
+
+// FoldConstants folds operations on constant operands and propagates constants through 'ref'
+// instructions and merges of branches until no more instruction can be folded.
+func FoldConstants(prog *mir.Program) {
+	foldConstants(prog, cfg.BuildProgramSSA(prog))
+}
+
+func foldConstants(prog *mir.Program, ssas map[string]*cfg.SSA) {
+	f := &constFolder{map[string]mir.Val{}, nil, true}
+	for _, s := range ssas {
+		for _, phis := range s.Phis {
+			f.phis = append(f.phis, phis...)
+		}
+	}
+	for f.changed {
+		f.changed = false
+		for _, p := range f.phis {
+			f.foldPhi(p)
+		}
+		for _, fun := range prog.Toplevel {
+			f.foldBlock(fun.Val.Body)
+		}
+		f.foldBlock(prog.Entry)
+	}
+}
@@ -0,0 +1,141 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestFoldConstants(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		contains []string
+		excludes []string
+	}{
+		{
+			what:     "int arithmetic",
+			code:     "let x = 1 + 2 * 3 in x",
+			contains: []string{"x$t1 = int 7 ; type=int"},
+			excludes: []string{"binary"},
+		},
+		{
+			what:     "float arithmetic",
+			code:     "let x = 1.5 *. 2.0 -. 0.5 in x",
+			contains: []string{"x$t1 = float 2.500000 ; type=float"},
+			excludes: []string{"binary"},
+		},
+		{
+			what:     "unary operators",
+			code:     "let x = -(1 + 2) in let y = not true in let z = -.1.5 in ()",
+			contains: []string{"x$t1 = int -3", "y$t2 = bool false", "z$t3 = float -1.500000"},
+			excludes: []string{"unary"},
+		},
+		{
+			what:     "int comparison",
+			code:     "let x = 1 + 1 < 3 in x",
+			contains: []string{"x$t1 = bool true ; type=bool"},
+			excludes: []string{"binary"},
+		},
+		{
+			what:     "bool operators",
+			code:     "let x = true && false || true in let y = true = false in ()",
+			contains: []string{"x$t1 = bool true", "y$t2 = bool false"},
+			excludes: []string{"binary"},
+		},
+		{
+			what:     "propagation through ref",
+			code:     "let x = 1 in let y = x in let z = y + 1 in z",
+			contains: []string{"y$t2 = int 1 ; type=int", "z$t3 = int 2 ; type=int"},
+			excludes: []string{"ref", "binary"},
+		},
+		{
+			what:     "nested block",
+			code:     "let x = 10 in if true then x / 2 else x % 3",
+			contains: []string{"int 5 ; type=int", "int 1 ; type=int"},
+			excludes: []string{"binary"},
+		},
+		{
+			what:     "division by zero",
+			code:     "let x = 1 / 0 in x",
+			contains: []string{"x$t1 = binary / "},
+		},
+		{
+			what:     "NaN is not equal to itself",
+			code:     "let n = 0.0 /. 0.0 in let x = n = n in let y = n <> n in ()",
+			contains: []string{"x$t2 = bool false", "y$t3 = bool false"},
+		},
+		{
+			what:     "same constants from branches",
+			code:     "let rec f c = let x = if c then 1 else 1 in x + 1 in f true",
+			contains: []string{"= int 2 ; type=int"},
+			excludes: []string{"binary"},
+		},
+		{
+			what:     "different constants from branches",
+			code:     "let rec f c = let x = if c then 1 else 2 in x + 1 in f true",
+			contains: []string{"binary +"},
+		},
+		{
+			what:     "non-constant operand",
+			code:     "let rec f x = x + 1 in f 1",
+			contains: []string{"binary + $k1 $k2"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			FoldConstants(prog)
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in program '%s'", expected, out)
+				}
+			}
+			for _, unexpected := range tc.excludes {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected '%s' not to be contained in program '%s'", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestFoldConstantsAfterInlining(t *testing.T) {
+	s := locerr.NewDummySource("let rec f a = a * 2 in f 21; ()")
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+	Inline(prog, env, 10)
+	FoldConstants(prog)
+
+	var buf bytes.Buffer
+	prog.Entry.Println(&buf, env)
+	out := buf.String()
+	if !strings.Contains(out, "= int 42 ; type=int") {
+		t.Fatalf("Inlined call was not folded: %s", out)
+	}
+}
@@ -0,0 +1,217 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+)
+
+// Note:
+// Dead code elimination removes instructions whose results are never used and which have no side
+// effect. Function calls, array stores, bounds checks, 'unreachable' and 'jump' instructions are
+// always kept since they may have side effects. 'if' instructions are removed only when both branches
+// have no side effect.
+// The last instruction of a block is never removed because it is the value of the block.
+//
+// Blocks are walked from bottom to top. When an instruction is removed, uses of its operands are
+// decremented so that instructions only used by removed ones are also removed in the same walk.
+// Toplevel functions which are not referenced transitively from the entry of program are also removed
+// with their closure information. Since removing a function decrements uses in its body, captured
+// variables only used by the function are removed in the next walk.
+// The walk is repeated until no instruction nor function is removed.
+// Closures whose environments are shared with other closures (see MinimizeClosureEnvs) are kept.
+
+// operandsOf returns identifiers used by the value. Identifiers used in nested blocks of 'if' are
+// not included.
+func operandsOf(val mir.Val) []string {
+	switch v := val.(type) {
+	case *mir.Unary:
+		return []string{v.Child}
+	case *mir.Binary:
+		return []string{v.LHS, v.RHS}
+	case *mir.Ref:
+		return []string{v.Ident}
+	case *mir.If:
+		return []string{v.Cond}
+	case *mir.App:
+		return append([]string{v.Callee}, v.Args...)
+	case *mir.Tuple:
+		return v.Elems
+	case *mir.TplLoad:
+		return []string{v.From}
+	case *mir.Array:
+		return []string{v.Size, v.Elem}
+	case *mir.ArrLit:
+		return v.Elems
+	case *mir.ArrLoad:
+		return []string{v.From, v.Index}
+	case *mir.ArrStore:
+		return []string{v.To, v.Index, v.RHS}
+	case *mir.ArrLen:
+		return []string{v.Array}
+	case *mir.BoundsCheck:
+		return []string{v.Array, v.Index}
+	case *mir.TblLoad:
+		return []string{v.From, v.Key}
+	case *mir.TblStore:
+		return []string{v.To, v.Key, v.RHS}
+	case *mir.TblRemove:
+		return []string{v.From, v.Key}
+	case *mir.Some:
+		return []string{v.Elem}
+	case *mir.IsSome:
+		return []string{v.OptVal}
+	case *mir.DerefSome:
+		return []string{v.SomeVal}
+	case *mir.Variant:
+		if v.Payload == "" {
+			return nil
+		}
+		return []string{v.Payload}
+	case *mir.IsVariant:
+		return []string{v.Target}
+	case *mir.VariantPayload:
+		return []string{v.Target}
+	case *mir.MakeCls:
+		return v.Vars
+	case *mir.Jump:
+		return v.Args
+	case *mir.Fun:
+		panic("FATAL: Function must be moved to toplevel before eliminating dead code")
+	default:
+		return nil
+	}
+}
+
+// hasSideEffect returns true when the value must be evaluated even if its result is not used.
+func hasSideEffect(val mir.Val) bool {
+	switch v := val.(type) {
+	case *mir.App, *mir.ArrStore, *mir.TblStore, *mir.TblRemove, *mir.BoundsCheck, *mir.Unreachable, *mir.Jump:
+		return true
+	case *mir.If:
+		return blockHasSideEffect(v.Then) || blockHasSideEffect(v.Else)
+	default:
+		return false
+	}
+}
+
+func blockHasSideEffect(b *mir.Block) bool {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		if hasSideEffect(i.Val) {
+			return true
+		}
+	}
+	return false
+}
+
+type deadCodeEliminator struct {
+	// Number of uses of each identifier
+	uses    map[string]int
+	changed bool
+}
+
+func (elim *deadCodeEliminator) countUses(b *mir.Block, delta int) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		elim.countUsesIn(i.Val, delta)
+	}
+}
+
+func (elim *deadCodeEliminator) countUsesIn(val mir.Val, delta int) {
+	for _, o := range operandsOf(val) {
+		elim.uses[o] += delta
+	}
+	if v, ok := val.(*mir.If); ok {
+		elim.countUses(v.Then, delta)
+		elim.countUses(v.Else, delta)
+	}
+}
+
+func (elim *deadCodeEliminator) isDead(insn *mir.Insn, b *mir.Block) bool {
+	if insn.Next == b.Bottom {
+		return false
+	}
+	if elim.uses[insn.Ident] > 0 {
+		return false
+	}
+	return !hasSideEffect(insn.Val)
+}
+
+func (elim *deadCodeEliminator) eliminate(b *mir.Block) {
+	for i := b.Bottom.Prev; i != b.Top; {
+		prev := i.Prev
+		if elim.isDead(i, b) {
+			elim.countUsesIn(i.Val, -1)
+			i.RemoveFromList()
+			elim.changed = true
+		} else if v, ok := i.Val.(*mir.If); ok {
+			elim.eliminate(v.Then)
+			elim.eliminate(v.Else)
+		}
+		i = prev
+	}
+}
+
+// markReachable marks toplevel functions referenced in the block. Bodies of marked functions are
+// visited recursively.
+func markReachable(b *mir.Block, prog *mir.Program, reachable map[string]struct{}) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		refs := operandsOf(i.Val)
+		switch v := i.Val.(type) {
+		case *mir.App:
+			refs = append(refs, v.Callee)
+		case *mir.MakeCls:
+			refs = append(refs, v.Fun)
+		case *mir.If:
+			markReachable(v.Then, prog, reachable)
+			markReachable(v.Else, prog, reachable)
+		}
+		for _, r := range refs {
+			f, ok := prog.Toplevel[r]
+			if !ok {
+				continue
+			}
+			if _, ok := reachable[r]; ok {
+				continue
+			}
+			reachable[r] = struct{}{}
+			markReachable(f.Val.Body, prog, reachable)
+		}
+	}
+}
+
+// eliminateFuns removes toplevel functions which are never reached from the entry of program.
+func (elim *deadCodeEliminator) eliminateFuns(prog *mir.Program) {
+	reachable := map[string]struct{}{}
+	markReachable(prog.Entry, prog, reachable)
+	for name, f := range prog.Toplevel {
+		if _, ok := reachable[name]; ok {
+			continue
+		}
+		elim.countUses(f.Val.Body, -1)
+		delete(prog.Toplevel, name)
+		delete(prog.Closures, name)
+		elim.changed = true
+	}
+}
+
+// EliminateDeadCode removes instructions whose results are not used and which have no side effect.
+// Toplevel functions and closures which are never referenced from the entry of program are also
+// removed.
+func EliminateDeadCode(prog *mir.Program) {
+	elim := &deadCodeEliminator{map[string]int{}, true}
+	for _, f := range prog.Toplevel {
+		elim.countUses(f.Val.Body, 1)
+	}
+	elim.countUses(prog.Entry, 1)
+	for _, from := range prog.SharedEnvs {
+		// Environment of the closure is reused by other closure
+		elim.uses[from]++
+	}
+
+	for elim.changed {
+		elim.changed = false
+		for _, f := range prog.Toplevel {
+			elim.eliminate(f.Val.Body)
+		}
+		elim.eliminate(prog.Entry)
+		elim.eliminateFuns(prog)
+	}
+}
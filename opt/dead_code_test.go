@@ -0,0 +1,132 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestEliminateDeadCode(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		contains []string
+		excludes []string
+	}{
+		{
+			what:     "unused arithmetic",
+			code:     "let x = 1 + 2 in 3",
+			excludes: []string{"x$t1", "binary"},
+		},
+		{
+			what:     "operands only used by dead instruction",
+			code:     "let a = 1 in let b = a * 2 in let c = (a, b) in 0",
+			excludes: []string{"a$t1", "b$t2", "c$t3"},
+		},
+		{
+			what:     "used value",
+			code:     "let x = 1 + 2 in println_int x",
+			contains: []string{"x$t1 = binary +"},
+		},
+		{
+			what:     "function call",
+			code:     "let x = println_int 42 in 0",
+			contains: []string{"x$t1 = appcls $k1 $k2"},
+		},
+		{
+			what:     "array store",
+			code:     "let a = Array.make 3 0 in let u = a.(0) <- 1 in 0",
+			contains: []string{"arrstore", "a$t1 = array"},
+		},
+		{
+			what:     "unused closure",
+			code:     "let x = 1 in let rec f a = a + x in 0",
+			excludes: []string{"makecls"},
+		},
+		{
+			what:     "pure if expression",
+			code:     "let c = 1 < 2 in let x = if c then 1 + 2 else 3 in 0",
+			excludes: []string{"if ", "c$t1"},
+		},
+		{
+			what:     "if expression with side effect",
+			code:     "let x = if true then println_int 1 else () in 0",
+			contains: []string{"x$t1 = if", "$k4 = appcls $k2 $k3"},
+		},
+		{
+			what:     "dead code in nested block",
+			code:     "let x = if true then (let y = 1 + 2 in println_int 1) else () in 0",
+			contains: []string{"$k7 = appcls $k5 $k6"},
+			excludes: []string{"y$t2"},
+		},
+		{
+			what:     "unreferenced function",
+			code:     "let rec f a = a + 1 in 0",
+			excludes: []string{"f$t1"},
+		},
+		{
+			what:     "function only called from dead function",
+			code:     "let rec f a = a + 1 in let rec g b = f b in 0",
+			excludes: []string{"f$t1", "g$t3"},
+		},
+		{
+			what:     "unreferenced recursive function",
+			code:     "let rec f a = if a = 0 then 0 else f (a - 1) in 0",
+			excludes: []string{"f$t1"},
+		},
+		{
+			what:     "captures only used by dead closure",
+			code:     "let x = 1 + 2 in let rec f a = a + x in 0",
+			excludes: []string{"f$t2", "x$t1"},
+		},
+		{
+			what:     "function called transitively",
+			code:     "let rec f a = a + 1 in let rec g b = f b in println_int (g 1)",
+			contains: []string{"f$t1 = fun", "g$t3 = fun"},
+		},
+		{
+			what:     "closure referenced from entry",
+			code:     "let x = 1 in let rec f a = a + x in let g = f in println_int (g 1)",
+			contains: []string{"f$t2 = fun", "makecls (x$t1) f$t2"},
+		},
+		{
+			what:     "last instruction of block",
+			code:     "let rec f a = a + 1 in f 1",
+			contains: []string{"binary +"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			EliminateDeadCode(prog)
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in program '%s'", expected, out)
+				}
+			}
+			for _, unexpected := range tc.excludes {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected '%s' not to be contained in program '%s'", unexpected, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+)
+
+// Note:
+// Closure transform calls a function directly only when the callee is the closure of the function
+// itself. When the closure is called through other variables, it is called indirectly via the
+// function pointer in the closure object even if the callee is statically unique.
+//   f$t1 = makecls (x$t2) f$t1
+//   g$t3 = ref f$t1
+//   $k4 = appcls g$t3 $k5
+// This pass finds the unique closure called at each call site. The callee is resolved through
+//   - 'ref' instructions (also introduced by inlining)
+//   - 'if' instructions whose both branches result in the same closure
+//   - parameters of functions which are only called. When all callers pass the same closure to the
+//     parameter, it is the closure. They are computed optimistically until they converge.
+// When the function captures nothing, any closure object of the function is the same. So the call
+// is converted into a direct call.
+//   $k4 = app f$t1 $k5
+// Otherwise the callee is replaced with the closure when it is in scope of the caller.
+//   $k4 = appcls f$t1 $k5
+// Codegen calls the function directly in both cases. Note that parameters are not considered for
+// the replacement because a closure created at the same instruction may be a different object with
+// different captures at runtime.
+
+type devirtualizer struct {
+	prog *mir.Program
+	// Definitions of all identifiers in the program. Identifiers defined more than once have nil.
+	defs map[string]mir.Val
+	// Function defining each identifier. Empty string means entry of program.
+	owners map[string]string
+	// Parameters of functions whose all uses are calls
+	params     map[string][]string
+	candidates map[string]bool
+	// Closure passed to the parameter at all call sites. Empty string means callers pass different
+	// values. Parameters whose callers are not visited yet are not in the map.
+	targets map[string]string
+	// Function currently visited. Empty at entry of program.
+	fun     string
+	changed bool
+}
+
+func (d *devirtualizer) collectDefs(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		if _, ok := d.defs[i.Ident]; ok {
+			d.defs[i.Ident] = nil
+		} else {
+			d.defs[i.Ident] = i.Val
+		}
+		d.owners[i.Ident] = d.fun
+		if v, ok := i.Val.(*mir.If); ok {
+			d.collectDefs(v.Then)
+			d.collectDefs(v.Else)
+		}
+	}
+}
+
+// collectEscapes removes functions used as values other than callees from candidates of parameter
+// analysis.
+func (d *devirtualizer) collectEscapes(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		operands := operandsOf(i.Val)
+		if app, ok := i.Val.(*mir.App); ok {
+			operands = app.Args
+		}
+		for _, o := range operands {
+			delete(d.params, o)
+		}
+		if v, ok := i.Val.(*mir.If); ok {
+			d.collectEscapes(v.Then)
+			d.collectEscapes(v.Else)
+		}
+	}
+}
+
+// targetOf returns the function of closure which the value always is. Empty string means the value
+// is not unique. The second return value is false when nothing is known about the value yet.
+func (d *devirtualizer) targetOf(ident string, viaParams bool) (string, bool) {
+	for {
+		val, defined := d.defs[ident]
+		if !defined {
+			if !viaParams || !d.candidates[ident] {
+				// Parameter of function which may be called from anywhere
+				return "", true
+			}
+			t, ok := d.targets[ident]
+			return t, ok
+		}
+
+		switch v := val.(type) {
+		case *mir.MakeCls:
+			return v.Fun, true
+		case *mir.Ref:
+			ident = v.Ident
+		case *mir.If:
+			t1, ok1 := d.targetOf(v.Then.Bottom.Prev.Ident, viaParams)
+			t2, ok2 := d.targetOf(v.Else.Bottom.Prev.Ident, viaParams)
+			switch {
+			case !ok1:
+				return t2, ok2
+			case !ok2 || t1 == t2:
+				return t1, true
+			default:
+				return "", true
+			}
+		default:
+			return "", true
+		}
+	}
+}
+
+// visitCall merges closures passed as arguments into targets of parameters of the callee.
+func (d *devirtualizer) visitCall(callee string, args []string) {
+	params, ok := d.params[callee]
+	if !ok {
+		return
+	}
+	for i, p := range params {
+		prev, visited := d.targets[p]
+		if visited && prev == "" {
+			continue
+		}
+		if i >= len(args) {
+			d.targets[p] = ""
+			d.changed = true
+			continue
+		}
+		t, ok := d.targetOf(args[i], true)
+		if !ok {
+			continue
+		}
+		if !visited {
+			d.targets[p] = t
+			d.changed = true
+		} else if prev != t {
+			d.targets[p] = ""
+			d.changed = true
+		}
+	}
+}
+
+// visible returns true when the closure can be referred in the function currently visited.
+func (d *devirtualizer) visible(closure string) bool {
+	if closure == d.fun || d.owners[closure] == d.fun {
+		return true
+	}
+	for _, c := range d.prog.Closures[d.fun] {
+		if c == closure {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *devirtualizer) rewrite(app *mir.App) {
+	if t, ok := d.targetOf(app.Callee, true); ok && t != "" {
+		if caps, ok := d.prog.Closures[t]; ok && len(caps) == 0 {
+			app.Callee = t
+			app.Kind = mir.DIRECT_CALL
+			return
+		}
+	}
+	if t, ok := d.targetOf(app.Callee, false); ok && t != "" && t != app.Callee && d.visible(t) {
+		app.Callee = t
+	}
+}
+
+func (d *devirtualizer) visit(b *mir.Block, rewrite bool) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.If:
+			d.visit(v.Then, rewrite)
+			d.visit(v.Else, rewrite)
+		case *mir.App:
+			if v.Kind == mir.EXTERNAL_CALL {
+				continue
+			}
+			d.visitCall(v.Callee, v.Args)
+			if rewrite && v.Kind == mir.CLOSURE_CALL {
+				d.rewrite(v)
+			}
+		case *mir.Jump:
+			d.visitCall(d.fun, v.Args)
+		}
+	}
+}
+
+func (d *devirtualizer) visitProgram(rewrite bool) {
+	for _, name := range d.prog.Toplevel.Names() {
+		d.fun = name
+		d.visit(d.prog.Toplevel[name].Val.Body, rewrite)
+	}
+	d.fun = ""
+	d.visit(d.prog.Entry, rewrite)
+}
+
+// Devirtualize converts calls of closures whose functions are statically unique into direct calls.
+func Devirtualize(prog *mir.Program) {
+	d := &devirtualizer{
+		prog,
+		map[string]mir.Val{},
+		map[string]string{},
+		map[string][]string{},
+		map[string]bool{},
+		map[string]string{},
+		"",
+		true,
+	}
+
+	for _, name := range prog.Toplevel.Names() {
+		f := prog.Toplevel[name]
+		d.fun = name
+		d.collectDefs(f.Val.Body)
+		d.params[name] = f.Val.Params
+	}
+	d.fun = ""
+	d.collectDefs(prog.Entry)
+	for _, f := range prog.Toplevel {
+		d.collectEscapes(f.Val.Body)
+	}
+	d.collectEscapes(prog.Entry)
+	for _, params := range d.params {
+		for _, p := range params {
+			d.candidates[p] = true
+		}
+	}
+
+	for d.changed {
+		d.changed = false
+		d.visitProgram(false)
+	}
+	d.visitProgram(true)
+}
@@ -0,0 +1,110 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestDevirtualize(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		contains []string
+		excludes []string
+	}{
+		{
+			what:     "alias of closure",
+			code:     "let x = 1 in let rec f a = a + x in let g = f in println_int (g 1)",
+			contains: []string{"= appcls f$t2 "},
+			excludes: []string{"appcls g$t4"},
+		},
+		{
+			what:     "alias of function which captures nothing",
+			code:     "let rec f a = a + 1 in let g = f in println_int (g 1)",
+			contains: []string{"= app f$t1 "},
+			excludes: []string{"appcls g$t3"},
+		},
+		{
+			what:     "same closure in both branches",
+			code:     "let x = 1 in let rec f a = a + x in let g = if x > 0 then f else f in println_int (g 1)",
+			contains: []string{"= appcls f$t2 "},
+			excludes: []string{"appcls g$t4"},
+		},
+		{
+			what:     "different closures in branches",
+			code:     "let x = 1 in let rec f a = a + x in let rec h a = a - x in let g = if x > 0 then f else h in println_int (g 1)",
+			contains: []string{"appcls g$t"},
+		},
+		{
+			what:     "parameter",
+			code:     "let rec f a = a + 1 in let rec apply h v = h v in println_int (apply f 1); println_int (apply f 2)",
+			contains: []string{"= app f$t1 $k4"},
+			excludes: []string{"appcls h$t"},
+		},
+		{
+			what:     "parameter passed recursively",
+			code:     "let rec f a = a + 1 in let rec loop h n = if n = 0 then 0 else h (loop h (n - 1)) in println_int (loop f 3)",
+			contains: []string{"= app f$t1 "},
+			excludes: []string{"appcls h$t"},
+		},
+		{
+			what:     "different closures passed to parameter",
+			code:     "let rec f a = a + 1 in let rec g a = a - 1 in let rec apply h v = h v in println_int (apply f 1); println_int (apply g 2)",
+			contains: []string{"appcls h$t"},
+		},
+		{
+			what:     "closure with captures passed to parameter",
+			code:     "let x = 1 in let rec f a = a + x in let rec apply h v = h v in println_int (apply f 1)",
+			contains: []string{"appcls h$t"},
+		},
+		{
+			what:     "parameter of escaping function",
+			code:     "let rec f a = a + 1 in let rec apply h v = h v in let k = apply in println_int (k f 1)",
+			contains: []string{"appcls h$t"},
+		},
+		{
+			what:     "closure not in scope",
+			code:     "let x = 1 in let rec f a = a + x in let g = f in let rec k u = g u in println_int (k 1)",
+			contains: []string{"appcls g$t4"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			Devirtualize(prog)
+			if err := mir.Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in program '%s'", expected, out)
+				}
+			}
+			for _, unexpected := range tc.excludes {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected '%s' not to be contained in program '%s'", unexpected, out)
+				}
+			}
+		})
+	}
+}
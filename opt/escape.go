@@ -0,0 +1,83 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+)
+
+// Note:
+// Escape analysis finds tuples and closures which never outlive the function creating them. They can
+// be allocated on stack instead of GC heap.
+// A tuple does not escape when it is only loaded by 'tplload' or compared with '=' or '<>'. A closure
+// does not escape when it is only called or compared. Any other use such as passing it to functions,
+// capturing it by closures, storing it in other values or returning it as the value of a block makes
+// it escape. Since identifiers are unique in program, uses in a closure body of the closure itself are
+// also considered.
+//   let t = (1, 2) in let (a, b) = t in a + b   (* 't' does not escape *)
+//   let t = (1, 2) in f t                       (* 't' escapes *)
+// Aliases by 'ref' instructions make values escape. So it should be applied after mir.ElimRefs.
+// When a closure reuses the environment of other closure, the other closure escapes if the closure
+// escapes.
+
+type escapeAnalysis struct {
+	// Identifiers of tuples and closures
+	candidates map[string]struct{}
+	escaping   map[string]struct{}
+}
+
+func (ea *escapeAnalysis) escape(names ...string) {
+	for _, n := range names {
+		ea.escaping[n] = struct{}{}
+	}
+}
+
+func (ea *escapeAnalysis) analyzeBlock(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Tuple:
+			ea.candidates[i.Ident] = struct{}{}
+			ea.escape(v.Elems...)
+		case *mir.MakeCls:
+			ea.candidates[i.Ident] = struct{}{}
+			ea.escape(v.Vars...)
+		case *mir.TplLoad:
+			// Loading element does not make the tuple escape
+		case *mir.Binary:
+			// Comparing values does not make them escape
+		case *mir.App:
+			if v.Kind != mir.CLOSURE_CALL {
+				ea.escape(v.Callee)
+			}
+			ea.escape(v.Args...)
+		case *mir.If:
+			ea.analyzeBlock(v.Then)
+			ea.analyzeBlock(v.Else)
+		default:
+			ea.escape(operandsOf(v)...)
+		}
+	}
+	// Value of block is returned from the block
+	ea.escape(b.Bottom.Prev.Ident)
+}
+
+// AnalyzeEscapes finds tuples and closures which never escape from the function creating them and
+// records them in the program as values to be allocated on stack.
+func AnalyzeEscapes(prog *mir.Program) {
+	ea := &escapeAnalysis{map[string]struct{}{}, map[string]struct{}{}}
+	for _, f := range prog.Toplevel {
+		ea.analyzeBlock(f.Val.Body)
+	}
+	ea.analyzeBlock(prog.Entry)
+
+	for to, from := range prog.SharedEnvs {
+		// Shared environment lives as long as the closure reusing it
+		if _, ok := ea.escaping[to]; ok {
+			ea.escape(from)
+		}
+	}
+
+	for name := range ea.candidates {
+		if _, ok := ea.escaping[name]; !ok {
+			prog.StackAllocated[name] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeEscapes(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		stack    []string
+		escaping []string
+	}{
+		{
+			what:  "destructured tuple",
+			code:  "let t = (1, 2) in let (a, b) = t in a + b",
+			stack: []string{"t$t1"},
+		},
+		{
+			what:  "compared tuple",
+			code:  "let t = (1, 2) in let u = (1, 2) in t = u",
+			stack: []string{"t$t1", "u$t2"},
+		},
+		{
+			what:     "tuple passed to function",
+			code:     "let rec f p = let (a, b) = p in a in let t = (1, 2) in f t",
+			escaping: []string{"t$t5"},
+		},
+		{
+			what:     "tuple returned from function",
+			code:     "let rec f x = (x, x) in f 1",
+			escaping: []string{"$k3"},
+		},
+		{
+			what:     "tuple in tuple",
+			code:     "let t = (1, 2) in let u = (t, 3) in let (a, b) = u in b",
+			stack:    []string{"u$t2"},
+			escaping: []string{"t$t1"},
+		},
+		{
+			what:  "called closure",
+			code:  "let x = 1 in let rec f a = a + x in f 1",
+			stack: []string{"f$t2"},
+		},
+		{
+			what:     "closure passed to function",
+			code:     "let x = 1 in let rec f a = a + x in let rec g h = h 1 in g f",
+			escaping: []string{"f$t2"},
+		},
+		{
+			what:     "closure captured by closure",
+			code:     "let x = 1 in let rec f a = a + x in let rec g b = f b in g 1",
+			stack:    []string{"g$t4"},
+			escaping: []string{"f$t2"},
+		},
+		{
+			what:     "closure returned from function",
+			code:     "let rec make x = let rec f a = a + x in f in (make 1) 2",
+			escaping: []string{"f$t3"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mir.ElimRefs(ir, env)
+			prog := closure.Transform(ir)
+			AnalyzeEscapes(prog)
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			for _, n := range append(tc.stack, tc.escaping...) {
+				if !strings.Contains(out, n+" = ") {
+					t.Fatalf("'%s' is not defined in program '%s'", n, out)
+				}
+			}
+
+			for _, n := range tc.stack {
+				if _, ok := prog.StackAllocated[n]; !ok {
+					t.Errorf("'%s' should be allocated on stack: %v", n, prog.StackAllocated)
+				}
+			}
+			for _, n := range tc.escaping {
+				if _, ok := prog.StackAllocated[n]; ok {
+					t.Errorf("'%s' should escape: %v", n, prog.StackAllocated)
+				}
+			}
+		})
+	}
+}
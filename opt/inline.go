@@ -0,0 +1,273 @@
+// Package opt provides optimization passes for MIR program.
+//
+// Passes take a program after closure transform and monomorphization, and rewrite it in place.
+// Type information of newly introduced identifiers is registered to the type environment.
+package opt
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Inlining replaces direct calls of small functions with their bodies. Identifiers bound in the body
+// are renamed to fresh ones and parameters are bound to arguments with 'ref' instructions. The
+// identifier of the call is bound to the last instruction of the body since it is the returned value.
+//   f$t1 = fun a$t2 ; (* toplevel *)
+//     $k1 = int 1
+//     $k2 = binary + a$t2 $k1
+//   $k5 = app f$t1 $k4
+// is converted into
+//   a$t2$i1 = ref $k4
+//   $k1$i2 = int 1
+//   $k5 = binary + a$t2$i1 $k1$i2
+// Recursive functions, closures and functions containing 'jump' are never inlined. Bodies are copied
+// from the functions before inlining so that inlining always terminates even if functions call each
+// other.
+// When a profile is given, the threshold is adjusted at each call site. Calls which were never
+// executed are not inlined to keep code small. Hot calls, executed at least 1/hotCallRatio times of
+// the hottest call site, accept functions hotInlineFactor times larger than the threshold. Calls not
+// recorded in the profile use the threshold as it is.
+
+const (
+	hotCallRatio    = 100
+	hotInlineFactor = 4
+)
+
+type renamer struct {
+	env   *types.Env
+	names map[string]string
+	count *int
+	// Keep identifiers as they are. It is used for copying function bodies as templates.
+	keep bool
+}
+
+func (r *renamer) fresh(name string) string {
+	if r.keep {
+		return name
+	}
+	*r.count++
+	n := fmt.Sprintf("%s$i%d", name, *r.count)
+	t, ok := r.env.DeclTable[name]
+	if !ok {
+		panic("FATAL: Type of identifier not found while inlining: " + name)
+	}
+	r.env.DeclTable[n] = t
+	r.names[name] = n
+	return n
+}
+
+func (r *renamer) resolve(name string) string {
+	if n, ok := r.names[name]; ok {
+		return n
+	}
+	// Function labels and external symbols are not renamed
+	return name
+}
+
+func (r *renamer) resolveAll(names []string) []string {
+	resolved := make([]string, 0, len(names))
+	for _, n := range names {
+		resolved = append(resolved, r.resolve(n))
+	}
+	return resolved
+}
+
+// copyVal copies the value with renaming identifiers it uses.
+func (r *renamer) copyVal(val mir.Val) mir.Val {
+	switch v := val.(type) {
+	case *mir.Unary:
+		return &mir.Unary{v.Op, r.resolve(v.Child)}
+	case *mir.Binary:
+		return &mir.Binary{v.Op, r.resolve(v.LHS), r.resolve(v.RHS)}
+	case *mir.Ref:
+		return &mir.Ref{r.resolve(v.Ident)}
+	case *mir.If:
+		return &mir.If{r.resolve(v.Cond), r.copyBlock(v.Then), r.copyBlock(v.Else)}
+	case *mir.App:
+		return &mir.App{r.resolve(v.Callee), r.resolveAll(v.Args), v.Kind}
+	case *mir.Tuple:
+		return &mir.Tuple{r.resolveAll(v.Elems)}
+	case *mir.TplLoad:
+		return &mir.TplLoad{r.resolve(v.From), v.Index}
+	case *mir.Array:
+		return &mir.Array{r.resolve(v.Size), r.resolve(v.Elem)}
+	case *mir.ArrLit:
+		return &mir.ArrLit{r.resolveAll(v.Elems)}
+	case *mir.ArrLoad:
+		return &mir.ArrLoad{r.resolve(v.From), r.resolve(v.Index)}
+	case *mir.ArrStore:
+		return &mir.ArrStore{r.resolve(v.To), r.resolve(v.Index), r.resolve(v.RHS)}
+	case *mir.ArrLen:
+		return &mir.ArrLen{r.resolve(v.Array)}
+	case *mir.BoundsCheck:
+		return &mir.BoundsCheck{r.resolve(v.Array), r.resolve(v.Index)}
+	case *mir.TblLoad:
+		return &mir.TblLoad{r.resolve(v.From), r.resolve(v.Key)}
+	case *mir.TblStore:
+		return &mir.TblStore{r.resolve(v.To), r.resolve(v.Key), r.resolve(v.RHS)}
+	case *mir.TblRemove:
+		return &mir.TblRemove{r.resolve(v.From), r.resolve(v.Key)}
+	case *mir.Some:
+		return &mir.Some{r.resolve(v.Elem)}
+	case *mir.IsSome:
+		return &mir.IsSome{r.resolve(v.OptVal)}
+	case *mir.DerefSome:
+		return &mir.DerefSome{r.resolve(v.SomeVal)}
+	case *mir.Variant:
+		payload := v.Payload
+		if payload != "" {
+			payload = r.resolve(payload)
+		}
+		return &mir.Variant{v.Tag, payload}
+	case *mir.IsVariant:
+		return &mir.IsVariant{r.resolve(v.Target), v.Tag}
+	case *mir.VariantPayload:
+		return &mir.VariantPayload{r.resolve(v.Target)}
+	case *mir.MakeCls:
+		return &mir.MakeCls{r.resolveAll(v.Vars), v.Fun}
+	case *mir.Jump:
+		return &mir.Jump{r.resolveAll(v.Args)}
+	case *mir.Fun:
+		panic("FATAL: Function must be moved to toplevel before inlining")
+	default:
+		// Constants and values which do not use any identifier can be shared
+		return val
+	}
+}
+
+func (r *renamer) copyBlock(b *mir.Block) *mir.Block {
+	to := mir.NewEmptyBlock(b.Name)
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		val := r.copyVal(i.Val)
+		to.Append(mir.NewInsn(r.fresh(i.Ident), val, i.Pos))
+	}
+	return to
+}
+
+type inliner struct {
+	env       *types.Env
+	threshold int
+	profile   *mir.Profile
+	// Bodies of functions to be inlined. They are copied before inlining
+	templates map[string]*mir.Fun
+	count     int
+}
+
+// containsJump returns true when the block contains 'jump' instruction. 'jump' goes back to the
+// beginning of the function containing it so the function cannot be inlined.
+func containsJump(b *mir.Block) bool {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Jump:
+			return true
+		case *mir.If:
+			if containsJump(v.Then) || containsJump(v.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (inl *inliner) isCandidate(f mir.FunInsn, closures mir.Closures) bool {
+	if f.Val.IsRecursive || containsJump(f.Val.Body) {
+		return false
+	}
+	if _, ok := closures[f.Name]; ok {
+		return false
+	}
+	threshold := inl.threshold
+	if inl.profile != nil {
+		threshold *= hotInlineFactor
+	}
+	return f.Val.Body.Size() <= threshold
+}
+
+// thresholdAt returns the threshold of inlining at the call site.
+func (inl *inliner) thresholdAt(call *mir.Insn) int {
+	if inl.profile == nil {
+		return inl.threshold
+	}
+	count, ok := inl.profile.Count(mir.ProfileCall, call.Pos)
+	switch {
+	case !ok:
+		return inl.threshold
+	case count == 0:
+		return 0
+	case count*hotCallRatio >= inl.profile.MaxCall():
+		return inl.threshold * hotInlineFactor
+	default:
+		return inl.threshold
+	}
+}
+
+// expand returns instructions of the inlined function body for the call instruction.
+func (inl *inliner) expand(call *mir.Insn, app *mir.App, fun *mir.Fun) []*mir.Insn {
+	r := &renamer{inl.env, map[string]string{}, &inl.count, false}
+	insns := make([]*mir.Insn, 0, len(fun.Params)+fun.Body.Size())
+	for i, p := range fun.Params {
+		insns = append(insns, mir.NewInsn(r.fresh(p), &mir.Ref{app.Args[i]}, call.Pos))
+	}
+	body := r.copyBlock(fun.Body)
+	for i, end := body.WholeRange(); i != end; i = i.Next {
+		insns = append(insns, i)
+	}
+	// The last instruction is the returned value
+	insns[len(insns)-1].Ident = call.Ident
+	return insns
+}
+
+func (inl *inliner) inlineBlock(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.If:
+			inl.inlineBlock(v.Then)
+			inl.inlineBlock(v.Else)
+		case *mir.App:
+			if v.Kind != mir.DIRECT_CALL {
+				continue
+			}
+			fun, ok := inl.templates[v.Callee]
+			if !ok || fun.Body.Size() > inl.thresholdAt(i) {
+				continue
+			}
+			insns := inl.expand(i, v, fun)
+			prev, next := i.Prev, i.Next
+			for _, insn := range insns {
+				prev.Next = insn
+				insn.Prev = prev
+				prev = insn
+			}
+			prev.Next = next
+			next.Prev = prev
+			i = prev
+		}
+	}
+}
+
+// Inline inlines small functions into their call sites. Functions whose number of instructions is
+// less than or equal to the threshold are inlined. Functions which are no longer referenced after
+// inlining are not removed.
+func Inline(prog *mir.Program, env *types.Env, threshold int) {
+	InlineWithProfile(prog, env, threshold, nil)
+}
+
+// InlineWithProfile is the same as Inline but prioritizes hot call sites in the profile. When the
+// profile is nil, it is equivalent to Inline.
+func InlineWithProfile(prog *mir.Program, env *types.Env, threshold int, profile *mir.Profile) {
+	inl := &inliner{env, threshold, profile, map[string]*mir.Fun{}, 0}
+	for name, f := range prog.Toplevel {
+		if !inl.isCandidate(f, prog.Closures) {
+			continue
+		}
+		r := &renamer{env, map[string]string{}, &inl.count, true}
+		inl.templates[name] = &mir.Fun{f.Val.Params, r.copyBlock(f.Val.Body), false}
+	}
+
+	for _, f := range prog.Toplevel {
+		inl.inlineBlock(f.Val.Body)
+	}
+	inl.inlineBlock(prog.Entry)
+}
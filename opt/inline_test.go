@@ -0,0 +1,206 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	cases := []struct {
+		what      string
+		code      string
+		threshold int
+		contains  []string
+		excludes  []string
+	}{
+		{
+			what:      "small function",
+			code:      "let rec f a = a + 1 in f 42",
+			threshold: 10,
+			contains: []string{
+				"a$t2$i1 = ref $k4 ; type=int",
+				"binary + $k1$i2 $k2$i3 ; type=int",
+			},
+			excludes: []string{
+				"app f$t1",
+			},
+		},
+		{
+			what:      "function larger than threshold",
+			code:      "let rec f a = a + 1 in f 42",
+			threshold: 1,
+			contains: []string{
+				"app f$t1 $k4 ; type=int",
+			},
+			excludes: []string{
+				"$i1",
+			},
+		},
+		{
+			what:      "function with nested block",
+			code:      "let rec f a = if a < 0 then 0 else a in f 42",
+			threshold: 10,
+			contains: []string{
+				"a$t2$i1 = ref",
+				"if ",
+			},
+			excludes: []string{
+				"app f$t1",
+			},
+		},
+		{
+			what:      "call in nested block",
+			code:      "let rec f a = a + 1 in if true then f 1 else 0",
+			threshold: 10,
+			contains: []string{
+				"a$t2$i1 = ref",
+			},
+			excludes: []string{
+				"app f$t1",
+			},
+		},
+		{
+			what:      "recursive function",
+			code:      "let rec f a = if a < 0 then 0 else f (a - 1) in f 42",
+			threshold: 100,
+			contains: []string{
+				"app f$t1",
+			},
+			excludes: []string{
+				"$i1",
+			},
+		},
+		{
+			what:      "closure",
+			code:      "let x = 1 in let rec f a = a + x in f 42",
+			threshold: 100,
+			contains: []string{
+				"appcls f$t2",
+			},
+			excludes: []string{
+				"$i1",
+			},
+		},
+		{
+			what:      "multiple calls",
+			code:      "let rec f a = a + 1 in f (f 42)",
+			threshold: 10,
+			contains: []string{
+				"a$t2$i1 = ref",
+				"a$t2$i5 = ref $k5 ; type=int",
+			},
+			excludes: []string{
+				"app f$t1",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			Inline(prog, env, tc.threshold)
+
+			var buf bytes.Buffer
+			prog.Entry.Println(&buf, env)
+			out := buf.String()
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in entry '%s'", expected, out)
+				}
+			}
+			for _, unexpected := range tc.excludes {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected '%s' not to be contained in entry '%s'", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestInlineKeepsFunctions(t *testing.T) {
+	s := locerr.NewDummySource("let rec f a = a + 1 in f 42; ()")
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+	Inline(prog, env, 10)
+
+	f, ok := prog.Toplevel["f$t1"]
+	if !ok {
+		t.Fatalf("Inlined function was removed from toplevel: %v", prog.Toplevel)
+	}
+	if _, ok := f.Val.Body.Bottom.Prev.Val.(*mir.Binary); !ok {
+		t.Fatalf("Body of inlined function was modified: %v", f.Val.Body)
+	}
+}
+
+func TestInlineWithProfile(t *testing.T) {
+	cases := []struct {
+		what      string
+		threshold int
+		// Count of the call site. Negative means the site is not recorded.
+		count int64
+		// Count of the hottest call site in the program
+		max     int64
+		inlined bool
+	}{
+		{"call never executed", 10, 0, 100, false},
+		{"hot call", 1, 100, 100, true},
+		{"call executed but not hot", 1, 1, 1000, false},
+		{"call not in profile", 10, -1, 100, true},
+		{"call not in profile with small threshold", 1, -1, 100, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource("let rec f a = a + 1 in f 42; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+
+			profile := mir.NewProfile()
+			profile.Add(mir.ProfileCall, locerr.Pos{Line: 100, Column: 1}, tc.max)
+			if tc.count >= 0 {
+				for i, end := prog.Entry.WholeRange(); i != end; i = i.Next {
+					if app, ok := i.Val.(*mir.App); ok && app.Callee == "f$t1" {
+						profile.Add(mir.ProfileCall, i.Pos, tc.count)
+					}
+				}
+			}
+			InlineWithProfile(prog, env, tc.threshold, profile)
+
+			var buf bytes.Buffer
+			prog.Entry.Println(&buf, env)
+			out := buf.String()
+			if inlined := !strings.Contains(out, "app f$t1"); inlined != tc.inlined {
+				t.Fatalf("Wanted inlined=%v but got %v: %s", tc.inlined, inlined, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/cfg"
+	"github.com/rhysd/gocaml/common"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+)
+
+// Note:
+// Passes in this package are run by mir.PassManager after closure transform. A pipeline is a list of
+// pass names. The default pipeline is selected by optimization level and can be replaced by a
+// user-specified one (-passes flag).
+//   tail-call       OptimizeTailCalls
+//   inline          Inline
+//   const-fold      FoldConstants (requires 'ssa' analysis)
+//   simplify-branch SimplifyBranches
+//   copy-prop       mir.PropagateCopies
+//   bounds-check    EliminateBoundsChecks
+//   scalar-replace  ReplaceTupleScalars
+//   devirtualize    Devirtualize
+//   dead-code       EliminateDeadCode
+//   closure-env     MinimizeClosureEnvs
+//   escape          AnalyzeEscapes
+
+// PassNames is a list of names of all available passes.
+var PassNames = []string{"tail-call", "inline", "const-fold", "simplify-branch", "copy-prop", "bounds-check", "scalar-replace", "devirtualize", "dead-code", "closure-env", "escape"}
+
+type ssaAnalysis struct{}
+
+func (a ssaAnalysis) Name() string {
+	return "ssa"
+}
+
+func (a ssaAnalysis) Analyze(prog *mir.Program, env *types.Env) interface{} {
+	return cfg.BuildProgramSSA(prog)
+}
+
+func transform(name string, f func(prog *mir.Program)) mir.Pass {
+	return mir.PassFunc(name, nil, func(ctx *mir.PassContext) error {
+		f(ctx.Prog)
+		return nil
+	})
+}
+
+func newPass(name string, inlineThreshold int) mir.Pass {
+	switch name {
+	case "tail-call":
+		return transform(name, OptimizeTailCalls)
+	case "inline":
+		return mir.PassFunc(name, nil, func(ctx *mir.PassContext) error {
+			InlineWithProfile(ctx.Prog, ctx.Env, inlineThreshold, ctx.Profile)
+			return nil
+		})
+	case "const-fold":
+		return mir.PassFunc(name, []string{"ssa"}, func(ctx *mir.PassContext) error {
+			foldConstants(ctx.Prog, ctx.Result("ssa").(map[string]*cfg.SSA))
+			return nil
+		})
+	case "simplify-branch":
+		return mir.PassFunc(name, nil, func(ctx *mir.PassContext) error {
+			SimplifyBranches(ctx.Prog, ctx.Env)
+			return nil
+		})
+	case "copy-prop":
+		return mir.PassFunc(name, nil, func(ctx *mir.PassContext) error {
+			mir.PropagateCopies(ctx.Prog, ctx.Env)
+			return nil
+		})
+	case "bounds-check":
+		return transform(name, EliminateBoundsChecks)
+	case "scalar-replace":
+		return transform(name, ReplaceTupleScalars)
+	case "devirtualize":
+		return transform(name, Devirtualize)
+	case "dead-code":
+		return transform(name, EliminateDeadCode)
+	case "closure-env":
+		return transform(name, MinimizeClosureEnvs)
+	case "escape":
+		return transform(name, AnalyzeEscapes)
+	default:
+		return nil
+	}
+}
+
+// DefaultPipeline returns names of passes run at the optimization level (0~3). Tail calls are always
+// optimized since they are guaranteed by the language. Inlining is enabled when the threshold is not
+// zero. Higher levels run more passes and take more compile time.
+//   0: No optimization
+//   1: Cheap passes (constant folding, branch simplification, copy propagation, bounds check
+//      elimination, dead code elimination, closure environment minimization and escape analysis)
+//   2: Level 1, scalar replacement of tuples and devirtualization of closure calls
+//   3: Level 2 and constant folding and branch simplification again on scalars replaced from tuples
+func DefaultPipeline(level int, inlineThreshold int) []string {
+	names := []string{"tail-call"}
+	if inlineThreshold > 0 {
+		names = append(names, "inline")
+	}
+	switch {
+	case level <= 0:
+		return names
+	case level == 1:
+		names = append(names, "const-fold", "simplify-branch", "copy-prop")
+	case level == 2:
+		names = append(names, "const-fold", "simplify-branch", "copy-prop", "scalar-replace", "devirtualize")
+	default:
+		names = append(names, "const-fold", "simplify-branch", "copy-prop", "scalar-replace", "const-fold", "simplify-branch", "devirtualize")
+	}
+	return append(names, "bounds-check", "dead-code", "closure-env", "escape")
+}
+
+// ParsePipeline parses comma-separated names of passes.
+func ParsePipeline(spec string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if newPass(name, 0) == nil {
+			err := locerr.Errorf("Unknown pass '%s'", name)
+			if similar := common.SimilarNames(name, PassNames, 1); len(similar) > 0 {
+				err = locerr.Notef(err, "Did you mean '%s'?", similar[0])
+			}
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// NewPipeline creates a pass manager which runs the passes in order.
+func NewPipeline(names []string, inlineThreshold int) (*mir.PassManager, error) {
+	pm := mir.NewPassManager()
+	pm.RegisterAnalysis(ssaAnalysis{})
+	for _, name := range names {
+		p := newPass(name, inlineThreshold)
+		if p == nil {
+			return nil, locerr.Errorf("Unknown pass '%s'", name)
+		}
+		pm.Add(p)
+	}
+	return pm, nil
+}
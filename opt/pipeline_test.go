@@ -0,0 +1,86 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultPipeline(t *testing.T) {
+	cases := []struct {
+		level     int
+		threshold int
+		expected  []string
+	}{
+		{0, 0, []string{"tail-call"}},
+		{0, 10, []string{"tail-call", "inline"}},
+		{1, 0, []string{"tail-call", "const-fold", "simplify-branch", "copy-prop", "bounds-check", "dead-code", "closure-env", "escape"}},
+		{2, 0, []string{"tail-call", "const-fold", "simplify-branch", "copy-prop", "scalar-replace", "devirtualize", "bounds-check", "dead-code", "closure-env", "escape"}},
+		{3, 10, []string{"tail-call", "inline", "const-fold", "simplify-branch", "copy-prop", "scalar-replace", "const-fold", "simplify-branch", "devirtualize", "bounds-check", "dead-code", "closure-env", "escape"}},
+	}
+	for _, tc := range cases {
+		if actual := DefaultPipeline(tc.level, tc.threshold); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Pipeline for level %d and threshold %d should be %v but got %v", tc.level, tc.threshold, tc.expected, actual)
+		}
+		if _, err := NewPipeline(tc.expected, tc.threshold); err != nil {
+			t.Errorf("Default pipeline %v is broken: %s", tc.expected, err)
+		}
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	names, err := ParsePipeline(" const-fold, dead-code,,escape ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"const-fold", "dead-code", "escape"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Wanted %v but got %v", expected, names)
+	}
+
+	_, err = ParsePipeline("const-fold,dead-cod")
+	if err == nil {
+		t.Fatal("Error did not occur")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "Unknown pass 'dead-cod'") || !strings.Contains(msg, "Did you mean 'dead-code'?") {
+		t.Fatalf("Unexpected error: %s", msg)
+	}
+
+	if _, err := NewPipeline([]string{"foo"}, 0); err == nil {
+		t.Fatal("Unknown pass should cause an error")
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	s := locerr.NewDummySource("let rec f c = let x = if c then 1 else 1 in x + 1 in f true; ()")
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := closure.Transform(ir)
+
+	pm, err := NewPipeline([]string{"const-fold", "dead-code"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.Verify = true
+	if err := pm.Run(prog, env); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	prog.Println(&buf, env)
+	out := buf.String()
+	if !strings.Contains(out, "= int 2 ; type=int") || strings.Contains(out, "binary") {
+		t.Fatalf("Constants were not folded with SSA analysis: %s", out)
+	}
+}
@@ -0,0 +1,120 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/locerr"
+	"sort"
+	"strings"
+)
+
+// Note:
+// Closures are safe for space when their environments never retain variables after their last use.
+// Since a closure can be called any number of times while it is alive, a captured variable is used
+// until the closure dies only when the closure body uses it. Variables are captured by value, so an
+// environment does not keep the scope of the enclosing function alive. The property holds when
+//
+// - Every captured variable is used in the closure body (including captures of nested closures)
+// - Closures sharing an environment capture exactly the same variables
+// - A closure linked to the environment of its enclosing closure captures all variables captured by
+//   the enclosing closure
+//
+// Otherwise a long-running program may leak large values (e.g. arrays) via stale closures.
+
+type spaceChecker struct {
+	prog *mir.Program
+	// 'makecls' instructions by their identifiers
+	makes map[string]*mir.Insn
+}
+
+func (c *spaceChecker) collect(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.MakeCls:
+			c.makes[i.Ident] = i
+		case *mir.If:
+			c.collect(v.Then)
+			c.collect(v.Else)
+		}
+	}
+}
+
+func (c *spaceChecker) checkCaptures(name string, caps []string) error {
+	fun := c.prog.Toplevel[name]
+	used := map[string]struct{}{}
+	collectUses(fun.Val.Body, used)
+	for _, v := range caps {
+		if _, ok := used[v]; !ok {
+			return locerr.ErrorfAt(fun.Pos, "Closure '%s' retains variable '%s' which is never used in its body", name, v)
+		}
+	}
+	return nil
+}
+
+func (c *spaceChecker) checkSharedEnv(to, from string) error {
+	toInsn, ok := c.makes[to]
+	if !ok {
+		// The closure was eliminated
+		return nil
+	}
+	fromInsn, ok := c.makes[from]
+	if !ok {
+		// Checked by verifier
+		return nil
+	}
+	toVars := toInsn.Val.(*mir.MakeCls).Vars
+	fromVars := fromInsn.Val.(*mir.MakeCls).Vars
+	if strings.Join(toVars, ",") != strings.Join(fromVars, ",") {
+		return locerr.ErrorfAt(toInsn.Pos, "Closure '%s' shares environment of '%s' which retains other variables (%s vs %s)", to, from, strings.Join(toVars, ","), strings.Join(fromVars, ","))
+	}
+	return nil
+}
+
+func (c *spaceChecker) checkLink(name, parent string) error {
+	caps := map[string]struct{}{}
+	for _, v := range c.prog.Closures[name] {
+		caps[v] = struct{}{}
+	}
+	for _, v := range c.prog.Closures[parent] {
+		if _, ok := caps[v]; !ok {
+			return locerr.ErrorfAt(c.prog.Toplevel[name].Pos, "Closure '%s' retains variable '%s' via environment of closure '%s' but never uses it", name, v, parent)
+		}
+	}
+	return nil
+}
+
+// CheckSafeForSpace verifies that environments of closures never retain variables which are no
+// longer used. It returns an error describing the first violation.
+func CheckSafeForSpace(prog *mir.Program) error {
+	c := &spaceChecker{prog, map[string]*mir.Insn{}}
+	for _, f := range prog.Toplevel {
+		c.collect(f.Val.Body)
+	}
+	c.collect(prog.Entry)
+
+	for _, name := range prog.Toplevel.Names() {
+		caps, ok := prog.Closures[name]
+		if !ok {
+			continue
+		}
+		if err := c.checkCaptures(name, caps); err != nil {
+			return err
+		}
+		if parent, ok := prog.EnvLinks[name]; ok {
+			if err := c.checkLink(name, parent); err != nil {
+				return err
+			}
+		}
+	}
+
+	shared := make([]string, 0, len(prog.SharedEnvs))
+	for to := range prog.SharedEnvs {
+		shared = append(shared, to)
+	}
+	sort.Strings(shared)
+	for _, to := range shared {
+		if err := c.checkSharedEnv(to, prog.SharedEnvs[to]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func closureProgram(t *testing.T, code string) *mir.Program {
+	s := locerr.NewDummySource(code + "; ()")
+	ast, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := sema.SemanticsCheck(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mir.ElimRefs(ir, env)
+	prog := closure.Transform(ir)
+	SimplifyBranches(prog, env)
+	EliminateDeadCode(prog)
+	return prog
+}
+
+func TestCheckSafeForSpace(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		breaks   func(p *mir.Program)
+		expected string
+	}{
+		{
+			what:   "minimized environments",
+			code:   "let x = 1 in let rec f a = a + x in let rec g b = b * x in f (g 2)",
+			breaks: func(p *mir.Program) { MinimizeClosureEnvs(p) },
+		},
+		{
+			what:     "capture made dead by optimization",
+			code:     "let x = 1 in let rec f a = if true then a else a + x in f 2",
+			breaks:   func(p *mir.Program) {},
+			expected: "Closure 'f$t2' retains variable 'x$t1' which is never used in its body",
+		},
+		{
+			what:   "dead capture is trimmed",
+			code:   "let x = 1 in let rec f a = if true then a else a + x in f 2",
+			breaks: func(p *mir.Program) { TrimClosureCaptures(p) },
+		},
+		{
+			what: "environment shared with closure capturing other variables",
+			code: "let x = 1 in let y = 2 in let rec f a = a + x in let rec g b = b * x * y in f (g 2)",
+			breaks: func(p *mir.Program) {
+				p.SharedEnvs["g$t5"] = "f$t3"
+			},
+			expected: "Closure 'g$t5' shares environment of 'f$t3' which retains other variables (x$t1,y$t2 vs x$t1)",
+		},
+		{
+			what: "linked environment retaining unused variable",
+			code: "let x = 1 in let y = 2 in let rec f a = (let rec g b = a + b + x in if a = y then g else (fun c -> c)) in (f 1) 2",
+			breaks: func(p *mir.Program) {
+				p.EnvLinks["g$t5"] = "f$t3"
+			},
+			expected: "Closure 'g$t5' retains variable 'y$t2' via environment of closure 'f$t3' but never uses it",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			prog := closureProgram(t, tc.code)
+			tc.breaks(prog)
+			err := CheckSafeForSpace(prog)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Error was expected: %s", tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Unexpected error message '%s'. It should contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
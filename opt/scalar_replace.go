@@ -0,0 +1,85 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+)
+
+// Note:
+// Tuples which are constructed and only destructured in the same function do not need to be
+// allocated on heap. Loads of their elements are replaced with references to the element values.
+//   t$t1 = tuple a$t2,b$t3
+//   x$t4 = tplload 0 t$t1
+//   y$t5 = tplload 1 t$t1
+// is converted into
+//   x$t4 = ref a$t2
+//   y$t5 = ref b$t3
+// A tuple escapes when it is used as an operand of other instructions than 'tplload' (e.g. passed
+// to a function, captured by a closure, stored in an array) or it is the value of a block. Escaping
+// tuples are kept as they are. Since aliases of tuples by 'ref' instructions are also regarded as
+// escaping, it should be applied after mir.ElimRefs.
+
+type scalarReplacer struct {
+	// Instructions constructing tuples which may not escape
+	tuples map[string]*mir.Insn
+	// Identifiers of escaping tuples
+	escaping map[string]struct{}
+}
+
+func (sr *scalarReplacer) analyzeBlock(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Tuple:
+			sr.tuples[i.Ident] = i
+		case *mir.TplLoad:
+			// Loading elements does not make the tuple escape
+			continue
+		case *mir.If:
+			sr.analyzeBlock(v.Then)
+			sr.analyzeBlock(v.Else)
+		}
+		for _, o := range operandsOf(i.Val) {
+			sr.escaping[o] = struct{}{}
+		}
+	}
+	// Value of block is returned from the block
+	sr.escaping[b.Bottom.Prev.Ident] = struct{}{}
+}
+
+func (sr *scalarReplacer) replaceBlock(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.TplLoad:
+			if t, ok := sr.tuples[v.From]; ok {
+				i.Val = &mir.Ref{t.Val.(*mir.Tuple).Elems[v.Index]}
+			}
+		case *mir.If:
+			sr.replaceBlock(v.Then)
+			sr.replaceBlock(v.Else)
+		}
+	}
+}
+
+// ReplaceTupleScalars removes allocations of tuples which never escape. Loads of their elements are
+// replaced with the element values directly.
+func ReplaceTupleScalars(prog *mir.Program) {
+	sr := &scalarReplacer{map[string]*mir.Insn{}, map[string]struct{}{}}
+	for _, f := range prog.Toplevel {
+		sr.analyzeBlock(f.Val.Body)
+	}
+	sr.analyzeBlock(prog.Entry)
+
+	for name := range sr.escaping {
+		delete(sr.tuples, name)
+	}
+	if len(sr.tuples) == 0 {
+		return
+	}
+
+	for _, f := range prog.Toplevel {
+		sr.replaceBlock(f.Val.Body)
+	}
+	sr.replaceBlock(prog.Entry)
+	for _, insn := range sr.tuples {
+		insn.RemoveFromList()
+	}
+}
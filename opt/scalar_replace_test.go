@@ -0,0 +1,84 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestReplaceTupleScalars(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		contains []string
+		excludes []string
+	}{
+		{
+			what:     "destructured tuple",
+			code:     "let t = (1, true) in let (a, b) = t in if b then a else 0",
+			contains: []string{"a$t2 = ref $k1", "b$t3 = ref $k2"},
+			excludes: []string{"tuple", "tplload"},
+		},
+		{
+			what:     "destructured in nested block",
+			code:     "let t = (1, 2) in if true then (let (a, b) = t in a + b) else 0",
+			excludes: []string{"tuple", "tplload"},
+		},
+		{
+			what:     "passed to function",
+			code:     "let rec f p = let (a, b) = p in a + b in let t = (1, 2) in f t",
+			contains: []string{"t$t5 = tuple", "tplload"},
+		},
+		{
+			what:     "value of block",
+			code:     "let t = if true then (1, 2) else (3, 4) in let (a, b) = t in a",
+			contains: []string{"tuple"},
+		},
+		{
+			what:     "captured by closure",
+			code:     "let t = (1, 2) in let rec f x = let (a, b) = t in a + x in f 1",
+			contains: []string{"t$t1 = tuple", "makecls (t$t1)"},
+		},
+		{
+			what:     "compared",
+			code:     "let t = (1, 2) in let (a, b) = t in t = (a, b)",
+			contains: []string{"t$t1 = tuple"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mir.ElimRefs(ir, env)
+			prog := closure.Transform(ir)
+			ReplaceTupleScalars(prog)
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in program '%s'", expected, out)
+				}
+			}
+			for _, unexpected := range tc.excludes {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected '%s' not to be contained in program '%s'", unexpected, out)
+				}
+			}
+		})
+	}
+}
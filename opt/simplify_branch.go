@@ -0,0 +1,314 @@
+package opt
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/types"
+	"math"
+)
+
+// Note:
+// Branch simplification cleans up 'if' instructions produced by desugaring, inlining and constant
+// folding.
+//   - 'if' whose condition is constant is replaced with instructions of the taken branch. The
+//     condition is also known when enclosing 'if' already checked the same value.
+//       $k2 = if $k1 (* $k1 = bool true *)
+//         BEGIN: then
+//         $k3 = int 1
+//         END: then
+//         ...
+//     is converted into
+//       $k2 = int 1
+//   - 'if' whose branches are the same except for names of identifiers defined in them is replaced
+//     with instructions of one of the branches.
+//   - Nested 'if' sharing the same branch with the enclosing one is collapsed into one 'if' with
+//     logical operator. The branch enclosing the nested 'if' must not contain instructions other
+//     than 'ref' and logical operators since they are moved before the enclosing 'if'.
+//       if a then (if b then X else Y) else Y  -->  if a && b then X else Y
+//       if a then X else (if b then X else Y)  -->  if a || b then X else Y
+// Branches are simplified before the 'if' enclosing them. Instructions which are no longer used
+// (e.g. condition) are left to dead code elimination.
+
+type branchSimplifier struct {
+	env *types.Env
+	// Definitions of identifiers in the program. Identifiers are unique across the program.
+	defs map[string]mir.Val
+	// Conditions whose values are known in the scope
+	known   map[string]bool
+	count   int
+	changed bool
+}
+
+func (s *branchSimplifier) collectDefs(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		s.defs[i.Ident] = i.Val
+		if v, ok := i.Val.(*mir.If); ok {
+			s.collectDefs(v.Then)
+			s.collectDefs(v.Else)
+		}
+	}
+}
+
+func (s *branchSimplifier) resolve(ident string) string {
+	for {
+		r, ok := s.defs[ident].(*mir.Ref)
+		if !ok {
+			return ident
+		}
+		ident = r.Ident
+	}
+}
+
+// boolOf returns the value of the condition when it is known.
+func (s *branchSimplifier) boolOf(ident string) (bool, bool) {
+	ident = s.resolve(ident)
+	if b, ok := s.known[ident]; ok {
+		return b, true
+	}
+	switch v := s.defs[ident].(type) {
+	case *mir.Bool:
+		return v.Const, true
+	case *mir.Unary:
+		if v.Op == mir.NOT {
+			b, ok := s.boolOf(v.Child)
+			return !b, ok
+		}
+	}
+	return false, false
+}
+
+// equalBlocks returns true when the blocks are the same except for names of identifiers defined in
+// them. Identifiers defined in l are mapped to identifiers defined in r in names.
+func (s *branchSimplifier) equalBlocks(l, r *mir.Block, names map[string]string) bool {
+	li, lend := l.WholeRange()
+	ri, rend := r.WholeRange()
+	for li != lend && ri != rend {
+		if !s.equalVals(li.Val, ri.Val, names) {
+			return false
+		}
+		if !types.Equals(s.env.DeclTable[li.Ident], s.env.DeclTable[ri.Ident]) {
+			return false
+		}
+		if _, ok := li.Val.(*mir.BoundsCheck); ok && li.Pos != ri.Pos {
+			// Position is reported when the check fails
+			return false
+		}
+		names[li.Ident] = ri.Ident
+		li, ri = li.Next, ri.Next
+	}
+	return li == lend && ri == rend
+}
+
+func (s *branchSimplifier) equalVals(l, r mir.Val, names map[string]string) bool {
+	same := false
+	switch lv := l.(type) {
+	case *mir.Bool:
+		rv, ok := r.(*mir.Bool)
+		same = ok && lv.Const == rv.Const
+	case *mir.Int:
+		rv, ok := r.(*mir.Int)
+		same = ok && lv.Const == rv.Const
+	case *mir.Float:
+		rv, ok := r.(*mir.Float)
+		same = ok && math.Float64bits(lv.Const) == math.Float64bits(rv.Const)
+	case *mir.String:
+		rv, ok := r.(*mir.String)
+		same = ok && lv.Const == rv.Const
+	case *mir.Unary:
+		rv, ok := r.(*mir.Unary)
+		same = ok && lv.Op == rv.Op
+	case *mir.Binary:
+		rv, ok := r.(*mir.Binary)
+		same = ok && lv.Op == rv.Op
+	case *mir.App:
+		rv, ok := r.(*mir.App)
+		same = ok && lv.Kind == rv.Kind
+	case *mir.TplLoad:
+		rv, ok := r.(*mir.TplLoad)
+		same = ok && lv.Index == rv.Index
+	case *mir.Variant:
+		rv, ok := r.(*mir.Variant)
+		same = ok && lv.Tag == rv.Tag
+	case *mir.IsVariant:
+		rv, ok := r.(*mir.IsVariant)
+		same = ok && lv.Tag == rv.Tag
+	case *mir.MakeCls:
+		rv, ok := r.(*mir.MakeCls)
+		same = ok && lv.Fun == rv.Fun
+	case *mir.XRef:
+		rv, ok := r.(*mir.XRef)
+		same = ok && lv.Ident == rv.Ident
+	case *mir.If:
+		rv, ok := r.(*mir.If)
+		same = ok && s.equalBlocks(lv.Then, rv.Then, names) && s.equalBlocks(lv.Else, rv.Else, names)
+	case *mir.Fun:
+		panic("FATAL: Function must be moved to toplevel before simplifying branches")
+	default:
+		// Other values have no attribute other than operands
+		same = fmt.Sprintf("%T", l) == fmt.Sprintf("%T", r)
+	}
+	if !same {
+		return false
+	}
+
+	lops, rops := operandsOf(l), operandsOf(r)
+	if len(lops) != len(rops) {
+		return false
+	}
+	for i, o := range lops {
+		if n, ok := names[o]; ok {
+			o = n
+		}
+		if o != rops[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splice replaces the 'if' instruction with instructions of the branch. The last instruction of the
+// branch is renamed to the identifier of the 'if' instruction since it is the value of the branch.
+// When the branch ends with 'jump', instructions following the 'if' in the block are removed since
+// 'jump' must be the last instruction of the block.
+func (s *branchSimplifier) splice(b *mir.Block, insn *mir.Insn, branch *mir.Block) {
+	first, last := branch.Top.Next, branch.Bottom.Prev
+	next := insn.Next
+	if _, ok := last.Val.(*mir.Jump); ok && next != b.Bottom {
+		s.env.DeclTable[insn.Ident] = s.env.DeclTable[b.Bottom.Prev.Ident]
+		next = b.Bottom
+	}
+	last.Ident = insn.Ident
+	first.Prev = insn.Prev
+	insn.Prev.Next = first
+	last.Next = next
+	next.Prev = last
+	s.changed = true
+}
+
+// nestedIf returns the 'if' instruction when it is the last instruction of the block and all
+// instructions preceding it can be moved out of the block. They are 'ref' and logical operators
+// (introduced by collapsing 'if') since they are cheap and have no side effect.
+func nestedIf(b *mir.Block) (*mir.Insn, *mir.If) {
+	last := b.Bottom.Prev
+	v, ok := last.Val.(*mir.If)
+	if !ok {
+		return nil, nil
+	}
+	for i := b.Top.Next; i != last; i = i.Next {
+		switch v := i.Val.(type) {
+		case *mir.Ref:
+		case *mir.Binary:
+			if v.Op != mir.AND && v.Op != mir.OR {
+				return nil, nil
+			}
+		default:
+			return nil, nil
+		}
+	}
+	return last, v
+}
+
+func insertBefore(insn, pos *mir.Insn) {
+	insn.Prev = pos.Prev
+	insn.Next = pos
+	pos.Prev.Next = insn
+	pos.Prev = insn
+}
+
+// collapse merges the nested 'if' into the enclosing one by combining their conditions.
+func (s *branchSimplifier) collapse(insn *mir.Insn, v *mir.If) bool {
+	var op mir.OperatorKind
+	var branch *mir.Block
+	var nested *mir.Insn
+	var merged *mir.If
+	if i, inner := nestedIf(v.Then); inner != nil && s.equalBlocks(inner.Else, v.Else, map[string]string{}) {
+		op, branch, nested, merged = mir.AND, v.Then, i, &mir.If{inner.Cond, inner.Then, inner.Else}
+	} else if i, inner := nestedIf(v.Else); inner != nil && s.equalBlocks(v.Then, inner.Then, map[string]string{}) {
+		op, branch, nested, merged = mir.OR, v.Else, i, &mir.If{inner.Cond, v.Then, inner.Else}
+	} else {
+		return false
+	}
+
+	// Move instructions preceding the nested 'if' since they may be used in its branches
+	for i := branch.Top.Next; i != nested; {
+		next := i.Next
+		insertBefore(i, insn)
+		i = next
+	}
+
+	s.count++
+	cond := fmt.Sprintf("%s$b%d", insn.Ident, s.count)
+	s.env.DeclTable[cond] = types.BoolType
+	insertBefore(mir.NewInsn(cond, &mir.Binary{op, v.Cond, merged.Cond}, insn.Pos), insn)
+
+	merged.Cond = cond
+	insn.Val = merged
+	s.changed = true
+	return true
+}
+
+func (s *branchSimplifier) simplifyBranch(b *mir.Block, cond string, value bool) {
+	cond = s.resolve(cond)
+	saved, ok := s.known[cond]
+	s.known[cond] = value
+	s.simplifyBlock(b)
+	if ok {
+		s.known[cond] = saved
+	} else {
+		delete(s.known, cond)
+	}
+}
+
+func (s *branchSimplifier) simplifyBlock(b *mir.Block) {
+	for i, end := b.WholeRange(); i != end; i = i.Next {
+		v, ok := i.Val.(*mir.If)
+		if !ok {
+			continue
+		}
+
+		if c, ok := s.boolOf(v.Cond); ok {
+			taken := v.Else
+			if c {
+				taken = v.Then
+			}
+			s.simplifyBlock(taken)
+			last := taken.Bottom.Prev
+			s.splice(b, i, taken)
+			i = last
+			continue
+		}
+
+		s.simplifyBranch(v.Then, v.Cond, true)
+		s.simplifyBranch(v.Else, v.Cond, false)
+
+		if s.equalBlocks(v.Then, v.Else, map[string]string{}) {
+			last := v.Then.Bottom.Prev
+			s.splice(b, i, v.Then)
+			i = last
+			continue
+		}
+
+		for s.collapse(i, v) {
+			v = i.Val.(*mir.If)
+		}
+	}
+}
+
+// SimplifyBranches folds 'if' instructions whose conditions are known and merges branches which
+// are the same.
+func SimplifyBranches(prog *mir.Program, env *types.Env) {
+	s := &branchSimplifier{env, nil, map[string]bool{}, 0, true}
+	for s.changed {
+		s.changed = false
+		s.defs = map[string]mir.Val{}
+		for _, f := range prog.Toplevel {
+			s.collectDefs(f.Val.Body)
+		}
+		s.collectDefs(prog.Entry)
+
+		for _, f := range prog.Toplevel {
+			s.simplifyBlock(f.Val.Body)
+		}
+		s.simplifyBlock(prog.Entry)
+	}
+}
@@ -0,0 +1,129 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestSimplifyBranches(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+		// Number of 'if' instructions remaining after the simplification
+		remains  int
+		contains []string
+	}{
+		{
+			what:     "constant true",
+			code:     "println_int (if true then 1 else 2)",
+			remains:  0,
+			contains: []string{"int 1"},
+		},
+		{
+			what:     "constant false",
+			code:     "println_int (if false then 1 else 2)",
+			remains:  0,
+			contains: []string{"int 2"},
+		},
+		{
+			what:    "negated constant",
+			code:    "println_int (if not true then 1 else 2)",
+			remains: 0,
+		},
+		{
+			what:    "nested constant",
+			code:    "println_int (if true then (if false then 1 else 2) else 3)",
+			remains: 0,
+		},
+		{
+			what:    "unknown condition",
+			code:    "let rec f b = if b then 1 else 2 in println_int (f true)",
+			remains: 1,
+		},
+		{
+			what:    "condition checked by enclosing if",
+			code:    "let rec f b = if b then (if b then 1 else 2) else 3 in println_int (f true)",
+			remains: 1,
+		},
+		{
+			what:    "negated condition checked by enclosing if",
+			code:    "let rec f b = if b then 1 else (if not b then 2 else 3) in println_int (f true)",
+			remains: 1,
+		},
+		{
+			what:    "identical branches",
+			code:    "let rec f b x = if b then x + 1 else x + 1 in println_int (f true 1)",
+			remains: 0,
+		},
+		{
+			what:    "identical nested branches",
+			code:    "let rec f a b x = if a then (if b then x * 2 else x) else (if b then x * 2 else x) in println_int (f true false 1)",
+			remains: 1,
+		},
+		{
+			what:    "different branches",
+			code:    "let rec f b x = if b then x + 1 else x + 2 in println_int (f true 1)",
+			remains: 1,
+		},
+		{
+			what:     "nested if sharing else branch",
+			code:     "let rec f a b = if a then (if b then 1 else 0) else 0 in println_int (f true false)",
+			remains:  1,
+			contains: []string{"binary &&"},
+		},
+		{
+			what:     "nested if sharing then branch",
+			code:     "let rec f a b = if a then 1 else (if b then 1 else 0) in println_int (f true false)",
+			remains:  1,
+			contains: []string{"binary ||"},
+		},
+		{
+			what:     "deeply nested ifs sharing else branch",
+			code:     "let rec f a b c = if a then (if b then (if c then 1 else 0) else 0) else 0 in println_int (f true false true)",
+			remains:  1,
+			contains: []string{"binary &&"},
+		},
+		{
+			what:    "condition of nested if computed in branch",
+			code:    "let rec f a x = if a then (if x > 0 then 1 else 0) else 0 in println_int (f true 1)",
+			remains: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			SimplifyBranches(prog, env)
+			if err := mir.Verify(prog); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			prog.Println(&buf, env)
+			out := buf.String()
+			if n := strings.Count(out, " = if "); n != tc.remains {
+				t.Fatalf("Wanted %d 'if' instructions to remain but got %d: %s", tc.remains, n, out)
+			}
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in program '%s'", expected, out)
+				}
+			}
+		})
+	}
+}
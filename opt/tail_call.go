@@ -0,0 +1,143 @@
+package opt
+
+import (
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/types"
+	"strings"
+)
+
+// Note:
+// Self tail calls are rewritten into loops. A call of the function itself is a tail call when it is
+// the last instruction of the function body, or the last instruction of a branch of 'if' which is in
+// tail position.
+//   f$t1 = fun n$t2,acc$t3 ; (* toplevel *)
+//     ...
+//     $k9 = if $k4
+//       BEGIN: then
+//       $k5 = ref acc$t3
+//       END: then
+//       BEGIN: else
+//       ...
+//       $k8 = app f$t1 $k6,$k7
+//       END: else
+// The tail call is converted into
+//       $k8 = jump $k6,$k7
+// which updates the parameters with its arguments and jumps to the beginning of the function body
+// in codegen. So the stack does not grow even if the function recurses deeply and the optimization
+// does not depend on tail call elimination of LLVM.
+
+// visitTailCalls calls the function with each call instruction in tail position of the block.
+func visitTailCalls(b *mir.Block, visit func(*mir.Insn, *mir.App)) {
+	last := b.Bottom.Prev
+	switch v := last.Val.(type) {
+	case *mir.App:
+		visit(last, v)
+	case *mir.If:
+		visitTailCalls(v.Then, visit)
+		visitTailCalls(v.Else, visit)
+	}
+}
+
+// OptimizeTailCalls rewrites self-recursive tail calls in toplevel functions into 'jump' instructions.
+// It must be applied after closure transform.
+func OptimizeTailCalls(prog *mir.Program) {
+	for name, f := range prog.Toplevel {
+		visitTailCalls(f.Val.Body, func(insn *mir.Insn, app *mir.App) {
+			if app.Callee == name && app.Kind != mir.EXTERNAL_CALL {
+				insn.Val = &mir.Jump{app.Args}
+			}
+		})
+	}
+}
+
+// Note:
+// Other calls in tail position are marked as tail calls in codegen. But they are not guaranteed to be
+// compiled into jumps when the signature of the callee differs from the caller's one because the
+// callee may need more space for its arguments than the caller. A closure takes a pointer to its
+// captures as a hidden first parameter so it is also a part of the signature.
+
+type signature struct {
+	closure bool
+	params  []types.Type
+}
+
+func (s signature) String() string {
+	ss := make([]string, 0, len(s.params)+1)
+	if s.closure {
+		ss = append(ss, "captures")
+	}
+	for _, p := range s.params {
+		ss = append(ss, p.String())
+	}
+	return "(" + strings.Join(ss, ", ") + ")"
+}
+
+func (s signature) equals(other signature) bool {
+	if s.closure != other.closure || len(s.params) != len(other.params) {
+		return false
+	}
+	for i, p := range s.params {
+		if !types.Equals(p, other.params[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func paramsOf(t types.Type) []types.Type {
+	if f, ok := t.(*types.Fun); ok {
+		return f.Params
+	}
+	panic("FATAL: Type of function is not a function type")
+}
+
+func calleeSignature(app *mir.App, prog *mir.Program, env *types.Env) signature {
+	switch app.Kind {
+	case mir.EXTERNAL_CALL:
+		ext, ok := env.Externals[app.Callee]
+		if !ok {
+			panic("FATAL: Unknown external function: " + app.Callee)
+		}
+		return signature{false, paramsOf(ext.Type)}
+	case mir.CLOSURE_CALL:
+		return signature{true, paramsOf(env.DeclTable[app.Callee])}
+	default:
+		_, closure := prog.Closures[app.Callee]
+		return signature{closure, paramsOf(env.DeclTable[app.Callee])}
+	}
+}
+
+// displayName returns the name of identifier in source. Identifiers introduced by compiler are
+// returned as-is.
+func displayName(ident string) string {
+	if i := strings.IndexByte(ident, '$'); i > 0 {
+		return ident[:i]
+	}
+	return ident
+}
+
+func describeCallee(ident string) string {
+	if strings.HasPrefix(ident, "$") {
+		// Callee is a result of some expression
+		return "function value"
+	}
+	return "'" + displayName(ident) + "'"
+}
+
+// DiagnoseTailCalls reports calls in tail position which are not guaranteed to be tail calls as
+// warnings. It must be applied after OptimizeTailCalls.
+func DiagnoseTailCalls(prog *mir.Program, env *types.Env, ws *sema.Warnings) {
+	for name, f := range prog.Toplevel {
+		_, closure := prog.Closures[name]
+		caller := signature{closure, paramsOf(env.DeclTable[name])}
+		visitTailCalls(f.Val.Body, func(insn *mir.Insn, app *mir.App) {
+			callee := calleeSignature(app, prog, env)
+			if callee.equals(caller) {
+				return
+			}
+			w := ws.Warnf(sema.WarnTailCall, sema.SeverityWarning, insn.Pos, insn.Pos, "Call of %s in tail position is not guaranteed to be a tail call because its signature %s differs from the signature %s of the caller '%s'", describeCallee(app.Callee), callee.String(), caller.String(), displayName(name))
+			w.NotefAt(f.Pos, "Caller '%s' is defined here", displayName(name))
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package opt
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/closure"
+	"github.com/rhysd/gocaml/sema"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestOptimizeTailCalls(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		contains []string
+		excludes []string
+	}{
+		{
+			what:     "tail call in else branch",
+			code:     "let rec sum n acc = if n = 0 then acc else sum (n - 1) (acc + n) in sum 10 0",
+			contains: []string{"jump $k"},
+			excludes: []string{"app sum$t1"},
+		},
+		{
+			what:     "tail calls in both branches",
+			code:     "let rec f n = if n < 0 then f (n + 1) else if n > 0 then f (n - 1) else 0 in f 10",
+			excludes: []string{"app f$t1"},
+		},
+		{
+			what:     "non-tail call",
+			code:     "let rec fact n = if n = 0 then 1 else n * fact (n - 1) in fact 10",
+			contains: []string{"app fact$t1"},
+			excludes: []string{"jump"},
+		},
+		{
+			what:     "tail call of closure",
+			code:     "let x = 1 in let rec f n = if n = 0 then x else f (n - 1) in f 10",
+			contains: []string{"jump $k"},
+			excludes: []string{"appcls f$t2 $k"},
+		},
+		{
+			what:     "call of other function",
+			code:     "let rec g n = n in let rec f n = g n in f 10",
+			contains: []string{"app g$t1"},
+			excludes: []string{"jump"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			OptimizeTailCalls(prog)
+
+			var buf bytes.Buffer
+			prog.PrintToplevels(&buf, env)
+			out := buf.String()
+			for _, expected := range tc.contains {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected '%s' to be contained in toplevel '%s'", expected, out)
+				}
+			}
+			for _, unexpected := range tc.excludes {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected '%s' not to be contained in toplevel '%s'", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnoseTailCalls(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{
+			what:     "same signature",
+			code:     "let rec g n = n + 1 in let rec f n = g n in f 10",
+			expected: []string{},
+		},
+		{
+			what: "different parameters",
+			code: "let rec g a b = a + b in let rec f n = g n n in f 10",
+			expected: []string{
+				"Call of 'g' in tail position is not guaranteed to be a tail call because its signature (int, int) differs from the signature (int) of the caller 'f'",
+			},
+		},
+		{
+			what: "closure call",
+			code: "let rec f n = (let rec h m = m + 1 in h) n in f 10",
+			expected: []string{
+				"Call of function value in tail position is not guaranteed to be a tail call because its signature (captures, int) differs from the signature (int) of the caller 'f'",
+			},
+		},
+		{
+			what:     "self tail call",
+			code:     "let rec f n = if n = 0 then 0 else f (n - 1) in f 10",
+			expected: []string{},
+		},
+		{
+			what:     "non-tail call",
+			code:     "let rec g a b = a + b in let rec f n = (g n n) + 1 in f 10",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			ast, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, ir, err := sema.SemanticsCheck(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog := closure.Transform(ir)
+			OptimizeTailCalls(prog)
+			ws := sema.NewWarnings()
+			DiagnoseTailCalls(prog, env, ws)
+
+			reported := ws.List()
+			if len(reported) != len(tc.expected) {
+				t.Fatalf("Expected %d warnings but got %d: %v", len(tc.expected), len(reported), reported)
+			}
+			for i, w := range reported {
+				if w.Code != sema.WarnTailCall {
+					t.Errorf("Unexpected warning code %s", w.Code.String())
+				}
+				if !strings.Contains(w.Message, tc.expected[i]) {
+					t.Errorf("Expected message '%s' to contain '%s'", w.Message, tc.expected[i])
+				}
+			}
+		})
+	}
+}
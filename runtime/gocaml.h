@@ -1,8 +1,37 @@
 #if !defined GOCAML_H_INCLUDED
 #define      GOCAML_H_INCLUDED
 
+#include <stddef.h>
 #include <stdint.h>
 
+// C ABI of GoCaml values
+//
+// Values are passed to and returned from C functions following the C calling convention of the
+// target with these representations. Options, variants and results have no stable representation
+// and cannot cross the boundary.
+//
+//   unit:      gocaml_unit (empty struct)
+//   bool:      gocaml_bool. Fields of tuples and elements of arrays are one byte (uint8_t)
+//   int:       gocaml_int
+//   float:     gocaml_float
+//   string:    gocaml_string
+//   'a array:  gocaml_array. 'buf' points to elements
+//   tuple:     Pointer to a struct whose fields are elements of the tuple in order
+//   function:  gocaml_closure
+//   table:     void *. Opaque pointer to a hash table managed by the runtime
+//   buffer:    void *. Opaque pointer to a byte buffer managed by the runtime
+//   json:      void *. Opaque pointer to an immutable JSON value managed by the runtime
+//
+// 'gocaml -emit h' generates declarations of external symbols of the program with these types.
+//
+// C functions should allocate memory for GoCaml values with gocaml_alloc() or gocaml_alloc_atomic()
+// instead of GC_malloc() so that they work with any garbage collector selected by '-gc'. The
+// built-in GC ('-gc builtin') only scans GoCaml's stack frames, objects on its heap and roots
+// registered with gocaml_gc_add_root(). A heap pointer held only by a local variable of C function
+// may be collected when the function allocates memory again. With reference counting ('-gc rc'), C
+// functions must call gocaml_retain() after storing a heap pointer to an object on GC heap and
+// gocaml_release() after overwriting it.
+
 typedef int64_t gocaml_int;
 typedef int gocaml_bool;
 typedef double gocaml_float;
@@ -13,10 +42,47 @@ typedef struct {
 } gocaml_array;
 
 typedef struct {
-    int8_t *chars; // Null-terminated string
+    int8_t *chars; // Not null-terminated. It may contain '\0'
     gocaml_int size;
 } gocaml_string;
 
 typedef struct {} gocaml_unit;
 
+typedef void (*gocaml_fun)(void);
+
+// Closure is a pair of function pointer and environment. The function follows the C calling
+// convention and takes the environment as its first parameter followed by the parameters of the
+// closure. e.g. 'int -> bool -> float' is called as:
+//
+//   typedef gocaml_float (*fun_t)(void *, gocaml_int, gocaml_bool);
+//   gocaml_float ret = ((fun_t) c.fun)(c.env, 42, 1);
+typedef struct {
+    gocaml_fun fun;
+    void *env;
+} gocaml_closure;
+
+// Layout of an object on GC heap. An object is an array of 'count' elements (see gocaml_alloc())
+// and each element has heap pointers at 'offsets'. A tuple is an object of one element.
+typedef struct {
+    size_t size;           // Size of an element in bytes
+    size_t num_pointers;   // Number of heap pointers in an element
+    size_t const* offsets; // Byte offsets of the heap pointers in an element
+} gocaml_layout;
+
+// Layout of an array of strings
+extern gocaml_layout const gocaml_string_layout;
+
+// Allocate zero-initialized memory for 'count' elements of the layout on GC heap.
+void *gocaml_alloc(gocaml_layout const* layout, size_t count);
+// Allocate zero-initialized memory which never contains heap pointers (e.g. characters of string).
+void *gocaml_alloc_atomic(size_t size);
+// Register a location outside GC heap (e.g. a global variable) which holds a heap pointer.
+void gocaml_gc_add_root(void **root);
+// Count a reference to the object from an object on GC heap. It does nothing unless reference
+// counting is selected.
+void gocaml_retain(void *ptr);
+// Drop a reference counted by gocaml_retain(). It does nothing unless reference counting is
+// selected.
+void gocaml_release(void *ptr);
+
 #endif    // GOCAML_H_INCLUDED
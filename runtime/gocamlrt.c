@@ -1,30 +1,33 @@
+// For clock_gettime()
+#define _POSIX_C_SOURCE 200809L
+
 #include <stdio.h>
 #include <inttypes.h>
 #include <stdlib.h>
 #include <string.h>
 #include <time.h>
 #include <math.h>
+#include <sys/resource.h>
 #include <gc.h>
 #include "gocaml.h"
 
 #define SNPRINTF_MAX 128
 #define LINE_MAX 1024
 #define BUF_CHUNK 1024
+#define STACK_MARGIN (256 * 1024)
 
 // Note:
-// Need to guard with this 'if' statement because when the string is allocated as global
-// constant variable, we can't modify it. And we does not need to modify global constant
-// string because it is always NUL-terminated.
-#define GOCAML_STRING_ENSURE_NULL(x) \
-    char const backup_null_char_ ## x = (x).chars[(x).size]; \
-    if ((x).chars[(x).size] != '\0') { \
-        (x).chars[(x).size] = '\0'; \
-    }
-
-#define GOCAML_STRING_RESTORE_NULL(x) \
-    if ((x).chars[(x).size] != '\0') { \
-        (x).chars[(x).size] = backup_null_char_ ## x; \
-    }
+// Strings are pairs of pointer to characters and length. Characters are not NUL-terminated and
+// may contain NUL. Substrings share characters with their original strings. Functions must not
+// rely on NUL and must not modify characters. When a C string is necessary, copy it with
+// to_c_str().
+static char *to_c_str(gocaml_string const s)
+{
+    char *const cstr = (char *) gocaml_alloc_atomic((size_t) s.size + 1);
+    memcpy(cstr, s.chars, (size_t) s.size);
+    cstr[s.size] = '\0';
+    return cstr;
+}
 
 extern int __gocaml_main();
 
@@ -54,9 +57,761 @@ typedef struct {
     gocaml_float snd;
 } if_pair_t;
 
-int main(int const argc, char const* const argv_[]) {
-    GC_init();
-    gocaml_string *ptr = (gocaml_string *) GC_malloc(argc * sizeof(gocaml_string *));
+// Lowest address of the stack which generated code can use. Functions which call other functions
+// compare their frame address with it at entry and call __gocaml_stack_overflow() when it is
+// exceeded (see buildStackCheck() in codegen/block_builder.go). Nothing is checked while it is NULL.
+char const* __gocaml_stack_limit = NULL;
+
+// Stack grows downward from the caller of __gocaml_init() up to the size limit of stack. Some
+// margin is left for C functions and the failure report.
+static void init_stack_limit(void)
+{
+    struct rlimit rl;
+    if (getrlimit(RLIMIT_STACK, &rl) != 0 || rl.rlim_cur == RLIM_INFINITY || rl.rlim_cur <= 2 * STACK_MARGIN) {
+        return;
+    }
+    uintptr_t const base = (uintptr_t) __builtin_frame_address(0);
+    uintptr_t const size = (uintptr_t) rl.rlim_cur - STACK_MARGIN;
+    if (base <= size) {
+        return;
+    }
+    __gocaml_stack_limit = (char const*) (base - size);
+}
+
+// Note:
+// Garbage collectors
+//
+// Generated code allocates all objects with gocaml_alloc() passing layouts emitted by codegen (see
+// codegen/gc.go) and defines __gocaml_gc to select one of the collectors:
+//
+//   GC_KIND_BOEHM:   Boehm GC collects garbage conservatively. gocaml_alloc() is a thin wrapper of
+//                    GC_malloc() (default)
+//   GC_KIND_BUILTIN: The precise mark-sweep collector described below
+//   GC_KIND_NONE:    No collection. Objects are allocated from arenas which are never freed. It is
+//                    the fastest for short-running programs whose memory usage is bounded
+//   GC_KIND_RC:      Reference counting on the heap of the built-in collector described below
+//
+// The built-in collector manages a heap which consists of pages allocated by malloc(). Small
+// objects are allocated from 64KiB pages divided into slots of the same size class. Each slot
+// starts with a header which holds the layout of the object, the number of its elements and its
+// reference count. A large object occupies a page on its own. Pages are sorted by their addresses
+// so that a pointer to any byte of an object (e.g. characters of substring) is resolved to the
+// object.
+//
+// Collection is mark-sweep and objects are never moved. Roots are the slots in stack frames of
+// generated code, which LLVM links into 'llvm_gc_root_chain' ('shadow-stack' GC strategy), and
+// locations registered with gocaml_gc_add_root(). Pointers which do not point to GC heap (string
+// literals, objects on stack or memory allocated by C) are ignored.
+//
+// Collection runs when allocated bytes exceed the threshold. After collection, the threshold is
+// set to the live bytes grown by the percentage. Environment variables tune the heap:
+//
+//   GOCAML_GC_INITIAL_HEAP: Initial threshold in bytes. 'K', 'M' and 'G' suffixes are available (default: 4M)
+//   GOCAML_GC_MAX_HEAP:     Abort with 'Out of memory' when live bytes exceed it (default: 0, unlimited)
+//   GOCAML_GC_GROWTH:       Percentage by which the threshold grows from the live bytes (default: 100)
+//
+// GOCAML_GC_MAX_HEAP also limits the total size of arenas with GC_KIND_NONE.
+//
+// With GC_KIND_RC, generated code calls gocaml_retain() for each heap pointer stored to an object
+// and gocaml_release() for each heap pointer overwritten in an object. Objects freed by counting
+// release the pointers in them. References from the shadow stack and registered roots are not
+// counted (deferred reference counting). An object whose count becomes zero is put into the zero
+// count table (ZCT). When the table is full or the heap exceeds the threshold, objects in the table
+// which no root points to are freed. It bounds pauses by the size of the table and the depth of
+// the stack. Cycles are never freed by counting. The mark-sweep collector frees them and recounts
+// references of live objects when it runs:
+//
+//   GOCAML_RC_CYCLES: 1 to run the mark-sweep collector when the heap still exceeds the threshold
+//                     after freeing objects in the ZCT (default: 0)
+//
+// do_garbage_collection() always runs the mark-sweep collector.
+
+// Values of __gocaml_gc. They must be the same as codegen.GCKind
+#define GC_KIND_BOEHM 0
+#define GC_KIND_BUILTIN 1
+#define GC_KIND_NONE 2
+#define GC_KIND_RC 3
+
+#define GC_PAGE_SIZE ((size_t) 64 * 1024)
+#define GC_MARK_BIT ((uintptr_t) 1)
+#define GC_ZCT_BIT ((uintptr_t) 2)
+#define GC_FLAG_BITS (GC_MARK_BIT | GC_ZCT_BIT)
+#define GC_NUM_CLASSES 15
+#define GC_LARGE_CLASS GC_NUM_CLASSES
+#define ARENA_CHUNK_SIZE ((size_t) 1024 * 1024)
+#define RC_ZCT_LIMIT 4096
+
+// Overridden by generated code. Boehm GC is used by C programs (e.g. compiled with -emit-c)
+__attribute__((weak)) int __gocaml_gc = GC_KIND_BOEHM;
+
+// Frames of shadow stack maintained by LLVM. Please see llvm/lib/CodeGen/ShadowStackGCLowering.cpp
+typedef struct {
+    int32_t num_roots;
+    int32_t num_meta;
+    void const* meta[];
+} gc_frame_map;
+
+typedef struct gc_stack_entry {
+    struct gc_stack_entry *next;
+    gc_frame_map const* map;
+    void *roots[];
+} gc_stack_entry;
+
+// Defined by generated code only when the built-in GC or reference counting is selected
+extern gc_stack_entry *llvm_gc_root_chain __attribute__((weak));
+
+typedef struct {
+    // Address of gocaml_layout with GC_FLAG_BITS. 0 means a free slot
+    uintptr_t layout;
+    size_t count;
+    // References from other objects. Only used with GC_KIND_RC
+    size_t refs;
+} gc_header;
+
+typedef struct {
+    size_t size; // Size of the page in bytes including this header
+    size_t slot_size;
+    size_t num_slots;
+    int size_class;
+    char *slots;
+} gc_page;
+
+#define GC_PAGE_HEADER ((sizeof(gc_page) + 15) & ~(size_t) 15)
+
+// Sizes of slots including headers
+static size_t const gc_class_sizes[GC_NUM_CLASSES] = {
+    32, 48, 64, 96, 128, 192, 256, 384, 512, 768, 1024, 1536, 2048, 4096, 8192,
+};
+
+static struct {
+    gc_page **pages; // Sorted by address
+    size_t num_pages;
+    size_t cap_pages;
+    uintptr_t lowest;
+    uintptr_t highest;
+    gc_header *free_lists[GC_NUM_CLASSES];
+    gc_header **mark_stack;
+    size_t mark_top;
+    size_t mark_cap;
+    void ***roots;
+    size_t num_roots;
+    size_t cap_roots;
+    size_t allocated;
+    size_t threshold;
+    size_t initial_heap;
+    size_t max_heap;
+    size_t growth;
+    int disabled;
+} gc;
+
+// Zero count table of GC_KIND_RC. Objects in it have GC_ZCT_BIT
+static struct {
+    gc_header **entries;
+    size_t size;
+    size_t cap;
+    int collect_cycles;
+} zct;
+
+static size_t const string_offsets[] = {offsetof(gocaml_string, chars)};
+gocaml_layout const gocaml_string_layout = {sizeof(gocaml_string), 1, string_offsets};
+static gocaml_layout const bytes_layout = {1, 0, NULL};
+
+static void gc_out_of_memory(void)
+{
+    fflush(stdout);
+    fputs("Out of memory\n", stderr);
+    abort();
+}
+
+static void *gc_grow(void *ptr, size_t *cap, size_t elem_size)
+{
+    size_t const new_cap = *cap == 0 ? 64 : *cap * 2;
+    void *const grown = realloc(ptr, new_cap * elem_size);
+    if (grown == NULL) {
+        gc_out_of_memory();
+    }
+    *cap = new_cap;
+    return grown;
+}
+
+static size_t gc_env_size(char const* const name, size_t const default_size)
+{
+    char const* const s = getenv(name);
+    if (s == NULL || s[0] == '\0') {
+        return default_size;
+    }
+    char *end;
+    unsigned long long n = strtoull(s, &end, 10);
+    switch (*end) {
+    case 'k': case 'K':
+        n <<= 10;
+        end++;
+        break;
+    case 'm': case 'M':
+        n <<= 20;
+        end++;
+        break;
+    case 'g': case 'G':
+        n <<= 30;
+        end++;
+        break;
+    default:
+        break;
+    }
+    if (end == s || *end != '\0') {
+        fprintf(stderr, "Ignored invalid value of %s: '%s'\n", name, s);
+        return default_size;
+    }
+    return (size_t) n;
+}
+
+static void gc_init(void)
+{
+    gc.initial_heap = gc_env_size("GOCAML_GC_INITIAL_HEAP", 4 * 1024 * 1024);
+    gc.max_heap = gc_env_size("GOCAML_GC_MAX_HEAP", 0);
+    gc.growth = gc_env_size("GOCAML_GC_GROWTH", 100);
+    gc.threshold = gc.initial_heap;
+    zct.collect_cycles = gc_env_size("GOCAML_RC_CYCLES", 0) != 0;
+}
+
+static gocaml_layout const* gc_layout_of(gc_header const* const h)
+{
+    return (gocaml_layout const*) (h->layout & ~GC_FLAG_BITS);
+}
+
+// Current chunk of arena for GC_KIND_NONE
+static struct {
+    char *next;
+    char *end;
+    size_t allocated;
+} arena;
+
+static void *arena_alloc(size_t const size)
+{
+    if (size > SIZE_MAX - 15) {
+        gc_out_of_memory();
+    }
+    size_t const aligned = size == 0 ? 16 : (size + 15) & ~(size_t) 15;
+    if (gc.max_heap != 0 && gc.max_heap - arena.allocated < aligned) {
+        gc_out_of_memory();
+    }
+    arena.allocated += aligned;
+
+    if (aligned > ARENA_CHUNK_SIZE / 4) {
+        // Large object does not waste the rest of current chunk
+        void *const ptr = calloc(1, aligned);
+        if (ptr == NULL) {
+            gc_out_of_memory();
+        }
+        return ptr;
+    }
+    if ((size_t) (arena.end - arena.next) < aligned) {
+        arena.next = (char *) calloc(1, ARENA_CHUNK_SIZE);
+        if (arena.next == NULL) {
+            gc_out_of_memory();
+        }
+        arena.end = arena.next + ARENA_CHUNK_SIZE;
+    }
+    void *const ptr = arena.next;
+    arena.next += aligned;
+    return ptr;
+}
+
+static void gc_add_page(gc_page *const page)
+{
+    if (gc.num_pages == gc.cap_pages) {
+        gc.pages = (gc_page **) gc_grow(gc.pages, &gc.cap_pages, sizeof(gc_page *));
+    }
+    size_t i = gc.num_pages;
+    while (i > 0 && (uintptr_t) page < (uintptr_t) gc.pages[i - 1]) {
+        gc.pages[i] = gc.pages[i - 1];
+        i--;
+    }
+    gc.pages[i] = page;
+    gc.num_pages++;
+    gc.lowest = (uintptr_t) gc.pages[0];
+    gc_page const* const last = gc.pages[gc.num_pages - 1];
+    gc.highest = (uintptr_t) last + last->size;
+}
+
+static gc_page *gc_new_page(size_t const size, size_t const slot_size, int const size_class)
+{
+    gc_page *const page = (gc_page *) calloc(1, size);
+    if (page == NULL) {
+        gc_out_of_memory();
+    }
+    page->size = size;
+    page->slot_size = slot_size;
+    page->num_slots = (size - GC_PAGE_HEADER) / slot_size;
+    page->size_class = size_class;
+    page->slots = (char *) page + GC_PAGE_HEADER;
+    gc_add_page(page);
+    return page;
+}
+
+// Thread all slots of the new page into the free list of its size class
+static void gc_fill_free_list(int const size_class)
+{
+    size_t const slot_size = gc_class_sizes[size_class];
+    gc_page *const page = gc_new_page(GC_PAGE_SIZE, slot_size, size_class);
+    for (size_t i = page->num_slots; i > 0; --i) {
+        gc_header *const h = (gc_header *) (page->slots + (i - 1) * slot_size);
+        *(gc_header **) (h + 1) = gc.free_lists[size_class];
+        gc.free_lists[size_class] = h;
+    }
+}
+
+// Find the index of the page which contains the address. It returns gc.num_pages when the address
+// is not in any page.
+static size_t gc_find_page(uintptr_t const addr)
+{
+    if (addr < gc.lowest || gc.highest <= addr) {
+        return gc.num_pages;
+    }
+    size_t lo = 0, hi = gc.num_pages;
+    while (lo < hi) {
+        size_t const mid = lo + (hi - lo) / 2;
+        if ((uintptr_t) gc.pages[mid] <= addr) {
+            lo = mid + 1;
+        } else {
+            hi = mid;
+        }
+    }
+    if (lo == 0 || (uintptr_t) gc.pages[lo - 1] + gc.pages[lo - 1]->size <= addr) {
+        return gc.num_pages;
+    }
+    return lo - 1;
+}
+
+// Find the header of the live object which contains the address. It returns NULL when the address
+// is not in GC heap.
+static gc_header *gc_find(void const* const ptr)
+{
+    uintptr_t const addr = (uintptr_t) ptr;
+    size_t const i = gc_find_page(addr);
+    if (i == gc.num_pages) {
+        return NULL;
+    }
+    gc_page const* const page = gc.pages[i];
+    uintptr_t const slots = (uintptr_t) page->slots;
+    if (addr < slots) {
+        return NULL;
+    }
+    size_t const idx = (addr - slots) / page->slot_size;
+    if (idx >= page->num_slots) {
+        return NULL;
+    }
+    gc_header *const h = (gc_header *) (page->slots + idx * page->slot_size);
+    if (h->layout == 0) {
+        return NULL;
+    }
+    return h;
+}
+
+static void gc_mark(void const* const ptr)
+{
+    gc_header *const h = gc_find(ptr);
+    if (h == NULL || (h->layout & GC_MARK_BIT) != 0) {
+        return;
+    }
+    h->layout |= GC_MARK_BIT;
+    if (gc_layout_of(h)->num_pointers == 0) {
+        return;
+    }
+    if (gc.mark_top == gc.mark_cap) {
+        gc.mark_stack = (gc_header **) gc_grow(gc.mark_stack, &gc.mark_cap, sizeof(gc_header *));
+    }
+    gc.mark_stack[gc.mark_top++] = h;
+}
+
+// Call the function for each heap pointer in the object
+static void gc_each_pointer(gc_header const* const h, void (*f)(void const*))
+{
+    gocaml_layout const* const layout = gc_layout_of(h);
+    char const* elem = (char const*) (h + 1);
+    for (size_t i = 0; i < h->count; ++i) {
+        for (size_t j = 0; j < layout->num_pointers; ++j) {
+            void *ptr;
+            memcpy(&ptr, elem + layout->offsets[j], sizeof(ptr));
+            f(ptr);
+        }
+        elem += layout->size;
+    }
+}
+
+static void gc_scan(gc_header const* const h)
+{
+    gc_each_pointer(h, gc_mark);
+}
+
+// Call the function for each root in the shadow stack and registered roots
+static void gc_each_root(void (*f)(void const*))
+{
+    if (&llvm_gc_root_chain != NULL) {
+        for (gc_stack_entry const* e = llvm_gc_root_chain; e != NULL; e = e->next) {
+            for (int32_t i = 0; i < e->map->num_roots; ++i) {
+                f(e->roots[i]);
+            }
+        }
+    }
+    for (size_t i = 0; i < gc.num_roots; ++i) {
+        f(*gc.roots[i]);
+    }
+}
+
+// Free unmarked objects and clear marks. Pages which have no live object are released.
+static void gc_sweep(void)
+{
+    for (int c = 0; c < GC_NUM_CLASSES; ++c) {
+        gc.free_lists[c] = NULL;
+    }
+    gc.allocated = 0;
+
+    size_t kept = 0;
+    for (size_t i = 0; i < gc.num_pages; ++i) {
+        gc_page *const page = gc.pages[i];
+        gc_header *free_head = NULL;
+        gc_header *free_tail = NULL;
+        size_t live = 0;
+        for (size_t j = 0; j < page->num_slots; ++j) {
+            gc_header *const h = (gc_header *) (page->slots + j * page->slot_size);
+            if ((h->layout & GC_MARK_BIT) != 0) {
+                h->layout &= ~GC_MARK_BIT;
+                live++;
+                continue;
+            }
+            h->layout = 0;
+            h->count = 0;
+            *(gc_header **) (h + 1) = free_head;
+            free_head = h;
+            if (free_tail == NULL) {
+                free_tail = h;
+            }
+        }
+        if (live == 0) {
+            free(page);
+            continue;
+        }
+        if (free_tail != NULL) {
+            *(gc_header **) (free_tail + 1) = gc.free_lists[page->size_class];
+            gc.free_lists[page->size_class] = free_head;
+        }
+        // Size of a large object includes the page header as counted on allocation
+        gc.allocated += page->size_class == GC_LARGE_CLASS ? page->size : live * page->slot_size;
+        gc.pages[kept++] = page;
+    }
+    gc.num_pages = kept;
+
+    if (kept == 0) {
+        gc.lowest = gc.highest = 0;
+        return;
+    }
+    gc.lowest = (uintptr_t) gc.pages[0];
+    gc_page const* const last = gc.pages[kept - 1];
+    gc.highest = (uintptr_t) last + last->size;
+}
+
+static void gc_update_threshold(void)
+{
+    size_t const next = gc.allocated + gc.allocated / 100 * gc.growth;
+    gc.threshold = next < gc.initial_heap ? gc.initial_heap : next;
+}
+
+static void rc_recount(void);
+
+static void gc_collect(void)
+{
+    gc_each_root(gc_mark);
+    while (gc.mark_top > 0) {
+        gc_scan(gc.mark_stack[--gc.mark_top]);
+    }
+    gc_sweep();
+    if (__gocaml_gc == GC_KIND_RC) {
+        rc_recount();
+    }
+    gc_update_threshold();
+}
+
+static void rc_defer(gc_header *const h)
+{
+    if ((h->layout & GC_ZCT_BIT) != 0) {
+        return;
+    }
+    h->layout |= GC_ZCT_BIT;
+    if (zct.size == zct.cap) {
+        zct.entries = (gc_header **) gc_grow(zct.entries, &zct.cap, sizeof(gc_header *));
+    }
+    zct.entries[zct.size++] = h;
+}
+
+static void rc_retain(void const* const ptr)
+{
+    gc_header *const h = gc_find(ptr);
+    if (h != NULL) {
+        h->refs++;
+    }
+}
+
+static void rc_release(void const* const ptr)
+{
+    gc_header *const h = gc_find(ptr);
+    if (h == NULL || h->refs == 0) {
+        return;
+    }
+    h->refs--;
+    if (h->refs == 0) {
+        rc_defer(h);
+    }
+}
+
+static void rc_mark_root(void const* const ptr)
+{
+    gc_header *const h = gc_find(ptr);
+    if (h != NULL) {
+        h->layout |= GC_MARK_BIT;
+    }
+}
+
+static void rc_unmark_root(void const* const ptr)
+{
+    gc_header *const h = gc_find(ptr);
+    if (h != NULL) {
+        h->layout &= ~GC_MARK_BIT;
+    }
+}
+
+// Release pointers in the object and return its slot to the free list. A large object releases its
+// page.
+static void rc_free(gc_header *const h)
+{
+    gc_each_pointer(h, rc_release);
+
+    size_t const i = gc_find_page((uintptr_t) h);
+    gc_page *const page = gc.pages[i];
+    if (page->size_class != GC_LARGE_CLASS) {
+        gc.allocated -= page->slot_size;
+        h->layout = 0;
+        h->count = 0;
+        *(gc_header **) (h + 1) = gc.free_lists[page->size_class];
+        gc.free_lists[page->size_class] = h;
+        return;
+    }
+
+    gc.allocated -= page->size;
+    memmove(&gc.pages[i], &gc.pages[i + 1], (gc.num_pages - i - 1) * sizeof(gc_page *));
+    gc.num_pages--;
+    free(page);
+    if (gc.num_pages == 0) {
+        gc.lowest = gc.highest = 0;
+        return;
+    }
+    gc.lowest = (uintptr_t) gc.pages[0];
+    gc_page const* const last = gc.pages[gc.num_pages - 1];
+    gc.highest = (uintptr_t) last + last->size;
+}
+
+// Free objects in the ZCT which no root points to. Objects whose counts become zero by the frees
+// are appended to the table and processed in the same loop.
+static void rc_reconcile(void)
+{
+    gc_each_root(rc_mark_root);
+    size_t kept = 0;
+    for (size_t i = 0; i < zct.size; ++i) {
+        gc_header *const h = zct.entries[i];
+        if (h->refs != 0) {
+            h->layout &= ~GC_ZCT_BIT;
+        } else if ((h->layout & GC_MARK_BIT) != 0) {
+            zct.entries[kept++] = h;
+        } else {
+            rc_free(h);
+        }
+    }
+    zct.size = kept;
+    gc_each_root(rc_unmark_root);
+}
+
+// Recount references between live objects after the mark-sweep collector freed cycles. Objects
+// which only roots point to are put into the ZCT again.
+static void rc_recount(void)
+{
+    zct.size = 0;
+    for (size_t i = 0; i < gc.num_pages; ++i) {
+        gc_page const* const page = gc.pages[i];
+        for (size_t j = 0; j < page->num_slots; ++j) {
+            gc_header *const h = (gc_header *) (page->slots + j * page->slot_size);
+            h->refs = 0;
+            h->layout &= ~GC_ZCT_BIT;
+        }
+    }
+    for (size_t i = 0; i < gc.num_pages; ++i) {
+        gc_page const* const page = gc.pages[i];
+        for (size_t j = 0; j < page->num_slots; ++j) {
+            gc_header const* const h = (gc_header const*) (page->slots + j * page->slot_size);
+            if (h->layout != 0) {
+                gc_each_pointer(h, rc_retain);
+            }
+        }
+    }
+    for (size_t i = 0; i < gc.num_pages; ++i) {
+        gc_page const* const page = gc.pages[i];
+        for (size_t j = 0; j < page->num_slots; ++j) {
+            gc_header *const h = (gc_header *) (page->slots + j * page->slot_size);
+            if (h->layout != 0 && h->refs == 0) {
+                rc_defer(h);
+            }
+        }
+    }
+}
+
+static int gc_exceeds(size_t const needed)
+{
+    return gc.threshold < needed || (gc.max_heap != 0 && gc.max_heap < needed);
+}
+
+// Free objects before allocating a slot with reference counting. Cycles are collected only when
+// freeing objects in the ZCT is not enough.
+static void rc_collect(size_t const slot_size)
+{
+    int const exceeded = gc_exceeds(gc.allocated + slot_size);
+    if (zct.size < RC_ZCT_LIMIT && !exceeded) {
+        return;
+    }
+    rc_reconcile();
+    if (!exceeded) {
+        return;
+    }
+    if (zct.collect_cycles && gc_exceeds(gc.allocated + slot_size)) {
+        gc_collect();
+        return;
+    }
+    gc_update_threshold();
+}
+
+void gocaml_retain(void *const ptr)
+{
+    if (__gocaml_gc == GC_KIND_RC) {
+        rc_retain(ptr);
+    }
+}
+
+void gocaml_release(void *const ptr)
+{
+    if (__gocaml_gc == GC_KIND_RC) {
+        rc_release(ptr);
+    }
+}
+
+static void *gc_alloc(gocaml_layout const* const layout, size_t const count)
+{
+    if (layout->size != 0 && count > (SIZE_MAX - GC_PAGE_HEADER - sizeof(gc_header)) / layout->size) {
+        gc_out_of_memory();
+    }
+    size_t const bytes = sizeof(gc_header) + layout->size * count;
+    int size_class = GC_LARGE_CLASS;
+    size_t slot_size = GC_PAGE_HEADER + bytes; // Large object occupies whole page
+    for (int c = 0; c < GC_NUM_CLASSES; ++c) {
+        if (bytes <= gc_class_sizes[c]) {
+            size_class = c;
+            slot_size = gc_class_sizes[c];
+            break;
+        }
+    }
+
+    if (gc.disabled <= 0) {
+        if (__gocaml_gc == GC_KIND_RC) {
+            rc_collect(slot_size);
+        } else if (gc_exceeds(gc.allocated + slot_size)) {
+            gc_collect();
+        }
+    }
+    if (gc.max_heap != 0 && gc.max_heap < gc.allocated + slot_size) {
+        gc_out_of_memory();
+    }
+
+    gc_header *h;
+    if (size_class == GC_LARGE_CLASS) {
+        gc_page *const page = gc_new_page(slot_size, slot_size - GC_PAGE_HEADER, GC_LARGE_CLASS);
+        h = (gc_header *) page->slots;
+    } else {
+        if (gc.free_lists[size_class] == NULL) {
+            gc_fill_free_list(size_class);
+        }
+        h = gc.free_lists[size_class];
+        gc.free_lists[size_class] = *(gc_header **) (h + 1);
+        memset(h, 0, slot_size);
+    }
+    gc.allocated += slot_size;
+    h->layout = (uintptr_t) layout;
+    h->count = count;
+    if (__gocaml_gc == GC_KIND_RC) {
+        // New object is only referenced from stack
+        rc_defer(h);
+    }
+    return h + 1;
+}
+
+void *gocaml_alloc(gocaml_layout const* const layout, size_t const count)
+{
+    switch (__gocaml_gc) {
+    case GC_KIND_BUILTIN:
+    case GC_KIND_RC:
+        return gc_alloc(layout, count);
+    case GC_KIND_NONE:
+        if (layout->size != 0 && count > SIZE_MAX / layout->size) {
+            gc_out_of_memory();
+        }
+        return arena_alloc(layout->size * count);
+    default:
+        break;
+    }
+    size_t size = layout->size * count;
+    if (size == 0) {
+        size = 1; // Allocated memory must be distinguished from null pointer
+    }
+    if (layout->num_pointers != 0) {
+        return GC_malloc(size);
+    }
+    void *const ptr = GC_malloc_atomic(size);
+    if (ptr != NULL) {
+        memset(ptr, 0, size);
+    }
+    return ptr;
+}
+
+void *gocaml_alloc_atomic(size_t const size)
+{
+    return gocaml_alloc(&bytes_layout, size);
+}
+
+void gocaml_gc_add_root(void **const root)
+{
+    switch (__gocaml_gc) {
+    case GC_KIND_BUILTIN:
+    case GC_KIND_RC:
+        break;
+    case GC_KIND_NONE:
+        return; // Nothing is collected
+    default:
+        GC_add_roots(root, root + 1);
+        return;
+    }
+    if (gc.num_roots == gc.cap_roots) {
+        gc.roots = (void ***) gc_grow(gc.roots, &gc.cap_roots, sizeof(void **));
+    }
+    gc.roots[gc.num_roots++] = root;
+}
+
+// Initialize runtime before running __gocaml_main(). It is separated from main() since JIT
+// execution calls it directly instead of main().
+void __gocaml_init(int const argc, char const* const argv_[]) {
+    if (__gocaml_gc == GC_KIND_BOEHM) {
+        GC_init();
+    } else {
+        gc_init();
+    }
+    init_stack_limit();
+    gocaml_gc_add_root((void **) &argv.buf);
+    gocaml_string *ptr = (gocaml_string *) gocaml_alloc(&gocaml_string_layout, (size_t) argc);
     for (int i = 0; i < argc; ++i) {
         gocaml_string s;
         s.chars = (int8_t *) argv_[i];
@@ -65,6 +820,10 @@ int main(int const argc, char const* const argv_[]) {
     }
     argv.buf = ptr;
     argv.size = (int64_t) argc;
+}
+
+int main(int const argc, char const* const argv_[]) {
+    __gocaml_init(argc, argv_);
     return __gocaml_main();
 }
 
@@ -86,7 +845,7 @@ void print_float(gocaml_float const d)
 // Do not expect Nul-terminated string because of string slices
 void print_str(gocaml_string const s)
 {
-    printf("%.*s", (int) s.size, (char *)s.chars);
+    fwrite(s.chars, 1, (size_t) s.size, stdout);
 }
 
 void println_int(gocaml_int const i)
@@ -106,7 +865,8 @@ void println_float(gocaml_float const d)
 
 void println_str(gocaml_string const s)
 {
-    printf("%.*s\n", (int) s.size, (char *)s.chars);
+    fwrite(s.chars, 1, (size_t) s.size, stdout);
+    putchar('\n');
 }
 
 gocaml_int float_to_int(gocaml_float const f)
@@ -129,18 +889,135 @@ gocaml_bool __str_equal(gocaml_string const l, gocaml_string const r)
     if (l.size != r.size) {
         return (gocaml_bool) 0;
     }
-    int const cmp = strncmp((char *)l.chars, (char *)r.chars, (size_t) l.size);
+    int const cmp = memcmp(l.chars, r.chars, (size_t) l.size);
     return (gocaml_bool) cmp == 0;
 }
 
+// Called when the condition of 'assert' expression is false
+void __gocaml_assert_fail(gocaml_string const loc)
+{
+    fflush(stdout);
+    fprintf(stderr, "Assertion failed at %.*s\n", (int) loc.size, (char *)loc.chars);
+    abort();
+}
+
+// Called when an index of array access is out of bounds
+void __gocaml_bounds_fail(gocaml_string const loc, gocaml_int const index, gocaml_int const size)
+{
+    fflush(stdout);
+    fprintf(stderr, "Index out of bounds at %.*s: index is %" PRId64 " but size of array is %" PRId64 "\n", (int) loc.size, (char *)loc.chars, index, size);
+    abort();
+}
+
+// Called when an integer operation overflows in executable compiled with -checked-arith
+void __gocaml_overflow_fail(gocaml_string const loc)
+{
+    fflush(stdout);
+    fprintf(stderr, "Integer overflow at %.*s\n", (int) loc.size, (char *)loc.chars);
+    abort();
+}
+
+// Called when an operation is undefined behavior in executable compiled with -sanitize=undefined
+void __gocaml_undefined_fail(gocaml_string const loc, gocaml_string const what)
+{
+    fflush(stdout);
+    fprintf(stderr, "Undefined behavior at %.*s: %.*s\n", (int) loc.size, (char *)loc.chars, (int) what.size, (char *)what.chars);
+    abort();
+}
+
+// Called when the stack is about to overflow by deep recursion
+void __gocaml_stack_overflow(gocaml_string const loc)
+{
+    fflush(stdout);
+    fprintf(stderr, "Stack overflow at %.*s\n", (int) loc.size, (char *)loc.chars);
+    abort();
+}
+
+// Counters of instrumented executable. Please see codegen/profile.go
+static char const* profile_sites = NULL;
+static int64_t const* profile_counters = NULL;
+static int64_t profile_size = 0;
+
+static void write_profile(void)
+{
+    char const* path = getenv("GOCAML_PROFILE");
+    if (path == NULL || path[0] == '\0') {
+        path = "gocaml.profile";
+    }
+    FILE *const f = fopen(path, "w");
+    if (f == NULL) {
+        fprintf(stderr, "Cannot write profile to '%s'\n", path);
+        return;
+    }
+    char const* site = profile_sites;
+    for (int64_t i = 0; i < profile_size; ++i) {
+        char const* const end = strchr(site, '\n');
+        fprintf(f, "%.*s %" PRId64 "\n", (int) (end - site), site, profile_counters[i]);
+        site = end + 1;
+    }
+    fclose(f);
+}
+
+// Called at the beginning of instrumented executable. Sites are separated by newlines.
+void __gocaml_profile_init(char const* const sites, int64_t const* const counters, int64_t const size)
+{
+    profile_sites = sites;
+    profile_counters = counters;
+    profile_size = size;
+    atexit(write_profile);
+}
+
+// Called by 'exit' built-in function
+void __gocaml_exit(gocaml_int const code)
+{
+    fflush(stdout);
+    exit((int) code);
+}
+
+// Escapes '"', '\\' and control characters as string literal of GoCaml
+gocaml_string __gocaml_str_escape(gocaml_string const s)
+{
+    // Each character is escaped in 4 characters at most
+    char *const ptr = (char *) gocaml_alloc_atomic((size_t) s.size * 4 + 1);
+    size_t len = 0;
+    for (gocaml_int i = 0; i < s.size; i++) {
+        unsigned char const c = (unsigned char) s.chars[i];
+        switch (c) {
+        case '"':
+        case '\\':
+            ptr[len++] = '\\';
+            ptr[len++] = (char) c;
+            break;
+        case '\n':
+            ptr[len++] = '\\';
+            ptr[len++] = 'n';
+            break;
+        case '\t':
+            ptr[len++] = '\\';
+            ptr[len++] = 't';
+            break;
+        default:
+            if (c < 0x20 || c == 0x7f) {
+                len += (size_t) sprintf(ptr + len, "\\x%02x", c);
+            } else {
+                ptr[len++] = (char) c;
+            }
+            break;
+        }
+    }
+    gocaml_string ret;
+    ret.chars = (int8_t *) ptr;
+    ret.size = (gocaml_int) len;
+    return ret;
+}
+
 gocaml_string str_concat(gocaml_string const l, gocaml_string const r)
 {
-    size_t const new_size = l.size + r.size + 1;
-    char *const new_ptr = (char *) GC_malloc(new_size);
+    size_t const new_size = l.size + r.size;
+    char *const new_ptr = (char *) gocaml_alloc_atomic(new_size);
 
-    strncpy(new_ptr, (char *) l.chars, (size_t) l.size);
-    strncpy(new_ptr + l.size, (char *) r.chars, (size_t) r.size);
-    new_ptr[new_size - 1] = '\0';
+    memcpy(new_ptr, l.chars, (size_t) l.size);
+    memcpy(new_ptr + l.size, r.chars, (size_t) r.size);
 
     gocaml_string ret;
     ret.chars = (int8_t *) new_ptr;
@@ -170,7 +1047,9 @@ gocaml_string str_sub(gocaml_string const s, gocaml_int const start, gocaml_int
     }
 
     int64_t new_size = last_idx - start_idx;
-    if (new_size < 0) {
+    if (new_size <= 0) {
+        // Empty substring must not point to the end of string, which may be the next object on heap
+        start_idx = 0;
         new_size = 0;
     }
 
@@ -181,19 +1060,127 @@ gocaml_string str_sub(gocaml_string const s, gocaml_int const start, gocaml_int
     return ret;
 }
 
-gocaml_string int_to_str(gocaml_int const i)
-{
-    char *const s = GC_malloc(SNPRINTF_MAX);
-    int const n = snprintf(s, SNPRINTF_MAX, "%" PRId64, i);
-    gocaml_string ret;
-    ret.chars = (int8_t *) s;
-    ret.size = (int64_t) n;
-    return ret;
-}
+// Functions of String module. Please see types/builtins.go for their names in GoCaml
 
-gocaml_string float_to_str(gocaml_float const f)
+// Index of the first occurrence of 'sub' in 's'. It returns -1 when not found
+gocaml_int str_index(gocaml_string const s, gocaml_string const sub)
 {
-    char *s = GC_malloc(SNPRINTF_MAX);
+    if (sub.size == 0) {
+        return 0;
+    }
+    for (int64_t i = 0; i + sub.size <= s.size; ++i) {
+        if (memcmp(s.chars + i, sub.chars, (size_t) sub.size) == 0) {
+            return i;
+        }
+    }
+    return -1;
+}
+
+// Split 's' into slices separated by 'sep' like Go's strings.Split(). Empty 'sep' splits 's' into
+// bytes. No characters are copied
+gocaml_array str_split(gocaml_string const s, gocaml_string const sep)
+{
+    int64_t count = 1;
+    if (sep.size == 0) {
+        count = s.size;
+    } else {
+        for (int64_t i = 0; i + sep.size <= s.size; ++i) {
+            if (memcmp(s.chars + i, sep.chars, (size_t) sep.size) == 0) {
+                count++;
+                i += sep.size - 1;
+            }
+        }
+    }
+
+    gocaml_string *const elems = (gocaml_string *) gocaml_alloc(&gocaml_string_layout, (size_t) count);
+    int64_t start = 0;
+    for (int64_t n = 0; n < count; ++n) {
+        int64_t last = s.size;
+        if (sep.size == 0) {
+            last = start + 1;
+        } else if (n < count - 1) {
+            last = start;
+            while (memcmp(s.chars + last, sep.chars, (size_t) sep.size) != 0) {
+                last++;
+            }
+        }
+        elems[n] = str_sub(s, start, last);
+        gocaml_retain(elems[n].chars);
+        start = last + sep.size;
+    }
+
+    gocaml_array ret;
+    ret.buf = elems;
+    ret.size = count;
+    return ret;
+}
+
+// Concatenate strings in the array putting 'sep' between them like Go's strings.Join()
+gocaml_string str_join(gocaml_array const a, gocaml_string const sep)
+{
+    gocaml_string const* const elems = (gocaml_string const*) a.buf;
+    int64_t size = 0;
+    for (int64_t i = 0; i < a.size; ++i) {
+        size += elems[i].size;
+        if (i > 0) {
+            size += sep.size;
+        }
+    }
+
+    char *const buf = (char *) gocaml_alloc_atomic((size_t) size);
+    char *p = buf;
+    for (int64_t i = 0; i < a.size; ++i) {
+        if (i > 0) {
+            memcpy(p, sep.chars, (size_t) sep.size);
+            p += sep.size;
+        }
+        memcpy(p, elems[i].chars, (size_t) elems[i].size);
+        p += elems[i].size;
+    }
+
+    gocaml_string ret;
+    ret.chars = (int8_t *) buf;
+    ret.size = size;
+    return ret;
+}
+
+// Only ASCII characters are converted since strings are sequences of bytes
+static gocaml_string str_map_ascii(gocaml_string const s, char const from, char const to)
+{
+    char *const buf = (char *) gocaml_alloc_atomic((size_t) s.size);
+    for (int64_t i = 0; i < s.size; ++i) {
+        char const c = (char) s.chars[i];
+        buf[i] = from <= c && c <= (char) (from + 25) ? (char) (c - from + to) : c;
+    }
+    gocaml_string ret;
+    ret.chars = (int8_t *) buf;
+    ret.size = s.size;
+    return ret;
+}
+
+gocaml_string str_uppercase(gocaml_string const s)
+{
+    return str_map_ascii(s, 'a', 'A');
+}
+
+gocaml_string str_lowercase(gocaml_string const s)
+{
+    return str_map_ascii(s, 'A', 'a');
+}
+
+gocaml_string int_to_str(gocaml_int const i)
+{
+    char *const s = gocaml_alloc_atomic(SNPRINTF_MAX);
+    int const n = snprintf(s, SNPRINTF_MAX, "%" PRId64, i);
+    gocaml_string ret;
+    ret.chars = (int8_t *) s;
+    ret.size = (int64_t) n;
+    return ret;
+}
+
+gocaml_string float_to_str(gocaml_float const f)
+{
+    char *s = gocaml_alloc_atomic(SNPRINTF_MAX);
     int const n = snprintf(s, SNPRINTF_MAX, "%lg", f);
     gocaml_string ret;
     ret.chars = (int8_t *) s;
@@ -203,34 +1190,24 @@ gocaml_string float_to_str(gocaml_float const f)
 
 gocaml_int str_to_int(gocaml_string const s)
 {
-    GOCAML_STRING_ENSURE_NULL(s);
-
-    int const i = atoi((char *) s.chars);
-
-    GOCAML_STRING_RESTORE_NULL(s);
-
+    int const i = atoi(to_c_str(s));
     return (gocaml_int) i;
 }
 
 gocaml_float str_to_float(gocaml_string const s)
 {
-    GOCAML_STRING_ENSURE_NULL(s);
-
-    double const f = atof((char *) s.chars);
-
-    GOCAML_STRING_RESTORE_NULL(s);
-
+    double const f = atof(to_c_str(s));
     return (gocaml_float) f;
 }
 
 gocaml_string get_line(gocaml_unit _)
 {
     (void) _;
-    char *const s = fgets((char *) GC_malloc(sizeof(char) * LINE_MAX), LINE_MAX, stdin);
+    char *const s = fgets((char *) gocaml_alloc_atomic(sizeof(char) * LINE_MAX), LINE_MAX, stdin);
     gocaml_string ret;
 
     if (s == NULL) {
-        char *const emp = GC_malloc(1);
+        char *const emp = gocaml_alloc_atomic(1);
         emp[0] = '\0';
         ret.chars = (int8_t *) emp;
         ret.size = 0;
@@ -246,7 +1223,7 @@ gocaml_string get_char(gocaml_unit _)
 {
     (void) _;
     gocaml_string ret;
-    int *const s = (int *) GC_malloc(sizeof(int) * 2);
+    int *const s = (int *) gocaml_alloc_atomic(sizeof(int) * 2);
     *s = getchar();
     *(s + 1) = '\0';
     ret.chars = (int8_t *) s;
@@ -264,7 +1241,7 @@ gocaml_int to_char_code(gocaml_string const s)
 
 gocaml_string from_char_code(gocaml_int const i)
 {
-    char *const ptr = GC_malloc(2);
+    char *const ptr = gocaml_alloc_atomic(2);
     *ptr = (char) i;
     *(ptr + 1) = '\0';
     gocaml_string ret;
@@ -276,19 +1253,44 @@ gocaml_string from_char_code(gocaml_int const i)
 void do_garbage_collection(gocaml_unit _)
 {
     (void) _;
-    GC_gcollect();
+    switch (__gocaml_gc) {
+    case GC_KIND_BUILTIN:
+        if (gc.disabled <= 0) {
+            gc_collect();
+        }
+        break;
+    case GC_KIND_RC:
+        if (gc.disabled <= 0) {
+            rc_reconcile();
+            gc_collect();
+        }
+        break;
+    case GC_KIND_NONE:
+        break;
+    default:
+        GC_gcollect();
+        break;
+    }
 }
 
 void enable_garbage_collection(gocaml_unit _)
 {
     (void) _;
-    GC_enable();
+    if (__gocaml_gc == GC_KIND_BOEHM) {
+        GC_enable();
+    } else {
+        gc.disabled--;
+    }
 }
 
 void disable_garbage_collection(gocaml_unit _)
 {
     (void) _;
-    GC_disable();
+    if (__gocaml_gc == GC_KIND_BOEHM) {
+        GC_disable();
+    } else {
+        gc.disabled++;
+    }
 }
 
 gocaml_int bit_and(gocaml_int const l, gocaml_int const r)
@@ -322,7 +1324,7 @@ ff_pair_t *gocaml_modf(gocaml_float const f)
     ff_pair_t *ret;
 
     fractional = modf(f, &integral);
-    ret = (ff_pair_t *) GC_malloc(sizeof(ff_pair_t));
+    ret = (ff_pair_t *) gocaml_alloc_atomic(sizeof(ff_pair_t));
     ret->fst = fractional;
     ret->snd = integral;
     return ret;
@@ -335,7 +1337,7 @@ fi_pair_t *gocaml_frexp(gocaml_float const f)
     fi_pair_t *ret;
 
     frac = frexp(f, &exp);
-    ret = (fi_pair_t *) GC_malloc(sizeof(fi_pair_t));
+    ret = (fi_pair_t *) gocaml_alloc_atomic(sizeof(fi_pair_t));
     ret->fst = frac;
     ret->snd = exp;
     return ret;
@@ -346,67 +1348,1851 @@ gocaml_float gocaml_ldexp(gocaml_float const f, gocaml_int const i)
     return ldexp(f, (int) i);
 }
 
+gocaml_int gocaml_min(gocaml_int const l, gocaml_int const r)
+{
+    return l < r ? l : r;
+}
+
+gocaml_int gocaml_max(gocaml_int const l, gocaml_int const r)
+{
+    return l > r ? l : r;
+}
+
 gocaml_int time_now(gocaml_unit _)
 {
     (void) _;
     return (gocaml_int) time(NULL);
 }
 
-gocaml_string read_file(gocaml_string const filename)
+// Processor time used by the program in seconds
+gocaml_float gocaml_clock(gocaml_unit _)
+{
+    (void) _;
+    return (gocaml_float) clock() / CLOCKS_PER_SEC;
+}
+
+// Nanoseconds from an arbitrary point which never goes backward. Only differences are meaningful
+gocaml_int gocaml_monotonic_ns(gocaml_unit _)
+{
+    (void) _;
+    struct timespec ts;
+    if (clock_gettime(CLOCK_MONOTONIC, &ts) != 0) {
+        return 0;
+    }
+    return (gocaml_int) ts.tv_sec * 1000000000 + (gocaml_int) ts.tv_nsec;
+}
+
+// Pseudo random numbers are generated with SplitMix64. All backends generate the same sequence from
+// the same seed. The seed is 0 until random_seed() is called so that programs are deterministic
+static uint64_t random_state = 0;
+
+static uint64_t random_next(void)
+{
+    uint64_t z = (random_state += UINT64_C(0x9E3779B97F4A7C15));
+    z = (z ^ (z >> 30)) * UINT64_C(0xBF58476D1CE4E5B9);
+    z = (z ^ (z >> 27)) * UINT64_C(0x94D049BB133111EB);
+    return z ^ (z >> 31);
+}
+
+void gocaml_random_seed(gocaml_int const seed)
+{
+    random_state = (uint64_t) seed;
+}
+
+// Uniform integer in [0, bound). It returns 0 when the bound is not positive
+gocaml_int gocaml_random_int(gocaml_int const bound)
+{
+    if (bound <= 0) {
+        return 0;
+    }
+    uint64_t const n = (uint64_t) bound;
+    for (;;) {
+        // Reject values in the last incomplete range to avoid modulo bias
+        uint64_t const x = random_next() >> 1;
+        uint64_t const r = x % n;
+        if (x - r <= (UINT64_C(1) << 63) - n) {
+            return (gocaml_int) r;
+        }
+    }
+}
+
+// Uniform float in [0.0, 1.0)
+gocaml_float gocaml_random_float(gocaml_unit _)
+{
+    (void) _;
+    return (gocaml_float) (random_next() >> 11) * (1.0 / 9007199254740992.0);
+}
+
+// Read characters until EOF or newline when 'line' is not 0. The newline is not included. It returns
+// a string whose 'chars' is NULL when no character was read before EOF (None of string option).
+static gocaml_string read_chars(FILE *const file, int const line)
 {
-    GOCAML_STRING_ENSURE_NULL(filename);
+    // Read into a temporary buffer outside GC heap since the built-in GC does not know a pointer
+    // held by a local variable while allocating a larger buffer
+    int c = EOF;
+    size_t idx = 0;
+    size_t cap = BUF_CHUNK;
+    char *tmp = (char *) malloc(cap);
+    while (tmp != NULL && (c = getc(file)) != EOF) {
+        if (line && c == '\n') {
+            break;
+        }
+        if (idx == cap) {
+            cap += BUF_CHUNK;
+            char *const grown = (char *) realloc(tmp, cap);
+            if (grown == NULL) {
+                free(tmp);
+                tmp = NULL;
+                break;
+            }
+            tmp = grown;
+        }
+        tmp[idx++] = (char) c;
+    }
+    if (tmp == NULL) {
+        gc_out_of_memory();
+    }
+
+    gocaml_string ret;
+    ret.chars = NULL;
+    ret.size = 0;
+    if (idx == 0 && c == EOF) {
+        free(tmp);
+        return ret;
+    }
 
-    FILE *file = fopen((char *) filename.chars, "r");
+    char *const buf = (char *) gocaml_alloc_atomic(idx);
+    memcpy(buf, tmp, idx);
+    free(tmp);
+    ret.chars = (int8_t *) buf;
+    ret.size = (gocaml_int) idx;
+    return ret;
+}
+
+gocaml_string read_file(gocaml_string const filename)
+{
+    FILE *file = fopen(to_c_str(filename), "r");
     if (file == NULL) {
-        GOCAML_STRING_RESTORE_NULL(filename);
         gocaml_string none;
         none.chars = NULL;
         return none;
     }
 
-    char c;
-    int idx = 0;
-    int num_chunk = 1;
-    char *buf = (char *) GC_malloc(sizeof(char) * BUF_CHUNK * num_chunk);
-    while ((c = getc(file)) != EOF) {
-        buf[idx] = c;
-        if ((BUF_CHUNK * num_chunk - 2) <= idx) {
-            char *old = buf;
-            num_chunk++;
-            buf = (char *) GC_malloc(sizeof(char) * BUF_CHUNK * num_chunk);
-            memcpy(buf, old, sizeof(char) * (num_chunk - 1));
-            GC_free(old);
-        }
-        idx++;
+    gocaml_string ret = read_chars(file, 0);
+    fclose(file);
+    if (ret.chars == NULL) {
+        // Empty file is not None
+        ret.chars = (int8_t *) gocaml_alloc_atomic(1);
     }
-    buf[idx] = '\0';
+    return ret;
+}
+
+gocaml_bool write_file(gocaml_string const filename, gocaml_string const content)
+{
+    FILE *file = fopen(to_c_str(filename), "w");
+    if (file == NULL) {
+        return (gocaml_bool) 0;
+    }
+
+    fwrite(content.chars, 1, (size_t) content.size, file);
+
     fclose(file);
+    return (gocaml_bool) 1;
+}
 
+gocaml_string gocaml_getenv(gocaml_string const name)
+{
+    char const* const value = getenv(to_c_str(name));
     gocaml_string ret;
-    ret.chars = (int8_t *)buf;
-    ret.size = (gocaml_int) idx;
-    GOCAML_STRING_RESTORE_NULL(filename);
+    ret.chars = NULL;
+    if (value == NULL) {
+        return ret;
+    }
+    // Copy the value since the environment may be modified later
+    size_t const size = strlen(value);
+    ret.chars = (int8_t *) gocaml_alloc_atomic(size + 1);
+    memcpy(ret.chars, value, size);
+    ret.size = (gocaml_int) size;
     return ret;
 }
 
-gocaml_bool write_file(gocaml_string const filename, gocaml_string const content)
+// Files opened by a program are referred by integer handles which are indices of this table. 0, 1
+// and 2 are stdin, stdout and stderr. A slot of closed file is NULL and reused
+static FILE **files = NULL;
+static gocaml_int files_size = 0;
+
+static FILE *file_of(gocaml_int const handle)
 {
-    GOCAML_STRING_ENSURE_NULL(filename);
-    GOCAML_STRING_ENSURE_NULL(content);
+    switch (handle) {
+    case 0:
+        return stdin;
+    case 1:
+        return stdout;
+    case 2:
+        return stderr;
+    default:
+        if (handle < 0 || handle >= files_size) {
+            return NULL;
+        }
+        return files[handle];
+    }
+}
 
-    FILE *file = fopen((char *) filename.chars, "w");
+static gocaml_int open_file(gocaml_string const filename, char const* const mode)
+{
+    FILE *const file = fopen(to_c_str(filename), mode);
     if (file == NULL) {
-        GOCAML_STRING_RESTORE_NULL(filename);
-        GOCAML_STRING_RESTORE_NULL(content);
+        return -1;
+    }
+
+    gocaml_int handle = 3;
+    while (handle < files_size && files[handle] != NULL) {
+        handle++;
+    }
+    if (handle >= files_size) {
+        gocaml_int const size = handle + 8;
+        FILE **const grown = (FILE **) realloc(files, sizeof(FILE *) * (size_t) size);
+        if (grown == NULL) {
+            fclose(file);
+            gc_out_of_memory();
+        }
+        memset(grown + files_size, 0, sizeof(FILE *) * (size_t) (size - files_size));
+        files = grown;
+        files_size = size;
+    }
+    files[handle] = file;
+    return handle;
+}
+
+gocaml_int gocaml_open_in(gocaml_string const filename)
+{
+    return open_file(filename, "r");
+}
+
+gocaml_int gocaml_open_out(gocaml_string const filename)
+{
+    return open_file(filename, "w");
+}
+
+gocaml_int gocaml_open_append(gocaml_string const filename)
+{
+    return open_file(filename, "a");
+}
+
+gocaml_string gocaml_input_line(gocaml_int const handle)
+{
+    FILE *const file = file_of(handle);
+    if (file == NULL || handle == 1 || handle == 2) {
+        gocaml_string none;
+        none.chars = NULL;
+        return none;
+    }
+    return read_chars(file, 1);
+}
+
+gocaml_string gocaml_input_all(gocaml_int const handle)
+{
+    FILE *const file = file_of(handle);
+    gocaml_string ret;
+    ret.chars = NULL;
+    if (file != NULL && handle != 1 && handle != 2) {
+        ret = read_chars(file, 0);
+    }
+    if (ret.chars == NULL) {
+        // Empty string on EOF or error
+        ret.chars = (int8_t *) gocaml_alloc_atomic(1);
+        ret.size = 0;
+    }
+    return ret;
+}
+
+gocaml_bool gocaml_output_string(gocaml_int const handle, gocaml_string const s)
+{
+    FILE *const file = file_of(handle);
+    if (file == NULL || handle == 0) {
         return (gocaml_bool) 0;
     }
+    if (handle == 2) {
+        fflush(stdout);
+    }
+    return (gocaml_bool) (fwrite(s.chars, 1, (size_t) s.size, file) == (size_t) s.size);
+}
 
-    for (int i = 0; i < content.size; i++) {
-        fputc(content.chars[i], file);
+// Standard streams cannot be closed
+gocaml_bool gocaml_close_file(gocaml_int const handle)
+{
+    if (handle < 3 || handle >= files_size || files[handle] == NULL) {
+        return (gocaml_bool) 0;
     }
+    int const err = fclose(files[handle]);
+    files[handle] = NULL;
+    return (gocaml_bool) (err == 0);
+}
 
-    fclose(file);
-    GOCAML_STRING_RESTORE_NULL(filename);
-    GOCAML_STRING_RESTORE_NULL(content);
+gocaml_string gocaml_read_line(gocaml_unit _)
+{
+    (void) _;
+    return read_chars(stdin, 1);
+}
+
+// Note:
+// Hash tables of 'Table' module. Since values of any type can be stored, generated code passes a
+// pointer to a value and the value is copied as bytes described by the layout which generated code
+// emits for its type. Keys are int or string and each operation has a function for each kind of
+// key. Slots are probed linearly and the capacity is always a power of two. A removed slot is
+// marked as deleted and its key and value are cleared so that collectors never see stale pointers.
+//
+// The table object on GC heap holds three arrays on GC heap: keys, values and states of slots. They
+// are allocated at the first insertion and reallocated when live and deleted slots exceed 3/4 of
+// the capacity. Collection is disabled while reallocating since the new arrays are only held by
+// local variables.
+#define TABLE_EMPTY 0
+#define TABLE_USED 1
+#define TABLE_DELETED 2
+#define TABLE_MIN_CAP 8
+#define TABLE_NOT_FOUND SIZE_MAX
+
+typedef struct {
+    void *keys;
+    void *values;
+    uint8_t *states;
+    gocaml_layout const* layout; // Layout of a value
+    size_t size;                 // Number of live slots
+    size_t used;                 // Number of live and deleted slots
+    size_t cap;
+} table_t;
+
+static size_t const table_offsets[] = {
+    offsetof(table_t, keys),
+    offsetof(table_t, values),
+    offsetof(table_t, states),
+};
+static gocaml_layout const table_layout = {sizeof(table_t), 3, table_offsets};
+static gocaml_layout const int_keys_layout = {sizeof(gocaml_int), 0, NULL};
+
+static size_t table_key_size(int const str)
+{
+    return str ? sizeof(gocaml_string) : sizeof(gocaml_int);
+}
+
+static uint64_t table_hash(void const* const key, int const str)
+{
+    if (!str) {
+        // Finalizer of SplitMix64 spreads sequential integers
+        uint64_t z = (uint64_t) *(gocaml_int const*) key;
+        z = (z ^ (z >> 30)) * UINT64_C(0xBF58476D1CE4E5B9);
+        z = (z ^ (z >> 27)) * UINT64_C(0x94D049BB133111EB);
+        return z ^ (z >> 31);
+    }
+    // FNV-1a
+    gocaml_string const* const s = (gocaml_string const*) key;
+    uint64_t h = UINT64_C(0xCBF29CE484222325);
+    for (gocaml_int i = 0; i < s->size; ++i) {
+        h ^= (uint8_t) s->chars[i];
+        h *= UINT64_C(0x100000001B3);
+    }
+    return h;
+}
+
+static int table_key_equal(void const* const l, void const* const r, int const str)
+{
+    if (!str) {
+        return *(gocaml_int const*) l == *(gocaml_int const*) r;
+    }
+    return __str_equal(*(gocaml_string const*) l, *(gocaml_string const*) r);
+}
+
+static void *table_key_at(table_t const* const t, size_t const i, int const str)
+{
+    return (char *) t->keys + i * table_key_size(str);
+}
+
+static void *table_value_at(table_t const* const t, size_t const i)
+{
+    return (char *) t->values + i * t->layout->size;
+}
+
+// Count or drop references from the slot with reference counting. The key is included when
+// 'with_key' is not 0.
+static void table_count_refs(table_t const* const t, size_t const i, int const str, int const with_key, void (*f)(void const*))
+{
+    if (__gocaml_gc != GC_KIND_RC) {
+        return;
+    }
+    if (str && with_key) {
+        f(((gocaml_string const*) t->keys)[i].chars);
+    }
+    char const* const value = (char const*) table_value_at(t, i);
+    for (size_t j = 0; j < t->layout->num_pointers; ++j) {
+        void *ptr;
+        memcpy(&ptr, value + t->layout->offsets[j], sizeof(ptr));
+        f(ptr);
+    }
+}
+
+// Replace the array held by the field of an object on GC heap. With reference counting, the object
+// owns a reference to the array.
+static void replace_array(void **const field, void *const array)
+{
+    if (__gocaml_gc == GC_KIND_RC) {
+        rc_retain(array);
+        rc_release(*field);
+    }
+    *field = array;
+}
+
+// Returns the index of the live slot of the key or TABLE_NOT_FOUND
+static size_t table_lookup(table_t const* const t, void const* const key, int const str)
+{
+    if (t->cap == 0) {
+        return TABLE_NOT_FOUND;
+    }
+    size_t const mask = t->cap - 1;
+    // Terminates since the table always has an empty slot
+    for (size_t i = (size_t) table_hash(key, str) & mask;; i = (i + 1) & mask) {
+        switch (t->states[i]) {
+        case TABLE_EMPTY:
+            return TABLE_NOT_FOUND;
+        case TABLE_USED:
+            if (table_key_equal(table_key_at(t, i, str), key, str)) {
+                return i;
+            }
+            break;
+        default:
+            break;
+        }
+    }
+}
+
+// Move live slots to new arrays of the capacity. Deleted slots are dropped.
+static void table_rehash(table_t *const t, size_t const cap, int const str)
+{
+    gc.disabled++;
+    size_t const key_size = table_key_size(str);
+    size_t const value_size = t->layout->size;
+    char *const keys = (char *) gocaml_alloc(str ? &gocaml_string_layout : &int_keys_layout, cap);
+    char *const values = (char *) gocaml_alloc(t->layout, cap);
+    uint8_t *const states = (uint8_t *) gocaml_alloc_atomic(cap);
+    for (size_t i = 0; i < t->cap; ++i) {
+        if (t->states[i] != TABLE_USED) {
+            continue;
+        }
+        void const* const key = table_key_at(t, i, str);
+        size_t j = (size_t) table_hash(key, str) & (cap - 1);
+        while (states[j] != TABLE_EMPTY) {
+            j = (j + 1) & (cap - 1);
+        }
+        memcpy(keys + j * key_size, key, key_size);
+        memcpy(values + j * value_size, table_value_at(t, i), value_size);
+        states[j] = TABLE_USED;
+    }
+    replace_array(&t->keys, keys);
+    replace_array(&t->values, values);
+    replace_array((void **) &t->states, states);
+    t->cap = cap;
+    t->used = t->size;
+    // Old arrays release their references when they are freed
+    for (size_t i = 0; i < cap; ++i) {
+        if (states[i] == TABLE_USED) {
+            table_count_refs(t, i, str, 1, rc_retain);
+        }
+    }
+    gc.disabled--;
+}
+
+static gocaml_bool table_find(void *const table, void const* const key, void *const value, int const str)
+{
+    table_t const* const t = (table_t const*) table;
+    size_t const i = table_lookup(t, key, str);
+    if (i == TABLE_NOT_FOUND) {
+        return (gocaml_bool) 0;
+    }
+    memcpy(value, table_value_at(t, i), t->layout->size);
     return (gocaml_bool) 1;
 }
+
+static void table_set(void *const table, void const* const key, void const* const value, int const str)
+{
+    table_t *const t = (table_t *) table;
+    size_t i = table_lookup(t, key, str);
+    if (i != TABLE_NOT_FOUND) {
+        table_count_refs(t, i, str, 0, rc_release);
+        memcpy(table_value_at(t, i), value, t->layout->size);
+        table_count_refs(t, i, str, 0, rc_retain);
+        return;
+    }
+
+    if ((t->used + 1) * 4 > t->cap * 3) {
+        size_t cap = TABLE_MIN_CAP;
+        while (cap < (t->size + 1) * 2) {
+            cap *= 2;
+        }
+        table_rehash(t, cap, str);
+    }
+    size_t const mask = t->cap - 1;
+    i = (size_t) table_hash(key, str) & mask;
+    while (t->states[i] == TABLE_USED) {
+        i = (i + 1) & mask;
+    }
+    if (t->states[i] == TABLE_EMPTY) {
+        t->used++;
+    }
+    t->states[i] = TABLE_USED;
+    t->size++;
+    memcpy(table_key_at(t, i, str), key, table_key_size(str));
+    memcpy(table_value_at(t, i), value, t->layout->size);
+    table_count_refs(t, i, str, 1, rc_retain);
+}
+
+static void table_remove(void *const table, void const* const key, int const str)
+{
+    table_t *const t = (table_t *) table;
+    size_t const i = table_lookup(t, key, str);
+    if (i == TABLE_NOT_FOUND) {
+        return;
+    }
+    table_count_refs(t, i, str, 1, rc_release);
+    memset(table_key_at(t, i, str), 0, table_key_size(str));
+    memset(table_value_at(t, i), 0, t->layout->size);
+    t->states[i] = TABLE_DELETED;
+    t->size--;
+}
+
+// Called by 'Table.create'. The layout must outlive the table
+void *__gocaml_table_create(gocaml_layout const* const value_layout)
+{
+    table_t *const t = (table_t *) gocaml_alloc(&table_layout, 1);
+    t->layout = value_layout;
+    return t;
+}
+
+gocaml_bool __gocaml_table_find_int(void *const table, gocaml_int const key, void *const value)
+{
+    return table_find(table, &key, value, 0);
+}
+
+gocaml_bool __gocaml_table_find_str(void *const table, gocaml_string const* const key, void *const value)
+{
+    return table_find(table, key, value, 1);
+}
+
+void __gocaml_table_set_int(void *const table, gocaml_int const key, void const* const value)
+{
+    table_set(table, &key, value, 0);
+}
+
+void __gocaml_table_set_str(void *const table, gocaml_string const* const key, void const* const value)
+{
+    table_set(table, key, value, 1);
+}
+
+void __gocaml_table_remove_int(void *const table, gocaml_int const key)
+{
+    table_remove(table, &key, 0);
+}
+
+void __gocaml_table_remove_str(void *const table, gocaml_string const* const key)
+{
+    table_remove(table, key, 1);
+}
+
+// Note:
+// Byte buffers of 'Buffer' module. A buffer object on GC heap holds an array of bytes on GC heap
+// and the array is reallocated with doubled capacity when it is full. So adding a string costs
+// amortized O(length of the string). Contents are copied to a new string so that later additions
+// never modify strings returned from the buffer.
+#define BUFFER_MIN_CAP 16
+
+typedef struct {
+    int8_t *chars;
+    gocaml_int size;
+    gocaml_int cap;
+} buffer_t;
+
+static size_t const buffer_offsets[] = {
+    offsetof(buffer_t, chars),
+};
+static gocaml_layout const buffer_layout = {sizeof(buffer_t), 1, buffer_offsets};
+
+// Ensure the capacity to add 'size' bytes
+static void buffer_reserve(buffer_t *const b, gocaml_int const size)
+{
+    if (b->size + size <= b->cap) {
+        return;
+    }
+    gocaml_int cap = b->cap == 0 ? BUFFER_MIN_CAP : b->cap;
+    while (cap < b->size + size) {
+        cap *= 2;
+    }
+    int8_t *const chars = (int8_t *) gocaml_alloc_atomic((size_t) cap);
+    if (b->size > 0) {
+        memcpy(chars, b->chars, (size_t) b->size);
+    }
+    replace_array((void **) &b->chars, chars);
+    b->cap = cap;
+}
+
+void *gocaml_buffer_create(gocaml_unit _)
+{
+    (void) _;
+    return gocaml_alloc(&buffer_layout, 1);
+}
+
+void gocaml_buffer_add_string(void *const buffer, gocaml_string const s)
+{
+    buffer_t *const b = (buffer_t *) buffer;
+    if (s.size == 0) {
+        return;
+    }
+    buffer_reserve(b, s.size);
+    memcpy(b->chars + b->size, s.chars, (size_t) s.size);
+    b->size += s.size;
+}
+
+// Only the lowest 8 bits of the character code are added as 'from_char_code' does
+void gocaml_buffer_add_char(void *const buffer, gocaml_int const c)
+{
+    buffer_t *const b = (buffer_t *) buffer;
+    buffer_reserve(b, 1);
+    b->chars[b->size] = (int8_t) c;
+    b->size++;
+}
+
+gocaml_string gocaml_buffer_contents(void *const buffer)
+{
+    buffer_t const* const b = (buffer_t const*) buffer;
+    gocaml_string ret;
+    ret.chars = (int8_t *) gocaml_alloc_atomic((size_t) b->size);
+    ret.size = b->size;
+    if (b->size > 0) {
+        memcpy(ret.chars, b->chars, (size_t) b->size);
+    }
+    return ret;
+}
+
+gocaml_int gocaml_buffer_length(void *const buffer)
+{
+    return ((buffer_t const*) buffer)->size;
+}
+
+static gocaml_string copy_string(int8_t const* const chars, gocaml_int const size)
+{
+    gocaml_string ret;
+    // Allocate at least one byte since null pointer means 'None'
+    ret.chars = (int8_t *) gocaml_alloc_atomic((size_t) size + 1);
+    ret.size = size;
+    if (size > 0) {
+        memcpy(ret.chars, chars, (size_t) size);
+    }
+    return ret;
+}
+
+// Growable bytes on C heap to build a string whose length is not known in advance. The result is
+// copied to GC heap with copy_string().
+typedef struct {
+    int8_t *chars;
+    size_t len;
+    size_t cap;
+} output_t;
+
+static void output_append(output_t *const out, int8_t const* const chars, gocaml_int const size)
+{
+    if (size <= 0) {
+        return;
+    }
+    if (out->len + (size_t) size > out->cap) {
+        while (out->len + (size_t) size > out->cap) {
+            out->cap = out->cap == 0 ? 16 : out->cap * 2;
+        }
+        out->chars = (int8_t *) realloc(out->chars, out->cap);
+        if (out->chars == NULL) {
+            gc_out_of_memory();
+        }
+    }
+    memcpy(out->chars + out->len, chars, (size_t) size);
+    out->len += (size_t) size;
+}
+
+// Note:
+// Regular expressions of 'Re' module. A small engine is bundled instead of POSIX regex since
+// strings may contain '\0' and the same engine is implemented in the interpreter (interp/regexp.go)
+// and the JavaScript runtime so that all backends return the same results. Patterns are sequences
+// of bytes and support:
+//
+//   c       Character which is not special
+//   .       Any character except for '\n'
+//   [...]   Character class. '[^...]' is its complement. Ranges like 'a-z' and escapes are available
+//   \d \w \s \D \W \S  Digits, word characters ([A-Za-z0-9_]), white spaces and their complements
+//   \n \t \r  Newline, tab and carriage return. '\' followed by other punctuation is the character
+//   * + ?   Greedy repetitions
+//   |       Alternation
+//   (...)   Group
+//   ^ $     Start and end of the string
+//
+// A pattern is compiled into a program of instructions whose jumps are relative so that
+// instructions can be inserted before a fragment of the program while parsing. The program is run
+// by Pike VM which steps all threads of matching in parallel for each character. Threads are kept in
+// priority order, so the leftmost match preferred by backtracking engines (greedy repetitions and
+// left alternatives first) is found in O(length of string * length of program) time.
+#define RE_CHAR 0
+#define RE_ANY 1
+#define RE_CLASS 2
+#define RE_SPLIT 3
+#define RE_JMP 4
+#define RE_BOL 5
+#define RE_EOL 6
+#define RE_MATCH 7
+
+typedef struct {
+    int op;
+    int x; // Relative offset of jump. Preferred branch of split
+    int y; // Relative offset of another branch of split
+    uint8_t c;
+    uint8_t set[32];
+} re_insn;
+
+typedef struct {
+    re_insn *insns;
+    size_t len;
+    size_t cap;
+    gocaml_string pat;
+    gocaml_int pos;
+} re_prog;
+
+typedef struct {
+    size_t pc;
+    gocaml_int start;
+} re_thread;
+
+static void re_fail(re_prog const* const p, char const* const msg)
+{
+    fflush(stdout);
+    fprintf(stderr, "Invalid regular expression '%.*s': %s at offset %" PRId64 "\n", (int) p->pat.size, (char *) p->pat.chars, msg, p->pos);
+    abort();
+}
+
+static int re_eof(re_prog const* const p)
+{
+    return p->pos >= p->pat.size;
+}
+
+static uint8_t re_peek(re_prog const* const p)
+{
+    return (uint8_t) p->pat.chars[p->pos];
+}
+
+static re_insn *re_insert(re_prog *const p, size_t const at, int const op)
+{
+    if (p->len == p->cap) {
+        p->cap = p->cap == 0 ? 16 : p->cap * 2;
+        p->insns = (re_insn *) realloc(p->insns, p->cap * sizeof(re_insn));
+        if (p->insns == NULL) {
+            gc_out_of_memory();
+        }
+    }
+    memmove(p->insns + at + 1, p->insns + at, (p->len - at) * sizeof(re_insn));
+    p->len++;
+    re_insn *const i = p->insns + at;
+    memset(i, 0, sizeof(re_insn));
+    i->op = op;
+    return i;
+}
+
+static re_insn *re_emit(re_prog *const p, int const op)
+{
+    return re_insert(p, p->len, op);
+}
+
+static void re_set_range(uint8_t *const set, int const lo, int const hi)
+{
+    for (int c = lo; c <= hi; ++c) {
+        set[c / 8] |= (uint8_t) (1 << (c % 8));
+    }
+}
+
+static int re_set_has(uint8_t const* const set, uint8_t const c)
+{
+    return (set[c / 8] >> (c % 8)) & 1;
+}
+
+// Adds the class of '\d', '\w', '\s' or their complements. Returns 0 when it is not a class escape
+static int re_class_escape(uint8_t const e, uint8_t *const set)
+{
+    uint8_t s[32] = {0};
+    switch (e) {
+    case 'd': case 'D':
+        re_set_range(s, '0', '9');
+        break;
+    case 'w': case 'W':
+        re_set_range(s, 'a', 'z');
+        re_set_range(s, 'A', 'Z');
+        re_set_range(s, '0', '9');
+        re_set_range(s, '_', '_');
+        break;
+    case 's': case 'S':
+        re_set_range(s, ' ', ' ');
+        re_set_range(s, '\t', '\r'); // \t \n \v \f \r
+        break;
+    default:
+        return 0;
+    }
+    int const complement = e == 'D' || e == 'W' || e == 'S';
+    for (int i = 0; i < 32; ++i) {
+        set[i] |= complement ? (uint8_t) ~s[i] : s[i];
+    }
+    return 1;
+}
+
+// Parses the character after '\'
+static uint8_t re_char_escape(re_prog *const p)
+{
+    if (re_eof(p)) {
+        re_fail(p, "Trailing '\\'");
+    }
+    uint8_t const e = re_peek(p);
+    p->pos++;
+    switch (e) {
+    case 'n':
+        return '\n';
+    case 't':
+        return '\t';
+    case 'r':
+        return '\r';
+    default:
+        break;
+    }
+    if (('a' <= e && e <= 'z') || ('A' <= e && e <= 'Z') || ('0' <= e && e <= '9')) {
+        p->pos--;
+        re_fail(p, "Unknown escape");
+    }
+    return e;
+}
+
+static void re_parse_class(re_prog *const p)
+{
+    uint8_t set[32] = {0};
+    int negate = 0;
+    if (!re_eof(p) && re_peek(p) == '^') {
+        negate = 1;
+        p->pos++;
+    }
+    for (int first = 1;; first = 0) {
+        if (re_eof(p)) {
+            re_fail(p, "Missing ']'");
+        }
+        uint8_t lo = re_peek(p);
+        p->pos++;
+        if (lo == ']' && !first) {
+            break;
+        }
+        if (lo == '\\') {
+            if (!re_eof(p) && re_class_escape(re_peek(p), set)) {
+                p->pos++;
+                continue;
+            }
+            lo = re_char_escape(p);
+        }
+        uint8_t hi = lo;
+        if (p->pos + 1 < p->pat.size && re_peek(p) == '-' && (uint8_t) p->pat.chars[p->pos + 1] != ']') {
+            p->pos++;
+            hi = re_peek(p);
+            p->pos++;
+            if (hi == '\\') {
+                hi = re_char_escape(p);
+            }
+            if (hi < lo) {
+                re_fail(p, "Invalid range in character class");
+            }
+        }
+        re_set_range(set, lo, hi);
+    }
+    if (negate) {
+        for (int i = 0; i < 32; ++i) {
+            set[i] = (uint8_t) ~set[i];
+        }
+    }
+    memcpy(re_emit(p, RE_CLASS)->set, set, sizeof(set));
+}
+
+static void re_parse_alt(re_prog *const p);
+
+static void re_parse_atom(re_prog *const p)
+{
+    uint8_t const c = re_peek(p);
+    p->pos++;
+    switch (c) {
+    case '(':
+        re_parse_alt(p);
+        if (re_eof(p)) {
+            re_fail(p, "Missing ')'");
+        }
+        p->pos++; // Eat ')'
+        break;
+    case '*': case '+': case '?':
+        p->pos--;
+        re_fail(p, "Nothing to repeat");
+        break;
+    case '.':
+        re_emit(p, RE_ANY);
+        break;
+    case '^':
+        re_emit(p, RE_BOL);
+        break;
+    case '$':
+        re_emit(p, RE_EOL);
+        break;
+    case '[':
+        re_parse_class(p);
+        break;
+    case '\\': {
+        uint8_t set[32] = {0};
+        if (!re_eof(p) && re_class_escape(re_peek(p), set)) {
+            p->pos++;
+            memcpy(re_emit(p, RE_CLASS)->set, set, sizeof(set));
+            break;
+        }
+        re_emit(p, RE_CHAR)->c = re_char_escape(p);
+        break;
+    }
+    default:
+        re_emit(p, RE_CHAR)->c = c;
+        break;
+    }
+}
+
+static void re_parse_repeat(re_prog *const p)
+{
+    size_t const start = p->len;
+    re_parse_atom(p);
+    if (re_eof(p)) {
+        return;
+    }
+    uint8_t const q = re_peek(p);
+    if (q != '*' && q != '+' && q != '?') {
+        return;
+    }
+    p->pos++;
+    int const len = (int) (p->len - start);
+    re_insn *i;
+    switch (q) {
+    case '*':
+        // L: split +1, +(len+2); e; jmp L
+        i = re_insert(p, start, RE_SPLIT);
+        i->x = 1;
+        i->y = len + 2;
+        re_emit(p, RE_JMP)->x = -(len + 1);
+        break;
+    case '+':
+        // L: e; split L, +1
+        i = re_emit(p, RE_SPLIT);
+        i->x = -len;
+        i->y = 1;
+        break;
+    default:
+        // split +1, +(len+1); e
+        i = re_insert(p, start, RE_SPLIT);
+        i->x = 1;
+        i->y = len + 1;
+        break;
+    }
+    if (!re_eof(p) && (re_peek(p) == '*' || re_peek(p) == '+' || re_peek(p) == '?')) {
+        re_fail(p, "Nested repetition");
+    }
+}
+
+static void re_parse_alt(re_prog *const p)
+{
+    size_t const start = p->len;
+    for (;;) {
+        while (!re_eof(p) && re_peek(p) != '|' && re_peek(p) != ')') {
+            re_parse_repeat(p);
+        }
+        if (re_eof(p) || re_peek(p) != '|') {
+            return;
+        }
+        p->pos++; // Eat '|'
+        // split +1, +(len+2); e1; jmp END; e2
+        int const len = (int) (p->len - start);
+        re_insn *const i = re_insert(p, start, RE_SPLIT);
+        i->x = 1;
+        i->y = len + 2;
+        size_t const jmp = p->len;
+        re_emit(p, RE_JMP);
+        while (!re_eof(p) && re_peek(p) != '|' && re_peek(p) != ')') {
+            re_parse_repeat(p);
+        }
+        p->insns[jmp].x = (int) (p->len - jmp);
+    }
+}
+
+// Compiles the pattern. When 'whole' is not 0, the pattern must match until the end of string.
+static void re_compile(re_prog *const p, gocaml_string const pat, int const whole)
+{
+    memset(p, 0, sizeof(re_prog));
+    p->pat = pat;
+    re_parse_alt(p);
+    if (!re_eof(p)) {
+        re_fail(p, "Unmatched ')'");
+    }
+    if (whole) {
+        re_emit(p, RE_EOL);
+    }
+    re_emit(p, RE_MATCH);
+}
+
+static void re_add_thread(re_prog const* const p, re_thread *const list, size_t *const n, gocaml_int *const marks, size_t const pc, gocaml_int const start, gocaml_int const pos, gocaml_int const size)
+{
+    // Position + 1 marks threads added to the list for the position
+    if (marks[pc] == pos + 1) {
+        return;
+    }
+    marks[pc] = pos + 1;
+    re_insn const* const i = p->insns + pc;
+    switch (i->op) {
+    case RE_JMP:
+        re_add_thread(p, list, n, marks, pc + i->x, start, pos, size);
+        break;
+    case RE_SPLIT:
+        re_add_thread(p, list, n, marks, pc + i->x, start, pos, size);
+        re_add_thread(p, list, n, marks, pc + i->y, start, pos, size);
+        break;
+    case RE_BOL:
+        if (pos == 0) {
+            re_add_thread(p, list, n, marks, pc + 1, start, pos, size);
+        }
+        break;
+    case RE_EOL:
+        if (pos == size) {
+            re_add_thread(p, list, n, marks, pc + 1, start, pos, size);
+        }
+        break;
+    default:
+        list[*n].pc = pc;
+        list[*n].start = start;
+        (*n)++;
+        break;
+    }
+}
+
+// Searches the first match starting at 'from' or later. When 'anchored' is not 0, the match must
+// start at 'from'. Returns 0 when no match is found.
+static int re_run(re_prog const* const p, gocaml_string const s, gocaml_int const from, int const anchored, gocaml_int *const match_start, gocaml_int *const match_end)
+{
+    re_thread *clist = (re_thread *) malloc(p->len * sizeof(re_thread));
+    re_thread *nlist = (re_thread *) malloc(p->len * sizeof(re_thread));
+    gocaml_int *const marks = (gocaml_int *) calloc(p->len, sizeof(gocaml_int));
+    if (clist == NULL || nlist == NULL || marks == NULL) {
+        gc_out_of_memory();
+    }
+
+    int matched = 0;
+    size_t cn = 0;
+    for (gocaml_int pos = from;; ++pos) {
+        if (!matched && (!anchored || pos == from)) {
+            // New thread has the lowest priority
+            re_add_thread(p, clist, &cn, marks, 0, pos, pos, s.size);
+        }
+        if (cn == 0 && (matched || anchored)) {
+            break;
+        }
+        size_t nn = 0;
+        for (size_t t = 0; t < cn; ++t) {
+            re_insn const* const i = p->insns + clist[t].pc;
+            int step = 0;
+            if (pos < s.size) {
+                uint8_t const c = (uint8_t) s.chars[pos];
+                switch (i->op) {
+                case RE_CHAR:
+                    step = c == i->c;
+                    break;
+                case RE_ANY:
+                    step = c != '\n';
+                    break;
+                case RE_CLASS:
+                    step = re_set_has(i->set, c);
+                    break;
+                default:
+                    break;
+                }
+            }
+            if (step) {
+                re_add_thread(p, nlist, &nn, marks, clist[t].pc + 1, clist[t].start, pos + 1, s.size);
+            } else if (i->op == RE_MATCH) {
+                // Threads after this one have lower priority
+                matched = 1;
+                *match_start = clist[t].start;
+                *match_end = pos;
+                break;
+            }
+        }
+        if (pos >= s.size) {
+            break;
+        }
+        re_thread *const tmp = clist;
+        clist = nlist;
+        nlist = tmp;
+        cn = nn;
+    }
+
+    free(clist);
+    free(nlist);
+    free(marks);
+    return matched;
+}
+
+gocaml_bool gocaml_re_match(gocaml_string const pat, gocaml_string const s)
+{
+    re_prog p;
+    re_compile(&p, pat, 1);
+    gocaml_int start, end;
+    int const matched = re_run(&p, s, 0, 1, &start, &end);
+    free(p.insns);
+    return (gocaml_bool) matched;
+}
+
+gocaml_string gocaml_re_find(gocaml_string const pat, gocaml_string const s)
+{
+    re_prog p;
+    re_compile(&p, pat, 0);
+    gocaml_int start, end;
+    int const matched = re_run(&p, s, 0, 0, &start, &end);
+    free(p.insns);
+    if (!matched) {
+        gocaml_string none;
+        none.chars = NULL;
+        none.size = 0;
+        return none;
+    }
+    return copy_string(s.chars + start, end - start);
+}
+
+// Replaces all matches. After an empty match, the next character is copied to make progress.
+gocaml_string gocaml_re_replace(gocaml_string const pat, gocaml_string const by, gocaml_string const s)
+{
+    re_prog p;
+    re_compile(&p, pat, 0);
+    output_t out = {NULL, 0, 0};
+    gocaml_int pos = 0, start, end;
+    while (pos <= s.size && re_run(&p, s, pos, 0, &start, &end)) {
+        output_append(&out, s.chars + pos, start - pos);
+        output_append(&out, by.chars, by.size);
+        if (end > start) {
+            pos = end;
+            continue;
+        }
+        output_append(&out, s.chars + start, start < s.size ? 1 : 0);
+        pos = start + 1;
+    }
+    if (pos < s.size) {
+        output_append(&out, s.chars + pos, s.size - pos);
+    }
+    gocaml_string const ret = copy_string(out.chars, (gocaml_int) out.len);
+    free(out.chars);
+    free(p.insns);
+    return ret;
+}
+
+// Note:
+// JSON values of 'Json' module. A value is an immutable object on GC heap. Arrays and objects hold
+// an array of pointers to their elements (values of fields for objects) and objects also hold an
+// array of keys in the same order. Since values are immutable, they never form cycles. Collection
+// is disabled while building values since new objects are only held by local variables. Encoding
+// and decoding are implemented in the interpreter (interp/json.go) and the JavaScript runtime in
+// the same way so that all backends return the same results:
+//
+//   - Integers are encoded in decimal and floats with the fewest digits which are parsed as the same
+//     float. '.0' is added to integral floats. Infinity and NaN are encoded as null.
+//   - Strings are sequences of bytes. '"', '\' and control characters are escaped and other bytes
+//     are encoded as they are. '\uXXXX' escapes are decoded into UTF-8.
+//   - Numbers without fraction and exponent are decoded as integers unless they overflow.
+//   - Decoding fails when arrays and objects are nested more than JSON_MAX_DEPTH.
+#define JSON_NULL 0
+#define JSON_BOOL 1
+#define JSON_INT 2
+#define JSON_FLOAT 3
+#define JSON_STRING 4
+#define JSON_ARRAY 5
+#define JSON_OBJECT 6
+#define JSON_MAX_DEPTH 512
+
+static char const* const json_kind_names[] = {"null", "bool", "int", "float", "string", "array", "object"};
+
+typedef struct {
+    gocaml_int kind;
+    gocaml_int i;        // Value of bool or int
+    gocaml_float f;
+    gocaml_string s;
+    void **elems;        // Elements of array or values of fields of object
+    gocaml_string *keys; // Keys of fields of object
+    gocaml_int size;     // Number of elements or fields
+} json_t;
+
+static size_t const json_offsets[] = {
+    offsetof(json_t, s) + offsetof(gocaml_string, chars),
+    offsetof(json_t, elems),
+    offsetof(json_t, keys),
+};
+static gocaml_layout const json_layout = {sizeof(json_t), 3, json_offsets};
+static size_t const json_elems_offsets[] = {0};
+static gocaml_layout const json_elems_layout = {sizeof(void *), 1, json_elems_offsets};
+
+// Tuple of key and value passed to 'Json.of_object'
+typedef struct {
+    gocaml_string key;
+    json_t *value;
+} json_field_t;
+
+static json_t *json_new(gocaml_int const kind)
+{
+    json_t *const v = (json_t *) gocaml_alloc(&json_layout, 1);
+    v->kind = kind;
+    return v;
+}
+
+// Allocate arrays for elements (and keys for objects). With reference counting, the value owns
+// references to them and the caller retains pointers stored to them.
+static json_t *json_new_container(gocaml_int const kind, gocaml_int const size)
+{
+    json_t *const v = json_new(kind);
+    v->size = size;
+    v->elems = (void **) gocaml_alloc(&json_elems_layout, (size_t) size);
+    gocaml_retain(v->elems);
+    if (kind == JSON_OBJECT) {
+        v->keys = (gocaml_string *) gocaml_alloc(&gocaml_string_layout, (size_t) size);
+        gocaml_retain(v->keys);
+    }
+    return v;
+}
+
+static void json_expect(char const* const fun, json_t const* const v, char const* const expected, gocaml_int const k1, gocaml_int const k2)
+{
+    if (v->kind == k1 || v->kind == k2) {
+        return;
+    }
+    fflush(stdout);
+    fprintf(stderr, "Json.%s: Expected %s but got %s\n", fun, expected, json_kind_names[v->kind]);
+    abort();
+}
+
+void *gocaml_json_null(gocaml_unit _)
+{
+    (void) _;
+    return json_new(JSON_NULL);
+}
+
+void *gocaml_json_of_bool(gocaml_bool const b)
+{
+    json_t *const v = json_new(JSON_BOOL);
+    v->i = b ? 1 : 0;
+    return v;
+}
+
+void *gocaml_json_of_int(gocaml_int const i)
+{
+    json_t *const v = json_new(JSON_INT);
+    v->i = i;
+    return v;
+}
+
+void *gocaml_json_of_float(gocaml_float const f)
+{
+    json_t *const v = json_new(JSON_FLOAT);
+    v->f = f;
+    return v;
+}
+
+void *gocaml_json_of_string(gocaml_string const s)
+{
+    json_t *const v = json_new(JSON_STRING);
+    v->s = s;
+    gocaml_retain(s.chars);
+    return v;
+}
+
+// Elements are copied since arrays are mutable
+void *gocaml_json_of_array(gocaml_array const a)
+{
+    gc.disabled++;
+    json_t *const v = json_new_container(JSON_ARRAY, a.size);
+    for (gocaml_int i = 0; i < a.size; ++i) {
+        v->elems[i] = ((void **) a.buf)[i];
+        gocaml_retain(v->elems[i]);
+    }
+    gc.disabled--;
+    return v;
+}
+
+void *gocaml_json_of_object(gocaml_array const a)
+{
+    gc.disabled++;
+    json_t *const v = json_new_container(JSON_OBJECT, a.size);
+    for (gocaml_int i = 0; i < a.size; ++i) {
+        json_field_t const* const field = ((json_field_t **) a.buf)[i];
+        v->keys[i] = field->key;
+        gocaml_retain(v->keys[i].chars);
+        v->elems[i] = field->value;
+        gocaml_retain(v->elems[i]);
+    }
+    gc.disabled--;
+    return v;
+}
+
+gocaml_string gocaml_json_kind(void *const json)
+{
+    char const* const name = json_kind_names[((json_t const*) json)->kind];
+    gocaml_string ret;
+    ret.chars = (int8_t *) name;
+    ret.size = (gocaml_int) strlen(name);
+    return ret;
+}
+
+gocaml_bool gocaml_json_to_bool(void *const json)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("to_bool", v, "bool", JSON_BOOL, JSON_BOOL);
+    return (gocaml_bool) v->i;
+}
+
+gocaml_int gocaml_json_to_int(void *const json)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("to_int", v, "int", JSON_INT, JSON_INT);
+    return v->i;
+}
+
+gocaml_float gocaml_json_to_float(void *const json)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("to_float", v, "float or int", JSON_FLOAT, JSON_INT);
+    return v->kind == JSON_INT ? (gocaml_float) v->i : v->f;
+}
+
+gocaml_string gocaml_json_to_string(void *const json)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("to_string", v, "string", JSON_STRING, JSON_STRING);
+    return v->s;
+}
+
+gocaml_int gocaml_json_length(void *const json)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("length", v, "array or object", JSON_ARRAY, JSON_OBJECT);
+    return v->size;
+}
+
+// Returns null pointer as 'None' when the index is out of range
+void *gocaml_json_get(void *const json, gocaml_int const idx)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("get", v, "array or object", JSON_ARRAY, JSON_OBJECT);
+    if (idx < 0 || idx >= v->size) {
+        return NULL;
+    }
+    return v->elems[idx];
+}
+
+gocaml_string gocaml_json_key(void *const json, gocaml_int const idx)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("key", v, "object", JSON_OBJECT, JSON_OBJECT);
+    if (idx < 0 || idx >= v->size) {
+        gocaml_string none;
+        none.chars = NULL;
+        none.size = 0;
+        return none;
+    }
+    gocaml_string const key = v->keys[idx];
+    // Empty key may not have characters, but null pointer means 'None'
+    return key.chars != NULL ? key : copy_string(NULL, 0);
+}
+
+// Returns the value of the last field with the key
+void *gocaml_json_member(void *const json, gocaml_string const key)
+{
+    json_t const* const v = (json_t const*) json;
+    json_expect("member", v, "object", JSON_OBJECT, JSON_OBJECT);
+    for (gocaml_int i = v->size - 1; i >= 0; --i) {
+        if (__str_equal(v->keys[i], key)) {
+            return v->elems[i];
+        }
+    }
+    return NULL;
+}
+
+static void json_append_str(output_t *const out, char const* const s)
+{
+    output_append(out, (int8_t const*) s, (gocaml_int) strlen(s));
+}
+
+static void json_encode_float(output_t *const out, gocaml_float const f)
+{
+    if (isnan(f) || isinf(f)) {
+        json_append_str(out, "null");
+        return;
+    }
+    char buf[SNPRINTF_MAX];
+    for (int prec = 1; prec <= 17; ++prec) {
+        snprintf(buf, SNPRINTF_MAX, "%.*g", prec, f);
+        if (strtod(buf, NULL) == f) {
+            break;
+        }
+    }
+    json_append_str(out, buf);
+    if (strspn(buf, "-0123456789") == strlen(buf)) {
+        json_append_str(out, ".0");
+    }
+}
+
+static void json_encode_string(output_t *const out, gocaml_string const s)
+{
+    static char const hex[] = "0123456789abcdef";
+    json_append_str(out, "\"");
+    for (gocaml_int i = 0; i < s.size; ++i) {
+        uint8_t const c = (uint8_t) s.chars[i];
+        char esc[7] = {'\\', 0, 0, 0, 0, 0, 0};
+        switch (c) {
+        case '"':
+        case '\\':
+            esc[1] = (char) c;
+            break;
+        case '\b':
+            esc[1] = 'b';
+            break;
+        case '\f':
+            esc[1] = 'f';
+            break;
+        case '\n':
+            esc[1] = 'n';
+            break;
+        case '\r':
+            esc[1] = 'r';
+            break;
+        case '\t':
+            esc[1] = 't';
+            break;
+        default:
+            if (c >= 0x20) {
+                output_append(out, s.chars + i, 1);
+                continue;
+            }
+            esc[1] = 'u';
+            esc[2] = esc[3] = '0';
+            esc[4] = hex[c >> 4];
+            esc[5] = hex[c & 0xf];
+            break;
+        }
+        json_append_str(out, esc);
+    }
+    json_append_str(out, "\"");
+}
+
+static void json_encode(output_t *const out, json_t const* const v)
+{
+    char buf[SNPRINTF_MAX];
+    switch (v->kind) {
+    case JSON_NULL:
+        json_append_str(out, "null");
+        return;
+    case JSON_BOOL:
+        json_append_str(out, v->i ? "true" : "false");
+        return;
+    case JSON_INT:
+        snprintf(buf, SNPRINTF_MAX, "%" PRId64, v->i);
+        json_append_str(out, buf);
+        return;
+    case JSON_FLOAT:
+        json_encode_float(out, v->f);
+        return;
+    case JSON_STRING:
+        json_encode_string(out, v->s);
+        return;
+    default:
+        break;
+    }
+    json_append_str(out, v->kind == JSON_ARRAY ? "[" : "{");
+    for (gocaml_int i = 0; i < v->size; ++i) {
+        if (i > 0) {
+            json_append_str(out, ",");
+        }
+        if (v->kind == JSON_OBJECT) {
+            json_encode_string(out, v->keys[i]);
+            json_append_str(out, ":");
+        }
+        json_encode(out, (json_t const*) v->elems[i]);
+    }
+    json_append_str(out, v->kind == JSON_ARRAY ? "]" : "}");
+}
+
+gocaml_string gocaml_json_encode(void *const json)
+{
+    output_t out = {NULL, 0, 0};
+    json_encode(&out, (json_t const*) json);
+    gocaml_string const ret = copy_string(out.chars, (gocaml_int) out.len);
+    free(out.chars);
+    return ret;
+}
+
+typedef struct {
+    gocaml_string src;
+    gocaml_int pos;
+    int depth;
+    output_t scratch; // Characters of string being decoded
+} json_decoder;
+
+static int json_eof(json_decoder const* const d)
+{
+    return d->pos >= d->src.size;
+}
+
+static uint8_t json_peek(json_decoder const* const d)
+{
+    return (uint8_t) d->src.chars[d->pos];
+}
+
+static void json_skip_spaces(json_decoder *const d)
+{
+    while (!json_eof(d)) {
+        switch (json_peek(d)) {
+        case ' ':
+        case '\t':
+        case '\n':
+        case '\r':
+            d->pos++;
+            break;
+        default:
+            return;
+        }
+    }
+}
+
+static int json_consume(json_decoder *const d, char const* const s)
+{
+    gocaml_int const len = (gocaml_int) strlen(s);
+    if (d->src.size - d->pos < len || memcmp(d->src.chars + d->pos, s, (size_t) len) != 0) {
+        return 0;
+    }
+    d->pos += len;
+    return 1;
+}
+
+// Returns -1 when next 4 characters are not hexadecimal digits
+static long json_hex4(json_decoder *const d)
+{
+    if (d->src.size - d->pos < 4) {
+        return -1;
+    }
+    long u = 0;
+    for (int i = 0; i < 4; ++i) {
+        uint8_t const c = json_peek(d);
+        d->pos++;
+        u <<= 4;
+        if ('0' <= c && c <= '9') {
+            u |= c - '0';
+        } else if ('a' <= c && c <= 'f') {
+            u |= c - 'a' + 10;
+        } else if ('A' <= c && c <= 'F') {
+            u |= c - 'A' + 10;
+        } else {
+            return -1;
+        }
+    }
+    return u;
+}
+
+static void json_append_utf8(output_t *const out, long const r)
+{
+    int8_t buf[4];
+    gocaml_int n;
+    if (r < 0x80) {
+        buf[0] = (int8_t) r;
+        n = 1;
+    } else if (r < 0x800) {
+        buf[0] = (int8_t) (0xc0 | (r >> 6));
+        buf[1] = (int8_t) (0x80 | (r & 0x3f));
+        n = 2;
+    } else if (r < 0x10000) {
+        buf[0] = (int8_t) (0xe0 | (r >> 12));
+        buf[1] = (int8_t) (0x80 | ((r >> 6) & 0x3f));
+        buf[2] = (int8_t) (0x80 | (r & 0x3f));
+        n = 3;
+    } else {
+        buf[0] = (int8_t) (0xf0 | (r >> 18));
+        buf[1] = (int8_t) (0x80 | ((r >> 12) & 0x3f));
+        buf[2] = (int8_t) (0x80 | ((r >> 6) & 0x3f));
+        buf[3] = (int8_t) (0x80 | (r & 0x3f));
+        n = 4;
+    }
+    output_append(out, buf, n);
+}
+
+// Decode the string into the scratch. Returns 0 on a syntax error.
+static int json_decode_chars(json_decoder *const d)
+{
+    d->scratch.len = 0;
+    d->pos++; // Eat '"'
+    while (!json_eof(d)) {
+        uint8_t const c = json_peek(d);
+        d->pos++;
+        if (c == '"') {
+            return 1;
+        }
+        if (c < 0x20) {
+            return 0;
+        }
+        if (c != '\\') {
+            output_append(&d->scratch, d->src.chars + d->pos - 1, 1);
+            continue;
+        }
+        if (json_eof(d)) {
+            return 0;
+        }
+        int8_t e = (int8_t) json_peek(d);
+        d->pos++;
+        switch (e) {
+        case '"':
+        case '\\':
+        case '/':
+            break;
+        case 'b':
+            e = '\b';
+            break;
+        case 'f':
+            e = '\f';
+            break;
+        case 'n':
+            e = '\n';
+            break;
+        case 'r':
+            e = '\r';
+            break;
+        case 't':
+            e = '\t';
+            break;
+        case 'u': {
+            long r = json_hex4(d);
+            if (r < 0 || (0xdc00 <= r && r <= 0xdfff)) {
+                return 0;
+            }
+            if (0xd800 <= r && r <= 0xdbff) {
+                // High surrogate must be followed by low surrogate
+                if (!json_consume(d, "\\u")) {
+                    return 0;
+                }
+                long const lo = json_hex4(d);
+                if (lo < 0xdc00 || 0xdfff < lo) {
+                    return 0;
+                }
+                r = 0x10000 + ((r - 0xd800) << 10) + (lo - 0xdc00);
+            }
+            json_append_utf8(&d->scratch, r);
+            continue;
+        }
+        default:
+            return 0;
+        }
+        output_append(&d->scratch, &e, 1);
+    }
+    return 0;
+}
+
+static int json_digits(json_decoder *const d)
+{
+    gocaml_int const start = d->pos;
+    while (!json_eof(d) && '0' <= json_peek(d) && json_peek(d) <= '9') {
+        d->pos++;
+    }
+    return d->pos > start;
+}
+
+// Numbers without fraction and exponent are integers unless they overflow
+static json_t *json_decode_number(json_decoder *const d)
+{
+    gocaml_int const start = d->pos;
+    int const neg = json_peek(d) == '-';
+    if (neg) {
+        d->pos++;
+    }
+    if (!json_eof(d) && json_peek(d) == '0') {
+        d->pos++;
+    } else if (!json_digits(d)) {
+        return NULL;
+    }
+    int integral = 1;
+    if (!json_eof(d) && json_peek(d) == '.') {
+        d->pos++;
+        if (!json_digits(d)) {
+            return NULL;
+        }
+        integral = 0;
+    }
+    if (!json_eof(d) && (json_peek(d) == 'e' || json_peek(d) == 'E')) {
+        d->pos++;
+        if (!json_eof(d) && (json_peek(d) == '+' || json_peek(d) == '-')) {
+            d->pos++;
+        }
+        if (!json_digits(d)) {
+            return NULL;
+        }
+        integral = 0;
+    }
+
+    if (integral) {
+        // Magnitude of the minimum integer is INT64_MAX + 1
+        uint64_t const limit = (uint64_t) INT64_MAX + (neg ? 1 : 0);
+        uint64_t u = 0;
+        gocaml_int i = start + (neg ? 1 : 0);
+        for (; i < d->pos; ++i) {
+            uint64_t const digit = (uint64_t) (d->src.chars[i] - '0');
+            if (u > (limit - digit) / 10) {
+                break;
+            }
+            u = u * 10 + digit;
+        }
+        if (i == d->pos) {
+            json_t *const v = json_new(JSON_INT);
+            v->i = neg ? (gocaml_int) (0 - u) : (gocaml_int) u;
+            return v;
+        }
+    }
+
+    gocaml_string lit;
+    lit.chars = d->src.chars + start;
+    lit.size = d->pos - start;
+    json_t *const v = json_new(JSON_FLOAT);
+    // Too large numbers are infinity
+    v->f = strtod(to_c_str(lit), NULL);
+    return v;
+}
+
+static json_t *json_decode_value(json_decoder *const d);
+
+// Decode elements of array or fields of object until the closing character. Elements are collected
+// in an array on C heap and copied to the value at the end.
+static json_t *json_decode_container(json_decoder *const d, gocaml_int const kind, char const* const closing)
+{
+    if (++d->depth > JSON_MAX_DEPTH) {
+        return NULL;
+    }
+    d->pos++; // Eat '[' or '{'
+    void **elems = NULL;
+    gocaml_string *keys = NULL;
+    size_t size = 0, cap = 0, keys_cap = 0;
+    json_t *v = NULL;
+
+    json_skip_spaces(d);
+    if (json_consume(d, closing)) {
+        goto done;
+    }
+    for (;;) {
+        if (kind == JSON_OBJECT) {
+            json_skip_spaces(d);
+            if (json_eof(d) || json_peek(d) != '"' || !json_decode_chars(d)) {
+                goto fail;
+            }
+            if (size == keys_cap) {
+                keys = (gocaml_string *) gc_grow(keys, &keys_cap, sizeof(gocaml_string));
+            }
+            keys[size] = copy_string(d->scratch.chars, (gocaml_int) d->scratch.len);
+            json_skip_spaces(d);
+            if (!json_consume(d, ":")) {
+                goto fail;
+            }
+        }
+        json_t *const e = json_decode_value(d);
+        if (e == NULL) {
+            goto fail;
+        }
+        if (size == cap) {
+            elems = (void **) gc_grow(elems, &cap, sizeof(void *));
+        }
+        elems[size++] = e;
+        json_skip_spaces(d);
+        if (json_consume(d, closing)) {
+            break;
+        }
+        if (!json_consume(d, ",")) {
+            goto fail;
+        }
+    }
+
+done:
+    v = json_new_container(kind, (gocaml_int) size);
+    for (size_t i = 0; i < size; ++i) {
+        v->elems[i] = elems[i];
+        gocaml_retain(elems[i]);
+        if (kind == JSON_OBJECT) {
+            v->keys[i] = keys[i];
+            gocaml_retain(keys[i].chars);
+        }
+    }
+    d->depth--;
+fail:
+    free(elems);
+    free(keys);
+    return v;
+}
+
+static json_t *json_decode_value(json_decoder *const d)
+{
+    json_skip_spaces(d);
+    if (json_eof(d)) {
+        return NULL;
+    }
+    uint8_t const c = json_peek(d);
+    json_t *v;
+    switch (c) {
+    case 'n':
+        return json_consume(d, "null") ? json_new(JSON_NULL) : NULL;
+    case 't':
+    case 'f':
+        if (!json_consume(d, c == 't' ? "true" : "false")) {
+            return NULL;
+        }
+        v = json_new(JSON_BOOL);
+        v->i = c == 't';
+        return v;
+    case '"':
+        if (!json_decode_chars(d)) {
+            return NULL;
+        }
+        v = json_new(JSON_STRING);
+        v->s = copy_string(d->scratch.chars, (gocaml_int) d->scratch.len);
+        gocaml_retain(v->s.chars);
+        return v;
+    case '[':
+        return json_decode_container(d, JSON_ARRAY, "]");
+    case '{':
+        return json_decode_container(d, JSON_OBJECT, "}");
+    default:
+        if (c == '-' || ('0' <= c && c <= '9')) {
+            return json_decode_number(d);
+        }
+        return NULL;
+    }
+}
+
+// Parses the whole string as one JSON value. Spaces around the value are allowed. Returns null
+// pointer as 'None' on a syntax error.
+void *gocaml_json_decode(gocaml_string const s)
+{
+    // Decoded values are only held by arrays on C heap until their container is built
+    if (__gocaml_gc == GC_KIND_BOEHM) {
+        GC_disable();
+    } else {
+        gc.disabled++;
+    }
+    json_decoder d = {s, 0, 0, {NULL, 0, 0}};
+    json_t *v = json_decode_value(&d);
+    json_skip_spaces(&d);
+    if (!json_eof(&d)) {
+        v = NULL;
+    }
+    free(d.scratch.chars);
+    if (__gocaml_gc == GC_KIND_BOEHM) {
+        GC_enable();
+    } else {
+        gc.disabled--;
+    }
+    return v;
+}
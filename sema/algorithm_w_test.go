@@ -20,7 +20,15 @@ func testInferCodeWithoutConv(code string) (types.Type, error) {
 	}
 	i := NewInferer(env)
 	// nodeTypeConv is unnecessary because no type annotation is contained in test cases
-	return i.infer(ast.Root, 0)
+	t, err := i.infer(ast.Root, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.solve(); err != nil {
+		return nil, err
+	}
+	i.defaultNumLiterals()
+	return t, nil
 }
 
 func TestInferAlgoWOK(t *testing.T) {
@@ -3,8 +3,11 @@ package sema
 import (
 	"fmt"
 	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/common"
+	"github.com/rhysd/gocaml/token"
 	"github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
+	"strings"
 )
 
 // Alpha transform.
@@ -31,13 +34,30 @@ func duplicateSymbol(symbols []*ast.Symbol) *ast.Symbol {
 
 func isBuiltinTypeCtor(name string) bool {
 	switch name {
-	case "_", "array", "option", "unit", "int", "bool", "float", "string":
+	case "_", "array", "option", "result", "table", "unit", "int", "bool", "float", "string", "buffer", "json":
 		return true
 	default:
 		return false
 	}
 }
 
+// isSpecialBuiltin returns true when the name is a built-in function which is not an external symbol.
+// They are handled by the compiler directly.
+func isSpecialBuiltin(name string) bool {
+	switch name {
+	case printfName, optionGetName, exitName:
+		return true
+	}
+	_, ok := tablePrimitives[name]
+	return ok
+}
+
+// declaration is a position where a variable is declared. It is remembered to report shadowing.
+type declaration struct {
+	pos       locerr.Pos
+	generated bool
+}
+
 type transformer struct {
 	current   *scope
 	typeScope *scope
@@ -45,6 +65,8 @@ type transformer struct {
 	tyId      uint
 	err       error
 	externals map[string]struct{}
+	warnings  *Warnings
+	decls     map[*ast.Symbol]declaration
 }
 
 func newTransformer() *transformer {
@@ -54,6 +76,8 @@ func newTransformer() *transformer {
 		varId:     0,
 		tyId:      0,
 		externals: nil,
+		warnings:  nil,
+		decls:     map[*ast.Symbol]declaration{},
 	}
 }
 
@@ -79,6 +103,57 @@ func (t *transformer) register(s *ast.Symbol) {
 	t.current.mapSymbol(s.DisplayName, s)
 }
 
+// declarationSpan returns the keyword token of the node declaring variables and the end of the range
+// to report warnings. The range does not contain the body of the declaration.
+func declarationSpan(node ast.Expr) (*token.Token, locerr.Pos) {
+	switch n := node.(type) {
+	case *ast.Let:
+		return n.LetToken, n.Bound.End()
+	case *ast.LetRec:
+		return n.LetToken, n.Func.Body.Pos()
+	case *ast.LetTuple:
+		return n.LetToken, n.Bound.End()
+	default:
+		panic("FATAL: Unknown declaration node: " + node.Name())
+	}
+}
+
+// paramSpan returns the range of the parameter of the function declared by 'let rec' to report
+// warnings. When the parameter was generated by compiler, the range of the declaration is returned.
+func paramSpan(node *ast.LetRec, param *ast.Symbol) (locerr.Pos, locerr.Pos) {
+	if param.Token == nil {
+		return node.Pos(), node.Func.Body.Pos()
+	}
+	return param.Token.Start, param.Token.End
+}
+
+// declare registers the symbol declared by 'let' or parameter. It reports a warning when the symbol
+// shadows a visible variable declared by user.
+func (t *transformer) declare(s *ast.Symbol, node ast.Expr, param bool) {
+	if t.warnings == nil || s.IsIgnored() {
+		t.register(s)
+		return
+	}
+
+	tok, end := declarationSpan(node)
+	start := node.Pos()
+	if param {
+		start, end = paramSpan(node.(*ast.LetRec), s)
+	}
+	// Note:
+	// Nodes derived from [@@deriving] attribute have the attribute token instead of keyword token.
+	// Names starting with '$' are generated while parsing (e.g. 'for' loop).
+	generated := tok.Kind == token.IDENT || strings.HasPrefix(s.DisplayName, "$")
+	if prev, ok := t.current.resolve(s.DisplayName); ok && !generated && !strings.HasPrefix(s.DisplayName, "_") {
+		if d, ok := t.decls[prev]; ok && !d.generated {
+			w := t.warnings.Warnf(WarnShadowing, SeverityWarning, start, end, "Variable '%s' shadows the variable declared before. Use a different name if it is not intended", s.DisplayName)
+			w.NotefAt(d.pos, "Shadowed variable '%s' is declared here", s.DisplayName)
+		}
+	}
+	t.register(s)
+	t.decls[s] = declaration{start, generated}
+}
+
 func (t *transformer) nest() {
 	t.current = newScope(t.current)
 }
@@ -96,7 +171,7 @@ func (t *transformer) VisitTopdown(node ast.Expr) ast.Visitor {
 			ast.Visit(t, n.Type)
 		}
 		t.nest()
-		t.register(n.Symbol)
+		t.declare(n.Symbol, n, false)
 		ast.Visit(t, n.Body)
 		t.pop()
 		return nil
@@ -106,13 +181,16 @@ func (t *transformer) VisitTopdown(node ast.Expr) ast.Visitor {
 			return nil
 		}
 		t.nest()
-		t.register(n.Func.Symbol)
+		t.declare(n.Func.Symbol, n, false)
+		if n.Func.Poly != nil {
+			ast.Visit(t, n.Func.Poly)
+		}
 		t.nest()
 		for _, p := range n.Func.Params {
 			if p.Type != nil {
 				ast.Visit(t, p.Type)
 			}
-			t.register(p.Ident)
+			t.declare(p.Ident, n, true)
 		}
 		if n.Func.RetType != nil {
 			ast.Visit(t, n.Func.RetType)
@@ -133,7 +211,7 @@ func (t *transformer) VisitTopdown(node ast.Expr) ast.Visitor {
 		}
 		t.nest()
 		for _, e := range n.Symbols {
-			t.register(e)
+			t.declare(e, n, false)
 		}
 		ast.Visit(t, n.Body)
 		t.pop()
@@ -146,6 +224,28 @@ func (t *transformer) VisitTopdown(node ast.Expr) ast.Visitor {
 		t.pop()
 		ast.Visit(t, n.IfNone)
 		return nil
+	case *ast.MatchResult:
+		ast.Visit(t, n.Target)
+		t.nest()
+		t.register(n.OkIdent)
+		ast.Visit(t, n.IfOk)
+		t.pop()
+		t.nest()
+		t.register(n.ErrorIdent)
+		ast.Visit(t, n.IfError)
+		t.pop()
+		return nil
+	case *ast.MatchVariant:
+		ast.Visit(t, n.Target)
+		for _, a := range n.Arms {
+			t.nest()
+			if a.Ident != nil {
+				t.register(a.Ident)
+			}
+			ast.Visit(t, a.Body)
+			t.pop()
+		}
+		return nil
 	case *ast.VarRef:
 		if n.Symbol.DisplayName == "_" {
 			// Note: Check '_'. Without this check, compiler will consdier it as
@@ -158,10 +258,18 @@ func (t *transformer) VisitTopdown(node ast.Expr) ast.Visitor {
 			return nil
 		}
 		// Check external it's an external symbol
-		if _, ok := t.externals[n.Symbol.Name]; !ok {
-			t.err = locerr.ErrorfIn(n.Pos(), n.End(), "Undefined variable '%s'", n.Symbol.DisplayName)
+		if _, ok := t.externals[n.Symbol.Name]; !ok && !isSpecialBuiltin(n.Symbol.Name) {
+			err := locerr.ErrorfIn(n.Pos(), n.End(), "Undefined variable '%s'", n.Symbol.DisplayName)
+			if similar := t.similarNames(n.Symbol.DisplayName); len(similar) > 0 {
+				err = err.NotefAt(n.Pos(), "Did you mean %s?", similar)
+			}
+			t.err = err
 		}
 		return nil
+	case *ast.Hole:
+		// Remember visible symbols to show candidates for the hole in type inference
+		n.Scope = t.current.symbols()
+		return nil
 	case *ast.CtorType:
 		if isBuiltinTypeCtor(n.Ctor.DisplayName) {
 			// '_' or other builtin types such as 'int' should not be alpha-transformed and handled as-is.
@@ -180,29 +288,103 @@ func (t *transformer) VisitTopdown(node ast.Expr) ast.Visitor {
 	}
 }
 
+// similarNames returns names of visible variables and external symbols which are close to the
+// undefined name, formatted as "'foo', 'bar' or 'piyo'". It returns an empty string when no
+// candidate is found.
+func (t *transformer) similarNames(name string) string {
+	candidates := []string{printfName, optionGetName, exitName}
+	for n := range tablePrimitives {
+		candidates = append(candidates, n)
+	}
+	for _, s := range t.current.symbols() {
+		if !s.IsIgnored() && !strings.HasPrefix(s.DisplayName, "$") {
+			candidates = append(candidates, s.DisplayName)
+		}
+	}
+	for n := range t.externals {
+		// Built-in symbols only for compiler contain '$'
+		if !strings.Contains(n, "$") {
+			candidates = append(candidates, n)
+		}
+	}
+
+	similar := common.SimilarNames(name, candidates, 3)
+	for i, s := range similar {
+		similar[i] = "'" + s + "'"
+	}
+	switch len(similar) {
+	case 0:
+		return ""
+	case 1:
+		return similar[0]
+	default:
+		last := len(similar) - 1
+		return strings.Join(similar[:last], ", ") + " or " + similar[last]
+	}
+}
+
 func (t *transformer) VisitBottomup(ast.Expr) {
 	return
 }
 
+func (t *transformer) typeDecls(group []*ast.TypeDecl, namesFirst bool) error {
+	if namesFirst {
+		seen := make(map[string]*ast.TypeDecl, len(group))
+		for _, decl := range group {
+			if prev, ok := seen[decl.Ident.DisplayName]; ok {
+				return locerr.ErrorfIn(decl.Pos(), decl.End(), "Type '%s' is declared twice in the same 'type ... and ...' group", decl.Ident.DisplayName).NoteAt(prev.Pos(), "Previous declaration is here")
+			}
+			seen[decl.Ident.DisplayName] = decl
+			if err := t.registerTypeName(decl); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, decl := range group {
+		ast.Visit(t, decl.Type)
+		if t.err != nil {
+			return t.err
+		}
+		if !namesFirst {
+			if err := t.registerTypeName(decl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *transformer) registerTypeName(decl *ast.TypeDecl) error {
+	i := decl.Ident
+	if isBuiltinTypeCtor(i.DisplayName) {
+		return locerr.ErrorfIn(decl.Pos(), decl.End(), "Cannot redefine built-in type '%s'", i.DisplayName)
+	}
+
+	// Note: Overwrite previous type mapping if already existing
+	i.Name = t.newTyID(i.DisplayName)
+	t.typeScope.mapSymbol(i.DisplayName, i)
+	return nil
+}
+
 // AlphaTransform adds identical names to all identifiers in AST nodes.
 // If there are some duplicate names, it causes an error.
 // External symbols are named the same as display names.
 func AlphaTransform(tree *ast.AST, env *types.Env) error {
-	v := newTransformer()
-	for _, decl := range tree.TypeDecls {
-		ast.Visit(v, decl.Type)
-		if v.err != nil {
-			return v.err
-		}
+	return alphaTransform(tree, env, nil)
+}
 
-		i := decl.Ident
-		if isBuiltinTypeCtor(i.DisplayName) {
-			return locerr.ErrorfIn(decl.Pos(), decl.End(), "Cannot redefine built-in type '%s'", i.DisplayName)
+// alphaTransform is the same as AlphaTransform but reports shadowing variables to the warnings.
+func alphaTransform(tree *ast.AST, env *types.Env, ws *Warnings) error {
+	v := newTransformer()
+	v.warnings = ws
+	for _, group := range ast.TypeDeclGroups(tree.TypeDecls) {
+		// Names in group declared with 'and' are registered at first so that types in the group can
+		// refer each other. Type declared alone cannot refer itself. Its name in the type refers
+		// previous declaration.
+		if err := v.typeDecls(group, len(group) > 1); err != nil {
+			return err
 		}
-
-		// Note: Overwrite previous type mapping if already existing
-		i.Name = v.newTyID(i.DisplayName)
-		v.typeScope.mapSymbol(i.DisplayName, i)
 	}
 
 	exts := make(map[string]struct{}, len(tree.Externals)+len(env.Externals))
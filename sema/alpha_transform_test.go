@@ -2,6 +2,7 @@ package sema
 
 import (
 	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/gocaml/token"
 	"github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
@@ -199,6 +200,7 @@ func TestLetRec(t *testing.T) {
 			},
 			ref2,
 			nil,
+			nil,
 		},
 		ref,
 	}
@@ -250,6 +252,7 @@ func TestRecursiveFunc(t *testing.T) {
 			},
 			ref,
 			nil,
+			nil,
 		},
 		&ast.Int{tok, 42},
 	}
@@ -288,6 +291,7 @@ func TestFuncAndParamHaveSameName(t *testing.T) {
 			},
 			ref,
 			nil,
+			nil,
 		},
 		ref2,
 	}
@@ -327,6 +331,7 @@ func TestParamDuplicate(t *testing.T) {
 			},
 			&ast.Int{tok, 42},
 			nil,
+			nil,
 		},
 		&ast.Int{tok, 42},
 	}
@@ -361,6 +366,12 @@ func TestInvalidTypeAlias(t *testing.T) {
 		End:   pos,
 		File:  locerr.NewDummySource(""),
 	}
+	andTok := &token.Token{
+		Kind:  token.AND,
+		Start: pos,
+		End:   pos,
+		File:  locerr.NewDummySource(""),
+	}
 	prim := func(name string) ast.Expr {
 		return &ast.CtorType{
 			nil,
@@ -379,7 +390,7 @@ func TestInvalidTypeAlias(t *testing.T) {
 		{
 			what: "cannot define '_'",
 			types: []*ast.TypeDecl{
-				{tok, ast.NewSymbol("_"), prim("int")},
+				{tok, ast.NewSymbol("_"), prim("int"), nil},
 			},
 			root: &ast.Unit{tok, tok},
 			err:  "Cannot redefine built-in type '_'",
@@ -387,7 +398,7 @@ func TestInvalidTypeAlias(t *testing.T) {
 		{
 			what: "cannot define primitive type",
 			types: []*ast.TypeDecl{
-				{tok, ast.NewSymbol("float"), prim("int")},
+				{tok, ast.NewSymbol("float"), prim("int"), nil},
 			},
 			root: &ast.Unit{tok, tok},
 			err:  "Cannot redefine built-in type 'float'",
@@ -395,11 +406,28 @@ func TestInvalidTypeAlias(t *testing.T) {
 		{
 			what: "undefined type name in type decls",
 			types: []*ast.TypeDecl{
-				{tok, ast.NewSymbol("foo"), prim("bar")},
+				{tok, ast.NewSymbol("foo"), prim("bar"), nil},
 			},
 			root: &ast.Unit{tok, tok},
 			err:  "Undefined type name 'bar'",
 		},
+		{
+			what: "duplicate type name in group",
+			types: []*ast.TypeDecl{
+				{tok, ast.NewSymbol("foo"), prim("int"), nil},
+				{andTok, ast.NewSymbol("foo"), prim("bool"), nil},
+			},
+			root: &ast.Unit{tok, tok},
+			err:  "Type 'foo' is declared twice in the same 'type ... and ...' group",
+		},
+		{
+			what: "type declared alone cannot refer itself",
+			types: []*ast.TypeDecl{
+				{tok, ast.NewSymbol("foo"), prim("foo"), nil},
+			},
+			root: &ast.Unit{tok, tok},
+			err:  "Undefined type name 'foo'",
+		},
 	}
 
 	env := types.NewEnv()
@@ -456,8 +484,8 @@ func TestTypeAlias(t *testing.T) {
 
 	ty2 := prim(ast.NewSymbol("foo"))
 	decls := []*ast.TypeDecl{
-		{tok, foo, prim(primitive)},
-		{tok, bar, ty2},
+		{tok, foo, prim(primitive), nil},
+		{tok, bar, ty2, nil},
 	}
 
 	tree := &ast.AST{root, decls, nil}
@@ -627,3 +655,63 @@ func TestUndefinedSymbol(t *testing.T) {
 		t.Fatal("Unexpected error message:", have, ", wanted:", want)
 	}
 }
+
+func TestUndefinedSymbolSuggestion(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+		want string
+	}{
+		{
+			what: "local variable",
+			code: "let counter = 1 in println_int countr",
+			want: "Did you mean 'counter'?",
+		},
+		{
+			what: "built-in function",
+			code: "printn_int 1",
+			want: "Did you mean 'print_int' or 'println_int'?",
+		},
+		{
+			what: "external symbol",
+			code: "external my_func : int -> int = \"my_func\"; println_int (my_fnuc 1)",
+			want: "Did you mean 'my_func'?",
+		},
+		{
+			what: "parameter",
+			code: "let rec f value = valeu + 1 in println_int (f 1)",
+			want: "Did you mean 'value'?",
+		},
+		{
+			what: "variable out of scope is not suggested",
+			code: "let rec f value = value + 1 in println_int (valeu + f 1)",
+			want: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = AlphaTransform(parsed, types.NewEnv())
+			if err == nil {
+				t.Fatal("Error should have been caused")
+			}
+			msg := err.Error()
+			if !strings.Contains(msg, "Undefined variable") {
+				t.Fatal("Unexpected error message:", msg)
+			}
+			if tc.want == "" {
+				if strings.Contains(msg, "Did you mean") {
+					t.Fatal("Nothing should be suggested:", msg)
+				}
+				return
+			}
+			if !strings.Contains(msg, tc.want) {
+				t.Fatalf("Error message '%s' does not contain '%s'", msg, tc.want)
+			}
+		})
+	}
+}
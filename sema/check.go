@@ -0,0 +1,52 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"sync"
+)
+
+// Check is an additional check of program. It receives the type environment, the root of program
+// and the inferred types after all type variables are dereferenced, and returns errors it found.
+// It must not modify any of them.
+type Check func(*types.Env, ast.Expr, InferredTypes) []*locerr.Error
+
+var (
+	checksLock sync.RWMutex
+	checks     []Check
+)
+
+// RegisterCheck registers the check which runs after type inference. It is intended that external
+// tools add their project-specific lint checks without modifying this package. Checks run in the
+// order of registration and analysis fails when some check returns errors.
+func RegisterCheck(c Check) {
+	checksLock.Lock()
+	checks = append(checks, c)
+	checksLock.Unlock()
+}
+
+// runChecks runs all registered checks. When multiple errors are returned, the first one is reported
+// and the others are added to it as notes.
+func runChecks(env *types.Env, root ast.Expr, inferred InferredTypes) *locerr.Error {
+	checksLock.RLock()
+	defer checksLock.RUnlock()
+
+	var err *locerr.Error
+	for _, c := range checks {
+		for _, e := range c(env, root, inferred) {
+			if err == nil {
+				err = e
+				continue
+			}
+			for i, msg := range e.Messages {
+				if i == 0 {
+					err = err.NoteAt(e.Start, msg)
+				} else {
+					err = err.Note(msg)
+				}
+			}
+		}
+	}
+	return err
+}
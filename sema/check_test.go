@@ -0,0 +1,70 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+type forbiddenNameFinder struct {
+	errs []*locerr.Error
+}
+
+func (f *forbiddenNameFinder) VisitTopdown(e ast.Expr) ast.Visitor {
+	if let, ok := e.(*ast.Let); ok && strings.HasPrefix(let.Symbol.DisplayName, "forbidden_") {
+		f.errs = append(f.errs, locerr.ErrorfIn(let.Pos(), let.End(), "Variable name '%s' is forbidden", let.Symbol.DisplayName))
+	}
+	return f
+}
+
+func (f *forbiddenNameFinder) VisitBottomup(ast.Expr) {}
+
+func init() {
+	RegisterCheck(func(env *types.Env, root ast.Expr, inferred InferredTypes) []*locerr.Error {
+		f := &forbiddenNameFinder{}
+		ast.Visit(f, root)
+		return f.errs
+	})
+}
+
+func TestRegisteredCheck(t *testing.T) {
+	for _, tc := range []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{"no error", "let allowed = 1 in println_int allowed", nil},
+		{"single error", "let forbidden_x = 1 in println_int forbidden_x", []string{"Variable name 'forbidden_x' is forbidden"}},
+		{
+			"multiple errors",
+			"let forbidden_x = 1 in let forbidden_y = 2 in println_int (forbidden_x + forbidden_y)",
+			[]string{"Variable name 'forbidden_x' is forbidden", "Variable name 'forbidden_y' is forbidden"},
+		},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if len(tc.expected) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			msg := err.Error()
+			for _, e := range tc.expected {
+				if !strings.Contains(msg, e) {
+					t.Errorf("Error message '%s' does not contain '%s'", msg, e)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Comparisons with '=' and '<>' whose results are obvious at compile time are often left by mistakes
+// on refactoring. They are reported while dereferencing type variables.
+//   if 1 = 2 then ...      (* Constants are compared *)
+//   if x <> x then ...     (* Variable is compared with itself *)
+// Comparing a float variable with itself is not reported because it is a common idiom to check NaN.
+
+// constantOf returns the value of literal. Integer and float values are returned as int64 and
+// float64. Unit value is returned as struct{}.
+func constantOf(e ast.Expr) (interface{}, bool) {
+	switch e := e.(type) {
+	case *ast.Unit:
+		return struct{}{}, true
+	case *ast.Bool:
+		return e.Value, true
+	case *ast.Int:
+		return e.Value, true
+	case *ast.Float:
+		return e.Value, true
+	case *ast.String:
+		return e.Value, true
+	default:
+		return nil, false
+	}
+}
+
+func constantEquals(l, r interface{}) bool {
+	// Integer literal may be typed as float
+	if i, ok := l.(int64); ok {
+		if f, ok := r.(float64); ok {
+			return float64(i) == f
+		}
+	}
+	if f, ok := l.(float64); ok {
+		if i, ok := r.(int64); ok {
+			return f == float64(i)
+		}
+	}
+	return l == r
+}
+
+// comparisonResult returns the result of comparing the operands for equality when it is known at
+// compile time. The reason is also returned.
+func (d *typeVarDereferencer) comparisonResult(left, right ast.Expr) (bool, string, bool) {
+	if l, ok := constantOf(left); ok {
+		if r, ok := constantOf(right); ok {
+			return constantEquals(l, r), "both operands are constants", true
+		}
+		return false, "", false
+	}
+
+	lref, ok := left.(*ast.VarRef)
+	if !ok {
+		return false, "", false
+	}
+	rref, ok := right.(*ast.VarRef)
+	if !ok || lref.Symbol.Name != rref.Symbol.Name {
+		return false, "", false
+	}
+	if d.inferred[left] == FloatType {
+		// x = x is false when x is NaN
+		return false, "", false
+	}
+	return true, "variable '" + lref.Symbol.DisplayName + "' is compared with itself", true
+}
+
+// checkComparison reports '=' and '<>' expressions whose results are known at compile time.
+func (d *typeVarDereferencer) checkComparison(node ast.Expr) {
+	if d.warnings == nil {
+		return
+	}
+
+	var left, right ast.Expr
+	var op string
+	var equal bool
+	switch n := node.(type) {
+	case *ast.Eq:
+		left, right, op, equal = n.Left, n.Right, "=", true
+	case *ast.NotEq:
+		left, right, op, equal = n.Left, n.Right, "<>", false
+	default:
+		return
+	}
+
+	eq, reason, ok := d.comparisonResult(left, right)
+	if !ok {
+		return
+	}
+	d.warnings.Warnf(WarnConstantComparison, SeverityWarning, node.Pos(), node.End(), "Comparison with operator '%s' is always %v because %s", op, eq == equal, reason)
+}
@@ -0,0 +1,52 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestConstantComparisonWarnings(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{"distinct integers", "println_bool (1 = 2)", []string{"Comparison with operator '=' is always false because both operands are constants"}},
+		{"same strings", `println_bool ("a" <> "a")`, []string{"Comparison with operator '<>' is always false because both operands are constants"}},
+		{"integer typed as float", "println_bool (1 = 1.0)", []string{"operator '=' is always true"}},
+		{"booleans", "println_bool (true <> false)", []string{"operator '<>' is always true"}},
+		{"variable with itself", "let x = 1 in println_bool (x = x)", []string{"always true because variable 'x' is compared with itself"}},
+		{"variable with itself by not equal", "let s = \"a\" in println_bool (s <> s)", []string{"always false because variable 's' is compared with itself"}},
+		{"float variable with itself", "let f = 1.0 in println_bool (f = f)", nil},
+		{"different variables", "let x = 1 in let y = 2 in println_bool (x = y)", nil},
+		{"variable and constant", "let x = 1 in println_bool (x = 1)", nil},
+		{"less than", "println_bool (1 < 2)", nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := NewWarnings()
+			if err := ws.Configure("none,W005"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+				t.Fatal(err)
+			}
+			list := ws.List()
+			if len(list) != len(tc.expected) {
+				t.Fatalf("Expected %d warnings but got %v", len(tc.expected), list)
+			}
+			for i, w := range list {
+				if !strings.Contains(w.String(), tc.expected[i]) {
+					t.Errorf("Warning '%s' does not contain '%s'", w.String(), tc.expected[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package sema
+
+import (
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// Relational operators are overloaded. '=' and '<>' are available for types which satisfy Eq and
+// '<', '<=', '>' and '>=' are available for types which satisfy Ord.
+//
+//   Eq:   unit, bool, int, float, string, functions, and tuples and options of Eq types
+//   Ord:  int, float
+//   Num:  int, float
+//   Hash: int, string
+//
+// When an operand of the operators is not determined yet, the constraint is put on its type variable
+// and checked when the variable is resolved. The constraint is kept through generalization and
+// instantiation. So the check for a polymorphic function is done at each instantiation.
+//   let rec lt a b = a < b in
+//   lt 1 2;        (* OK *)
+//   lt true false  (* Error: 'bool' does not satisfy Ord *)
+//
+// Num is not put by operators. It is put on types of integer literals. See num_literal.go. Hash is
+// put on types of keys of tables. See table.go. Since a type variable can remember only one
+// constraint, the variable is resolved to 'int' when it is constrained by both Hash and Ord (or Num).
+
+func unsatisfied(t Type, c Constraint) *locerr.Error {
+	if c == NumConstraint {
+		return locerr.Errorf("Type '%s' does not satisfy constraint 'Num'. Integer literal can only be typed as 'int' or 'float'", t.String())
+	}
+	if c == OrdConstraint {
+		return locerr.Errorf("Type '%s' does not satisfy constraint 'Ord'. Only 'int' and 'float' values can be compared with operators '<', '<=', '>' and '>='", t.String())
+	}
+	if c == HashConstraint {
+		return locerr.Errorf("Type '%s' does not satisfy constraint 'Hash'. Only 'int' and 'string' values can be keys of table", t.String())
+	}
+	return locerr.Errorf("Type '%s' does not satisfy constraint 'Eq'. Arrays, tables, buffers, JSON values and polymorphic variants cannot be compared with operators '=' and '<>'", t.String())
+}
+
+// satisfy checks the type satisfies the constraint. When the type contains unresolved type variables,
+// the constraint is propagated to them.
+func satisfy(t Type, c Constraint) *locerr.Error {
+	if c == NoConstraint {
+		return nil
+	}
+
+	switch t := t.(type) {
+	case *Var:
+		if t.Ref != nil {
+			return satisfy(t.Ref, c)
+		}
+		if isOrdAndHash(c, t.Constraint) {
+			t.Ref = IntType
+			return nil
+		}
+		// Ord implies Eq. So stronger one is kept.
+		if c > t.Constraint {
+			t.Constraint = c
+		}
+		return nil
+	case *Int:
+		return nil
+	case *Float:
+		if c != HashConstraint {
+			return nil
+		}
+	case *String:
+		if c == EqConstraint || c == HashConstraint {
+			return nil
+		}
+	case *Unit, *Bool, *Fun:
+		if c == EqConstraint {
+			return nil
+		}
+	case *Tuple:
+		if c != EqConstraint {
+			break
+		}
+		for _, e := range t.Elems {
+			if err := satisfy(e, c); err != nil {
+				return locerr.Notef(err, "On checking element types of tuple '%s'", t.String())
+			}
+		}
+		return nil
+	case *Option:
+		if c != EqConstraint {
+			break
+		}
+		if err := satisfy(t.Elem, c); err != nil {
+			return locerr.Notef(err, "On checking element type of option '%s'", t.String())
+		}
+		return nil
+	case *Result:
+		if c != EqConstraint {
+			break
+		}
+		if err := satisfy(t.Ok, c); err != nil {
+			return locerr.Notef(err, "On checking 'Ok' type of result '%s'", t.String())
+		}
+		if err := satisfy(t.Error, c); err != nil {
+			return locerr.Notef(err, "On checking 'Error' type of result '%s'", t.String())
+		}
+		return nil
+	}
+
+	return unsatisfied(t, c)
+}
+
+// isOrdAndHash returns true when one of the constraints is Hash and another is Ord or Num.
+func isOrdAndHash(l, r Constraint) bool {
+	if l == HashConstraint {
+		l, r = r, l
+	}
+	return r == HashConstraint && (l == OrdConstraint || l == NumConstraint)
+}
@@ -0,0 +1,229 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestSatisfy(t *testing.T) {
+	cases := []struct {
+		what string
+		t    Type
+		c    Constraint
+		ok   bool
+	}{
+		{"int is Ord", IntType, OrdConstraint, true},
+		{"float is Ord", FloatType, OrdConstraint, true},
+		{"bool is not Ord", BoolType, OrdConstraint, false},
+		{"string is not Ord", StringType, OrdConstraint, false},
+		{"string is Eq", StringType, EqConstraint, true},
+		{"function is Eq", &Fun{IntType, []Type{IntType}}, EqConstraint, true},
+		{"tuple of Eq is Eq", &Tuple{[]Type{IntType, &Option{BoolType}}}, EqConstraint, true},
+		{"tuple is not Ord", &Tuple{[]Type{IntType, IntType}}, OrdConstraint, false},
+		{"array is not Eq", &Array{IntType}, EqConstraint, false},
+		{"tuple containing array is not Eq", &Tuple{[]Type{IntType, &Array{IntType}}}, EqConstraint, false},
+		{"option of array is not Eq", &Option{&Array{IntType}}, EqConstraint, false},
+		{"result of Eq is Eq", &Result{IntType, StringType}, EqConstraint, true},
+		{"result is not Ord", &Result{IntType, IntType}, OrdConstraint, false},
+		{"result of array is not Eq", &Result{IntType, &Array{IntType}}, EqConstraint, false},
+		{"int is Hash", IntType, HashConstraint, true},
+		{"string is Hash", StringType, HashConstraint, true},
+		{"float is not Hash", FloatType, HashConstraint, false},
+		{"tuple is not Hash", &Tuple{[]Type{IntType, IntType}}, HashConstraint, false},
+		{"table is not Eq", &Table{IntType, IntType}, EqConstraint, false},
+		{"buffer is not Eq", BufferType, EqConstraint, false},
+		{"buffer is not Hash", BufferType, HashConstraint, false},
+		{"json is not Eq", JsonType, EqConstraint, false},
+		{"variant is not Eq", &Variant{[]*VariantTag{{"A", nil}}, nil}, EqConstraint, false},
+		{"linked variable", NewVar(IntType, 0), OrdConstraint, true},
+		{"no constraint", &Array{IntType}, NoConstraint, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			err := satisfy(tc.t, tc.c)
+			if tc.ok && err != nil {
+				t.Fatalf("'%s' should satisfy %s but got error: %s", tc.t.String(), tc.c.String(), err.Error())
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("'%s' should not satisfy %s", tc.t.String(), tc.c.String())
+			}
+		})
+	}
+}
+
+func TestSatisfyPropagatesConstraint(t *testing.T) {
+	v := NewVar(nil, 0)
+	if err := satisfy(&Tuple{[]Type{IntType, v}}, EqConstraint); err != nil {
+		t.Fatal(err)
+	}
+	if v.Constraint != EqConstraint {
+		t.Fatal("Eq constraint was not propagated to type variable:", v.Constraint)
+	}
+	if err := satisfy(v, OrdConstraint); err != nil {
+		t.Fatal(err)
+	}
+	if v.Constraint != OrdConstraint {
+		t.Fatal("Constraint should be strengthened to Ord:", v.Constraint)
+	}
+	if err := satisfy(v, EqConstraint); err != nil {
+		t.Fatal(err)
+	}
+	if v.Constraint != OrdConstraint {
+		t.Fatal("Constraint should not be weakened to Eq:", v.Constraint)
+	}
+
+	if err := Unify(v, BoolType); err == nil {
+		t.Fatal("Type variable constrained by Ord must not be resolved to bool")
+	}
+	if err := Unify(v, FloatType); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSatisfyHashAndOrd(t *testing.T) {
+	v := NewVar(nil, 0)
+	if err := satisfy(v, HashConstraint); err != nil {
+		t.Fatal(err)
+	}
+	if err := satisfy(v, EqConstraint); err != nil {
+		t.Fatal(err)
+	}
+	if v.Constraint != HashConstraint {
+		t.Fatal("Constraint should not be weakened to Eq:", v.Constraint)
+	}
+	if err := Unify(v, FloatType); err == nil {
+		t.Fatal("Type variable constrained by Hash must not be resolved to float")
+	}
+	if err := satisfy(v, OrdConstraint); err != nil {
+		t.Fatal(err)
+	}
+	if v.Ref != IntType {
+		t.Fatal("Type variable constrained by Hash and Ord should be resolved to int:", Debug(v))
+	}
+}
+
+func TestComparisonConstraintOK(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+	}{
+		{
+			what: "polymorphic less-than instantiated with int and float",
+			code: "let rec lt a b = a < b in print_bool (lt 1 2); print_bool (lt 1.0 2.0)",
+		},
+		{
+			what: "polymorphic equality instantiated with tuple and option",
+			code: "let rec eq a b = a = b in print_bool (eq (1, true) (1, false)); print_bool (eq (Some 1) None)",
+		},
+		{
+			what: "constraint on parameter resolved later",
+			code: "let rec f x = let b = x < x in x + 1 in print_int (f 1)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			if err := NewInferer(env).Infer(parsed); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestComparisonConstraintError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "unit is invalid for operator '<'",
+			code:     "() < ()",
+			expected: "'unit' can't be compared with operator '<'",
+		},
+		{
+			what:     "tuple is invalid for operator '<'",
+			code:     "let t = (1, 2) in t < t",
+			expected: "'int * int' can't be compared with operator '<'",
+		},
+		{
+			what:     "option is invalid for operator '<'",
+			code:     "let a = Some 3 in a < None",
+			expected: "'int option' can't be compared with operator '<'",
+		},
+		{
+			what:     "array is invalid for operator '='",
+			code:     "let a = Array.make  3 3 in a = a",
+			expected: "'int array' can't be compared with operator '='",
+		},
+		{
+			what:     "variant is invalid for operator '='",
+			code:     "`Foo = `Foo",
+			expected: "'[> `Foo]' can't be compared with operator '='",
+		},
+		{
+			what:     "variant is invalid for operator '<'",
+			code:     "`Foo 1 < `Foo 2",
+			expected: "'[> `Foo of int]' can't be compared with operator '<'",
+		},
+		{
+			what:     "array in tuple is invalid for operator '='",
+			code:     "let t = (1, [| 1 |]) in t = t",
+			expected: "Type 'int array' does not satisfy constraint 'Eq'",
+		},
+		{
+			what:     "polymorphic less-than instantiated with bool",
+			code:     "let rec lt a b = a < b in lt true false",
+			expected: "Type 'bool' does not satisfy constraint 'Ord'",
+		},
+		{
+			what:     "polymorphic equality instantiated with array",
+			code:     "let rec eq a b = a = b in eq [| 1 |] [| 1 |]",
+			expected: "Type 'int array' does not satisfy constraint 'Eq'",
+		},
+		{
+			what:     "constraint on parameter violated later",
+			code:     "let rec f x = let b = x < x in x && true in f true",
+			expected: "Type 'bool' does not satisfy constraint 'Ord'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(fmt.Sprintf("%s; ()", tc.code))
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+
+			inf := NewInferer(env)
+			err = inf.Infer(parsed)
+
+			if err == nil {
+				t.Fatalf("Expected code '%s' to cause an error '%s' but actually there is no error", tc.code, tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
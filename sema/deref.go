@@ -3,16 +3,35 @@ package sema
 import (
 	"fmt"
 	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/token"
 	. "github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
+	"strings"
 )
 
+// binding is a variable or a parameter introduced by a node. It is used for detecting unused ones.
+type binding struct {
+	sym   *ast.Symbol
+	start locerr.Pos
+	end   locerr.Pos
+	param bool
+}
+
 type typeVarDereferencer struct {
 	err      *locerr.Error
 	env      *Env
 	inferred InferredTypes
 	schemes  schemes
 	insts    refInsts
+	warnings *Warnings
+	bindings []binding
+	refs     map[string]struct{}
+	// Constraints which resolved type variables. They are used to explain failed instantiations.
+	resolvedBy map[*Var]*provenance
+	// Nodes declaring symbols visited so far
+	decls map[string]ast.Expr
+	// Expressions which never return
+	diverging map[ast.Expr]*divergence
 }
 
 func (d *typeVarDereferencer) unwrapVar(v *Var) (Type, bool) {
@@ -49,6 +68,38 @@ func (d *typeVarDereferencer) unwrapFun(fun *Fun) (Type, bool) {
 	return fun, true
 }
 
+func (d *typeVarDereferencer) unwrapVariant(variant *Variant) (Type, bool) {
+	tags, row := variant.Flatten()
+	for _, tag := range tags {
+		if tag.Payload == nil {
+			continue
+		}
+		p, ok := d.unwrap(tag.Payload)
+		if !ok {
+			return nil, false
+		}
+		tag.Payload = p
+	}
+	variant.Tags = tags
+	if row != nil && !row.IsGeneric() {
+		// Note:
+		// Row which is still open after type inference can have any other tags. But no more tag is
+		// added to the variant. So it can be closed safely.
+		//   let v = `Foo in ...
+		// Type of `v` is `[> `Foo]` but it can be considered as `[`Foo]` here.
+		row.Ref = &Variant{nil, nil}
+		variant.Row = nil
+		return variant, true
+	}
+	// Note: Assigning nil *Var directly would make a non-nil interface value
+	if row != nil {
+		variant.Row = row
+	} else {
+		variant.Row = nil
+	}
+	return variant, true
+}
+
 func (d *typeVarDereferencer) unwrap(target Type) (Type, bool) {
 	switch t := target.(type) {
 	case *Fun:
@@ -73,6 +124,30 @@ func (d *typeVarDereferencer) unwrap(target Type) (Type, bool) {
 			return nil, false
 		}
 		t.Elem = e
+	case *Result:
+		o, ok := d.unwrap(t.Ok)
+		if !ok {
+			return nil, false
+		}
+		t.Ok = o
+		e, ok := d.unwrap(t.Error)
+		if !ok {
+			return nil, false
+		}
+		t.Error = e
+	case *Table:
+		k, ok := d.unwrap(t.Key)
+		if !ok {
+			return nil, false
+		}
+		t.Key = k
+		v, ok := d.unwrap(t.Value)
+		if !ok {
+			return nil, false
+		}
+		t.Value = v
+	case *Variant:
+		return d.unwrapVariant(t)
 	case *Var:
 		return d.unwrapVar(t)
 	}
@@ -100,6 +175,7 @@ func (d *typeVarDereferencer) derefSym(node ast.Expr, sym *ast.Symbol) {
 	if !ok {
 		panic("FATAL: Cannot dereference unknown symbol: " + sym.Name)
 	}
+	d.decls[sym.Name] = node
 
 	if sym.IsIgnored() {
 		// Parser expands `foo; bar` to `let $unused = foo in bar`. In this situation, type of the
@@ -117,6 +193,9 @@ func (d *typeVarDereferencer) derefSym(node ast.Expr, sym *ast.Symbol) {
 	if !ok {
 		msg := fmt.Sprintf("Cannot infer type of variable '%s'. Inferred type was '%s'", sym.DisplayName, symType.String())
 		d.errIn(node, msg)
+		if len(weakVarsOf(symType)) > 0 {
+			d.errMsg(fmt.Sprintf("Type of '%s' was not generalized because its bound expression is not a value. Weak type variables like '_a must be determined by uses of the variable", sym.DisplayName))
+		}
 		return
 	}
 
@@ -124,10 +203,39 @@ func (d *typeVarDereferencer) derefSym(node ast.Expr, sym *ast.Symbol) {
 	d.env.DeclTable[sym.Name] = t
 }
 
+// bind records the symbol to check it is referenced after visiting all nodes. Symbols which are
+// intentionally unused such as '_foo' and symbols generated by compiler are not recorded.
+func (d *typeVarDereferencer) bind(tok *token.Token, sym *ast.Symbol, start, end locerr.Pos, param bool) {
+	if d.warnings == nil || sym.IsIgnored() {
+		return
+	}
+	// Note:
+	// Nodes derived from [@@deriving] attribute have the attribute token instead of keyword token.
+	// Names starting with '$' are generated while parsing (e.g. 'for' loop).
+	if tok.Kind == token.IDENT || strings.HasPrefix(sym.DisplayName, "_") || strings.HasPrefix(sym.DisplayName, "$") {
+		return
+	}
+	d.bindings = append(d.bindings, binding{sym, start, end, param})
+}
+
+func (d *typeVarDereferencer) reportUnused() {
+	for _, b := range d.bindings {
+		if _, ok := d.refs[b.sym.Name]; ok {
+			continue
+		}
+		if b.param {
+			d.warnings.Warnf(WarnUnusedParameter, SeverityWarning, b.start, b.end, "Parameter '%s' is never used. Rename it to '_%s' if it is intended", b.sym.DisplayName, b.sym.DisplayName)
+		} else {
+			d.warnings.Warnf(WarnUnusedVariable, SeverityWarning, b.start, b.end, "Variable '%s' is never used. Rename it to '_%s' if it is intended", b.sym.DisplayName, b.sym.DisplayName)
+		}
+	}
+}
+
 func (d *typeVarDereferencer) VisitTopdown(node ast.Expr) ast.Visitor {
 	switch n := node.(type) {
 	case *ast.Let:
 		d.derefSym(n, n.Symbol)
+		d.bind(n.LetToken, n.Symbol, n.Pos(), n.Bound.End(), false)
 	case *ast.LetRec:
 		// Note:
 		// Need to dereference parameters at first because type of the function depends on type
@@ -135,21 +243,36 @@ func (d *typeVarDereferencer) VisitTopdown(node ast.Expr) ast.Visitor {
 		// may not be determined and need to be fixed as unit type.
 		for _, p := range n.Func.Params {
 			d.derefSym(n, p.Ident)
+			start, end := paramSpan(n, p.Ident)
+			d.bind(n.LetToken, p.Ident, start, end, true)
 		}
 		d.derefSym(n, n.Func.Symbol)
+		d.bind(n.LetToken, n.Func.Symbol, n.Pos(), n.Func.Body.Pos(), false)
 	case *ast.LetTuple:
 		for _, sym := range n.Symbols {
 			d.derefSym(n, sym)
+			d.bind(n.LetToken, sym, n.Pos(), n.Bound.End(), false)
 		}
 	case *ast.Match:
 		d.derefSym(n, n.SomeIdent)
+	case *ast.MatchResult:
+		d.derefSym(n, n.OkIdent)
+		d.derefSym(n, n.ErrorIdent)
+	case *ast.MatchVariant:
+		for _, a := range n.Arms {
+			if a.Ident != nil {
+				d.derefSym(n, a.Ident)
+			}
+		}
 	case *ast.VarRef:
+		d.refs[n.Symbol.Name] = struct{}{}
 		if inst, ok := d.insts[n]; ok {
 			unwrapped, ok := d.unwrap(inst.To)
 			if !ok {
 				msg := fmt.Sprintf("Cannot instantiate declaration '%s' typed as type '%s'", n.Symbol.DisplayName, inst.From.String())
 				d.errIn(n, msg)
 				d.err = d.err.NotefAt(n.Pos(), "Tried to instantiate the generic type as '%s'", inst.To.String())
+				d.explainInstantiation(n, inst)
 				return nil
 			}
 			inst.To = unwrapped
@@ -158,6 +281,7 @@ func (d *typeVarDereferencer) VisitTopdown(node ast.Expr) ast.Visitor {
 				if !ok {
 					msg := fmt.Sprintf("Cannot instantiate type variable in generic type '%s' at declaration '%s'", inst.From.String(), n.Symbol.DisplayName)
 					d.errIn(n, msg)
+					d.explainInstantiation(n, inst)
 					return nil
 				}
 				m.Type = t
@@ -167,59 +291,76 @@ func (d *typeVarDereferencer) VisitTopdown(node ast.Expr) ast.Visitor {
 	return d
 }
 
-func (d *typeVarDereferencer) checkLess(op string, lhs ast.Expr) string {
-	operand, ok := d.inferred[lhs]
-	if !ok {
-		panic("FATAL: Operand type of operator '" + op + "' not found at " + lhs.Pos().String())
-	}
-	// Note:
-	// This type constraint may be useful for type inference. But current HM type inference algorithm cannot
-	// handle a union type. In this context, the operand should be `int | float`
-	switch operand.(type) {
-	case *Unit, *Bool, *String, *Fun, *Tuple, *Array, *Option:
-		return fmt.Sprintf("'%s' can't be compared with operator '%s'", operand.String(), op)
-	default:
-		return ""
-	}
+// resolutionTracer collects type variables reachable from a type in depth-first order.
+type resolutionTracer struct {
+	vars []*Var
+	seen map[*Var]struct{}
 }
 
-func (d *typeVarDereferencer) checkEq(op string, lhs ast.Expr) string {
-	operand, ok := d.inferred[lhs]
+func (tr *resolutionTracer) VisitTopdown(t Type) Visitor {
+	v, ok := t.(*Var)
 	if !ok {
-		panic("FATAL: Operand type of operator '" + op + "' not found at " + lhs.Pos().String())
+		return tr
 	}
-	// Note:
-	// This type constraint may be useful for type inference. But current HM type inference algorithm cannot
-	// handle a union type. In this context, the operand should be `() | bool | int | float | fun<R, TS...> | tuple<Args...>`
-	if a, ok := operand.(*Array); ok {
-		return fmt.Sprintf("Array type '%s' can't be compared with operator '%s'", a.String(), op)
+	if _, ok := tr.seen[v]; ok {
+		return nil
 	}
-	return ""
+	tr.seen[v] = struct{}{}
+	tr.vars = append(tr.vars, v)
+	return tr
 }
 
-func (d *typeVarDereferencer) miscCheck(node ast.Expr) {
-	msg := ""
-	switch n := node.(type) {
-	case *ast.Less:
-		msg = d.checkLess("<", n.Left)
-	case *ast.LessEq:
-		msg = d.checkLess("<=", n.Left)
-	case *ast.Greater:
-		msg = d.checkLess(">", n.Left)
-	case *ast.GreaterEq:
-		msg = d.checkLess(">=", n.Left)
-	case *ast.Eq:
-		msg = d.checkEq("=", n.Left)
-	case *ast.NotEq:
-		msg = d.checkEq("<>", n.Left)
+func (tr *resolutionTracer) VisitBottomup(Type) {}
+
+// explainInstantiation adds notes to the error of failed instantiation at the variable reference.
+// They show where the generic type was generalized and how each type variable instantiated from
+// a bound type variable was resolved by unifications.
+//   let rec f x = x in println_bool (f None = None)
+//   (* 'a of ''a -> 'a' is instantiated as ?(1). ?(1) is resolved to '?(2) option' at 'f None' *)
+//   (* but ?(2) is never resolved *)
+func (d *typeVarDereferencer) explainInstantiation(ref *ast.VarRef, inst *Instantiation) {
+	if decl, ok := d.decls[ref.Symbol.Name]; ok {
+		d.err = d.err.NotefAt(decl.Pos(), "Generic type '%s' of '%s' was generalized at this declaration", inst.From.String(), ref.Symbol.DisplayName)
 	}
-	if msg != "" {
-		d.errIn(node, msg)
+
+	names := GenericNames(inst.From)
+	tr := &resolutionTracer{nil, map[*Var]struct{}{}}
+	for _, m := range inst.Mapping {
+		name, ok := names[m.ID]
+		if !ok {
+			continue
+		}
+		to := m.Type.String()
+		if v, ok := m.Type.(*Var); ok {
+			to = varName(v)
+		}
+		d.err = d.err.NotefAt(ref.Pos(), "Bound type variable %s was instantiated as '%s'", name, to)
+		start := len(tr.vars)
+		Visit(tr, m.Type)
+		for _, v := range tr.vars[start:] {
+			if v.Ref == nil {
+				if !v.IsGeneric() {
+					d.err = d.err.Notef("Type variable '%s' was never resolved by any unification", varName(v))
+				}
+				continue
+			}
+			p, ok := d.resolvedBy[v]
+			if !ok {
+				continue
+			}
+			to := v.Ref.String()
+			if r, ok := v.Ref.(*Var); ok {
+				// Show the next step of resolution instead of the final result
+				to = varName(r)
+			}
+			d.err = d.err.NotefAt(p.at, "Type variable '%s' was resolved to '%s' by unification: %s", varName(v), to, fmt.Sprintf(p.format, p.args...))
+		}
 	}
 }
 
 func (d *typeVarDereferencer) VisitBottomup(node ast.Expr) {
-	d.miscCheck(node)
+	d.checkDivergence(node)
+	d.checkComparison(node)
 
 	// Dereference all nodes' types
 	t, ok := d.inferred[node]
@@ -257,12 +398,13 @@ RefLoop:
 	d.env.PolyTypes = polys
 }
 
-func derefTypeVars(env *Env, root ast.Expr, inferred InferredTypes, ss schemes, insts map[*ast.VarRef]*Instantiation) *locerr.Error {
-	deref := &typeVarDereferencer{nil, env, inferred, ss, insts}
+func derefTypeVars(env *Env, root ast.Expr, inferred InferredTypes, ss schemes, insts map[*ast.VarRef]*Instantiation, resolved map[*Var]*provenance, ws *Warnings) *locerr.Error {
+	deref := &typeVarDereferencer{nil, env, inferred, ss, insts, ws, nil, map[string]struct{}{}, resolved, map[string]ast.Expr{}, map[ast.Expr]*divergence{}}
 
 	// Note:
 	// Don't need to dereference types of external symbols because they must not contain any
-	// type variables.
+	// type variables except for generic ones. Generic external symbols are instantiated at each
+	// reference and the instantiations are dereferenced at VarRef nodes.
 	ast.Visit(deref, root)
 
 	// Note:
@@ -272,6 +414,7 @@ func derefTypeVars(env *Env, root ast.Expr, inferred InferredTypes, ss schemes,
 	}
 
 	deref.normalizePolyTypes()
+	deref.reportUnused()
 
 	return nil
 }
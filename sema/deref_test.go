@@ -1,9 +1,7 @@
 package sema
 
 import (
-	"fmt"
 	"github.com/rhysd/gocaml/ast"
-	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/gocaml/token"
 	. "github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
@@ -22,10 +20,13 @@ func TestDerefFailure(t *testing.T) {
 	env := NewEnv()
 	env.DeclTable["hello"] = varT(nil)
 	v := &typeVarDereferencer{
-		nil,
-		env,
-		map[ast.Expr]Type{},
-		schemes{},
+		env:        env,
+		inferred:   map[ast.Expr]Type{},
+		schemes:    schemes{},
+		refs:       map[string]struct{}{},
+		resolvedBy: map[*Var]*provenance{},
+		decls:      map[string]ast.Expr{},
+		diverging:  map[ast.Expr]*divergence{},
 	}
 	root := &ast.Let{
 		tok,
@@ -57,10 +58,13 @@ func TestUnwrapEmptyTypeVar(t *testing.T) {
 		&Array{e},
 	} {
 		v := &typeVarDereferencer{
-			nil,
-			NewEnv(),
-			map[ast.Expr]Type{},
-			schemes{},
+			env:        NewEnv(),
+			inferred:   map[ast.Expr]Type{},
+			schemes:    schemes{},
+			refs:       map[string]struct{}{},
+			resolvedBy: map[*Var]*provenance{},
+			decls:      map[string]ast.Expr{},
+			diverging:  map[ast.Expr]*divergence{},
 		}
 		_, ok := v.unwrap(ty)
 		if ok {
@@ -68,59 +72,3 @@ func TestUnwrapEmptyTypeVar(t *testing.T) {
 		}
 	}
 }
-
-func TestMiscCheckError(t *testing.T) {
-	cases := []struct {
-		what     string
-		code     string
-		expected string
-	}{
-		{
-			what:     "unit is invalid for operator '<'",
-			code:     "() < ()",
-			expected: "'unit' can't be compared with operator '<'",
-		},
-		{
-			what:     "tuple is invalid for operator '<'",
-			code:     "let t = (1, 2) in t < t",
-			expected: "'int * int' can't be compared with operator '<'",
-		},
-		{
-			what:     "option is invalid for operator '<'",
-			code:     "let a = Some 3 in a < None",
-			expected: "'int option' can't be compared with operator '<'",
-		},
-		{
-			what:     "array is invalid for operator '='",
-			code:     "let a = Array.make  3 3 in a = a",
-			expected: "'int array' can't be compared with operator '='",
-		},
-	}
-
-	for _, tc := range cases {
-		t.Run(tc.what, func(t *testing.T) {
-			s := locerr.NewDummySource(fmt.Sprintf("%s; ()", tc.code))
-			parsed, err := syntax.Parse(s)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			env := NewEnv()
-			if err := AlphaTransform(parsed, env); err != nil {
-				t.Fatal(err)
-			}
-
-			inf := NewInferer(env)
-
-			// inf.Infer() invokes type dereferences
-			err = inf.Infer(parsed)
-
-			if err == nil {
-				t.Fatalf("Expected code '%s' to cause an error '%s' but actually there is no error", tc.code, tc.expected)
-			}
-			if !strings.Contains(err.Error(), tc.expected) {
-				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
-			}
-		})
-	}
-}
@@ -0,0 +1,476 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/token"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// [@@deriving show, eq] attribute of type declaration is desugared into functions before alpha
+// transform. Generated functions are defined at the outermost of the program in the order of
+// declarations. So a function for a type can use functions derived for previously declared types.
+//   type point = int * int [@@deriving show, eq];
+//
+//   let rec show_point (v : point) = let (x1, x2) = v in "(" ^ int_to_str x1 ^ ", " ^ ... in
+//   let rec eq_point (a : point) (b : point) = let (x1, x2) = a in let (y1, y2) = b in ... in
+//   ...
+// (Note that '^' means 'str_concat' in above pseudo code.)
+// Functions are generated structurally for primitive types, tuples, options, results, arrays and
+// closed variant types. Since functions cannot be compared structurally, they are shown as "<fun>" and
+// compared by operator '='.
+
+// Built-in function to escape string for derived 'show' functions
+const strEscapeName = "__str_escape$builtin"
+
+type deriver struct {
+	decls []*ast.TypeDecl
+	// Declarations visible from each declaration are before the bound index. Declarations in the
+	// same 'type ... and ...' group are visible from each other.
+	bounds []int
+	// Index of the declaration whose functions are being derived. Only derived functions of
+	// declarations before it are defined outside of the function.
+	current int
+	// Indices of declarations being expanded to detect cyclic types
+	expanding map[int]struct{}
+	tok       *token.Token
+	count     int
+}
+
+func newDeriver(decls []*ast.TypeDecl) *deriver {
+	bounds := make([]int, 0, len(decls))
+	for _, group := range ast.TypeDeclGroups(decls) {
+		if len(group) == 1 {
+			bounds = append(bounds, len(bounds))
+			continue
+		}
+		end := len(bounds) + len(group)
+		for range group {
+			bounds = append(bounds, end)
+		}
+	}
+	return &deriver{decls: decls, bounds: bounds, expanding: map[int]struct{}{}}
+}
+
+func (d *deriver) fresh(prefix string) *ast.Symbol {
+	d.count++
+	return ast.NewSymbol(fmt.Sprintf("%s%d", prefix, d.count))
+}
+
+func (d *deriver) ref(s *ast.Symbol) ast.Expr {
+	return &ast.VarRef{d.tok, ast.NewSymbol(s.DisplayName)}
+}
+
+func (d *deriver) str(s string) ast.Expr {
+	return &ast.String{d.tok, s}
+}
+
+func (d *deriver) call(name string, args ...ast.Expr) ast.Expr {
+	return &ast.Apply{&ast.VarRef{d.tok, ast.NewSymbol(name)}, args}
+}
+
+// concat concatenates strings with built-in 'str_concat' function from left to right.
+func (d *deriver) concat(exprs ...ast.Expr) ast.Expr {
+	ret := exprs[0]
+	for _, e := range exprs[1:] {
+		ret = d.call("str_concat", ret, e)
+	}
+	return ret
+}
+
+func (d *deriver) typeName(name string) ast.Expr {
+	return &ast.CtorType{nil, d.tok, nil, ast.NewSymbol(name)}
+}
+
+// lookup returns the latest type declaration of the name visible from the declaration at the index.
+func (d *deriver) lookup(name string, from int) (*ast.TypeDecl, int) {
+	for i := d.bounds[from] - 1; i >= 0; i-- {
+		if d.decls[i].Ident.DisplayName == name {
+			return d.decls[i], i
+		}
+	}
+	return nil, -1
+}
+
+func derives(decl *ast.TypeDecl, name string) bool {
+	for _, t := range decl.Deriving {
+		if t.Value() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// callable returns whether the derived function for the declaration at the index can be called
+// from the function being derived.
+func (d *deriver) callable(decl *ast.TypeDecl, idx int, which string) bool {
+	return idx < d.current && derives(decl, which)
+}
+
+// expand derives the function for the type of the declaration at the index structurally.
+func (d *deriver) expand(which string, ty *ast.CtorType, idx int, derive func() (ast.Expr, error)) (ast.Expr, error) {
+	if _, ok := d.expanding[idx]; ok {
+		return nil, locerr.ErrorfIn(ty.Pos(), ty.End(), "Cannot derive '%s' for recursive type '%s'", which, ty.Ctor.DisplayName)
+	}
+	d.expanding[idx] = struct{}{}
+	e, err := derive()
+	delete(d.expanding, idx)
+	return e, err
+}
+
+func (d *deriver) unsupported(which string, ty ast.Expr) *locerr.Error {
+	return locerr.ErrorfIn(ty.Pos(), ty.End(), "Cannot derive '%s' for type '%s'", which, ty.Name())
+}
+
+func (d *deriver) show(v *ast.Symbol, ty ast.Expr, from int) (ast.Expr, error) {
+	switch ty := ty.(type) {
+	case *ast.CtorType:
+		name := ty.Ctor.DisplayName
+		switch len(ty.ParamTypes) {
+		case 0:
+			switch name {
+			case "unit":
+				return d.str("()"), nil
+			case "int":
+				return d.call("int_to_str", d.ref(v)), nil
+			case "float":
+				return d.call("float_to_str", d.ref(v)), nil
+			case "bool":
+				return &ast.If{d.tok, d.ref(v), d.str("true"), d.str("false")}, nil
+			case "string":
+				return d.concat(d.str("\""), d.call(strEscapeName, d.ref(v)), d.str("\"")), nil
+			}
+			decl, idx := d.lookup(name, from)
+			if decl == nil {
+				break
+			}
+			if d.callable(decl, idx, "show") {
+				return d.call("show_"+name, d.ref(v)), nil
+			}
+			return d.expand("show", ty, idx, func() (ast.Expr, error) {
+				return d.show(v, decl.Type, idx)
+			})
+		case 1:
+			switch name {
+			case "option":
+				x := d.fresh("x")
+				s, err := d.show(x, ty.ParamTypes[0], from)
+				if err != nil {
+					return nil, err
+				}
+				some := d.withPayload("Some", s, ty.ParamTypes[0], from)
+				return &ast.Match{d.tok, d.ref(v), some, d.str("None"), x, d.tok.End}, nil
+			case "array":
+				return d.showArray(v, ty.ParamTypes[0], from)
+			}
+		case 2:
+			if name == "result" {
+				x, y := d.fresh("x"), d.fresh("y")
+				s, err := d.show(x, ty.ParamTypes[0], from)
+				if err != nil {
+					return nil, err
+				}
+				t, err := d.show(y, ty.ParamTypes[1], from)
+				if err != nil {
+					return nil, err
+				}
+				ok := d.withPayload("Ok", s, ty.ParamTypes[0], from)
+				e := d.withPayload("Error", t, ty.ParamTypes[1], from)
+				return &ast.MatchResult{d.tok, d.ref(v), ok, e, x, y, d.tok.End}, nil
+			}
+		}
+	case *ast.TupleType:
+		syms := make([]*ast.Symbol, 0, len(ty.ElemTypes))
+		elems := make([]ast.Expr, 0, len(ty.ElemTypes)*2+1)
+		elems = append(elems, d.str("("))
+		for i, t := range ty.ElemTypes {
+			x := d.fresh("x")
+			s, err := d.show(x, t, from)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				elems = append(elems, d.str(", "))
+			}
+			syms = append(syms, x)
+			elems = append(elems, s)
+		}
+		elems = append(elems, d.str(")"))
+		return &ast.LetTuple{d.tok, syms, d.ref(v), d.concat(elems...), nil}, nil
+	case *ast.VariantType:
+		arms := make([]*ast.VariantArm, 0, len(ty.Tags))
+		for _, tag := range ty.Tags {
+			if tag.Payload == nil {
+				arms = append(arms, &ast.VariantArm{d.tok, tag.Tag, nil, d.str("`" + tag.Tag)})
+				continue
+			}
+			x := d.fresh("x")
+			s, err := d.show(x, tag.Payload, from)
+			if err != nil {
+				return nil, err
+			}
+			body := d.withPayload("`"+tag.Tag, s, tag.Payload, from)
+			arms = append(arms, &ast.VariantArm{d.tok, tag.Tag, x, body})
+		}
+		return &ast.MatchVariant{d.tok, d.ref(v), arms}, nil
+	case *ast.FuncType:
+		return d.str("<fun>"), nil
+	}
+	return nil, d.unsupported("show", ty)
+}
+
+// isTuple returns whether the type is a tuple type after expanding aliases.
+func (d *deriver) isTuple(ty ast.Expr, from int) bool {
+	// Aliases in 'type ... and ...' group may be cyclic. Expanding more than the number of
+	// declarations means the cycle.
+	for i := 0; i <= len(d.decls); i++ {
+		switch t := ty.(type) {
+		case *ast.TupleType:
+			return true
+		case *ast.CtorType:
+			if len(t.ParamTypes) > 0 {
+				return false
+			}
+			decl, idx := d.lookup(t.Ctor.DisplayName, from)
+			if decl == nil {
+				return false
+			}
+			ty, from = decl.Type, idx
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// withPayload shows a constructor with its payload. Payload is enclosed with parens unless it is a
+// tuple because a shown tuple is already enclosed with parens.
+//   Some (42), Some (1, 2), `Foo (Some (42))
+func (d *deriver) withPayload(ctor string, payload ast.Expr, ty ast.Expr, from int) ast.Expr {
+	if d.isTuple(ty, from) {
+		return d.concat(d.str(ctor+" "), payload)
+	}
+	return d.concat(d.str(ctor+" ("), payload, d.str(")"))
+}
+
+// showArray generates a loop to concatenate shown elements.
+//   if Array.length v = 0 then "[||]" else
+//   let rec loop i acc = if i < Array.length v then let x = v.(i) in loop (i+1) (acc ^ "; " ^ show x) else acc in
+//   "[| " ^ loop 1 (show v.(0)) ^ " |]"
+func (d *deriver) showArray(v *ast.Symbol, elem ast.Expr, from int) (ast.Expr, error) {
+	x := d.fresh("x")
+	s, err := d.show(x, elem, from)
+	if err != nil {
+		return nil, err
+	}
+	fst := d.fresh("x")
+	sf, err := d.show(fst, elem, from)
+	if err != nil {
+		return nil, err
+	}
+
+	loop, i, acc := d.fresh("loop"), d.fresh("i"), d.fresh("acc")
+	next := d.call(loop.DisplayName, &ast.Add{d.ref(i), &ast.Int{d.tok, 1}}, d.concat(d.ref(acc), d.str("; "), s))
+	body := &ast.If{
+		d.tok,
+		&ast.Less{d.ref(i), &ast.ArraySize{d.tok, d.ref(v)}},
+		&ast.Let{d.tok, x, &ast.ArrayGet{d.ref(v), d.ref(i)}, next, nil},
+		d.ref(acc),
+	}
+	def := &ast.FuncDef{loop, []ast.Param{{i, nil}, {acc, nil}}, body, nil, nil}
+	first := &ast.Let{d.tok, fst, &ast.ArrayGet{d.ref(v), &ast.Int{d.tok, 0}}, sf, nil}
+	elems := d.concat(d.str("[| "), d.call(loop.DisplayName, &ast.Int{d.tok, 1}, first), d.str(" |]"))
+	empty := &ast.Eq{&ast.ArraySize{d.tok, d.ref(v)}, &ast.Int{d.tok, 0}}
+	return &ast.If{d.tok, empty, d.str("[||]"), &ast.LetRec{d.tok, def, elems}}, nil
+}
+
+func (d *deriver) eq(a, b *ast.Symbol, ty ast.Expr, from int) (ast.Expr, error) {
+	switch ty := ty.(type) {
+	case *ast.CtorType:
+		name := ty.Ctor.DisplayName
+		switch len(ty.ParamTypes) {
+		case 0:
+			switch name {
+			case "unit", "int", "float", "bool", "string":
+				return &ast.Eq{d.ref(a), d.ref(b)}, nil
+			}
+			decl, idx := d.lookup(name, from)
+			if decl == nil {
+				break
+			}
+			if d.callable(decl, idx, "eq") {
+				return d.call("eq_"+name, d.ref(a), d.ref(b)), nil
+			}
+			return d.expand("eq", ty, idx, func() (ast.Expr, error) {
+				return d.eq(a, b, decl.Type, idx)
+			})
+		case 1:
+			switch name {
+			case "option":
+				x, y := d.fresh("x"), d.fresh("y")
+				e, err := d.eq(x, y, ty.ParamTypes[0], from)
+				if err != nil {
+					return nil, err
+				}
+				ifSome := &ast.Match{d.tok, d.ref(b), e, &ast.Bool{d.tok, false}, y, d.tok.End}
+				ifNone := &ast.Match{d.tok, d.ref(b), &ast.Bool{d.tok, false}, &ast.Bool{d.tok, true}, ast.IgnoredSymbol(), d.tok.End}
+				return &ast.Match{d.tok, d.ref(a), ifSome, ifNone, x, d.tok.End}, nil
+			case "array":
+				return d.eqArray(a, b, ty.ParamTypes[0], from)
+			}
+		case 2:
+			if name == "result" {
+				return d.eqResult(a, b, ty.ParamTypes[0], ty.ParamTypes[1], from)
+			}
+		}
+	case *ast.TupleType:
+		xs := make([]*ast.Symbol, 0, len(ty.ElemTypes))
+		ys := make([]*ast.Symbol, 0, len(ty.ElemTypes))
+		var body ast.Expr
+		for _, t := range ty.ElemTypes {
+			x, y := d.fresh("x"), d.fresh("y")
+			e, err := d.eq(x, y, t, from)
+			if err != nil {
+				return nil, err
+			}
+			xs = append(xs, x)
+			ys = append(ys, y)
+			if body == nil {
+				body = e
+			} else {
+				body = &ast.And{body, e}
+			}
+		}
+		return &ast.LetTuple{d.tok, xs, d.ref(a), &ast.LetTuple{d.tok, ys, d.ref(b), body, nil}, nil}, nil
+	case *ast.VariantType:
+		arms := make([]*ast.VariantArm, 0, len(ty.Tags))
+		for _, tag := range ty.Tags {
+			var x, y *ast.Symbol
+			var e ast.Expr = &ast.Bool{d.tok, true}
+			if tag.Payload != nil {
+				x, y = d.fresh("x"), d.fresh("y")
+				var err error
+				e, err = d.eq(x, y, tag.Payload, from)
+				if err != nil {
+					return nil, err
+				}
+			}
+			inner := &ast.MatchVariant{d.tok, d.ref(b), []*ast.VariantArm{
+				{d.tok, tag.Tag, y, e},
+				{d.tok, "", ast.IgnoredSymbol(), &ast.Bool{d.tok, false}},
+			}}
+			arms = append(arms, &ast.VariantArm{d.tok, tag.Tag, x, inner})
+		}
+		return &ast.MatchVariant{d.tok, d.ref(a), arms}, nil
+	case *ast.FuncType:
+		return &ast.Eq{d.ref(a), d.ref(b)}, nil
+	}
+	return nil, d.unsupported("eq", ty)
+}
+
+// eqResult generates nested 'match' expressions. Values are equal when both are 'Ok' or both are
+// 'Error' and their payloads are equal.
+func (d *deriver) eqResult(a, b *ast.Symbol, ok, err ast.Expr, from int) (ast.Expr, error) {
+	x1, y1 := d.fresh("x"), d.fresh("y")
+	okEq, e := d.eq(x1, y1, ok, from)
+	if e != nil {
+		return nil, e
+	}
+	x2, y2 := d.fresh("x"), d.fresh("y")
+	errEq, e := d.eq(x2, y2, err, from)
+	if e != nil {
+		return nil, e
+	}
+	ifOk := &ast.MatchResult{d.tok, d.ref(b), okEq, &ast.Bool{d.tok, false}, y1, ast.IgnoredSymbol(), d.tok.End}
+	ifErr := &ast.MatchResult{d.tok, d.ref(b), &ast.Bool{d.tok, false}, errEq, ast.IgnoredSymbol(), y2, d.tok.End}
+	return &ast.MatchResult{d.tok, d.ref(a), ifOk, ifErr, x1, x2, d.tok.End}, nil
+}
+
+// eqArray generates a loop to compare elements.
+//   Array.length a = Array.length b &&
+//   let rec loop i = if i < Array.length a then (let x = a.(i) in let y = b.(i) in eq x y) && loop (i+1) else true in
+//   loop 0
+func (d *deriver) eqArray(a, b *ast.Symbol, elem ast.Expr, from int) (ast.Expr, error) {
+	x, y := d.fresh("x"), d.fresh("y")
+	e, err := d.eq(x, y, elem, from)
+	if err != nil {
+		return nil, err
+	}
+
+	loop, i := d.fresh("loop"), d.fresh("i")
+	elemEq := &ast.Let{d.tok, x, &ast.ArrayGet{d.ref(a), d.ref(i)}, &ast.Let{d.tok, y, &ast.ArrayGet{d.ref(b), d.ref(i)}, e, nil}, nil}
+	next := d.call(loop.DisplayName, &ast.Add{d.ref(i), &ast.Int{d.tok, 1}})
+	body := &ast.If{
+		d.tok,
+		&ast.Less{d.ref(i), &ast.ArraySize{d.tok, d.ref(a)}},
+		&ast.And{elemEq, next},
+		&ast.Bool{d.tok, true},
+	}
+	def := &ast.FuncDef{loop, []ast.Param{{i, nil}}, body, nil, nil}
+	sameLen := &ast.Eq{&ast.ArraySize{d.tok, d.ref(a)}, &ast.ArraySize{d.tok, d.ref(b)}}
+	return &ast.And{sameLen, &ast.LetRec{d.tok, def, d.call(loop.DisplayName, &ast.Int{d.tok, 0})}}, nil
+}
+
+func (d *deriver) deriveFunc(decl *ast.TypeDecl, idx int, which string, body ast.Expr) (ast.Expr, error) {
+	d.current = idx
+	d.expanding[idx] = struct{}{}
+	defer delete(d.expanding, idx)
+
+	name := decl.Ident.DisplayName
+	a := d.fresh("v")
+	switch which {
+	case "show":
+		e, err := d.show(a, decl.Type, idx)
+		if err != nil {
+			return nil, err
+		}
+		def := &ast.FuncDef{ast.NewSymbol("show_" + name), []ast.Param{{a, d.typeName(name)}}, e, d.typeName("string"), nil}
+		return &ast.LetRec{d.tok, def, body}, nil
+	case "eq":
+		b := d.fresh("v")
+		e, err := d.eq(a, b, decl.Type, idx)
+		if err != nil {
+			return nil, err
+		}
+		params := []ast.Param{{a, d.typeName(name)}, {b, d.typeName(name)}}
+		def := &ast.FuncDef{ast.NewSymbol("eq_" + name), params, e, d.typeName("bool"), nil}
+		return &ast.LetRec{d.tok, def, body}, nil
+	default:
+		panic("FATAL: Unknown deriving: " + which)
+	}
+}
+
+// DeriveFunctions desugars [@@deriving ...] attributes of type declarations into function definitions.
+// It must be applied before alpha transform.
+func DeriveFunctions(tree *ast.AST) error {
+	d := newDeriver(tree.TypeDecls)
+	root := tree.Root
+	for i := len(tree.TypeDecls) - 1; i >= 0; i-- {
+		decl := tree.TypeDecls[i]
+		if len(decl.Deriving) == 0 {
+			continue
+		}
+
+		// Derived functions take the type by its name. When the name is redefined by later declaration,
+		// the name in parameter type would refer the later one.
+		name := decl.Ident.DisplayName
+		for _, later := range tree.TypeDecls[i+1:] {
+			if later.Ident.DisplayName == name {
+				return locerr.ErrorfIn(later.Pos(), later.End(), "Type '%s' cannot be redefined because functions are derived for it", name).NotefAt(decl.Pos(), "Type '%s' with [@@deriving] attribute is declared here", name)
+			}
+		}
+
+		for j := len(decl.Deriving) - 1; j >= 0; j-- {
+			t := decl.Deriving[j]
+			d.tok = t
+			derived, err := d.deriveFunc(decl, i, t.Value(), root)
+			if err != nil {
+				return locerr.NotefAt(t.Start, err, "Deriving '%s' for type '%s'", t.Value(), name)
+			}
+			root = derived
+		}
+	}
+	tree.Root = root
+	return nil
+}
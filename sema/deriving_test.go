@@ -0,0 +1,256 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestDeriveFunctionsOK(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+	}{
+		{
+			what: "primitive types",
+			code: `
+			type i = int [@@deriving show, eq];
+			type s = string [@@deriving show, eq];
+			type b = bool [@@deriving show, eq];
+			type u = unit [@@deriving show, eq];
+			let x : string = show_i 42 in
+			let y : bool = eq_s "a" "b" in
+			println_str (show_b true); println_bool (eq_u () ())
+			`,
+		},
+		{
+			what: "tuple",
+			code: `
+			type point = int * float [@@deriving show, eq];
+			println_str (show_point (1, 2.0)); println_bool (eq_point (1, 2.0) (1, 3.0))
+			`,
+		},
+		{
+			what: "option and array",
+			code: `
+			type o = int option [@@deriving show, eq];
+			type a = (bool * string) array [@@deriving show, eq];
+			println_str (show_o (Some 1)); println_bool (eq_o None (Some 1));
+			println_str (show_a [| (true, "foo") |]); println_bool (eq_a [| |] [| (false, "") |])
+			`,
+		},
+		{
+			what: "result",
+			code: `
+			type r = (int * int, string option) result [@@deriving show, eq];
+			println_str (show_r (Ok (1, 2))); println_bool (eq_r (Error None) (Error (Some "oops")))
+			`,
+		},
+		{
+			what: "variant",
+			code: `
+			type shape = [` + "`Circle of int | `Rect of int * int | `Empty" + `] [@@deriving show, eq];
+			println_str (show_shape ` + "`Empty" + `); println_bool (eq_shape (` + "`Circle 1) (`Rect (1, 2)" + `))
+			`,
+		},
+		{
+			what: "variant with single tag",
+			code: "type one = [`One of bool] [@@deriving eq]; println_bool (eq_one (`One true) (`One true))",
+		},
+		{
+			what: "use derived functions of previous types",
+			code: `
+			type point = int * int [@@deriving show, eq];
+			type line = point * point [@@deriving show, eq];
+			type lines = line array [@@deriving show];
+			println_str (show_lines [| ((0, 0), (1, 1)) |]); println_bool (eq_line ((0, 0), (1, 1)) ((0, 0), (1, 1)))
+			`,
+		},
+		{
+			what: "alias without deriving is expanded",
+			code: `
+			type point = int * int;
+			type p = point option [@@deriving show];
+			println_str (show_p (Some (1, 2)))
+			`,
+		},
+		{
+			what: "function type",
+			code: "type f = (int -> int) * int [@@deriving show, eq]; let rec g x = x in println_str (show_f (g, 1))",
+		},
+		{
+			what: "derived function is shadowed by user definition",
+			code: "type t = int [@@deriving show]; let rec show_t x = x in println_int (show_t 1)",
+		},
+		{
+			what: "types in group",
+			code: `
+			type pair = item * item [@@deriving show, eq]
+			and item = int option [@@deriving show, eq]
+			and items = item array [@@deriving show];
+			println_str (show_pair (Some 1, None)); println_bool (eq_pair (None, None) (None, Some 2));
+			println_str (show_items [| Some 1 |])
+			`,
+		},
+		{
+			what: "type without deriving can be redefined",
+			code: "type t = int; type u = t [@@deriving show]; type t = bool; println_str (show_u 1)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := Analyze(parsed); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDeriveFunctionsError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "unknown type name",
+			code:     "type t = foo [@@deriving show]; ()",
+			expected: "Cannot derive 'show' for type 'CtorType (foo)'",
+		},
+		{
+			what:     "unknown type constructor",
+			code:     "type t = int list [@@deriving eq]; ()",
+			expected: "Cannot derive 'eq' for type 'CtorType (list (1))'",
+		},
+		{
+			what:     "any type",
+			code:     "type t = _ [@@deriving show]; ()",
+			expected: "Cannot derive 'show' for type 'CtorType (_)'",
+		},
+		{
+			what:     "note for deriving",
+			code:     "type t = int * foo [@@deriving show]; ()",
+			expected: "Deriving 'show' for type 't'",
+		},
+		{
+			what:     "redefine type with deriving",
+			code:     "type t = int [@@deriving show]; type t = bool; ()",
+			expected: "Type 't' cannot be redefined because functions are derived for it",
+		},
+		{
+			what:     "recursive type in group",
+			code:     "type t = int * u [@@deriving show] and u = t option; ()",
+			expected: "Cannot derive 'show' for recursive type 't'",
+		},
+		{
+			what:     "cyclic types in group",
+			code:     "type t = int * u and u = t option; ()",
+			expected: "Type 't' is recursive",
+		},
+		{
+			what:     "derived function is typed",
+			code:     "type t = int * int [@@deriving eq]; println_bool (eq_t (1, 2) (1, true))",
+			expected: "Type mismatch between 'int' and 'bool'",
+		},
+		{
+			what:     "tag not in closed variant type",
+			code:     "type t = [`A | `B] [@@deriving show]; println_str (show_t `C)",
+			expected: "`C",
+		},
+		{
+			what:     "duplicate tag in variant type",
+			code:     "type t = [`A | `A of int]; ()",
+			expected: "Tag `A appears twice in variant type",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if err == nil {
+				t.Fatalf("Expected error '%s' but no error occurred", tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestDerivingAttributeParseError(t *testing.T) {
+	for _, code := range []string{
+		"type t = int [@@deriving ord]; ()",
+		"type t = int [@@derive show]; ()",
+	} {
+		s := locerr.NewDummySource(code)
+		if _, err := syntax.Parse(s); err == nil {
+			t.Errorf("Parse error was expected for '%s'", code)
+		}
+	}
+}
+
+func TestDeriveFunctionsSemanticsCheck(t *testing.T) {
+	code := `
+	type point = int * int [@@deriving show, eq];
+	type shape = [` + "`Circle of point * int | `Empty" + `] [@@deriving show, eq];
+	type shapes = shape array [@@deriving show, eq];
+	let ss = [| ` + "`Circle ((0, 0), 1); `Empty" + ` |] in
+	println_str (show_shapes ss); println_bool (eq_shapes ss ss)
+	`
+	s := locerr.NewDummySource(code)
+	parsed, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SemanticsCheck(parsed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDerivedShowFormat(t *testing.T) {
+	code := `
+	type point = int * int;
+	type t = [` + "`A of point | `B of int option | `C" + `] array [@@deriving show];
+	()
+	`
+	s := locerr.NewDummySource(code)
+	parsed, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeriveFunctions(parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	ast.Visit(stringLitCollector(found), parsed.Root)
+	for _, want := range []string{"`A ", "`B (", "Some (", ")", "`C", "(", ", ", "[| ", "; ", " |]", "[||]"} {
+		if !found[want] {
+			t.Errorf("String literal '%s' was not generated: %v", want, found)
+		}
+	}
+}
+
+type stringLitCollector map[string]bool
+
+func (c stringLitCollector) VisitTopdown(e ast.Expr) ast.Visitor {
+	if s, ok := e.(*ast.String); ok {
+		c[s.Value] = true
+	}
+	return c
+}
+
+func (c stringLitCollector) VisitBottomup(ast.Expr) {}
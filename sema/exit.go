@@ -0,0 +1,161 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/token"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// 'exit' is a special built-in function which terminates the program with the exit code. Since it
+// never returns, its return type is the bottom type. The bottom type is represented as a fresh type
+// variable so that 'exit' can be used in any context.
+//   let x = if n < 0 then exit 1 else n in ...  (* 'exit 1' is typed as 'int' *)
+// When the type variable is not determined by its context, it is defaulted to 'unit' after type
+// inference. For the defaulting, 'let' binding the call directly does not generalize it.
+//
+// Expressions following a diverging expression in a sequence are never evaluated. They are reported
+// as unreachable while dereferencing type variables.
+//   exit 1; println_str "never printed"
+//
+// The call is lowered into a call of runtime function followed by 'unreachable' instruction while
+// converting AST into MIR.
+const (
+	exitName     = "exit"
+	exitFuncName = "__exit$builtin"
+)
+
+// isExit returns true when the expression refers the built-in 'exit' function. 'exit' may be
+// declared with 'external'.
+func isExit(env *Env, e ast.Expr) bool {
+	ref, ok := e.(*ast.VarRef)
+	if !ok || ref.Symbol.Name != exitName {
+		return false
+	}
+	_, ok = env.Externals[ref.Symbol.Name]
+	return !ok
+}
+
+// isDiverging returns true when the expression never returns and its type is the bottom type. It is
+// 'exit' call, or 'break' or 'continue' in 'for' loop.
+func isDiverging(env *Env, e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Apply:
+		return isExit(env, e.Callee)
+	case *ast.Break, *ast.Continue, *ast.LoopJump:
+		return true
+	default:
+		return false
+	}
+}
+
+func (inf *Inferer) inferExit(node *ast.Apply, level int) (Type, error) {
+	if len(node.Args) != 1 {
+		return nil, locerr.ErrorfIn(node.Pos(), node.End(), "'exit' requires exactly 1 argument but %d argument(s) given", len(node.Args))
+	}
+	if err := inf.checkNodeType("exit code of 'exit'", node.Args[0], IntType, level); err != nil {
+		return nil, err
+	}
+	return NewVar(nil, level), nil
+}
+
+// defaultDivergingTypes fixes types of diverging expressions which are not determined by their
+// contexts as unit.
+func (inf *Inferer) defaultDivergingTypes() {
+	for e, t := range inf.inferred {
+		if !isDiverging(inf.Env, e) {
+			continue
+		}
+		for {
+			v, ok := t.(*Var)
+			if !ok {
+				break
+			}
+			if v.Ref == nil {
+				if !v.IsGeneric() {
+					v.Ref = UnitType
+				}
+				break
+			}
+			t = v.Ref
+		}
+	}
+}
+
+// divergence is information of an expression which never returns.
+type divergence struct {
+	// The expression which makes the program diverge such as 'exit' call
+	origin ast.Expr
+	// True when expressions following the origin were already reported as unreachable
+	reported bool
+}
+
+// checkDivergence records the node when it never returns. It is called in bottom-up order so
+// children of the node were already checked. Expressions which follow a diverging expression are
+// reported as unreachable.
+func (d *typeVarDereferencer) checkDivergence(node ast.Expr) {
+	var div *divergence
+	switch n := node.(type) {
+	case *ast.Apply:
+		if isExit(d.env, n.Callee) {
+			div = &divergence{n, false}
+		}
+	case *ast.Break, *ast.Continue:
+		div = &divergence{n, false}
+	case *ast.Let:
+		if n.LetToken.Kind == token.FOR {
+			// Generated by desugaring 'for' loop. Expressions generated after the loop body are not
+			// reported even if the body never returns (e.g. the body ends with 'break').
+			if div = d.diverging[n.Bound]; div == nil {
+				div = d.diverging[n.Body]
+			}
+			break
+		}
+		div = d.divergesAfter(n.Bound, n.Body)
+	case *ast.LetTuple:
+		div = d.divergesAfter(n.Bound, n.Body)
+	case *ast.LetRec:
+		div = d.diverging[n.Body]
+	case *ast.If:
+		div = d.divergesBranches(node, n.Cond, n.Then, n.Else)
+	case *ast.Match:
+		div = d.divergesBranches(node, n.Target, n.IfSome, n.IfNone)
+	case *ast.MatchResult:
+		div = d.divergesBranches(node, n.Target, n.IfOk, n.IfError)
+	}
+	if div != nil {
+		d.diverging[node] = div
+	}
+}
+
+// divergesBranches returns the divergence of the branching expression. It never returns when its
+// condition never returns or when all of its branches never return.
+func (d *typeVarDereferencer) divergesBranches(node, cond, left, right ast.Expr) *divergence {
+	if div, ok := d.diverging[cond]; ok {
+		return div
+	}
+	if _, ok := d.diverging[left]; !ok {
+		return nil
+	}
+	if _, ok := d.diverging[right]; !ok {
+		return nil
+	}
+	return &divergence{node, false}
+}
+
+// divergesAfter reports the body as unreachable when the bound expression never returns. Since
+// sequences are nested to the left, only the first unreachable expression after the diverging
+// expression is reported.
+//   exit 1; a; b  (* parsed as '(exit 1; a); b'. Only 'a' is reported *)
+func (d *typeVarDereferencer) divergesAfter(bound, body ast.Expr) *divergence {
+	div, ok := d.diverging[bound]
+	if !ok {
+		return d.diverging[body]
+	}
+	if !div.reported {
+		w := d.warnings.Warnf(WarnUnreachableCode, SeverityWarning, body.Pos(), body.End(), "Unreachable expression. It is never evaluated because the preceding expression never returns")
+		w.NotefAt(div.origin.Pos(), "This expression never returns")
+	}
+	return &divergence{div.origin, true}
+}
@@ -0,0 +1,166 @@
+package sema
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestExitTypes(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{"typed by if branch", "let x = if true then exit 1 else 42 in println_int x", "int"},
+		{"typed by argument", "println_str (exit 1)", "string"},
+		{"defaulted to unit", "exit 1", "unit"},
+		{"defaulted in sequence", "exit 0; ()", "unit"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, inferred, err := Analyze(parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for e, ty := range inferred {
+				app, ok := e.(*ast.Apply)
+				if !ok || app.Callee.(*ast.VarRef).Symbol.Name != exitName {
+					continue
+				}
+				found = true
+				if s := ty.String(); s != tc.expected {
+					t.Fatalf("Expected type '%s' but got '%s'", tc.expected, s)
+				}
+			}
+			if !found {
+				t.Fatal("Call of 'exit' was not found")
+			}
+		})
+	}
+}
+
+func TestExitError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{"exit code is not int", "exit true", "exit code of 'exit' must be 'int'"},
+		{"wrong arity", "exit 1 2", "'exit' requires exactly 1 argument"},
+		{"as value", "let f = exit in ()", "'exit' cannot be used as a value"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestUnreachableWarnings(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected int
+	}{
+		{"after exit", "exit 1; println_int 42", 1},
+		{"multiple expressions after exit", "exit 1; println_int 1; println_int 2; println_int 3", 1},
+		{"nested sequence in let", "let x = (exit 1; 1) in println_int x; println_int 2", 1},
+		{"exit at last", "println_int 42; exit 1", 0},
+		{"after let binding", "let x = exit 1 in println_int x", 1},
+		{"after diverging if", "(if true then exit 1 else exit 2); ()", 1},
+		{"after if with one diverging branch", "(if true then exit 1 else ()); ()", 0},
+		{"after diverging match", "let o = Some 1 in (match o with Some _ -> exit 1 | None -> exit 2); ()", 1},
+		{"inside function", "let rec f x = exit x; () in f 1", 1},
+		{"after function which calls exit", "let rec f x = exit x in f 1; ()", 0},
+		{"exit declared as external", "external exit: int -> unit = \"exit\"; exit 1; ()", 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := NewWarnings()
+			if err := ws.Configure("none,W004"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+				t.Fatal(err)
+			}
+			list := ws.List()
+			if len(list) != tc.expected {
+				t.Fatalf("Expected %d warnings but got %v", tc.expected, list)
+			}
+			for _, w := range list {
+				if !strings.Contains(w.String(), "[W004]: Unreachable expression") {
+					t.Errorf("Unexpected warning: %s", w.String())
+				}
+			}
+		})
+	}
+}
+
+func TestUnreachableWarningPosition(t *testing.T) {
+	code := "println_int 1;\nexit 1;\nprintln_int 2;\nprintln_int 3"
+	parsed, err := syntax.Parse(locerr.NewDummySource(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWarnings()
+	if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+		t.Fatal(err)
+	}
+	list := ws.List()
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 warning but got %v", list)
+	}
+	w := list[0]
+	if w.Start.Line != 3 || w.Start.Column != 1 {
+		t.Errorf("Warning should be reported at the first unreachable expression but got %d:%d", w.Start.Line, w.Start.Column)
+	}
+	if len(w.Notes) != 1 {
+		t.Fatalf("Expected 1 note but got %v", w.Notes)
+	}
+	if p := w.Notes[0].Pos; p.Line != 2 || p.Column != 1 {
+		t.Errorf("Note should point the 'exit' call but got %d:%d", p.Line, p.Column)
+	}
+}
+
+func TestExitEmitsUnreachable(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("println_int (if true then exit 1 else 42)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := SemanticsCheck(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	out := buf.String()
+	if !strings.Contains(out, "xref "+exitFuncName) || !strings.Contains(out, "unreachable") {
+		t.Fatalf("Call of 'exit' was not lowered: %s", out)
+	}
+}
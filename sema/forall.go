@@ -0,0 +1,290 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// Rank-N polymorphic types are not inferred. They are only checked with explicit annotations of
+// function parameters.
+//   let rec pair (f : forall 'a. 'a -> 'a) = (f 1, f true) in
+//   let rec id x = x in
+//   pair id
+// In the body of 'pair', 'f' is instantiated at each reference like let-polymorphism. At the call site,
+// the argument is inferred and generalized, then it is checked to be at least as polymorphic as the
+// annotated type.
+
+func derefForall(t Type) (*Forall, bool) {
+	for {
+		v, ok := t.(*Var)
+		if !ok || v.Ref == nil {
+			break
+		}
+		t = v.Ref
+	}
+	f, ok := t.(*Forall)
+	return f, ok
+}
+
+// forallParamsOf returns rank-N polymorphic parameter types of callee. When callee has no such
+// parameter, it returns nil. Elements for other parameters are nil. When type of the callee is not
+// determined yet, pending constraints are solved to determine it.
+func (inf *Inferer) forallParamsOf(callee ast.Expr) ([]*Forall, error) {
+	ref, ok := callee.(*ast.VarRef)
+	if !ok {
+		return nil, nil
+	}
+	t, ok := inf.Env.DeclTable[ref.Symbol.Name]
+	if !ok {
+		return nil, nil
+	}
+	if _, ok := resolvedTypeOf(t).(*Var); ok && len(inf.constraints) > 0 {
+		if err := inf.solve(); err != nil {
+			return nil, err
+		}
+	}
+	fun, ok := resolvedTypeOf(t).(*Fun)
+	if !ok {
+		return nil, nil
+	}
+
+	var params []*Forall
+	for i, p := range fun.Params {
+		f, ok := derefForall(p)
+		if !ok {
+			continue
+		}
+		if params == nil {
+			params = make([]*Forall, len(fun.Params))
+		}
+		params[i] = f
+	}
+	return params, nil
+}
+
+type polyArgMatcher struct {
+	forall *Forall
+	// Type variables instantiated from generalized type of the argument
+	fresh map[VarID]struct{}
+	// Types assigned to the fresh type variables
+	subst map[VarID]Type
+}
+
+func (m *polyArgMatcher) isBound(v *Var) bool {
+	for _, b := range m.forall.Vars {
+		if b == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *polyArgMatcher) containsBound(t Type) bool {
+	switch t := t.(type) {
+	case *Var:
+		if t.Ref != nil {
+			return m.containsBound(t.Ref)
+		}
+		return m.isBound(t)
+	case *Fun:
+		if m.containsBound(t.Ret) {
+			return true
+		}
+		for _, p := range t.Params {
+			if m.containsBound(p) {
+				return true
+			}
+		}
+	case *Tuple:
+		for _, e := range t.Elems {
+			if m.containsBound(e) {
+				return true
+			}
+		}
+	case *Array:
+		return m.containsBound(t.Elem)
+	case *Option:
+		return m.containsBound(t.Elem)
+	case *Result:
+		return m.containsBound(t.Ok) || m.containsBound(t.Error)
+	case *Table:
+		return m.containsBound(t.Key) || m.containsBound(t.Value)
+	case *Variant:
+		tags, _ := t.Flatten()
+		for _, tag := range tags {
+			if tag.Payload != nil && m.containsBound(tag.Payload) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *polyArgMatcher) matchVar(v *Var, param Type) *locerr.Error {
+	if _, ok := m.fresh[v.ID]; ok {
+		if assigned, ok := m.subst[v.ID]; ok {
+			if Equals(assigned, param) {
+				return nil
+			}
+			if l, ok := assigned.(*Var); ok && m.isBound(l) {
+				if r, ok := param.(*Var); ok && m.isBound(r) {
+					return locerr.Errorf("Type variables bound by 'forall' must be distinct but the argument requires them to be the same type")
+				}
+			}
+			return locerr.Errorf("Type variable of the argument would need to be both '%s' and '%s'", assigned.String(), param.String())
+		}
+		m.subst[v.ID] = param
+		return nil
+	}
+
+	// Free type variable which comes from outside of the argument. When it is bound to a type
+	// variable of 'forall', the type variable escapes from its scope.
+	if m.containsBound(param) {
+		return locerr.Errorf("Type '%s' is not general enough because it depends on a type outside the argument", param.String())
+	}
+	return Unify(v, param)
+}
+
+// match checks the type of argument is an instance of the body of Forall type. Type variables bound
+// by the Forall type are rigid. They can only be matched with type variables of the argument.
+func (m *polyArgMatcher) match(arg, param Type) *locerr.Error {
+	if v, ok := arg.(*Var); ok && v.Ref != nil {
+		return m.match(v.Ref, param)
+	}
+
+	if pv, ok := param.(*Var); ok && m.isBound(pv) {
+		av, ok := arg.(*Var)
+		if !ok || av.IsGeneric() {
+			return locerr.Errorf("Type '%s' is not general enough. Polymorphic type is expected here", arg.String())
+		}
+		return m.matchVar(av, pv)
+	}
+
+	switch a := arg.(type) {
+	case *Var:
+		return m.matchVar(a, param)
+	case *Fun:
+		p, ok := param.(*Fun)
+		if !ok || len(a.Params) != len(p.Params) {
+			break
+		}
+		for i, ap := range a.Params {
+			if err := m.match(ap, p.Params[i]); err != nil {
+				return err
+			}
+		}
+		return m.match(a.Ret, p.Ret)
+	case *Tuple:
+		p, ok := param.(*Tuple)
+		if !ok || len(a.Elems) != len(p.Elems) {
+			break
+		}
+		for i, e := range a.Elems {
+			if err := m.match(e, p.Elems[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Array:
+		if p, ok := param.(*Array); ok {
+			return m.match(a.Elem, p.Elem)
+		}
+	case *Option:
+		if p, ok := param.(*Option); ok {
+			return m.match(a.Elem, p.Elem)
+		}
+	case *Result:
+		if p, ok := param.(*Result); ok {
+			if err := m.match(a.Ok, p.Ok); err != nil {
+				return err
+			}
+			return m.match(a.Error, p.Error)
+		}
+	case *Table:
+		if p, ok := param.(*Table); ok {
+			if err := m.match(a.Key, p.Key); err != nil {
+				return err
+			}
+			return m.match(a.Value, p.Value)
+		}
+	default:
+		if !m.containsBound(param) {
+			return Unify(arg, param)
+		}
+	}
+
+	return locerr.Errorf("Type mismatch between '%s' and '%s'", arg.String(), param.String())
+}
+
+// checkPolyArg checks the argument for rank-N polymorphic parameter. The argument is inferred and
+// generalized, then it is checked to be at least as polymorphic as the annotated type.
+func (inf *Inferer) checkPolyArg(arg ast.Expr, param *Forall, level int) error {
+	t, err := inf.infer(arg, level+1)
+	if err != nil {
+		return err
+	}
+	if err := inf.solve(); err != nil {
+		return err
+	}
+	gen, _ := generalize(t, level)
+
+	m := &polyArgMatcher{param, map[VarID]struct{}{}, map[VarID]Type{}}
+	t = gen
+	if inst := instantiate(gen, level); inst != nil {
+		t = inst.To
+		for _, mapping := range inst.Mapping {
+			v := mapping.Type.(*Var)
+			m.fresh[v.ID] = struct{}{}
+		}
+	}
+
+	if err := m.match(t, param.Body); err != nil {
+		return err.In(arg.Pos(), arg.End()).NotefAt(arg.Pos(), "Argument typed '%s' is not as polymorphic as '%s'", gen.String(), param.String())
+	}
+	return nil
+}
+
+type forallParamFinder struct {
+	polyCalls map[*ast.FuncDef]*ast.VarRef
+	// Polymorphic type annotations of recursive functions. They are not rank-N polymorphic types
+	annots map[ast.Expr]struct{}
+	err    *locerr.Error
+}
+
+func (f *forallParamFinder) VisitTopdown(e ast.Expr) ast.Visitor {
+	if f.err != nil {
+		return nil
+	}
+	if n, ok := e.(*ast.LetRec); ok && n.Func.Poly != nil {
+		if ref, ok := f.polyCalls[n.Func]; ok {
+			f.err = locerr.ErrorfIn(ref.Pos(), ref.End(), "Function '%s' calls itself with different types. It can be type-checked, run by interpreter and compiled into JavaScript but cannot be compiled yet because polymorphic recursion cannot be monomorphized", n.Func.Symbol.DisplayName)
+			f.err = f.err.NotefAt(n.Func.Poly.Pos(), "Polymorphic type annotation of '%s'", n.Func.Symbol.DisplayName)
+			return nil
+		}
+		f.annots[n.Func.Poly] = struct{}{}
+	}
+	if t, ok := e.(*ast.ForallType); ok {
+		if _, ok := f.annots[t]; ok {
+			return f
+		}
+		f.err = locerr.ErrorIn(t.Pos(), t.End(), "Rank-N polymorphic parameter can be type-checked, run by interpreter and compiled into JavaScript but cannot be compiled yet because all functions are monomorphized at compile time")
+		return nil
+	}
+	return f
+}
+
+func (f *forallParamFinder) VisitBottomup(ast.Expr) {}
+
+// rejectForallTypes reports an error when the program contains rank-N polymorphic parameters or
+// polymorphically recursive functions. They cannot be monomorphized. Only the interpreter and the
+// JavaScript backend, which do not monomorphize MIR, support them.
+func rejectForallTypes(root ast.Expr, polyCalls map[*ast.FuncDef]*ast.VarRef) error {
+	f := &forallParamFinder{polyCalls, map[ast.Expr]struct{}{}, nil}
+	ast.Visit(f, root)
+	if f.err != nil {
+		return f.err
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestForallParamOK(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		param    string
+		expected string
+	}{
+		{
+			what:     "identity function passed to rank-2 parameter",
+			code:     "let rec pair (f : forall 'a. 'a -> 'a) = (f 1, f true) in let rec id x = x in pair id",
+			param:    "f",
+			expected: "forall 'a. 'a -> 'a",
+		},
+		{
+			what:     "lambda passed to rank-2 parameter",
+			code:     "let rec app (f : forall 'a 'b. 'a -> 'b -> 'a) = f 1 true in app (fun x y -> x)",
+			param:    "f",
+			expected: "forall 'a 'b. 'a -> 'b -> 'a",
+		},
+		{
+			what:     "argument more polymorphic than parameter",
+			code:     "let rec app (f : forall 'a. 'a -> 'a -> 'a) = f 1 2 in let rec k x y = x in app k",
+			param:    "f",
+			expected: "forall 'a. 'a -> 'a -> 'a",
+		},
+		{
+			what:     "concrete type in forall type",
+			code:     "let rec app (f : forall 'a. 'a -> int) = f true + f 1.0 in app (fun x -> 42)",
+			param:    "f",
+			expected: "forall 'a. 'a -> int",
+		},
+		{
+			what:     "unused type variable is removed",
+			code:     "let rec app (f : forall 'a. int -> int) = f 1 in app (fun x -> x + 1)",
+			param:    "f",
+			expected: "int -> int",
+		},
+		{
+			what:     "forall type passed through another rank-2 function",
+			code:     "let rec app (f : forall 'a. 'a -> 'a) = f 1 in let rec app2 (g : forall 'a. 'a -> 'a) = app g in let rec id x = x in app2 id",
+			param:    "g",
+			expected: "forall 'a. 'a -> 'a",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			if err := NewInferer(env).Infer(parsed); err != nil {
+				t.Fatal(err)
+			}
+			for name, ty := range env.DeclTable {
+				if strings.HasPrefix(name, tc.param+"$") {
+					if actual := ty.String(); actual != tc.expected {
+						t.Fatalf("Type of parameter '%s' should be '%s' but actually '%s'", tc.param, tc.expected, actual)
+					}
+					return
+				}
+			}
+			t.Fatalf("Parameter '%s' was not found in %v", tc.param, env.DeclTable)
+		})
+	}
+}
+
+func TestForallParamError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "monomorphic function passed to rank-2 parameter",
+			code:     "let rec pair (f : forall 'a. 'a -> 'a) = (f 1, f true) in let rec inc x = x + 1 in pair inc",
+			expected: "Argument typed 'int -> int' is not as polymorphic as 'forall 'a. 'a -> 'a'",
+		},
+		{
+			what:     "type variables of argument are not distinguished",
+			code:     "let rec app (f : forall 'a 'b. 'a -> 'b -> 'a) = f 1 true in let rec k x y = if true then x else y in app k",
+			expected: "Type variables bound by 'forall' must be distinct",
+		},
+		{
+			what:     "bound type variable escapes",
+			code:     "let rec g y = let rec app (f : forall 'a. 'a -> 'a) = f 1 in let rec k x = y in app k in g 3",
+			expected: "depends on a type outside the argument",
+		},
+		{
+			what:     "monomorphic parameter passed to rank-2 parameter",
+			code:     "let rec app (f : forall 'a. 'a -> 'a) = f 1 in let rec h g = app g in ()",
+			expected: "is not general enough because it depends on a type outside the argument",
+		},
+		{
+			what:     "polymorphic parameter is used monomorphically in body",
+			code:     "let rec app (f : forall 'a. 'a -> 'a) = f 1 + 1 in app (fun x -> 10)",
+			expected: "is not as polymorphic as",
+		},
+		{
+			what:     "unbound type variable",
+			code:     "let rec f (x : 'a) = x in f 1",
+			expected: "Type variable 'a is not bound",
+		},
+		{
+			what:     "type variable bound by other forall",
+			code:     "let rec f (g : forall 'a. 'a -> 'a) (x : 'a) = x in ()",
+			expected: "Type variable 'a is not bound",
+		},
+		{
+			what:     "duplicate type variables",
+			code:     "let rec f (g : forall 'a 'a. 'a -> 'a) = g 1 in ()",
+			expected: "Type variable 'a is bound twice",
+		},
+		{
+			what:     "'_' in forall type",
+			code:     "let rec f (g : forall 'a. 'a -> _) = g 1 in ()",
+			expected: "'_' is not permitted",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			err = NewInferer(env).Infer(parsed)
+			if err == nil {
+				t.Fatalf("Expected code '%s' to cause an error '%s' but actually there is no error", tc.code, tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestForallParamRejectedOnCodegen(t *testing.T) {
+	s := locerr.NewDummySource("let rec app (f : forall 'a. 'a -> 'a) = f 1 in let rec id x = x in app id; ()")
+	parsed, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Analyze(parsed); err != nil {
+		t.Fatal("Rank-N polymorphic parameter should be accepted by type checking:", err)
+	}
+
+	parsed, err = syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = SemanticsCheck(parsed)
+	if err == nil {
+		t.Fatal("Rank-N polymorphic parameter should be rejected before code generation")
+	}
+	if !strings.Contains(err.Error(), "cannot be compiled yet") {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestForallTypesAcceptedWithoutMonomorphization(t *testing.T) {
+	for _, code := range []string{
+		"let rec app (f : forall 'a. 'a -> 'a) = f 1 in let rec id x = x in app id; ()",
+		"let rec f : 'a. 'a -> int -> int = fun x n -> if n = 0 then 0 else f (x, x) (n - 1) in print_int (f 1 3)",
+	} {
+		parsed, err := syntax.Parse(locerr.NewDummySource(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := SemanticsCheckWithOptions(parsed, Options{false, nil, false, false, true}); err != nil {
+			t.Fatalf("Code '%s' should be accepted when MIR is not monomorphized: %s", code, err)
+		}
+	}
+}
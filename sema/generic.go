@@ -4,6 +4,15 @@ import (
 	"github.com/rhysd/gocaml/types"
 )
 
+// Note:
+// Generalization is based on levels of type variables (Remy's algorithm). Each type variable has
+// the level of 'let' where it is created. Occur check lowers levels of type variables in the type
+// which a type variable is resolved to. So a type variable whose level is deeper than the current
+// 'let' never escapes to the environment and can be generalized safely.
+//   let f = fun x -> x in ...   (* 'x' is typed as ?(1) at level 1. It is generalized at level 0 *)
+// Thanks to the levels, generalization only needs to traverse the type and does not need to scan
+// the type environment.
+
 type boundVarIDs map[types.VarID]struct{}
 
 func (ids boundVarIDs) add(id types.VarID) {
@@ -18,6 +27,8 @@ func (ids boundVarIDs) contains(id types.VarID) bool {
 type generalizer struct {
 	bounds boundVarIDs
 	level  int
+	// Type variables which must not be generalized due to value restriction
+	weaks boundVarIDs
 }
 
 func (gen *generalizer) apply(t types.Type) types.Type {
@@ -27,6 +38,19 @@ func (gen *generalizer) apply(t types.Type) types.Type {
 			return gen.apply(t.Ref)
 		}
 		if t.Level > gen.level {
+			if t.Constraint == types.NumConstraint {
+				// Type variable of integer literal is never generalized. It is resolved by its
+				// uses or defaulted to 'int'.
+				t.Level = gen.level
+				return t
+			}
+			if gen.weaks.contains(t.ID) {
+				// Weak type variable belongs to current level. Enclosing function may still
+				// generalize it.
+				t.Level = gen.level
+				t.Weak = true
+				return t
+			}
 			gen.bounds.add(t.ID)
 			t.SetGeneric()
 		}
@@ -41,6 +65,24 @@ func (gen *generalizer) apply(t types.Type) types.Type {
 		return &types.Array{gen.apply(t.Elem)}
 	case *types.Option:
 		return &types.Option{gen.apply(t.Elem)}
+	case *types.Result:
+		return &types.Result{gen.apply(t.Ok), gen.apply(t.Error)}
+	case *types.Table:
+		return &types.Table{gen.apply(t.Key), gen.apply(t.Value)}
+	case *types.Variant:
+		tags, row := t.Flatten()
+		applied := make([]*types.VariantTag, 0, len(tags))
+		for _, tag := range tags {
+			var p types.Type
+			if tag.Payload != nil {
+				p = gen.apply(tag.Payload)
+			}
+			applied = append(applied, &types.VariantTag{tag.Name, p})
+		}
+		if row == nil {
+			return &types.Variant{applied, nil}
+		}
+		return &types.Variant{applied, gen.apply(row)}
 	case *types.Fun:
 		params := make([]types.Type, 0, len(t.Params))
 		for _, p := range t.Params {
@@ -55,7 +97,7 @@ func (gen *generalizer) apply(t types.Type) types.Type {
 // Generalize given type variable. It means binding proper free type variables in the type. It returns
 // generalized type and IDs of bound type variables in given type.
 func generalize(t types.Type, level int) (types.Type, boundVarIDs) {
-	gen := &generalizer{boundVarIDs{}, level}
+	gen := &generalizer{boundVarIDs{}, level, nil}
 	t = gen.apply(t)
 	return t, gen.bounds
 }
@@ -80,6 +122,7 @@ func (inst *instantiator) apply(t types.Type) types.Type {
 			}
 		}
 		v := types.NewVar(nil, inst.level)
+		v.Constraint = t.Constraint
 		inst.freeVars = append(inst.freeVars, &types.VarMapping{t.ID, v})
 		return v
 	case *types.Tuple:
@@ -92,6 +135,24 @@ func (inst *instantiator) apply(t types.Type) types.Type {
 		return &types.Array{inst.apply(t.Elem)}
 	case *types.Option:
 		return &types.Option{inst.apply(t.Elem)}
+	case *types.Result:
+		return &types.Result{inst.apply(t.Ok), inst.apply(t.Error)}
+	case *types.Table:
+		return &types.Table{inst.apply(t.Key), inst.apply(t.Value)}
+	case *types.Variant:
+		tags, row := t.Flatten()
+		applied := make([]*types.VariantTag, 0, len(tags))
+		for _, tag := range tags {
+			var p types.Type
+			if tag.Payload != nil {
+				p = inst.apply(tag.Payload)
+			}
+			applied = append(applied, &types.VariantTag{tag.Name, p})
+		}
+		if row == nil {
+			return &types.Variant{applied, nil}
+		}
+		return &types.Variant{applied, inst.apply(row)}
 	case *types.Fun:
 		ts := make([]types.Type, 0, len(t.Params))
 		for _, p := range t.Params {
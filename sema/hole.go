@@ -0,0 +1,130 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+)
+
+// Note:
+// Typed hole is a placeholder for an expression which is not written yet.
+//   let rec f x = x + ?todo in ...
+// Its type is inferred from its context like other expressions. After type inference, all holes are
+// reported as an error with their types and in-scope variables which can be put in them.
+
+type hole struct {
+	node *ast.Hole
+	t    Type
+}
+
+// holeMatcher checks a variable can be put in a hole. Generic type variables of the variable's type
+// can be instantiated. Unresolved type variables of the hole's type accept any type.
+type holeMatcher struct {
+	subst map[VarID]Type
+}
+
+func (m *holeMatcher) match(cand, want Type) bool {
+	cand, want = resolvedTypeOf(cand), resolvedTypeOf(want)
+
+	if _, ok := want.(*Var); ok {
+		return true
+	}
+
+	switch c := cand.(type) {
+	case *Var:
+		if prev, ok := m.subst[c.ID]; ok {
+			return Equals(prev, want)
+		}
+		m.subst[c.ID] = want
+		return true
+	case *Fun:
+		w, ok := want.(*Fun)
+		if !ok || len(c.Params) != len(w.Params) {
+			return false
+		}
+		for i, p := range c.Params {
+			if !m.match(p, w.Params[i]) {
+				return false
+			}
+		}
+		return m.match(c.Ret, w.Ret)
+	case *Tuple:
+		w, ok := want.(*Tuple)
+		if !ok || len(c.Elems) != len(w.Elems) {
+			return false
+		}
+		for i, e := range c.Elems {
+			if !m.match(e, w.Elems[i]) {
+				return false
+			}
+		}
+		return true
+	case *Array:
+		w, ok := want.(*Array)
+		return ok && m.match(c.Elem, w.Elem)
+	case *Option:
+		w, ok := want.(*Option)
+		return ok && m.match(c.Elem, w.Elem)
+	case *Result:
+		w, ok := want.(*Result)
+		return ok && m.match(c.Ok, w.Ok) && m.match(c.Error, w.Error)
+	case *Table:
+		w, ok := want.(*Table)
+		return ok && m.match(c.Key, w.Key) && m.match(c.Value, w.Value)
+	default:
+		return Equals(cand, want)
+	}
+}
+
+func (inf *Inferer) holeCandidates(h *hole) []string {
+	cands := []string{}
+	for _, sym := range h.node.Scope {
+		t, ok := inf.Env.DeclTable[sym.Name]
+		if !ok {
+			continue
+		}
+		m := &holeMatcher{map[VarID]Type{}}
+		if m.match(t, h.t) {
+			cands = append(cands, fmt.Sprintf("%s : %s", sym.DisplayName, t.String()))
+		}
+	}
+	return cands
+}
+
+// reportHoles reports all holes in program with their types. It returns nil when there is no hole.
+func (inf *Inferer) reportHoles() *locerr.Error {
+	if len(inf.holes) == 0 {
+		return nil
+	}
+
+	// Candidates must be collected before generalizing types of holes for display
+	cands := make([][]string, 0, len(inf.holes))
+	for _, h := range inf.holes {
+		cands = append(cands, inf.holeCandidates(h))
+	}
+
+	var err *locerr.Error
+	for i, h := range inf.holes {
+		// Unresolved type variables in the type of hole can be any type. Generalize them to display
+		// them as 'a, 'b, ... instead of internal type variables.
+		t, _ := generalize(h.t, -1)
+		n := h.node
+
+		msg := fmt.Sprintf("Found hole ?%s. It must have type '%s'", n.Ident, t.String())
+		if err == nil {
+			err = locerr.ErrorIn(n.Pos(), n.End(), msg)
+		} else {
+			err = err.NoteAt(n.Pos(), msg)
+		}
+
+		if len(cands[i]) == 0 {
+			err = err.Notef("No variable in scope can be put in hole ?%s", n.Ident)
+		} else {
+			err = err.Notef("Variables in scope which can be put in hole ?%s: %s", n.Ident, strings.Join(cands[i], ", "))
+		}
+	}
+
+	return err
+}
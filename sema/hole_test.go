@@ -0,0 +1,96 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestHoleReport(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{
+			what: "type of hole is inferred from context",
+			code: "let rec f x = x + ?todo in ()",
+			expected: []string{
+				"Found hole ?todo. It must have type 'int'",
+				"Variables in scope which can be put in hole ?todo: x : int",
+			},
+		},
+		{
+			what: "no candidate in scope",
+			code: "let b = true in print_str ?s",
+			expected: []string{
+				"Found hole ?s. It must have type 'string'",
+				"No variable in scope can be put in hole ?s",
+			},
+		},
+		{
+			what: "out of scope variable is not a candidate",
+			code: "let a = (let s = \"foo\" in s) in print_str ?s",
+			expected: []string{
+				"Variables in scope which can be put in hole ?s: a : string",
+			},
+		},
+		{
+			what: "shadowed variable is not a candidate",
+			code: "let x = 1 in let x = true in print_int ?i",
+			expected: []string{
+				"No variable in scope can be put in hole ?i",
+			},
+		},
+		{
+			what: "polymorphic variable is a candidate",
+			code: "let rec id x = x in let rec app f = f 1 + 1 in app ?fn; ()",
+			expected: []string{
+				"Found hole ?fn. It must have type 'int -> int'",
+				"Variables in scope which can be put in hole ?fn: id : 'a -> 'a",
+			},
+		},
+		{
+			what: "hole can be any type",
+			code: "let x = ?any in ()",
+			expected: []string{
+				"Found hole ?any. It must have type ''a'",
+			},
+		},
+		{
+			what: "all holes are reported",
+			code: "let t = (1, ?a) in let rec f x = x && ?b in ()",
+			expected: []string{
+				"Found hole ?a.",
+				"Found hole ?b. It must have type 'bool'",
+				"hole ?b: x : bool",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			err = NewInferer(env).Infer(parsed)
+			if err == nil {
+				t.Fatalf("Holes in code '%s' should be reported but actually there is no error", tc.code)
+			}
+			msg := err.Error()
+			for _, e := range tc.expected {
+				if !strings.Contains(msg, e) {
+					t.Errorf("Error message '%s' does not contain '%s'", msg, e)
+				}
+			}
+		})
+	}
+}
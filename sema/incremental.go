@@ -0,0 +1,412 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strconv"
+	"strings"
+)
+
+// Note:
+// Program is a chain of top-level bindings followed by the last expression.
+//   let x = ... in
+//   let rec f a = ... in
+//   let (a, b) = ... in
+//   last expression
+// Incremental re-typechecking re-infers only the changed top-level bindings and the bindings
+// depending on them. Dependencies are found by references to variables declared by top-level
+// bindings. Thanks to alpha transform, a symbol identifies its declaration uniquely.
+// Since type of a binding which is not generalized due to value restriction is fixed by its uses,
+// such binding is also re-inferred when some binding depending on it is re-inferred.
+//
+// Only bound expressions of 'let' and 'let (...)', bodies of 'let rec' functions and the last
+// expression can be replaced. Declarations themselves such as names, parameters and type
+// annotations cannot be changed incrementally.
+
+// topLevel is a top-level binding or the last expression of program.
+type topLevel struct {
+	// *ast.Let, *ast.LetRec, *ast.LetTuple or the last expression
+	node ast.Expr
+	// Bound expression, body of function or the last expression at the last analysis
+	bound ast.Expr
+	// Symbols declared by the binding
+	syms []*ast.Symbol
+	// Indices of top-level bindings the binding refers
+	deps map[int]struct{}
+	// True when type of the binding may not be generalized due to value restriction
+	weak bool
+}
+
+func boundOf(node ast.Expr) ast.Expr {
+	switch n := node.(type) {
+	case *ast.Let:
+		return n.Bound
+	case *ast.LetRec:
+		return n.Func.Body
+	case *ast.LetTuple:
+		return n.Bound
+	default:
+		return node
+	}
+}
+
+// topLevelsOf collects the top-level bindings and the last expression of the program.
+func topLevelsOf(root ast.Expr) []*topLevel {
+	tops := []*topLevel{}
+	e := root
+	for {
+		top := &topLevel{node: e, bound: boundOf(e)}
+		tops = append(tops, top)
+		switch n := e.(type) {
+		case *ast.Let:
+			top.syms = []*ast.Symbol{n.Symbol}
+			top.weak = !isValue(n.Bound)
+			e = n.Body
+		case *ast.LetRec:
+			top.syms = []*ast.Symbol{n.Func.Symbol}
+			e = n.Body
+		case *ast.LetTuple:
+			top.syms = n.Symbols
+			top.weak = !isValue(n.Bound)
+			e = n.Body
+		default:
+			return tops
+		}
+	}
+}
+
+type refCollector struct {
+	refs map[string]struct{}
+}
+
+func (c *refCollector) VisitTopdown(e ast.Expr) ast.Visitor {
+	if ref, ok := e.(*ast.VarRef); ok {
+		c.refs[ref.Symbol.Name] = struct{}{}
+	}
+	return c
+}
+
+func (c *refCollector) VisitBottomup(ast.Expr) {}
+
+// declaredSymbols returns symbols declared by the node.
+func declaredSymbols(e ast.Expr) []*ast.Symbol {
+	switch n := e.(type) {
+	case *ast.Let:
+		return []*ast.Symbol{n.Symbol}
+	case *ast.LetRec:
+		return append(n.Func.ParamSymbols(), n.Func.Symbol)
+	case *ast.LetTuple:
+		return n.Symbols
+	case *ast.Match:
+		return []*ast.Symbol{n.SomeIdent}
+	case *ast.MatchResult:
+		return []*ast.Symbol{n.OkIdent, n.ErrorIdent}
+	case *ast.MatchVariant:
+		syms := []*ast.Symbol{}
+		for _, a := range n.Arms {
+			if a.Ident != nil {
+				syms = append(syms, a.Ident)
+			}
+		}
+		return syms
+	default:
+		return nil
+	}
+}
+
+// forgetter removes results of type inference for nodes in the visited tree.
+type forgetter struct {
+	inf *Inferer
+}
+
+func (f *forgetter) forgetSym(sym *ast.Symbol) {
+	if t, ok := f.inf.Env.DeclTable[sym.Name]; ok {
+		delete(f.inf.schemes, t)
+		delete(f.inf.Env.DeclTable, sym.Name)
+	}
+}
+
+func (f *forgetter) VisitTopdown(e ast.Expr) ast.Visitor {
+	delete(f.inf.inferred, e)
+	if ref, ok := e.(*ast.VarRef); ok {
+		delete(f.inf.insts, ref)
+	}
+	for _, sym := range declaredSymbols(e) {
+		f.forgetSym(sym)
+	}
+	return f
+}
+
+func (f *forgetter) VisitBottomup(ast.Expr) {}
+
+// Incremental is a result of semantic analysis which can be updated incrementally when some top-level
+// bindings are changed. It is intended to be used by tools such as editors.
+type Incremental struct {
+	Env      *types.Env
+	Inferred InferredTypes
+	parsed   *ast.AST
+	inferer  *Inferer
+	tops     []*topLevel
+	// The last ID used for alpha transform
+	varID uint
+}
+
+// NewIncremental analyzes the program as Analyze does and remembers the information to re-typecheck
+// it incrementally.
+func NewIncremental(parsed *ast.AST) (*Incremental, error) {
+	inferer, err := analyze(parsed, Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	var id uint
+	for name := range inferer.Env.DeclTable {
+		i := strings.LastIndex(name, "$t")
+		if i < 0 {
+			continue
+		}
+		if n, err := strconv.ParseUint(name[i+2:], 10, 0); err == nil && uint(n) > id {
+			id = uint(n)
+		}
+	}
+
+	inc := &Incremental{inferer.Env, inferer.inferred, parsed, inferer, topLevelsOf(parsed.Root), id}
+	for i := range inc.tops {
+		inc.updateDeps(i)
+	}
+	return inc, nil
+}
+
+func (inc *Incremental) updateDeps(idx int) {
+	c := &refCollector{map[string]struct{}{}}
+	ast.Visit(c, inc.tops[idx].bound)
+	deps := map[int]struct{}{}
+	for i, top := range inc.tops[:idx] {
+		for _, sym := range top.syms {
+			if _, ok := c.refs[sym.Name]; ok {
+				deps[i] = struct{}{}
+			}
+		}
+	}
+	inc.tops[idx].deps = deps
+}
+
+// affected returns indices of top-level bindings to be re-inferred in order. They are the dirty
+// ones and ones depending on them.
+func (inc *Incremental) affected(dirty map[int]struct{}) []int {
+	for {
+		grown := false
+		for i, top := range inc.tops {
+			_, ok := dirty[i]
+			for d := range top.deps {
+				if _, ok := dirty[d]; ok {
+					continue
+				}
+				if ok && inc.tops[d].weak {
+					// Type of the weak binding may be fixed by this binding
+					dirty[d] = struct{}{}
+					grown = true
+				}
+			}
+			if ok {
+				continue
+			}
+			for d := range top.deps {
+				if _, ok := dirty[d]; ok {
+					dirty[i] = struct{}{}
+					grown = true
+					break
+				}
+			}
+		}
+		if !grown {
+			break
+		}
+	}
+
+	indices := make([]int, 0, len(dirty))
+	for i := range inc.tops {
+		if _, ok := dirty[i]; ok {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// transform applies alpha transform to the new bound expression of the top-level binding. Variables
+// declared by preceding top-level bindings are visible from the expression.
+func (inc *Incremental) transform(idx int) error {
+	t := newTransformer()
+	t.varId = inc.varID
+	for _, decl := range inc.parsed.TypeDecls {
+		t.typeScope.mapSymbol(decl.Ident.DisplayName, decl.Ident)
+	}
+	t.externals = make(map[string]struct{}, len(inc.Env.Externals))
+	for name := range inc.Env.Externals {
+		t.externals[name] = struct{}{}
+	}
+	for _, top := range inc.tops[:idx] {
+		for _, sym := range top.syms {
+			if !sym.IsIgnored() {
+				t.current.mapSymbol(sym.DisplayName, sym)
+			}
+		}
+	}
+
+	node := inc.tops[idx].node
+	if n, ok := node.(*ast.LetRec); ok {
+		// Function itself and its parameters are visible in its body
+		for _, sym := range append([]*ast.Symbol{n.Func.Symbol}, n.Func.ParamSymbols()...) {
+			if !sym.IsIgnored() {
+				t.current.mapSymbol(sym.DisplayName, sym)
+			}
+		}
+	}
+
+	ast.Visit(t, boundOf(node))
+	inc.varID = t.varId
+	return t.err
+}
+
+func (inc *Incremental) reinfer(top *topLevel) error {
+	inf := inc.inferer
+	switch n := top.node.(type) {
+	case *ast.Let:
+		_, err := inf.declareLet(n, 0)
+		return err
+	case *ast.LetRec:
+		return inf.declareLetRec(n, 0)
+	case *ast.LetTuple:
+		return inf.declareLetTuple(n, 0)
+	default:
+		t, err := inf.infer(n, 0)
+		if err != nil {
+			return err
+		}
+		if err := inf.solve(); err != nil {
+			return err
+		}
+		if err := inf.unify(types.UnitType, t); err != nil {
+			return err.At(n.Pos()).Note("Type of root expression of program must be unit")
+		}
+		return nil
+	}
+}
+
+func (inc *Incremental) deref(tops []*topLevel) error {
+	inf := inc.inferer
+	d := &typeVarDereferencer{nil, inc.Env, inf.inferred, inf.schemes, inf.insts, nil, nil, map[string]struct{}{}, inf.resolvedBy, map[string]ast.Expr{}, map[ast.Expr]*divergence{}}
+	for _, top := range tops {
+		switch n := top.node.(type) {
+		case *ast.LetRec:
+			for _, p := range n.Func.Params {
+				d.derefSym(n, p.Ident)
+			}
+		}
+		for _, sym := range top.syms {
+			d.derefSym(top.node, sym)
+		}
+		ast.Visit(d, top.bound)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	d.normalizePolyTypes()
+	return nil
+}
+
+// Retypecheck re-infers types of the changed top-level bindings and bindings depending on them.
+// Before calling this method, bound expressions of the changed bindings should be replaced with
+// newly parsed ones. Each element of changed must be a *ast.Let, *ast.LetRec or *ast.LetTuple node
+// at top-level. Replaced last expression of program is detected automatically.
+// When an error is returned, the analysis result is no longer consistent. The program must be
+// analyzed again with NewIncremental.
+func (inc *Incremental) Retypecheck(changed []ast.Expr) error {
+	dirty := map[int]struct{}{}
+	for _, c := range changed {
+		found := false
+		for i, top := range inc.tops[:len(inc.tops)-1] {
+			if top.node == c {
+				dirty[i] = struct{}{}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return locerr.ErrorIn(c.Pos(), c.End(), "Only top-level 'let' expressions can be re-typechecked incrementally")
+		}
+	}
+
+	// The last expression is replaced when it is different from the body of the last binding
+	lastIdx := len(inc.tops) - 1
+	last := inc.parsed.Root
+	if lastIdx > 0 {
+		last = inc.tops[lastIdx-1].node
+	}
+	if body := bodyOf(last); body != inc.tops[lastIdx].node {
+		inc.tops[lastIdx].node = body
+		dirty[lastIdx] = struct{}{}
+	}
+
+	inf := inc.inferer
+	inf.holes = nil
+	indices := inc.affected(dirty)
+	tops := make([]*topLevel, 0, len(indices))
+	for _, i := range indices {
+		top := inc.tops[i]
+		f := &forgetter{inf}
+		ast.Visit(f, top.bound)
+		for _, sym := range top.syms {
+			f.forgetSym(sym)
+		}
+
+		if bound := boundOf(top.node); bound != top.bound {
+			top.bound = bound
+			if _, ok := top.node.(*ast.LetRec); !ok && len(top.syms) > 0 {
+				top.weak = !isValue(bound)
+			}
+			if err := inc.transform(i); err != nil {
+				return err
+			}
+			inc.updateDeps(i)
+		}
+
+		if err := inc.reinfer(top); err != nil {
+			return err
+		}
+		tops = append(tops, top)
+	}
+
+	if err := inf.reportHoles(); err != nil {
+		return err
+	}
+	for _, top := range tops {
+		if err := checkNarrowing(inc.Env, top.bound); err != nil {
+			return err
+		}
+	}
+
+	inf.defaultNumLiterals()
+	inf.defaultDivergingTypes()
+	if err := inc.deref(tops); err != nil {
+		return err
+	}
+	if err := runChecks(inc.Env, inc.parsed.Root, inc.Inferred); err != nil {
+		return err
+	}
+	return nil
+}
+
+func bodyOf(e ast.Expr) ast.Expr {
+	switch n := e.(type) {
+	case *ast.Let:
+		return n.Body
+	case *ast.LetRec:
+		return n.Body
+	case *ast.LetTuple:
+		return n.Body
+	default:
+		return e
+	}
+}
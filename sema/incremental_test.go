@@ -0,0 +1,169 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func parseForIncremental(t *testing.T, code string) *ast.AST {
+	parsed, err := syntax.Parse(locerr.NewDummySource(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestIncrementalRetypecheck(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		index    int
+		bound    string
+		affected []int
+		expected string
+	}{
+		{
+			what:     "dependents are re-inferred",
+			code:     "let x = 1 in let y = x + 1 in let z = true in println_int y",
+			index:    0,
+			bound:    "40 + 2",
+			affected: []int{0, 1, 3},
+			expected: "int",
+		},
+		{
+			what:     "independent binding",
+			code:     "let x = 1 in let y = 2 in println_int y",
+			index:    0,
+			bound:    "true",
+			affected: []int{0},
+			expected: "bool",
+		},
+		{
+			what:     "function body",
+			code:     "let rec f a = a in println_int (f 1)",
+			index:    0,
+			bound:    "a + 1",
+			affected: []int{0, 1},
+			expected: "int",
+		},
+		{
+			what:     "variable not generalized by value restriction",
+			code:     "let a = Array.make 1 None in let b = a.(0) <- Some 1 in ()",
+			index:    1,
+			bound:    "a.(0) <- Some true",
+			affected: []int{0, 1},
+			expected: "unit",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			inc, err := NewIncremental(parseForIncremental(t, tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bound := parseForIncremental(t, tc.bound).Root
+			node := inc.tops[tc.index].node
+			switch n := node.(type) {
+			case *ast.Let:
+				n.Bound = bound
+			case *ast.LetRec:
+				n.Func.Body = bound
+			default:
+				t.Fatal("Unexpected node:", node.Name())
+			}
+
+			dirty := map[int]struct{}{tc.index: {}}
+			affected := inc.affected(dirty)
+			if len(affected) != len(tc.affected) {
+				t.Fatalf("Expected affected bindings %v but got %v", tc.affected, affected)
+			}
+			for i, a := range affected {
+				if tc.affected[i] != a {
+					t.Fatalf("Expected affected bindings %v but got %v", tc.affected, affected)
+				}
+			}
+
+			if err := inc.Retypecheck([]ast.Expr{node}); err != nil {
+				t.Fatal(err)
+			}
+			ty, ok := inc.Inferred[bound]
+			if !ok {
+				t.Fatal("Type of new bound expression was not inferred")
+			}
+			if s := ty.String(); s != tc.expected {
+				t.Fatalf("Expected type '%s' but got '%s'", tc.expected, s)
+			}
+		})
+	}
+}
+
+func TestIncrementalRetypecheckError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		bound    string
+		expected string
+	}{
+		{
+			what:     "dependent binding is broken",
+			code:     "let x = 1 in let y = x + 1 in println_int y",
+			bound:    "true",
+			expected: "Type mismatch between 'int' and 'bool'",
+		},
+		{
+			what:     "undefined variable",
+			code:     "let x = 1 in println_int x",
+			bound:    "y + 1",
+			expected: "Undefined variable 'y'",
+		},
+		{
+			what:     "variable declared after the binding",
+			code:     "let x = 1 in let y = 2 in println_int (x + y)",
+			bound:    "y",
+			expected: "Undefined variable 'y'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			inc, err := NewIncremental(parseForIncremental(t, tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			let := inc.tops[0].node.(*ast.Let)
+			let.Bound = parseForIncremental(t, tc.bound).Root
+			err = inc.Retypecheck([]ast.Expr{let})
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestIncrementalReplaceLastExpression(t *testing.T) {
+	parsed := parseForIncremental(t, "let x = 1 in println_int x")
+	inc, err := NewIncremental(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := parseForIncremental(t, "println_int (x * 2)").Root
+	parsed.Root.(*ast.Let).Body = last
+	if err := inc.Retypecheck(nil); err != nil {
+		t.Fatal(err)
+	}
+	if ty, ok := inc.Inferred[last]; !ok || ty.String() != "unit" {
+		t.Fatal("Type of new last expression was not inferred:", ty)
+	}
+
+	if err := inc.Retypecheck([]ast.Expr{last}); err == nil {
+		t.Fatal("Non-binding node should not be accepted")
+	}
+}
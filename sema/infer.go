@@ -6,6 +6,8 @@ import (
 	"github.com/rhysd/gocaml/common"
 	. "github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
+	"sort"
+	"strings"
 )
 
 // InferredTypes is a dictonary from an AST nodes to inferred types.
@@ -24,6 +26,18 @@ type Inferer struct {
 	// Map from generic type to bound type variables in the generic type
 	schemes schemes
 	insts   refInsts
+	// Typed holes found while type inference
+	holes []*hole
+	// Warnings collects non-fatal findings while type inference. Maybe nil.
+	Warnings *Warnings
+	// Parallel makes independent top-level bindings inferred concurrently.
+	Parallel bool
+	// Constraints generated while visiting AST and not solved yet
+	constraints []*typeConstraint
+	// Map from type variable to the constraint which resolved it
+	resolvedBy map[*Var]*provenance
+	// Map from polymorphically recursive function to its recursive reference at a different instance
+	polyCalls map[*ast.FuncDef]*ast.VarRef
 }
 
 // NewInferer creates a new Inferer instance
@@ -34,7 +48,83 @@ func NewInferer(env *Env) *Inferer {
 		map[ast.Expr]Type{},
 		map[Type]boundVarIDs{},
 		refInsts{},
+		nil,
+		nil,
+		false,
+		nil,
+		map[*Var]*provenance{},
+		map[*ast.FuncDef]*ast.VarRef{},
+	}
+}
+
+// unify unifies two types as Unify does. When occur check fails, it adds notes which point the
+// expressions typed as type variables on the cycle.
+func (inf *Inferer) unify(left, right Type) *locerr.Error {
+	return inf.unifyFrom(left, right, nil)
+}
+
+// unifyFrom unifies two types as unify does. When the provenance is not nil, type variables resolved
+// by the unification remember it.
+func (inf *Inferer) unifyFrom(left, right Type, from *provenance) *locerr.Error {
+	u := &unifier{}
+	err := u.run(left, right)
+	if err == nil {
+		if from != nil {
+			for _, v := range u.assigned {
+				inf.resolvedBy[v] = from
+			}
+		}
+		return nil
+	}
+	if len(u.cycle) == 0 {
+		return err
+	}
+	for _, v := range u.cycle {
+		if e := inf.exprTypedAs(v); e != nil {
+			err = err.NotefAt(e.Pos(), "Type variable '%s' comes from type of %s", varName(v), describeExpr(e))
+		}
+	}
+	return err
+}
+
+// describeExpr returns a readable description of the expression for notes of error messages. A
+// variable reference is described with its name and other expressions are described with their code
+// snippets. Long snippets are truncated.
+func describeExpr(e ast.Expr) string {
+	if v, ok := e.(*ast.VarRef); ok {
+		return fmt.Sprintf("variable '%s'", v.Symbol.DisplayName)
+	}
+	start, end := e.Pos(), e.End()
+	if start.File == nil || end.Offset <= start.Offset || end.Offset > len(start.File.Code) {
+		return "this expression"
+	}
+	code := strings.Join(strings.Fields(string(start.File.Code[start.Offset:end.Offset])), " ")
+	if r := []rune(code); len(r) > 40 {
+		code = string(r[:40]) + "..."
 	}
+	return fmt.Sprintf("expression '%s'", code)
+}
+
+// exprTypedAs returns the first expression in source whose type is the type variable. It returns
+// nil when no such expression is found.
+func (inf *Inferer) exprTypedAs(v *Var) ast.Expr {
+	var found ast.Expr
+	for e, t := range inf.inferred {
+		for t != Type(v) {
+			tv, ok := t.(*Var)
+			if !ok || tv.Ref == nil {
+				break
+			}
+			t = tv.Ref
+		}
+		if t != Type(v) {
+			continue
+		}
+		if found == nil || e.Pos().Offset < found.Pos().Offset {
+			found = e
+		}
+	}
+	return found
 }
 
 func (inf *Inferer) generalize(t Type, level int) Type {
@@ -50,9 +140,7 @@ func (inf *Inferer) checkNodeType(where string, node ast.Expr, expected Type, le
 	if err != nil {
 		return err
 	}
-	if err := Unify(expected, t); err != nil {
-		return err.In(node.Pos(), node.End()).NotefAt(node.Pos(), "Type error: %s must be '%s'", where, expected.String())
-	}
+	inf.constrain(expected, t, node.Pos(), node.End(), node.Pos(), "Type error: %s must be '%s'", where, expected)
 	return nil
 }
 
@@ -65,17 +153,13 @@ func (inf *Inferer) inferArithmeticBinOp(op string, left, right ast.Expr, operan
 	if err != nil {
 		return nil, err
 	}
-	if err := Unify(operand, l); err != nil {
-		return nil, err.In(left.Pos(), left.End()).NotefAt(left.Pos(), "Left hand of operator '%s' must be %s", op, operand.String())
-	}
-	if err := Unify(operand, r); err != nil {
-		return nil, err.In(right.Pos(), right.End()).NotefAt(right.Pos(), "Right hand of operator '%s' must be %s", op, operand.String())
-	}
+	inf.constrain(operand, l, left.Pos(), left.End(), left.Pos(), "Left hand of operator '%s' must be %s", op, operand)
+	inf.constrain(operand, r, right.Pos(), right.End(), right.Pos(), "Right hand of operator '%s' must be %s", op, operand)
 	// Returns the same type as operands
 	return operand, nil
 }
 
-func (inf *Inferer) inferRelationalBinOp(op string, left, right ast.Expr, level int) (Type, error) {
+func (inf *Inferer) inferRelationalBinOp(op string, c Constraint, left, right ast.Expr, level int) (Type, error) {
 	l, err := inf.infer(left, level)
 	if err != nil {
 		return nil, err
@@ -84,9 +168,8 @@ func (inf *Inferer) inferRelationalBinOp(op string, left, right ast.Expr, level
 	if err != nil {
 		return nil, err
 	}
-	if err := Unify(l, r); err != nil {
-		return nil, err.In(left.Pos(), right.End()).NotefAt(left.Pos(), "Type mismatch at operands of relational operator '%s'", op)
-	}
+	inf.constrain(l, r, left.Pos(), right.End(), left.Pos(), "Type mismatch at operands of relational operator '%s'", op)
+	inf.constrainClass(l, c, left.Pos(), right.End(), left.Pos(), "'%s' can't be compared with operator '%s'", l, op)
 	return BoolType, nil
 }
 
@@ -96,19 +179,249 @@ func (inf *Inferer) inferLogicalOp(op string, left, right ast.Expr, level int) (
 		if err != nil {
 			return nil, err
 		}
-		if err := Unify(BoolType, t); err != nil {
-			return nil, err.In(left.Pos(), right.End()).NotefAt(e.Pos(), "Type mismatch at %dth operand of logical operator '%s'", i+1, op)
-		}
+		inf.constrain(BoolType, t, left.Pos(), right.End(), e.Pos(), "Type mismatch at %dth operand of logical operator '%s'", i+1, op)
 	}
 	return BoolType, nil
 }
 
+func (inf *Inferer) inferMatchVariant(node *ast.MatchVariant, level int) (Type, error) {
+	tags := make([]*VariantTag, 0, len(node.Arms))
+	seen := make(map[string]*ast.VariantArm, len(node.Arms))
+	var row Type
+	for i, arm := range node.Arms {
+		if arm.IsDefault() {
+			if i != len(node.Arms)-1 {
+				return nil, locerr.ErrorfIn(arm.Token.Start, arm.Body.End(), "Default arm '%s -> ...' must be the last arm of 'match' expression. Following arms are never matched", arm.Ident.DisplayName)
+			}
+			// When the 'match' expression has a default arm, the matched variant can have other tags
+			row = NewVar(nil, level)
+			continue
+		}
+
+		if prev, ok := seen[arm.Tag]; ok {
+			return nil, locerr.ErrorfIn(arm.Token.Start, arm.Token.End, "Tag `%s is matched twice in 'match' expression", arm.Tag).NotefAt(prev.Token.Start, "Previous arm for `%s is here", arm.Tag)
+		}
+		seen[arm.Tag] = arm
+
+		var payload Type
+		if arm.Ident != nil {
+			payload = NewVar(nil, level)
+			inf.Env.DeclTable[arm.Ident.Name] = payload
+		}
+		tags = append(tags, &VariantTag{arm.Tag, payload})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	// Note: Without default arm, the matched variant is closed. It means that the 'match' expression
+	// is always exhaustive.
+	matched := &Variant{tags, row}
+	if err := inf.checkNodeType("matching target in 'match' expression", node.Target, matched, level); err != nil {
+		return nil, err
+	}
+
+	var ret Type
+	for _, arm := range node.Arms {
+		if arm.IsDefault() {
+			inf.Env.DeclTable[arm.Ident.Name] = matched
+		}
+		t, err := inf.infer(arm.Body, level)
+		if err != nil {
+			return nil, err
+		}
+		if ret == nil {
+			ret = t
+			continue
+		}
+		b := arm.Body
+		inf.constrain(ret, t, b.Pos(), b.End(), b.Pos(), "Mismatch of types between arms in 'match' expression")
+	}
+	return ret, nil
+}
+
+// declareLet infers the type of the bound expression of 'let' and registers the generalized type to
+// the environment. It returns the registered type. The body of 'let' is not visited.
+func (inf *Inferer) declareLet(n *ast.Let, level int) (Type, error) {
+	bound, err := inf.infer(n.Bound, level+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Type != nil {
+		// When let x: type = ...
+		t, err := inf.conv.nodeToType(n.Type, level)
+		if err != nil {
+			return nil, err
+		}
+		b := n.Body
+		inf.constrain(t, bound, b.Pos(), b.End(), b.Pos(), "Type of variable '%s'", n.Symbol.DisplayName)
+	}
+	if err := inf.solve(); err != nil {
+		return nil, err
+	}
+	if _, ok := resolvedTypeOf(bound).(*Var); ok && n.Symbol.IsIgnored() {
+		// Left hand side of sequence which never returns (e.g. 'exit 1' or 'break' at the end) is
+		// not generalized so that its undetermined type is fixed to unit while dereferencing
+		inf.Env.DeclTable[n.Symbol.Name] = bound
+		return bound, nil
+	}
+	decl := inf.generalizeBound(n.Bound, bound, level)
+	inf.Env.DeclTable[n.Symbol.Name] = decl
+	return decl, nil
+}
+
+// explainWeakBinding adds a note to the error which occurred in the scope of the variable declared by
+// 'let' when its type was not generalized and was fixed by its use.
+func explainWeakBinding(n *ast.Let, decl Type, weaks []*Var, err error) error {
+	for _, v := range weaks {
+		// Type variable constrained by Num was fixed by integer literal
+		if v.Ref != nil || v.Constraint == NumConstraint {
+			return locerr.NotefAt(n.Pos(), err, "Type of '%s' was not generalized because its bound expression is not a value. It was fixed to '%s' by its first use", n.Symbol.DisplayName, decl.String())
+		}
+	}
+	return err
+}
+
+// declareLetRec infers the type of function declared by 'let rec' and registers it to the
+// environment. The body of 'let rec' is not visited.
+func (inf *Inferer) declareLetRec(n *ast.LetRec, level int) error {
+	// Note:
+	// LetRec is different from other Let or LetTuple because it may be recursive.
+	// It's the point to separe LetRec to recursive variable declaration and function expression.
+	//   before: let rec f a b = a > b in ...
+	//   after:  let rec f = fun a b -> a > b in ...
+	// It means that type variables of parameters should be made with level + 1. And type variable
+	// of return type is also. Then type of `f` should be generalized with level.
+
+	// Register parameters of function as variables to table
+	params := make([]Type, len(n.Func.Params))
+	for i, p := range n.Func.Params {
+		var t Type
+		var err error
+		if p.Type != nil {
+			t, err = inf.conv.nodeToType(p.Type, level+1)
+			if err != nil {
+				return locerr.NotefAt(p.Type.Pos(), err, "%s parameter of function '%s'", common.Ordinal(i+1), n.Func.Symbol.DisplayName)
+			}
+		} else {
+			t = NewVar(nil, level+1)
+		}
+		inf.Env.DeclTable[p.Ident.Name] = t
+		params[i] = t
+	}
+
+	var ret Type
+	if n.Func.RetType != nil {
+		r := n.Func.RetType
+		t, err := inf.conv.nodeToType(r, level+1)
+		if err != nil {
+			return locerr.NotefAt(r.Pos(), err, "Return type of function '%s'", n.Func.Symbol.DisplayName)
+		}
+		ret = t
+	} else {
+		ret = NewVar(nil, level+1)
+	}
+
+	// Considering recursive function call, register function name before inferring type of its
+	// body. Register the function as a type variable here and later update the type with the
+	// result of type inference for body of function.
+	// Type of recursive function is *NOT* generic while inferring type of its body. For example,
+	// `let rec f x = f 10 in f true` causes compilation error because of mismatch between 'int'
+	// and 'bool'.
+	fun := &Fun{ret, params}
+	inf.Env.DeclTable[n.Func.Symbol.Name] = fun
+
+	// With polymorphic type annotation, recursive calls instantiate the annotated type.
+	var poly *polyRec
+	if n.Func.Poly != nil {
+		p, err := inf.startPolyRec(n.Func, fun, level)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			inf.Env.DeclTable[n.Func.Symbol.Name] = p.scheme.Body
+			poly = p
+		}
+	}
+
+	// Infer return type of function from its body
+	ret2, err := inf.infer(n.Func.Body, level+1)
+	if err != nil {
+		return err
+	}
+
+	inf.constrain(ret2, ret, n.Pos(), n.End(), n.Pos(), "Return type of function '%s'", n.Func.Symbol.DisplayName)
+	if err := inf.solve(); err != nil {
+		return err
+	}
+
+	if poly != nil {
+		if err := poly.finish(n.Func, level); err != nil {
+			return err
+		}
+		if ref := poly.polymorphicCall(n.Func, inf.insts); ref != nil {
+			inf.polyCalls[n.Func] = ref
+		}
+		inf.Env.DeclTable[n.Func.Symbol.Name] = poly.scheme.Body
+		return nil
+	}
+
+	// Update the return type with the result of type inference of function body. The function was
+	// registered as non-polymorphic type for recursive call before inferring its body.
+	inf.Env.DeclTable[n.Func.Symbol.Name] = inf.generalize(fun, level)
+	return nil
+}
+
+// declareLetTuple infers the type of the bound tuple of 'let (...) =' and registers its elements to
+// the environment. The body of 'let' is not visited.
+func (inf *Inferer) declareLetTuple(n *ast.LetTuple, level int) error {
+	var t *Tuple
+
+	if n.Type != nil {
+		ty, err := inf.conv.nodeToType(n.Type, level)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		t, ok = ty.(*Tuple)
+		if !ok {
+			return locerr.ErrorfIn(n.Type.Pos(), n.Type.End(), "Type error: Bound value of 'let (...) =' must be tuple, but found '%s'", ty.String())
+		}
+		if len(t.Elems) != len(n.Symbols) {
+			return locerr.ErrorfIn(n.Type.Pos(), n.Type.End(), "Type error: Mismatch numbers of elements of specified tuple type and symbols in 'let (...)' expression: %d vs %d", len(t.Elems), len(n.Symbols))
+		}
+	} else {
+		elems := make([]Type, len(n.Symbols))
+		for i := range n.Symbols {
+			// Bound elements' types are unknown in this point
+			elems[i] = NewVar(nil, level+1)
+		}
+		t = &Tuple{Elems: elems}
+	}
+
+	bound, err := inf.infer(n.Bound, level+1)
+	if err != nil {
+		return err
+	}
+
+	// Bound value must be tuple
+	inf.constrain(t, bound, n.Pos(), n.End(), n.Pos(), "Type error: bound tuple value at 'let' must be '%s'", t)
+	if err := inf.solve(); err != nil {
+		return err
+	}
+
+	for i, sym := range n.Symbols {
+		inf.Env.DeclTable[sym.Name] = inf.generalizeBound(n.Bound, t.Elems[i], level)
+	}
+	return nil
+}
+
 func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 	switch n := e.(type) {
 	case *ast.Unit:
 		return UnitType, nil
 	case *ast.Int:
-		return IntType, nil
+		return newNumVar(level), nil
 	case *ast.Float:
 		return FloatType, nil
 	case *ast.String:
@@ -149,17 +462,17 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 	case *ast.FDiv:
 		return inf.inferArithmeticBinOp("/.", n.Left, n.Right, FloatType, level)
 	case *ast.Eq:
-		return inf.inferRelationalBinOp("=", n.Left, n.Right, level)
+		return inf.inferRelationalBinOp("=", EqConstraint, n.Left, n.Right, level)
 	case *ast.NotEq:
-		return inf.inferRelationalBinOp("<>", n.Left, n.Right, level)
+		return inf.inferRelationalBinOp("<>", EqConstraint, n.Left, n.Right, level)
 	case *ast.Less:
-		return inf.inferRelationalBinOp("<", n.Left, n.Right, level)
+		return inf.inferRelationalBinOp("<", OrdConstraint, n.Left, n.Right, level)
 	case *ast.LessEq:
-		return inf.inferRelationalBinOp("<=", n.Left, n.Right, level)
+		return inf.inferRelationalBinOp("<=", OrdConstraint, n.Left, n.Right, level)
 	case *ast.Greater:
-		return inf.inferRelationalBinOp(">", n.Left, n.Right, level)
+		return inf.inferRelationalBinOp(">", OrdConstraint, n.Left, n.Right, level)
 	case *ast.GreaterEq:
-		return inf.inferRelationalBinOp(">=", n.Left, n.Right, level)
+		return inf.inferRelationalBinOp(">=", OrdConstraint, n.Left, n.Right, level)
 	case *ast.And:
 		return inf.inferLogicalOp("&&", n.Left, n.Right, level)
 	case *ast.Or:
@@ -179,33 +492,31 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 			return nil, err
 		}
 
-		if err := Unify(t, e); err != nil {
-			return nil, err.In(n.Pos(), n.End()).NoteAt(n.Pos(), "Mismatch of types for 'then' clause and 'else' clause in 'if' expression")
-		}
+		inf.constrain(t, e, n.Pos(), n.End(), n.Pos(), "Mismatch of types for 'then' clause and 'else' clause in 'if' expression")
 
 		return t, nil
 	case *ast.Let:
-		bound, err := inf.infer(n.Bound, level+1)
+		decl, err := inf.declareLet(n, level)
 		if err != nil {
 			return nil, err
 		}
+		weaks := weakVarsOf(decl)
 
-		if n.Type != nil {
-			// When let x: type = ...
-			t, err := inf.conv.nodeToType(n.Type, level)
-			if err != nil {
-				return nil, err
-			}
-			if err := Unify(t, bound); err != nil {
-				b := n.Body
-				return nil, err.In(b.Pos(), b.End()).NotefAt(b.Pos(), "Type of variable '%s'", n.Symbol.DisplayName)
-			}
+		body, err := inf.infer(n.Body, level)
+		if err == nil && len(weaks) > 0 {
+			// Solve constraints in the body here to explain an error caused by the weak type variables
+			err = inf.solve()
 		}
-		inf.Env.DeclTable[n.Symbol.Name] = inf.generalize(bound, level)
-
-		return inf.infer(n.Body, level)
+		if err != nil {
+			return nil, explainWeakBinding(n, decl, weaks, err)
+		}
+		return body, nil
 	case *ast.VarRef:
 		if t, ok := inf.Env.DeclTable[n.Symbol.Name]; ok {
+			if f, ok := derefForall(t); ok {
+				// Parameter typed with rank-N polymorphic type is instantiated at each reference
+				t = f.Body
+			}
 			inst := instantiate(t, level)
 			if inst == nil {
 				return t, nil
@@ -214,74 +525,61 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 			return inst.To, nil
 		}
 		if e, ok := inf.Env.Externals[n.Symbol.Name]; ok {
-			return e.Type, nil
+			f, ok := e.Type.(*Forall)
+			if !ok {
+				return e.Type, nil
+			}
+			// Generic external symbol is instantiated at each reference. The instantiation is
+			// monomorphized into a distinct external symbol.
+			inst := instantiate(f.Body, level)
+			inf.insts[n] = inst
+			return inst.To, nil
+		}
+		if n.Symbol.Name == printfName {
+			return nil, locerr.ErrorIn(n.Pos(), n.End(), "'printf' cannot be used as a value. It must be called directly with a format string literal")
+		}
+		if n.Symbol.Name == optionGetName {
+			return nil, locerr.ErrorIn(n.Pos(), n.End(), "'option_get' cannot be used as a value. It must be called directly with a variable narrowed to 'Some'")
+		}
+		if n.Symbol.Name == exitName {
+			return nil, locerr.ErrorIn(n.Pos(), n.End(), "'exit' cannot be used as a value. It must be called directly with an exit code")
+		}
+		if _, ok := tablePrimitives[n.Symbol.Name]; ok {
+			return nil, locerr.ErrorfIn(n.Pos(), n.End(), "'%s' cannot be used as a value. It must be called directly with all its arguments", n.Symbol.Name)
 		}
 		panic("FATAL: Unknown symbol must be checked in alpha transform: " + n.Symbol.Name)
 	case *ast.LetRec:
-		// Note:
-		// LetRec is different from other Let or LetTuple because it may be recursive.
-		// It's the point to separe LetRec to recursive variable declaration and function expression.
-		//   before: let rec f a b = a > b in ...
-		//   after:  let rec f = fun a b -> a > b in ...
-		// It means that type variables of parameters should be made with level + 1. And type variable
-		// of return type is also. Then type of `f` should be generalized with level.
-
-		// Register parameters of function as variables to table
-		params := make([]Type, len(n.Func.Params))
-		for i, p := range n.Func.Params {
-			var t Type
-			var err error
-			if p.Type != nil {
-				t, err = inf.conv.nodeToType(p.Type, level+1)
-				if err != nil {
-					return nil, locerr.NotefAt(p.Type.Pos(), err, "%s parameter of function '%s'", common.Ordinal(i+1), n.Func.Symbol.DisplayName)
-				}
-			} else {
-				t = NewVar(nil, level+1)
-			}
-			inf.Env.DeclTable[p.Ident.Name] = t
-			params[i] = t
+		if err := inf.declareLetRec(n, level); err != nil {
+			return nil, err
 		}
-
-		var ret Type
-		if n.Func.RetType != nil {
-			r := n.Func.RetType
-			t, err := inf.conv.nodeToType(r, level+1)
-			if err != nil {
-				return nil, locerr.NotefAt(r.Pos(), err, "Return type of function '%s'", n.Func.Symbol.DisplayName)
-			}
-			ret = t
-		} else {
-			ret = NewVar(nil, level+1)
+		return inf.infer(n.Body, level)
+	case *ast.Apply:
+		if inf.isPrintf(n.Callee) {
+			return inf.inferPrintf(n, level)
+		}
+		if inf.isOptionGet(n.Callee) {
+			return inf.inferOptionGet(n, level)
+		}
+		if isExit(inf.Env, n.Callee) {
+			return inf.inferExit(n, level)
+		}
+		if name, ok := tablePrimitiveOf(n.Callee); ok {
+			return inf.inferTable(n, name, level)
 		}
 
-		// Considering recursive function call, register function name before inferring type of its
-		// body. Register the function as a type variable here and later update the type with the
-		// result of type inference for body of function.
-		// Type of recursive function is *NOT* generic while inferring type of its body. For example,
-		// `let rec f x = f 10 in f true` causes compilation error because of mismatch between 'int'
-		// and 'bool'.
-		fun := &Fun{ret, params}
-		inf.Env.DeclTable[n.Func.Symbol.Name] = fun
-
-		// Infer return type of function from its body
-		ret2, err := inf.infer(n.Func.Body, level+1)
+		polys, err := inf.forallParamsOf(n.Callee)
 		if err != nil {
 			return nil, err
 		}
-
-		if err := Unify(ret2, ret); err != nil {
-			return nil, err.In(n.Pos(), n.End()).NotefAt(n.Pos(), "Return type of function '%s'", n.Func.Symbol.DisplayName)
-		}
-
-		// Update the return type with the result of type inference of function body. The function was
-		// registered as non-polymorphic type for recursive call before inferring its body.
-		inf.Env.DeclTable[n.Func.Symbol.Name] = inf.generalize(fun, level)
-
-		return inf.infer(n.Body, level)
-	case *ast.Apply:
 		args := make([]Type, len(n.Args))
 		for i, a := range n.Args {
+			if i < len(polys) && polys[i] != nil {
+				if err := inf.checkPolyArg(a, polys[i], level); err != nil {
+					return nil, err
+				}
+				args[i] = polys[i]
+				continue
+			}
 			t, err := inf.infer(a, level)
 			if err != nil {
 				return nil, err
@@ -302,9 +600,7 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 			return nil, err
 		}
 
-		if err := Unify(callee, fun); err != nil {
-			return nil, err.In(n.Pos(), n.End()).NoteAt(n.Pos(), "Type of called function")
-		}
+		inf.constrain(callee, fun, n.Pos(), n.End(), n.Pos(), "Type of called function")
 
 		return ret, nil
 	case *ast.Tuple:
@@ -318,45 +614,9 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 		}
 		return &Tuple{Elems: elems}, nil
 	case *ast.LetTuple:
-		var t *Tuple
-
-		if n.Type != nil {
-			ty, err := inf.conv.nodeToType(n.Type, level)
-			if err != nil {
-				return nil, err
-			}
-
-			var ok bool
-			t, ok = ty.(*Tuple)
-			if !ok {
-				return nil, locerr.ErrorfIn(n.Type.Pos(), n.Type.End(), "Type error: Bound value of 'let (...) =' must be tuple, but found '%s'", t.String())
-			}
-			if len(t.Elems) != len(n.Symbols) {
-				return nil, locerr.ErrorfIn(n.Type.Pos(), n.Type.End(), "Type error: Mismatch numbers of elements of specified tuple type and symbols in 'let (...)' expression: %d vs %d", len(t.Elems), len(n.Symbols))
-			}
-		} else {
-			elems := make([]Type, len(n.Symbols))
-			for i := range n.Symbols {
-				// Bound elements' types are unknown in this point
-				elems[i] = NewVar(nil, level+1)
-			}
-			t = &Tuple{Elems: elems}
-		}
-
-		bound, err := inf.infer(n.Bound, level+1)
-		if err != nil {
+		if err := inf.declareLetTuple(n, level); err != nil {
 			return nil, err
 		}
-
-		for i, sym := range n.Symbols {
-			inf.Env.DeclTable[sym.Name] = inf.generalize(t.Elems[i], level)
-		}
-
-		// Bound value must be tuple
-		if err := Unify(t, bound); err != nil {
-			return nil, err.In(n.Pos(), n.End()).NotefAt(n.Pos(), "Type error: bound tuple value at 'let' must be '%s'", t.String())
-		}
-
 		return inf.infer(n.Body, level)
 	case *ast.ArrayMake:
 		if err := inf.checkNodeType("size at array creation", n.Size, IntType, level); err != nil {
@@ -409,20 +669,43 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 			// Array is empty. Cannot infer type of elements.
 			return &Array{NewVar(nil, level)}, nil
 		}
-		elem, err := inf.infer(n.Elems[0], level)
+		// Constraints are solved for each element so that an error in the element is explained with
+		// its index
+		if err := inf.solve(); err != nil {
+			return nil, err
+		}
+		elem, err := inf.inferSolved(n.Elems[0], level)
 		if err != nil {
 			return nil, locerr.NoteAt(n.Pos(), err, "1st element type of array literal is incorrect")
 		}
 		for i, e := range n.Elems[1:] {
-			t, err := inf.infer(e, level)
+			t, err := inf.inferSolved(e, level)
 			if err != nil {
 				return nil, locerr.NotefAt(e.Pos(), err, "%s element type of array literal is incorrect", common.Ordinal(i+2))
 			}
-			if err := Unify(elem, t); err != nil {
-				return nil, err.In(e.Pos(), e.End()).NotefAt(e.Pos(), "Mismatch between 1st element and %s element in array literal", common.Ordinal(i+2))
+			inf.constrain(elem, t, e.Pos(), e.End(), e.Pos(), "Mismatch between 1st element and %s element in array literal", common.Ordinal(i+2))
+			if err := inf.solve(); err != nil {
+				return nil, err
 			}
 		}
 		return &Array{elem}, nil
+	case *ast.Assert:
+		if err := inf.checkNodeType("condition of 'assert' expression", n.Cond, BoolType, level); err != nil {
+			return nil, err
+		}
+		return UnitType, nil
+	case *ast.Break:
+		return inf.infer(n.Jump, level)
+	case *ast.Continue:
+		return inf.infer(n.Jump, level)
+	case *ast.LoopJump:
+		for _, a := range n.Args {
+			if _, err := inf.infer(a, level); err != nil {
+				return nil, err
+			}
+		}
+		// Jump never returns. Its type is the bottom type as the same as 'exit'
+		return NewVar(nil, level), nil
 	case *ast.Some:
 		elem, err := inf.infer(n.Child, level)
 		if err != nil {
@@ -431,6 +714,23 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 		return &Option{elem}, nil
 	case *ast.None:
 		return &Option{NewVar(nil, level)}, nil
+	case *ast.Ok:
+		ok, err := inf.infer(n.Child, level)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{ok, NewVar(nil, level)}, nil
+	case *ast.Error:
+		e, err := inf.infer(n.Child, level)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{NewVar(nil, level), e}, nil
+	case *ast.Hole:
+		// Type of hole is determined by its context. It is reported after type inference.
+		t := NewVar(nil, level)
+		inf.holes = append(inf.holes, &hole{n, t})
+		return t, nil
 	case *ast.Match:
 		elem := NewVar(nil, level)
 		matched := &Option{elem}
@@ -447,10 +747,40 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 		if err != nil {
 			return nil, err
 		}
-		if err := Unify(some, none); err != nil {
-			return nil, err.In(n.Pos(), n.End()).NoteAt(n.Pos(), "Mismatch of types between 'Some' arm and 'None' arm in 'match' expression")
-		}
+		inf.constrain(some, none, n.Pos(), n.End(), n.Pos(), "Mismatch of types between 'Some' arm and 'None' arm in 'match' expression")
 		return some, nil
+	case *ast.MatchResult:
+		ok, e := NewVar(nil, level), NewVar(nil, level)
+		matched := &Result{ok, e}
+		if err := inf.checkNodeType("matching target in 'match' expression", n.Target, matched, level); err != nil {
+			return nil, err
+		}
+
+		inf.Env.DeclTable[n.OkIdent.Name] = ok
+		inf.Env.DeclTable[n.ErrorIdent.Name] = e
+		okRet, err := inf.infer(n.IfOk, level)
+		if err != nil {
+			return nil, err
+		}
+		errRet, err := inf.infer(n.IfError, level)
+		if err != nil {
+			return nil, err
+		}
+		inf.constrain(okRet, errRet, n.Pos(), n.End(), n.Pos(), "Mismatch of types between 'Ok' arm and 'Error' arm in 'match' expression")
+		return okRet, nil
+	case *ast.Variant:
+		var payload Type
+		if n.Payload != nil {
+			t, err := inf.infer(n.Payload, level)
+			if err != nil {
+				return nil, err
+			}
+			payload = t
+		}
+		// Variant value can be used as any variant type which contains the tag. So its row is open.
+		return &Variant{[]*VariantTag{{n.Tag, payload}}, NewVar(nil, level)}, nil
+	case *ast.MatchVariant:
+		return inf.inferMatchVariant(n, level)
 	case *ast.Typed:
 		child, err := inf.infer(n.Child, level)
 		if err != nil {
@@ -462,9 +792,7 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 			return nil, err
 		}
 
-		if err := Unify(t, child); err != nil {
-			return nil, err.In(n.Pos(), n.End()).NoteAt(n.Pos(), "Mismatch between inferred type and specified type")
-		}
+		inf.constrain(t, child, n.Pos(), n.End(), n.Pos(), "Mismatch between inferred type and specified type")
 
 		return child, nil
 	default:
@@ -475,12 +803,29 @@ func (inf *Inferer) inferNode(e ast.Expr, level int) (Type, error) {
 func (inf *Inferer) infer(e ast.Expr, level int) (Type, error) {
 	t, err := inf.inferNode(e, level)
 	if err != nil {
+		// Constraints generated before the error may be unsatisfiable. The error should be reported
+		// first since it appears earlier in source.
+		if serr := inf.solve(); serr != nil {
+			return nil, serr
+		}
 		return nil, err
 	}
 	inf.inferred[e] = t
 	return t, nil
 }
 
+// inferSolved infers the type of the expression and solves constraints generated while inferring it.
+func (inf *Inferer) inferSolved(e ast.Expr, level int) (Type, error) {
+	t, err := inf.infer(e, level)
+	if err != nil {
+		return nil, err
+	}
+	if err := inf.solve(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
 // Infer infers types in given AST and returns error when detecting type errors
 func (inf *Inferer) Infer(parsed *ast.AST) error {
 	var err error
@@ -505,16 +850,40 @@ func (inf *Inferer) Infer(parsed *ast.AST) error {
 	}
 	inf.conv.acceptsAnyType = true
 
-	root, err := inf.infer(parsed.Root, 0)
+	var root Type
+	if inf.Parallel {
+		root, err = inf.inferParallel(parsed.Root)
+	} else {
+		root, err = inf.infer(parsed.Root, 0)
+	}
 	if err != nil {
 		return err
 	}
 
-	if err := Unify(UnitType, root); err != nil {
+	if err := inf.solve(); err != nil {
+		return err
+	}
+
+	inf.defaultNumLiterals()
+	inf.defaultDivergingTypes()
+
+	if err := inf.unify(UnitType, root); err != nil {
 		return err.At(parsed.Root.Pos()).Note("Type of root expression of program must be unit")
 	}
 
-	if err := derefTypeVars(inf.Env, parsed.Root, inf.inferred, inf.schemes, inf.insts); err != nil {
+	if err := inf.reportHoles(); err != nil {
+		return err
+	}
+
+	if err := checkNarrowing(inf.Env, parsed.Root); err != nil {
+		return err
+	}
+
+	if err := derefTypeVars(inf.Env, parsed.Root, inf.inferred, inf.schemes, inf.insts, inf.resolvedBy, inf.Warnings); err != nil {
+		return err
+	}
+
+	if err := runChecks(inf.Env, parsed.Root, inf.inferred); err != nil {
 		return err
 	}
 
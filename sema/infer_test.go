@@ -1,6 +1,7 @@
 package sema
 
 import (
+	"github.com/rhysd/gocaml/ast"
 	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
@@ -47,7 +48,7 @@ func TestUnificationFailure(t *testing.T) {
 	}{
 		{
 			what:     "+. with int",
-			code:     "1 +. 2",
+			code:     "(1 + 1) +. 2.0",
 			expected: "Type mismatch between 'float' and 'int'",
 		},
 		{
@@ -77,12 +78,12 @@ func TestUnificationFailure(t *testing.T) {
 		},
 		{
 			what:     "invalid = compare",
-			code:     "41 = 3.14",
+			code:     "(40 + 1) = 3.14",
 			expected: "Type mismatch between 'int' and 'float'",
 		},
 		{
 			what:     "invalid <> compare",
-			code:     "41 <> 3.14",
+			code:     "(40 + 1) <> 3.14",
 			expected: "Type mismatch between 'int' and 'float'",
 		},
 		{
@@ -122,12 +123,12 @@ func TestUnificationFailure(t *testing.T) {
 		},
 		{
 			what:     "/. with int",
-			code:     "1 /. 2",
+			code:     "(1 + 1) /. 2.0",
 			expected: "Type mismatch between 'float' and 'int'",
 		},
 		{
 			what:     "*. with int",
-			code:     "1 *. 2",
+			code:     "(1 + 1) *. 2.0",
 			expected: "Type mismatch between 'float' and 'int'",
 		},
 		{
@@ -137,7 +138,7 @@ func TestUnificationFailure(t *testing.T) {
 		},
 		{
 			what:     "unary -. with non-float",
-			code:     "-.42",
+			code:     "-.(41 + 1)",
 			expected: "operand of unary operator '-.' must be 'float'",
 		},
 		{
@@ -147,7 +148,7 @@ func TestUnificationFailure(t *testing.T) {
 		},
 		{
 			what:     "mismatch type between else and then",
-			code:     "if true then 42 else 4.2",
+			code:     "if true then 40 + 2 else 4.2",
 			expected: "Type mismatch between 'int' and 'float'",
 		},
 		{
@@ -157,7 +158,7 @@ func TestUnificationFailure(t *testing.T) {
 		},
 		{
 			what:     "mismatch parameter type",
-			code:     "let rec f a b = a < b in f 1.0 1",
+			code:     "let rec f a b = a < b in f 1.0 (0 + 1)",
 			expected: "On unifying 2nd parameter of function 'float -> float -> bool' and 'float -> int -> bool'",
 		},
 		{
@@ -235,6 +236,21 @@ func TestUnificationFailure(t *testing.T) {
 			code:     "(Array.length (Array.make 3 true)) = 3.0",
 			expected: "'int' and 'float'",
 		},
+		{
+			what:     "string is not buffer",
+			code:     "Buffer.add_string \"foo\" \"bar\"",
+			expected: "Type mismatch between 'buffer' and 'string'",
+		},
+		{
+			what:     "compare buffers",
+			code:     "let b = Buffer.create () in b = b",
+			expected: "Type 'buffer' does not satisfy constraint 'Eq'",
+		},
+		{
+			what:     "compare json values",
+			code:     "Json.null () = Json.of_int 1",
+			expected: "Type 'json' does not satisfy constraint 'Eq'",
+		},
 		{
 			what:     "cyclic dependency",
 			code:     "let rec f x = f in f 4",
@@ -275,6 +291,31 @@ func TestUnificationFailure(t *testing.T) {
 			code:     "match Some 42 with Some i -> 3.14 | None -> true",
 			expected: "Mismatch of types between 'Some' arm and 'None' arm in 'match' expression",
 		},
+		{
+			what:     "Ok arm of result match",
+			code:     "match Ok 42 with Ok i -> not i | Error e -> false",
+			expected: "Type mismatch between 'bool' and 'int'",
+		},
+		{
+			what:     "result match expression arms",
+			code:     "match Error true with Ok i -> 3.14 | Error e -> e",
+			expected: "Mismatch of types between 'Ok' arm and 'Error' arm in 'match' expression",
+		},
+		{
+			what:     "result is not option",
+			code:     "match Some 42 with Ok i -> () | Error e -> ()",
+			expected: "Type mismatch between",
+		},
+		{
+			what:     "result error type mismatch",
+			code:     "let rec f r = match r with Ok i -> i | Error e -> e + 1 in f (Error true); ()",
+			expected: "On unifying 'Error' types of results",
+		},
+		{
+			what:     "result type has 2 parameters",
+			code:     "let r : int result = Ok 1 in ()",
+			expected: "Invalid result type. 'result' has 2 type parameters",
+		},
 		{
 			what:     "None type comparison",
 			code:     "let o = None in o = 42",
@@ -380,6 +421,36 @@ func TestUnificationFailure(t *testing.T) {
 			code:     "let rec f x: (int, bool) array = x in f 10",
 			expected: "Return type of function 'f'",
 		},
+		{
+			what:     "tag not handled by closed variant match",
+			code:     "match `Baz with `Foo -> () | `Bar -> ()",
+			expected: "Tag(s) `Baz cannot be added to closed variant",
+		},
+		{
+			what:     "payload mismatch of variant tag",
+			code:     "let rec f v = match v with `Foo i -> i + 1 in f (`Foo true); ()",
+			expected: "On unifying payloads of tag `Foo",
+		},
+		{
+			what:     "variant tag with and without payload",
+			code:     "match `Foo with `Foo i -> print_int i",
+			expected: "Tag `Foo has a payload in one variant but has no payload in another variant",
+		},
+		{
+			what:     "duplicate tags in variant match",
+			code:     "match `Foo with `Foo -> () | `Foo -> ()",
+			expected: "Tag `Foo is matched twice",
+		},
+		{
+			what:     "default arm of variant match is not last",
+			code:     "match `Foo with x -> () | `Foo -> ()",
+			expected: "Default arm 'x -> ...' must be the last arm",
+		},
+		{
+			what:     "mismatch between variant match arms",
+			code:     "let x = match `Foo with `Foo -> 1 | _ -> true in ()",
+			expected: "Mismatch of types between arms in 'match' expression",
+		},
 	}
 
 	for _, testcase := range testcases {
@@ -479,3 +550,68 @@ func TestExternalDeclError(t *testing.T) {
 		t.Fatal("Unexpected error message:", msg)
 	}
 }
+
+func TestGenericExternal(t *testing.T) {
+	s := locerr.NewDummySource(`external print: 'a. 'a -> unit = "print"; print 42; print true; print 10`)
+	tree, err := syntax.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	env, inferred, err := Analyze(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := env.Externals["print"].Type.(*types.Forall); !ok {
+		t.Fatal("Type of generic external is not generic:", env.Externals["print"].Type)
+	}
+
+	found := map[string]int{}
+	for e, ty := range inferred {
+		if ref, ok := e.(*ast.VarRef); ok && ref.Symbol.Name == "print" {
+			found[ty.String()]++
+		}
+	}
+	if len(found) != 2 || found["int -> unit"] != 2 || found["bool -> unit"] != 1 {
+		t.Fatal("Unexpected instantiations of generic external:", found)
+	}
+}
+
+func TestGenericExternalError(t *testing.T) {
+	s := locerr.NewDummySource(`external print: 'a. 'a -> unit = "print"; print 1 2`)
+	tree, err := syntax.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	_, _, err = Analyze(tree)
+	if err == nil {
+		t.Fatal("Error should have occurred")
+	}
+	if !strings.Contains(err.Error(), "Number of parameters of function does not match") {
+		t.Fatal("Unexpected error message:", err.Error())
+	}
+}
+
+func TestInstantiationTrace(t *testing.T) {
+	s := locerr.NewDummySource("let rec f x = x in\nprintln_bool (f None = None)")
+	tree, err := syntax.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	_, _, err = Analyze(tree)
+	if err == nil {
+		t.Fatal("Error should have occurred")
+	}
+	msg := err.Error()
+	for _, want := range []string{
+		"Cannot instantiate declaration 'f' typed as type ''a -> 'a'",
+		"Generic type ''a -> 'a' of 'f' was generalized at this declaration",
+		"Bound type variable 'a was instantiated as",
+		"by unification: Type of called function",
+		"was never resolved by any unification",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error message does not contain '%s': %s", want, msg)
+		}
+	}
+}
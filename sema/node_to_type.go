@@ -4,31 +4,75 @@ import (
 	"github.com/rhysd/gocaml/ast"
 	. "github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
+	"sort"
 )
 
 type nodeTypeConv struct {
 	aliases        map[string]Type
 	acceptsAnyType bool
+	// Type variables bound by 'forall' in current context
+	typeVars map[string]*Var
+	// Declarations in current 'type ... and ...' group which are not converted yet
+	pending map[string]*ast.TypeDecl
+	// Declarations being converted. Referring them again means the types are cyclic
+	resolving map[string]struct{}
 }
 
 func newNodeTypeConv(decls []*ast.TypeDecl) (*nodeTypeConv, error) {
-	conv := &nodeTypeConv{make(map[string]Type, len(decls)+5 /*primitives*/), true}
+	conv := &nodeTypeConv{
+		make(map[string]Type, len(decls)+5 /*primitives*/),
+		true,
+		map[string]*Var{},
+		map[string]*ast.TypeDecl{},
+		map[string]struct{}{},
+	}
 	conv.aliases["unit"] = UnitType
 	conv.aliases["int"] = IntType
 	conv.aliases["bool"] = BoolType
 	conv.aliases["float"] = FloatType
 	conv.aliases["string"] = StringType
+	conv.aliases["buffer"] = BufferType
+	conv.aliases["json"] = JsonType
 
-	for _, decl := range decls {
-		t, err := conv.nodeToType(decl.Type, -1)
-		if err != nil {
-			return nil, locerr.NotefAt(decl.Pos(), err, "Type declaration '%s'", decl.Ident.Name)
+	for _, group := range ast.TypeDeclGroups(decls) {
+		// Types in the group may refer each other. They are converted on demand when referred.
+		for _, decl := range group {
+			conv.pending[decl.Ident.Name] = decl
+		}
+		for _, decl := range group {
+			if _, err := conv.resolveDecl(decl); err != nil {
+				return nil, err
+			}
 		}
-		conv.aliases[decl.Ident.Name] = t
 	}
 	return conv, nil
 }
 
+func (conv *nodeTypeConv) resolveDecl(decl *ast.TypeDecl) (Type, error) {
+	name := decl.Ident.Name
+	if t, ok := conv.aliases[name]; ok {
+		// Already converted since other declaration in the group referred it
+		return t, nil
+	}
+
+	// Declaration may be converted while converting other type. Context of the type must not affect it.
+	typeVars, acceptsAnyType := conv.typeVars, conv.acceptsAnyType
+	conv.typeVars, conv.acceptsAnyType = map[string]*Var{}, true
+
+	delete(conv.pending, name)
+	conv.resolving[name] = struct{}{}
+	t, err := conv.nodeToType(decl.Type, -1)
+	delete(conv.resolving, name)
+
+	conv.typeVars, conv.acceptsAnyType = typeVars, acceptsAnyType
+	if err != nil {
+		return nil, locerr.NotefAt(decl.Pos(), err, "Type declaration '%s'", name)
+	}
+
+	conv.aliases[name] = t
+	return t, nil
+}
+
 func (conv *nodeTypeConv) nodesToTypes(nodes []ast.Expr, level int) ([]Type, error) {
 	types := make([]Type, 0, len(nodes))
 	for _, n := range nodes {
@@ -41,6 +85,89 @@ func (conv *nodeTypeConv) nodesToTypes(nodes []ast.Expr, level int) ([]Type, err
 	return types, nil
 }
 
+type boundVarCollector struct {
+	bounds map[VarID]*Var
+	found  []*Var
+}
+
+func (col *boundVarCollector) VisitTopdown(t Type) Visitor {
+	if v, ok := t.(*Var); ok {
+		if b, ok := col.bounds[v.ID]; ok {
+			col.found = append(col.found, b)
+			delete(col.bounds, v.ID)
+		}
+	}
+	return col
+}
+
+func (col *boundVarCollector) VisitBottomup(t Type) {}
+
+func (conv *nodeTypeConv) forallToType(node *ast.ForallType, level int) (Type, error) {
+	bounds := make(map[VarID]*Var, len(node.Vars))
+	saved := make(map[string]*Var, len(node.Vars))
+	for _, tv := range node.Vars {
+		name := tv.Ident.Name
+		if _, ok := saved[name]; ok {
+			return nil, locerr.ErrorfIn(tv.Pos(), tv.End(), "Type variable %s is bound twice in 'forall'", name)
+		}
+		saved[name] = conv.typeVars[name]
+		v := NewGeneric()
+		conv.typeVars[name] = v
+		bounds[v.ID] = v
+	}
+
+	// '_' is not permitted in 'forall' because the type must be closed.
+	acceptsAnyType := conv.acceptsAnyType
+	conv.acceptsAnyType = false
+	body, err := conv.nodeToType(node.Body, level)
+	conv.acceptsAnyType = acceptsAnyType
+
+	for name, v := range saved {
+		if v == nil {
+			delete(conv.typeVars, name)
+		} else {
+			conv.typeVars[name] = v
+		}
+	}
+
+	if err != nil {
+		return nil, locerr.NoteAt(node.Pos(), err, "Type annotation of 'forall'")
+	}
+
+	// Order bound type variables by their first occurrences in body. Unused ones are removed.
+	col := &boundVarCollector{bounds, make([]*Var, 0, len(bounds))}
+	Visit(col, body)
+	if len(col.found) == 0 {
+		return body, nil
+	}
+	return &Forall{col.found, body}, nil
+}
+
+// variantToType converts closed variant type. Its row is always closed since '[> ...]' is not
+// available in type annotation.
+func (conv *nodeTypeConv) variantToType(node *ast.VariantType, level int) (Type, error) {
+	tags := make([]*VariantTag, 0, len(node.Tags))
+	seen := make(map[string]*ast.VariantTagType, len(node.Tags))
+	for _, tag := range node.Tags {
+		if prev, ok := seen[tag.Tag]; ok {
+			return nil, locerr.ErrorfIn(tag.Token.Start, tag.Token.End, "Tag `%s appears twice in variant type", tag.Tag).NotefAt(prev.Token.Start, "Previous `%s is here", tag.Tag)
+		}
+		seen[tag.Tag] = tag
+
+		var payload Type
+		if tag.Payload != nil {
+			t, err := conv.nodeToType(tag.Payload, level)
+			if err != nil {
+				return nil, err
+			}
+			payload = t
+		}
+		tags = append(tags, &VariantTag{tag.Tag, payload})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return &Variant{tags, nil}, nil
+}
+
 func (conv *nodeTypeConv) nodeToType(node ast.Expr, level int) (Type, error) {
 	switch n := node.(type) {
 	case *ast.FuncType:
@@ -58,6 +185,15 @@ func (conv *nodeTypeConv) nodeToType(node ast.Expr, level int) (Type, error) {
 	case *ast.TupleType:
 		elems, err := conv.nodesToTypes(n.ElemTypes, level)
 		return &Tuple{elems}, err
+	case *ast.TypeVar:
+		if v, ok := conv.typeVars[n.Ident.Name]; ok {
+			return v, nil
+		}
+		return nil, locerr.ErrorfIn(n.Pos(), n.End(), "Type variable %s is not bound. Type variables are only available in 'forall' type of function parameter, polymorphic type annotation of recursive function and generic external symbol", n.Ident.Name)
+	case *ast.ForallType:
+		return conv.forallToType(n, level)
+	case *ast.VariantType:
+		return conv.variantToType(n, level)
 	case *ast.CtorType:
 		len := len(n.ParamTypes)
 		if len == 0 {
@@ -71,6 +207,12 @@ func (conv *nodeTypeConv) nodeToType(node ast.Expr, level int) (Type, error) {
 			if t, ok := conv.aliases[n.Ctor.Name]; ok {
 				return t, nil
 			}
+			if _, ok := conv.resolving[n.Ctor.Name]; ok {
+				return nil, locerr.ErrorfIn(n.Pos(), n.End(), "Type '%s' is recursive. Type aliases can refer each other with 'and' but cannot be cyclic since they are expanded structurally", n.Ctor.DisplayName)
+			}
+			if decl, ok := conv.pending[n.Ctor.Name]; ok {
+				return conv.resolveDecl(decl)
+			}
 		}
 
 		// TODO: Currently only built-in array and option types are supported
@@ -87,8 +229,29 @@ func (conv *nodeTypeConv) nodeToType(node ast.Expr, level int) (Type, error) {
 			}
 			elem, err := conv.nodeToType(n.ParamTypes[0], level)
 			return &Option{elem}, err
+		case "result":
+			if len != 2 {
+				return nil, locerr.ErrorIn(n.Pos(), n.End(), "Invalid result type. 'result' has 2 type parameters like ('a, 'e) result")
+			}
+			ts, err := conv.nodesToTypes(n.ParamTypes, level)
+			if err != nil {
+				return nil, err
+			}
+			return &Result{ts[0], ts[1]}, nil
+		case "table":
+			if len != 2 {
+				return nil, locerr.ErrorIn(n.Pos(), n.End(), "Invalid table type. 'table' has 2 type parameters like ('k, 'v) table")
+			}
+			ts, err := conv.nodesToTypes(n.ParamTypes, level)
+			if err != nil {
+				return nil, err
+			}
+			if err := satisfy(ts[0], HashConstraint); err != nil {
+				return nil, err.NoteAt(n.ParamTypes[0].Pos(), "Key type of table")
+			}
+			return &Table{ts[0], ts[1]}, nil
 		default:
-			return nil, locerr.ErrorfIn(n.Pos(), n.End(), "Unknown type constructor '%s'. Primitive types, aliased types, 'array', 'option' and '_' are supported", n.Ctor.DisplayName)
+			return nil, locerr.ErrorfIn(n.Pos(), n.End(), "Unknown type constructor '%s'. Primitive types, aliased types, 'array', 'option', 'result', 'table' and '_' are supported", n.Ctor.DisplayName)
 		}
 	default:
 		panic("FATAL: Cannot convert non-type AST node into type values: " + node.Name())
@@ -33,13 +33,21 @@ func TestSuccess(t *testing.T) {
 			ast.NewSymbol(name),
 		}
 	}
+	andTok := &token.Token{
+		Kind:  token.AND,
+		Start: pos,
+		End:   pos,
+		File:  locerr.NewDummySource(""),
+	}
 	decls := []*ast.TypeDecl{
-		{tok, ast.NewSymbol("foo"), prim("int")},
-		{tok, ast.NewSymbol("bar"), prim("foo")},
+		{tok, ast.NewSymbol("foo"), prim("int"), nil},
+		{tok, ast.NewSymbol("bar"), prim("foo"), nil},
 		{tok, ast.NewSymbol("piyo"), &ast.FuncType{
 			[]ast.Expr{prim("int"), prim("foo")},
 			prim("bar"),
-		}},
+		}, nil},
+		{tok, ast.NewSymbol("tree"), ctor("array", prim("leaf")), nil},
+		{andTok, ast.NewSymbol("leaf"), ctor("option", prim("bar")), nil},
 	}
 
 	cases := []struct {
@@ -88,6 +96,14 @@ func TestSuccess(t *testing.T) {
 			},
 			want: &Fun{FloatType, []Type{IntType, BoolType}},
 		},
+		{
+			what: "variant",
+			node: &ast.VariantType{tok, tok, []*ast.VariantTagType{
+				{tok, "Foo", prim("int")},
+				{tok, "Bar", nil},
+			}},
+			want: &Variant{[]*VariantTag{{"Bar", nil}, {"Foo", IntType}}, nil},
+		},
 		{
 			what: "nested any",
 			node: ctor("array", prim("_")),
@@ -161,6 +177,11 @@ func TestSuccess(t *testing.T) {
 			node: prim("bar"),
 			want: IntType,
 		},
+		{
+			what: "aliased type referring later type in group",
+			node: prim("tree"),
+			want: &Array{&Option{IntType}},
+		},
 		{
 			what: "alias in parameter",
 			node: ctor("array", prim("bar")),
@@ -287,6 +308,12 @@ func TestInvalidAliases(t *testing.T) {
 		End:   pos,
 		File:  locerr.NewDummySource(""),
 	}
+	andTok := &token.Token{
+		Kind:  token.AND,
+		Start: pos,
+		End:   pos,
+		File:  locerr.NewDummySource(""),
+	}
 	prim := func(name string) ast.Expr {
 		return &ast.CtorType{
 			nil,
@@ -295,6 +322,14 @@ func TestInvalidAliases(t *testing.T) {
 			ast.NewSymbol(name),
 		}
 	}
+	ctor := func(name string, child ast.Expr) ast.Expr {
+		return &ast.CtorType{
+			nil,
+			tok,
+			[]ast.Expr{child},
+			ast.NewSymbol(name),
+		}
+	}
 
 	cases := []struct {
 		what  string
@@ -304,10 +339,26 @@ func TestInvalidAliases(t *testing.T) {
 		{
 			what: "invalid aliased type",
 			decls: []*ast.TypeDecl{
-				{tok, ast.NewSymbol("foo"), prim("piyo")},
+				{tok, ast.NewSymbol("foo"), prim("piyo"), nil},
 			},
 			msg: "Type declaration 'foo'",
 		},
+		{
+			what: "cyclic types in group",
+			decls: []*ast.TypeDecl{
+				{tok, ast.NewSymbol("foo"), &ast.TupleType{[]ast.Expr{prim("int"), prim("bar")}}, nil},
+				{andTok, ast.NewSymbol("bar"), ctor("array", prim("foo")), nil},
+			},
+			msg: "Type 'foo' is recursive",
+		},
+		{
+			what: "recursive type in group",
+			decls: []*ast.TypeDecl{
+				{tok, ast.NewSymbol("foo"), prim("int"), nil},
+				{andTok, ast.NewSymbol("bar"), ctor("option", prim("bar")), nil},
+			},
+			msg: "Type 'bar' is recursive",
+		},
 	}
 
 	for _, tc := range cases {
@@ -0,0 +1,38 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Integer literals are overloaded. An integer literal is typed as a type variable constrained by
+// Num, so it can be typed as 'float' when its context demands it.
+//   let pi = 3.14 in
+//   let r = 2 in
+//   pi *. r *. r  (* 'r' is typed as 'float' *)
+// The type variable is never generalized. After type inference, type variables of integer literals
+// which are still not resolved are defaulted to 'int'.
+//   let x = 42 in
+//   print_int (x + 1)  (* 'x' is typed as 'int' by '+' *)
+//   let y = 42 in ()   (* 'y' is typed as 'int' by defaulting *)
+// Operators are not overloaded. '+' still accepts only 'int' and '+.' accepts only 'float'.
+
+func newNumVar(level int) *Var {
+	v := NewVar(nil, level)
+	v.Constraint = NumConstraint
+	return v
+}
+
+// defaultNumLiterals resolves types of integer literals which were not determined by type inference
+// to 'int'.
+func (inf *Inferer) defaultNumLiterals() {
+	for e, t := range inf.inferred {
+		if _, ok := e.(*ast.Int); !ok {
+			continue
+		}
+		if v, ok := resolvedTypeOf(t).(*Var); ok && v.Constraint == NumConstraint {
+			v.Ref = IntType
+		}
+	}
+}
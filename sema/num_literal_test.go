@@ -0,0 +1,110 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/mir"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNumLiteralTypes(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{"defaulted to int", "let x = 1 in ()", []string{"int"}},
+		{"float operator", "let x = 1 in print_float (x +. 2.0)", []string{"float"}},
+		{"int operator", "println_int (1 + 2)", []string{"int", "int"}},
+		{"array literal", "let a = [| 1; 2.0 |] in ()", []string{"float"}},
+		{"function parameter", "let rec f x = x +. 1 in print_float (f 2)", []string{"float", "float"}},
+		{"polymorphic function", "let rec id x = x in print_float (id 3); println_int (id 4)", []string{"float", "int"}},
+		{"return value", "let rec f x = 1 in print_float (f ())", []string{"float"}},
+		{"comparison", "let x = 1 in print_bool (2.0 < x)", []string{"float"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, inferred, err := Analyze(parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lits := []ast.Expr{}
+			for e := range inferred {
+				if _, ok := e.(*ast.Int); ok {
+					lits = append(lits, e)
+				}
+			}
+			sort.Slice(lits, func(i, j int) bool { return lits[i].Pos().Offset < lits[j].Pos().Offset })
+
+			if len(lits) != len(tc.expected) {
+				t.Fatalf("Expected %d integer literals but got %d", len(tc.expected), len(lits))
+			}
+			for i, lit := range lits {
+				if s := inferred[lit].String(); s != tc.expected[i] {
+					t.Errorf("Expected type of %s to be '%s' but got '%s'", lit.Name(), tc.expected[i], s)
+				}
+			}
+		})
+	}
+}
+
+func TestNumLiteralError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{"int and float uses", "let x = 1 in println_int x; print_float x", "Type mismatch between 'float' and 'int'"},
+		{"non-number type", "if 1 then () else ()", "Type mismatch between 'bool' and 'int'"},
+		{"int operator with float", "let x = 1 in print_float (x + 2)", "Type mismatch between 'float' and 'int'"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestNumLiteralEmitsFloat(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("print_float 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ir, err := SemanticsCheck(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin, end := ir.WholeRange()
+	for i := begin; i != end; i = i.Next {
+		if f, ok := i.Val.(*mir.Float); ok {
+			if f.Const != 42.0 {
+				t.Fatal("Unexpected float value:", f.Const)
+			}
+			return
+		}
+		if _, ok := i.Val.(*mir.Int); ok {
+			t.Fatal("Integer literal typed as float was emitted as int")
+		}
+	}
+	t.Fatal("Float value was not emitted")
+}
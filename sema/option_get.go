@@ -0,0 +1,108 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// 'option_get' is a special built-in function which takes the value out of an option value without
+// re-matching it. It is typed as 'a option -> 'a.
+//   match x with
+//     | Some y -> option_get x + 1  (* 'x' is narrowed to 'Some' in this arm *)
+//     | None -> 0
+// Its argument must be a variable which is narrowed to 'Some' by an enclosing 'match' expression.
+// Narrowing is a simple flow analysis on AST after type inference. Since variables are immutable,
+// a variable matched in 'match' expression is always 'Some' in its 'Some' arm, including closures
+// defined in the arm. Other uses are reported as possibly 'None'.
+//
+// The call is lowered into 'derefsome' instruction while converting AST into MIR.
+const optionGetName = "option_get"
+
+func (inf *Inferer) isOptionGet(e ast.Expr) bool {
+	ref, ok := e.(*ast.VarRef)
+	if !ok || ref.Symbol.Name != optionGetName {
+		return false
+	}
+	// 'option_get' may be declared with 'external'
+	_, ok = inf.Env.Externals[ref.Symbol.Name]
+	return !ok
+}
+
+func (inf *Inferer) inferOptionGet(node *ast.Apply, level int) (Type, error) {
+	if len(node.Args) != 1 {
+		return nil, locerr.ErrorfIn(node.Pos(), node.End(), "'option_get' requires exactly 1 argument but %d argument(s) given", len(node.Args))
+	}
+	elem := NewVar(nil, level)
+	if err := inf.checkNodeType("argument of 'option_get'", node.Args[0], &Option{elem}, level); err != nil {
+		return nil, err
+	}
+	return elem, nil
+}
+
+// narrowingChecker checks that every argument of 'option_get' is narrowed to 'Some'.
+type narrowingChecker struct {
+	env *Env
+	err *locerr.Error
+	// Symbols of variables narrowed to 'Some' by enclosing 'match' expressions
+	narrowed map[string]struct{}
+}
+
+func (c *narrowingChecker) isOptionGet(e ast.Expr) bool {
+	ref, ok := e.(*ast.VarRef)
+	if !ok || ref.Symbol.Name != optionGetName {
+		return false
+	}
+	_, ok = c.env.Externals[ref.Symbol.Name]
+	return !ok
+}
+
+func (c *narrowingChecker) VisitTopdown(e ast.Expr) ast.Visitor {
+	if c.err != nil {
+		return nil
+	}
+
+	switch n := e.(type) {
+	case *ast.Match:
+		ref, ok := n.Target.(*ast.VarRef)
+		if !ok {
+			return c
+		}
+		if _, ok := c.narrowed[ref.Symbol.Name]; ok {
+			// Already narrowed by outer 'match' expression
+			return c
+		}
+		c.narrowed[ref.Symbol.Name] = struct{}{}
+		ast.Visit(c, n.IfSome)
+		delete(c.narrowed, ref.Symbol.Name)
+		ast.Visit(c, n.IfNone)
+		return nil
+	case *ast.Apply:
+		if !c.isOptionGet(n.Callee) {
+			return c
+		}
+		arg := n.Args[0]
+		ref, ok := arg.(*ast.VarRef)
+		if !ok {
+			c.err = locerr.ErrorIn(arg.Pos(), arg.End(), "Argument of 'option_get' is possibly None. It must be a variable matched with 'Some' in an enclosing 'match' expression")
+			return nil
+		}
+		if _, ok := c.narrowed[ref.Symbol.Name]; !ok {
+			c.err = locerr.ErrorfIn(arg.Pos(), arg.End(), "Variable '%s' is possibly None. 'option_get' can only be applied to a variable in 'Some' arm of 'match' expression matching the variable", ref.Symbol.DisplayName)
+			c.err = c.err.NotefAt(n.Pos(), "Match '%s' with 'Some' before applying 'option_get' to it", ref.Symbol.DisplayName)
+			return nil
+		}
+		return c
+	default:
+		return c
+	}
+}
+
+func (c *narrowingChecker) VisitBottomup(ast.Expr) {}
+
+func checkNarrowing(env *Env, root ast.Expr) *locerr.Error {
+	c := &narrowingChecker{env, nil, map[string]struct{}{}}
+	ast.Visit(c, root)
+	return c.err
+}
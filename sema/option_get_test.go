@@ -0,0 +1,80 @@
+package sema
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestOptionGetNarrowed(t *testing.T) {
+	for _, tc := range []struct {
+		what string
+		code string
+	}{
+		{"in 'Some' arm", "let x = Some 42 in match x with Some _ -> println_int (option_get x) | None -> ()"},
+		{"in closure in 'Some' arm", "let x = Some 42 in match x with Some _ -> let rec f _ = option_get x in println_int (f ()) | None -> ()"},
+		{"in nested match", "let x = Some 1 in let y = Some true in match x with Some _ -> (match y with Some b -> println_bool (b && option_get y && option_get x = 1) | None -> ()) | None -> ()"},
+		{"parameter", "let rec f o = match o with Some _ -> option_get o | None -> 0 in println_int (f (Some 1))"},
+		{"declared as external", "external option_get: int -> int = \"get\"; println_int (option_get 1)"},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := Analyze(parsed); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOptionGetPossiblyNone(t *testing.T) {
+	for _, tc := range []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{"not matched", "let x = Some 42 in println_int (option_get x)", "Variable 'x' is possibly None"},
+		{"in 'None' arm", "let x = Some 42 in match x with Some _ -> () | None -> println_int (option_get x)", "Variable 'x' is possibly None"},
+		{"after 'match'", "let x = Some 42 in (match x with Some _ -> () | None -> ()); println_int (option_get x)", "Variable 'x' is possibly None"},
+		{"other variable", "let x = Some 1 in let y = Some 2 in match x with Some _ -> println_int (option_get y) | None -> ()", "Variable 'y' is possibly None"},
+		{"not a variable", "println_int (option_get (Some 1))", "Argument of 'option_get' is possibly None"},
+		{"not an option", "let x = 1 in println_int (option_get x)", "argument of 'option_get' must be"},
+		{"wrong arity", "let x = Some 1 in match x with Some _ -> println_int (option_get x x) | None -> ()", "'option_get' requires exactly 1 argument"},
+		{"as value", "let f = option_get in ()", "'option_get' cannot be used as a value"},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestOptionGetEmitsDerefSome(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("let x = Some 42 in match x with Some _ -> println_int (option_get x) | None -> ()"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := SemanticsCheck(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	// One for 'Some _' pattern and one for 'option_get x'
+	if n := strings.Count(buf.String(), "derefsome"); n != 2 {
+		t.Fatalf("Expected 2 'derefsome' instructions but got %d: %s", n, buf.String())
+	}
+}
@@ -0,0 +1,244 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"sort"
+	"sync"
+)
+
+// Note:
+// Independent top-level bindings can be inferred concurrently.
+//   let x = 42 in            (* component 1 *)
+//   let rec f a = a in       (* component 2 *)
+//   let y = x + 1 in         (* component 1 *)
+//   print_int (f y)          (* last expression *)
+// Top-level bindings are split into components of their dependency graph. When a binding refers a
+// variable declared by another binding, they belong to the same component. Bindings in different
+// components never share type variables. So each component is inferred on its own goroutine with its
+// own Inferer and the results are merged into the original one. Bindings in the same component are
+// inferred sequentially because a binding which is not generalized may be fixed by bindings depending
+// on it. The last expression is inferred after merging the results.
+//
+// When a type alias contains a type variable like 'type t = _ list', the type variable is shared by all
+// bindings referring the alias. In the case, the program is inferred sequentially.
+
+type component struct {
+	tops []*topLevel
+	inf  *Inferer
+	// Weak type variables of 'let' bindings in the component
+	weaks map[*ast.Let][]*Var
+	err   error
+	// Index of top-level binding where the error occurred. It is used for choosing the error appearing
+	// earliest in source.
+	errIdx int
+}
+
+func (c *component) infer(indices []int) {
+	inf := c.inf
+	for i, top := range c.tops {
+		var err error
+		switch n := top.node.(type) {
+		case *ast.Let:
+			var decl Type
+			decl, err = inf.declareLet(n, 0)
+			if err == nil {
+				c.weaks[n] = weakVarsOf(decl)
+			}
+		case *ast.LetRec:
+			err = inf.declareLetRec(n, 0)
+		case *ast.LetTuple:
+			err = inf.declareLetTuple(n, 0)
+		default:
+			panic("FATAL: Last expression must not be inferred in component")
+		}
+		if err != nil {
+			c.err = explainWeakBindings(c.tops[:i], c.weaks, inf.Env, err)
+			c.errIdx = indices[i]
+			return
+		}
+	}
+}
+
+// explainWeakBindings adds notes to the error as enclosing 'let' expressions do in sequential inference.
+func explainWeakBindings(tops []*topLevel, weaks map[*ast.Let][]*Var, env *Env, err error) error {
+	for i := len(tops) - 1; i >= 0; i-- {
+		if n, ok := tops[i].node.(*ast.Let); ok {
+			err = explainWeakBinding(n, env.DeclTable[n.Symbol.Name], weaks[n], err)
+		}
+	}
+	return err
+}
+
+type freeVarFinder struct {
+	found bool
+}
+
+func (f *freeVarFinder) VisitTopdown(t Type) Visitor {
+	if v, ok := t.(*Var); ok && !v.IsGeneric() {
+		f.found = true
+		return nil
+	}
+	return f
+}
+
+func (f *freeVarFinder) VisitBottomup(Type) {}
+
+// hasSharedVars returns true when some type alias contains type variables which may be unified
+// by multiple components.
+func (inf *Inferer) hasSharedVars() bool {
+	f := &freeVarFinder{}
+	for _, t := range inf.conv.aliases {
+		Visit(f, t)
+		if f.found {
+			return true
+		}
+	}
+	return false
+}
+
+// componentsOf splits top-level bindings into components. Indices of bindings in each component are
+// also returned. Components are ordered by their first bindings.
+func componentsOf(tops []*topLevel) ([][]*topLevel, [][]int) {
+	declared := map[string]int{}
+	parents := make([]int, len(tops))
+	var root func(int) int
+	root = func(i int) int {
+		for parents[i] != i {
+			parents[i] = parents[parents[i]]
+			i = parents[i]
+		}
+		return i
+	}
+
+	for i, top := range tops {
+		parents[i] = i
+		c := &refCollector{map[string]struct{}{}}
+		ast.Visit(c, top.bound)
+		for name := range c.refs {
+			if j, ok := declared[name]; ok {
+				parents[root(i)] = root(j)
+			}
+		}
+		for _, sym := range top.syms {
+			declared[sym.Name] = i
+		}
+	}
+
+	comps := [][]*topLevel{}
+	indices := [][]int{}
+	idx := map[int]int{}
+	for i, top := range tops {
+		r := root(i)
+		c, ok := idx[r]
+		if !ok {
+			c = len(comps)
+			idx[r] = c
+			comps = append(comps, nil)
+			indices = append(indices, nil)
+		}
+		comps[c] = append(comps[c], top)
+		indices[c] = append(indices[c], i)
+	}
+	return comps, indices
+}
+
+func (inf *Inferer) newComponent(tops []*topLevel) *component {
+	conv := &nodeTypeConv{inf.conv.aliases, true, map[string]*Var{}, inf.conv.pending, inf.conv.resolving}
+	env := &Env{map[string]Type{}, inf.Env.Externals, inf.Env.RefInsts, nil}
+	child := &Inferer{
+		env,
+		conv,
+		map[ast.Expr]Type{},
+		map[Type]boundVarIDs{},
+		refInsts{},
+		nil,
+		nil,
+		false,
+		nil,
+		map[*Var]*provenance{},
+		map[*ast.FuncDef]*ast.VarRef{},
+	}
+	return &component{tops, child, map[*ast.Let][]*Var{}, nil, 0}
+}
+
+func (inf *Inferer) merge(c *component) {
+	for k, v := range c.inf.Env.DeclTable {
+		inf.Env.DeclTable[k] = v
+	}
+	for k, v := range c.inf.inferred {
+		inf.inferred[k] = v
+	}
+	for k, v := range c.inf.schemes {
+		inf.schemes[k] = v
+	}
+	for k, v := range c.inf.insts {
+		inf.insts[k] = v
+	}
+	for k, v := range c.inf.resolvedBy {
+		inf.resolvedBy[k] = v
+	}
+	for k, v := range c.inf.polyCalls {
+		inf.polyCalls[k] = v
+	}
+	inf.holes = append(inf.holes, c.inf.holes...)
+}
+
+// inferParallel infers the program rooted by the node as infer does, but independent top-level
+// bindings are inferred concurrently.
+func (inf *Inferer) inferParallel(root ast.Expr) (Type, error) {
+	tops := topLevelsOf(root)
+	bindings, last := tops[:len(tops)-1], tops[len(tops)-1]
+	comps, indices := componentsOf(bindings)
+	if len(comps) < 2 || inf.hasSharedVars() {
+		return inf.infer(root, 0)
+	}
+
+	cs := make([]*component, 0, len(comps))
+	var wg sync.WaitGroup
+	for i, tops := range comps {
+		c := inf.newComponent(tops)
+		cs = append(cs, c)
+		wg.Add(1)
+		go func(c *component, indices []int) {
+			defer wg.Done()
+			c.infer(indices)
+		}(c, indices[i])
+	}
+	wg.Wait()
+
+	var failed *component
+	for _, c := range cs {
+		if c.err != nil && (failed == nil || c.errIdx < failed.errIdx) {
+			failed = c
+		}
+	}
+	if failed != nil {
+		return nil, failed.err
+	}
+
+	weaks := map[*ast.Let][]*Var{}
+	for _, c := range cs {
+		inf.merge(c)
+		for k, v := range c.weaks {
+			weaks[k] = v
+		}
+	}
+	sort.Slice(inf.holes, func(i, j int) bool {
+		return inf.holes[i].node.Pos().Offset < inf.holes[j].node.Pos().Offset
+	})
+
+	t, err := inf.infer(last.node, 0)
+	if err == nil {
+		err = inf.solve()
+	}
+	if err != nil {
+		return nil, explainWeakBindings(bindings, weaks, inf.Env, err)
+	}
+
+	// Type of 'let' expression is the type of its body
+	for _, top := range bindings {
+		inf.inferred[top.node] = t
+	}
+	return t, nil
+}
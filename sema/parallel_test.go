@@ -0,0 +1,119 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"testing"
+)
+
+func TestComponentsOfTopLevels(t *testing.T) {
+	code := "let x = 1 in let rec f a = a in let y = x + 1 in let (p, q) = (f 1, true) in let z = 3 in print_int y"
+	parsed, err := syntax.Parse(locerr.NewDummySource(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Analyze(parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	tops := topLevelsOf(parsed.Root)
+	_, indices := componentsOf(tops[:len(tops)-1])
+	expected := [][]int{{0, 2}, {1, 3}, {4}}
+	if len(indices) != len(expected) {
+		t.Fatalf("Expected components %v but got %v", expected, indices)
+	}
+	for i, is := range indices {
+		if len(is) != len(expected[i]) {
+			t.Fatalf("Expected components %v but got %v", expected, indices)
+		}
+		for j, idx := range is {
+			if idx != expected[i][j] {
+				t.Fatalf("Expected components %v but got %v", expected, indices)
+			}
+		}
+	}
+}
+
+func TestParallelInference(t *testing.T) {
+	codes := []string{
+		"let x = 1 in let rec f a = a in let y = x + 1 in let (p, q) = (f 1, f true) in print_int (p + y)",
+		"let rec id x = x in let rec pair a b = (a, b) in let p = pair (id 1) (id 2.0) in ()",
+		"let a = Array.make 1 None in let rec f x = x in let b = a.(0) <- Some (f 1) in ()",
+		"let r = 2 in let pi = 3.14 in let s = pi *. 2.0 in print_float (s *. r)",
+		"let x = 1 in ()",
+	}
+
+	for _, code := range codes {
+		t.Run(code, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, _, err := Analyze(parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err = syntax.Parse(locerr.NewDummySource(code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			penv, inferred, err := AnalyzeWithOptions(parsed, Options{false, nil, true, false, false})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(env.DeclTable) != len(penv.DeclTable) {
+				t.Fatalf("Number of declarations mismatch: %d vs %d", len(env.DeclTable), len(penv.DeclTable))
+			}
+			for name, ty := range env.DeclTable {
+				pty, ok := penv.DeclTable[name]
+				if !ok {
+					t.Fatalf("'%s' is not declared in parallel inference", name)
+				}
+				if ty.String() != pty.String() {
+					t.Errorf("Type of '%s' mismatch: '%s' vs '%s'", name, ty.String(), pty.String())
+				}
+			}
+			if ty, ok := inferred[parsed.Root]; !ok || ty.String() != "unit" {
+				t.Fatal("Type of root was not inferred:", ty)
+			}
+		})
+	}
+}
+
+func TestParallelInferenceError(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+	}{
+		{"earliest error", "let x = 1 + true in let rec f a = a in let y = 1.0 + f 2 in ()"},
+		{"error in later binding", "let x = 1 in let rec f a = a in let y = x +. 1.0 in let z = f true in print_int y"},
+		{"error in last expression", "let x = 1 in let rec f a = a in print_float (f x); print_int x"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, expected := Analyze(parsed)
+			if expected == nil {
+				t.Fatal("Error did not occur in sequential inference")
+			}
+
+			parsed, err = syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = AnalyzeWithOptions(parsed, Options{false, nil, true, false, false})
+			if err == nil {
+				t.Fatal("Error did not occur in parallel inference")
+			}
+			if err.Error() != expected.Error() {
+				t.Fatalf("Error mismatch:\n%s\nvs\n%s", expected.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// Recursive function is not polymorphic while inferring its body. So polymorphic recursion is
+// rejected by type inference.
+//   let rec f x = f 1; f true; x in ...
+// With explicit polymorphic type annotation, the annotated type is registered as the type scheme of
+// the function before inferring its body. Recursive calls instantiate the scheme. Then the inferred
+// type of the function is checked to be as polymorphic as the annotation.
+//   let rec f : 'a. 'a -> int = fun x -> f 1 + f true in ...
+// Functions which call themselves with the type variables of the annotation are generic functions
+// as usual. Only functions which actually call themselves at different instances cannot be
+// compiled because they cannot be monomorphized.
+
+// polyRec is a polymorphic type annotation of recursive function under checking.
+type polyRec struct {
+	scheme *Forall
+	inst   *Instantiation
+}
+
+// startPolyRec converts the polymorphic type annotation of the function and unifies the function
+// type with its instance. Type variables of the instance must not be resolved while inferring the
+// body of the function.
+func (inf *Inferer) startPolyRec(def *ast.FuncDef, fun *Fun, level int) (*polyRec, error) {
+	t, err := inf.conv.nodeToType(def.Poly, level)
+	if err != nil {
+		return nil, locerr.NotefAt(def.Poly.Pos(), err, "Polymorphic type annotation of function '%s'", def.Symbol.DisplayName)
+	}
+
+	scheme, ok := t.(*Forall)
+	if !ok {
+		// No type variable is used. It is the same as monomorphic type annotation.
+		inf.constrain(t, fun, def.Poly.Pos(), def.Poly.End(), def.Poly.Pos(), "Type annotation of function '%s'", def.Symbol.DisplayName)
+		return nil, nil
+	}
+
+	if f, ok := scheme.Body.(*Fun); !ok || len(f.Params) != len(fun.Params) {
+		return nil, locerr.ErrorfIn(def.Poly.Pos(), def.Poly.End(), "Type annotation '%s' of function '%s' must be a function type which takes %d parameters", scheme.String(), def.Symbol.DisplayName, len(fun.Params))
+	}
+
+	inst := instantiate(scheme.Body, level+1)
+	inf.constrain(inst.To, fun, def.Poly.Pos(), def.Poly.End(), def.Poly.Pos(), "Type annotation of function '%s'", def.Symbol.DisplayName)
+
+	inf.schemes[scheme.Body] = generalizedIDs(scheme)
+	return &polyRec{scheme, inst}, nil
+}
+
+func generalizedIDs(f *Forall) boundVarIDs {
+	ids := make(boundVarIDs, len(f.Vars))
+	for _, v := range f.Vars {
+		ids.add(v.ID)
+	}
+	return ids
+}
+
+func resolvedTypeOf(t Type) Type {
+	for {
+		v, ok := t.(*Var)
+		if !ok || v.Ref == nil {
+			return t
+		}
+		t = v.Ref
+	}
+}
+
+// boundVarName returns the name of the i-th type variable bound by Forall type. It is the same as
+// the name displayed by Forall.String().
+func boundVarName(i int) string {
+	c := 'a' + rune(i%26)
+	if i < 26 {
+		return "'" + string(c)
+	}
+	return fmt.Sprintf("'%c%d", c, i/26)
+}
+
+// finish checks the type variables instantiated from the annotation are still distinct and not
+// escaping from the function. Then links them to the generic type variables of the annotation.
+func (poly *polyRec) finish(def *ast.FuncDef, level int) error {
+	seen := make(map[*Var]int, len(poly.inst.Mapping))
+	for i, bound := range poly.scheme.Vars {
+		var inst *Var
+		for _, m := range poly.inst.Mapping {
+			if m.ID == bound.ID {
+				inst = m.Type.(*Var)
+				break
+			}
+		}
+		if inst == nil {
+			panic("FATAL: Type variable bound by polymorphic type annotation was not instantiated")
+		}
+
+		t := resolvedTypeOf(inst)
+		v, ok := t.(*Var)
+		if !ok {
+			return poly.lessGeneral(def, i, "'"+t.String()+"'")
+		}
+		if j, ok := seen[v]; ok {
+			return poly.lessGeneral(def, i, "the same type as "+boundVarName(j))
+		}
+		if v.Level <= level {
+			return poly.lessGeneral(def, i, "a type outside the function")
+		}
+		if v.Constraint != NoConstraint {
+			return poly.lessGeneral(def, i, "a type which satisfies constraint '"+v.Constraint.String()+"'")
+		}
+		seen[v] = i
+	}
+
+	for v, i := range seen {
+		v.Ref = poly.scheme.Vars[i]
+	}
+	return nil
+}
+
+func (poly *polyRec) lessGeneral(def *ast.FuncDef, idx int, resolved string) error {
+	return locerr.ErrorfIn(def.Poly.Pos(), def.Poly.End(), "Type of function '%s' is less general than its annotation '%s'. Type variable %s would be %s", def.Symbol.DisplayName, poly.scheme.String(), boundVarName(idx), resolved)
+}
+
+type polyRecRefFinder struct {
+	name  string
+	insts refInsts
+	found *ast.VarRef
+}
+
+// isIdentity returns whether the instantiation maps all type variables of the annotation to
+// themselves.
+func (f *polyRecRefFinder) isIdentity(inst *Instantiation) bool {
+	for _, m := range inst.Mapping {
+		v, ok := resolvedTypeOf(m.Type).(*Var)
+		if !ok || v.ID != m.ID {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *polyRecRefFinder) VisitTopdown(e ast.Expr) ast.Visitor {
+	if f.found != nil {
+		return nil
+	}
+	if ref, ok := e.(*ast.VarRef); ok && ref.Symbol.Name == f.name {
+		if inst, ok := f.insts[ref]; ok && !f.isIdentity(inst) {
+			f.found = ref
+		}
+	}
+	return f
+}
+
+func (f *polyRecRefFinder) VisitBottomup(ast.Expr) {}
+
+// polymorphicCall returns the recursive reference to the function which is instantiated differently
+// from the annotation. It returns nil when the function is not polymorphically recursive. It must be
+// called after finish() linked type variables to the annotation.
+func (poly *polyRec) polymorphicCall(def *ast.FuncDef, insts refInsts) *ast.VarRef {
+	f := &polyRecRefFinder{def.Symbol.Name, insts, nil}
+	ast.Visit(f, def.Body)
+	return f.found
+}
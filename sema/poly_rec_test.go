@@ -0,0 +1,204 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestPolyRecOK(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "recursive call with different types",
+			code:     "let rec f : 'a. 'a -> int = fun x -> if true then 0 else f 1 + f true in f ()",
+			expected: "'a -> int",
+		},
+		{
+			what:     "recursive call with nested type",
+			code:     "let rec f : 'a. 'a -> int -> int = fun x n -> if n = 0 then 0 else f (x, x) (n - 1) in f 1 3",
+			expected: "'a -> int -> int",
+		},
+		{
+			what:     "type variables ordered by annotation body",
+			code:     "let rec f : 'b 'a. 'a -> 'b -> 'a = fun x y -> x in f 1 true",
+			expected: "'a -> 'b -> 'a",
+		},
+		{
+			what:     "parameter annotation",
+			code:     "let rec f : 'a. 'a -> int -> 'a option = fun x (n : int) -> Some x in f true 1",
+			expected: "'a -> int -> 'a option",
+		},
+		{
+			what:     "annotation without type variable",
+			code:     "let rec f : 'a. int -> int = fun x -> x + 1 in f 1",
+			expected: "int -> int",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code + "; ()")
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			if err := NewInferer(env).Infer(parsed); err != nil {
+				t.Fatal(err)
+			}
+			for name, ty := range env.DeclTable {
+				if strings.HasPrefix(name, "f$") {
+					if actual := ty.String(); actual != tc.expected {
+						t.Fatalf("Type of 'f' should be '%s' but actually '%s'", tc.expected, actual)
+					}
+					return
+				}
+			}
+			t.Fatalf("Function 'f' was not found in %v", env.DeclTable)
+		})
+	}
+}
+
+func TestPolyRecError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "polymorphic recursion without annotation",
+			code:     "let rec f x = f 1; f true; x in ()",
+			expected: "Type mismatch between 'int' and 'bool'",
+		},
+		{
+			what:     "type variable resolved to concrete type",
+			code:     "let rec f : 'a. 'a -> int = fun x -> x + 1 in ()",
+			expected: "Type of function 'f' is less general than its annotation 'forall 'a. 'a -> int'. Type variable 'a would be 'int'",
+		},
+		{
+			what:     "type variables unified with each other",
+			code:     "let rec f : 'a 'b. 'a -> 'b -> 'a = fun x y -> y in ()",
+			expected: "Type variable 'b would be the same type as 'a",
+		},
+		{
+			what:     "type variable escapes",
+			code:     "let rec h x = let rec f : 'a. 'a -> 'a = fun y -> x in f in ()",
+			expected: "Type variable 'a would be a type outside the function",
+		},
+		{
+			what:     "type variable constrained by comparison",
+			code:     "let rec f : 'a. 'a -> bool = fun x -> x < x in ()",
+			expected: "Type variable 'a would be a type which satisfies constraint 'Ord'",
+		},
+		{
+			what:     "number of parameters mismatch",
+			code:     "let rec f : 'a. 'a -> 'a = fun x y -> x in ()",
+			expected: "must be a function type which takes 2 parameters",
+		},
+		{
+			what:     "mismatch with parameter annotation",
+			code:     "let rec f : 'a. 'a -> int = fun (x : bool) -> 0 in ()",
+			expected: "Type variable 'a would be 'bool'",
+		},
+		{
+			what:     "mismatch with return type annotation",
+			code:     "let rec f : 'a. 'a -> int = fun x : bool -> true in ()",
+			expected: "Type annotation of function 'f'",
+		},
+		{
+			what:     "wrong use of function",
+			code:     "let rec f : 'a. 'a -> int = fun x -> 0 in f 1 2",
+			expected: "Number of parameters of function does not match",
+		},
+		{
+			what:     "unbound type variable in annotation",
+			code:     "let rec f : 'a. 'a -> 'b = fun x -> x in ()",
+			expected: "Type variable 'b is not bound",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			err = NewInferer(env).Infer(parsed)
+			if err == nil {
+				t.Fatalf("Expected code '%s' to cause an error '%s' but actually there is no error", tc.code, tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestPolyRecRejectedOnCodegen(t *testing.T) {
+	s := locerr.NewDummySource("let rec f : 'a. 'a -> int -> int = fun x n -> if n = 0 then 0 else f (x, x) (n - 1) in print_int (f 1 3)")
+	parsed, err := syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Analyze(parsed); err != nil {
+		t.Fatal("Polymorphic recursion should be accepted by type checking:", err)
+	}
+
+	parsed, err = syntax.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = SemanticsCheck(parsed)
+	if err == nil {
+		t.Fatal("Polymorphic recursion should be rejected before code generation")
+	}
+	if !strings.Contains(err.Error(), "polymorphic recursion cannot be monomorphized") {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestPolyRecAnnotationCompiled(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+	}{
+		{
+			what: "without recursive call",
+			code: "let rec f : 'a. 'a -> int = fun x -> 0 in print_int (f 1)",
+		},
+		{
+			what: "recursive call with the same type",
+			code: "let rec f : 'a. 'a -> int -> 'a = fun x n -> if n = 0 then x else f x (n - 1) in print_int (f 1 3)",
+		},
+		{
+			what: "recursive call in nested function",
+			code: "let rec f : 'a. 'a -> int -> int = fun x n -> let rec g m = f x m in if n = 0 then 0 else g (n - 1) in print_int (f true 3)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := SemanticsCheck(parsed); err != nil {
+				t.Fatal("Function which is not polymorphically recursive should be compiled:", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// 'printf' is a special built-in function. Its type depends on the format string given as its first
+// argument. So it is not an external symbol and its arguments are checked by analyzing the format
+// string at compile time like OCaml's Printf module.
+//   printf "%d: %s\n" 42 "foo"  (* 'int' and 'string' are expected as 2nd and 3rd arguments *)
+//
+// The call is finally lowered into calls of print_* built-in functions while converting AST into MIR.
+const printfName = "printf"
+
+// formatSegment is a piece of a format string. When Type is nil, it represents literal text.
+// Otherwise it represents a conversion specification which consumes one argument.
+type formatSegment struct {
+	Text string
+	Type Type
+}
+
+func parseFormat(format string) ([]formatSegment, error) {
+	segs := []formatSegment{}
+	lit := []byte{}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			lit = append(lit, c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return nil, fmt.Errorf("Format string must not end with '%%'")
+		}
+
+		var t Type
+		switch format[i] {
+		case '%':
+			lit = append(lit, '%')
+			continue
+		case 'd':
+			t = IntType
+		case 'f':
+			t = FloatType
+		case 's':
+			t = StringType
+		case 'b':
+			t = BoolType
+		default:
+			return nil, fmt.Errorf("Unknown conversion specification '%%%c' in format string. Only '%%d', '%%f', '%%s', '%%b' and '%%%%' are available", format[i])
+		}
+
+		if len(lit) > 0 {
+			segs = append(segs, formatSegment{string(lit), nil})
+			lit = []byte{}
+		}
+		segs = append(segs, formatSegment{format[i-1 : i+1], t})
+	}
+	if len(lit) > 0 {
+		segs = append(segs, formatSegment{string(lit), nil})
+	}
+	return segs, nil
+}
+
+func (inf *Inferer) isPrintf(e ast.Expr) bool {
+	ref, ok := e.(*ast.VarRef)
+	if !ok || ref.Symbol.Name != printfName {
+		return false
+	}
+	// 'printf' may be declared with 'external'
+	_, ok = inf.Env.Externals[ref.Symbol.Name]
+	return !ok
+}
+
+func (inf *Inferer) inferPrintf(node *ast.Apply, level int) (Type, error) {
+	if len(node.Args) == 0 {
+		return nil, locerr.ErrorIn(node.Pos(), node.End(), "'printf' requires a format string as its 1st argument")
+	}
+
+	lit, ok := node.Args[0].(*ast.String)
+	if !ok {
+		a := node.Args[0]
+		return nil, locerr.ErrorIn(a.Pos(), a.End(), "1st argument of 'printf' must be a string literal because the format string is analyzed at compile time")
+	}
+	inf.inferred[lit] = StringType
+
+	segs, err := parseFormat(lit.Value)
+	if err != nil {
+		return nil, locerr.ErrorfIn(lit.Pos(), lit.End(), "Invalid format string for 'printf': %s", err.Error())
+	}
+
+	args := node.Args[1:]
+	specs := make([]formatSegment, 0, len(segs))
+	for _, s := range segs {
+		if s.Type != nil {
+			specs = append(specs, s)
+		}
+	}
+	if len(specs) != len(args) {
+		return nil, locerr.ErrorfIn(node.Pos(), node.End(), "Format string of 'printf' requires %d argument(s) but %d argument(s) given", len(specs), len(args))
+	}
+
+	for i, a := range args {
+		t, err := inf.infer(a, level)
+		if err != nil {
+			return nil, err
+		}
+		s := specs[i]
+		inf.constrain(s.Type, t, a.Pos(), a.End(), a.Pos(), "Argument for '%s' in format string of 'printf' must be '%s'", s.Text, s.Type)
+	}
+
+	return UnitType, nil
+}
@@ -0,0 +1,123 @@
+package sema
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	segs, err := parseFormat("a%d b%%c %s%f%b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []formatSegment{
+		{"a", nil},
+		{"%d", types.IntType},
+		{" b%c ", nil},
+		{"%s", types.StringType},
+		{"%f", types.FloatType},
+		{"%b", types.BoolType},
+	}
+	if len(segs) != len(expected) {
+		t.Fatalf("Expected %d segments but actually %d: %v", len(expected), len(segs), segs)
+	}
+	for i, s := range segs {
+		e := expected[i]
+		if s.Text != e.Text || s.Type != e.Type {
+			t.Errorf("Expected %v at %d but actually %v", e, i, s)
+		}
+	}
+}
+
+func TestParseFormatError(t *testing.T) {
+	for _, f := range []string{"foo %", "%x", "%d %z"} {
+		if _, err := parseFormat(f); err == nil {
+			t.Errorf("Error should occur for format '%s'", f)
+		}
+	}
+}
+
+func TestPrintfTypeError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "argument type mismatch",
+			code:     `printf "%d" true`,
+			expected: "Argument for '%d' in format string of 'printf' must be 'int'",
+		},
+		{
+			what:     "too few arguments",
+			code:     `printf "%d %s" 42`,
+			expected: "requires 2 argument(s) but 1 argument(s) given",
+		},
+		{
+			what:     "too many arguments",
+			code:     `printf "%d" 1 2`,
+			expected: "requires 1 argument(s) but 2 argument(s) given",
+		},
+		{
+			what:     "format is not a literal",
+			code:     `let s = "%d" in printf s 42`,
+			expected: "1st argument of 'printf' must be a string literal",
+		},
+		{
+			what:     "invalid format",
+			code:     `printf "%q" 42`,
+			expected: "Unknown conversion specification '%q'",
+		},
+		{
+			what:     "printf as value",
+			code:     `let f = printf in ()`,
+			expected: "'printf' cannot be used as a value",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			tree, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := types.NewEnv()
+			if err := AlphaTransform(tree, env); err != nil {
+				t.Fatal(err)
+			}
+			err = NewInferer(env).Infer(tree)
+			if err == nil {
+				t.Fatal("Error should occur:", tc.code)
+			}
+			if msg := err.Error(); !strings.Contains(msg, tc.expected) {
+				t.Fatalf("Expected error message '%s' to contain '%s'", msg, tc.expected)
+			}
+		})
+	}
+}
+
+func TestPrintfLowering(t *testing.T) {
+	tree, err := syntax.Parse(locerr.NewDummySource(`printf "x = %d\n" 42`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := SemanticsCheck(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	out := buf.String()
+	for _, want := range []string{"xref print_str", "xref print_int", `string "x = "`, "int 42"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("'%s' should be contained in lowered MIR:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "printf") {
+		t.Errorf("printf should not remain in lowered MIR:\n%s", out)
+	}
+}
@@ -0,0 +1,93 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// QueryType returns the innermost expression at the position and its inferred type. Only the
+// offset of the position is used. It is intended to be used by tools such as editors after
+// semantic analysis.
+// When the position is on the declaration part of 'let' or 'let rec' like 'let x =', the type of
+// the declared variable is looked up in the environment and returned with the 'let' expression.
+func QueryType(env *types.Env, inferred InferredTypes, pos locerr.Pos) (types.Type, ast.Expr, error) {
+	var candidates []ast.Expr
+	span := -1
+	for e := range inferred {
+		start, end := e.Pos().Offset, e.End().Offset
+		if pos.Offset < start || end <= pos.Offset {
+			continue
+		}
+		switch {
+		case span < 0 || end-start < span:
+			span = end - start
+			candidates = []ast.Expr{e}
+		case end-start == span:
+			candidates = append(candidates, e)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil, locerr.ErrorfAt(pos, "No expression is found at offset %d", pos.Offset)
+	}
+
+	found := innermost(candidates)
+
+	switch n := found.(type) {
+	case *ast.Let:
+		if pos.Offset < n.Bound.Pos().Offset {
+			if t, ok := env.DeclTable[n.Symbol.Name]; ok {
+				return t, n, nil
+			}
+		}
+	case *ast.LetRec:
+		if pos.Offset < n.Func.Body.Pos().Offset {
+			if t, ok := env.DeclTable[n.Func.Symbol.Name]; ok {
+				return t, n, nil
+			}
+		}
+	}
+
+	return inferred[found], found, nil
+}
+
+type descendantFinder struct {
+	root    ast.Expr
+	targets map[ast.Expr]struct{}
+	found   bool
+}
+
+func (f *descendantFinder) VisitTopdown(e ast.Expr) ast.Visitor {
+	if f.found {
+		return nil
+	}
+	if _, ok := f.targets[e]; ok && e != f.root {
+		f.found = true
+		return nil
+	}
+	return f
+}
+
+func (f *descendantFinder) VisitBottomup(ast.Expr) {}
+
+// innermost returns the expression which does not contain any other expressions in the list.
+// Expressions in the list have the same span, so they are nested in each other. Iteration order of
+// a map is random so the innermost one is chosen by AST structure to make the result deterministic.
+func innermost(exprs []ast.Expr) ast.Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	targets := make(map[ast.Expr]struct{}, len(exprs))
+	for _, e := range exprs {
+		targets[e] = struct{}{}
+	}
+	for _, e := range exprs {
+		f := &descendantFinder{e, targets, false}
+		ast.Visit(f, e)
+		if !f.found {
+			return e
+		}
+	}
+	return exprs[0]
+}
@@ -0,0 +1,82 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestQueryType(t *testing.T) {
+	code := "let x = 1 + 2 in\nlet rec f a = a in\nprintln_int (f x)"
+	cases := []struct {
+		what     string
+		at       string
+		node     string
+		expected string
+	}{
+		{"literal", "2 in", "Int", "int"},
+		{"binary operator", "+ 2", "Add", "int"},
+		{"variable declared by let", "x =", "Let", "int"},
+		{"function declared by let rec", "f a", "LetRec", "'a -> 'a"},
+		{"variable reference", "x)", "VarRef", "int"},
+		{"instantiated function", "f x", "VarRef", "int -> int"},
+		{"application", " x)", "Apply", "int"},
+		{"external function", "println_int", "VarRef", "int -> unit"},
+	}
+
+	src := locerr.NewDummySource(code)
+	parsed, err := syntax.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, inferred, err := Analyze(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			offset := strings.Index(code, tc.at)
+			ty, node, err := QueryType(env, inferred, locerr.Pos{offset, 1, 1, src})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node.Name() != tc.node && !strings.HasPrefix(node.Name(), tc.node+" ") {
+				t.Fatalf("Expected node %s but got %s", tc.node, node.Name())
+			}
+			if s := ty.String(); s != tc.expected {
+				t.Fatalf("Expected type '%s' but got '%s'", tc.expected, s)
+			}
+		})
+	}
+
+	if _, _, err := QueryType(env, inferred, locerr.Pos{len(code) + 1, 1, 1, src}); err == nil {
+		t.Fatal("Error should occur when no expression is at the position")
+	}
+}
+
+func TestQueryTypeNodesWithSameSpan(t *testing.T) {
+	// Lambda is desugared into 'let rec' and a reference to the function. Both have the same span
+	code := "let f = fun x -> x + 1 in print_int (f 1)"
+	src := locerr.NewDummySource(code)
+	parsed, err := syntax.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, inferred, err := Analyze(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := strings.Index(code, "fun")
+	for i := 0; i < 20; i++ {
+		_, node, err := QueryType(env, inferred, locerr.Pos{offset, 1, 1, src})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(node.Name(), "VarRef ") {
+			t.Fatalf("Innermost node should be returned but got %s", node.Name())
+		}
+	}
+}
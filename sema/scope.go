@@ -2,6 +2,7 @@ package sema
 
 import (
 	"github.com/rhysd/gocaml/ast"
+	"sort"
 )
 
 type scope struct {
@@ -29,3 +30,25 @@ func (m *scope) resolve(name string) (*ast.Symbol, bool) {
 	}
 	return m.parent.resolve(name)
 }
+
+// symbols returns all symbols visible from the scope. Shadowed symbols are not included. Symbols in
+// inner scope come first.
+func (m *scope) symbols() []*ast.Symbol {
+	seen := map[string]struct{}{}
+	syms := []*ast.Symbol{}
+	for s := m; s != nil; s = s.parent {
+		names := make([]string, 0, len(s.vars))
+		for n := range s.vars {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if _, ok := seen[n]; ok {
+				continue
+			}
+			seen[n] = struct{}{}
+			syms = append(syms, s.vars[n])
+		}
+	}
+	return syms
+}
@@ -51,3 +51,28 @@ func TestFindNestedSymbol(t *testing.T) {
 		t.Errorf("symbol piyo should not be found but actually %v was found", sym)
 	}
 }
+
+func TestVisibleSymbols(t *testing.T) {
+	s := newScope(nil)
+	foo := ast.NewSymbol("foo")
+	s.mapSymbol("foo", foo)
+	s.mapSymbol("bar", ast.NewSymbol("bar"))
+
+	s = newScope(s)
+	foo2 := ast.NewSymbol("foo")
+	s.mapSymbol("foo", foo2)
+	s.mapSymbol("piyo", ast.NewSymbol("piyo"))
+
+	syms := s.symbols()
+	if len(syms) != 3 {
+		t.Fatalf("3 symbols should be visible but actually %d", len(syms))
+	}
+	for i, n := range []string{"foo", "piyo", "bar"} {
+		if syms[i].DisplayName != n {
+			t.Errorf("expected %s at %d but actually %s", n, i, syms[i].DisplayName)
+		}
+	}
+	if syms[0] != foo2 {
+		t.Errorf("shadowed symbol must not be visible")
+	}
+}
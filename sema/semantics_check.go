@@ -12,40 +12,98 @@ import (
 )
 
 func Analyze(parsed *ast.AST) (*types.Env, InferredTypes, error) {
+	return AnalyzeWithOptions(parsed, Options{})
+}
+
+// AnalyzeWithOptions is the same as Analyze but non-fatal findings are reported to the warnings
+// collector in the options.
+func AnalyzeWithOptions(parsed *ast.AST, opts Options) (*types.Env, InferredTypes, error) {
+	inferer, err := analyze(parsed, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inferer.Env, inferer.inferred, nil
+}
+
+// analyze runs semantic analysis and returns the inferer which holds the results.
+func analyze(parsed *ast.AST, opts Options) (*Inferer, error) {
 	env := types.NewEnv()
 
+	// Desugar [@@deriving] attributes into function definitions
+	if err := DeriveFunctions(parsed); err != nil {
+		return nil, locerr.NoteAt(parsed.Root.Pos(), err, "Deriving functions failed")
+	}
+
 	// First, resolve all symbols by alpha transform
-	if err := AlphaTransform(parsed, env); err != nil {
-		return nil, nil, locerr.NoteAt(parsed.Root.Pos(), err, "Alpha transform failed")
+	if err := alphaTransform(parsed, env, opts.Warnings); err != nil {
+		return nil, locerr.NoteAt(parsed.Root.Pos(), err, "Alpha transform failed")
 	}
 
 	// Second, run unification on all nodes and dereference type variables
 	inferer := NewInferer(env)
+	inferer.Warnings = opts.Warnings
+	inferer.Parallel = opts.Parallel
 	if err := inferer.Infer(parsed); err != nil {
-		return nil, nil, locerr.NoteAt(parsed.Root.Pos(), err, "Type inference failed")
+		return nil, locerr.NoteAt(parsed.Root.Pos(), err, "Type inference failed")
 	}
 
-	return env, inferer.inferred, nil
+	return inferer, nil
+}
+
+// Options configures semantic analysis in AnalyzeWithOptions and SemanticsCheckWithOptions.
+type Options struct {
+	// NoAssert compiles out 'assert' expressions. Their conditions are type-checked but not evaluated.
+	NoAssert bool
+	// Warnings collects non-fatal findings of analyses. When it is nil, warnings are not reported.
+	Warnings *Warnings
+	// Parallel infers independent top-level bindings concurrently.
+	Parallel bool
+	// NoBoundsCheck does not insert bounds checks on accessing arrays.
+	NoBoundsCheck bool
+	// Polymorphic accepts rank-N polymorphic parameters and polymorphic recursion. It is only for
+	// consumers of MIR which run generic functions without monomorphizing them (e.g. interpreter and
+	// JavaScript backend).
+	Polymorphic bool
 }
 
 // SemanticsCheck applies type inference, checks semantics of types and finally converts AST into MIR
 // with inferred type information.
 func SemanticsCheck(parsed *ast.AST) (*types.Env, *mir.Block, error) {
+	return SemanticsCheckWithOptions(parsed, Options{})
+}
+
+// SemanticsCheckWithOptions is the same as SemanticsCheck but MIR is emitted with the options.
+func SemanticsCheckWithOptions(parsed *ast.AST, opts Options) (*types.Env, *mir.Block, error) {
 	env := types.NewEnv()
 
+	// Desugar [@@deriving] attributes into function definitions
+	if err := DeriveFunctions(parsed); err != nil {
+		return nil, nil, locerr.NoteAt(parsed.Root.Pos(), err, "Deriving functions failed")
+	}
+
 	// First, resolve all symbols by alpha transform
-	if err := AlphaTransform(parsed, env); err != nil {
+	if err := alphaTransform(parsed, env, opts.Warnings); err != nil {
 		return nil, nil, locerr.NoteAt(parsed.Root.Pos(), err, "Alpha transform failed")
 	}
 
 	// Second, run unification on all nodes and dereference type variables
 	inferer := NewInferer(env)
+	inferer.Warnings = opts.Warnings
+	inferer.Parallel = opts.Parallel
 	if err := inferer.Infer(parsed); err != nil {
 		return nil, nil, locerr.NoteAt(parsed.Root.Pos(), err, "Type inference failed")
 	}
 
+	// Functions are monomorphized on compilation. Parameters with rank-N polymorphic types and
+	// polymorphic recursion are only available for type checking, interpreter and JavaScript for now.
+	if !opts.Polymorphic {
+		if err := rejectForallTypes(parsed.Root, inferer.polyCalls); err != nil {
+			return nil, nil, locerr.NoteAt(parsed.Root.Pos(), err, "Unsupported feature for code generation")
+		}
+	}
+
 	// Third, convert AST into MIR
-	block := ToMIR(parsed.Root, env, inferer.inferred, inferer.insts)
+	block := ToMIR(parsed.Root, env, inferer.inferred, inferer.insts, opts.NoAssert, opts.NoBoundsCheck)
 
 	return env, block, nil
 }
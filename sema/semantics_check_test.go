@@ -1,6 +1,7 @@
 package sema
 
 import (
+	"bytes"
 	"github.com/rhysd/gocaml/syntax"
 	"github.com/rhysd/locerr"
 	"io/ioutil"
@@ -81,3 +82,63 @@ func TestSemanticsCheckFail(t *testing.T) {
 		})
 	}
 }
+
+func TestAssertion(t *testing.T) {
+	code := "let x = 42 in assert (x > 0); println_int x"
+	for _, noAssert := range []bool{false, true} {
+		parsed, err := syntax.Parse(locerr.NewDummySource(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, block, err := SemanticsCheckWithOptions(parsed, Options{noAssert, nil, false, false, false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		block.Println(&buf, env)
+		out := buf.String()
+
+		if noAssert {
+			if strings.Contains(out, assertFailName) || strings.Contains(out, "binary >") {
+				t.Error("Assertion should be compiled out:", out)
+			}
+			continue
+		}
+		if !strings.Contains(out, "xref "+assertFailName) {
+			t.Error("Assertion should be lowered into the call of runtime function:", out)
+		}
+		if !strings.Contains(out, ":1:15") {
+			t.Error("Location of assertion should be passed to runtime function:", out)
+		}
+	}
+}
+
+func TestBoundsCheck(t *testing.T) {
+	code := "let a = Array.make 3 0 in a.(1) <- 2; println_int a.(1)"
+	for _, noBoundsCheck := range []bool{false, true} {
+		parsed, err := syntax.Parse(locerr.NewDummySource(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, block, err := SemanticsCheckWithOptions(parsed, Options{false, nil, false, noBoundsCheck, false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		block.Println(&buf, env)
+		out := buf.String()
+
+		if noBoundsCheck {
+			if strings.Contains(out, "boundscheck") {
+				t.Error("Bounds checks should not be inserted:", out)
+			}
+			continue
+		}
+		if n := strings.Count(out, "boundscheck"); n != 2 {
+			t.Errorf("Bounds checks should be inserted before both 'arrstore' and 'arrload' but got %d: %s", n, out)
+		}
+		if !strings.Contains(out, "boundscheck $k5 $k4 ; type=unit") {
+			t.Error("Bounds check should take index and array:", out)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package sema
+
+import (
+	"fmt"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// Type inference consists of two phases. While visiting AST, Inferer does not unify types
+// immediately. Instead, it generates constraints between types. Each constraint remembers its
+// provenance: the expression which caused it and the reason why the types must match. Then pending
+// constraints are solved in the order of generation and an error is decorated with its provenance.
+//   if c then 1 else true
+//   (* Generates: bool = typeof(c), typeof(1) = typeof(true) *)
+//   (* Solving the second one fails. It is reported at the 'if' expression *)
+//
+// Constraints must be solved before looking into types. Pending constraints are solved at
+//   - generalization of 'let' and 'let rec'
+//   - checks of polymorphic type annotations and rank-N polymorphic arguments
+//   - an error while inference, to report the earliest type error first
+//   - the end of inference
+
+// provenance is where a constraint comes from. Its message is formatted when solving the constraint
+// fails. So types in args are shown with the information at the failure.
+type provenance struct {
+	start  locerr.Pos
+	end    locerr.Pos
+	at     locerr.Pos
+	format string
+	args   []interface{}
+}
+
+func (p *provenance) decorate(err *locerr.Error) *locerr.Error {
+	return err.In(p.start, p.end).NoteAt(p.at, fmt.Sprintf(p.format, p.args...))
+}
+
+// typeConstraint requires 'expected' and 'actual' to be the same type. When class is not
+// NoConstraint, it instead requires 'actual' to satisfy the constraint.
+type typeConstraint struct {
+	expected Type
+	actual   Type
+	class    Constraint
+	from     *provenance
+}
+
+func (c *typeConstraint) solve(inf *Inferer) *locerr.Error {
+	if c.class != NoConstraint {
+		return satisfy(c.actual, c.class)
+	}
+	return inf.unifyFrom(c.expected, c.actual, c.from)
+}
+
+// constrain adds a constraint that the two types must be the same. The error is reported in the
+// range from start to end with the note at 'at'.
+func (inf *Inferer) constrain(expected, actual Type, start, end, at locerr.Pos, format string, args ...interface{}) {
+	c := &typeConstraint{expected, actual, NoConstraint, &provenance{start, end, at, format, args}}
+	inf.constraints = append(inf.constraints, c)
+}
+
+// constrainClass adds a constraint that the type must satisfy the type class constraint such as Eq.
+func (inf *Inferer) constrainClass(t Type, class Constraint, start, end, at locerr.Pos, format string, args ...interface{}) {
+	c := &typeConstraint{nil, t, class, &provenance{start, end, at, format, args}}
+	inf.constraints = append(inf.constraints, c)
+}
+
+// solve solves all pending constraints in the order of generation. Remaining constraints are
+// discarded when some constraint cannot be solved.
+func (inf *Inferer) solve() error {
+	pending := inf.constraints
+	inf.constraints = nil
+	for _, c := range pending {
+		if err := c.solve(inf); err != nil {
+			return c.from.decorate(err)
+		}
+	}
+	return nil
+}
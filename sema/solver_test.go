@@ -0,0 +1,81 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestSolveConstraintsInOrder(t *testing.T) {
+	src := locerr.NewDummySource("1 + true")
+	pos := locerr.Pos{0, 1, 1, src}
+
+	inf := NewInferer(NewEnv())
+	v := NewVar(nil, 0)
+	inf.constrain(v, IntType, pos, pos, pos, "First")
+	inf.constrain(v, BoolType, pos, pos, pos, "Second must be '%s'", v)
+	inf.constrain(StringType, BoolType, pos, pos, pos, "Third")
+
+	if len(inf.constraints) != 3 {
+		t.Fatal("Constraints should not be solved until solve() is called:", inf.constraints)
+	}
+	if v.Ref != nil {
+		t.Fatal("Type variable should not be resolved before solving constraints:", v.Ref.String())
+	}
+
+	err := inf.solve()
+	if err == nil {
+		t.Fatal("Error should occur")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "Second must be 'int'") {
+		t.Fatal("Error should be decorated with provenance of the first unsolvable constraint:", msg)
+	}
+	if strings.Contains(msg, "Third") {
+		t.Fatal("Constraints after the error should not be solved:", msg)
+	}
+	if len(inf.constraints) != 0 {
+		t.Fatal("Pending constraints should be discarded:", inf.constraints)
+	}
+}
+
+func TestSolveClassConstraint(t *testing.T) {
+	src := locerr.NewDummySource("[| 1 |] = [| 1 |]")
+	pos := locerr.Pos{0, 1, 1, src}
+
+	inf := NewInferer(NewEnv())
+	v := NewVar(nil, 0)
+	inf.constrainClass(v, EqConstraint, pos, pos, pos, "'%s' can't be compared", v)
+	inf.constrain(v, &Array{IntType}, pos, pos, pos, "Array")
+
+	err := inf.solve()
+	if err == nil {
+		t.Fatal("Error should occur")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "does not satisfy constraint 'Eq'") {
+		t.Fatal("Unexpected error message:", msg)
+	}
+}
+
+func TestEarlierConstraintErrorIsReportedFirst(t *testing.T) {
+	// Constraint for the 1st element of tuple is not solved yet when the error in printf occurs
+	code := `(1 + true, printf "%d" 1 2)`
+	parsed, err := syntax.Parse(locerr.NewDummySource(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := NewEnv()
+	if err := AlphaTransform(parsed, env); err != nil {
+		t.Fatal(err)
+	}
+	err = NewInferer(env).Infer(parsed)
+	if err == nil {
+		t.Fatal("Error should occur")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "Right hand of operator '+' must be int") {
+		t.Fatal("Error of the earlier constraint should be reported:", msg)
+	}
+}
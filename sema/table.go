@@ -0,0 +1,82 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+)
+
+// Note:
+// Table is a built-in mutable hash table. Its primitives are special built-in functions referred
+// with qualified names.
+//   Table.create : unit -> ('k, 'v) table
+//   Table.find   : ('k, 'v) table -> 'k -> 'v option
+//   Table.set    : ('k, 'v) table -> 'k -> 'v -> unit
+//   Table.remove : ('k, 'v) table -> 'k -> unit
+// Type of keys must satisfy Hash constraint. It means keys are 'int' or 'string'. Values can be any
+// type. Since the runtime stores values with their representations in each backend, the primitives
+// cannot be external functions. They must be called directly with all arguments and are lowered
+// into 'table', 'tblload', 'tblstore' and 'tblremove' instructions while converting AST into MIR.
+//   let t = Table.create () in
+//   Table.set t "one" 1;
+//   match Table.find t "one" with Some i -> println_int i | None -> ()
+const (
+	tableCreateName = "Table.create"
+	tableFindName   = "Table.find"
+	tableSetName    = "Table.set"
+	tableRemoveName = "Table.remove"
+)
+
+// Number of parameters of each primitive
+var tablePrimitives = map[string]int{
+	tableCreateName: 1,
+	tableFindName:   2,
+	tableSetName:    3,
+	tableRemoveName: 2,
+}
+
+// tablePrimitiveOf returns the name of primitive when the expression refers one of 'Table' module.
+func tablePrimitiveOf(e ast.Expr) (string, bool) {
+	ref, ok := e.(*ast.VarRef)
+	if !ok {
+		return "", false
+	}
+	_, ok = tablePrimitives[ref.Symbol.Name]
+	return ref.Symbol.Name, ok
+}
+
+func newHashVar(level int) *Var {
+	v := NewVar(nil, level)
+	v.Constraint = HashConstraint
+	return v
+}
+
+func (inf *Inferer) inferTable(node *ast.Apply, name string, level int) (Type, error) {
+	if want := tablePrimitives[name]; len(node.Args) != want {
+		return nil, locerr.ErrorfIn(node.Pos(), node.End(), "'%s' requires exactly %d argument(s) but %d argument(s) given", name, want, len(node.Args))
+	}
+
+	table := &Table{newHashVar(level), NewVar(nil, level)}
+	if name == tableCreateName {
+		if err := inf.checkNodeType("argument of '"+name+"'", node.Args[0], UnitType, level); err != nil {
+			return nil, err
+		}
+		return table, nil
+	}
+
+	if err := inf.checkNodeType("table of '"+name+"'", node.Args[0], table, level); err != nil {
+		return nil, err
+	}
+	if err := inf.checkNodeType("key of '"+name+"'", node.Args[1], table.Key, level); err != nil {
+		return nil, err
+	}
+	switch name {
+	case tableFindName:
+		return &Option{table.Value}, nil
+	case tableSetName:
+		if err := inf.checkNodeType("value of '"+name+"'", node.Args[2], table.Value, level); err != nil {
+			return nil, err
+		}
+	}
+	return UnitType, nil
+}
@@ -0,0 +1,109 @@
+package sema
+
+import (
+	"bytes"
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestTableTypes(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{"int keys", "let t = Table.create () in Table.set t 1 true; ()", "(int, bool) table"},
+		{"string keys", "let t = Table.create () in Table.set t \"a\" (1, 2); ()", "(string, int * int) table"},
+		{"typed by annotation", "let t : (string, float) table = Table.create () in ()", "(string, float) table"},
+		{"hashed and ordered key", "let t = Table.create () in let rec f k = Table.set t k 1; k < k in ()", "(int, int) table"},
+		{"generic function", "let rec get t k = Table.find t k in let t = Table.create () in Table.set t \"a\" 1; println_int (match get t \"a\" with Some i -> i | None -> 0)", "(string, int) table"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, inferred, err := Analyze(parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for e, ty := range inferred {
+				app, ok := e.(*ast.Apply)
+				if !ok {
+					continue
+				}
+				if ref, ok := app.Callee.(*ast.VarRef); !ok || ref.Symbol.Name != tableCreateName {
+					continue
+				}
+				found = true
+				if s := ty.String(); s != tc.expected {
+					t.Fatalf("Expected type '%s' but got '%s'", tc.expected, s)
+				}
+			}
+			if !found {
+				t.Fatal("Call of 'Table.create' was not found")
+			}
+		})
+	}
+}
+
+func TestTableError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{"float key", "let t = Table.create () in Table.set t 1.0 1", "Only 'int' and 'string' values can be keys of table"},
+		{"tuple key", "let t = Table.create () in Table.remove t (1, 2)", "Only 'int' and 'string' values can be keys of table"},
+		{"key mismatch", "let t = Table.create () in Table.set t 1 1; Table.remove t \"a\"", "key of 'Table.remove' must be 'int'"},
+		{"value mismatch", "let t = Table.create () in Table.set t 1 1; Table.set t 2 true", "value of 'Table.set' must be 'int'"},
+		{"not a table", "Table.find [| 1 |] 0", "table of 'Table.find' must be"},
+		{"argument of create", "Table.create 1", "argument of 'Table.create' must be 'unit'"},
+		{"wrong arity", "let t = Table.create () in Table.set t 1", "'Table.set' requires exactly 3 argument(s)"},
+		{"as value", "let f = Table.find in ()", "'Table.find' cannot be used as a value"},
+		{"float key in annotation", "let t : (float, int) table = Table.create () in ()", "Key type of table"},
+		{"compare tables", "let t = Table.create () in Table.set t 1 1; println_bool (t = t)", "Arrays, tables, buffers, JSON values and polymorphic variants"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestTableEmitsInsns(t *testing.T) {
+	code := "let t = Table.create () in Table.set t \"a\" 1; Table.remove t \"b\"; match Table.find t \"a\" with Some i -> println_int i | None -> ()"
+	parsed, err := syntax.Parse(locerr.NewDummySource(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ir, err := SemanticsCheck(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	ir.Println(&buf, env)
+	out := buf.String()
+	for _, insn := range []string{"table", "tblstore", "tblremove", "tblload"} {
+		if !strings.Contains(out, insn+" ") {
+			t.Errorf("'%s' instruction was not emitted: %s", insn, out)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+let rec fact n =
+  assert (n >= 0);
+  if n = 0 then 1 else n * fact (n - 1)
+in
+assert (fact 3 = 6);
+println_int (fact 10)
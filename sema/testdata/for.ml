@@ -0,0 +1,17 @@
+let a = Array.make 10 0 in
+for i = 0 to Array.length a - 1 do
+  a.(i) <- i * i
+done;
+for i = 9 downto 0 do
+  if a.(i) > 50 then continue else
+  if a.(i) = 1 then break else
+  let i = int_to_float i in
+  println_float i
+done;
+for i = 1 to 3 do
+  for j = 1 to i do
+    match if j = 2 then None else Some (i * j) with
+    | Some n -> println_int n
+    | None -> continue
+  done
+done
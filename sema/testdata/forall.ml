@@ -0,0 +1,10 @@
+let rec pair (f : forall 'a. 'a -> 'a) = (f 42, f true) in
+let rec id x = x in
+let p = pair id in
+let rec first (g : forall 'a 'b. 'a -> 'b -> 'a) = g 1 "foo" + g 2 3.0 in
+let rec k x y = x in
+print_int (first k);
+print_int (first (fun a b -> a));
+let rec is_some (h : forall 'a. 'a option -> bool) = h (Some 1) && h (Some "foo") in
+let rec f o = match o with Some _ -> true | None -> false in
+print_bool (is_some f)
@@ -0,0 +1,9 @@
+external print: 'a. 'a -> unit = "print";
+external pair: 'a 'b. 'a -> 'b -> 'a * 'b = "pair";
+print 42;
+print 3.14;
+let p = pair true "foo" in
+let f = print in
+f (Some 1);
+let rec g x = print x in
+g p
@@ -0,0 +1,3 @@
+let main args =
+  print_str "argc: "; println_int (Array.length args);
+  if Array.length args > 1 then println_str args.(1) else ()
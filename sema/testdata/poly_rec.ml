@@ -0,0 +1,8 @@
+let rec depth : 'a. 'a -> int -> int = fun x n ->
+  if n = 0 then 0 else 1 + depth (x, x) (n - 1)
+in
+let rec first : 'a 'b. 'a -> 'b -> 'a = fun x y ->
+  if false then first x 1.0 else x
+in
+print_int (depth true 3);
+print_int (first 42 "foo")
@@ -0,0 +1,7 @@
+printf "no argument\n";
+printf "%d %f %s %b %%\n" 42 3.14 "foo" true;
+let x = 10 in
+let s = "bar" in
+printf "x = %d, s = %s\n" x s;
+let rec printf x = x + 1 in
+print_int (printf 10)
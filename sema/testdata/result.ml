@@ -0,0 +1,8 @@
+let r: (int, string) result = Ok 42 in
+let r2: (int * unit, bool array) result = Error [| true |] in
+let rec f x = match x with Ok i -> i | Error s -> str_length s in
+f (Ok 1); f (Error "foo"); f r;
+let rec g x = match x with Error e -> e | Ok b -> b in
+println_bool (g (Ok true));
+println_bool (r = Ok 1);
+()
@@ -0,0 +1,10 @@
+type edge = node * node
+and node = int * string
+and graph = node array * edge array;
+let n1 = (1, "a") in
+let n2 = (2, "b") in
+let g: graph = ([| n1; n2 |], [| (n1, n2) |]) in
+let rec first_edge (g: graph): edge = let (_, es) = g in es.(0) in
+let (from, _) = first_edge g in
+let (id, _) = from in
+println_int id
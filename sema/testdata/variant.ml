@@ -0,0 +1,42 @@
+let rec name v =
+  match v with
+  | `Red -> "red"
+  | `Green -> "green"
+  | `Rgb code -> int_to_str code
+in
+print_str (name `Red);
+print_str (name (`Rgb 16711935));
+
+(* Open variant by default arm *)
+let rec is_zero v =
+  match v with
+  | `Zero -> true
+  | other -> false
+in
+print_bool (is_zero `Zero);
+print_bool (is_zero (`Succ 3));
+print_bool (is_zero `Foo);
+
+(* Tags are accumulated in row *)
+let rec to_int v =
+  match v with
+  | `Int i -> i
+  | `Float f -> float_to_int f
+  | `Bool b -> if b then 1 else 0
+in
+let xs = Array.make 3 (`Int 1) in
+xs.(1) <- `Float 3.14;
+xs.(2) <- `Bool true;
+print_int (to_int xs.(0) + to_int xs.(1) + to_int xs.(2));
+
+(* Nested variants *)
+let rec unwrap v =
+  match v with
+  | `Some x -> (match x with `Num n -> n)
+  | `None -> 0
+in
+print_int (unwrap (`Some (`Num 42)));
+
+(* Variant value not matched anywhere *)
+let v = `Foo (1, 2.0) in
+()
@@ -14,6 +14,9 @@ type emitter struct {
 	env      *types.Env
 	inferred InferredTypes
 	insts    refInsts
+	noAssert bool
+	// Bounds checks are not inserted before accessing arrays
+	noBoundsCheck bool
 }
 
 func (e *emitter) genID() string {
@@ -126,6 +129,84 @@ func (e *emitter) emitMatchInsn(node *ast.Match) *mir.Insn {
 	return e.insn(&mir.If{cond.Ident, someBlk, noneBlk}, cond, node)
 }
 
+// Note:
+// Result values are represented as polymorphic variants tagged with `Ok or `Error at runtime.
+//   match r with Ok x -> e1 | Error y -> e2
+// is converted into
+//   if isvariant `Ok r then (x = variantpayload r; e1) else (y = variantpayload r; e2)
+func (e *emitter) emitMatchResultInsn(node *ast.MatchResult) *mir.Insn {
+	pos := node.Pos()
+	matched := e.emitInsn(node.Target)
+	id := e.genID()
+	e.env.DeclTable[id] = types.BoolType
+	cond := mir.Concat(mir.NewInsn(id, &mir.IsVariant{matched.Ident, "Ok"}, pos), matched)
+
+	matchedTy, ok := e.env.DeclTable[matched.Ident].(*types.Result)
+	if !ok {
+		panic("Type of 'match' expression target not found")
+	}
+	e.env.DeclTable[node.OkIdent.Name] = matchedTy.Ok
+	e.env.DeclTable[node.ErrorIdent.Name] = matchedTy.Error
+
+	okBlk := e.emitBlock("then", node.IfOk)
+	okBlk.Prepend(mir.NewInsn(node.OkIdent.Name, &mir.VariantPayload{matched.Ident}, pos))
+	errBlk := e.emitBlock("else", node.IfError)
+	errBlk.Prepend(mir.NewInsn(node.ErrorIdent.Name, &mir.VariantPayload{matched.Ident}, pos))
+
+	return e.insn(&mir.If{cond.Ident, okBlk, errBlk}, cond, node)
+}
+
+func (e *emitter) emitVariantArmBody(target string, arm *ast.VariantArm) *mir.Insn {
+	body := e.emitInsn(arm.Body)
+	if arm.Ident == nil || arm.Ident.IsIgnored() {
+		return body
+	}
+	var val mir.Val
+	if arm.IsDefault() {
+		// Default arm binds the matched value itself
+		val = &mir.Ref{target}
+	} else {
+		val = &mir.VariantPayload{target}
+	}
+	body.Append(mir.NewInsn(arm.Ident.Name, val, arm.Token.Start))
+	return body
+}
+
+// Note:
+// 'match' expression for polymorphic variants is converted into a chain of 'if' instructions.
+//   match v with `A -> e1 | `B x -> e2 | `C -> e3
+// is converted into
+//   if isvariant `A v then e1 else if isvariant `B v then (x = variantpayload v; e2) else e3
+// The last arm does not need to check its tag because the matched variant is closed or the arm is default.
+// Since patterns are not nested and each tag is matched at most once (checked in type inference), the
+// chain is already a decision tree for one column; no test is repeated on any path. Comparisons of the
+// tag in the chain are merged into one 'switch' by LLVM. Compiling nested patterns into a decision tree
+// which shares tests between arms will be necessary when general patterns are supported.
+func (e *emitter) emitVariantArms(target string, arms []*ast.VariantArm, node *ast.MatchVariant) *mir.Insn {
+	arm := arms[0]
+	if len(arms) == 1 || arm.IsDefault() {
+		return e.emitVariantArmBody(target, arm)
+	}
+
+	id := e.genID()
+	e.env.DeclTable[id] = types.BoolType
+	cond := mir.NewInsn(id, &mir.IsVariant{target, arm.Tag}, arm.Token.Start)
+
+	thenLast := e.emitVariantArmBody(target, arm)
+	thenBlk := mir.NewBlock("then", mir.Reverse(thenLast), thenLast)
+	elseLast := e.emitVariantArms(target, arms[1:], node)
+	elseBlk := mir.NewBlock("else", mir.Reverse(elseLast), elseLast)
+
+	return e.insn(&mir.If{cond.Ident, thenBlk, elseBlk}, cond, node)
+}
+
+func (e *emitter) emitMatchVariantInsn(node *ast.MatchVariant) *mir.Insn {
+	target := e.emitInsn(node.Target)
+	arms := e.emitVariantArms(target.Ident, node.Arms, node)
+	arms.Append(target)
+	return arms
+}
+
 func (e *emitter) emitLetTupleInsn(node *ast.LetTuple) *mir.Insn {
 	if len(node.Symbols) == 0 {
 		panic("FATAL: LetTuple node must contain at least one symbol")
@@ -157,7 +238,180 @@ func (e *emitter) emitLetTupleInsn(node *ast.LetTuple) *mir.Insn {
 	return body
 }
 
+func (e *emitter) emitPrintfInsn(node *ast.Apply) *mir.Insn {
+	// Note:
+	// Format string was already analyzed in type inference. Here the call is lowered into calls of
+	// print_* built-in functions for each segment of the format string.
+	//   printf "x = %d\n" x
+	// is converted into
+	//   print_str "x = "; print_int x; print_str "\n"
+	segs, err := parseFormat(node.Args[0].(*ast.String).Value)
+	if err != nil {
+		panic("FATAL: Invalid format string must be checked in type inference: " + err.Error())
+	}
+
+	pos := node.Pos()
+	var prev *mir.Insn
+	emit := func(val mir.Val, t types.Type) *mir.Insn {
+		id := e.genID()
+		e.env.DeclTable[id] = t
+		prev = mir.Concat(mir.NewInsn(id, val, pos), prev)
+		return prev
+	}
+
+	args := node.Args[1:]
+	for _, s := range segs {
+		var arg *mir.Insn
+		if s.Type == nil {
+			arg = emit(&mir.String{s.Text}, types.StringType)
+		} else {
+			arg = e.emitInsn(args[0])
+			arg.Append(prev)
+			prev = arg
+			args = args[1:]
+		}
+
+		var printer string
+		switch s.Type {
+		case nil, types.StringType:
+			printer = "print_str"
+		case types.IntType:
+			printer = "print_int"
+		case types.FloatType:
+			printer = "print_float"
+		case types.BoolType:
+			printer = "print_bool"
+		default:
+			panic("FATAL: Unknown type for format string: " + s.Type.String())
+		}
+
+		fun := emit(&mir.XRef{printer}, e.env.Externals[printer].Type)
+		emit(&mir.App{fun.Ident, []string{arg.Ident}, mir.DIRECT_CALL}, types.UnitType)
+	}
+
+	// printf returns unit
+	return e.insn(mir.UnitVal, prev, node)
+}
+
+const assertFailName = "__assert_fail$builtin"
+
+func (e *emitter) emitAssertInsn(node *ast.Assert) *mir.Insn {
+	if e.noAssert {
+		// Assertions are compiled out. Condition is not evaluated.
+		return e.insn(mir.UnitVal, nil, node)
+	}
+
+	// Note:
+	// 'assert' is lowered into a conditional call of runtime function. The function reports the
+	// location of the assertion and aborts the program.
+	//   assert cond
+	// is converted into
+	//   if cond then () else __assert_fail "file:line:col"
+	pos := node.Pos()
+	emit := func(val mir.Val, t types.Type, prev *mir.Insn) *mir.Insn {
+		id := e.genID()
+		e.env.DeclTable[id] = t
+		return mir.Concat(mir.NewInsn(id, val, pos), prev)
+	}
+
+	unit := emit(mir.UnitVal, types.UnitType, nil)
+	thenBlk := mir.NewBlock("then", mir.Reverse(unit), unit)
+
+	loc := fmt.Sprintf("%s:%d:%d", pos.File.Path, pos.Line, pos.Column)
+	fun := emit(&mir.XRef{assertFailName}, e.env.Externals[assertFailName].Type, nil)
+	msg := emit(&mir.String{loc}, types.StringType, fun)
+	call := emit(&mir.App{fun.Ident, []string{msg.Ident}, mir.DIRECT_CALL}, types.UnitType, msg)
+	elseBlk := mir.NewBlock("else", mir.Reverse(call), call)
+
+	cond := e.emitInsn(node.Cond)
+	return e.insn(&mir.If{cond.Ident, thenBlk, elseBlk}, cond, node)
+}
+
+// emitBoundsCheck emits 'boundscheck' instruction before accessing the array. It emits nothing when
+// bounds checks are disabled.
+func (e *emitter) emitBoundsCheck(array, index string, prev *mir.Insn, node ast.Expr) *mir.Insn {
+	if e.noBoundsCheck {
+		return prev
+	}
+	id := e.genID()
+	e.env.DeclTable[id] = types.UnitType
+	return mir.Concat(mir.NewInsn(id, &mir.BoundsCheck{array, index}, node.Pos()), prev)
+}
+
+func (e *emitter) emitExitInsn(node *ast.Apply) *mir.Insn {
+	// Note:
+	// 'exit' never returns. Its value is a placeholder typed as the context requires.
+	//   exit code
+	// is converted into
+	//   __exit code; unreachable
+	pos := node.Pos()
+	code := e.emitInsn(node.Args[0])
+	id := e.genID()
+	e.env.DeclTable[id] = e.env.Externals[exitFuncName].Type
+	fun := mir.Concat(mir.NewInsn(id, &mir.XRef{exitFuncName}, pos), code)
+	id = e.genID()
+	e.env.DeclTable[id] = types.UnitType
+	call := mir.Concat(mir.NewInsn(id, &mir.App{fun.Ident, []string{code.Ident}, mir.DIRECT_CALL}, pos), fun)
+	return e.insn(mir.UnreachableVal, call, node)
+}
+
+// emitLoopJumpInsn emits 'jump' instruction for 'break' or 'continue' in 'for' loop. Instructions
+// following it in the same block are never executed. They are removed in emitBlock.
+func (e *emitter) emitLoopJumpInsn(node *ast.LoopJump) *mir.Insn {
+	var prev *mir.Insn
+	args := make([]string, 0, len(node.Args))
+	for _, a := range node.Args {
+		arg := e.emitInsn(a)
+		arg.Append(prev)
+		args = append(args, arg.Ident)
+		prev = arg
+	}
+	return e.insn(&mir.Jump{args}, prev, node)
+}
+
+// emitTableInsn emits an instruction for the primitive of 'Table' module. Operands are evaluated from
+// left to right.
+func (e *emitter) emitTableInsn(node *ast.Apply, name string) *mir.Insn {
+	if name == tableCreateName {
+		arg := e.emitInsn(node.Args[0])
+		return e.insn(&mir.Table{}, arg, node)
+	}
+	table := e.emitInsn(node.Args[0])
+	key := e.emitInsn(node.Args[1])
+	key.Append(table)
+	switch name {
+	case tableFindName:
+		return e.insn(&mir.TblLoad{table.Ident, key.Ident}, key, node)
+	case tableSetName:
+		rhs := e.emitInsn(node.Args[2])
+		rhs.Append(key)
+		return e.insn(&mir.TblStore{table.Ident, key.Ident, rhs.Ident}, rhs, node)
+	default:
+		return e.insn(&mir.TblRemove{table.Ident, key.Ident}, key, node)
+	}
+}
+
 func (e *emitter) emitAppInsn(node *ast.Apply) *mir.Insn {
+	if ref, ok := node.Callee.(*ast.VarRef); ok && ref.Symbol.Name == printfName {
+		_, isExt := e.env.Externals[printfName]
+		if !isExt {
+			return e.emitPrintfInsn(node)
+		}
+	}
+	if isExit(e.env, node.Callee) {
+		return e.emitExitInsn(node)
+	}
+	if name, ok := tablePrimitiveOf(node.Callee); ok {
+		return e.emitTableInsn(node, name)
+	}
+	if ref, ok := node.Callee.(*ast.VarRef); ok && ref.Symbol.Name == optionGetName {
+		if _, isExt := e.env.Externals[optionGetName]; !isExt {
+			// The argument was checked to be narrowed to 'Some' after type inference
+			arg := e.emitInsn(node.Args[0])
+			return e.insn(&mir.DerefSome{arg.Ident}, arg, node)
+		}
+	}
+
 	var prev *mir.Insn
 	var inst *types.Instantiation
 	var ident string
@@ -174,7 +428,7 @@ func (e *emitter) emitAppInsn(node *ast.Apply) *mir.Insn {
 			ident = ref.Symbol.Name
 			inst, _ = e.insts[ref]
 		} else if _, ok := e.env.Externals[ref.Symbol.Name]; ok {
-			prev = e.insn(&mir.XRef{ref.Symbol.Name}, nil, ref)
+			prev = e.emitXRefInsn(ref)
 			ident = prev.Ident
 		} else {
 			panic("FATAL: Unknown identifier: " + ref.Symbol.Name)
@@ -197,6 +451,16 @@ func (e *emitter) emitAppInsn(node *ast.Apply) *mir.Insn {
 	return insn
 }
 
+// emitXRefInsn emits a reference to external symbol. When the symbol is generic, how it was
+// instantiated is recorded with the identifier of the instruction for monomorphization.
+func (e *emitter) emitXRefInsn(ref *ast.VarRef) *mir.Insn {
+	insn := e.insn(&mir.XRef{ref.Symbol.Name}, nil, ref)
+	if inst, ok := e.insts[ref]; ok {
+		e.env.RefInsts[insn.Ident] = inst
+	}
+	return insn
+}
+
 func (e *emitter) emitInsn(node ast.Expr) *mir.Insn {
 	switch n := node.(type) {
 	case *ast.Unit:
@@ -204,6 +468,10 @@ func (e *emitter) emitInsn(node ast.Expr) *mir.Insn {
 	case *ast.Bool:
 		return e.insn(&mir.Bool{n.Value}, nil, node)
 	case *ast.Int:
+		if _, ok := e.inferred[node].(*types.Float); ok {
+			// Integer literal typed as 'float' by its context
+			return e.insn(&mir.Float{float64(n.Value)}, nil, node)
+		}
 		return e.insn(&mir.Int{n.Value}, nil, node)
 	case *ast.Float:
 		return e.insn(&mir.Float{n.Value}, nil, node)
@@ -272,7 +540,7 @@ func (e *emitter) emitInsn(node ast.Expr) *mir.Insn {
 			}
 			return insn
 		} else if _, ok := e.env.Externals[n.Symbol.Name]; ok {
-			return e.insn(&mir.XRef{n.Symbol.Name}, nil, node)
+			return e.emitXRefInsn(n)
 		} else {
 			panic("FATAL: Unknown identifier: " + n.Symbol.Name)
 		}
@@ -315,17 +583,27 @@ func (e *emitter) emitInsn(node ast.Expr) *mir.Insn {
 		array := e.emitInsn(n.Array)
 		index := e.emitInsn(n.Index)
 		index.Append(array)
-		return e.insn(&mir.ArrLoad{array.Ident, index.Ident}, index, node)
+		check := e.emitBoundsCheck(array.Ident, index.Ident, index, node)
+		return e.insn(&mir.ArrLoad{array.Ident, index.Ident}, check, node)
 	case *ast.ArrayPut:
 		array := e.emitInsn(n.Array)
 		index := e.emitInsn(n.Index)
 		index.Append(array)
 		rhs := e.emitInsn(n.Assignee)
 		rhs.Append(index)
-		return e.insn(&mir.ArrStore{array.Ident, index.Ident, rhs.Ident}, rhs, node)
+		check := e.emitBoundsCheck(array.Ident, index.Ident, rhs, node)
+		return e.insn(&mir.ArrStore{array.Ident, index.Ident, rhs.Ident}, check, node)
 	case *ast.ArraySize:
 		array := e.emitInsn(n.Target)
 		return e.insn(&mir.ArrLen{array.Ident}, array, node)
+	case *ast.Assert:
+		return e.emitAssertInsn(n)
+	case *ast.Break:
+		return e.emitInsn(n.Jump)
+	case *ast.Continue:
+		return e.emitInsn(n.Jump)
+	case *ast.LoopJump:
+		return e.emitLoopJumpInsn(n)
 	case *ast.Some:
 		child := e.emitInsn(n.Child)
 		return e.insn(&mir.Some{child.Ident}, child, node)
@@ -333,6 +611,22 @@ func (e *emitter) emitInsn(node ast.Expr) *mir.Insn {
 		return e.insn(mir.NoneVal, nil, node)
 	case *ast.Match:
 		return e.emitMatchInsn(n)
+	case *ast.Ok:
+		child := e.emitInsn(n.Child)
+		return e.insn(&mir.Variant{"Ok", child.Ident}, child, node)
+	case *ast.Error:
+		child := e.emitInsn(n.Child)
+		return e.insn(&mir.Variant{"Error", child.Ident}, child, node)
+	case *ast.MatchResult:
+		return e.emitMatchResultInsn(n)
+	case *ast.Variant:
+		if n.Payload == nil {
+			return e.insn(&mir.Variant{n.Tag, ""}, nil, node)
+		}
+		payload := e.emitInsn(n.Payload)
+		return e.insn(&mir.Variant{n.Tag, payload.Ident}, payload, node)
+	case *ast.MatchVariant:
+		return e.emitMatchVariantInsn(n)
 	case *ast.Typed:
 		return e.emitInsn(n.Child)
 	default:
@@ -346,11 +640,31 @@ func (e *emitter) emitBlock(name string, node ast.Expr) *mir.Block {
 	// emitInsn() emits instructions in descending order.
 	// Reverse the order to iterate instractions ascending order.
 	firstInsn := mir.Reverse(lastInsn)
-	return mir.NewBlock(name, firstInsn, lastInsn)
+	blk := mir.NewBlock(name, firstInsn, lastInsn)
+	e.truncateAfterJump(blk)
+	return blk
+}
+
+// truncateAfterJump removes instructions following 'jump' instruction in the block since 'jump' must
+// be the last instruction of a block. The 'jump' instruction becomes the value of the block so it is
+// typed as the removed last instruction.
+//   $k1 = jump $k2,$k3
+//   $k4 = app f$t1 $k5   (* removed *)
+func (e *emitter) truncateAfterJump(blk *mir.Block) {
+	for i, end := blk.WholeRange(); i != end; i = i.Next {
+		if _, ok := i.Val.(*mir.Jump); !ok || i.Next == end {
+			continue
+		}
+		e.env.DeclTable[i.Ident] = e.env.DeclTable[end.Prev.Ident]
+		i.Next = end
+		end.Prev = i
+		return
+	}
 }
 
-// ToMIR converts given AST into MIR with type environment
-func ToMIR(root ast.Expr, env *types.Env, inferred InferredTypes, insts refInsts) *mir.Block {
-	e := &emitter{0, env, inferred, insts}
+// ToMIR converts given AST into MIR with type environment. When noAssert is true, 'assert'
+// expressions are compiled out. When noBoundsCheck is true, indices of arrays are not checked.
+func ToMIR(root ast.Expr, env *types.Env, inferred InferredTypes, insts refInsts, noAssert, noBoundsCheck bool) *mir.Block {
+	e := &emitter{0, env, inferred, insts, noAssert, noBoundsCheck}
 	return e.emitBlock("program", root)
 }
@@ -224,6 +224,7 @@ func TestEmitInsn(t *testing.T) {
 				"array $k1 $k2 ; type=bool array",
 				"ref a$t1 ; type=bool array",
 				"int 1 ; type=int",
+				"boundscheck $k5 $k4 ; type=unit",
 				"arrload $k5 $k4 ; type=bool",
 			},
 		},
@@ -237,6 +238,7 @@ func TestEmitInsn(t *testing.T) {
 				"ref a$t1 ; type=bool array",
 				"int 1 ; type=int",
 				"bool false ; type=bool",
+				"boundscheck $k5 $k4 ; type=unit",
 				"arrstore $k5 $k4 $k6 ; type=unit",
 			},
 		},
@@ -351,6 +353,46 @@ func TestEmitInsn(t *testing.T) {
 				"arrlit  ; type=int array",
 			},
 		},
+		{
+			"variant without payload",
+			"`Foo",
+			[]string{
+				"variant `Foo ; type=[> `Foo]",
+			},
+		},
+		{
+			"variant with payload",
+			"`Foo 42",
+			[]string{
+				"int 42 ; type=int",
+				"variant `Foo $k1 ; type=[> `Foo of int]",
+			},
+		},
+		{
+			"match with variant",
+			"match `Foo 42 with `Foo i -> i | `Bar -> 0 | x -> 1",
+			[]string{
+				"int 42 ; type=int",
+				"variant `Foo $k1 ; type=[`Bar | `Foo of int]",
+				"isvariant `Foo $k2 ; type=bool",
+				"if $k3 ; type=int",
+				"BEGIN: then",
+				"i$t1 = variantpayload $k2 ; type=int",
+				"ref i$t1 ; type=int",
+				"END: then",
+				"BEGIN: else",
+				"isvariant `Bar $k2 ; type=bool",
+				"if $k5 ; type=int",
+				"BEGIN: then",
+				"int 0 ; type=int",
+				"END: then",
+				"BEGIN: else",
+				"x$t2 = ref $k2 ; type=[`Bar | `Foo of int]",
+				"int 1 ; type=int",
+				"END: else",
+				"END: else",
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -368,7 +410,7 @@ func TestEmitInsn(t *testing.T) {
 			if err := inf.Infer(ast); err != nil {
 				t.Fatal(err)
 			}
-			ir := ToMIR(ast.Root, inf.Env, inf.inferred)
+			ir := ToMIR(ast.Root, inf.Env, inf.inferred, inf.insts, false, false)
 			var buf bytes.Buffer
 			ir.Println(&buf, inf.Env)
 			r := bufio.NewReader(&buf)
@@ -0,0 +1,37 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/types"
+)
+
+// TypeTable is a side table of inferred types keyed by stable node IDs. InferredTypes is keyed by
+// pointers of nodes so it is no longer available after nodes are rewritten or copied. TypeTable is
+// available as long as the positions of nodes are preserved.
+type TypeTable map[ast.NodeID]types.Type
+
+// Table converts the inferred types into TypeTable. When nodes sharing the same ID have different
+// types, the type for the ID is not recorded since it is ambiguous.
+func (inferred InferredTypes) Table() TypeTable {
+	tbl := make(TypeTable, len(inferred))
+	ambiguous := map[ast.NodeID]struct{}{}
+	for e, t := range inferred {
+		id := ast.IDOf(e)
+		if _, ok := ambiguous[id]; ok {
+			continue
+		}
+		if prev, ok := tbl[id]; ok && !types.Equals(prev, t) {
+			delete(tbl, id)
+			ambiguous[id] = struct{}{}
+			continue
+		}
+		tbl[id] = t
+	}
+	return tbl
+}
+
+// TypeOf returns the type of the node.
+func (tbl TypeTable) TypeOf(e ast.Expr) (types.Type, bool) {
+	t, ok := tbl[ast.IDOf(e)]
+	return t, ok
+}
@@ -0,0 +1,73 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"testing"
+)
+
+type nodeCopier struct {
+	copies []ast.Expr
+}
+
+func (c *nodeCopier) VisitTopdown(e ast.Expr) ast.Visitor {
+	switch n := e.(type) {
+	case *ast.Add:
+		copied := *n
+		c.copies = append(c.copies, &copied)
+	case *ast.VarRef:
+		copied := *n
+		c.copies = append(c.copies, &copied)
+	}
+	return c
+}
+
+func (c *nodeCopier) VisitBottomup(ast.Expr) {}
+
+func TestTypeTable(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("let rec f x = x in let y = 1 + 2 in println_int (f y); f true; ()"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inferred, err := Analyze(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := inferred.Table()
+
+	for e, want := range inferred {
+		have, ok := tbl.TypeOf(e)
+		if !ok {
+			// Nodes generated by compiler may be ambiguous
+			continue
+		}
+		if have.String() != want.String() {
+			t.Errorf("Type of %s mismatched: %s vs %s", e.Name(), have.String(), want.String())
+		}
+	}
+
+	// Copied nodes are different pointers but have the same IDs
+	c := &nodeCopier{}
+	ast.Visit(c, parsed.Root)
+	if len(c.copies) == 0 {
+		t.Fatal("No node was copied")
+	}
+	for _, e := range c.copies {
+		if _, ok := inferred[e]; ok {
+			t.Fatal("Copied node should not be found in inferred types")
+		}
+		ty, ok := tbl.TypeOf(e)
+		if !ok {
+			t.Fatal("Type of copied node was not found:", e.Name())
+		}
+		if e.Name() == "Add" && ty.String() != "int" {
+			t.Fatal("Unexpected type for copied node:", ty.String())
+		}
+		if e.Name() == "VarRef (f)" {
+			if s := ty.String(); s != "int -> int" && s != "bool -> bool" {
+				t.Fatal("Unexpected type for copied reference:", s)
+			}
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package sema
 
 import (
+	"fmt"
 	"github.com/rhysd/gocaml/common"
 	. "github.com/rhysd/gocaml/types"
 	"github.com/rhysd/locerr"
+	"strings"
 )
 
 // Check cyclic dependency. When unifying t and u where t is type variable and
@@ -21,6 +23,19 @@ func occur(v *Var, rhs Type) bool {
 		return occur(v, t.Elem)
 	case *Option:
 		return occur(v, t.Elem)
+	case *Result:
+		return occur(v, t.Ok) || occur(v, t.Error)
+	case *Table:
+		return occur(v, t.Key) || occur(v, t.Value)
+	case *Variant:
+		for _, tag := range t.Tags {
+			if tag.Payload != nil && occur(v, tag.Payload) {
+				return true
+			}
+		}
+		if t.Row != nil {
+			return occur(v, t.Row)
+		}
 	case *Fun:
 		if occur(v, t.Ret) {
 			return true
@@ -44,11 +59,143 @@ func occur(v *Var, rhs Type) bool {
 			// Adjust levels
 			t.Level = v.Level
 		}
+		if v.Weak {
+			// Type variables in the type which a weak type variable is resolved to are also weak
+			t.Weak = true
+		}
 	}
 	return false
 }
 
-func unifyTuple(left, right *Tuple) *locerr.Error {
+// unifyStep is a step from parent types to their children while unification.
+type unifyStep struct {
+	left, right    Type
+	lindex, rindex int
+	what           string
+}
+
+// unifier remembers where unification failed. When unification of child types fails, the step to
+// the children is recorded while unwinding. So the innermost step comes first.
+type unifier struct {
+	steps []unifyStep
+	// Type variables on the cycle found by occur check. They are used to explain the cycle.
+	cycle []*Var
+	// Type variables resolved by the unification in order. They are used to trace instantiations.
+	assigned []*Var
+}
+
+func (u *unifier) enter(left, right Type, index int, what string) {
+	u.steps = append(u.steps, unifyStep{left, right, index, index, what})
+}
+
+// mismatchNote describes where in the whole types unification failed. The mismatched children are
+// marked with '^' under the types.
+//   Type mismatch at the 1st element of tuple in the 2nd parameter of function
+//     Expected: int -> (bool * int) -> unit
+//                       ^^^^
+//     Actual:   int -> (string * int) -> unit
+//                       ^^^^^^
+func (u *unifier) mismatchNote(left, right Type) string {
+	whats := make([]string, 0, len(u.steps))
+	for _, s := range u.steps {
+		whats = append(whats, s.what)
+	}
+	inner := u.steps[0]
+	return fmt.Sprintf(
+		"Type mismatch at the %s\n%s\n%s",
+		strings.Join(whats, " in the "),
+		highlightType("Expected: ", left, inner.left, inner.lindex),
+		highlightType("Actual:   ", right, inner.right, inner.rindex),
+	)
+}
+
+func highlightType(label string, t, parent Type, index int) string {
+	indent := "    "
+	s, start, end := Highlight(t, parent, index)
+	line := indent + label + s
+	if start < 0 {
+		return line
+	}
+	if end == start {
+		end++
+	}
+	pad := strings.Repeat(" ", len(indent)+len(label)+start)
+	return line + "\n" + pad + strings.Repeat("^", end-start)
+}
+
+// occursChain returns the chain from rhs to the type variable v which occurs in rhs, and type
+// variables on the chain. Each element of the chain describes where the previous type is contained
+// so the chain starts from the innermost type.
+// It must be called only when occur(v, rhs) returned true.
+func occursChain(v *Var, rhs Type) ([]string, []*Var) {
+	var chain []string
+	vars := []*Var{v}
+	var walk func(t Type) bool
+	step := func(what string, parent, child Type) bool {
+		if !walk(child) {
+			return false
+		}
+		chain = append(chain, fmt.Sprintf("in the %s '%s'", what, parent.String()))
+		return true
+	}
+	walk = func(t Type) bool {
+		switch t := t.(type) {
+		case *Tuple:
+			for i, e := range t.Elems {
+				if step(common.Ordinal(i+1)+" element of tuple", t, e) {
+					return true
+				}
+			}
+		case *Array:
+			return step("element of array", t, t.Elem)
+		case *Option:
+			return step("element of option", t, t.Elem)
+		case *Result:
+			return step("'Ok' type of result", t, t.Ok) || step("'Error' type of result", t, t.Error)
+		case *Table:
+			return step("key of table", t, t.Key) || step("value of table", t, t.Value)
+		case *Variant:
+			for _, tag := range t.Tags {
+				if tag.Payload != nil && step("payload of tag `"+tag.Name+" of variant", t, tag.Payload) {
+					return true
+				}
+			}
+			if t.Row != nil {
+				return walk(t.Row)
+			}
+		case *Fun:
+			for i, p := range t.Params {
+				if step(common.Ordinal(i+1)+" parameter of function", t, p) {
+					return true
+				}
+			}
+			return step("return type of function", t, t.Ret)
+		case *Var:
+			if t == v {
+				return true
+			}
+			if t.Ref != nil && walk(t.Ref) {
+				chain = append(chain, fmt.Sprintf("through type variable '%s' resolved to '%s'", varName(t), t.Ref.String()))
+				vars = append(vars, t)
+				return true
+			}
+		}
+		return false
+	}
+	walk(rhs)
+	return chain, vars
+}
+
+// varName returns the name of type variable. Unlike String() method, it does not show the type
+// which the variable is linked to.
+func varName(v *Var) string {
+	if v.Ref == nil {
+		return v.String()
+	}
+	return fmt.Sprintf("?(%d)", v.ID)
+}
+
+func (u *unifier) unifyTuple(left, right *Tuple) *locerr.Error {
 	length := len(left.Elems)
 	if length != len(right.Elems) {
 		return locerr.Errorf("Number of elements of tuple does not match: %d vs %d (between '%s' and '%s')", length, len(right.Elems), left.String(), right.String())
@@ -57,7 +204,8 @@ func unifyTuple(left, right *Tuple) *locerr.Error {
 	for i := 0; i < length; i++ {
 		l := left.Elems[i]
 		r := right.Elems[i]
-		if err := Unify(l, r); err != nil {
+		if err := u.unify(l, r); err != nil {
+			u.enter(left, right, i, common.Ordinal(i+1)+" element of tuple")
 			return locerr.Notef(err, "On unifying tuples' %s elements of '%s' and '%s'", common.Ordinal(i+1), left.String(), right.String())
 		}
 	}
@@ -65,8 +213,9 @@ func unifyTuple(left, right *Tuple) *locerr.Error {
 	return nil
 }
 
-func unifyFun(left, right *Fun) *locerr.Error {
-	if err := Unify(left.Ret, right.Ret); err != nil {
+func (u *unifier) unifyFun(left, right *Fun) *locerr.Error {
+	if err := u.unify(left.Ret, right.Ret); err != nil {
+		u.enter(left, right, len(left.Params), "return type of function")
 		return locerr.Notef(err, "On unifying functions' return types of '%s' and '%s'", left.String(), right.String())
 	}
 
@@ -76,7 +225,8 @@ func unifyFun(left, right *Fun) *locerr.Error {
 
 	for i, l := range left.Params {
 		r := right.Params[i]
-		if err := Unify(l, r); err != nil {
+		if err := u.unify(l, r); err != nil {
+			u.enter(left, right, i, common.Ordinal(i+1)+" parameter of function")
 			return locerr.Notef(err, "On unifying %s parameter of function '%s' and '%s'", common.Ordinal(i+1), left.String(), right.String())
 		}
 	}
@@ -84,10 +234,133 @@ func unifyFun(left, right *Fun) *locerr.Error {
 	return nil
 }
 
-func assignVar(v *Var, t Type) *locerr.Error {
+// Split tags of two variants into tags which both have, tags which only left has and tags which only
+// right has. Tags must be sorted by their names.
+func splitTags(left, right []*VariantTag) (common [][2]*VariantTag, lonly, ronly []*VariantTag) {
+	i, j := 0, 0
+	for i < len(left) && j < len(right) {
+		l, r := left[i], right[j]
+		switch {
+		case l.Name == r.Name:
+			common = append(common, [2]*VariantTag{l, r})
+			i++
+			j++
+		case l.Name < r.Name:
+			lonly = append(lonly, l)
+			i++
+		default:
+			ronly = append(ronly, r)
+			j++
+		}
+	}
+	lonly = append(lonly, left[i:]...)
+	ronly = append(ronly, right[j:]...)
+	return
+}
+
+func tagIndex(tags []*VariantTag, name string) int {
+	for i, t := range tags {
+		if t.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func tagNames(tags []*VariantTag) string {
+	s := "`" + tags[0].Name
+	for _, t := range tags[1:] {
+		s += ", `" + t.Name
+	}
+	return s
+}
+
+// Note:
+// Rows of polymorphic variants are unified as Remy's row unification. When unifying
+//   [tags1 | row1] and [tags2 | row2]
+// tags both variants have are unified at first. Then row1 is unified with 'tags only the right has' and
+// row2 is unified with 'tags only the left has'. When both rows are open, they share a new row variable
+// for the rest of tags.
+//   [`A | `B | r1] and [`B | `C | r2]  =>  r1 := [`C | r3], r2 := [`A | r3]
+// When a row is closed, no tag can be added to the variant.
+func (u *unifier) unifyVariant(left, right *Variant) *locerr.Error {
+	ltags, lrow := left.Flatten()
+	rtags, rrow := right.Flatten()
+	common, lonly, ronly := splitTags(ltags, rtags)
+
+	for _, c := range common {
+		l, r := c[0], c[1]
+		li, ri := tagIndex(ltags, l.Name), tagIndex(rtags, r.Name)
+		if l.Payload == nil || r.Payload == nil {
+			if l.Payload != r.Payload {
+				return locerr.Errorf("Tag `%s has a payload in one variant but has no payload in another variant (between '%s' and '%s')", l.Name, left.String(), right.String())
+			}
+			continue
+		}
+		if err := u.unify(l.Payload, r.Payload); err != nil {
+			u.steps = append(u.steps, unifyStep{left, right, li, ri, fmt.Sprintf("payload of tag `%s", l.Name)})
+			return locerr.Notef(err, "On unifying payloads of tag `%s of variants '%s' and '%s'", l.Name, left.String(), right.String())
+		}
+	}
+
+	if lrow == nil && len(ronly) > 0 {
+		return locerr.Errorf("Tag(s) %s cannot be added to closed variant '%s' (while unifying with '%s')", tagNames(ronly), left.String(), right.String())
+	}
+	if rrow == nil && len(lonly) > 0 {
+		return locerr.Errorf("Tag(s) %s cannot be added to closed variant '%s' (while unifying with '%s')", tagNames(lonly), right.String(), left.String())
+	}
+
+	switch {
+	case lrow == nil && rrow == nil:
+		return nil
+	case lrow == nil:
+		return u.assignVar(rrow, &Variant{lonly, nil})
+	case rrow == nil:
+		return u.assignVar(lrow, &Variant{ronly, nil})
+	case lrow == rrow:
+		if len(lonly) > 0 || len(ronly) > 0 {
+			return locerr.Errorf("Cannot unify variants sharing the same row with different tags: '%s' and '%s'", left.String(), right.String())
+		}
+		return nil
+	case len(lonly) == 0 && len(ronly) == 0:
+		return u.assignVar(lrow, rrow)
+	}
+
+	level := lrow.Level
+	if rrow.Level < level {
+		level = rrow.Level
+	}
+	rest := NewVar(nil, level)
+	if err := u.assignVar(lrow, &Variant{ronly, rest}); err != nil {
+		return err
+	}
+	return u.assignVar(rrow, &Variant{lonly, rest})
+}
+
+// isNumMismatch returns true when the type variable of integer literal cannot be resolved to the type.
+// The mismatch is reported as a mismatch with 'int' since the literal is 'int' by default.
+func isNumMismatch(v *Var, t Type) bool {
+	if v.Constraint != NumConstraint {
+		return false
+	}
+	switch t.(type) {
+	case *Var, *Int, *Float:
+		return false
+	default:
+		return true
+	}
+}
+
+func (u *unifier) assignVar(v *Var, t Type) *locerr.Error {
 	// When rv.Ref == nil
 	if occur(v, t) {
-		return locerr.Errorf("Cannot resolve free type variable. Cyclic dependency found for free type variable '%s' while unification with '%s'", v.String(), t.String())
+		err := locerr.Errorf("Cannot resolve free type variable. Cyclic dependency found for free type variable '%s' while unification with '%s'", v.String(), t.String())
+		chain, vars := occursChain(v, t)
+		u.cycle = vars
+		if len(chain) > 0 {
+			err = err.Notef("Type variable '%s' occurs %s. It would make an infinite type", v.String(), strings.Join(chain, " "))
+		}
+		return err
 	}
 
 	// Note:
@@ -98,33 +371,95 @@ func assignVar(v *Var, t Type) *locerr.Error {
 	// The `_` is typed as 'a so the type of `x` will be 'a.
 	// In `x + x`, type of `x` is unified although its type is generic.
 
+	// Type variable may be constrained by relational operators. Resolved type must satisfy it.
+	if err := satisfy(t, v.Constraint); err != nil {
+		return locerr.Notef(err, "On resolving type variable constrained by comparison operator, with '%s'", t.String())
+	}
+
 	v.Ref = t
+	u.assigned = append(u.assigned, v)
 	return nil
 }
 
+// Unify unifies two types. When they cannot be unified, the returned error describes where the types
+// mismatch. By convention, left is the expected type and right is the actual type.
 func Unify(left, right Type) *locerr.Error {
+	u := &unifier{}
+	return u.run(left, right)
+}
+
+func (u *unifier) run(left, right Type) *locerr.Error {
+	err := u.unify(left, right)
+	if err == nil || len(u.steps) == 0 {
+		return err
+	}
+	return err.Note(u.mismatchNote(left, right))
+}
+
+func (u *unifier) unify(left, right Type) *locerr.Error {
 	switch l := left.(type) {
-	case *Unit, *Bool, *Int, *Float, *String:
-		// Types for Unit, Bool, Int, Float and String are singleton instance.
+	case *Unit, *Bool, *Int, *Float, *String, *Buffer, *Json:
+		// Types for Unit, Bool, Int, Float, String, Buffer and Json are singleton instance.
 		// So comparing directly is OK.
 		if l == right {
 			return nil
 		}
 	case *Tuple:
 		if r, ok := right.(*Tuple); ok {
-			return unifyTuple(l, r)
+			return u.unifyTuple(l, r)
 		}
 	case *Array:
 		if r, ok := right.(*Array); ok {
-			return Unify(l.Elem, r.Elem)
+			if err := u.unify(l.Elem, r.Elem); err != nil {
+				u.enter(l, r, 0, "element of array")
+				return err
+			}
+			return nil
 		}
 	case *Option:
 		if r, ok := right.(*Option); ok {
-			return Unify(l.Elem, r.Elem)
+			if err := u.unify(l.Elem, r.Elem); err != nil {
+				u.enter(l, r, 0, "element of option")
+				return err
+			}
+			return nil
+		}
+	case *Result:
+		if r, ok := right.(*Result); ok {
+			if err := u.unify(l.Ok, r.Ok); err != nil {
+				u.enter(l, r, 0, "'Ok' type of result")
+				return locerr.Notef(err, "On unifying 'Ok' types of results '%s' and '%s'", l.String(), r.String())
+			}
+			if err := u.unify(l.Error, r.Error); err != nil {
+				u.enter(l, r, 1, "'Error' type of result")
+				return locerr.Notef(err, "On unifying 'Error' types of results '%s' and '%s'", l.String(), r.String())
+			}
+			return nil
+		}
+	case *Table:
+		if r, ok := right.(*Table); ok {
+			if err := u.unify(l.Key, r.Key); err != nil {
+				u.enter(l, r, 0, "key of table")
+				return locerr.Notef(err, "On unifying key types of tables '%s' and '%s'", l.String(), r.String())
+			}
+			if err := u.unify(l.Value, r.Value); err != nil {
+				u.enter(l, r, 1, "value of table")
+				return locerr.Notef(err, "On unifying value types of tables '%s' and '%s'", l.String(), r.String())
+			}
+			return nil
 		}
 	case *Fun:
 		if r, ok := right.(*Fun); ok {
-			return unifyFun(l, r)
+			return u.unifyFun(l, r)
+		}
+	case *Variant:
+		if r, ok := right.(*Variant); ok {
+			return u.unifyVariant(l, r)
+		}
+	case *Forall:
+		// Rank-N polymorphic types are never inferred. They only match to the same annotation.
+		if r, ok := right.(*Forall); ok && Equals(l, r) {
+			return nil
 		}
 	}
 
@@ -137,18 +472,24 @@ func Unify(left, right Type) *locerr.Error {
 		return nil
 	}
 	if lok && lv.Ref != nil {
-		return Unify(lv.Ref, right)
+		return u.unify(lv.Ref, right)
 	}
 	if rok && rv.Ref != nil {
-		return Unify(left, rv.Ref)
+		return u.unify(left, rv.Ref)
 	}
 	if lok {
 		// When lv.Ref == nil
-		return assignVar(lv, right)
+		if isNumMismatch(lv, right) {
+			return u.unify(IntType, right)
+		}
+		return u.assignVar(lv, right)
 	}
 	if rok {
 		// When rv.Ref == nil
-		return assignVar(rv, left)
+		if isNumMismatch(rv, left) {
+			return u.unify(left, IntType)
+		}
+		return u.assignVar(rv, left)
 	}
 
 	return locerr.Errorf("Cannot unify types. Type mismatch between '%s' and '%s'", left.String(), right.String())
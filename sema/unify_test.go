@@ -0,0 +1,120 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestUnificationMismatchNote(t *testing.T) {
+	cases := []struct {
+		what     string
+		left     Type
+		right    Type
+		expected []string
+	}{
+		{
+			what:  "parameter of function",
+			left:  &Fun{UnitType, []Type{IntType, &Tuple{[]Type{BoolType, IntType}}}},
+			right: &Fun{UnitType, []Type{IntType, &Tuple{[]Type{StringType, IntType}}}},
+			expected: []string{
+				"Type mismatch at the 1st element of tuple in the 2nd parameter of function",
+				"    Expected: int -> (bool * int) -> unit\n                      ^^^^\n",
+				"    Actual:   int -> (string * int) -> unit\n                      ^^^^^^",
+			},
+		},
+		{
+			what:  "return type",
+			left:  &Fun{&Option{IntType}, []Type{IntType}},
+			right: &Fun{&Option{FloatType}, []Type{IntType}},
+			expected: []string{
+				"Type mismatch at the element of option in the return type of function",
+				"    Expected: int -> int option\n                     ^^^\n",
+			},
+		},
+		{
+			what:  "through type variable",
+			left:  NewVar(&Array{&Result{IntType, BoolType}}, 0),
+			right: &Array{&Result{IntType, UnitType}},
+			expected: []string{
+				"Type mismatch at the 'Error' type of result in the element of array",
+				"    Actual:   (int, unit) result array\n                    ^^^^",
+			},
+		},
+		{
+			what:  "payload of tag",
+			left:  &Variant{[]*VariantTag{{"A", nil}, {"B", IntType}}, nil},
+			right: &Variant{[]*VariantTag{{"A", nil}, {"B", BoolType}}, nil},
+			expected: []string{
+				"Type mismatch at the payload of tag `B",
+				"    Expected: [`A | `B of int]\n                    ^^^^^^^^^",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			err := Unify(tc.left, tc.right)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			msg := err.Error()
+			for _, e := range tc.expected {
+				if !strings.Contains(msg, e) {
+					t.Errorf("Error message '%s' does not contain '%s'", msg, e)
+				}
+			}
+		})
+	}
+
+	if err := Unify(IntType, BoolType); err == nil || strings.Contains(err.Error(), "Type mismatch at the") {
+		t.Fatal("Mismatch of top-level types should not have a note for the location:", err)
+	}
+}
+
+func TestOccursCheckExplanation(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{
+			what: "self application",
+			code: "let rec f x = x x in ()",
+			expected: []string{
+				"' occurs in the 1st parameter of function '?(",
+				"' comes from type of variable 'x'",
+			},
+		},
+		{
+			what: "nested types",
+			code: "let rec f y = let z = (y, 1) in y = Some z in ()",
+			expected: []string{
+				" * int' in the element of option '(?(",
+				"' occurs in the 1st element of tuple '?(",
+				"' comes from type of variable 'y'",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Analyze(parsed)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			msg := err.Error()
+			for _, e := range tc.expected {
+				if !strings.Contains(msg, e) {
+					t.Errorf("Error message '%s' does not contain '%s'", msg, e)
+				}
+			}
+		})
+	}
+}
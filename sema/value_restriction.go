@@ -0,0 +1,158 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	. "github.com/rhysd/gocaml/types"
+)
+
+// Note:
+// Generalizing a type of 'let' bound expression is unsound when the expression allocates a mutable
+// value such as array.
+//   let a = Array.make 1 None in
+//   a.(0) <- Some 42;
+//   match a.(0) with Some s -> print_str s | None -> ()
+// So types of expressions are generalized only when they are syntactic values (value restriction).
+// For other expressions, type variables which only appear at covariant positions are still generalized
+// since they can never be used for writing any value (relaxed value restriction).
+//   let o = id None in ...          (* 'a option: generalized *)
+//   let a = Array.make 1 None in ...   (* '_a option array: not generalized *)
+//   let f = id id in ...            (* '_a -> '_a: not generalized *)
+// Type variables which are not generalized are 'weak'. They are fixed at their first use.
+
+// isValue returns the expression is a syntactic value. Evaluating a syntactic value never allocates
+// any mutable value.
+func isValue(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Unit, *ast.Bool, *ast.Int, *ast.Float, *ast.String, *ast.VarRef, *ast.None:
+		return true
+	case *ast.Tuple:
+		for _, elem := range e.Elems {
+			if !isValue(elem) {
+				return false
+			}
+		}
+		return true
+	case *ast.Some:
+		return isValue(e.Child)
+	case *ast.Ok:
+		return isValue(e.Child)
+	case *ast.Error:
+		return isValue(e.Child)
+	case *ast.Variant:
+		return e.Payload == nil || isValue(e.Payload)
+	case *ast.Typed:
+		return isValue(e.Child)
+	case *ast.LetRec:
+		// Function is a value. Note that lambda is also desugared into LetRec.
+		return isValue(e.Body)
+	case *ast.Let:
+		return isValue(e.Bound) && isValue(e.Body)
+	default:
+		return false
+	}
+}
+
+type variance int
+
+const (
+	covariant variance = iota
+	contravariant
+	invariant
+)
+
+func (v variance) flip() variance {
+	switch v {
+	case covariant:
+		return contravariant
+	case contravariant:
+		return covariant
+	default:
+		return invariant
+	}
+}
+
+// collectWeakVars collects type variables which will be generalized at the level but appear at
+// non-covariant positions.
+func collectWeakVars(t Type, level int, v variance, weaks boundVarIDs) {
+	switch t := t.(type) {
+	case *Var:
+		if t.Ref != nil {
+			collectWeakVars(t.Ref, level, v, weaks)
+			return
+		}
+		if t.Level > level && v != covariant {
+			weaks.add(t.ID)
+		}
+	case *Fun:
+		collectWeakVars(t.Ret, level, v, weaks)
+		for _, p := range t.Params {
+			collectWeakVars(p, level, v.flip(), weaks)
+		}
+	case *Tuple:
+		for _, e := range t.Elems {
+			collectWeakVars(e, level, v, weaks)
+		}
+	case *Array:
+		// Array is mutable. So its element type is invariant.
+		collectWeakVars(t.Elem, level, invariant, weaks)
+	case *Option:
+		collectWeakVars(t.Elem, level, v, weaks)
+	case *Result:
+		collectWeakVars(t.Ok, level, v, weaks)
+		collectWeakVars(t.Error, level, v, weaks)
+	case *Table:
+		// Table is mutable as array
+		collectWeakVars(t.Key, level, invariant, weaks)
+		collectWeakVars(t.Value, level, invariant, weaks)
+	case *Variant:
+		tags, row := t.Flatten()
+		for _, tag := range tags {
+			if tag.Payload != nil {
+				collectWeakVars(tag.Payload, level, v, weaks)
+			}
+		}
+		if row != nil {
+			collectWeakVars(row, level, v, weaks)
+		}
+	}
+}
+
+// generalizeBound generalizes the type of 'let' bound expression with relaxed value restriction.
+func (inf *Inferer) generalizeBound(bound ast.Expr, t Type, level int) Type {
+	if isValue(bound) {
+		return inf.generalize(t, level)
+	}
+	weaks := boundVarIDs{}
+	if isDiverging(inf.Env, bound) {
+		// Bottom type of 'exit' or loop jumps is never generalized so that it can be defaulted to unit
+		collectWeakVars(t, level, invariant, weaks)
+	} else {
+		collectWeakVars(t, level, covariant, weaks)
+	}
+	gen := &generalizer{boundVarIDs{}, level, weaks}
+	t = gen.apply(t)
+	if len(gen.bounds) > 0 {
+		inf.schemes[t] = gen.bounds
+	}
+	return t
+}
+
+type weakVarsCollector struct {
+	vars []*Var
+}
+
+func (c *weakVarsCollector) VisitTopdown(t Type) Visitor {
+	if v, ok := t.(*Var); ok && v.Ref == nil && v.Weak {
+		c.vars = append(c.vars, v)
+	}
+	return c
+}
+
+func (c *weakVarsCollector) VisitBottomup(Type) {}
+
+// weakVarsOf returns unresolved weak type variables in the type.
+func weakVarsOf(t Type) []*Var {
+	c := &weakVarsCollector{}
+	Visit(c, t)
+	return c.vars
+}
@@ -0,0 +1,161 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/syntax"
+	. "github.com/rhysd/gocaml/types"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestIsValue(t *testing.T) {
+	cases := []struct {
+		code  string
+		value bool
+	}{
+		{"42", true},
+		{"x", true},
+		{"(1, None, `Foo (Some x))", true},
+		{"fun x -> x", true},
+		{"let rec f x = x in f", true},
+		{"(x : int option)", true},
+		{"f x", false},
+		{"(1, f x)", false},
+		{"Some (f x)", false},
+		{"Array.make 3 None", false},
+		{"[| 1; 2 |]", false},
+		{"if true then None else None", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.code, func(t *testing.T) {
+			s := locerr.NewDummySource(fmt.Sprintf("let rec f x = x in let x = None in let v = %s in ()", tc.code))
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := parsed.Root.(*ast.LetRec).Body.(*ast.Let).Body.(*ast.Let).Bound
+			if actual := isValue(e); actual != tc.value {
+				t.Fatalf("isValue() should return %v but actually %v for %s", tc.value, actual, e.Name())
+			}
+		})
+	}
+}
+
+func TestValueRestrictionOK(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		sym      string
+		expected string
+	}{
+		{
+			what:     "value is generalized",
+			code:     "let o = None in o = Some 1; o = Some true; ()",
+			sym:      "o",
+			expected: "'a option",
+		},
+		{
+			what:     "covariant type variable is generalized",
+			code:     "let rec id x = x in let o = id None in o = Some 1; o = Some true; ()",
+			sym:      "o",
+			expected: "'a option",
+		},
+		{
+			what:     "weak type variable is fixed at first use",
+			code:     "let rec id x = x in let f = id id in print_int (f 1); print_int (f 2)",
+			sym:      "f",
+			expected: "int -> int",
+		},
+		{
+			what:     "element type of array is fixed at first use",
+			code:     "let a = Array.make 1 None in a.(0) <- Some 1; ()",
+			sym:      "a",
+			expected: "int option array",
+		},
+		{
+			what:     "weak type variable in function is generalized by the function",
+			code:     "let rec mk u = let a = Array.make 1 None in a in let a = mk () in let b = mk () in a.(0) <- Some 1; b.(0) <- Some true; ()",
+			sym:      "mk",
+			expected: "'a -> 'b option array",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			if err := NewInferer(env).Infer(parsed); err != nil {
+				t.Fatal(err)
+			}
+			for name, ty := range env.DeclTable {
+				if strings.HasPrefix(name, tc.sym+"$") {
+					if actual := ty.String(); actual != tc.expected {
+						t.Fatalf("Type of '%s' should be '%s' but actually '%s'", tc.sym, tc.expected, actual)
+					}
+					return
+				}
+			}
+			t.Fatalf("Symbol '%s' was not found in %v", tc.sym, env.DeclTable)
+		})
+	}
+}
+
+func TestValueRestrictionError(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected string
+	}{
+		{
+			what:     "array is not generalized",
+			code:     "let a = Array.make 1 None in a.(0) <- Some 42; match a.(0) with Some s -> print_str s | None -> ()",
+			expected: "Type of 'a' was not generalized because its bound expression is not a value. It was fixed to 'int option array' by its first use",
+		},
+		{
+			what:     "partial application result is not generalized",
+			code:     "let rec id x = x in let f = id id in print_int (f 1); print_bool (f true)",
+			expected: "It was fixed to 'int -> int' by its first use",
+		},
+		{
+			what:     "weak type variable is never determined",
+			code:     "let a = Array.make 1 None in print_int (Array.length a)",
+			expected: "Weak type variables like '_a must be determined by uses of the variable",
+		},
+		{
+			what:     "inferred type shows weak type variable",
+			code:     "let a = Array.make 1 None in print_int (Array.length a)",
+			expected: "Inferred type was ''_a option array'",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			s := locerr.NewDummySource(tc.code)
+			parsed, err := syntax.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := NewEnv()
+			if err := AlphaTransform(parsed, env); err != nil {
+				t.Fatal(err)
+			}
+			err = NewInferer(env).Infer(parsed)
+			if err == nil {
+				t.Fatalf("Expected code '%s' to cause an error '%s' but actually there is no error", tc.code, tc.expected)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.expected)
+			}
+		})
+	}
+}
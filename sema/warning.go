@@ -0,0 +1,212 @@
+package sema
+
+import (
+	"fmt"
+	"github.com/rhysd/locerr"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Note:
+// Warnings are non-fatal findings of analyses. Unlike errors, they don't stop compilation. Each
+// kind of warning has a stable code like W001 so that users can enable or disable it with -W flag.
+// Codes must never be renumbered or reused once released.
+
+// Severity is a severity of warning.
+type Severity int
+
+const (
+	// SeverityInfo is for findings which are worth knowing but not problems.
+	SeverityInfo Severity = iota
+	// SeverityWarning is for findings which are likely to be mistakes. They are treated as errors
+	// with -Werror.
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "Info"
+	case SeverityWarning:
+		return "Warning"
+	default:
+		panic("FATAL: Unknown severity: " + strconv.Itoa(int(s)))
+	}
+}
+
+// WarningCode is a stable code to identify a kind of warning. It is shown as W001.
+type WarningCode int
+
+func (c WarningCode) String() string {
+	return fmt.Sprintf("W%03d", int(c))
+}
+
+// ParseWarningCode parses a code such as W001.
+func ParseWarningCode(s string) (WarningCode, error) {
+	if len(s) < 2 || s[0] != 'W' {
+		return 0, fmt.Errorf("Invalid warning code '%s'. It must be 'W' followed by a number like W001", s)
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid warning code '%s'. It must be 'W' followed by a number like W001", s)
+	}
+	return WarningCode(n), nil
+}
+
+const (
+	// WarnUnusedVariable is reported when a variable bound by 'let' is never referenced.
+	WarnUnusedVariable WarningCode = iota + 1
+	// WarnUnusedParameter is reported when a parameter of function is never referenced.
+	WarnUnusedParameter
+	// WarnShadowing is reported when a variable declared by 'let' or parameter shadows another
+	// variable in scope.
+	WarnShadowing
+	// WarnUnreachableCode is reported when an expression follows an expression which never returns
+	// such as 'exit'.
+	WarnUnreachableCode
+	// WarnConstantComparison is reported when the result of '=' or '<>' is known at compile time.
+	WarnConstantComparison
+	// WarnTailCall is reported when a call in tail position is not guaranteed to be a tail call. It
+	// is only checked when tail calls are diagnosed.
+	WarnTailCall
+)
+
+// WarningNote is an additional information of warning with its position.
+type WarningNote struct {
+	Pos     locerr.Pos
+	Message string
+}
+
+// Warning is a non-fatal finding reported by analyses.
+type Warning struct {
+	Code     WarningCode
+	Severity Severity
+	Start    locerr.Pos
+	End      locerr.Pos
+	Message  string
+	Notes    []WarningNote
+}
+
+// NotefAt adds a note at the position to the warning. It does nothing when the receiver is nil
+// so that it can be chained with Warnings.Warnf.
+func (w *Warning) NotefAt(pos locerr.Pos, format string, args ...interface{}) {
+	if w == nil {
+		return
+	}
+	w.Notes = append(w.Notes, WarningNote{pos, fmt.Sprintf(format, args...)})
+}
+
+func (w *Warning) String() string {
+	s := fmt.Sprintf("%s[%s]: %s (at %s)", w.Severity.String(), w.Code.String(), w.Message, w.Start.String())
+	for _, n := range w.Notes {
+		s += fmt.Sprintf("\n  Note: %s (at %s)", n.Message, n.Pos.String())
+	}
+	return s
+}
+
+// ToError converts the warning into an error. It is used for -Werror.
+func (w *Warning) ToError() *locerr.Error {
+	err := locerr.ErrorfIn(w.Start, w.End, "%s [%s]", w.Message, w.Code.String())
+	for _, n := range w.Notes {
+		err = err.NoteAt(n.Pos, n.Message)
+	}
+	return err
+}
+
+// Warnings collects warnings reported by analyses. Methods can be called with nil receiver. In the
+// case, all warnings are discarded.
+type Warnings struct {
+	all       bool
+	overrides map[WarningCode]bool
+	reported  []*Warning
+}
+
+// NewWarnings creates a new warnings collector which reports all warnings.
+func NewWarnings() *Warnings {
+	return &Warnings{true, map[WarningCode]bool{}, nil}
+}
+
+// Configure enables or disables warnings with comma-separated specification. It is a value of -W flag.
+// Each element is applied from left to right.
+//   all:      Enable all warnings
+//   none:     Disable all warnings
+//   W001:     Enable the warning
+//   no-W001:  Disable the warning
+func (ws *Warnings) Configure(spec string) error {
+	for _, elem := range strings.Split(spec, ",") {
+		elem = strings.TrimSpace(elem)
+		switch elem {
+		case "":
+			continue
+		case "all", "none":
+			ws.all = elem == "all"
+			ws.overrides = map[WarningCode]bool{}
+			continue
+		}
+
+		enabled := !strings.HasPrefix(elem, "no-")
+		code, err := ParseWarningCode(strings.TrimPrefix(elem, "no-"))
+		if err != nil {
+			return err
+		}
+		ws.overrides[code] = enabled
+	}
+	return nil
+}
+
+// Enabled returns whether the warning of the code is reported.
+func (ws *Warnings) Enabled(code WarningCode) bool {
+	if ws == nil {
+		return false
+	}
+	if enabled, ok := ws.overrides[code]; ok {
+		return enabled
+	}
+	return ws.all
+}
+
+// Warnf reports a warning in the range and returns it. It is ignored and nil is returned when the
+// warning is disabled.
+func (ws *Warnings) Warnf(code WarningCode, severity Severity, start, end locerr.Pos, format string, args ...interface{}) *Warning {
+	if !ws.Enabled(code) {
+		return nil
+	}
+	w := &Warning{code, severity, start, end, fmt.Sprintf(format, args...), nil}
+	ws.reported = append(ws.reported, w)
+	return w
+}
+
+// List returns reported warnings ordered by their positions.
+func (ws *Warnings) List() []*Warning {
+	if ws == nil {
+		return nil
+	}
+	sort.SliceStable(ws.reported, func(i, j int) bool {
+		return ws.reported[i].Start.Offset < ws.reported[j].Start.Offset
+	})
+	return ws.reported
+}
+
+// AsError converts reported warnings whose severity is SeverityWarning into one error. Warnings
+// with SeverityInfo are not included. It returns nil when no such warning was reported.
+func (ws *Warnings) AsError() *locerr.Error {
+	var err *locerr.Error
+	for _, w := range ws.List() {
+		if w.Severity < SeverityWarning {
+			continue
+		}
+		if err == nil {
+			err = w.ToError()
+			continue
+		}
+		err = err.NotefAt(w.Start, "%s [%s]", w.Message, w.Code.String())
+		for _, n := range w.Notes {
+			err = err.NoteAt(n.Pos, n.Message)
+		}
+	}
+	if err != nil {
+		err = err.Note("Warnings are treated as errors")
+	}
+	return err
+}
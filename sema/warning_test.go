@@ -0,0 +1,343 @@
+package sema
+
+import (
+	"github.com/rhysd/gocaml/syntax"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestWarningCode(t *testing.T) {
+	if s := WarningCode(1).String(); s != "W001" {
+		t.Fatal("Unexpected code string:", s)
+	}
+	c, err := ParseWarningCode("W012")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != 12 {
+		t.Fatal("Unexpected parsed code:", c)
+	}
+	for _, s := range []string{"", "W", "E001", "W0", "Wfoo"} {
+		if _, err := ParseWarningCode(s); err == nil {
+			t.Errorf("Error did not occur for invalid code '%s'", s)
+		}
+	}
+}
+
+func TestWarningsConfigure(t *testing.T) {
+	cases := []struct {
+		spec     string
+		enabled  []WarningCode
+		disabled []WarningCode
+	}{
+		{"", []WarningCode{1, 2}, nil},
+		{"all", []WarningCode{1, 2}, nil},
+		{"none", nil, []WarningCode{1, 2}},
+		{"no-W001", []WarningCode{2}, []WarningCode{1}},
+		{"none,W002", []WarningCode{2}, []WarningCode{1}},
+		{"W002,none", nil, []WarningCode{1, 2}},
+		{"no-W001, W001", []WarningCode{1, 2}, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.spec, func(t *testing.T) {
+			ws := NewWarnings()
+			if err := ws.Configure(tc.spec); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tc.enabled {
+				if !ws.Enabled(c) {
+					t.Error(c, "should be enabled")
+				}
+			}
+			for _, c := range tc.disabled {
+				if ws.Enabled(c) {
+					t.Error(c, "should be disabled")
+				}
+			}
+		})
+	}
+
+	if err := NewWarnings().Configure("all,no-foo"); err == nil {
+		t.Fatal("Invalid specification should cause an error")
+	}
+}
+
+func TestWarningsCollect(t *testing.T) {
+	src := locerr.NewDummySource("let x = 1 in\nlet y = 2 in\n()")
+	pos := func(offset, line, col int) locerr.Pos {
+		return locerr.Pos{offset, line, col, src}
+	}
+
+	ws := NewWarnings()
+	if err := ws.Configure("no-W003"); err != nil {
+		t.Fatal(err)
+	}
+	ws.Warnf(2, SeverityWarning, pos(17, 2, 5), pos(18, 2, 6), "Variable '%s' is unused", "y")
+	ws.Warnf(1, SeverityInfo, pos(4, 1, 5), pos(5, 1, 6), "Variable '%s' is unused", "x")
+	ws.Warnf(3, SeverityWarning, pos(0, 1, 1), pos(1, 1, 2), "Disabled")
+
+	list := ws.List()
+	if len(list) != 2 {
+		t.Fatal("Disabled warning should not be reported:", list)
+	}
+	if list[0].Code != 1 || list[1].Code != 2 {
+		t.Fatal("Warnings should be ordered by position:", list)
+	}
+	if s := list[0].String(); !strings.HasPrefix(s, "Info[W001]: Variable 'x' is unused") {
+		t.Fatal("Unexpected warning message:", s)
+	}
+
+	err := ws.AsError()
+	if err == nil {
+		t.Fatal("Warning should be converted into error")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "Variable 'y' is unused [W002]") || strings.Contains(msg, "'x'") {
+		t.Fatal("Only warnings with SeverityWarning should be errors:", msg)
+	}
+
+	var nilWarnings *Warnings
+	nilWarnings.Warnf(1, SeverityWarning, pos(0, 1, 1), pos(1, 1, 2), "Ignored")
+	if nilWarnings.List() != nil || nilWarnings.AsError() != nil {
+		t.Fatal("Nil collector should discard warnings")
+	}
+}
+
+func TestUnusedWarnings(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{
+			what:     "unused variable",
+			code:     "let x = 1 in ()",
+			expected: []string{"[W001]: Variable 'x' is never used"},
+		},
+		{
+			what:     "unused parameter",
+			code:     "let rec f a b = a in println_int (f 1 2)",
+			expected: []string{"[W002]: Parameter 'b' is never used"},
+		},
+		{
+			what:     "unused function",
+			code:     "let rec f x = x in ()",
+			expected: []string{"[W001]: Variable 'f' is never used"},
+		},
+		{
+			what:     "unused element of tuple",
+			code:     "let (a, b) = (1, 2) in println_int a",
+			expected: []string{"[W001]: Variable 'b' is never used"},
+		},
+		{
+			what:     "unused parameter of lambda",
+			code:     "let f = fun x y -> y in println_int (f 1 2)",
+			expected: []string{"[W002]: Parameter 'x' is never used"},
+		},
+		{
+			what:     "shadowed variable is unused",
+			code:     "let x = 1 in let x = 2 in println_int x",
+			expected: []string{"[W001]: Variable 'x' is never used"},
+		},
+		{
+			what:     "underscore prefixed names",
+			code:     "let _x = 1 in let rec f _a = () in f 1",
+			expected: nil,
+		},
+		{
+			what:     "used in recursive call",
+			code:     "let rec f n = if n = 0 then () else f (n - 1) in f 3",
+			expected: nil,
+		},
+		{
+			what:     "derived functions",
+			code:     "type t = int [@@deriving show, eq]; ()",
+			expected: nil,
+		},
+		{
+			what:     "for loop",
+			code:     "for i = 0 to 3 do () done; for _j = 0 to 3 do () done",
+			expected: []string{"[W001]: Variable 'i' is never used"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := NewWarnings()
+			if err := ws.Configure("none,W001,W002"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+				t.Fatal(err)
+			}
+			list := ws.List()
+			if len(list) != len(tc.expected) {
+				t.Fatalf("Expected %d warnings but got %v", len(tc.expected), list)
+			}
+			for i, w := range list {
+				if !strings.Contains(w.String(), tc.expected[i]) {
+					t.Errorf("Warning '%s' does not contain '%s'", w.String(), tc.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUnusedWarningsDisabled(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("let x = 1 in let rec f a = () in f 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWarnings()
+	if err := ws.Configure("no-W001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+		t.Fatal(err)
+	}
+	list := ws.List()
+	if len(list) != 1 || list[0].Code != WarnUnusedParameter {
+		t.Fatal("Only unused parameter should be reported:", list)
+	}
+}
+
+func TestShadowingWarnings(t *testing.T) {
+	cases := []struct {
+		what     string
+		code     string
+		expected []string
+	}{
+		{
+			what:     "let shadows let",
+			code:     "let x = 1 in let x = x + 1 in println_int x",
+			expected: []string{"Variable 'x' shadows the variable declared before"},
+		},
+		{
+			what:     "parameter shadows let",
+			code:     "let x = 1 in let rec f x = x in println_int (f x)",
+			expected: []string{"Variable 'x' shadows the variable declared before"},
+		},
+		{
+			what:     "function shadows parameter",
+			code:     "let rec f g = let rec g x = x in g 1 in println_int (f 1)",
+			expected: []string{"Variable 'g' shadows the variable declared before"},
+		},
+		{
+			what:     "tuple element shadows let",
+			code:     "let a = 1 in let (a, b) = (a, 2) in println_int (a + b)",
+			expected: []string{"Variable 'a' shadows the variable declared before"},
+		},
+		{
+			what:     "nested for loops",
+			code:     "for i = 0 to 1 do for i = 0 to 1 do println_int i done done",
+			expected: []string{"Variable 'i' shadows the variable declared before"},
+		},
+		{
+			what:     "variables in different scopes",
+			code:     "let rec f x = x in let rec g x = x in println_int (f (g 1))",
+			expected: nil,
+		},
+		{
+			what:     "underscore prefixed name",
+			code:     "let _x = 1 in let _x = 2 in ()",
+			expected: nil,
+		},
+		{
+			what:     "derived function",
+			code:     "type t = int [@@deriving show]; let rec show_t x = x in println_int (show_t 1)",
+			expected: nil,
+		},
+		{
+			what:     "match arm",
+			code:     "let x = 1 in match Some x with Some x -> println_int x | None -> ()",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			parsed, err := syntax.Parse(locerr.NewDummySource(tc.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := NewWarnings()
+			if err := ws.Configure("none,W003"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+				t.Fatal(err)
+			}
+			list := ws.List()
+			if len(list) != len(tc.expected) {
+				t.Fatalf("Expected %d warnings but got %v", len(tc.expected), list)
+			}
+			for i, w := range list {
+				if !strings.Contains(w.String(), tc.expected[i]) {
+					t.Errorf("Warning '%s' does not contain '%s'", w.String(), tc.expected[i])
+				}
+				if len(w.Notes) != 1 || !strings.Contains(w.Notes[0].Message, "is declared here") {
+					t.Errorf("Warning should have a note for shadowed variable: %v", w.Notes)
+				}
+			}
+		})
+	}
+}
+
+func TestShadowingWarningNote(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("let x = 1 in\nlet x = 2 in\nprintln_int x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWarnings()
+	if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+		t.Fatal(err)
+	}
+	var found *Warning
+	for _, w := range ws.List() {
+		if w.Code == WarnShadowing {
+			found = w
+		}
+	}
+	if found == nil {
+		t.Fatal("Shadowing was not reported:", ws.List())
+	}
+	if found.Start.Line != 2 {
+		t.Error("Warning should be reported at shadowing variable but got line", found.Start.Line)
+	}
+	if found.Notes[0].Pos.Line != 1 {
+		t.Error("Note should point shadowed variable but got line", found.Notes[0].Pos.Line)
+	}
+	if err := ws.AsError(); err == nil || !strings.Contains(err.Error(), "Shadowed variable 'x' is declared here") {
+		t.Fatal("Note should be included in error:", err)
+	}
+}
+
+func TestParameterWarningPosition(t *testing.T) {
+	parsed, err := syntax.Parse(locerr.NewDummySource("let x = 1 in\nlet rec f a x = a in\nprintln_int (f x 2)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWarnings()
+	if _, _, err := AnalyzeWithOptions(parsed, Options{false, ws, false, false, false}); err != nil {
+		t.Fatal(err)
+	}
+	codes := map[WarningCode]bool{}
+	for _, w := range ws.List() {
+		if w.Code != WarnUnusedParameter && w.Code != WarnShadowing {
+			continue
+		}
+		codes[w.Code] = true
+		if w.Start.Line != 2 || w.Start.Column != 13 || w.End.Column != 14 {
+			t.Errorf("Warning should be reported at parameter 'x' (2:13) but got %d:%d-%d: %s", w.Start.Line, w.Start.Column, w.End.Column, w.Message)
+		}
+	}
+	if !codes[WarnUnusedParameter] || !codes[WarnShadowing] {
+		t.Fatal("Unused parameter and shadowing were not reported:", ws.List())
+	}
+}
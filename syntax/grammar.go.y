@@ -23,6 +23,13 @@ import (
 	decl *ast.Symbol
 	params []ast.Param
 	program *ast.AST
+	arms []*ast.VariantArm
+	arm *ast.VariantArm
+	typevars []*ast.TypeVar
+	tokens []*token.Token
+	tagtypes []*ast.VariantTagType
+	tagtype *ast.VariantTagType
+	typedecls []*ast.TypeDecl
 }
 
 %token<token> ILLEGAL
@@ -78,6 +85,24 @@ import (
 %token<token> LBRACKET
 %token<token> RBRACKET
 %token<token> EXTERNAL
+%token<token> VARIANT_TAG
+%token<token> FORALL
+%token<token> TYPE_VAR
+%token<token> HOLE
+%token<token> OF
+%token<token> LBRACKET_AT_AT
+%token<token> OK
+%token<token> ERROR
+%token<token> AND
+%token<token> FOR
+%token<token> TO
+%token<token> DOWNTO
+%token<token> DO
+%token<token> DONE
+%token<token> BREAK
+%token<token> CONTINUE
+%token<token> ASSERT
+%token<token> MODULE_IDENT
 
 %nonassoc IN
 %right prec_let
@@ -100,7 +125,7 @@ import (
 %left prec_app
 %left DOT
 %nonassoc prec_below_ident
-%nonassoc IDENT
+%nonassoc IDENT LPAREN BOOL INT FLOAT STRING_LITERAL LBRACKET_BAR LBRACKET NONE VARIANT_TAG HOLE BREAK CONTINUE MODULE_IDENT
 
 %type<node> exp
 %type<node> simple_exp
@@ -113,7 +138,12 @@ import (
 %type<token> match_arm_start
 %type<decl> match_ident
 %type<nodes> semi_elems
+%type<arms> variant_arms
+%type<arm> variant_arm
 %type<node> type_annotation
+%type<node> param_type
+%type<node> external_type
+%type<typevars> type_vars
 %type<node> simple_type_annotation
 %type<node> type
 %type<node> simple_type
@@ -121,6 +151,11 @@ import (
 %type<nodes> arrow_types
 %type<nodes> simple_type_star_list
 %type<nodes> type_comma_list
+%type<tagtypes> variant_tag_types
+%type<tagtype> variant_tag_type
+%type<typedecls> type_decls
+%type<tokens> deriving
+%type<tokens> ident_comma_list
 %type<program> toplevels
 %type<> opt_semi
 %type<> program
@@ -134,20 +169,26 @@ program:
 		{
 			tree := $1
 			tree.Root = $2
-			yylex.(*pseudoLexer).result = tree
+			yylex.(*pseudoLexer).setResult(tree)
+		}
+	| toplevels LET IDENT params type_annotation EQUAL seq_exp
+		{
+			tree := $1
+			l := yylex.(*pseudoLexer)
+			tree.Root = l.entryPoint($2, $3, $4, $5, $7)
+			l.setResult(tree)
 		}
 
 toplevels:
 	/* empty */
 		{ $$ = &ast.AST{} }
-	| toplevels TYPE IDENT EQUAL type SEMICOLON
+	| toplevels type_decls SEMICOLON
 		{
-			decl := &ast.TypeDecl{$2, ast.NewSymbol($3.Value()), $5}
 			tree := $1
-			tree.TypeDecls = append(tree.TypeDecls, decl)
+			tree.TypeDecls = append(tree.TypeDecls, $2...)
 			$$ = tree
 		}
-	| toplevels EXTERNAL IDENT COLON type EQUAL STRING_LITERAL SEMICOLON
+	| toplevels EXTERNAL IDENT COLON external_type EQUAL STRING_LITERAL SEMICOLON
 		{
 			from := $7.Value()
 			lit, err := strconv.Unquote(from)
@@ -161,6 +202,34 @@ toplevels:
 			}
 		}
 
+type_decls:
+	TYPE IDENT EQUAL type deriving
+		{ $$ = []*ast.TypeDecl{&ast.TypeDecl{$1, ast.NewSymbol($2.Value()), $4, $5}} }
+	| type_decls AND IDENT EQUAL type deriving
+		{ $$ = append($1, &ast.TypeDecl{$2, ast.NewSymbol($3.Value()), $5, $6}) }
+
+deriving:
+	/* empty */
+		{ $$ = nil }
+	| LBRACKET_AT_AT IDENT ident_comma_list RBRACKET
+		{
+			if $2.Value() != "deriving" {
+				yylex.Error(fmt.Sprintf("Unknown attribute '%s'. Only 'deriving' is supported", $2.Value()))
+			}
+			for _, t := range $3 {
+				if n := t.Value(); n != "show" && n != "eq" {
+					yylex.Error(fmt.Sprintf("Unknown deriving '%s'. Only 'show' and 'eq' can be derived", n))
+				}
+			}
+			$$ = $3
+		}
+
+ident_comma_list:
+	IDENT
+		{ $$ = []*token.Token{$1} }
+	| ident_comma_list COMMA IDENT
+		{ $$ = append($1, $3) }
+
 seq_exp:
 	exp %prec prec_seq
 		{ $$ = $1 }
@@ -205,6 +274,10 @@ exp:
 	| IF seq_exp THEN seq_exp ELSE exp
 		%prec prec_if
 		{ $$ = &ast.If{$1, $2, $4, $6} }
+	| FOR IDENT EQUAL seq_exp TO seq_exp DO seq_exp DONE
+		{ $$ = yylex.(*pseudoLexer).desugarFor($1, $9, sym($2), $4, $6, $8, false) }
+	| FOR IDENT EQUAL seq_exp DOWNTO seq_exp DO seq_exp DONE
+		{ $$ = yylex.(*pseudoLexer).desugarFor($1, $9, sym($2), $4, $6, $8, true) }
 	| MATCH seq_exp match_arm_start SOME match_ident MINUS_GREATER seq_exp BAR NONE MINUS_GREATER exp
 		%prec prec_match
 		{
@@ -217,6 +290,21 @@ exp:
 			some := $11
 			$$ = &ast.Match{$1, $2, some, $6, $9, some.Pos()}
 		}
+	| MATCH seq_exp match_arm_start OK match_ident MINUS_GREATER seq_exp BAR ERROR match_ident MINUS_GREATER exp
+		%prec prec_match
+		{
+			err := $12
+			$$ = &ast.MatchResult{$1, $2, $7, err, $5, $10, err.Pos()}
+		}
+	| MATCH seq_exp match_arm_start ERROR match_ident MINUS_GREATER seq_exp BAR OK match_ident MINUS_GREATER exp
+		%prec prec_match
+		{
+			ok := $12
+			$$ = &ast.MatchResult{$1, $2, ok, $7, $10, $5, ok.Pos()}
+		}
+	| MATCH seq_exp match_arm_start variant_arms
+		%prec prec_match
+		{ $$ = &ast.MatchVariant{$1, $2, $4} }
 	| MINUS_DOT exp
 		%prec prec_unary_minus
 		{ $$ = &ast.FNeg{$1, $2} }
@@ -234,6 +322,19 @@ exp:
 	| LET REC fundef IN seq_exp
 		%prec prec_let
 		{ $$ = &ast.LetRec{$1, $3, $5} }
+	| LET REC IDENT EQUAL seq_exp IN seq_exp
+		%prec prec_let
+		{
+			if def := lambdaDef($5); def != nil {
+				// 'let rec f = fun x -> ...' is desugared into 'let rec f x = ...'
+				$$ = &ast.LetRec{$1, &ast.FuncDef{ast.NewSymbol($3.Value()), def.Params, def.Body, def.RetType, nil}, $7}
+			} else {
+				l := yylex.(*pseudoLexer)
+				ident := &ast.VarRef{$3, sym($3)}
+				l.errorIn(ident, fmt.Sprintf("'let rec' can only define functions with parameters like 'let rec %s x = ...' but '%s' has no parameter. Recursive value which is not a function is not permitted", $3.Value(), $3.Value()))
+				$$ = &ast.Let{$1, sym($3), $5, $7, nil}
+			}
+		}
 	| simple_exp args
 		%prec prec_app
 		{ $$ = &ast.Apply{$1, $2} }
@@ -252,12 +353,20 @@ exp:
 		{ $$ = &ast.ArraySize{$1, $2} }
 	| SOME simple_exp
 		{ $$ = &ast.Some{$1, $2} }
+	| ASSERT simple_exp
+		{ $$ = &ast.Assert{$1, $2} }
+	| OK simple_exp
+		{ $$ = &ast.Ok{$1, $2} }
+	| ERROR simple_exp
+		{ $$ = &ast.Error{$1, $2} }
+	| VARIANT_TAG simple_exp
+		{ $$ = &ast.Variant{$1, variantTag($1), $2} }
 	| FUN params simple_type_annotation MINUS_GREATER seq_exp
 		%prec prec_fun
 		{
 			t := $1
 			ident := ast.NewSymbol(fmt.Sprintf("lambda.line%d.col%d", t.Start.Line, t.Start.Column))
-			def := &ast.FuncDef{ident, $2, $5, $3}
+			def := &ast.FuncDef{ident, $2, $5, $3, nil}
 			ref := &ast.VarRef{$1, ident}
 			$$ = &ast.LetRec{$1, def, ref}
 		}
@@ -269,18 +378,47 @@ exp:
 
 fundef:
 	IDENT params type_annotation EQUAL seq_exp
-		{ $$ = &ast.FuncDef{ast.NewSymbol($1.Value()), $2, $5, $3} }
+		{ $$ = &ast.FuncDef{ast.NewSymbol($1.Value()), $2, $5, $3, nil} }
+	| IDENT COLON type_vars DOT type EQUAL FUN params simple_type_annotation MINUS_GREATER seq_exp
+		{
+			vars := $3
+			poly := &ast.ForallType{vars[0].Token, vars, $5}
+			$$ = &ast.FuncDef{ast.NewSymbol($1.Value()), $8, $11, $9, poly}
+		}
 
 params:
 	IDENT
 		{ $$ = []ast.Param{{sym($1), nil}} }
-	| LPAREN IDENT COLON type RPAREN
+	| LPAREN IDENT COLON param_type RPAREN
 		{ $$ = []ast.Param{{sym($2), $4}} }
 	| params IDENT
 		{ $$ = append($1, ast.Param{sym($2), nil}) }
-	| params LPAREN IDENT COLON type RPAREN
+	| params LPAREN IDENT COLON param_type RPAREN
 		{ $$ = append($1, ast.Param{sym($3), $5}) }
 
+param_type:
+	type
+		{ $$ = $1 }
+	| FORALL type_vars DOT type
+		{ $$ = &ast.ForallType{$1, $2, $4} }
+
+external_type:
+	type
+		{ $$ = $1 }
+	| type_vars DOT type
+		{
+			vars := $1
+			$$ = &ast.ForallType{vars[0].Token, vars, $3}
+		}
+	| FORALL type_vars DOT type
+		{ $$ = &ast.ForallType{$1, $2, $4} }
+
+type_vars:
+	TYPE_VAR
+		{ $$ = []*ast.TypeVar{typeVar($1)} }
+	| type_vars TYPE_VAR
+		{ $$ = append($1, typeVar($2)) }
+
 args:
 	args simple_exp
 		{ $$ = append($1, $2) }
@@ -351,8 +489,19 @@ simple_exp:
 		{ yylex.Error("List literal is not implemented yet. Please use array literal [| e1; e2; ... |] instead") }
 	| NONE
 		{ $$ = &ast.None{$1} }
+	| VARIANT_TAG
+		%prec prec_below_ident
+		{ $$ = &ast.Variant{$1, variantTag($1), nil} }
 	| IDENT
 		{ $$ = &ast.VarRef{$1, ast.NewSymbol($1.Value())} }
+	| MODULE_IDENT
+		{ $$ = &ast.VarRef{$1, ast.NewSymbol($1.Value())} }
+	| HOLE
+		{ $$ = &ast.Hole{$1, $1.Value()[1:], nil} }
+	| BREAK
+		{ $$ = &ast.Break{$1, nil} }
+	| CONTINUE
+		{ $$ = &ast.Continue{$1, nil} }
 	| simple_exp DOT LPAREN exp RPAREN
 		{ $$ = &ast.ArrayGet{$1, $4} }
 
@@ -365,6 +514,23 @@ match_ident:
 	| IDENT
 		{ $$ = ast.NewSymbol($1.Value()) }
 
+variant_arms:
+	variant_arm
+		{ $$ = []*ast.VariantArm{$1} }
+	| variant_arms BAR variant_arm
+		{ $$ = append($1, $3) }
+
+variant_arm:
+	VARIANT_TAG MINUS_GREATER exp
+		%prec prec_match
+		{ $$ = &ast.VariantArm{$1, variantTag($1), nil, $3} }
+	| VARIANT_TAG match_ident MINUS_GREATER exp
+		%prec prec_match
+		{ $$ = &ast.VariantArm{$1, variantTag($1), $2, $4} }
+	| IDENT MINUS_GREATER exp
+		%prec prec_match
+		{ $$ = &ast.VariantArm{$1, "", sym($1), $3} }
+
 semi_elems:
 	exp %prec prec_seq
 		{ $$ = []ast.Expr{$1} }
@@ -419,6 +585,8 @@ simple_type:
 			t := $1
 			$$ = &ast.CtorType{nil, t, nil, ast.NewSymbol(t.Value())}
 		}
+	| TYPE_VAR
+		{ $$ = typeVar($1) }
 	| simple_type IDENT
 		{
 			t := $2
@@ -429,6 +597,8 @@ simple_type:
 			t := $4
 			$$ = &ast.CtorType{$1, t, $2, ast.NewSymbol(t.Value())}
 		}
+	| LBRACKET variant_tag_types RBRACKET
+		{ $$ = &ast.VariantType{$1, $3, $2} }
 	| LPAREN type_comma_list RPAREN
 		%prec prec_below_ident
 		{
@@ -440,6 +610,18 @@ simple_type:
 			}
 		}
 
+variant_tag_types:
+	variant_tag_type
+		{ $$ = []*ast.VariantTagType{$1} }
+	| variant_tag_types BAR variant_tag_type
+		{ $$ = append($1, $3) }
+
+variant_tag_type:
+	VARIANT_TAG
+		{ $$ = &ast.VariantTagType{$1, variantTag($1), nil} }
+	| VARIANT_TAG OF simple_type_or_tuple
+		{ $$ = &ast.VariantTagType{$1, variantTag($1), $3} }
+
 type_comma_list:
 	type
 		{ $$ = []ast.Expr{$1} }
@@ -449,12 +631,36 @@ type_comma_list:
 %%
 
 func sym(tok *token.Token) *ast.Symbol {
-	s := tok.Value()
-	if s == "_" {
-		return ast.IgnoredSymbol()
+	var s *ast.Symbol
+	if tok.Value() == "_" {
+		s = ast.IgnoredSymbol()
 	} else {
-		return ast.NewSymbol(s)
+		s = ast.NewSymbol(tok.Value())
+	}
+	s.Token = tok
+	return s
+}
+
+// lambdaDef returns the function definition when the expression is a lambda. Lambda is desugared
+// into 'let rec' which defines the function and returns a reference to it while parsing.
+func lambdaDef(e ast.Expr) *ast.FuncDef {
+	l, ok := e.(*ast.LetRec)
+	if !ok || l.LetToken.Kind != token.FUN {
+		return nil
 	}
+	if ref, ok := l.Body.(*ast.VarRef); !ok || ref.Symbol != l.Func.Symbol {
+		return nil
+	}
+	return l.Func
+}
+
+// Strip '`' from the token of polymorphic variant tag
+func variantTag(tok *token.Token) string {
+	return tok.Value()[1:]
+}
+
+func typeVar(tok *token.Token) *ast.TypeVar {
+	return &ast.TypeVar{tok, ast.NewSymbol(tok.Value())}
 }
 
 // vim: noet
@@ -99,12 +99,38 @@ func (l *Lexer) emitIdent(ident string) {
 		l.emit(token.SOME)
 	case "None":
 		l.emit(token.NONE)
+	case "Ok":
+		l.emit(token.OK)
+	case "Error":
+		l.emit(token.ERROR)
+	case "and":
+		l.emit(token.AND)
+	case "for":
+		l.emit(token.FOR)
+	case "to":
+		l.emit(token.TO)
+	case "downto":
+		l.emit(token.DOWNTO)
+	case "do":
+		l.emit(token.DO)
+	case "done":
+		l.emit(token.DONE)
+	case "break":
+		l.emit(token.BREAK)
+	case "continue":
+		l.emit(token.CONTINUE)
+	case "assert":
+		l.emit(token.ASSERT)
 	case "fun":
 		l.emit(token.FUN)
 	case "type":
 		l.emit(token.TYPE)
 	case "external":
 		l.emit(token.EXTERNAL)
+	case "forall":
+		l.emit(token.FORALL)
+	case "of":
+		l.emit(token.OF)
 	default:
 		l.emit(token.IDENT)
 	}
@@ -409,6 +435,27 @@ func lexArrayCreate(l *Lexer) stateFn {
 	}
 }
 
+// modules is a set of modules of the standard library. Members of them are referred with qualified
+// names such as 'String.length'. They are defined as builtins (please see types/builtins.go) except
+// for primitives of 'Table' (please see sema/table.go).
+var modules = map[string]struct{}{
+	"Buffer": {},
+	"Json":   {},
+	"Re":     {},
+	"String": {},
+	"Table":  {},
+}
+
+// e.g. String.length
+func lexModuleIdent(l *Lexer) stateFn {
+	l.eat() // Eat '.'
+	if !l.eatIdent() {
+		return nil
+	}
+	l.emit(token.MODULE_IDENT)
+	return lex
+}
+
 func lexIdent(l *Lexer) stateFn {
 	if !l.eatIdent() {
 		return nil
@@ -417,6 +464,12 @@ func lexIdent(l *Lexer) stateFn {
 	if i == "Array" {
 		return lexArrayCreate
 	}
+	if _, ok := modules[i]; ok && l.top == '.' {
+		// 'String.(0)' is an access to array bound to variable 'String'
+		if next, _ := utf8.DecodeRune(l.src.Code[l.current.Offset+1:]); isLetter(next) {
+			return lexModuleIdent
+		}
+	}
 	l.emitIdent(i)
 	return lex
 }
@@ -445,12 +498,49 @@ func lexLbracket(l *Lexer) stateFn {
 	if l.top == '|' {
 		l.eat()
 		l.emit(token.LBRACKET_BAR)
+	} else if l.top == '@' {
+		// Attribute such as [@@deriving show]
+		l.eat()
+		if l.top != '@' {
+			l.expected("'@' for attribute '[@@'", l.top)
+			return nil
+		}
+		l.eat()
+		l.emit(token.LBRACKET_AT_AT)
 	} else {
 		l.emit(token.LBRACKET)
 	}
 	return lex
 }
 
+// e.g. `Foo
+func lexVariantTag(l *Lexer) stateFn {
+	l.eat() // Eat '`'
+	if !l.eatIdent() {
+		return nil
+	}
+	l.emit(token.VARIANT_TAG)
+	return lex
+}
+
+func lexTypeVar(l *Lexer) stateFn {
+	l.eat() // Eat '\''
+	if !l.eatIdent() {
+		return nil
+	}
+	l.emit(token.TYPE_VAR)
+	return lex
+}
+
+func lexHole(l *Lexer) stateFn {
+	l.eat() // Eat '?'
+	if !l.eatIdent() {
+		return nil
+	}
+	l.emit(token.HOLE)
+	return lex
+}
+
 func lex(l *Lexer) stateFn {
 	for {
 		if l.eof {
@@ -504,6 +594,12 @@ func lex(l *Lexer) stateFn {
 		case ']':
 			l.eat()
 			l.emit(token.RBRACKET)
+		case '`':
+			return lexVariantTag
+		case '\'':
+			return lexTypeVar
+		case '?':
+			return lexHole
 		default:
 			switch {
 			case unicode.IsSpace(l.top):
@@ -111,3 +111,38 @@ func TestLexingIllegal(t *testing.T) {
 		})
 	}
 }
+
+func TestLexingModuleIdent(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		want []token.Kind
+	}{
+		{"String.length s", []token.Kind{token.MODULE_IDENT, token.IDENT}},
+		{"String.of_int", []token.Kind{token.MODULE_IDENT}},
+		{"Table.find t k", []token.Kind{token.MODULE_IDENT, token.IDENT, token.IDENT}},
+		{"Buffer.add_char b 97", []token.Kind{token.MODULE_IDENT, token.IDENT, token.INT}},
+		{"Json.of_int 1", []token.Kind{token.MODULE_IDENT, token.INT}},
+		{"Re.match p s", []token.Kind{token.MODULE_IDENT, token.IDENT, token.IDENT}},
+		{"String.(0)", []token.Kind{token.IDENT, token.DOT, token.LPAREN, token.INT, token.RPAREN}},
+		{"String", []token.Kind{token.IDENT}},
+		{"Strings.length", []token.Kind{token.IDENT, token.DOT, token.IDENT}},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			l := NewLexer(locerr.NewDummySource(tc.code))
+			go l.Lex()
+			have := []token.Kind{}
+			for tok := range l.Tokens {
+				if tok.Kind == token.EOF {
+					break
+				}
+				if tok.Kind == token.MODULE_IDENT && tok.Value() != tc.code[:len(tok.Value())] {
+					t.Errorf("Unexpected qualified name: %s", tok.Value())
+				}
+				have = append(have, tok.Kind)
+			}
+			if fmt.Sprint(have) != fmt.Sprint(tc.want) {
+				t.Fatalf("Wanted tokens %v but got %v", tc.want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package syntax
+
+import (
+	"fmt"
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/gocaml/token"
+)
+
+// Note:
+// 'for' loop is desugared into a tail recursive function while parsing. The self tail call is
+// optimized into a jump so the loop does not consume stack.
+//   for i = a to b do body done
+//
+//   let $from1 = a in
+//   let $to1 = b in
+//   let rec $loop1 $i1 =
+//     if $i1 <= $to1 then
+//       (let i = $i1 in body);
+//       if $i1 = $to1 then () else $loop1 ($i1 + 1)
+//     else () in
+//   $loop1 $from1
+//
+// The counter is compared with the bound before incremented so that it never overflows even if the
+// bound is max_int ('min_int' for 'downto').
+//
+// When the body contains 'break' or 'continue', the loop function takes one more parameter which
+// stops the loop.
+//   let rec $loop1 $i1 $stop1 =
+//     if $stop1 then () else
+//     if $i1 <= $to1 then
+//       (let i = $i1 in body);
+//       if $i1 = $to1 then () else $loop1 ($i1 + 1) false
+//     else () in
+//   $loop1 $from1 false
+//
+// 'break' and 'continue' in the body are desugared into jumps to the beginning of the loop function
+// (ast.LoopJump). They can appear at any position in the body and are lowered into 'jump'
+// instructions in MIR.
+//   break     -> jump $i1 true
+//   continue  -> if $i1 = $to1 then jump $i1 true else jump ($i1 + 1) false
+// They cannot jump out of functions defined in the body.
+// Generated names contain '$' so that they never conflict with names in the body.
+
+type loopDesugarer struct {
+	lexer   *pseudoLexer
+	start   *token.Token
+	end     *token.Token
+	loop    string
+	counter string
+	to      string
+	stop    string
+	down    bool
+	jumps   bool
+}
+
+func (d *loopDesugarer) ref(tok *token.Token, name string) ast.Expr {
+	return &ast.VarRef{tok, ast.NewSymbol(name)}
+}
+
+// step generates the counter for the next iteration.
+func (d *loopDesugarer) step(tok *token.Token) ast.Expr {
+	i := d.ref(tok, d.counter)
+	one := &ast.Int{tok, 1}
+	if d.down {
+		return &ast.Sub{i, one}
+	}
+	return &ast.Add{i, one}
+}
+
+// last generates the condition which is true at the last iteration.
+func (d *loopDesugarer) last(tok *token.Token) ast.Expr {
+	return &ast.Eq{d.ref(tok, d.counter), d.ref(tok, d.to)}
+}
+
+// args generates the arguments of the loop function. The stop flag is passed only when the loop
+// function takes it.
+func (d *loopDesugarer) args(tok *token.Token, counter ast.Expr, stop bool) []ast.Expr {
+	if !d.jumps {
+		return []ast.Expr{counter}
+	}
+	return []ast.Expr{counter, &ast.Bool{tok, stop}}
+}
+
+func (d *loopDesugarer) breakJump(tok *token.Token) ast.Expr {
+	return &ast.LoopJump{tok, d.args(tok, d.ref(tok, d.counter), true)}
+}
+
+func (d *loopDesugarer) continueJump(tok *token.Token) ast.Expr {
+	next := &ast.LoopJump{tok, d.args(tok, d.step(tok), false)}
+	return &ast.If{tok, d.last(tok), d.breakJump(tok), next}
+}
+
+// VisitTopdown binds 'break' and 'continue' in the loop body to the loop. Jumps in nested loops were
+// already bound by them. Jumps in functions defined in the body cannot jump out of the functions.
+func (d *loopDesugarer) VisitTopdown(e ast.Expr) ast.Visitor {
+	switch e := e.(type) {
+	case *ast.Break:
+		if e.Jump == nil {
+			d.jumps = true
+			e.Jump = d.breakJump(e.Token)
+		}
+		return nil
+	case *ast.Continue:
+		if e.Jump == nil {
+			d.jumps = true
+			e.Jump = d.continueJump(e.Token)
+		}
+		return nil
+	case *ast.LetRec:
+		if j := findLoopJump(e.Func.Body); j != nil {
+			d.lexer.errorIn(j, fmt.Sprintf("'%s' cannot jump out of function defined in body of 'for' loop", jumpName(j)))
+		}
+		ast.Visit(d, e.Body)
+		return nil
+	}
+	return d
+}
+
+func (d *loopDesugarer) VisitBottomup(ast.Expr) {}
+
+type loopJumpFinder struct {
+	found ast.Expr
+}
+
+func (f *loopJumpFinder) VisitTopdown(e ast.Expr) ast.Visitor {
+	if f.found != nil {
+		return nil
+	}
+	switch e := e.(type) {
+	case *ast.Break:
+		if e.Jump == nil {
+			f.found = e
+		}
+		return nil
+	case *ast.Continue:
+		if e.Jump == nil {
+			f.found = e
+		}
+		return nil
+	}
+	return f
+}
+
+func (f *loopJumpFinder) VisitBottomup(ast.Expr) {}
+
+// findLoopJump returns the first 'break' or 'continue' in the expression which is not bound to any
+// loop. It returns nil when there is no such expression.
+func findLoopJump(e ast.Expr) ast.Expr {
+	f := &loopJumpFinder{}
+	ast.Visit(f, e)
+	return f.found
+}
+
+func jumpName(e ast.Expr) string {
+	if _, ok := e.(*ast.Break); ok {
+		return "break"
+	}
+	return "continue"
+}
+
+// desugarFor desugars 'for' loop expression into a tail recursive function.
+func (l *pseudoLexer) desugarFor(start, end *token.Token, ident *ast.Symbol, from, to, body ast.Expr, down bool) ast.Expr {
+	l.loops++
+	id := l.loops
+	d := &loopDesugarer{
+		lexer:   l,
+		start:   start,
+		end:     end,
+		loop:    fmt.Sprintf("$loop%d", id),
+		counter: fmt.Sprintf("$i%d", id),
+		to:      fmt.Sprintf("$to%d", id),
+		stop:    fmt.Sprintf("$stop%d", id),
+		down:    down,
+	}
+	fromName := fmt.Sprintf("$from%d", id)
+
+	ast.Visit(d, body)
+
+	i := d.ref(start, d.counter)
+	bound := d.ref(start, d.to)
+	var cond ast.Expr
+	if down {
+		cond = &ast.GreaterEq{i, bound}
+	} else {
+		cond = &ast.LessEq{i, bound}
+	}
+	iter := &ast.Let{start, ident, d.ref(start, d.counter), body, nil}
+	next := &ast.Apply{d.ref(end, d.loop), d.args(end, d.step(end), false)}
+	rest := &ast.If{end, d.last(end), &ast.Unit{end, end}, next}
+	var funBody ast.Expr = &ast.If{start, cond, &ast.Let{start, ast.IgnoredSymbol(), iter, rest, nil}, &ast.Unit{end, end}}
+
+	params := []ast.Param{{ast.NewSymbol(d.counter), nil}}
+	if d.jumps {
+		params = append(params, ast.Param{ast.NewSymbol(d.stop), nil})
+		funBody = &ast.If{start, d.ref(start, d.stop), &ast.Unit{end, end}, funBody}
+	}
+	fun := &ast.FuncDef{ast.NewSymbol(d.loop), params, funBody, nil, nil}
+	loop := &ast.LetRec{start, fun, &ast.Apply{d.ref(end, d.loop), d.args(end, d.ref(end, fromName), false)}}
+	return &ast.Let{start, ast.NewSymbol(fromName), from, &ast.Let{start, ast.NewSymbol(d.to), to, loop, nil}, nil}
+}
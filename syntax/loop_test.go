@@ -0,0 +1,149 @@
+package syntax
+
+import (
+	"github.com/rhysd/gocaml/ast"
+	"github.com/rhysd/locerr"
+	"strings"
+	"testing"
+)
+
+func TestDesugarForLoop(t *testing.T) {
+	s := locerr.NewDummySource("for i = 0 to 9 do if i = 5 then break else if i = 3 then continue else println_int i done")
+	parsed, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, ok := parsed.Root.(*ast.Let)
+	if !ok || from.Symbol.DisplayName != "$from1" {
+		t.Fatal("Lower bound is not bound:", parsed.Root.Name())
+	}
+	to, ok := from.Body.(*ast.Let)
+	if !ok || to.Symbol.DisplayName != "$to1" {
+		t.Fatal("Upper bound is not bound:", from.Body.Name())
+	}
+	loop, ok := to.Body.(*ast.LetRec)
+	if !ok || loop.Func.Symbol.DisplayName != "$loop1" {
+		t.Fatal("Loop function is not defined:", to.Body.Name())
+	}
+	if len(loop.Func.Params) != 2 || loop.Func.Params[1].Ident.DisplayName != "$stop1" {
+		t.Fatal("Loop function should take stop flag since the body contains jumps:", loop.Func.Params)
+	}
+	stop := loop.Func.Body.(*ast.If)
+	if ref, ok := stop.Cond.(*ast.VarRef); !ok || ref.Symbol.DisplayName != "$stop1" {
+		t.Fatal("Stop flag should be checked at first but got", stop.Cond.Name())
+	}
+	if _, ok := stop.Else.(*ast.If).Cond.(*ast.LessEq); !ok {
+		t.Fatal("Condition of loop should be '<=' but got", stop.Else.(*ast.If).Cond.Name())
+	}
+	if j := findLoopJump(parsed.Root); j != nil {
+		t.Fatal("'break' or 'continue' is not bound to loop:", j.Name())
+	}
+}
+
+func TestDesugarForLoopDownto(t *testing.T) {
+	s := locerr.NewDummySource("for i = 9 downto 0 do println_int i done")
+	parsed, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop := parsed.Root.(*ast.Let).Body.(*ast.Let).Body.(*ast.LetRec)
+	if len(loop.Func.Params) != 1 {
+		t.Fatal("Loop function should take only counter but got", loop.Func.Params)
+	}
+	body := loop.Func.Body.(*ast.If)
+	if _, ok := body.Cond.(*ast.GreaterEq); !ok {
+		t.Fatal("Condition of loop should be '>=' but got", body.Cond.Name())
+	}
+	rest := body.Then.(*ast.Let).Body.(*ast.If)
+	if _, ok := rest.Cond.(*ast.Eq); !ok {
+		t.Fatal("Counter should be compared with bound before decremented but got", rest.Cond.Name())
+	}
+	next := rest.Else.(*ast.Apply)
+	if _, ok := next.Args[0].(*ast.Sub); !ok {
+		t.Fatal("Counter should be decremented but got", next.Args[0].Name())
+	}
+}
+
+type jumpCollector struct {
+	jumps map[string]*ast.LoopJump
+}
+
+func (c *jumpCollector) VisitTopdown(e ast.Expr) ast.Visitor {
+	switch e := e.(type) {
+	case *ast.Break:
+		c.jumps["break"] = e.Jump.(*ast.LoopJump)
+	case *ast.Continue:
+		c.jumps["continue"] = e.Jump.(*ast.If).Else.(*ast.LoopJump)
+	}
+	return c
+}
+
+func (c *jumpCollector) VisitBottomup(ast.Expr) {}
+
+func TestDesugarLoopJump(t *testing.T) {
+	// Inner loop is desugared before outer one. So the inner loop is numbered 1
+	s := locerr.NewDummySource("for i = 0 to 3 do (if i = 2 then break else ()); for j = 0 to i do continue done; println_int i done")
+	parsed, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &jumpCollector{map[string]*ast.LoopJump{}}
+	ast.Visit(c, parsed.Root)
+	jumps := c.jumps
+
+	brk, ok := jumps["break"]
+	if !ok {
+		t.Fatal("'break' was not found")
+	}
+	if ref, ok := brk.Args[0].(*ast.VarRef); !ok || ref.Symbol.DisplayName != "$i2" {
+		t.Fatal("'break' should be bound to outer loop but got", brk.Args[0].Name())
+	}
+	if b, ok := brk.Args[1].(*ast.Bool); !ok || !b.Value {
+		t.Fatal("'break' should stop loop but got", brk.Args[1].Name())
+	}
+	cont, ok := jumps["continue"]
+	if !ok {
+		t.Fatal("'continue' was not found")
+	}
+	if ref, ok := cont.Args[0].(*ast.Add).Left.(*ast.VarRef); !ok || ref.Symbol.DisplayName != "$i1" {
+		t.Fatal("'continue' should be bound to inner loop but got", cont.Args[0].Name())
+	}
+}
+
+func TestLoopJumpError(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+		msg  string
+	}{
+		{
+			what: "break outside loop",
+			code: "let x = 1 in break",
+			msg:  "'break' must be in body of 'for' loop",
+		},
+		{
+			what: "continue outside loop",
+			code: "continue; ()",
+			msg:  "'continue' must be in body of 'for' loop",
+		},
+		{
+			what: "continue in function",
+			code: "for i = 0 to 3 do let f = fun x -> continue in f () done",
+			msg:  "'continue' cannot jump out of function defined in body of 'for' loop",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			_, err := Parse(locerr.NewDummySource(tc.code))
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.msg) {
+				t.Fatalf("Error message '%s' does not contain '%s'", err.Error(), tc.msg)
+			}
+		})
+	}
+}
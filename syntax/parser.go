@@ -2,6 +2,7 @@
 package syntax
 
 import (
+	"fmt"
 	"github.com/rhysd/gocaml/ast"
 	"github.com/rhysd/gocaml/token"
 	"github.com/rhysd/locerr"
@@ -12,6 +13,8 @@ type pseudoLexer struct {
 	tokens    chan token.Token
 	err       *locerr.Error
 	result    *ast.AST
+	// Number of desugared 'for' loops to generate unique names
+	loops int
 }
 
 func (l *pseudoLexer) Lex(lval *yySymType) int {
@@ -58,6 +61,49 @@ func (l *pseudoLexer) Error(msg string) {
 	}
 }
 
+// errorIn reports an error at the node. It is used for errors detected while building AST.
+func (l *pseudoLexer) errorIn(node ast.Expr, msg string) {
+	if l.err == nil {
+		l.err = locerr.ErrorIn(node.Pos(), node.End(), msg)
+	} else {
+		l.err = l.err.NoteAt(node.Pos(), msg)
+	}
+}
+
+func (l *pseudoLexer) setResult(tree *ast.AST) {
+	if j := findLoopJump(tree.Root); j != nil && l.err == nil {
+		l.errorIn(j, fmt.Sprintf("'%s' must be in body of 'for' loop", jumpName(j)))
+	}
+	l.result = tree
+}
+
+// entryPoint desugars entry point function of program into the program which calls it with
+// program arguments.
+//   let main args = body
+//
+//   let rec main (args : string array) : unit = body in main argv
+func (l *pseudoLexer) entryPoint(let, name *token.Token, params []ast.Param, ret, body ast.Expr) ast.Expr {
+	ident := &ast.VarRef{name, ast.NewSymbol(name.Value())}
+	if name.Value() != "main" {
+		l.errorIn(ident, fmt.Sprintf("Only 'main' can be defined as entry point of program but got '%s'", name.Value()))
+	}
+	if len(params) != 1 {
+		l.errorIn(ident, fmt.Sprintf("Entry point 'main' must receive only program arguments as 'string array' but it has %d parameters", len(params)))
+	}
+
+	if params[0].Type == nil {
+		str := &ast.CtorType{nil, name, nil, ast.NewSymbol("string")}
+		params[0].Type = &ast.CtorType{nil, name, []ast.Expr{str}, ast.NewSymbol("array")}
+	}
+	if ret == nil {
+		ret = &ast.CtorType{nil, name, nil, ast.NewSymbol("unit")}
+	}
+
+	def := &ast.FuncDef{ident.Symbol, params[:1], body, ret, nil}
+	call := &ast.Apply{&ast.VarRef{name, ast.NewSymbol(name.Value())}, []ast.Expr{&ast.VarRef{name, ast.NewSymbol("argv")}}}
+	return &ast.LetRec{let, def, call}
+}
+
 func Parse(src *locerr.Source) (*ast.AST, error) {
 	var lexErr *locerr.Error
 	l := NewLexer(src)
@@ -2,6 +2,7 @@ package syntax
 
 import (
 	"fmt"
+	"github.com/rhysd/gocaml/ast"
 	"github.com/rhysd/gocaml/token"
 	"github.com/rhysd/locerr"
 	"io/ioutil"
@@ -60,6 +61,11 @@ func TestErrorHeuristic(t *testing.T) {
 			codes: []string{"let t: (int, bool) = 42 in ()"},
 			msg:   "(t1, t2, ...) is not a type",
 		},
+		{
+			what:  "recursive non-function value",
+			codes: []string{"let rec x = x + 1 in ()", "let rec x = 42 in x", "let rec f = (fun x -> x) 1 in ()"},
+			msg:   "'let rec' can only define functions",
+		},
 	}
 
 	for _, tc := range cases {
@@ -211,3 +217,81 @@ func TestLexFailed(t *testing.T) {
 		t.Fatal("Unexpected error message:", msg)
 	}
 }
+
+func TestEntryPoint(t *testing.T) {
+	src := locerr.NewDummySource("let main args = println_str args.(0)")
+	tree, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, ok := tree.Root.(*ast.LetRec)
+	if !ok {
+		t.Fatal("Entry point should be desugared into 'let rec' but got", tree.Root.Name())
+	}
+	if def.Func.Symbol.DisplayName != "main" {
+		t.Fatal("Unexpected function name:", def.Func.Symbol.DisplayName)
+	}
+	if ty := def.Func.Params[0].Type; ty == nil || ty.Name() != "CtorType (array (1))" {
+		t.Fatal("Parameter should be string array but got", ty)
+	}
+	call, ok := def.Body.(*ast.Apply)
+	if !ok {
+		t.Fatal("Entry point should be called but got", def.Body.Name())
+	}
+	if arg := call.Args[0].(*ast.VarRef).Symbol.DisplayName; arg != "argv" {
+		t.Fatal("Entry point should be called with argv but got", arg)
+	}
+}
+
+func TestLetRecLambda(t *testing.T) {
+	for _, code := range []string{
+		"let rec f = fun x -> f x in ()",
+		"let rec f = (fun x y : int -> f x y) in ()",
+	} {
+		tree, err := Parse(locerr.NewDummySource(code))
+		if err != nil {
+			t.Fatal(code, err)
+		}
+		def, ok := tree.Root.(*ast.LetRec)
+		if !ok {
+			t.Fatal("'let rec' with lambda should be desugared into function definition but got", tree.Root.Name())
+		}
+		if def.Func.Symbol.DisplayName != "f" {
+			t.Fatal("Unexpected function name:", def.Func.Symbol.DisplayName)
+		}
+		if _, ok := def.Func.Body.(*ast.Apply); !ok {
+			t.Fatal("Body of lambda should be body of the function but got", def.Func.Body.Name())
+		}
+	}
+}
+
+func TestInvalidEntryPoint(t *testing.T) {
+	cases := []struct {
+		what string
+		code string
+		msg  string
+	}{
+		{
+			what: "not main",
+			code: "let foo args = ()",
+			msg:  "Only 'main' can be defined as entry point of program but got 'foo'",
+		},
+		{
+			what: "too many parameters",
+			code: "let main args env = ()",
+			msg:  "Entry point 'main' must receive only program arguments as 'string array' but it has 2 parameters",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.what, func(t *testing.T) {
+			_, err := Parse(locerr.NewDummySource(tc.code))
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.msg) {
+				t.Fatal("Unexpected error message:", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+type point = int * float [@@deriving show, eq];
+type shape = [`Circle of point * int | `Rect of point * point | `Empty] [@@deriving show];
+type names = string array [@@deriving eq];
+println_str (show_shape (`Circle ((0, 0.0), 1)))
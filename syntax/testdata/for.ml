@@ -0,0 +1,9 @@
+for i = 0 to 9 do
+  println_int i
+done;
+for i = 10 downto 1 do
+  if i % 2 = 0 then continue else
+  if i < 3 then break else
+  println_int i
+done;
+for i = 0 to 3 do for j = i downto 0 do println_int (i * j) done done
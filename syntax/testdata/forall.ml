@@ -0,0 +1,5 @@
+let rec pair (f : forall 'a. 'a -> 'a) = (f 1, f true) in
+let rec apply2 (g : forall 'a 'b. 'a -> 'b -> ('a * 'b)) (x : int) = g x x in
+let h = fun (k : forall 'a. 'a option -> bool) -> k None in
+let rec id x = x in
+pair id
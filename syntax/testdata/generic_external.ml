@@ -0,0 +1,4 @@
+external print: 'a. 'a -> unit = "print";
+external pair: 'a 'b. 'a -> 'b -> 'a * 'b = "pair";
+external id: forall 'a. 'a -> 'a = "id";
+print 42
@@ -0,0 +1,3 @@
+let rec f x = x + ?todo in
+let a = ?elem, ?snd in
+f ?arg; ?unit
@@ -0,0 +1,2 @@
+type t = int [@deriving show];
+()
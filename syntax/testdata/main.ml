@@ -0,0 +1,4 @@
+type point = int * int;
+let main (args : string array) : unit =
+  let p: point = (1, 2) in
+  println_str args.(0)
@@ -0,0 +1,6 @@
+let s = String.uppercase "hello" in
+let words = String.split "a b c" " " in
+println_str (String.join words ", ");
+println_int (String.length s + String.index s "L");
+let String = [| 1 |] in
+String.(0)
@@ -0,0 +1,4 @@
+let rec f : 'a. 'a -> int = fun x -> f 1 + f true in
+let rec g : 'a 'b. 'a -> 'b -> 'a = fun x (y : int) -> x in
+let rec h : 'a. 'a option -> bool = fun o : bool -> h None in
+f (g 1 2)
@@ -0,0 +1,6 @@
+let r: (int, string) result = Ok 42 in
+let e = Error "foo" in
+match r with
+  | Ok i -> print_int i
+  | Error msg -> print_str msg;
+match e with Error (m) -> () | Ok (x) -> ()
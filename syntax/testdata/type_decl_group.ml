@@ -0,0 +1,4 @@
+type tree = int * forest option
+and forest = int array;
+type foo = int and bar = foo * foo and piyo = bar option [@@deriving show];
+()
@@ -0,0 +1,14 @@
+let a = `Foo in
+let b = `Bar 42 in
+let c = `Piyo (1, true) in
+let rec f x = x in
+f `Foo;
+f `Foo 1;
+match b with
+| `Foo -> 0
+| `Bar i -> i + 1
+| `Baz (j) -> j;
+match c with `Piyo t -> () | _ -> ();
+match a with
+| `Foo -> match b with `Bar x -> x | other -> 0
+| x -> 1
@@ -62,6 +62,24 @@ const (
 	LBRACKET
 	RBRACKET
 	EXTERNAL
+	VARIANT_TAG
+	FORALL
+	TYPE_VAR
+	HOLE
+	OF
+	LBRACKET_AT_AT
+	OK
+	ERROR
+	AND
+	FOR
+	TO
+	DOWNTO
+	DO
+	DONE
+	BREAK
+	CONTINUE
+	ASSERT
+	MODULE_IDENT
 	EOF
 )
 
@@ -120,6 +138,24 @@ var tokenTable = [...]string{
 	LBRACKET:       "[",
 	RBRACKET:       "]",
 	EXTERNAL:       "external",
+	VARIANT_TAG:    "VARIANT_TAG",
+	FORALL:         "forall",
+	TYPE_VAR:       "TYPE_VAR",
+	HOLE:           "HOLE",
+	OF:             "of",
+	LBRACKET_AT_AT: "[@@",
+	OK:             "Ok",
+	ERROR:          "Error",
+	AND:            "and",
+	FOR:            "for",
+	TO:             "to",
+	DOWNTO:         "downto",
+	DO:             "do",
+	DONE:           "done",
+	BREAK:          "break",
+	CONTINUE:       "continue",
+	ASSERT:         "assert",
+	MODULE_IDENT:   "MODULE_IDENT",
 }
 
 // Token instance for GoCaml.
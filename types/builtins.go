@@ -1,5 +1,9 @@
 package types
 
+import (
+	"strings"
+)
+
 // TODO:
 // 'builtin' does not mean 'external' always. For example, we might introduce polymorphic function
 // `print: 'a -> ()` in the future as built-in function. We need to separate external symbols and
@@ -22,6 +26,13 @@ func builtinPopulatedTable() map[string]*External {
 		"int_to_float":               &External{&Fun{FloatType, []Type{IntType}}, "int_to_float"},
 		"str_length":                 &External{&Fun{IntType, []Type{StringType}}, "str_length"},
 		"__str_equal$builtin":        &External{&Fun{BoolType, []Type{StringType, StringType}}, "__str_equal"},
+		"__assert_fail$builtin":      &External{&Fun{UnitType, []Type{StringType}}, "__gocaml_assert_fail"},
+		"__bounds_fail$builtin":      &External{&Fun{UnitType, []Type{StringType, IntType, IntType}}, "__gocaml_bounds_fail"},
+		"__overflow_fail$builtin":    &External{&Fun{UnitType, []Type{StringType}}, "__gocaml_overflow_fail"},
+		"__stack_overflow$builtin":   &External{&Fun{UnitType, []Type{StringType}}, "__gocaml_stack_overflow"},
+		"__undefined_fail$builtin":   &External{&Fun{UnitType, []Type{StringType, StringType}}, "__gocaml_undefined_fail"},
+		"__exit$builtin":             &External{&Fun{UnitType, []Type{IntType}}, "__gocaml_exit"},
+		"__str_escape$builtin":       &External{&Fun{StringType, []Type{StringType}}, "__gocaml_str_escape"},
 		"str_concat":                 &External{&Fun{StringType, []Type{StringType, StringType}}, "str_concat"},
 		"str_sub":                    &External{&Fun{StringType, []Type{StringType, IntType, IntType}}, "str_sub"},
 		"int_to_str":                 &External{&Fun{StringType, []Type{IntType}}, "int_to_str"},
@@ -63,11 +74,84 @@ func builtinPopulatedTable() map[string]*External {
 		"modf":                       &External{&Fun{&Tuple{[]Type{FloatType, FloatType}}, []Type{FloatType}}, "gocaml_modf"},
 		"frexp":                      &External{&Fun{&Tuple{[]Type{FloatType, IntType}}, []Type{FloatType}}, "gocaml_frexp"},
 		"ldexp":                      &External{&Fun{FloatType, []Type{FloatType, IntType}}, "gocaml_ldexp"},
+		"abs_float":                  &External{&Fun{FloatType, []Type{FloatType}}, "fabs"},
+		"fmin":                       &External{&Fun{FloatType, []Type{FloatType, FloatType}}, "fmin"},
+		"fmax":                       &External{&Fun{FloatType, []Type{FloatType, FloatType}}, "fmax"},
+		"min":                        &External{&Fun{IntType, []Type{IntType, IntType}}, "gocaml_min"},
+		"max":                        &External{&Fun{IntType, []Type{IntType, IntType}}, "gocaml_max"},
 		"time_now":                   &External{&Fun{IntType, []Type{UnitType}}, "time_now"},
+		"clock":                      &External{&Fun{FloatType, []Type{UnitType}}, "gocaml_clock"},
+		"monotonic_ns":               &External{&Fun{IntType, []Type{UnitType}}, "gocaml_monotonic_ns"},
+		"random_int":                 &External{&Fun{IntType, []Type{IntType}}, "gocaml_random_int"},
+		"random_float":               &External{&Fun{FloatType, []Type{UnitType}}, "gocaml_random_float"},
+		"random_seed":                &External{&Fun{UnitType, []Type{IntType}}, "gocaml_random_seed"},
 		"read_file":                  &External{&Fun{&Option{StringType}, []Type{StringType}}, "read_file"},
 		"write_file":                 &External{&Fun{BoolType, []Type{StringType, StringType}}, "write_file"},
+		"open_in":                    &External{&Fun{IntType, []Type{StringType}}, "gocaml_open_in"},
+		"open_out":                   &External{&Fun{IntType, []Type{StringType}}, "gocaml_open_out"},
+		"open_append":                &External{&Fun{IntType, []Type{StringType}}, "gocaml_open_append"},
+		"input_line":                 &External{&Fun{&Option{StringType}, []Type{IntType}}, "gocaml_input_line"},
+		"input_all":                  &External{&Fun{StringType, []Type{IntType}}, "gocaml_input_all"},
+		"output_string":              &External{&Fun{BoolType, []Type{IntType, StringType}}, "gocaml_output_string"},
+		"close_file":                 &External{&Fun{BoolType, []Type{IntType}}, "gocaml_close_file"},
+		"read_line":                  &External{&Fun{&Option{StringType}, []Type{UnitType}}, "gocaml_read_line"},
+		"getenv":                     &External{&Fun{&Option{StringType}, []Type{StringType}}, "gocaml_getenv"},
 		"do_garbage_collection":      &External{&Fun{UnitType, []Type{UnitType}}, "do_garbage_collection"},
 		"enable_garbage_collection":  &External{&Fun{UnitType, []Type{UnitType}}, "enable_garbage_collection"},
 		"disable_garbage_collection": &External{&Fun{UnitType, []Type{UnitType}}, "disable_garbage_collection"},
+		// String module
+		"String.length":    &External{&Fun{IntType, []Type{StringType}}, "str_length"},
+		"String.sub":       &External{&Fun{StringType, []Type{StringType, IntType, IntType}}, "str_sub"},
+		"String.index":     &External{&Fun{IntType, []Type{StringType, StringType}}, "str_index"},
+		"String.split":     &External{&Fun{&Array{StringType}, []Type{StringType, StringType}}, "str_split"},
+		"String.join":      &External{&Fun{StringType, []Type{&Array{StringType}, StringType}}, "str_join"},
+		"String.uppercase": &External{&Fun{StringType, []Type{StringType}}, "str_uppercase"},
+		"String.lowercase": &External{&Fun{StringType, []Type{StringType}}, "str_lowercase"},
+		"String.of_int":    &External{&Fun{StringType, []Type{IntType}}, "int_to_str"},
+		"String.to_int":    &External{&Fun{IntType, []Type{StringType}}, "str_to_int"},
+		// Buffer module
+		"Buffer.create":     &External{&Fun{BufferType, []Type{UnitType}}, "gocaml_buffer_create"},
+		"Buffer.add_string": &External{&Fun{UnitType, []Type{BufferType, StringType}}, "gocaml_buffer_add_string"},
+		"Buffer.add_char":   &External{&Fun{UnitType, []Type{BufferType, IntType}}, "gocaml_buffer_add_char"},
+		"Buffer.contents":   &External{&Fun{StringType, []Type{BufferType}}, "gocaml_buffer_contents"},
+		"Buffer.length":     &External{&Fun{IntType, []Type{BufferType}}, "gocaml_buffer_length"},
+		// Re module
+		"Re.match":   &External{&Fun{BoolType, []Type{StringType, StringType}}, "gocaml_re_match"},
+		"Re.find":    &External{&Fun{&Option{StringType}, []Type{StringType, StringType}}, "gocaml_re_find"},
+		"Re.replace": &External{&Fun{StringType, []Type{StringType, StringType, StringType}}, "gocaml_re_replace"},
+		// Json module
+		"Json.null":      &External{&Fun{JsonType, []Type{UnitType}}, "gocaml_json_null"},
+		"Json.of_bool":   &External{&Fun{JsonType, []Type{BoolType}}, "gocaml_json_of_bool"},
+		"Json.of_int":    &External{&Fun{JsonType, []Type{IntType}}, "gocaml_json_of_int"},
+		"Json.of_float":  &External{&Fun{JsonType, []Type{FloatType}}, "gocaml_json_of_float"},
+		"Json.of_string": &External{&Fun{JsonType, []Type{StringType}}, "gocaml_json_of_string"},
+		"Json.of_array":  &External{&Fun{JsonType, []Type{&Array{JsonType}}}, "gocaml_json_of_array"},
+		"Json.of_object": &External{&Fun{JsonType, []Type{&Array{&Tuple{[]Type{StringType, JsonType}}}}}, "gocaml_json_of_object"},
+		"Json.kind":      &External{&Fun{StringType, []Type{JsonType}}, "gocaml_json_kind"},
+		"Json.to_bool":   &External{&Fun{BoolType, []Type{JsonType}}, "gocaml_json_to_bool"},
+		"Json.to_int":    &External{&Fun{IntType, []Type{JsonType}}, "gocaml_json_to_int"},
+		"Json.to_float":  &External{&Fun{FloatType, []Type{JsonType}}, "gocaml_json_to_float"},
+		"Json.to_string": &External{&Fun{StringType, []Type{JsonType}}, "gocaml_json_to_string"},
+		"Json.length":    &External{&Fun{IntType, []Type{JsonType}}, "gocaml_json_length"},
+		"Json.get":       &External{&Fun{&Option{JsonType}, []Type{JsonType, IntType}}, "gocaml_json_get"},
+		"Json.key":       &External{&Fun{&Option{StringType}, []Type{JsonType, IntType}}, "gocaml_json_key"},
+		"Json.member":    &External{&Fun{&Option{JsonType}, []Type{JsonType, StringType}}, "gocaml_json_member"},
+		"Json.encode":    &External{&Fun{StringType, []Type{JsonType}}, "gocaml_json_encode"},
+		"Json.decode":    &External{&Fun{&Option{JsonType}, []Type{StringType}}, "gocaml_json_decode"},
+	}
+}
+
+var builtinNames = builtinPopulatedTable()
+
+// IsBuiltin returns whether the external symbol is a builtin provided by runtime. Symbols
+// monomorphized from builtin symbols are also builtins.
+func IsBuiltin(name string) bool {
+	if _, ok := builtinNames[name]; ok {
+		return true
+	}
+	if i := strings.IndexByte(name, '$'); i >= 0 {
+		_, ok := builtinNames[name[:i]]
+		return ok
 	}
+	return false
 }
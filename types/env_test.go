@@ -58,3 +58,18 @@ func TestEnvHasBuiltins(t *testing.T) {
 		t.Fatal("'print_int' is not found though it is builtin:", env.Externals)
 	}
 }
+
+func TestIsBuiltin(t *testing.T) {
+	for name, want := range map[string]bool{
+		"print_int":           true,
+		"__str_equal$builtin": true,
+		"argv":                true,
+		"print_int$int":       true,
+		"c_apply":             false,
+		"f$int":               false,
+	} {
+		if have := IsBuiltin(name); have != want {
+			t.Errorf("Wanted %v for '%s' but got %v", want, name, have)
+		}
+	}
+}
@@ -3,8 +3,15 @@ package types
 // Equals returns given two types are equivalent or not. Note that type variable's ID and level are
 // not seen, but free or bound (.IsGeneric() or not) is seen.
 func Equals(l, r Type) bool {
+	return equals(l, r, nil)
+}
+
+// Map from IDs of type variables bound by left Forall type to ones bound by right Forall type
+type boundVarPairs map[VarID]VarID
+
+func equals(l, r Type, bounds boundVarPairs) bool {
 	switch l := l.(type) {
-	case *Unit, *Int, *Float, *Bool, *String:
+	case *Unit, *Int, *Float, *Bool, *String, *Buffer, *Json:
 		return l == r
 	case *Tuple:
 		r, ok := r.(*Tuple)
@@ -12,7 +19,7 @@ func Equals(l, r Type) bool {
 			return false
 		}
 		for i, e := range l.Elems {
-			if !Equals(e, r.Elems[i]) {
+			if !equals(e, r.Elems[i], bounds) {
 				return false
 			}
 		}
@@ -22,14 +29,14 @@ func Equals(l, r Type) bool {
 		if !ok {
 			return false
 		}
-		return Equals(l.Elem, r.Elem)
+		return equals(l.Elem, r.Elem, bounds)
 	case *Fun:
 		r, ok := r.(*Fun)
-		if !ok || !Equals(l.Ret, r.Ret) || len(l.Params) != len(r.Params) {
+		if !ok || !equals(l.Ret, r.Ret, bounds) || len(l.Params) != len(r.Params) {
 			return false
 		}
 		for i, p := range l.Params {
-			if !Equals(p, r.Params[i]) {
+			if !equals(p, r.Params[i], bounds) {
 				return false
 			}
 		}
@@ -42,6 +49,9 @@ func Equals(l, r Type) bool {
 		if l.Ref == nil && r.Ref == nil {
 			lgen, rgen := l.IsGeneric(), r.IsGeneric()
 			if lgen && rgen {
+				if id, ok := bounds[l.ID]; ok {
+					return id == r.ID
+				}
 				return l.ID == r.ID
 			}
 			return !lgen && !rgen
@@ -49,13 +59,69 @@ func Equals(l, r Type) bool {
 		if l.Ref == nil || r.Ref == nil {
 			return false
 		}
-		return Equals(l.Ref, r.Ref)
+		return equals(l.Ref, r.Ref, bounds)
 	case *Option:
 		r, ok := r.(*Option)
 		if !ok {
 			return false
 		}
-		return Equals(l.Elem, r.Elem)
+		return equals(l.Elem, r.Elem, bounds)
+	case *Result:
+		r, ok := r.(*Result)
+		if !ok {
+			return false
+		}
+		return equals(l.Ok, r.Ok, bounds) && equals(l.Error, r.Error, bounds)
+	case *Table:
+		r, ok := r.(*Table)
+		if !ok {
+			return false
+		}
+		return equals(l.Key, r.Key, bounds) && equals(l.Value, r.Value, bounds)
+	case *Variant:
+		r, ok := r.(*Variant)
+		if !ok {
+			return false
+		}
+		ltags, lrow := l.Flatten()
+		rtags, rrow := r.Flatten()
+		if len(ltags) != len(rtags) {
+			return false
+		}
+		for i, lt := range ltags {
+			rt := rtags[i]
+			if lt.Name != rt.Name {
+				return false
+			}
+			if lt.Payload == nil || rt.Payload == nil {
+				if lt.Payload != rt.Payload {
+					return false
+				}
+				continue
+			}
+			if !equals(lt.Payload, rt.Payload, bounds) {
+				return false
+			}
+		}
+		if lrow == nil || rrow == nil {
+			return lrow == nil && rrow == nil
+		}
+		return equals(lrow, rrow, bounds)
+	case *Forall:
+		r, ok := r.(*Forall)
+		if !ok || len(l.Vars) != len(r.Vars) {
+			return false
+		}
+		// Bound type variables are ordered by their first occurrences in body. So they can be
+		// compared by their positions.
+		pairs := make(boundVarPairs, len(bounds)+len(l.Vars))
+		for id, bound := range bounds {
+			pairs[id] = bound
+		}
+		for i, v := range l.Vars {
+			pairs[v.ID] = r.Vars[i].ID
+		}
+		return equals(l.Body, r.Body, pairs)
 	default:
 		panic("Unreachable")
 	}
@@ -14,8 +14,16 @@ func TestEquals(t *testing.T) {
 		gen,
 		&Array{IntType},
 		&Option{free},
+		&Result{free, IntType},
+		&Result{IntType, free},
+		&Table{StringType, free},
+		&Table{IntType, free},
 		NewVar(&Tuple{[]Type{UnitType, NewVar(free, 0), NewVar(gen, 0)}}, 0),
 		&Fun{free, []Type{&Array{gen}, StringType, BoolType}},
+		&Variant{[]*VariantTag{{"A", IntType}, {"B", nil}}, nil},
+		&Variant{[]*VariantTag{{"A", IntType}, {"B", nil}}, free},
+		&Forall{[]*Var{gen}, &Fun{gen, []Type{gen}}},
+		&Forall{[]*Var{gen}, &Fun{gen, []Type{IntType}}},
 	}
 
 	for i, l := range cases {
@@ -33,3 +41,21 @@ func TestEquals(t *testing.T) {
 		}
 	}
 }
+
+func TestForallEqualsRenamingVars(t *testing.T) {
+	a, b := NewGeneric(), NewGeneric()
+	c, d := NewGeneric(), NewGeneric()
+	l := &Forall{[]*Var{a, b}, &Fun{a, []Type{a, b}}}
+	r := &Forall{[]*Var{c, d}, &Fun{c, []Type{c, d}}}
+	if !Equals(l, r) {
+		t.Errorf("`%s` == `%s` is false", Debug(l), Debug(r))
+	}
+	r = &Forall{[]*Var{c, d}, &Fun{d, []Type{c, d}}}
+	if Equals(l, r) {
+		t.Errorf("`%s` != `%s` is false", Debug(l), Debug(r))
+	}
+	r = &Forall{[]*Var{c}, &Fun{c, []Type{c, b}}}
+	if Equals(l, r) {
+		t.Errorf("`%s` != `%s` is false", Debug(l), Debug(r))
+	}
+}
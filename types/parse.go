@@ -0,0 +1,305 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Note:
+// Parse parses the string representation of type returned from String() method. Type variables with
+// the same name in the string are the same type variable. Generic type variables such as 'a are
+// parsed as new generic type variables and weak ones such as '_a as new weak type variables.
+// Unresolved type variables such as ?(42) are parsed as new type variables. So their IDs are not
+// preserved.
+//   int -> int -> bool       => &Fun{BoolType, [IntType, IntType]}
+//   (int * 'a) array option  => &Option{&Array{&Tuple{[IntType, 'a]}}}
+
+type typeParser struct {
+	src  string
+	pos  int
+	vars map[string]*Var
+}
+
+func (p *typeParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Cannot parse type '%s' at offset %d: %s", p.src, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *typeParser) skipSpaces() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *typeParser) eat(s string) bool {
+	p.skipSpaces()
+	if !strings.HasPrefix(p.src[p.pos:], s) {
+		return false
+	}
+	p.pos += len(s)
+	return true
+}
+
+func (p *typeParser) expect(s string) error {
+	if !p.eat(s) {
+		return p.errorf("'%s' is expected", s)
+	}
+	return nil
+}
+
+func isNameChar(r byte) bool {
+	return r == '_' || r == '\'' || unicode.IsLetter(rune(r)) || unicode.IsDigit(rune(r))
+}
+
+// word reads a name of type, type variable or variant tag without consuming it
+func (p *typeParser) word() string {
+	p.skipSpaces()
+	end := p.pos
+	for end < len(p.src) && isNameChar(p.src[end]) {
+		end++
+	}
+	return p.src[p.pos:end]
+}
+
+func (p *typeParser) eatWord(w string) bool {
+	if p.word() != w {
+		return false
+	}
+	p.pos += len(w)
+	return true
+}
+
+func (p *typeParser) typeVar(name string, weak bool) *Var {
+	if v, ok := p.vars[name]; ok {
+		return v
+	}
+	var v *Var
+	if weak {
+		v = NewVar(nil, 0)
+		v.Weak = true
+	} else {
+		v = NewGeneric()
+	}
+	p.vars[name] = v
+	return v
+}
+
+func (p *typeParser) parseType() (Type, error) {
+	if p.eatWord("forall") {
+		return p.parseForall()
+	}
+	t, err := p.parseTuple()
+	if err != nil {
+		return nil, err
+	}
+	if !p.eat("->") {
+		return t, nil
+	}
+	ts := []Type{t}
+	for {
+		t, err := p.parseTuple()
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+		if !p.eat("->") {
+			break
+		}
+	}
+	return &Fun{ts[len(ts)-1], ts[:len(ts)-1]}, nil
+}
+
+func (p *typeParser) parseForall() (Type, error) {
+	vars := []*Var{}
+	for {
+		w := p.word()
+		if !strings.HasPrefix(w, "'") {
+			break
+		}
+		p.pos += len(w)
+		vars = append(vars, p.typeVar(w, false))
+	}
+	if len(vars) == 0 {
+		return nil, p.errorf("Type variables are expected after 'forall'")
+	}
+	if err := p.expect("."); err != nil {
+		return nil, err
+	}
+	body, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	return &Forall{vars, body}, nil
+}
+
+func (p *typeParser) parseTuple() (Type, error) {
+	t, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	if !p.eat("*") {
+		return t, nil
+	}
+	elems := []Type{t}
+	for {
+		t, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, t)
+		if !p.eat("*") {
+			break
+		}
+	}
+	return &Tuple{elems}, nil
+}
+
+func (p *typeParser) parsePostfix() (Type, error) {
+	t, err := p.parseAtom()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.eatWord("array"):
+			t = &Array{t}
+		case p.eatWord("option"):
+			t = &Option{t}
+		default:
+			return t, nil
+		}
+	}
+}
+
+func (p *typeParser) parseAtom() (Type, error) {
+	if p.eat("(") {
+		t, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		if p.eat(",") {
+			e, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			switch {
+			case p.eatWord("result"):
+				return &Result{t, e}, nil
+			case p.eatWord("table"):
+				return &Table{t, e}, nil
+			default:
+				return nil, p.errorf("'result' or 'table' is expected after type arguments")
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if p.eat("[") {
+		return p.parseVariant()
+	}
+
+	if p.eat("?(") {
+		start := p.pos
+		for p.pos < len(p.src) && p.src[p.pos] != ')' {
+			p.pos++
+		}
+		if _, err := strconv.ParseUint(p.src[start:p.pos], 10, 64); err != nil {
+			return nil, p.errorf("ID of type variable is expected")
+		}
+		id := p.src[start:p.pos]
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if v, ok := p.vars["?"+id]; ok {
+			return v, nil
+		}
+		v := NewVar(nil, 0)
+		p.vars["?"+id] = v
+		return v, nil
+	}
+
+	w := p.word()
+	p.pos += len(w)
+	switch w {
+	case "unit":
+		return UnitType, nil
+	case "bool":
+		return BoolType, nil
+	case "int":
+		return IntType, nil
+	case "float":
+		return FloatType, nil
+	case "string":
+		return StringType, nil
+	case "buffer":
+		return BufferType, nil
+	case "json":
+		return JsonType, nil
+	}
+	if strings.HasPrefix(w, "'_") && len(w) > 2 {
+		return p.typeVar(w, true), nil
+	}
+	if strings.HasPrefix(w, "'") && len(w) > 1 {
+		return p.typeVar(w, false), nil
+	}
+	if w == "" {
+		return nil, p.errorf("Type is expected")
+	}
+	return nil, p.errorf("Unknown type '%s'", w)
+}
+
+func (p *typeParser) parseVariant() (Type, error) {
+	v := &Variant{[]*VariantTag{}, nil}
+	if p.eat(">") {
+		v.Row = NewGeneric()
+	}
+	if p.eat("]") {
+		return v, nil
+	}
+	for {
+		if !p.eat("`") {
+			return nil, p.errorf("Tag of variant is expected")
+		}
+		tag := &VariantTag{p.word(), nil}
+		if tag.Name == "" {
+			return nil, p.errorf("Name of variant tag is expected")
+		}
+		p.pos += len(tag.Name)
+		if p.eatWord("of") {
+			t, err := p.parsePostfix()
+			if err != nil {
+				return nil, err
+			}
+			tag.Payload = t
+		}
+		v.Tags = append(v.Tags, tag)
+		if !p.eat("|") {
+			break
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Parse parses a string representation of type.
+func Parse(s string) (Type, error) {
+	p := &typeParser{s, 0, map[string]*Var{}}
+	t, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos != len(s) {
+		return nil, p.errorf("Unexpected '%s' after type", s[p.pos:])
+	}
+	return t, nil
+}
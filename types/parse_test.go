@@ -0,0 +1,88 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"unit",
+		"bool",
+		"int",
+		"float",
+		"string",
+		"buffer",
+		"json",
+		"int -> bool",
+		"int -> (float -> bool array) -> (string option -> int)",
+		"int * bool * (float * unit)",
+		"(int * int) array",
+		"int array array option",
+		"(int * bool, string option) result",
+		"(int, string) result array",
+		"(string, int * bool) table",
+		"(int, string option) table array",
+		"buffer -> string -> unit",
+		"(string * json) array -> json",
+		"[`A of int | `B | `C of (int * bool)]",
+		"[> `A | `D]",
+		"[]",
+		"'a -> 'a",
+		"('a -> 'b) -> 'a array -> 'b array",
+		"'_a option",
+		"(forall 'a. 'a -> 'a) -> (int * bool)",
+	} {
+		ty, err := Parse(s)
+		if err != nil {
+			t.Errorf("Cannot parse '%s': %s", s, err)
+			continue
+		}
+		if actual := ty.String(); actual != s {
+			t.Errorf("Expected '%s' but got '%s'", s, actual)
+		}
+	}
+}
+
+func TestParseSameTypeVar(t *testing.T) {
+	ty, err := Parse("'a -> 'b -> 'a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := ty.(*Fun)
+	if f.Params[0] != f.Ret {
+		t.Errorf("'a should be the same type variable: %s", Debug(f))
+	}
+	if f.Params[0] == f.Params[1] {
+		t.Errorf("'a and 'b should be different type variables: %s", Debug(f))
+	}
+	if v := f.Ret.(*Var); !v.IsGeneric() {
+		t.Errorf("'a should be generic: %s", Debug(f))
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, tc := range []struct {
+		what     string
+		src      string
+		expected string
+	}{
+		{"unknown type", "int -> foo", "Unknown type 'foo'"},
+		{"empty", "", "Type is expected"},
+		{"unclosed paren", "(int * bool", "')' is expected"},
+		{"trailing token", "int bool", "Unexpected 'bool' after type"},
+		{"missing result", "(int, bool)", "'result' or 'table' is expected after type arguments"},
+		{"missing tag", "[int]", "Tag of variant is expected"},
+		{"forall without var", "forall . int", "Type variables are expected after 'forall'"},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			_, err := Parse(tc.src)
+			if err == nil {
+				t.Fatal("Error did not occur")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected '%s' to be contained in error message '%s'", tc.expected, err.Error())
+			}
+		})
+	}
+}
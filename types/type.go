@@ -3,6 +3,7 @@ package types
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 )
 
 type Type interface {
@@ -44,6 +45,22 @@ func (t *String) String() string {
 	return "string"
 }
 
+// Buffer is a type of mutable byte buffer to build a string efficiently.
+type Buffer struct {
+}
+
+func (t *Buffer) String() string {
+	return "buffer"
+}
+
+// Json is a type of immutable JSON value. Its structure is inspected with functions of 'Json' module.
+type Json struct {
+}
+
+func (t *Json) String() string {
+	return "json"
+}
+
 type Fun struct {
 	Ret    Type
 	Params []Type
@@ -77,17 +94,157 @@ func (t *Option) String() string {
 	return newToString().ofOption(t)
 }
 
+// Result is a type of value which is either 'Ok' or 'Error'.
+//   ('a, 'e) result => &Result{'a, 'e}
+type Result struct {
+	Ok    Type
+	Error Type
+}
+
+func (t *Result) String() string {
+	return newToString().ofResult(t)
+}
+
+// Table is a type of mutable hash table. Keys must be 'int' or 'string'.
+//   (string, int) table => &Table{StringType, IntType}
+type Table struct {
+	Key   Type
+	Value Type
+}
+
+func (t *Table) String() string {
+	return newToString().ofTable(t)
+}
+
+// VariantTag is a tag of polymorphic variant type. When Payload is nil, the tag has no payload.
+type VariantTag struct {
+	Name    string
+	Payload Type
+}
+
+// Variant is a type for polymorphic variants. Its tags are represented as a row. Tags are sorted by
+// their names. When Row is nil, the row is closed and no more tag can be added. Otherwise Row is a type
+// variable representing rest of tags. When the type variable is resolved, it is linked to another
+// *Variant which has rest tags.
+//   [`Foo of int | `Bar] => &Variant{[{"Bar", nil}, {"Foo", IntType}], nil}
+//   [> `Foo]             => &Variant{[{"Foo", nil}], &Var{...}}
+type Variant struct {
+	Tags []*VariantTag
+	Row  Type
+}
+
+func (t *Variant) String() string {
+	return newToString().ofVariant(t)
+}
+
+// Flatten follows links of the row and collects all tags of the variant. Returned tags are sorted by
+// their names. Returned row is nil when the variant is closed, or an unresolved type variable.
+func (t *Variant) Flatten() ([]*VariantTag, *Var) {
+	tags := t.Tags
+	row := t.Row
+	for row != nil {
+		switch r := row.(type) {
+		case *Var:
+			if r.Ref == nil {
+				return tags, r
+			}
+			row = r.Ref
+		case *Variant:
+			tags = mergeTags(tags, r.Tags)
+			row = r.Row
+		default:
+			panic("FATAL: Row of variant type must be variant or type variable: " + row.String())
+		}
+	}
+	return tags, nil
+}
+
+func mergeTags(l, r []*VariantTag) []*VariantTag {
+	if len(r) == 0 {
+		return l
+	}
+	if len(l) == 0 {
+		return r
+	}
+	merged := make([]*VariantTag, 0, len(l)+len(r))
+	i, j := 0, 0
+	for i < len(l) && j < len(r) {
+		if l[i].Name < r[j].Name {
+			merged = append(merged, l[i])
+			i++
+		} else {
+			merged = append(merged, r[j])
+			j++
+		}
+	}
+	merged = append(merged, l[i:]...)
+	return append(merged, r[j:]...)
+}
+
 // INT32_MAX. When this value is specified to variable's level, it means that the variable is
 // 'forall a.a' (generic bound type variable). It's because any other level is smaller than
 // the GenericLevel. Type inference algorithm treats type variables whose level is larger than
 // current level as generic type.
 const GenericLevel = 2147483647
 
+// Forall is a polymorphic type explicitly annotated to a function parameter. Type variables in Vars
+// are generic and bound by this type. Since Forall type is closed, it is never generalized or
+// instantiated as a part of other types. It is instantiated only when the parameter is referred.
+//   let rec f (g : forall 'a. 'a -> 'a) = (g 1, g true) in ...
+type Forall struct {
+	Vars []*Var
+	Body Type
+}
+
+func (t *Forall) String() string {
+	return newToString().ofForall(t)
+}
+
+// Constraint is a constraint put on a type variable by overloaded operators and integer literals.
+// A type variable can only be resolved to a type which satisfies its constraint.
+//   let rec eq a b = a = b in ...
+// The type of 'eq' is 'a -> 'a -> bool where 'a satisfies Eq. So 'eq [| 1 |] [| 1 |]' is an error.
+type Constraint int
+
+const (
+	NoConstraint Constraint = iota
+	// Eq constraint means values of the type can be compared with '=' and '<>'.
+	EqConstraint
+	// Ord constraint means values of the type can be compared with '<', '<=', '>' and '>='.
+	// Ord implies Eq.
+	OrdConstraint
+	// Num constraint means the type is 'int' or 'float'. Integer literals are typed with it.
+	// Num implies Ord.
+	NumConstraint
+	// Hash constraint means the type is 'int' or 'string'. Keys of tables are typed with it.
+	// Hash implies Eq but it is not related to Ord and Num. Only 'int' satisfies both.
+	HashConstraint
+)
+
+func (c Constraint) String() string {
+	switch c {
+	case EqConstraint:
+		return "Eq"
+	case OrdConstraint:
+		return "Ord"
+	case NumConstraint:
+		return "Num"
+	case HashConstraint:
+		return "Hash"
+	default:
+		return ""
+	}
+}
+
 type VarID uint64
 type Var struct {
-	Ref   Type
-	Level int
-	ID    VarID
+	Ref        Type
+	Level      int
+	ID         VarID
+	Constraint Constraint
+	// Weak type variable is a type variable which could not be generalized by value restriction.
+	// It is not generic and fixed at its first use. It is displayed as '_a.
+	Weak bool
 }
 
 func (t *Var) String() string {
@@ -96,9 +253,14 @@ func (t *Var) String() string {
 
 var currentVarID VarID = 0
 
+// newVarID returns a new unique ID for type variable. It is safe to be called from multiple goroutines
+// since type inference may run concurrently.
+func newVarID() VarID {
+	return VarID(atomic.AddUint64((*uint64)(&currentVarID), 1))
+}
+
 func NewVar(t Type, l int) *Var {
-	currentVarID++
-	return &Var{t, l, currentVarID}
+	return &Var{t, l, newVarID(), NoConstraint, false}
 }
 
 func (t *Var) SetGeneric() {
@@ -106,6 +268,7 @@ func (t *Var) SetGeneric() {
 		panic("FATAL: Cannot promote linked type variable to generic variable")
 	}
 	t.Level = GenericLevel
+	t.Weak = false
 }
 
 func (t *Var) IsGeneric() bool {
@@ -113,8 +276,7 @@ func (t *Var) IsGeneric() bool {
 }
 
 func NewGeneric() *Var {
-	currentVarID++
-	return &Var{nil, GenericLevel, currentVarID}
+	return &Var{nil, GenericLevel, newVarID(), NoConstraint, false}
 }
 
 // Make singleton type values because it doesn't have any contextual information
@@ -124,6 +286,8 @@ var (
 	IntType    = &Int{}
 	FloatType  = &Float{}
 	StringType = &String{}
+	BufferType = &Buffer{}
+	JsonType   = &Json{}
 )
 
 type toString struct {
@@ -131,10 +295,35 @@ type toString struct {
 	count    int
 	char     rune
 	debug    bool
+	// Child to be highlighted. Maybe nil.
+	highlight *highlight
+}
+
+// highlight is a child of the parent type to be marked while stringifying types.
+type highlight struct {
+	parent Type
+	index  int
+	found  bool
 }
 
+// Markers surrounding the highlighted child. They never appear in type names.
+const (
+	highlightStart = "\x00"
+	highlightEnd   = "\x01"
+)
+
 func newToString() *toString {
-	return &toString{map[VarID]string{}, 0, 'a', false}
+	return &toString{map[VarID]string{}, 0, 'a', false, nil}
+}
+
+// child marks the string of the index-th child of the parent type when it should be highlighted.
+func (toStr *toString) child(parent Type, index int, s string) string {
+	h := toStr.highlight
+	if h == nil || h.found || h.parent != parent || h.index != index {
+		return s
+	}
+	h.found = true
+	return highlightStart + s + highlightEnd
 }
 
 func (toStr *toString) newGenName() string {
@@ -155,7 +344,7 @@ func (toStr *toString) newGenName() string {
 
 func (toStr *toString) ofType(t Type) string {
 	switch t := t.(type) {
-	case *Unit, *Bool, *Int, *Float, *String:
+	case *Unit, *Bool, *Int, *Float, *String, *Buffer, *Json:
 		// Monomorphic types
 		return t.String()
 	case *Fun:
@@ -166,6 +355,14 @@ func (toStr *toString) ofType(t Type) string {
 		return toStr.ofArray(t)
 	case *Option:
 		return toStr.ofOption(t)
+	case *Result:
+		return toStr.ofResult(t)
+	case *Table:
+		return toStr.ofTable(t)
+	case *Variant:
+		return toStr.ofVariant(t)
+	case *Forall:
+		return toStr.ofForall(t)
 	case *Var:
 		return toStr.ofVar(t)
 	default:
@@ -179,6 +376,8 @@ func (toStr *toString) ofNestedType(t Type) string {
 		return fmt.Sprintf("(%s)", toStr.ofFun(t))
 	case *Tuple:
 		return fmt.Sprintf("(%s)", toStr.ofTuple(t))
+	case *Forall:
+		return fmt.Sprintf("(%s)", toStr.ofForall(t))
 	default:
 		return toStr.ofType(t)
 	}
@@ -186,27 +385,62 @@ func (toStr *toString) ofNestedType(t Type) string {
 
 func (toStr *toString) ofFun(f *Fun) string {
 	ss := make([]string, 0, len(f.Params)+1)
-	for _, p := range f.Params {
-		ss = append(ss, toStr.ofNestedType(p))
+	for i, p := range f.Params {
+		ss = append(ss, toStr.child(f, i, toStr.ofNestedType(p)))
 	}
-	ss = append(ss, toStr.ofNestedType(f.Ret))
+	ss = append(ss, toStr.child(f, len(f.Params), toStr.ofNestedType(f.Ret)))
 	return strings.Join(ss, " -> ")
 }
 
 func (toStr *toString) ofTuple(t *Tuple) string {
 	elems := make([]string, len(t.Elems))
 	for i, e := range t.Elems {
-		elems[i] = toStr.ofNestedType(e)
+		elems[i] = toStr.child(t, i, toStr.ofNestedType(e))
 	}
 	return strings.Join(elems, " * ")
 }
 
 func (toStr *toString) ofArray(a *Array) string {
-	return toStr.ofNestedType(a.Elem) + " array"
+	return toStr.child(a, 0, toStr.ofNestedType(a.Elem)) + " array"
 }
 
 func (toStr *toString) ofOption(o *Option) string {
-	return toStr.ofNestedType(o.Elem) + " option"
+	return toStr.child(o, 0, toStr.ofNestedType(o.Elem)) + " option"
+}
+
+func (toStr *toString) ofResult(r *Result) string {
+	return fmt.Sprintf("(%s, %s) result", toStr.child(r, 0, toStr.ofType(r.Ok)), toStr.child(r, 1, toStr.ofType(r.Error)))
+}
+
+func (toStr *toString) ofTable(t *Table) string {
+	return fmt.Sprintf("(%s, %s) table", toStr.child(t, 0, toStr.ofType(t.Key)), toStr.child(t, 1, toStr.ofType(t.Value)))
+}
+
+func (toStr *toString) ofVariant(v *Variant) string {
+	tags, row := v.Flatten()
+	ss := make([]string, 0, len(tags))
+	for i, t := range tags {
+		if t.Payload == nil {
+			ss = append(ss, toStr.child(v, i, "`"+t.Name))
+		} else {
+			ss = append(ss, toStr.child(v, i, fmt.Sprintf("`%s of %s", t.Name, toStr.ofNestedType(t.Payload))))
+		}
+	}
+	if row == nil {
+		return fmt.Sprintf("[%s]", strings.Join(ss, " | "))
+	}
+	if toStr.debug {
+		ss = append(ss, toStr.ofVar(row))
+	}
+	return fmt.Sprintf("[> %s]", strings.Join(ss, " | "))
+}
+
+func (toStr *toString) ofForall(f *Forall) string {
+	vars := make([]string, 0, len(f.Vars))
+	for _, v := range f.Vars {
+		vars = append(vars, toStr.ofVar(v))
+	}
+	return fmt.Sprintf("forall %s. %s", strings.Join(vars, " "), toStr.ofType(f.Body))
 }
 
 func (toStr *toString) ofVar(v *Var) string {
@@ -216,6 +450,21 @@ func (toStr *toString) ofVar(v *Var) string {
 		}
 		return toStr.ofType(v.Ref)
 	}
+	if v.Constraint == NumConstraint && !toStr.debug {
+		// Type of integer literal not resolved yet is displayed as its default type
+		return "int"
+	}
+	if v.Weak && v.Level != GenericLevel {
+		s, ok := toStr.generics[v.ID]
+		if !ok {
+			s = "'_" + toStr.newGenName()[1:]
+			toStr.generics[v.ID] = s
+		}
+		if toStr.debug {
+			return fmt.Sprintf("%s(%d, %d)", s, v.ID, v.Level)
+		}
+		return s
+	}
 	if v.Level != GenericLevel {
 		if toStr.debug {
 			return fmt.Sprintf("?(%d, %d)", v.ID, v.Level)
@@ -233,8 +482,39 @@ func (toStr *toString) ofVar(v *Var) string {
 	return s
 }
 
+// GenericNames returns names of generic type variables in the given type. The names are the same as
+// ones in the string returned from String() method of the type.
+func GenericNames(t Type) map[VarID]string {
+	tos := newToString()
+	tos.ofType(t)
+	return tos.generics
+}
+
 // Debug represents the given type as string with detailed type variable information.
 func Debug(t Type) string {
-	tos := &toString{map[VarID]string{}, 0, 'a', true}
+	tos := &toString{map[VarID]string{}, 0, 'a', true, nil}
 	return tos.ofType(t)
 }
+
+// Highlight represents the given type as string and returns the byte offsets where the child of the
+// parent type starts and ends in the string. The parent type must be contained in the given type.
+// Index of the child is
+//   function: index of parameter. Return type is next to the last parameter
+//   tuple:    index of element
+//   variant:  index of tag
+//   array, option: 0
+//   result:   0 for 'Ok' type, 1 for 'Error' type
+// When the child is not found, both offsets are -1.
+func Highlight(t, parent Type, index int) (string, int, int) {
+	tos := newToString()
+	tos.highlight = &highlight{parent, index, false}
+	s := tos.ofType(t)
+	start := strings.Index(s, highlightStart)
+	if start < 0 {
+		return s, -1, -1
+	}
+	s = s[:start] + s[start+len(highlightStart):]
+	end := strings.Index(s, highlightEnd)
+	s = s[:end] + s[end+len(highlightEnd):]
+	return s, start, end
+}
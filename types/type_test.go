@@ -39,6 +39,60 @@ func TestFunString(t *testing.T) {
 	}
 }
 
+func TestVariantString(t *testing.T) {
+	closed := &Variant{[]*VariantTag{{"A", IntType}, {"B", nil}, {"C", &Tuple{[]Type{IntType, BoolType}}}}, nil}
+	s := closed.String()
+	if s != "[`A of int | `B | `C of (int * bool)]" {
+		t.Fatal("Closed variant string format is unexpected:", s)
+	}
+	row := NewVar(&Variant{[]*VariantTag{{"D", nil}}, NewVar(nil, 0)}, 0)
+	open := &Variant{[]*VariantTag{{"A", nil}}, row}
+	s = open.String()
+	if s != "[> `A | `D]" {
+		t.Fatal("Open variant string format is unexpected:", s)
+	}
+}
+
+func TestResultString(t *testing.T) {
+	r := &Result{&Tuple{[]Type{IntType, BoolType}}, &Option{StringType}}
+	if s := r.String(); s != "(int * bool, string option) result" {
+		t.Fatal("Result type string format is unexpected:", s)
+	}
+}
+
+func TestTableString(t *testing.T) {
+	tbl := &Table{StringType, &Array{IntType}}
+	if s := tbl.String(); s != "(string, int array) table" {
+		t.Fatal("Table type string format is unexpected:", s)
+	}
+}
+
+func TestForallString(t *testing.T) {
+	a, b := NewGeneric(), NewGeneric()
+	f := &Forall{[]*Var{a, b}, &Fun{a, []Type{a, b}}}
+	s := f.String()
+	if s != "forall 'a 'b. 'a -> 'b -> 'a" {
+		t.Fatal("Forall type string format is unexpected:", s)
+	}
+	s = (&Fun{IntType, []Type{f}}).String()
+	if s != "(forall 'a 'b. 'a -> 'b -> 'a) -> int" {
+		t.Fatal("Forall type in parameter must be parenthesized:", s)
+	}
+}
+
+func TestWeakVarString(t *testing.T) {
+	weak := NewVar(nil, 0)
+	weak.Weak = true
+	s := (&Fun{weak, []Type{NewGeneric(), weak}}).String()
+	if s != "'a -> '_b -> '_b" {
+		t.Fatal("Weak type variable should be displayed with '_ prefix:", s)
+	}
+	weak.SetGeneric()
+	if weak.Weak {
+		t.Fatal("Generic type variable must not be weak")
+	}
+}
+
 func TestVarString(t *testing.T) {
 	var_ := func(t Type) *Var {
 		return NewVar(t, 0)
@@ -119,3 +173,41 @@ func TestDebug(t *testing.T) {
 		t.Fatal("Unexpected debug string:", have, ", want:", want)
 	}
 }
+
+func TestHighlight(t *testing.T) {
+	tuple := &Tuple{[]Type{BoolType, IntType}}
+	fun := &Fun{UnitType, []Type{IntType, tuple}}
+	variant := &Variant{[]*VariantTag{{"A", nil}, {"B", &Option{IntType}}}, nil}
+	result := &Result{IntType, &Array{StringType}}
+
+	cases := []struct {
+		t      Type
+		parent Type
+		index  int
+		marked string
+	}{
+		{fun, fun, 0, "int"},
+		{fun, fun, 1, "(bool * int)"},
+		{fun, fun, 2, "unit"},
+		{fun, tuple, 0, "bool"},
+		{NewVar(fun, 0), tuple, 1, "int"},
+		{variant, variant, 1, "`B of int option"},
+		{result, result, 1, "string array"},
+		{result, result.Error, 0, "string"},
+	}
+
+	for _, tc := range cases {
+		s, start, end := Highlight(tc.t, tc.parent, tc.index)
+		if s != tc.t.String() {
+			t.Errorf("Highlighted string '%s' should be the same as '%s'", s, tc.t.String())
+			continue
+		}
+		if start < 0 || s[start:end] != tc.marked {
+			t.Errorf("'%s' should be marked in '%s' but got range %d-%d", tc.marked, s, start, end)
+		}
+	}
+
+	if _, start, end := Highlight(tuple, fun, 0); start != -1 || end != -1 {
+		t.Error("Range should be -1 when child is not found:", start, end)
+	}
+}
@@ -34,6 +34,26 @@ func Visit(vis Visitor, t Type) {
 		Visit(v, t.Elem)
 	case *Option:
 		Visit(v, t.Elem)
+	case *Result:
+		Visit(v, t.Ok)
+		Visit(v, t.Error)
+	case *Table:
+		Visit(v, t.Key)
+		Visit(v, t.Value)
+	case *Variant:
+		for _, tag := range t.Tags {
+			if tag.Payload != nil {
+				Visit(v, tag.Payload)
+			}
+		}
+		if t.Row != nil {
+			Visit(v, t.Row)
+		}
+	case *Forall:
+		for _, bound := range t.Vars {
+			Visit(v, bound)
+		}
+		Visit(v, t.Body)
 	case *Var:
 		if t.Ref != nil {
 			Visit(v, t.Ref)